@@ -1,44 +1,396 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 
-	"github.com/alecthomas/kong"
+	"github.com/mnixry/envoy-ext-procs/internal/archive"
 	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
 	"github.com/mnixry/envoy-ext-procs/internal/extproc/accesslog"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/kafka"
+	"github.com/mnixry/envoy-ext-procs/internal/leader"
 	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/logsink"
+	"github.com/mnixry/envoy-ext-procs/internal/loki"
+	"github.com/mnixry/envoy-ext-procs/internal/pathtemplate"
+	"github.com/mnixry/envoy-ext-procs/internal/policy"
+	"github.com/mnixry/envoy-ext-procs/internal/selftest"
 	"github.com/mnixry/envoy-ext-procs/internal/server"
 )
 
 func main() {
 	var cli config.AccessLogCLI
-	kong.Parse(&cli,
-		kong.Description("Envoy external processor that emits Caddy-style JSON access logs."),
-		kong.UsageOnError(),
-	)
+	ctx := config.Parse(&cli, "Envoy external processor that emits Caddy-style JSON access logs.")
 
 	log := logger.New(cli.Log)
+	if err := httpclient.Configure(httpclient.NewDefaults(cli.HTTPClient)); err != nil {
+		log.Fatal().Err(err).Msg("invalid outbound HTTP client configuration")
+	}
+
+	if ctx.Command() == "selftest" {
+		var out bytes.Buffer
+		factory := accesslog.NewProcessorFactory(&out, log, accesslog.WithExcludeHeaders(cli.ExcludeHeaders...))
+		if err := selftest.Run(context.Background(), factory, accesslog.SelfTestCases(&out), os.Stdout, log); err != nil {
+			log.Fatal().Err(err).Msg("self-test failed")
+		}
+		return
+	}
 
 	log.Info().
+		Str("format", cli.Format).
+		Str("schema", cli.Schema).
+		Str("encoder", cli.Encoder).
 		Strs("exclude_headers", cli.ExcludeHeaders).
+		Strs("encrypt_fields", cli.EncryptFields).
+		Bool("count_grpc_messages", cli.CountGRPCMessages).
 		Str("log_output", cli.Log.Output).
 		Str("log_format", string(cli.Log.Format)).
+		Str("output", cli.Output.Path).
+		Str("output_compression", cli.Output.Compression).
+		Bool("output_anonymize_ips", cli.Output.AnonymizeIPs).
 		Msg("access log processor configured")
 
-	factory := accesslog.NewProcessorFactory(
-		os.Stdout,
-		log,
-		accesslog.WithExcludeHeaders(cli.ExcludeHeaders...),
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+
+	sinkCfg := logsink.Config{
+		Output:        cli.Output.Path,
+		Compression:   logsink.Compression(cli.Output.Compression),
+		Rotation:      logsink.Rotation(cli.Output.Rotate),
+		LocalTime:     cli.Output.LocalTime,
+		MaxSize:       cli.Output.MaxSize,
+		MaxAge:        cli.Output.MaxAge,
+		MaxBackups:    cli.Output.MaxBackups,
+		FlushInterval: cli.Output.FlushInterval,
+		BatchEntries:  cli.Output.BatchEntries,
+		BatchInterval: cli.Output.BatchInterval,
+		Sync:          logsink.SyncPolicy(cli.Output.Fsync),
+		AnonymizeIPs:  cli.Output.AnonymizeIPs,
+		Anonymizer: logsink.Anonymizer{
+			IPv4Prefix: cli.Anonymize.IPv4Prefix,
+			IPv6Prefix: cli.Anonymize.IPv6Prefix,
+		},
+		Memory: queueMemory(srvCfg.MemoryBudget),
+	}
+	if err := sinkCfg.Anonymizer.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid IP anonymization")
+	}
+
+	var (
+		uploader     *archive.Uploader
+		stopCampaign = func() {}
 	)
+	if cli.Archive.Provider != "" {
+		var err error
+		uploader, err = archive.New(archive.Config{
+			Provider:     archive.Provider(cli.Archive.Provider),
+			Endpoint:     cli.Archive.Endpoint,
+			Region:       cli.Archive.Region,
+			Bucket:       cli.Archive.Bucket,
+			AccessKey:    cli.Archive.AccessKey,
+			SecretKey:    cli.Archive.SecretKey,
+			PathStyle:    cli.Archive.PathStyle,
+			Prefix:       cli.Archive.Prefix,
+			KeepLocal:    cli.Archive.KeepLocal,
+			MaxRetries:   cli.Archive.MaxRetries,
+			RetryBackoff: cli.Archive.RetryBackoff,
+			Timeout:      cli.Archive.Timeout,
+		}, log)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create log archive uploader")
+		}
+		extproc.TrackQueue("archive", uploader.Depth)
+		if cli.LeaderElection.Enabled {
+			// Only the leader uploads; followers leave rotated files on
+			// (shared) disk for it.
+			elector, err := leader.New(leader.Config{
+				Namespace:     cli.LeaderElection.Namespace,
+				Name:          cli.LeaderElection.Name,
+				Identity:      cli.LeaderElection.Identity,
+				LeaseDuration: cli.LeaderElection.LeaseDuration,
+				RenewDeadline: cli.LeaderElection.RenewDeadline,
+				RetryPeriod:   cli.LeaderElection.RetryPeriod,
+			}, log)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to set up leader election")
+			}
+			leadArchival := func(context.Context) {
+				// Pick up files rotated before this replica became leader.
+				pending, err := logsink.Completed(sinkCfg)
+				if err != nil {
+					log.Warn().Err(err).Msg("failed to list rotated access log files")
+				}
+				for _, path := range pending {
+					uploader.Enqueue(path)
+				}
+			}
+			sinkCfg.OnRotate = func(path string) {
+				if elector.IsLeader() {
+					uploader.Enqueue(path)
+				}
+			}
+			uploader.Start(nil)
+			campaign, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				elector.Run(campaign, leadArchival)
+			}()
+			// Release the lease before exiting so a follower takes over
+			// immediately.
+			stopCampaign = func() {
+				cancel()
+				<-done
+			}
+		} else {
+			// Files rotated before a restart are uploaded first.
+			pending, err := logsink.Completed(sinkCfg)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to list rotated access log files")
+			}
+			sinkCfg.OnRotate = uploader.Enqueue
+			uploader.Start(pending)
+		}
+		log.Info().
+			Stringer("destination", uploader).
+			Str("prefix", cli.Archive.Prefix).
+			Bool("leader_election", cli.LeaderElection.Enabled).
+			Msg("access log archival configured")
+	}
+
+	out, err := logsink.Open(sinkCfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open access log output")
+	}
+	if cli.Loki.URL != "" {
+		sink, err := loki.New(loki.Config{
+			URL:           cli.Loki.URL,
+			Labels:        cli.Loki.Labels,
+			TenantID:      cli.Loki.TenantID,
+			Username:      cli.Loki.Username,
+			Password:      cli.Loki.Password,
+			BatchEntries:  cli.Loki.BatchEntries,
+			BatchInterval: cli.Loki.BatchInterval,
+			QueueSize:     cli.Loki.QueueSize,
+			MaxRetries:    cli.Loki.MaxRetries,
+			RetryBackoff:  cli.Loki.RetryBackoff,
+			MaxBackoff:    cli.Loki.MaxBackoff,
+			Timeout:       cli.Loki.Timeout,
+			Compression:   logsink.Compression(cli.Loki.Compression),
+			Memory:        queueMemory(srvCfg.MemoryBudget),
+		}, log)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create Loki sink")
+		}
+		extproc.TrackQueue("loki", sink.Depth)
+		if cli.Loki.AnonymizeIPs {
+			out = logsink.Tee(out, logsink.Anonymize(sink, sinkCfg.Anonymizer))
+		} else {
+			out = logsink.Tee(out, sink)
+		}
+		log.Info().
+			Interface("labels", cli.Loki.Labels).
+			Int("batch_entries", cli.Loki.BatchEntries).
+			Dur("batch_interval", cli.Loki.BatchInterval).
+			Int("queue_size", cli.Loki.QueueSize).
+			Msg("access log shipping to Loki configured")
+	}
+	if len(cli.Kafka.Brokers) > 0 {
+		// The flag is an enum, so the acks always parse.
+		acks, _ := kafka.ParseAcks(cli.Kafka.Acks)
+		sink, err := kafka.New(kafka.Config{
+			Brokers:     cli.Kafka.Brokers,
+			Topic:       cli.Kafka.Topic,
+			ClientID:    cli.Kafka.ClientID,
+			Acks:        acks,
+			Compression: logsink.Compression(cli.Kafka.Compression),
+			TLS: kafka.TLSConfig{
+				Enabled:            cli.Kafka.TLS,
+				CAFile:             cli.Kafka.TLSCAFile,
+				CertFile:           cli.Kafka.TLSCertFile,
+				KeyFile:            cli.Kafka.TLSKeyFile,
+				ServerName:         cli.Kafka.TLSServerName,
+				InsecureSkipVerify: cli.Kafka.TLSInsecureSkipVerify,
+			},
+			SASL: kafka.SASLConfig{
+				Mechanism: kafka.SASLMechanism(cli.Kafka.SASLMechanism),
+				Username:  cli.Kafka.SASLUsername,
+				Password:  cli.Kafka.SASLPassword,
+			},
+			BatchEntries:  cli.Kafka.BatchEntries,
+			BatchInterval: cli.Kafka.BatchInterval,
+			QueueSize:     cli.Kafka.QueueSize,
+			MaxRetries:    cli.Kafka.MaxRetries,
+			RetryBackoff:  cli.Kafka.RetryBackoff,
+			MaxBackoff:    cli.Kafka.MaxBackoff,
+			Timeout:       cli.Kafka.Timeout,
+			Memory:        queueMemory(srvCfg.MemoryBudget),
+		}, log)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create Kafka sink")
+		}
+		extproc.TrackQueue("kafka", sink.Depth)
+		if cli.Kafka.AnonymizeIPs {
+			out = logsink.Tee(out, logsink.Anonymize(sink, sinkCfg.Anonymizer))
+		} else {
+			out = logsink.Tee(out, sink)
+		}
+		log.Info().
+			Strs("brokers", cli.Kafka.Brokers).
+			Str("topic", cli.Kafka.Topic).
+			Str("acks", cli.Kafka.Acks).
+			Str("compression", cli.Kafka.Compression).
+			Int("batch_entries", cli.Kafka.BatchEntries).
+			Dur("batch_interval", cli.Kafka.BatchInterval).
+			Int("queue_size", cli.Kafka.QueueSize).
+			Msg("access log shipping to Kafka configured")
+	}
+
+	schema, err := accesslog.LookupSchema(cli.Schema)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid access log schema")
+	}
+
+	formatter, err := accesslog.NewFormatter(cli.Format, cli.LogFormat)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid access log format")
+	}
 
-	if err := server.Run(server.Config{
-		GRPCPort:       cli.GRPC.Port,
-		CertPath:       cli.GRPC.CertPath,
-		CAFile:         cli.GRPC.CAFile,
-		HealthPort:     cli.Health.Port,
-		DialServerName: cli.Health.DialServerName,
-	}, factory, log); err != nil {
-		log.Fatal().Err(err).Send()
+	srvCfg.Admin.Handlers = map[string]http.Handler{
+		"GET /admin/accesslog/schema": accesslog.SchemaHandler(schema),
+	}
+	opts := []accesslog.Option{
+		accesslog.WithExcludeHeaders(cli.ExcludeHeaders...),
+		accesslog.WithSchema(schema),
+		accesslog.WithFormatter(formatter),
+	}
+	if cli.CountGRPCMessages {
+		opts = append(opts, accesslog.WithGRPCMessageCounts())
+	}
+	if cli.TrackResponseEnd {
+		opts = append(opts, accesslog.WithResponseEnd())
+	}
+	if cli.Encoder == "fast" {
+		opts = append(opts, accesslog.WithFastEncoder())
+	}
+	if len(cli.EncryptFields) > 0 {
+		if cli.EncryptPublicKey == "" {
+			log.Fatal().Msg("--accesslog-encrypt-fields requires --accesslog-encrypt-public-key")
+		}
+		encryption, err := accesslog.NewFieldEncryption(cli.EncryptPublicKey, cli.EncryptFields)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid access log field encryption")
+		}
+		opts = append(opts, accesslog.WithFieldEncryption(encryption))
+	}
+	var overrides *accesslog.Overrides
+	if cli.OverridesFile != "" {
+		overrides, err = accesslog.NewOverrides(cli.OverridesFile, cli.OverridesReload, sinkCfg, log)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load access log overrides")
+		}
+		opts = append(opts, accesslog.WithOverrides(overrides, cli.GRPC.RouteKey))
+	}
+	if cli.Metrics.Enabled {
+		paths, err := pathtemplate.New(srvCfg.Metrics.PathTemplate)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create path templater")
+		}
+		opts = append(opts, accesslog.WithPathTemplater(paths))
+	}
+
+	var factory extproc.ProcessorFactory = accesslog.NewProcessorFactory(out, log, opts...)
+
+	if len(cli.RouteExcludeHeaders) > 0 || cli.PolicyController.Enabled {
+		mux, err := extproc.NewMux(cli.GRPC.RouteKey, factory)
+		if err != nil {
+			log.Fatal().Err(err).Msg("route mux init failed")
+		}
+		for route, headers := range cli.RouteExcludeHeaders {
+			mux.Handle(route, accesslog.NewProcessorFactory(
+				out,
+				log,
+				append(slices.Clip(opts), accesslog.WithExcludeHeaders(strings.Split(headers, ",")...))...,
+			))
+			log.Info().
+				Str("route_key", cli.GRPC.RouteKey).
+				Str("route", route).
+				Str("exclude_headers", headers).
+				Msg("access log route configured")
+		}
+		if cli.PolicyController.Enabled {
+			controller, err := policy.New(policy.Config{
+				Processor: "accesslog",
+				Namespace: cli.PolicyController.Namespace,
+			}, mux, func(settings json.RawMessage) (extproc.ProcessorFactory, error) {
+				extra, err := accesslog.PolicyOptions(settings)
+				if err != nil {
+					return nil, err
+				}
+				return accesslog.NewProcessorFactory(out, log, append(slices.Clip(opts), extra...)...), nil
+			}, log)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to create policy controller")
+			}
+			go controller.Run(context.Background())
+			log.Info().
+				Str("namespace", cli.PolicyController.Namespace).
+				Msg("access log policy controller started")
+		}
+		factory = mux
+	}
+
+	// Flush the outputs, including the batches queued for Loki and Kafka,
+	// when the server fails or the process is asked to stop.
+	var closeOnce sync.Once
+	closeOutputs := func() {
+		closeOnce.Do(func() {
+			// Finish compressed output so the file stays readable.
+			if err := out.Close(); err != nil {
+				log.Error().Err(err).Msg("failed to close access log output")
+			}
+			if overrides != nil {
+				if err := overrides.Close(); err != nil {
+					log.Error().Err(err).Msg("failed to close access log override outputs")
+				}
+			}
+			if uploader != nil {
+				stopCampaign()
+				uploader.Close()
+			}
+		})
+	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Info().Str("signal", sig.String()).Msg("shutting down, flushing access log outputs")
+		closeOutputs()
+		os.Exit(0)
+	}()
+
+	runErr := server.Run(srvCfg, factory, log)
+	closeOutputs()
+	if runErr != nil {
+		log.Fatal().Err(runErr).Send()
 		os.Exit(1)
 	}
 }
+
+// queueMemory returns an account of budget for a log queue, or nil without a
+// budget so the queue skips accounting.
+func queueMemory(budget *extproc.MemoryBudget) logsink.Reserver {
+	if budget == nil {
+		return nil
+	}
+	return budget.NewAccount()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/dynconfig"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/deprecation"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.DeprecationCLI
+	config.Parse(&cli, "Envoy external processor that adds Deprecation/Sunset headers and rejects sunset endpoints.")
+
+	log := logger.New(cli.Log)
+
+	rules, err := deprecation.LoadRules(cli.Deprecation.RulesFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load deprecation rules")
+	}
+	audit.Record("deprecation-rules", audit.File(cli.Deprecation.RulesFile), rules)
+
+	log.Info().
+		Str("rules_file", cli.Deprecation.RulesFile).
+		Int("routes", len(rules.Routes)).
+		Bool("reject_after_sunset", cli.Deprecation.RejectAfterSunset).
+		Msg("api deprecation configured")
+
+	factory := deprecation.NewProcessorFactory(rules, log,
+		deprecation.WithRejectAfterSunset(cli.Deprecation.RejectAfterSunset),
+	)
+	go kube.WatchFile(context.Background(), cli.Deprecation.RulesFile, log, func(data []byte) {
+		rules, err := deprecation.ParseRules(data)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to reload deprecation rules, keeping previous")
+			return
+		}
+		factory.SetRules(rules)
+		log.Info().Int("routes", len(rules.Routes)).Msg("deprecation rules reloaded")
+		audit.Record("deprecation-rules", audit.File(cli.Deprecation.RulesFile), rules)
+	})
+
+	registry := dynconfig.NewRegistry(log)
+	registry.Register("deprecation-rules", func(data []byte) (func(), error) {
+		rules, err := deprecation.ParseRules(data)
+		if err != nil {
+			return nil, err
+		}
+		return func() { factory.SetRules(rules) }, nil
+	})
+	if err := dynconfig.Start(context.Background(), dynconfig.Config{
+		ADS: dynconfig.ADSConfig{
+			Address:    cli.DynConfig.Server,
+			NodeID:     cli.DynConfig.NodeID,
+			Cluster:    cli.DynConfig.Cluster,
+			CAFile:     cli.DynConfig.CAFile,
+			ServerName: cli.DynConfig.ServerName,
+			Plaintext:  cli.DynConfig.Plaintext,
+		},
+		File:         cli.DynConfig.File,
+		PollInterval: cli.DynConfig.PollInterval,
+	}, registry); err != nil {
+		log.Fatal().Err(err).Msg("dynamic configuration failed")
+	}
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Admin.Handlers = map[string]http.Handler{"GET /admin/dynconfig": registry}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
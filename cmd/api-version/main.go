@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/apiversion"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.APIVersionCLI
+	config.Parse(&cli, "Envoy external processor that negotiates and validates the requested API version.")
+
+	log := logger.New(cli.Log)
+
+	sources := make([]apiversion.Source, 0, len(cli.Version.Sources))
+	for _, s := range cli.Version.Sources {
+		sources = append(sources, apiversion.Source(s))
+	}
+
+	log.Info().
+		Strs("sources", cli.Version.Sources).
+		Strs("supported", cli.Version.Supported).
+		Str("default", cli.Version.Default).
+		Str("upstream_header", cli.Version.UpstreamHeader).
+		Msg("api version negotiation configured")
+
+	factory := apiversion.NewProcessorFactory(apiversion.Config{
+		Sources:          sources,
+		Supported:        cli.Version.Supported,
+		Default:          cli.Version.Default,
+		RequestHeader:    cli.Version.RequestHeader,
+		UpstreamHeader:   cli.Version.UpstreamHeader,
+		StripPathVersion: cli.Version.StripPathVersion,
+	}, log)
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/benchgate"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+)
+
+func main() {
+	var cli config.BenchCLI
+	config.Parse(&cli, "Benchmark tooling: compares benchmark runs against performance budgets.")
+
+	log := logger.New(cli.Log)
+	cmd := cli.Compare
+
+	budgets, err := benchgate.LoadBudgets(cmd.Budgets)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load budgets")
+	}
+	base, err := os.Open(cmd.Old)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", cmd.Old).Msg("failed to open base results")
+	}
+	defer base.Close()
+	head, err := os.Open(cmd.New)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", cmd.New).Msg("failed to open new results")
+	}
+	defer head.Close()
+
+	report, err := benchgate.Compare(base, head, budgets, benchgate.Options{Alpha: cmd.Alpha})
+	if err != nil {
+		log.Fatal().Err(err).Msg("comparison failed")
+	}
+	report.WriteText(os.Stdout)
+	if len(report.Violations) > 0 {
+		log.Error().Int("violations", len(report.Violations)).Msg("benchmarks over budget")
+		os.Exit(1)
+	}
+}
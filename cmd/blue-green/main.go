@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/bluegreen"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.BlueGreenCLI
+	config.Parse(&cli, "Envoy external processor that splits requests between blue and green deployments by an adjustable percentage.")
+
+	log := logger.New(cli.Log)
+
+	controller, err := bluegreen.NewController(cli.BlueGreen.StateFile, cli.BlueGreen.GreenPercent, nil, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("blue/green state init failed")
+	}
+
+	log.Info().
+		Float64("green_percent", controller.Status().GreenPercent).
+		Str("state_file", cli.BlueGreen.StateFile).
+		Str("header", cli.BlueGreen.Header).
+		Str("hash_header", cli.BlueGreen.HashHeader).
+		Msg("blue/green configured")
+
+	factory := bluegreen.NewProcessorFactory(bluegreen.Config{
+		Header:     cli.BlueGreen.Header,
+		HashHeader: cli.BlueGreen.HashHeader,
+	}, controller, log)
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Admin.Handlers = map[string]http.Handler{"/admin/bluegreen": controller}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
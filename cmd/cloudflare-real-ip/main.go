@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/cloudflare"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	cloudflareproc "github.com/mnixry/envoy-ext-procs/internal/extproc/cloudflare"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.CloudflareCLI
+	config.Parse(&cli, "Envoy external processor that validates Cloudflare requests and sets real client IP headers.")
+
+	log := logger.New(cli.Log)
+	if err := httpclient.Configure(httpclient.NewDefaults(cli.HTTPClient)); err != nil {
+		log.Fatal().Err(err).Msg("invalid outbound HTTP client configuration")
+	}
+
+	validator, err := cloudflare.New(cloudflare.Config{
+		IPv4URL:         cli.Cloudflare.IPv4URL,
+		IPv6URL:         cli.Cloudflare.IPv6URL,
+		RefreshInterval: cli.Cloudflare.RefreshInterval,
+		Timeout:         cli.Cloudflare.Timeout,
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cloudflare validator init failed")
+	}
+	defer validator.Close()
+
+	log.Info().
+		Str("ipv4_url", cli.Cloudflare.IPv4URL).
+		Str("ipv6_url", cli.Cloudflare.IPv6URL).
+		Dur("refresh_interval", cli.Cloudflare.RefreshInterval).
+		Dur("timeout", cli.Cloudflare.Timeout).
+		Msg("cloudflare validator configured")
+
+	factory := cloudflareproc.NewProcessorFactory(validator, log)
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/connbudget"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.ConnBudgetCLI
+	config.Parse(&cli, "Envoy external processor that enforces per-IP budgets of new connections and requests per time window.")
+
+	log := logger.New(cli.Log)
+
+	factory, err := connbudget.NewProcessorFactory(connbudget.Config{
+		Window:          cli.ConnBudget.Window,
+		Connections:     cli.ConnBudget.Connections,
+		Requests:        cli.ConnBudget.Requests,
+		PerListener:     cli.ConnBudget.PerListener,
+		CacheSize:       cli.ConnBudget.CacheSize,
+		ResponseHeaders: cli.ConnBudget.ResponseHeaders,
+		DecisionMode:    extproc.DecisionMode(cli.Decision.Mode),
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("connection budget init failed")
+	}
+
+	log.Info().
+		Dur("window", cli.ConnBudget.Window).
+		Int("connections", cli.ConnBudget.Connections).
+		Int("requests", cli.ConnBudget.Requests).
+		Bool("per_listener", cli.ConnBudget.PerListener).
+		Int("cache_size", cli.ConnBudget.CacheSize).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("connection budgets configured")
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/throttle"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.ThrottleCLI
+	config.Parse(&cli, "Envoy external processor that limits concurrent downloads and paces bandwidth per client.")
+
+	log := logger.New(cli.Log)
+
+	factory, err := throttle.NewProcessorFactory(throttle.Config{
+		Routes:         cli.Throttle.Routes,
+		MaxConcurrent:  cli.Throttle.MaxConcurrent,
+		BytesPerSecond: cli.Throttle.BytesPerSecond,
+		Burst:          cli.Throttle.Burst,
+		MaxDelay:       cli.Throttle.MaxDelay,
+		MinSize:        cli.Throttle.MinSize,
+		MaxRanges:      cli.Throttle.MaxRanges,
+		CacheSize:      cli.Throttle.CacheSize,
+		DecisionMode:   extproc.DecisionMode(cli.Decision.Mode),
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("throttle init failed")
+	}
+
+	log.Info().
+		Strs("routes", cli.Throttle.Routes).
+		Int("max_concurrent", cli.Throttle.MaxConcurrent).
+		Int64("bytes_per_second", cli.Throttle.BytesPerSecond).
+		Int64("burst", cli.Throttle.Burst).
+		Dur("max_delay", cli.Throttle.MaxDelay).
+		Int("max_ranges", cli.Throttle.MaxRanges).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("download throttling configured")
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -1,58 +1,163 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"net/netip"
 	"os"
 
-	"github.com/alecthomas/kong"
 	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/dnsverify"
 	"github.com/mnixry/envoy-ext-procs/internal/edgeone"
+	"github.com/mnixry/envoy-ext-procs/internal/edgeone/faketeo"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
 	edgeoneproc "github.com/mnixry/envoy-ext-procs/internal/extproc/edgeone"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/ipfilter"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
 	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/selftest"
 	"github.com/mnixry/envoy-ext-procs/internal/server"
+	"github.com/samber/oops"
 )
 
 func main() {
 	var cli config.EdgeOneCLI
-	kong.Parse(&cli,
-		kong.Description("Envoy external processor that validates EdgeOne CDN requests and sets real client IP headers."),
-		kong.UsageOnError(),
-	)
+	ctx := config.Parse(&cli, "Envoy external processor that validates EdgeOne CDN requests and sets real client IP headers.")
 
 	log := logger.New(cli.Log)
 
-	validator, err := edgeone.New(edgeone.Config{
+	edgeOneCfg := edgeone.Config{
 		SecretID:    cli.EdgeOne.SecretID,
 		SecretKey:   cli.EdgeOne.SecretKey,
 		APIEndpoint: cli.EdgeOne.APIEndpoint,
 		Region:      cli.EdgeOne.Region,
 		CacheSize:   cli.EdgeOne.CacheSize,
-		CacheTTL:    cli.EdgeOne.CacheTTL,
+		PositiveTTL: cli.EdgeOne.PositiveTTL,
+		NegativeTTL: cli.EdgeOne.NegativeTTL,
 		Timeout:     cli.EdgeOne.Timeout,
-	}, log)
+		FailOpen:    cli.EdgeOne.FailurePolicy == "open",
+	}
+	fallback, err := loadFallback(cli.EdgeOne.FallbackCIDRs, cli.EdgeOne.FallbackFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid EdgeOne fallback ranges")
+	}
+	edgeOneCfg.Fallback = fallback
+	if fake := cli.EdgeOne.Fake; len(fake.IPs) > 0 {
+		prefixes, err := faketeo.ParsePrefixes(fake.IPs)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid fake TEO API addresses")
+		}
+		endpoint, stop, err := faketeo.New(faketeo.Config{
+			EdgeOneIPs: prefixes,
+			Latency:    fake.Latency,
+			ErrorRate:  fake.ErrorRate,
+		}).Listen("127.0.0.1:0")
+		if err != nil {
+			log.Fatal().Err(err).Msg("fake TEO API init failed")
+		}
+		defer stop()
+		edgeOneCfg.APIEndpoint = endpoint
+		edgeOneCfg.SecretID = cmp.Or(edgeOneCfg.SecretID, "fake")
+		edgeOneCfg.SecretKey = cmp.Or(edgeOneCfg.SecretKey, "fake")
+		log.Warn().
+			Str("api_endpoint", endpoint).
+			Strs("edgeone_ips", fake.IPs).
+			Msg("using an in-process fake TEO API; do not use in production")
+	}
+
+	if dnsCfg := cli.EdgeOne.DNS; cli.EdgeOne.Validator == "dns" || len(dnsCfg.Suffixes) > 0 || len(dnsCfg.Hostnames) > 0 {
+		verifier, err := dnsverify.New(dnsverify.Config{
+			Suffixes:        dnsCfg.Suffixes,
+			Hostnames:       dnsCfg.Hostnames,
+			RefreshInterval: dnsCfg.RefreshInterval,
+			Resolver:        dnsCfg.Resolver,
+			DNSSEC:          dnsCfg.DNSSEC,
+			Timeout:         dnsCfg.Timeout,
+			CacheSize:       cli.EdgeOne.CacheSize,
+			PositiveTTL:     cli.EdgeOne.PositiveTTL,
+			NegativeTTL:     cli.EdgeOne.NegativeTTL,
+		}, log)
+		if err != nil {
+			log.Fatal().Err(err).Msg("EdgeOne DNS validation init failed")
+		}
+		defer verifier.Close()
+		edgeOneCfg.DNS = verifier
+		edgeOneCfg.DNSOnly = cli.EdgeOne.Validator == "dns"
+		log.Info().
+			Strs("suffixes", dnsCfg.Suffixes).
+			Strs("hostnames", dnsCfg.Hostnames).
+			Str("resolver", dnsCfg.Resolver).
+			Bool("dnssec", dnsCfg.DNSSEC).
+			Bool("dns_only", edgeOneCfg.DNSOnly).
+			Msg("EdgeOne DNS validation configured")
+	}
+
+	validator, err := edgeone.New(edgeOneCfg, log)
 	if err != nil {
 		log.Fatal().Err(err).Msg("edgeone validator init failed")
 	}
 
 	log.Info().
-		Str("api_endpoint", cli.EdgeOne.APIEndpoint).
+		Str("api_endpoint", edgeOneCfg.APIEndpoint).
 		Str("region", cli.EdgeOne.Region).
 		Int("cache_size", cli.EdgeOne.CacheSize).
-		Dur("cache_ttl", cli.EdgeOne.CacheTTL).
+		Dur("positive_ttl", cli.EdgeOne.PositiveTTL).
+		Dur("negative_ttl", cli.EdgeOne.NegativeTTL).
 		Dur("timeout", cli.EdgeOne.Timeout).
+		Int("fallback_prefixes", len(fallback)).
+		Str("failure_policy", cli.EdgeOne.FailurePolicy).
+		Str("validator", cli.EdgeOne.Validator).
 		Str("log_output", cli.Log.Output).
 		Str("log_format", string(cli.Log.Format)).
+		Str("decision_mode", cli.Decision.Mode).
 		Msg("edgeone validator configured")
 
-	factory := edgeoneproc.NewProcessorFactory(validator, log)
+	if ctx.Command() == "selftest" {
+		// The cases expect enforced header rewrites, whatever the decision mode.
+		factory := edgeoneproc.NewProcessorFactory(validator, log)
+		if err := selftest.Run(context.Background(), factory, edgeoneproc.SelfTestCases(cli.Selftest.TrustedIP), os.Stdout, log); err != nil {
+			log.Fatal().Err(err).Msg("self-test failed")
+		}
+		return
+	}
 
-	if err := server.Run(server.Config{
-		GRPCPort:       cli.GRPC.Port,
-		CertPath:       cli.GRPC.CertPath,
-		CAFile:         cli.GRPC.CAFile,
-		HealthPort:     cli.Health.Port,
-		DialServerName: cli.Health.DialServerName,
-	}, factory, log); err != nil {
+	factory := edgeoneproc.NewProcessorFactory(validator, log, edgeoneproc.WithDecisionMode(extproc.DecisionMode(cli.Decision.Mode)))
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+		{Name: "failure_policy", Value: cli.EdgeOne.FailurePolicy, Permissive: cli.EdgeOne.FailurePolicy == "open"},
+		// Unvalidated DNS answers can be spoofed.
+		{Name: "validator", Value: cli.EdgeOne.Validator, Permissive: cli.EdgeOne.Validator == "dns" && !cli.EdgeOne.DNS.DNSSEC},
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
 		log.Fatal().Err(err).Send()
 		os.Exit(1)
 	}
 }
+
+// loadFallback parses the fallback CIDRs given inline and in file.
+func loadFallback(cidrs []string, file string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		prefix, err := ipfilter.ParseEntry(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if file == "" {
+		return prefixes, nil
+	}
+	data, err := kube.ReadFile(context.Background(), file)
+	if err != nil {
+		return nil, oops.Code(errcode.ReadConfigFailed).With("path", file).Wrapf(err, "failed to read fallback file")
+	}
+	listed, err := ipfilter.ParseList(data)
+	if err != nil {
+		return nil, oops.With("path", file).Wrap(err)
+	}
+	return append(prefixes, listed...), nil
+}
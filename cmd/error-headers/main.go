@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/errorheaders"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.ErrorHeadersCLI
+	config.Parse(&cli, "Envoy external processor that adds diagnostic headers to error responses.")
+
+	log := logger.New(cli.Log)
+
+	classes, err := errorheaders.ParseClasses(cli.Errors.Classes)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid status classes")
+	}
+
+	log.Info().
+		Str("environment", cli.Errors.Environment).
+		Strs("classes", cli.Errors.Classes).
+		Str("error_id_header", cli.Errors.ErrorIDHeader).
+		Str("cluster_header", cli.Errors.ClusterHeader).
+		Msg("error headers configured")
+
+	factory := errorheaders.NewProcessorFactory(errorheaders.Config{
+		Environment:   errorheaders.Environment(cli.Errors.Environment),
+		Classes:       classes,
+		ErrorIDHeader: cli.Errors.ErrorIDHeader,
+		ClusterHeader: cli.Errors.ClusterHeader,
+	}, log)
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
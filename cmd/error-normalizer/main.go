@@ -0,0 +1,46 @@
+package main
+
+import (
+	"html/template"
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/errorpage"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.ErrorPageCLI
+	config.Parse(&cli, "Envoy external processor that normalizes upstream error responses to problem+json or HTML pages.")
+
+	log := logger.New(cli.Log)
+
+	var tmpl *template.Template
+	if cli.ErrorPage.TemplateFile != "" {
+		var err error
+		if tmpl, err = template.ParseFiles(cli.ErrorPage.TemplateFile); err != nil {
+			log.Fatal().Err(err).Str("file", cli.ErrorPage.TemplateFile).Msg("failed to parse error page template")
+		}
+	}
+
+	log.Info().
+		Str("template_file", cli.ErrorPage.TemplateFile).
+		Str("default_format", cli.ErrorPage.DefaultFormat).
+		Ints("skip_statuses", cli.ErrorPage.SkipStatuses).
+		Str("correlation_header", cli.ErrorPage.CorrelationHeader).
+		Msg("error normalization configured")
+
+	factory := errorpage.NewProcessorFactory(errorpage.Config{
+		Template:          tmpl,
+		DefaultFormat:     cli.ErrorPage.DefaultFormat,
+		SkipStatuses:      cli.ErrorPage.SkipStatuses,
+		CorrelationHeader: cli.ErrorPage.CorrelationHeader,
+		ProblemTypeBase:   cli.ErrorPage.ProblemTypeBase,
+	}, log)
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
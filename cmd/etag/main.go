@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/etag"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.ETagCLI
+	config.Parse(&cli, "Envoy external processor that adds strong ETags to responses and answers If-None-Match with 304.")
+
+	log := logger.New(cli.Log)
+
+	log.Info().
+		Strs("routes", cli.ETag.Routes).
+		Int("cache_size", cli.ETag.CacheSize).
+		Dur("cache_ttl", cli.ETag.CacheTTL).
+		Msg("etag generation configured")
+
+	factory := etag.NewProcessorFactory(etag.Config{
+		Routes:    cli.ETag.Routes,
+		CacheSize: cli.ETag.CacheSize,
+		CacheTTL:  cli.ETag.CacheTTL,
+	}, log)
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/fault"
+	"github.com/mnixry/envoy-ext-procs/internal/featureflag"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.FaultCLI
+	config.Parse(&cli, "Envoy external processor that injects delays, errors and body corruption for chaos testing.")
+
+	log := logger.New(cli.Log)
+	if err := httpclient.Configure(httpclient.NewDefaults(cli.HTTPClient)); err != nil {
+		log.Fatal().Err(err).Msg("invalid outbound HTTP client configuration")
+	}
+
+	if cli.Fault.GuardHeader == "" {
+		log.Warn().Msg("no guard header configured, faults apply to all matching traffic")
+	}
+	log.Info().
+		Strs("routes", cli.Fault.Routes).
+		Str("guard_header", cli.Fault.GuardHeader).
+		Float64("delay_percent", cli.Fault.DelayPercent).
+		Dur("delay", cli.Fault.Delay).
+		Float64("abort_percent", cli.Fault.AbortPercent).
+		Int("abort_status", cli.Fault.AbortStatus).
+		Float64("corrupt_percent", cli.Fault.CorruptPercent).
+		Str("feature_flags", cli.FeatureFlags.Provider).
+		Msg("fault injection configured")
+
+	flags, err := featureflag.New(featureflag.Config{
+		Provider:        cli.FeatureFlags.Provider,
+		File:            cli.FeatureFlags.File,
+		PollInterval:    cli.FeatureFlags.PollInterval,
+		OFREPURL:        cli.FeatureFlags.OFREPURL,
+		OFREPToken:      cli.FeatureFlags.OFREPToken,
+		TargetingHeader: cli.FeatureFlags.TargetingHeader,
+		Timeout:         cli.FeatureFlags.Timeout,
+		CacheSize:       cli.FeatureFlags.CacheSize,
+		CacheTTL:        cli.FeatureFlags.CacheTTL,
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create feature flag provider")
+	}
+	defer flags.Close()
+
+	factory := fault.NewProcessorFactory(fault.Config{
+		Routes:         cli.Fault.Routes,
+		GuardHeader:    cli.Fault.GuardHeader,
+		GuardValue:     cli.Fault.GuardValue,
+		DelayPercent:   cli.Fault.DelayPercent,
+		Delay:          cli.Fault.Delay,
+		AbortPercent:   cli.Fault.AbortPercent,
+		AbortStatus:    cli.Fault.AbortStatus,
+		CorruptPercent: cli.Fault.CorruptPercent,
+		CorruptBytes:   cli.Fault.CorruptBytes,
+		MarkerHeader:   cli.Fault.MarkerHeader,
+		Flags:          flags,
+	}, log)
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
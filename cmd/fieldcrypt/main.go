@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/fieldcrypt"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+)
+
+func main() {
+	var cli config.FieldCryptCLI
+	ctx := config.Parse(&cli, "Access log field encryption tooling: generates keys and decrypts encrypted fields.")
+
+	log := logger.New(cli.Log)
+
+	switch ctx.Command() {
+	case "keygen":
+		id, err := fieldcrypt.GenerateIdentity()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to generate key")
+		}
+		key := fmt.Sprintf("# public key: %s\n%s\n", id.PublicKey(), id)
+		if cli.Keygen.Output == "" {
+			fmt.Print(key)
+			return
+		}
+		if err := os.WriteFile(cli.Keygen.Output, []byte(key), 0o600); err != nil {
+			log.Fatal().Err(err).Str("path", cli.Keygen.Output).Msg("failed to write private key")
+		}
+		fmt.Println(id.PublicKey())
+
+	default:
+		cmd := cli.Decrypt
+		data, err := os.ReadFile(cmd.IdentityFile)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cmd.IdentityFile).Msg("failed to read private key")
+		}
+		id, err := fieldcrypt.ParseIdentity(string(data))
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cmd.IdentityFile).Msg("invalid private key")
+		}
+
+		out := bufio.NewWriter(os.Stdout)
+		total := 0
+		decrypt := func(in io.Reader, name string) {
+			r := bufio.NewReader(in)
+			for {
+				line, err := r.ReadString('\n')
+				plain, n := id.DecryptAll(line)
+				total += n
+				if _, werr := out.WriteString(plain); werr != nil {
+					log.Fatal().Err(werr).Msg("failed to write output")
+				}
+				if err == io.EOF {
+					return
+				} else if err != nil {
+					log.Fatal().Err(err).Str("path", name).Msg("failed to read access log")
+				}
+			}
+		}
+		if len(cmd.Files) == 0 {
+			decrypt(os.Stdin, "-")
+		}
+		for _, name := range cmd.Files {
+			f, err := os.Open(name)
+			if err != nil {
+				log.Fatal().Err(err).Str("path", name).Msg("failed to open access log")
+			}
+			decrypt(f, name)
+			_ = f.Close()
+		}
+		if err := out.Flush(); err != nil {
+			log.Fatal().Err(err).Msg("failed to write output")
+		}
+		log.Debug().Int("decrypted", total).Msg("access log decrypted")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/geo"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/ipfilter"
+	geodb "github.com/mnixry/envoy-ext-procs/internal/geo"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+	"github.com/samber/oops"
+)
+
+func main() {
+	var cli config.GeoCLI
+	config.Parse(&cli, "Envoy external processor that resolves clients to a region for locality-aware routing.")
+
+	log := logger.New(cli.Log)
+
+	geoCfg := geo.Config{
+		CDNHeaders:       cli.Geo.CDNHeaders,
+		ClientIPHeader:   cli.Geo.ClientIPHeader,
+		Regions:          cli.Geo.Regions,
+		ContinentRegions: cli.Geo.ContinentRegions,
+		DefaultRegion:    cli.Geo.DefaultRegion,
+		RegionHeader:     cli.Geo.RegionHeader,
+		CountryHeader:    cli.Geo.CountryHeader,
+	}
+	for _, entry := range cli.Geo.TrustedProxies {
+		prefix, err := ipfilter.ParseEntry(entry)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid trusted proxy")
+		}
+		geoCfg.TrustedProxies = append(geoCfg.TrustedProxies, prefix)
+	}
+	if h := cli.Geo.TrustHeader; h != "" {
+		name, value, ok := strings.Cut(h, "=")
+		if !ok || name == "" {
+			log.Fatal().Err(oops.In("geo").Code(errcode.InvalidConfig).
+				With("trust_header", h).
+				Errorf("trust header must be NAME=VALUE")).Send()
+		}
+		geoCfg.TrustHeader, geoCfg.TrustValue = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+	}
+	if path := cli.Geo.MMDBFile; path != "" {
+		db, err := geodb.Open(path)
+		if err != nil {
+			log.Fatal().Err(err).Msg("geo database open failed")
+		}
+		defer db.Close()
+		geoCfg.DB = db
+	}
+
+	log.Info().
+		Str("mmdb_file", cli.Geo.MMDBFile).
+		Strs("cdn_headers", cli.Geo.CDNHeaders).
+		Strs("trusted_proxies", prefixStrings(geoCfg.TrustedProxies)).
+		Str("trust_header", geoCfg.TrustHeader).
+		Int("regions", len(cli.Geo.Regions)).
+		Int("continent_regions", len(cli.Geo.ContinentRegions)).
+		Str("default_region", cli.Geo.DefaultRegion).
+		Msg("geo routing configured")
+
+	factory := geo.NewProcessorFactory(geoCfg, log)
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Error().Err(err).Send()
+		os.Exit(1)
+	}
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	out := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		out[i] = p.String()
+	}
+	return out
+}
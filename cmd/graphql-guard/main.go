@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	graphqlproc "github.com/mnixry/envoy-ext-procs/internal/extproc/graphql"
+	"github.com/mnixry/envoy-ext-procs/internal/graphql"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/ratelimit"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.GraphQLCLI
+	config.Parse(&cli, "Envoy external processor that limits GraphQL query depth, complexity, introspection and per-operation rates.")
+
+	log := logger.New(cli.Log)
+
+	limits := make(map[string]ratelimit.Limit, len(cli.GraphQL.OperationLimits))
+	for name, value := range cli.GraphQL.OperationLimits {
+		limit, err := ratelimit.ParseLimit(value)
+		if err != nil {
+			log.Fatal().Err(err).Str("operation", name).Msg("invalid operation rate limit")
+		}
+		limits[name] = limit
+	}
+	var defaultLimit ratelimit.Limit
+	if cli.GraphQL.DefaultLimit != "" {
+		var err error
+		if defaultLimit, err = ratelimit.ParseLimit(cli.GraphQL.DefaultLimit); err != nil {
+			log.Fatal().Err(err).Msg("invalid default rate limit")
+		}
+	}
+
+	factory, err := graphqlproc.NewProcessorFactory(graphqlproc.Config{
+		Paths:              cli.GraphQL.Paths,
+		MaxBodyBytes:       cli.GraphQL.MaxBodyBytes,
+		MaxDepth:           cli.GraphQL.MaxDepth,
+		MaxComplexity:      cli.GraphQL.MaxComplexity,
+		MaxBatch:           cli.GraphQL.MaxBatch,
+		BlockIntrospection: cli.GraphQL.BlockIntrospection,
+		Analysis:           graphql.Options{ListArguments: cli.GraphQL.ListArguments},
+		OperationLimits:    limits,
+		DefaultLimit:       defaultLimit,
+		CacheSize:          cli.GraphQL.CacheSize,
+		OperationHeader:    cli.GraphQL.OperationHeader,
+		DecisionMode:       extproc.DecisionMode(cli.Decision.Mode),
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("graphql init failed")
+	}
+
+	log.Info().
+		Strs("paths", cli.GraphQL.Paths).
+		Int("max_depth", cli.GraphQL.MaxDepth).
+		Int64("max_complexity", cli.GraphQL.MaxComplexity).
+		Int("max_batch", cli.GraphQL.MaxBatch).
+		Bool("block_introspection", cli.GraphQL.BlockIntrospection).
+		Int("operation_limits", len(limits)).
+		Str("default_limit", cli.GraphQL.DefaultLimit).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("graphql inspection configured")
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
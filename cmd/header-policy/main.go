@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/headerpolicy"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.HeaderPolicyCLI
+	config.Parse(&cli, "Envoy external processor that strips or rewrites information-leaking response headers.")
+
+	log := logger.New(cli.Log)
+
+	allow, deny := cli.Policy.Allow, cli.Policy.Deny
+	if !cli.Policy.NoDefaults {
+		allow = append(headerpolicy.DefaultAllow, allow...)
+		deny = append(headerpolicy.DefaultDeny, deny...)
+	}
+
+	log.Info().
+		Str("mode", cli.Policy.Mode).
+		Strs("allow", allow).
+		Strs("deny", deny).
+		Interface("rewrite", cli.Policy.Rewrite).
+		Msg("response header policy configured")
+
+	factory := headerpolicy.NewProcessorFactory(headerpolicy.Config{
+		Mode:    headerpolicy.Mode(cli.Policy.Mode),
+		Allow:   allow,
+		Deny:    deny,
+		Rewrite: cli.Policy.Rewrite,
+	}, log)
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/ipfilter"
+	"github.com/mnixry/envoy-ext-procs/internal/kvstore"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.IPFilterCLI
+	config.Parse(&cli, "Envoy external processor that allows or denies clients by static CIDR lists and a runtime denylist.")
+
+	log := logger.New(cli.Log)
+
+	log.Info().
+		Strs("allow_files", cli.IPFilter.AllowFiles).
+		Strs("deny_files", cli.IPFilter.DenyFiles).
+		Int("allow", len(cli.IPFilter.Allow)).
+		Int("deny", len(cli.IPFilter.Deny)).
+		Str("client_ip_header", cli.IPFilter.ClientIPHeader).
+		Bool("runtime_denylist", cli.IPFilter.Denylist).
+		Str("store", cli.Store.Driver).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("ip filter configured")
+
+	var denylist *ipfilter.Denylist
+	if cli.IPFilter.Denylist {
+		store, err := kvstore.Open(kvstore.NewConfig(cli.Store, log))
+		if err != nil {
+			log.Fatal().Err(err).Msg("state store init failed")
+		}
+		defer store.Close()
+		denylist = ipfilter.NewDenylist(store)
+	}
+
+	factory, err := ipfilter.NewProcessorFactory(ipfilter.Config{
+		AllowFiles:     cli.IPFilter.AllowFiles,
+		DenyFiles:      cli.IPFilter.DenyFiles,
+		Allow:          cli.IPFilter.Allow,
+		Deny:           cli.IPFilter.Deny,
+		ClientIPHeader: cli.IPFilter.ClientIPHeader,
+		ReloadInterval: cli.IPFilter.ReloadInterval,
+		Denylist:       denylist,
+		DecisionMode:   extproc.DecisionMode(cli.Decision.Mode),
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load IP lists")
+	}
+	defer factory.Close()
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+		{Name: "store_tls_skip_verify", Value: strconv.FormatBool(cli.Store.TLSInsecureSkipVerify), Permissive: cli.Store.TLSInsecureSkipVerify},
+		{Name: "store_gossip_authenticated", Value: strconv.FormatBool(cli.Store.GossipSecretKey != ""), Permissive: cli.IPFilter.Denylist && cli.Store.Driver == string(kvstore.DriverGossip) && cli.Store.GossipSecretKey == ""},
+	}
+	if denylist != nil {
+		srvCfg.Admin.Handlers = map[string]http.Handler{"/admin/ipfilter/deny": denylist}
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	jsonredactproc "github.com/mnixry/envoy-ext-procs/internal/extproc/jsonredact"
+	"github.com/mnixry/envoy-ext-procs/internal/jsonredact"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.JSONRedactCLI
+	ctx := config.Parse(&cli, "Envoy external processor that removes or masks JSON fields in streamed response bodies.")
+
+	log := logger.New(cli.Log)
+
+	var rules []jsonredact.Rule
+	for action, paths := range map[jsonredact.Action][]string{
+		jsonredact.ActionRemove: cli.Redact.Remove,
+		jsonredact.ActionMask:   cli.Redact.Mask,
+	} {
+		for _, raw := range paths {
+			path, err := jsonredact.ParsePath(raw)
+			ctx.FatalIfErrorf(err)
+			rules = append(rules, jsonredact.Rule{Path: path, Action: action})
+		}
+	}
+	if len(rules) == 0 {
+		ctx.Fatalf("at least one of --redact-remove or --redact-mask is required")
+	}
+
+	log.Info().
+		Strs("routes", cli.Redact.Routes).
+		Strs("remove", cli.Redact.Remove).
+		Strs("mask", cli.Redact.Mask).
+		Msg("json redaction configured")
+
+	factory := jsonredactproc.NewProcessorFactory(jsonredactproc.Config{
+		Routes: cli.Redact.Routes,
+		Rules:  rules,
+		Mask:   cli.Redact.With,
+	}, log)
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/jsontransform"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.JSONTransformCLI
+	config.Parse(&cli, "Envoy external processor that rewrites JSON request bodies with per-route jq templates.")
+
+	log := logger.New(cli.Log)
+
+	rules, err := jsontransform.LoadRules(cli.Transform.RulesFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load transform rules")
+	}
+	audit.Record("transform-rules", audit.File(cli.Transform.RulesFile), rules)
+
+	log.Info().
+		Str("rules_file", cli.Transform.RulesFile).
+		Int("routes", len(rules.Routes)).
+		Int("max_body_bytes", cli.Transform.MaxBodyBytes).
+		Dur("timeout", cli.Transform.Timeout).
+		Msg("json transform configured")
+
+	factory := jsontransform.NewProcessorFactory(jsontransform.Config{
+		MaxBodyBytes: cli.Transform.MaxBodyBytes,
+		Timeout:      cli.Transform.Timeout,
+	}, rules, log)
+	go kube.WatchFile(context.Background(), cli.Transform.RulesFile, log, func(data []byte) {
+		rules, err := jsontransform.ParseRules(data)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to reload transform rules, keeping previous")
+			return
+		}
+		factory.SetRules(rules)
+		log.Info().Int("routes", len(rules.Routes)).Msg("transform rules reloaded")
+		audit.Record("transform-rules", audit.File(cli.Transform.RulesFile), rules)
+	})
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
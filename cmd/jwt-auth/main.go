@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	jwtauthproc "github.com/mnixry/envoy-ext-procs/internal/extproc/jwtauth"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/jwtauth"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.JWTAuthCLI
+	config.Parse(&cli, "Envoy external processor that validates JWT bearer tokens against a JWKS and forwards their claims.")
+
+	log := logger.New(cli.Log)
+	if err := httpclient.Configure(httpclient.NewDefaults(cli.HTTPClient)); err != nil {
+		log.Fatal().Err(err).Msg("invalid outbound HTTP client configuration")
+	}
+
+	verifier, err := jwtauth.New(jwtauth.Config{
+		JWKSURL:            cli.JWT.JWKSURL,
+		Issuer:             cli.JWT.Issuer,
+		Audiences:          cli.JWT.Audiences,
+		Algorithms:         cli.JWT.Algorithms,
+		Leeway:             cli.JWT.Leeway,
+		RefreshInterval:    cli.JWT.RefreshInterval,
+		MinRefreshInterval: cli.JWT.MinRefreshInterval,
+		Timeout:            cli.JWT.Timeout,
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("JWT verifier init failed")
+	}
+
+	log.Info().
+		Str("jwks_url", cli.JWT.JWKSURL).
+		Str("issuer", cli.JWT.Issuer).
+		Strs("audiences", cli.JWT.Audiences).
+		Dur("refresh_interval", cli.JWT.RefreshInterval).
+		Strs("claims", cli.JWT.Claims).
+		Str("header_prefix", cli.JWT.HeaderPrefix).
+		Bool("strip_authorization", cli.JWT.StripAuthorization).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("jwt auth configured")
+
+	factory := jwtauthproc.NewProcessorFactory(verifier, log,
+		jwtauthproc.WithClaims(cli.JWT.Claims...),
+		jwtauthproc.WithHeaderPrefix(cli.JWT.HeaderPrefix),
+		jwtauthproc.WithStripAuthorization(cli.JWT.StripAuthorization),
+		jwtauthproc.WithDecisionMode(extproc.DecisionMode(cli.Decision.Mode)),
+	)
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	ldapauthproc "github.com/mnixry/envoy-ext-procs/internal/extproc/ldapauth"
+	"github.com/mnixry/envoy-ext-procs/internal/ldapauth"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.LDAPAuthCLI
+	config.Parse(&cli, "Envoy external processor that authorizes identities by LDAP/Active Directory group membership.")
+
+	log := logger.New(cli.Log)
+
+	client, err := ldapauth.New(ldapauth.Config{
+		URL:            cli.LDAP.URL,
+		BindDN:         cli.LDAP.BindDN,
+		BindPassword:   cli.LDAP.BindPassword,
+		StartTLS:       cli.LDAP.StartTLS,
+		BaseDN:         cli.LDAP.BaseDN,
+		UserFilter:     cli.LDAP.UserFilter,
+		GroupAttribute: cli.LDAP.GroupAttribute,
+		NestedGroups:   cli.LDAP.NestedGroups,
+		PoolSize:       cli.LDAP.PoolSize,
+		CacheSize:      cli.LDAP.CacheSize,
+		CacheTTL:       cli.LDAP.CacheTTL,
+		Timeout:        cli.LDAP.Timeout,
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("ldap client init failed")
+	}
+	defer client.Close()
+
+	log.Info().
+		Str("url", cli.LDAP.URL).
+		Str("base_dn", cli.LDAP.BaseDN).
+		Bool("nested_groups", cli.LDAP.NestedGroups).
+		Int("pool_size", cli.LDAP.PoolSize).
+		Dur("cache_ttl", cli.LDAP.CacheTTL).
+		Str("identity_header", cli.LDAP.IdentityHeader).
+		Strs("default_groups", cli.LDAP.DefaultGroups).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("ldap authorization configured")
+
+	opts := []ldapauthproc.Option{
+		ldapauthproc.WithIdentityHeader(cli.LDAP.IdentityHeader),
+		ldapauthproc.WithGroupsHeader(cli.LDAP.GroupsHeader),
+		ldapauthproc.WithDefaultGroups(cli.LDAP.DefaultGroups...),
+		ldapauthproc.WithDecisionMode(extproc.DecisionMode(cli.Decision.Mode)),
+	}
+	groupMatch := "dn"
+	if cli.LDAP.MatchCN {
+		groupMatch = "cn"
+		opts = append(opts, ldapauthproc.WithCNMatching())
+	}
+	for prefix, groups := range cli.LDAP.RouteGroups {
+		opts = append(opts, ldapauthproc.WithRouteGroups(prefix, strings.Split(groups, "|")...))
+	}
+	factory := ldapauthproc.NewProcessorFactory(client, log, opts...)
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+		{Name: "ldap_group_match", Value: groupMatch, Permissive: cli.LDAP.MatchCN},
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
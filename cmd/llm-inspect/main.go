@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"regexp"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/llm"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.LLMCLI
+	ctx := config.Parse(&cli, "Envoy external processor that inspects OpenAI-compatible LLM API traffic.")
+
+	log := logger.New(cli.Log)
+
+	var patterns []*regexp.Regexp
+	for _, expr := range append(llm.DefaultRedactPatterns, cli.LLM.RedactPatterns...) {
+		re, err := regexp.Compile(expr)
+		ctx.FatalIfErrorf(err, "invalid redact pattern")
+		patterns = append(patterns, re)
+	}
+
+	log.Info().
+		Strs("routes", cli.LLM.Routes).
+		Int("max_request_bytes", cli.LLM.MaxRequestBytes).
+		Int("max_prompt_tokens", cli.LLM.MaxPromptTokens).
+		Int("max_completion_tokens", cli.LLM.MaxCompletionTokens).
+		Strs("allowed_models", cli.LLM.AllowedModels).
+		Bool("log_prompts", cli.LLM.LogPrompts).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("llm inspection configured")
+
+	factory := llm.NewProcessorFactory(llm.Config{
+		Routes:              cli.LLM.Routes,
+		MaxRequestBytes:     cli.LLM.MaxRequestBytes,
+		MaxPromptTokens:     cli.LLM.MaxPromptTokens,
+		MaxCompletionTokens: cli.LLM.MaxCompletionTokens,
+		AllowedModels:       cli.LLM.AllowedModels,
+		LogPrompts:          cli.LLM.LogPrompts,
+		LogMaxChars:         cli.LLM.LogMaxChars,
+		RedactPatterns:      patterns,
+		UsageHeaderPrefix:   cli.LLM.UsageHeaderPrefix,
+		DecisionMode:        extproc.DecisionMode(cli.Decision.Mode),
+	}, log)
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+
+	envoy_service_ratelimit_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/dynconfig"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/kvstore"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/ratelimit"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	var cli config.RateLimitServiceCLI
+	config.Parse(&cli, "Envoy RateLimitService (RLS) compatible server backed by the shared token bucket limiter.")
+
+	log := logger.New(cli.Log)
+
+	rules, err := ratelimit.LoadRules(cli.RateLimit.RulesFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("rate limit rules load failed")
+	}
+	audit.Record("ratelimit-rules", audit.File(cli.RateLimit.RulesFile), rules)
+	var limiter ratelimit.Limiter
+	if cli.Store.Driver == string(kvstore.DriverMemory) {
+		if limiter, err = ratelimit.NewMemoryLimiter(cli.RateLimit.CacheSize); err != nil {
+			log.Fatal().Err(err).Msg("rate limiter init failed")
+		}
+	} else {
+		store, err := kvstore.Open(kvstore.NewConfig(cli.Store, log))
+		if err != nil {
+			log.Fatal().Err(err).Msg("state store init failed")
+		}
+		defer store.Close()
+		limiter = ratelimit.NewSharedLimiter(store)
+	}
+
+	log.Info().
+		Str("rules_file", cli.RateLimit.RulesFile).
+		Str("domain", rules.Domain).
+		Int("cache_size", cli.RateLimit.CacheSize).
+		Str("store", cli.Store.Driver).
+		Bool("response_headers", cli.RateLimit.ResponseHeaders).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("rate limit service configured")
+
+	rls := ratelimit.NewRLSServer(rules, limiter, log,
+		ratelimit.WithResponseHeaders(cli.RateLimit.ResponseHeaders),
+		ratelimit.WithDecisionMode(extproc.DecisionMode(cli.Decision.Mode)),
+	)
+	go kube.WatchFile(context.Background(), cli.RateLimit.RulesFile, log, func(data []byte) {
+		rules, err := ratelimit.ParseRules(data)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to reload rate limit rules, keeping previous")
+			return
+		}
+		rls.SetRules(rules)
+		log.Info().Str("domain", rules.Domain).Msg("rate limit rules reloaded")
+		audit.Record("ratelimit-rules", audit.File(cli.RateLimit.RulesFile), rules)
+	})
+
+	registry := dynconfig.NewRegistry(log)
+	registry.Register("ratelimit-rules", func(data []byte) (func(), error) {
+		rules, err := ratelimit.ParseRules(data)
+		if err != nil {
+			return nil, err
+		}
+		return func() { rls.SetRules(rules) }, nil
+	})
+	if err := dynconfig.Start(context.Background(), dynconfig.Config{
+		ADS: dynconfig.ADSConfig{
+			Address:    cli.DynConfig.Server,
+			NodeID:     cli.DynConfig.NodeID,
+			Cluster:    cli.DynConfig.Cluster,
+			CAFile:     cli.DynConfig.CAFile,
+			ServerName: cli.DynConfig.ServerName,
+			Plaintext:  cli.DynConfig.Plaintext,
+		},
+		File:         cli.DynConfig.File,
+		PollInterval: cli.DynConfig.PollInterval,
+	}, registry); err != nil {
+		log.Fatal().Err(err).Msg("dynamic configuration failed")
+	}
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+		{Name: "store_tls_skip_verify", Value: strconv.FormatBool(cli.Store.TLSInsecureSkipVerify), Permissive: cli.Store.TLSInsecureSkipVerify},
+		{Name: "store_gossip_authenticated", Value: strconv.FormatBool(cli.Store.GossipSecretKey != ""), Permissive: cli.Store.Driver == string(kvstore.DriverGossip) && cli.Store.GossipSecretKey == ""},
+		{Name: "dynconfig_plaintext", Value: strconv.FormatBool(cli.DynConfig.Plaintext), Permissive: cli.DynConfig.Server != "" && cli.DynConfig.Plaintext},
+	}
+
+	if err := server.Serve(srvCfg, log, func(gs *grpc.Server, mux *http.ServeMux) {
+		envoy_service_ratelimit_v3.RegisterRateLimitServiceServer(gs, rls)
+		mux.Handle("GET /admin/dynconfig", registry)
+	}); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
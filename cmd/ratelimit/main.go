@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	ratelimitproc "github.com/mnixry/envoy-ext-procs/internal/extproc/ratelimit"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/kvstore"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/ratelimit"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.RateLimitProcessorCLI
+	config.Parse(&cli, "Envoy external processor that rate limits requests per client with token buckets, optionally shared through Redis.")
+
+	log := logger.New(cli.Log)
+
+	var limit ratelimit.Limit
+	if cli.RateLimit.Limit != "" {
+		var err error
+		if limit, err = ratelimit.ParseLimit(cli.RateLimit.Limit); err != nil {
+			log.Fatal().Err(err).Msg("invalid default rate limit")
+		}
+	}
+	key, err := ratelimitproc.ParseKey(cli.RateLimit.Key)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid rate limit key")
+	}
+	var rules *ratelimitproc.Rules
+	if cli.RateLimit.RulesFile != "" {
+		if rules, err = ratelimitproc.LoadRules(cli.RateLimit.RulesFile); err != nil {
+			log.Fatal().Err(err).Msg("rate limit rules load failed")
+		}
+		audit.Record("ratelimit-rules", audit.File(cli.RateLimit.RulesFile), rules)
+	}
+
+	var opts []ratelimitproc.Option
+	if cli.Store.Driver != string(kvstore.DriverMemory) {
+		store, err := kvstore.Open(kvstore.NewConfig(cli.Store, log))
+		if err != nil {
+			log.Fatal().Err(err).Msg("state store init failed")
+		}
+		defer store.Close()
+		opts = append(opts, ratelimitproc.WithLimiter(ratelimit.NewSharedLimiter(store)))
+	}
+
+	factory, err := ratelimitproc.NewProcessorFactory(ratelimitproc.Config{
+		DefaultLimit:    limit,
+		DefaultKey:      key,
+		CacheSize:       cli.RateLimit.CacheSize,
+		FailClosed:      cli.RateLimit.FailurePolicy == "closed",
+		ResponseHeaders: cli.RateLimit.ResponseHeaders,
+		DecisionMode:    extproc.DecisionMode(cli.Decision.Mode),
+	}, rules, log, opts...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("rate limiter init failed")
+	}
+	if cli.RateLimit.RulesFile != "" {
+		go kube.WatchFile(context.Background(), cli.RateLimit.RulesFile, log, func(data []byte) {
+			rules, err := ratelimitproc.ParseRules(data)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to reload rate limit rules, keeping previous")
+				return
+			}
+			factory.SetRules(rules)
+			log.Info().Int("rules", len(rules.Rules)).Msg("rate limit rules reloaded")
+			audit.Record("ratelimit-rules", audit.File(cli.RateLimit.RulesFile), rules)
+		})
+	}
+
+	log.Info().
+		Str("limit", cli.RateLimit.Limit).
+		Str("key", cli.RateLimit.Key).
+		Str("rules_file", cli.RateLimit.RulesFile).
+		Int("cache_size", cli.RateLimit.CacheSize).
+		Str("store", cli.Store.Driver).
+		Str("failure_policy", cli.RateLimit.FailurePolicy).
+		Bool("response_headers", cli.RateLimit.ResponseHeaders).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("rate limiting configured")
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+		{Name: "store_tls_skip_verify", Value: strconv.FormatBool(cli.Store.TLSInsecureSkipVerify), Permissive: cli.Store.TLSInsecureSkipVerify},
+		{Name: "store_gossip_authenticated", Value: strconv.FormatBool(cli.Store.GossipSecretKey != ""), Permissive: cli.Store.Driver == string(kvstore.DriverGossip) && cli.Store.GossipSecretKey == ""},
+		{Name: "ratelimit_failure_policy", Value: cli.RateLimit.FailurePolicy, Permissive: cli.Store.Driver != string(kvstore.DriverMemory) && cli.RateLimit.FailurePolicy == "open"},
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
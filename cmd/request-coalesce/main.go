@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/coalesce"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.CoalesceCLI
+	config.Parse(&cli, "Envoy external processor that coalesces concurrent identical GET requests.")
+
+	log := logger.New(cli.Log)
+
+	log.Info().
+		Strs("routes", cli.Coalesce.Routes).
+		Dur("max_wait", cli.Coalesce.MaxWait).
+		Strs("vary_headers", cli.Coalesce.VaryHeaders).
+		Bool("include_authenticated", cli.Coalesce.IncludeAuthenticated).
+		Msg("request coalescing configured")
+
+	factory := coalesce.NewProcessorFactory(coalesce.Config{
+		Routes:               cli.Coalesce.Routes,
+		MaxWait:              cli.Coalesce.MaxWait,
+		VaryHeaders:          cli.Coalesce.VaryHeaders,
+		IncludeAuthenticated: cli.Coalesce.IncludeAuthenticated,
+		MarkerHeader:         cli.Coalesce.MarkerHeader,
+	}, log)
+
+	if err := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	samlproc "github.com/mnixry/envoy-ext-procs/internal/extproc/saml"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/securecookie"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/samber/oops"
+)
+
+func main() {
+	var cli config.SAMLCLI
+	config.Parse(&cli, "Envoy external processor performing SP-initiated SAML SSO with a signed session cookie.")
+
+	log := logger.New(cli.Log)
+	if err := httpclient.Configure(httpclient.NewDefaults(cli.HTTPClient)); err != nil {
+		log.Fatal().Err(err).Msg("invalid outbound HTTP client configuration")
+	}
+
+	sp, err := newServiceProvider(cli.SAML)
+	if err != nil {
+		log.Fatal().Err(err).Msg("saml service provider init failed")
+	}
+	cookies, err := securecookie.New([]byte(cli.SAML.SessionKey))
+	if err != nil {
+		log.Fatal().Err(err).Msg("session cookie codec init failed")
+	}
+
+	log.Info().
+		Str("entity_id", cli.SAML.EntityID).
+		Str("acs_url", cli.SAML.ACSURL).
+		Str("idp_entity_id", sp.IDPMetadata.EntityID).
+		Dur("session_ttl", cli.SAML.SessionTTL).
+		Bool("sign_requests", cli.SAML.SignRequests).
+		Bool("allow_idp_initiated", cli.SAML.AllowIDPInitiated).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("saml processor configured")
+
+	factory := samlproc.NewProcessorFactory(samlproc.Config{
+		ServiceProvider:  sp,
+		Cookies:          cookies,
+		SessionCookie:    cli.SAML.SessionCookie,
+		SessionTTL:       cli.SAML.SessionTTL,
+		SubjectHeader:    cli.SAML.SubjectHeader,
+		AttributeHeaders: cli.SAML.AttributeHeaders,
+		MetadataPath:     cli.SAML.MetadataPath,
+		SkipPaths:        cli.SAML.SkipPaths,
+		DecisionMode:     extproc.DecisionMode(cli.Decision.Mode),
+	}, log)
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+		{Name: "allow_idp_initiated", Value: strconv.FormatBool(cli.SAML.AllowIDPInitiated), Permissive: cli.SAML.AllowIDPInitiated},
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
+
+func newServiceProvider(cfg config.SAMLConfig) (*saml.ServiceProvider, error) {
+	acsURL, err := url.Parse(cfg.ACSURL)
+	if err != nil || !acsURL.IsAbs() {
+		return nil, oops.In("saml").Code(errcode.InvalidACSURL).With("acs_url", cfg.ACSURL).Errorf("ACS URL must be absolute")
+	}
+
+	var idpMetadata *saml.EntityDescriptor
+	switch {
+	case cfg.IDPMetadataURL != "":
+		mdURL, err := url.Parse(cfg.IDPMetadataURL)
+		if err != nil {
+			return nil, oops.In("saml").Code(errcode.InvalidMetadataURL).Wrapf(err, "invalid IdP metadata URL")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.MetadataTimeout)
+		defer cancel()
+		idpMetadata, err = samlsp.FetchMetadata(ctx, httpclient.New("saml-metadata", 0), *mdURL)
+		if err != nil {
+			return nil, oops.In("saml").Code(errcode.FetchMetadataFailed).With("url", cfg.IDPMetadataURL).Wrapf(err, "failed to fetch IdP metadata")
+		}
+	case cfg.IDPMetadataFile != "":
+		data, err := os.ReadFile(cfg.IDPMetadataFile)
+		if err != nil {
+			return nil, oops.In("saml").Code(errcode.ReadMetadataFailed).With("path", cfg.IDPMetadataFile).Wrapf(err, "failed to read IdP metadata")
+		}
+		if idpMetadata, err = samlsp.ParseMetadata(data); err != nil {
+			return nil, oops.In("saml").Code(errcode.ParseMetadataFailed).With("path", cfg.IDPMetadataFile).Wrapf(err, "failed to parse IdP metadata")
+		}
+	default:
+		return nil, oops.In("saml").Code(errcode.MissingMetadata).Errorf("one of --saml-idp-metadata-url or --saml-idp-metadata-file is required")
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          cfg.EntityID,
+		AcsURL:            *acsURL,
+		MetadataURL:       *acsURL.ResolveReference(&url.URL{Path: cfg.MetadataPath}),
+		IDPMetadata:       idpMetadata,
+		AllowIDPInitiated: cfg.AllowIDPInitiated,
+	}
+
+	if cfg.SPCertFile != "" && cfg.SPKeyFile != "" {
+		pair, err := tls.LoadX509KeyPair(cfg.SPCertFile, cfg.SPKeyFile)
+		if err != nil {
+			return nil, oops.In("saml").Code(errcode.LoadKeypairFailed).Wrapf(err, "failed to load SP key pair")
+		}
+		if sp.Certificate, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, oops.In("saml").Code(errcode.ParseCertFailed).Wrapf(err, "failed to parse SP certificate")
+		}
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, oops.In("saml").Code(errcode.UnsupportedKey).Errorf("SP private key cannot sign")
+		}
+		sp.Key = signer
+		if cfg.SignRequests {
+			sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+			if _, ok := signer.Public().(*ecdsa.PublicKey); ok {
+				sp.SignatureMethod = dsig.ECDSASHA256SignatureMethod
+			}
+		}
+	} else if cfg.SignRequests {
+		return nil, oops.In("saml").Code(errcode.MissingKeypair).Errorf("--saml-sign-requests requires --saml-sp-cert-file and --saml-sp-key-file")
+	}
+	return sp, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/sticky"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/securecookie"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.StickyCLI
+	config.Parse(&cli, "Envoy external processor that pins clients to a backend shard with a signed cookie.")
+
+	log := logger.New(cli.Log)
+
+	cookies, err := securecookie.New([]byte(cli.Sticky.CookieKey))
+	if err != nil {
+		log.Fatal().Err(err).Msg("session cookie codec init failed")
+	}
+
+	log.Info().
+		Strs("shards", cli.Sticky.Shards).
+		Str("cookie_name", cli.Sticky.CookieName).
+		Dur("cookie_ttl", cli.Sticky.CookieTTL).
+		Str("header", cli.Sticky.Header).
+		Msg("sticky session configured")
+
+	factory, err := sticky.NewProcessorFactory(sticky.Config{
+		Shards:     cli.Sticky.Shards,
+		Cookies:    cookies,
+		CookieName: cli.Sticky.CookieName,
+		CookieTTL:  cli.Sticky.CookieTTL,
+		Secure:     !cli.Sticky.Insecure,
+		Header:     cli.Sticky.Header,
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("sticky session init failed")
+	}
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		{Name: "insecure_cookie", Value: strconv.FormatBool(cli.Sticky.Insecure), Permissive: cli.Sticky.Insecure},
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	introspectionproc "github.com/mnixry/envoy-ext-procs/internal/extproc/introspection"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/introspection"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+)
+
+func main() {
+	var cli config.IntrospectionCLI
+	config.Parse(&cli, "Envoy external processor that authorizes opaque OAuth2 bearer tokens via RFC 7662 introspection.")
+
+	log := logger.New(cli.Log)
+	if err := httpclient.Configure(httpclient.NewDefaults(cli.HTTPClient)); err != nil {
+		log.Fatal().Err(err).Msg("invalid outbound HTTP client configuration")
+	}
+
+	introspector, err := introspection.New(introspection.Config{
+		Endpoint:      cli.Introspection.Endpoint,
+		ClientID:      cli.Introspection.ClientID,
+		ClientSecret:  cli.Introspection.ClientSecret,
+		TokenTypeHint: cli.Introspection.TokenTypeHint,
+		CacheSize:     cli.Introspection.CacheSize,
+		CacheTTL:      cli.Introspection.CacheTTL,
+		Timeout:       cli.Introspection.Timeout,
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("introspection client init failed")
+	}
+
+	log.Info().
+		Str("endpoint", cli.Introspection.Endpoint).
+		Int("cache_size", cli.Introspection.CacheSize).
+		Dur("cache_ttl", cli.Introspection.CacheTTL).
+		Dur("timeout", cli.Introspection.Timeout).
+		Strs("required_scopes", cli.Introspection.RequiredScopes).
+		Str("header_prefix", cli.Introspection.HeaderPrefix).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("token introspection configured")
+
+	opts := []introspectionproc.Option{
+		introspectionproc.WithRequiredScopes(cli.Introspection.RequiredScopes...),
+		introspectionproc.WithHeaderPrefix(cli.Introspection.HeaderPrefix),
+		introspectionproc.WithDecisionMode(extproc.DecisionMode(cli.Decision.Mode)),
+	}
+	for prefix, scopes := range cli.Introspection.RouteScopes {
+		opts = append(opts, introspectionproc.WithRouteScopes(prefix, strings.Fields(scopes)...))
+	}
+	factory := introspectionproc.NewProcessorFactory(introspector, log, opts...)
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/record"
+	"github.com/mnixry/envoy-ext-procs/internal/featureflag"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/jsonredact"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/recording"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+	"github.com/mnixry/envoy-ext-procs/internal/spill"
+)
+
+func main() {
+	var cli config.RecordCLI
+	config.Parse(&cli, "Envoy external processor that records sampled, redacted request/response exchanges.")
+
+	log := logger.New(cli.Log)
+	if err := httpclient.Configure(httpclient.NewDefaults(cli.HTTPClient)); err != nil {
+		log.Fatal().Err(err).Msg("invalid outbound HTTP client configuration")
+	}
+
+	var fields []jsonredact.Rule
+	for _, raw := range cli.Record.RedactFields {
+		path, err := jsonredact.ParsePath(raw)
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		fields = append(fields, jsonredact.Rule{Path: path, Action: jsonredact.ActionMask})
+	}
+
+	writer, err := recording.NewWriter(recording.WriterConfig{
+		Dir:      cli.Record.Dir,
+		Format:   recording.Format(cli.Record.Format),
+		MaxSize:  int64(cli.Record.MaxFileSize) << 20,
+		MaxFiles: cli.Record.MaxFiles,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create capture writer")
+	}
+
+	log.Info().
+		Str("dir", cli.Record.Dir).
+		Str("format", cli.Record.Format).
+		Strs("routes", cli.Record.Routes).
+		Float64("sample_percent", cli.Record.SamplePercent).
+		Int("spill_bytes", cli.Record.SpillBytes).
+		Strs("redact_fields", cli.Record.RedactFields).
+		Str("feature_flags", cli.FeatureFlags.Provider).
+		Msg("traffic recording configured")
+
+	flags, err := featureflag.New(featureflag.Config{
+		Provider:        cli.FeatureFlags.Provider,
+		File:            cli.FeatureFlags.File,
+		PollInterval:    cli.FeatureFlags.PollInterval,
+		OFREPURL:        cli.FeatureFlags.OFREPURL,
+		OFREPToken:      cli.FeatureFlags.OFREPToken,
+		TargetingHeader: cli.FeatureFlags.TargetingHeader,
+		Timeout:         cli.FeatureFlags.Timeout,
+		CacheSize:       cli.FeatureFlags.CacheSize,
+		CacheTTL:        cli.FeatureFlags.CacheTTL,
+	}, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create feature flag provider")
+	}
+	defer flags.Close()
+
+	factory := record.NewProcessorFactory(record.Config{
+		Routes:        cli.Record.Routes,
+		SamplePercent: cli.Record.SamplePercent,
+		MaxBodyBytes:  cli.Record.MaxBodyBytes,
+		SpillBytes:    cli.Record.SpillBytes,
+		SpillDir:      cli.Record.SpillDir,
+		SpillBudget:   spill.NewBudget(int64(cli.Record.SpillDisk) << 20),
+		RedactHeaders: cli.Record.RedactHeaders,
+		RedactQuery:   cli.Record.RedactQuery,
+		RedactFields:  fields,
+		Flags:         flags,
+	}, writer, log)
+
+	runErr := server.Run(server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics), factory, log)
+	// Finish the current capture file so HAR documents stay valid.
+	if err := writer.Close(); err != nil {
+		log.Error().Err(err).Msg("failed to close capture file")
+	}
+	if runErr != nil {
+		log.Fatal().Err(runErr).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	xmlguardproc "github.com/mnixry/envoy-ext-procs/internal/extproc/xmlguard"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+	"github.com/mnixry/envoy-ext-procs/internal/xmlguard"
+)
+
+func main() {
+	var cli config.XMLGuardCLI
+	config.Parse(&cli, "Envoy external processor that rejects malformed, oversized or entity-declaring XML and SOAP request bodies.")
+
+	log := logger.New(cli.Log)
+
+	log.Info().
+		Strs("routes", cli.XML.Routes).
+		Int("max_body_bytes", cli.XML.MaxBodyBytes).
+		Int("max_depth", cli.XML.MaxDepth).
+		Int("max_elements", cli.XML.MaxElements).
+		Int("max_attributes", cli.XML.MaxAttributes).
+		Bool("allow_dtd", cli.XML.AllowDTD).
+		Str("decision_mode", cli.Decision.Mode).
+		Msg("xml guard configured")
+
+	factory := xmlguardproc.NewProcessorFactory(xmlguardproc.Config{
+		Routes:       cli.XML.Routes,
+		MaxBodyBytes: cli.XML.MaxBodyBytes,
+		Validation: xmlguard.Options{
+			Limits: xmlguard.Limits{
+				MaxDepth:      cli.XML.MaxDepth,
+				MaxElements:   cli.XML.MaxElements,
+				MaxAttributes: cli.XML.MaxAttributes,
+			},
+			AllowDTD: cli.XML.AllowDTD,
+		},
+		OperationHeader: cli.XML.OperationHeader,
+		DecisionMode:    extproc.DecisionMode(cli.Decision.Mode),
+	}, log)
+
+	srvCfg := server.NewConfig(cli.GRPC, cli.Health, cli.Admin, cli.Metrics)
+	srvCfg.Posture = []server.PostureSetting{
+		server.DecisionSetting(extproc.DecisionMode(cli.Decision.Mode)),
+		{Name: "allow_dtd", Value: strconv.FormatBool(cli.XML.AllowDTD), Permissive: cli.XML.AllowDTD},
+	}
+
+	if err := server.Run(srvCfg, factory, log); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
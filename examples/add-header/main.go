@@ -0,0 +1,60 @@
+// Command add-header is a minimal custom processor built on the public SDK:
+// it adds a header to every request and rejects requests missing another
+// one, with the flags, TLS, health checks and metrics of the bundled
+// processors.
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/pkg/extproc"
+	"github.com/mnixry/envoy-ext-procs/pkg/server"
+)
+
+type cli struct {
+	Server   server.Flags         `embed:""`
+	Decision server.DecisionFlags `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+
+	Header   string `name:"header" env:"HEADER" default:"x-hello" help:"Header added to every request."`
+	Value    string `name:"value" env:"VALUE" default:"world" help:"Value of --header."`
+	Required string `name:"required" env:"REQUIRED" help:"Header requests must carry; empty requires none."`
+}
+
+// processor handles the request headers of one request; the other phases
+// are continued by BaseProcessor.
+type processor struct {
+	extproc.BaseProcessor
+	cfg     *cli
+	decider extproc.Decider
+}
+
+func (p *processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders
+}
+
+func (p *processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	if p.cfg.Required != "" && ctx.Headers.Get(p.cfg.Required) == "" {
+		return p.decider.Reject(ctx.GetRequestID(), "missing_header",
+			extproc.ImmediateResult(http.StatusBadRequest, nil, []byte("missing "+p.cfg.Required+"\n")), nil)
+	}
+	return extproc.ContinueWithHeaders([]*extproc.HeaderValueOption{extproc.SetHeader(p.cfg.Header, p.cfg.Value)})
+}
+
+func main() {
+	var cfg cli
+	server.Parse(&cfg, "Example processor adding a header to every request.")
+	log := cfg.Server.Logger()
+
+	decider := extproc.NewDecider("add-header", extproc.DecisionMode(cfg.Decision.Mode), log)
+	factory := extproc.FactoryFunc(func() extproc.Processor {
+		return &processor{cfg: &cfg, decider: decider}
+	})
+
+	if err := server.Run(cfg.Server, factory, log,
+		server.WithPosture(server.DecisionSetting(decider.Mode())),
+	); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,110 @@
+// Package adminauth guards the admin API endpoints that change runtime
+// state, such as blue-green weights or the ipfilter denylist. Reads are left
+// open for probes and scrapers; every other method needs a bearer token or a
+// verified client certificate, or, with neither configured, a loopback
+// caller.
+package adminauth
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Config holds how admin callers authenticate.
+type Config struct {
+	// Token, if set, admits requests with "Authorization: Bearer <Token>".
+	Token string
+	// ClientCerts admits requests with a client certificate verified by the
+	// listener (see tls.Config.ClientCAs).
+	ClientCerts bool
+}
+
+// Enabled reports whether callers can authenticate; without it only
+// loopback callers may change state.
+func (c Config) Enabled() bool {
+	return c.Token != "" || c.ClientCerts
+}
+
+// principalKey is the context key of the principal Require verified.
+type principalKey struct{}
+
+// tokenPrincipal is the principal of requests admitted by the token.
+const tokenPrincipal = "bearer token"
+
+// Require serves safe (GET, HEAD and OPTIONS) requests with next and the
+// others only once they authenticated with cfg. Refused requests get 401.
+func Require(cfg Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if principal, ok := authenticate(cfg, r); ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+			return
+		}
+		if cfg.Token != "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		}
+		msg := "admin changes need a bearer token or client certificate"
+		if !cfg.Enabled() {
+			msg = "admin changes are only accepted from loopback without --admin-token or --admin-client-ca-file"
+		}
+		http.Error(w, msg, http.StatusUnauthorized)
+	})
+}
+
+// authenticate returns the principal of r, empty for loopback callers when
+// authentication is not configured.
+func authenticate(cfg Config, r *http.Request) (string, bool) {
+	if cfg.ClientCerts {
+		if subject, ok := certSubject(r); ok {
+			return subject, true
+		}
+	}
+	if cfg.Token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) == 1 {
+			return tokenPrincipal, true
+		}
+	}
+	if !cfg.Enabled() && loopback(r.RemoteAddr) {
+		return "", true
+	}
+	return "", false
+}
+
+// Principal returns who r authenticated as: the subject of a verified client
+// certificate or "bearer token". It is false for unauthenticated requests,
+// including loopback callers admitted without authentication.
+func Principal(r *http.Request) (string, bool) {
+	if subject, ok := certSubject(r); ok {
+		return subject, true
+	}
+	principal, _ := r.Context().Value(principalKey{}).(string)
+	return principal, principal != ""
+}
+
+// certSubject returns the subject of the client certificate of r, if the
+// listener verified it.
+func certSubject(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.String(), true
+}
+
+// loopback reports whether addr, a host:port, is a loopback address.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.Unmap().IsLoopback()
+}
@@ -0,0 +1,57 @@
+package adminauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequire(t *testing.T) {
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "operator"}}}}}
+	unverified := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "mallory"}}}}
+	for _, tc := range []struct {
+		name          string
+		cfg           Config
+		method        string
+		remote        string
+		authorization string
+		tls           *tls.ConnectionState
+		want          int
+		principal     string
+	}{
+		{name: "read", method: http.MethodGet, remote: "192.0.2.1:1234", want: http.StatusOK},
+		{name: "remote change", method: http.MethodPut, remote: "192.0.2.1:1234", want: http.StatusUnauthorized},
+		{name: "loopback change", method: http.MethodPut, remote: "127.0.0.1:1234", want: http.StatusOK},
+		{name: "ipv6 loopback change", method: http.MethodDelete, remote: "[::1]:1234", want: http.StatusOK},
+		{name: "loopback without token", cfg: Config{Token: "s3cret"}, method: http.MethodPost, remote: "127.0.0.1:1234", want: http.StatusUnauthorized},
+		{name: "wrong token", cfg: Config{Token: "s3cret"}, method: http.MethodPut, remote: "192.0.2.1:1234", authorization: "Bearer guess", want: http.StatusUnauthorized},
+		{name: "token", cfg: Config{Token: "s3cret"}, method: http.MethodPut, remote: "192.0.2.1:1234", authorization: "Bearer s3cret", want: http.StatusOK, principal: "bearer token"},
+		{name: "verified certificate", cfg: Config{ClientCerts: true}, method: http.MethodPut, remote: "192.0.2.1:1234", tls: verified, want: http.StatusOK, principal: "CN=operator"},
+		{name: "unverified certificate", cfg: Config{ClientCerts: true}, method: http.MethodPut, remote: "192.0.2.1:1234", tls: unverified, want: http.StatusUnauthorized},
+		{name: "certificate without client certs", cfg: Config{Token: "s3cret"}, method: http.MethodPut, remote: "192.0.2.1:1234", tls: verified, want: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var principal string
+			h := Require(tc.cfg, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				principal, _ = Principal(r)
+			}))
+			r := httptest.NewRequest(tc.method, "/admin/bluegreen", nil)
+			r.RemoteAddr = tc.remote
+			r.TLS = tc.tls
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Fatalf("status %d, want %d", w.Code, tc.want)
+			}
+			if tc.want == http.StatusOK && tc.method != http.MethodGet && principal != tc.principal {
+				t.Errorf("principal %q, want %q", principal, tc.principal)
+			}
+		})
+	}
+}
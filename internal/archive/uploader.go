@@ -0,0 +1,243 @@
+// Package archive ships completed log files to S3-compatible object storage
+// (AWS S3, GCS through its XML API, Tencent COS) and removes the local
+// copies once stored.
+package archive
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/logsink"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// Provider selects endpoint defaults.
+type Provider string
+
+const (
+	ProviderS3  Provider = "s3"
+	ProviderGCS Provider = "gcs"
+	ProviderCOS Provider = "cos"
+)
+
+// Config holds object storage settings.
+type Config struct {
+	Provider Provider
+	// Endpoint overrides the provider's endpoint, e.g. for MinIO.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses objects as endpoint/bucket/key instead of
+	// bucket.endpoint/key.
+	PathStyle bool
+	// Prefix is an object key prefix template. It accepts strftime
+	// directives, evaluated against the file's modification time, and
+	// {hostname}.
+	Prefix string
+	// KeepLocal keeps files after a successful upload.
+	KeepLocal bool
+	// MaxRetries bounds upload attempts after the first one.
+	MaxRetries int
+	// RetryBackoff is the initial delay between attempts, doubled each time.
+	RetryBackoff time.Duration
+	Timeout      time.Duration
+}
+
+// Uploader uploads queued files in the background, one at a time.
+type Uploader struct {
+	cfg      Config
+	endpoint *url.URL
+	hostname string
+	client   *http.Client
+	log      zerolog.Logger
+
+	queue chan string
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// New creates an Uploader. Call Start to begin uploading.
+func New(cfg Config, log zerolog.Logger) (*Uploader, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		switch cfg.Provider {
+		case ProviderS3:
+			endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+		case ProviderGCS:
+			endpoint = "https://storage.googleapis.com"
+		case ProviderCOS:
+			endpoint = "https://cos." + cfg.Region + ".myqcloud.com"
+		}
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, oops.
+			In("archive").
+			Code(errcode.InvalidEndpoint).
+			With("provider", cfg.Provider).
+			With("endpoint", endpoint).
+			Errorf("invalid object storage endpoint %q", endpoint)
+	}
+	if cfg.Region == "" {
+		// GCS ignores the region but SigV4 needs one.
+		cfg.Region = "auto"
+	}
+	hostname, _ := os.Hostname()
+	return &Uploader{
+		cfg:      cfg,
+		endpoint: u,
+		hostname: hostname,
+		client:   httpclient.New("archive", cfg.Timeout),
+		log:      log.With().Str("component", "archive").Str("bucket", cfg.Bucket).Logger(),
+		queue:    make(chan string, 1024),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// Enqueue schedules path for upload. It never blocks; if the queue is full
+// the file stays on disk and is picked up by the next Start.
+func (u *Uploader) Enqueue(path string) {
+	select {
+	case u.queue <- path:
+	default:
+		u.log.Warn().Str("file", path).Msg("upload queue full, leaving file on disk")
+	}
+}
+
+// Depth returns the number of files waiting in the queue.
+func (u *Uploader) Depth() int {
+	return len(u.queue)
+}
+
+// Start uploads the given leftover files, then queued ones, until Close.
+func (u *Uploader) Start(pending []string) {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		for _, path := range pending {
+			if !u.upload(path) {
+				return
+			}
+		}
+		for {
+			select {
+			case path := <-u.queue:
+				if !u.upload(path) {
+					return
+				}
+			case <-u.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops uploading after the current file. Files still queued remain
+// on disk.
+func (u *Uploader) Close() {
+	close(u.stop)
+	u.wg.Wait()
+}
+
+// upload ships path with retries. It returns false if the uploader was
+// stopped while waiting to retry.
+func (u *Uploader) upload(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		u.log.Warn().Err(err).Str("file", path).Msg("skipping missing log file")
+		return true
+	}
+	key := u.key(path, info.ModTime())
+	backoff := u.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := u.put(path, key, info.Size())
+		if err == nil {
+			break
+		}
+		if attempt >= u.cfg.MaxRetries {
+			u.log.Error().Err(err).Str("file", path).Str("key", key).Msg("giving up uploading log file")
+			return true
+		}
+		u.log.Warn().Err(err).Str("file", path).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("log upload failed, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-u.stop:
+			return false
+		}
+		backoff *= 2
+	}
+
+	u.log.Info().Str("file", path).Str("key", key).Int64("size", info.Size()).Msg("uploaded log file")
+	if !u.cfg.KeepLocal {
+		if err := os.Remove(path); err != nil {
+			u.log.Warn().Err(err).Str("file", path).Msg("failed to remove uploaded log file")
+		}
+	}
+	return true
+}
+
+func (u *Uploader) put(path, key string, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return oops.In("archive").Code(errcode.ReadFailed).With("file", path).Wrap(err)
+	}
+	defer file.Close()
+
+	target := *u.endpoint
+	if u.cfg.PathStyle {
+		target.Path = "/" + u.cfg.Bucket + "/" + key
+	} else {
+		target.Host = u.cfg.Bucket + "." + target.Host
+		target.Path = "/" + key
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target.String(), file)
+	if err != nil {
+		return oops.In("archive").Code(errcode.RequestBuildFailed).Wrap(err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	signV4(req, u.cfg.AccessKey, u.cfg.SecretKey, u.cfg.Region, unsignedPayload, time.Now())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return oops.In("archive").Code(errcode.UploadFailed).With("url", target.String()).Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return oops.
+			In("archive").
+			Code(errcode.UploadFailed).
+			With("url", target.String()).
+			With("status", resp.StatusCode).
+			Errorf("object storage returned %s", resp.Status)
+	}
+	return nil
+}
+
+// key builds the object key of a file from the prefix template.
+func (u *Uploader) key(path string, modTime time.Time) string {
+	prefix := strings.ReplaceAll(u.cfg.Prefix, "{hostname}", u.hostname)
+	prefix = logsink.Strftime(prefix, modTime.UTC())
+	key := prefix + filepath.Base(path)
+	return strings.TrimPrefix(key, "/")
+}
+
+// String describes the destination for logging.
+func (u *Uploader) String() string {
+	return fmt.Sprintf("%s://%s/%s", u.cfg.Provider, u.endpoint.Host, u.cfg.Bucket)
+}
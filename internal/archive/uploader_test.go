@@ -0,0 +1,106 @@
+package archive
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// newTestUploader returns an Uploader storing into srv with path-style
+// addressing and a file to upload.
+func newTestUploader(t *testing.T, srv *httptest.Server, keepLocal bool) (*Uploader, string) {
+	t.Helper()
+	u, err := New(Config{
+		Provider:     ProviderS3,
+		Endpoint:     srv.URL,
+		Region:       "us-east-1",
+		Bucket:       "logs",
+		AccessKey:    "AKID",
+		SecretKey:    "secret",
+		PathStyle:    true,
+		Prefix:       "access/",
+		KeepLocal:    keepLocal,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+		Timeout:      5 * time.Second,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "access.log.1")
+	if err := os.WriteFile(path, []byte("line\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return u, path
+}
+
+// failingServer answers the first failures PUTs with 503 and stores the
+// later ones.
+func failingServer(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32, *atomic.Value) {
+	var attempts atomic.Int32
+	var stored atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") ||
+			r.Header.Get("x-amz-content-sha256") != unsignedPayload {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if attempts.Add(1) <= failures {
+			http.Error(w, "slow down", http.StatusServiceUnavailable)
+			return
+		}
+		stored.Store(r.URL.Path + " " + string(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &attempts, &stored
+}
+
+func TestUploadRetries(t *testing.T) {
+	srv, attempts, stored := failingServer(t, 2)
+	u, path := newTestUploader(t, srv, false)
+	if !u.upload(path) {
+		t.Fatal("upload reported the uploader stopped")
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("%d attempts, want 3", got)
+	}
+	if got, _ := stored.Load().(string); got != "/logs/access/access.log.1 line\n" {
+		t.Errorf("stored %q", got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("uploaded file not removed: %v", err)
+	}
+}
+
+func TestUploadKeepsFileOnFailure(t *testing.T) {
+	srv, attempts, _ := failingServer(t, 100)
+	u, path := newTestUploader(t, srv, false)
+	u.upload(path)
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("%d attempts, want 1 plus 2 retries", got)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file not kept after failed upload: %v", err)
+	}
+}
+
+func TestUploadKeepLocal(t *testing.T) {
+	srv, _, stored := failingServer(t, 0)
+	u, path := newTestUploader(t, srv, true)
+	u.upload(path)
+	if stored.Load() == nil {
+		t.Fatal("file not uploaded")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file not kept with KeepLocal: %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+// Package audit records the configuration changes applied at runtime: rules
+// and list files reloaded from disk or Kubernetes, updates pushed by a
+// control plane and changes made through the admin API. Each change is
+// logged with a redacted diff against the previous contents and who or what
+// triggered it, and the most recent changes are kept for /admin/changes.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/adminauth"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultRedactKeys are the key fragments whose values are redacted.
+var DefaultRedactKeys = []string{
+	"password", "passphrase", "secret", "token", "credential",
+	"private_key", "api_key", "apikey", "cookie", "authorization",
+}
+
+// maxDiffLines bounds the diff kept per change.
+const maxDiffLines = 200
+
+// Trigger describes what applied a change.
+type Trigger struct {
+	// Source is "file", "configmap", "secret", "flags", "ads", "admin" or
+	// "kubernetes".
+	Source string `json:"source"`
+	// Actor identifies the file or reference, the control plane or the
+	// admin API caller.
+	Actor string `json:"actor,omitempty"`
+	// Version is the source's version of the configuration, if any.
+	Version string `json:"version,omitempty"`
+}
+
+// File returns the Trigger of a file path or ConfigMap/Secret reference
+// (see kube.ParseRef).
+func File(path string) Trigger {
+	if ref, ok, err := kube.ParseRef(path); ok && err == nil {
+		return Trigger{Source: string(ref.Kind), Actor: path}
+	}
+	return Trigger{Source: "file", Actor: path}
+}
+
+// Admin returns the Trigger of an admin API request: the principal it
+// authenticated as (see adminauth.Principal) with the caller's address, or
+// only the address of callers admitted without authentication. Headers the
+// caller chooses are not trusted.
+func Admin(r *http.Request) Trigger {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	actor := addr
+	if principal, ok := adminauth.Principal(r); ok {
+		actor = principal + " (" + addr + ")"
+	}
+	return Trigger{Source: "admin", Actor: actor}
+}
+
+// Change is one applied configuration change.
+type Change struct {
+	Time     time.Time `json:"time"`
+	Resource string    `json:"resource"`
+	Trigger
+	// Initial marks the first contents recorded for the resource, which
+	// have nothing to be compared with.
+	Initial bool `json:"initial,omitempty"`
+	// Diff lists removed ("- path: value") and added ("+ path: value")
+	// settings, with sensitive values replaced by a short hash.
+	Diff []string `json:"diff,omitempty"`
+}
+
+// Config holds audit trail settings.
+type Config struct {
+	// HistorySize is the number of changes kept; 0 keeps none, but changes
+	// are still logged.
+	HistorySize int
+	// RedactKeys are key fragments, matched case-insensitively, whose values
+	// are redacted; empty uses DefaultRedactKeys.
+	RedactKeys []string
+}
+
+// Trail diffs and keeps the changes of every resource.
+type Trail struct {
+	mu      sync.Mutex
+	cfg     Config
+	log     zerolog.Logger
+	current map[string][]string
+	history []Change
+	now     func() time.Time
+}
+
+// NewTrail creates an empty Trail.
+func NewTrail(cfg Config, log zerolog.Logger) *Trail {
+	t := &Trail{current: make(map[string][]string), now: time.Now}
+	t.Configure(cfg, log)
+	return t
+}
+
+// Configure replaces the settings, keeping the recorded contents.
+func (t *Trail) Configure(cfg Config, log zerolog.Logger) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(cfg.RedactKeys) == 0 {
+		cfg.RedactKeys = DefaultRedactKeys
+	}
+	keys := make([]string, len(cfg.RedactKeys))
+	for i, key := range cfg.RedactKeys {
+		keys[i] = strings.ToLower(key)
+	}
+	cfg.RedactKeys = keys
+	t.cfg = cfg
+	t.log = log.With().Str("component", "audit").Logger()
+	t.trimLocked()
+}
+
+// Record notes that config, now applied to resource, was triggered by
+// trigger. config is a YAML or JSON document, or any value marshaled to
+// one; other raw contents, such as IP lists, are compared line by line.
+// Contents equal to the previous ones are not recorded.
+func (t *Trail) Record(resource string, trigger Trigger, config any) {
+	sensitive := trigger.Source == "secret"
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := flatten(config, t.cfg.RedactKeys, sensitive)
+	previous, seen := t.current[resource]
+	change := Change{Time: t.now(), Resource: resource, Trigger: trigger, Initial: !seen}
+	if seen {
+		change.Diff = diff(previous, lines)
+		if len(change.Diff) == 0 {
+			return
+		}
+	}
+	t.current[resource] = lines
+
+	if seen {
+		t.log.Info().
+			Str("resource", resource).
+			Str("source", trigger.Source).
+			Str("actor", trigger.Actor).
+			Str("version", trigger.Version).
+			Strs("diff", change.Diff).
+			Msg("configuration changed")
+	}
+	t.history = append(t.history, change)
+	t.trimLocked()
+}
+
+func (t *Trail) trimLocked() {
+	if n := len(t.history) - max(t.cfg.HistorySize, 0); n > 0 {
+		t.history = append(t.history[:0:0], t.history[n:]...)
+	}
+}
+
+// History returns the kept changes, newest first.
+func (t *Trail) History() []Change {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]Change, len(t.history))
+	for i, c := range t.history {
+		out[len(out)-1-i] = c
+	}
+	return out
+}
+
+// ServeHTTP serves the History as JSON; ?resource= filters it.
+func (t *Trail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	changes := t.History()
+	if resource := r.URL.Query().Get("resource"); resource != "" {
+		filtered := changes[:0]
+		for _, c := range changes {
+			if c.Resource == resource {
+				filtered = append(filtered, c)
+			}
+		}
+		changes = filtered
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Changes []Change `json:"changes"`
+	}{changes})
+}
+
+// std is the process-wide Trail served by the admin API.
+var std = NewTrail(Config{HistorySize: 100, RedactKeys: DefaultRedactKeys}, zerolog.Nop())
+
+// Configure replaces the settings of the process-wide Trail.
+func Configure(cfg Config, log zerolog.Logger) {
+	std.Configure(cfg, log)
+}
+
+// Record records a change on the process-wide Trail.
+func Record(resource string, trigger Trigger, config any) {
+	std.Record(resource, trigger, config)
+}
+
+// Handler serves the history of the process-wide Trail.
+func Handler() http.Handler {
+	return std
+}
+
+// flatten renders config as "path: value" lines, lists of mappings keyed
+// by their name, id or prefix where unique.
+func flatten(config any, redactKeys []string, redactAll bool) []string {
+	var doc any
+	switch c := config.(type) {
+	case []byte:
+		if yaml.Unmarshal(c, &doc) != nil {
+			doc = nil
+		}
+		if _, ok := doc.(map[string]any); !ok {
+			if _, ok := doc.([]any); !ok {
+				return rawLines(c, redactAll)
+			}
+		}
+	default:
+		data, err := yaml.Marshal(config)
+		if err == nil {
+			err = yaml.Unmarshal(data, &doc)
+		}
+		if err != nil {
+			return []string{"<unrepresentable: " + err.Error() + ">"}
+		}
+	}
+	var lines []string
+	var walk func(path string, v any, redact bool)
+	walk = func(path string, v any, redact bool) {
+		switch v := v.(type) {
+		case map[string]any:
+			for key, child := range v {
+				walk(join(path, key), child, redact || sensitiveKey(key, redactKeys))
+			}
+		case []any:
+			ids := itemIDs(v)
+			for i, child := range v {
+				switch {
+				case ids != nil:
+					walk(path+"["+ids[i]+"]", child, redact)
+				case isScalar(child):
+					walk(path+"[]", child, redact)
+				default:
+					walk(path+"["+strconv.Itoa(i)+"]", child, redact)
+				}
+			}
+		default:
+			value := scalar(v)
+			if redact || redactAll {
+				value = redacted(value)
+			}
+			lines = append(lines, path+": "+value)
+		}
+	}
+	walk("", doc, false)
+	return lines
+}
+
+// rawLines returns the non-empty, non-comment lines of data.
+func rawLines(data []byte, redactAll bool) []string {
+	var lines []string
+	for line := range strings.SplitSeq(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if redactAll {
+			line = redacted(line)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// itemIDs returns the name, id or prefix of every item of list, or nil
+// unless all items are mappings with distinct values of the same field.
+func itemIDs(list []any) []string {
+	for _, field := range []string{"name", "id", "prefix"} {
+		ids := make([]string, 0, len(list))
+		seen := make(map[string]bool, len(list))
+		for _, item := range list {
+			m, ok := item.(map[string]any)
+			if !ok {
+				return nil
+			}
+			v, ok := m[field]
+			if !ok || !isScalar(v) {
+				break
+			}
+			id, ok := v.(string)
+			if !ok {
+				id = scalar(v)
+			}
+			if seen[id] {
+				break
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		if len(ids) == len(list) {
+			return ids
+		}
+	}
+	return nil
+}
+
+func isScalar(v any) bool {
+	switch v.(type) {
+	case map[string]any, []any:
+		return false
+	}
+	return true
+}
+
+func scalar(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sensitiveKey(key string, redactKeys []string) bool {
+	key = strings.ToLower(key)
+	for _, fragment := range redactKeys {
+		if strings.Contains(key, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted replaces value with a short hash, so changes stay visible.
+func redacted(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "<redacted sha256:" + hex.EncodeToString(sum[:4]) + ">"
+}
+
+// diff returns the lines only in old, prefixed "- ", then those only in
+// new, prefixed "+ ", each sorted by path.
+func diff(old, new []string) []string {
+	remaining := make(map[string]int, len(new))
+	for _, line := range new {
+		remaining[line]++
+	}
+	var removed []string
+	for _, line := range old {
+		if remaining[line] > 0 {
+			remaining[line]--
+			continue
+		}
+		removed = append(removed, "- "+line)
+	}
+	var added []string
+	for _, line := range new {
+		if remaining[line] > 0 {
+			remaining[line]--
+			added = append(added, "+ "+line)
+		}
+	}
+	slices.Sort(removed)
+	slices.Sort(added)
+	out := append(removed, added...)
+	if len(out) > maxDiffLines {
+		out = append(out[:maxDiffLines], "... "+strconv.Itoa(len(out)-maxDiffLines)+" more")
+	}
+	return out
+}
@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/adminauth"
+	"github.com/rs/zerolog"
+)
+
+func TestRecord(t *testing.T) {
+	trail := NewTrail(Config{HistorySize: 2, RedactKeys: []string{"Password"}}, zerolog.Nop())
+	rules := func(limit, password string) []byte {
+		return []byte(`
+rules:
+  - {name: login, limit: ` + limit + `}
+  - {name: api, limit: 10/second}
+store: {addrs: [a, b], password: ` + password + `}
+`)
+	}
+
+	trail.Record("rules", File("rules.yaml"), rules("5/minute", "hunter2"))
+	trail.Record("rules", File("rules.yaml"), rules("5/minute", "hunter2"))
+	trail.Record("rules", File("configmap://ns/rules/rules.yaml"), rules("1/minute", "swordfish"))
+
+	history := trail.History()
+	if len(history) != 2 || !history[1].Initial || history[0].Initial {
+		t.Fatalf("history = %+v, want the initial contents and one change", history)
+	}
+	change := history[0]
+	if change.Source != "configmap" || change.Actor != "configmap://ns/rules/rules.yaml" {
+		t.Errorf("trigger = %+v", change.Trigger)
+	}
+	want := []string{
+		`- rules[login].limit: "5/minute"`,
+		`+ rules[login].limit: "1/minute"`,
+	}
+	for _, line := range want {
+		if !slices.Contains(change.Diff, line) {
+			t.Errorf("diff %q lacks %q", change.Diff, line)
+		}
+	}
+	if len(change.Diff) != 4 {
+		t.Errorf("diff = %q, want 4 lines", change.Diff)
+	}
+	for _, line := range change.Diff {
+		if strings.Contains(line, "hunter2") || strings.Contains(line, "swordfish") {
+			t.Errorf("diff line %q not redacted", line)
+		}
+	}
+
+	trail.Record("other", File("other.yaml"), []byte("a: 1"))
+	if got := trail.History(); len(got) != 2 || got[0].Resource != "other" {
+		t.Errorf("history not bounded to the newest changes: %+v", got)
+	}
+}
+
+func TestRecordRawAndStructured(t *testing.T) {
+	trail := NewTrail(Config{HistorySize: 10}, zerolog.Nop())
+	trail.Record("allow", File("secret://ns/ips/list"), []byte("# office\n10.0.0.0/8\n192.0.2.0/24\n"))
+	trail.Record("allow", File("secret://ns/ips/list"), []byte("10.0.0.0/8\n198.51.100.0/24\n"))
+	diff := trail.History()[0].Diff
+	if len(diff) != 2 || !strings.HasPrefix(diff[0], "- <redacted sha256:") || !strings.HasPrefix(diff[1], "+ <redacted sha256:") {
+		t.Errorf("secret list diff = %q", diff)
+	}
+
+	type route struct {
+		Prefix string   `yaml:"prefix"`
+		Hosts  []string `yaml:"hosts"`
+	}
+	trail.Record("routes", Trigger{Source: "ads", Version: "1"}, []route{{Prefix: "/a", Hosts: []string{"x", "y"}}})
+	trail.Record("routes", Trigger{Source: "ads", Version: "2"}, []route{{Prefix: "/a", Hosts: []string{"y", "x", "z"}}})
+	if diff := trail.History()[0].Diff; !slices.Equal(diff, []string{`+ [/a].hosts[]: "z"`}) {
+		t.Errorf("structured diff = %q", diff)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/admin/bluegreen", nil)
+	r.RemoteAddr = "192.0.2.9:5123"
+	if got := Admin(r).Actor; got != "192.0.2.9" {
+		t.Errorf("anonymous actor = %q", got)
+	}
+	// Client-chosen identities are ignored.
+	r.Header.Set("X-Admin-User", "alice")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice"}}}}
+	if got := Admin(r).Actor; got != "192.0.2.9" {
+		t.Errorf("unverified actor = %q", got)
+	}
+
+	r.TLS.VerifiedChains = [][]*x509.Certificate{r.TLS.PeerCertificates}
+	if got := Admin(r).Actor; got != "CN=alice (192.0.2.9)" {
+		t.Errorf("client certificate actor = %q", got)
+	}
+
+	r.TLS = nil
+	r.Header.Set("Authorization", "Bearer s3cret")
+	var actor string
+	adminauth.Require(adminauth.Config{Token: "s3cret"}, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		actor = Admin(r).Actor
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if actor != "bearer token (192.0.2.9)" {
+		t.Errorf("token actor = %q", actor)
+	}
+}
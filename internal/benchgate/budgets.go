@@ -0,0 +1,102 @@
+// Package benchgate compares two sets of Go benchmark results with benchstat
+// and checks the changes against performance budgets, so regressions fail a
+// build instead of being spotted by eye.
+package benchgate
+
+import (
+	"os"
+	"regexp"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+)
+
+// Limit bounds the change of a benchmark's metrics. Percentages are
+// increases over the base run; unset fields are not checked.
+type Limit struct {
+	// Time is the largest significant slowdown of sec/op, in percent.
+	Time *float64 `yaml:"time,omitempty"`
+	// Bytes is the largest significant growth of B/op, in percent.
+	Bytes *float64 `yaml:"bytes,omitempty"`
+	// Allocs is the largest growth of allocs/op, in percent. Allocation
+	// counts are deterministic, so any growth past it fails.
+	Allocs *float64 `yaml:"allocs,omitempty"`
+	// MaxAllocs caps allocs/op of the new run, e.g. 0 for paths that must
+	// stay allocation-free.
+	MaxAllocs *float64 `yaml:"max_allocs,omitempty"`
+}
+
+// merge returns l with the fields set in o replaced.
+func (l Limit) merge(o Limit) Limit {
+	if o.Time != nil {
+		l.Time = o.Time
+	}
+	if o.Bytes != nil {
+		l.Bytes = o.Bytes
+	}
+	if o.Allocs != nil {
+		l.Allocs = o.Allocs
+	}
+	if o.MaxAllocs != nil {
+		l.MaxAllocs = o.MaxAllocs
+	}
+	return l
+}
+
+// Rule overrides the default limit for benchmarks whose name matches.
+type Rule struct {
+	// Name is a regular expression matched against the benchmark name
+	// without the "Benchmark" prefix, e.g. "Emit/.*/fast".
+	Name  string `yaml:"name"`
+	Limit `yaml:",inline"`
+
+	re *regexp.Regexp
+}
+
+// Budgets are the limits of a comparison.
+type Budgets struct {
+	Default Limit `yaml:"default"`
+	// Benchmarks are checked in order; the first match applies.
+	Benchmarks []Rule `yaml:"benchmarks"`
+}
+
+// ParseBudgets parses and validates a budgets file.
+func ParseBudgets(data []byte) (*Budgets, error) {
+	var b Budgets
+	if err := yaml.Unmarshal(data, &b); err != nil {
+		return nil, oops.In("benchgate").Code(errcode.InvalidConfig).Wrapf(err, "failed to parse benchmark budgets")
+	}
+	for i, r := range b.Benchmarks {
+		re, err := regexp.Compile(r.Name)
+		if err != nil {
+			return nil, oops.
+				In("benchgate").
+				Code(errcode.InvalidPattern).
+				With("index", i).
+				With("name", r.Name).
+				Wrapf(err, "invalid benchmark pattern")
+		}
+		b.Benchmarks[i].re = re
+	}
+	return &b, nil
+}
+
+// LoadBudgets reads and parses the budgets file at path.
+func LoadBudgets(path string) (*Budgets, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, oops.In("benchgate").Code(errcode.ReadConfigFailed).With("path", path).Wrapf(err, "failed to read benchmark budgets")
+	}
+	return ParseBudgets(data)
+}
+
+// limitFor returns the limit of the named benchmark.
+func (b *Budgets) limitFor(name string) Limit {
+	for _, r := range b.Benchmarks {
+		if r.re.MatchString(name) {
+			return b.Default.merge(r.Limit)
+		}
+	}
+	return b.Default
+}
@@ -0,0 +1,122 @@
+package benchgate
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+	"golang.org/x/perf/benchstat"
+)
+
+// Violation is a benchmark metric over its budget.
+type Violation struct {
+	Benchmark string
+	// Metric is benchstat's metric name: time/op, alloc/op or allocs/op.
+	Metric   string
+	Old, New float64
+	// Delta is the change in percent.
+	Delta float64
+	// Limit describes the budget exceeded.
+	Limit string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s %s: %.4g -> %.4g (%+.2f%%), over budget %s", v.Benchmark, v.Metric, v.Old, v.New, v.Delta, v.Limit)
+}
+
+// Report is the outcome of a comparison.
+type Report struct {
+	Tables     []*benchstat.Table
+	Violations []Violation
+}
+
+// WriteText writes the benchstat tables and the violations.
+func (r *Report) WriteText(w io.Writer) {
+	benchstat.FormatText(w, r.Tables)
+	if len(r.Violations) == 0 {
+		fmt.Fprintln(w, "all benchmarks within budget")
+		return
+	}
+	fmt.Fprintf(w, "%d budget violations:\n", len(r.Violations))
+	for _, v := range r.Violations {
+		fmt.Fprintf(w, "  %s\n", v)
+	}
+}
+
+// Options configure a comparison.
+type Options struct {
+	// Alpha is the p-value below which a time or memory change is
+	// significant; zero uses benchstat's 0.05.
+	Alpha float64
+}
+
+// Compare reads `go test -bench` output of a base and a new run, ideally
+// with -count of 5 or more, and checks the new run against budgets.
+// Benchmarks missing from either run are shown but not checked.
+func Compare(base, head io.Reader, budgets *Budgets, opts Options) (*Report, error) {
+	c := &benchstat.Collection{Alpha: opts.Alpha, SplitBy: []string{"pkg"}}
+	if err := c.AddFile("old", base); err != nil {
+		return nil, oops.In("benchgate").Code(errcode.ParseError).Wrapf(err, "failed to read base results")
+	}
+	if err := c.AddFile("new", head); err != nil {
+		return nil, oops.In("benchgate").Code(errcode.ParseError).Wrapf(err, "failed to read new results")
+	}
+
+	report := &Report{Tables: c.Tables()}
+	for _, table := range report.Tables {
+		for _, row := range table.Rows {
+			if len(row.Metrics) != 2 || row.Metrics[0].Unit == "" || row.Metrics[1].Unit == "" {
+				continue
+			}
+			name := row.Benchmark
+			if pkg, ok := strings.CutPrefix(row.Group, "pkg:"); ok {
+				name = pkg + "." + name
+			}
+			report.Violations = append(report.Violations, check(table.Metric, row, name, budgets.limitFor(row.Benchmark))...)
+		}
+	}
+	return report, nil
+}
+
+// check returns the violations of one row.
+func check(metric string, row *benchstat.Row, name string, limit Limit) []Violation {
+	old, cur := row.Metrics[0].Mean, row.Metrics[1].Mean
+	violation := func(format string, budget float64) Violation {
+		return Violation{Benchmark: name, Metric: metric, Old: old, New: cur, Delta: pctDelta(old, cur), Limit: fmt.Sprintf(format, budget)}
+	}
+
+	var violations []Violation
+	switch metric {
+	case "time/op", "alloc/op":
+		budget := limit.Time
+		if metric == "alloc/op" {
+			budget = limit.Bytes
+		}
+		// Only significant regressions count; noise is not a failure.
+		if budget != nil && row.Change < 0 && row.PctDelta > *budget {
+			violations = append(violations, violation("+%g%%", *budget))
+		}
+	case "allocs/op":
+		if limit.MaxAllocs != nil && cur > *limit.MaxAllocs {
+			violations = append(violations, violation("max %g", *limit.MaxAllocs))
+		} else if limit.Allocs != nil && pctDelta(old, cur) > *limit.Allocs {
+			violations = append(violations, violation("+%g%%", *limit.Allocs))
+		}
+	}
+	return violations
+}
+
+// pctDelta is the change from old to cur in percent; growth from zero is
+// infinite.
+func pctDelta(old, cur float64) float64 {
+	switch {
+	case old == cur:
+		return 0
+	case old == 0:
+		return math.Inf(1)
+	}
+	return (cur/old - 1) * 100
+}
@@ -0,0 +1,66 @@
+package benchgate
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// results formats count runs of a benchmark in `go test -bench` output.
+func results(name string, ns []float64, allocs int) string {
+	var b strings.Builder
+	b.WriteString("pkg: example.com/p\n")
+	for _, v := range ns {
+		fmt.Fprintf(&b, "Benchmark%s-8\t1000000\t%g ns/op\t64 B/op\t%d allocs/op\n", name, v, allocs)
+	}
+	return b.String()
+}
+
+func TestCompare(t *testing.T) {
+	budgets, err := ParseBudgets([]byte(`
+default: {time: 10, bytes: 10, allocs: 0}
+benchmarks:
+  - name: '^Fast'
+    max_allocs: 0
+  - name: '^Noisy'
+    time: 50
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := []float64{100, 101, 99, 100, 102, 98}
+	slower := []float64{130, 131, 129, 130, 132, 128}
+	for _, tc := range []struct {
+		name       string
+		old, new   string
+		violations []string
+	}{
+		{"unchanged", results("Path", base, 3), results("Path", base, 3), nil},
+		{"faster", results("Path", slower, 3), results("Path", base, 2), nil},
+		{"slower", results("Path", base, 3), results("Path", slower, 3), []string{"time/op"}},
+		{"within rule budget", results("Noisy", base, 3), results("Noisy", slower, 3), nil},
+		{"more allocs", results("Path", base, 3), results("Path", base, 4), []string{"allocs/op"}},
+		{"allocation-free", results("Fast", base, 0), results("Fast", base, 1), []string{"allocs/op"}},
+		{"missing", results("Path", base, 3), results("Other", slower, 9), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			report, err := Compare(strings.NewReader(tc.old), strings.NewReader(tc.new), budgets, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range report.Violations {
+				got = append(got, v.Metric)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.violations) {
+				t.Errorf("violations %v, want %v", report.Violations, tc.violations)
+			}
+		})
+	}
+}
+
+func TestParseBudgetsInvalidPattern(t *testing.T) {
+	if _, err := ParseBudgets([]byte("benchmarks: [{name: '('}]")); err == nil {
+		t.Fatal("expected an error")
+	}
+}
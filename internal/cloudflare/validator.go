@@ -0,0 +1,145 @@
+// Package cloudflare checks addresses against Cloudflare's published edge
+// IP ranges.
+package cloudflare
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/ipfilter"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+type Config struct {
+	// IPv4URL and IPv6URL serve the ranges as text, one CIDR per line.
+	IPv4URL string
+	IPv6URL string
+	// RefreshInterval is how often the ranges are fetched again.
+	RefreshInterval time.Duration
+	Timeout         time.Duration
+}
+
+type Validator struct {
+	cfg    Config
+	client *http.Client
+	ranges atomic.Pointer[ipfilter.Ranges]
+	stop   context.CancelFunc
+	log    zerolog.Logger
+}
+
+// New fetches the ranges and refreshes them every RefreshInterval until
+// Close. A failed refresh keeps the previous ranges.
+func New(cfg Config, log zerolog.Logger) (*Validator, error) {
+	for _, u := range []string{cfg.IPv4URL, cfg.IPv6URL} {
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, oops.
+				In("cloudflare").
+				Code(errcode.InvalidEndpoint).
+				With("url", u).
+				Wrapf(err, "invalid Cloudflare IP list URL")
+		}
+	}
+	v := &Validator{
+		cfg:    cfg,
+		client: httpclient.New("cloudflare", cfg.Timeout),
+		log:    log.With().Str("component", "cloudflare").Logger(),
+	}
+	if err := v.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	v.stop = cancel
+	go v.refreshLoop(ctx)
+	return v, nil
+}
+
+// IsCloudflareIP reports whether ip is a Cloudflare edge address.
+func (v *Validator) IsCloudflareIP(ip netip.Addr) (bool, error) {
+	return v.ranges.Load().Contains(ip), nil
+}
+
+// Refresh fetches both lists and swaps them in together.
+func (v *Validator) Refresh(ctx context.Context) error {
+	var prefixes []netip.Prefix
+	for _, u := range []string{v.cfg.IPv4URL, v.cfg.IPv6URL} {
+		list, err := v.fetch(ctx, u)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, list...)
+	}
+	ranges := ipfilter.NewRanges(prefixes)
+	v.ranges.Store(ranges)
+	v.log.Info().Int("prefixes", len(prefixes)).Int("ranges", ranges.Len()).Msg("Cloudflare IP ranges loaded")
+	return nil
+}
+
+func (v *Validator) fetch(ctx context.Context, u string) ([]netip.Prefix, error) {
+	ctx, cancel := context.WithTimeout(ctx, v.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, oops.In("cloudflare").Code(errcode.RequestBuildFailed).With("url", u).Wrapf(err, "failed to build request")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, oops.In("cloudflare").Code(errcode.APIRequestFailed).With("url", u).Wrapf(err, "Cloudflare IP list request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, oops.
+			In("cloudflare").
+			Code(errcode.APIBadStatus).
+			With("url", u).
+			With("status", resp.StatusCode).
+			Errorf("Cloudflare IP list returned status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, oops.In("cloudflare").Code(errcode.APIRequestFailed).With("url", u).Wrapf(err, "failed to read Cloudflare IP list")
+	}
+	prefixes, err := ipfilter.ParseList(data)
+	if err != nil {
+		return nil, oops.In("cloudflare").Code(errcode.APIDecodeFailed).With("url", u).Wrapf(err, "invalid Cloudflare IP list")
+	}
+	// An empty list is far more likely a broken response than Cloudflare
+	// retiring every range.
+	if len(prefixes) == 0 {
+		return nil, oops.In("cloudflare").Code(errcode.APIDecodeFailed).With("url", u).Errorf("Cloudflare IP list is empty")
+	}
+	return prefixes, nil
+}
+
+func (v *Validator) refreshLoop(ctx context.Context) {
+	interval := v.cfg.RefreshInterval
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := v.Refresh(ctx); err != nil {
+			v.log.Error().Err(err).Msg("failed to refresh Cloudflare IP ranges, keeping previous")
+		}
+	}
+}
+
+// Close stops refreshing.
+func (v *Validator) Close() error {
+	v.stop()
+	return nil
+}
@@ -0,0 +1,61 @@
+package cloudflare
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+)
+
+func TestValidator(t *testing.T) {
+	var v4 atomic.Value
+	v4.Store("173.245.48.0/20\n103.21.244.0/22\n")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ips-v4", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte(v4.Load().(string))) })
+	mux.HandleFunc("/ips-v6", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("2400:cb00::/32\n")) })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	v, err := New(Config{
+		IPv4URL:         srv.URL + "/ips-v4",
+		IPv6URL:         srv.URL + "/ips-v6",
+		RefreshInterval: time.Hour,
+		Timeout:         5 * time.Second,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { _ = v.Close() })
+
+	check := func(ip string, want bool) {
+		t.Helper()
+		got, err := v.IsCloudflareIP(netip.MustParseAddr(ip))
+		if err != nil || got != want {
+			t.Errorf("IsCloudflareIP(%s) = %v, %v; want %v", ip, got, err, want)
+		}
+	}
+	check("173.245.48.9", true)
+	check("::ffff:103.21.244.1", true)
+	check("2400:cb00::1", true)
+	check("203.0.113.7", false)
+
+	// A broken list keeps the previous ranges.
+	v4.Store("")
+	if err := v.Refresh(context.Background()); !errcode.Is(err, errcode.APIDecodeFailed) {
+		t.Fatalf("Refresh with empty list = %v, want APIDecodeFailed", err)
+	}
+	check("173.245.48.9", true)
+
+	v4.Store("198.51.100.0/24\n")
+	if err := v.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	check("173.245.48.9", false)
+	check("198.51.100.1", true)
+}
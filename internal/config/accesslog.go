@@ -1,9 +1,120 @@
 package config
 
+import "time"
+
 // AccessLogCLI is the CLI configuration for the access log command.
 type AccessLogCLI struct {
-	GRPC           GRPCConfig   `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
-	Health         HealthConfig `embed:"" prefix:"health-" envprefix:"HEALTH_"`
-	Log            LogConfig    `embed:"" prefix:"log-" envprefix:"LOG_"`
-	ExcludeHeaders []string     `name:"exclude-headers" env:"EXCLUDE_HEADERS" help:"Comma-separated list of headers to exclude from logging."`
+	Serve    ServeCmd    `cmd:"" default:"1" help:"Run the ext_proc gRPC server."`
+	Selftest SelftestCmd `cmd:"" help:"Run synthetic requests through the processor and report pass/fail."`
+
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC                GRPCConfig             `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health              HealthConfig           `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Log                 LogConfig              `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Admin               AdminConfig            `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics             MetricsConfig          `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	HTTPClient          HTTPClientConfig       `embed:"" prefix:"http-client-" envprefix:"HTTP_CLIENT_"`
+	Output              LogOutputConfig        `embed:"" prefix:"output-" envprefix:"OUTPUT_"`
+	Archive             ArchiveConfig          `embed:"" prefix:"archive-" envprefix:"ARCHIVE_"`
+	Loki                LokiConfig             `embed:"" prefix:"loki-" envprefix:"LOKI_"`
+	Kafka               KafkaConfig            `embed:"" prefix:"kafka-" envprefix:"KAFKA_"`
+	Anonymize           AnonymizeConfig        `embed:"" prefix:"anonymize-" envprefix:"ANONYMIZE_"`
+	LeaderElection      LeaderElectionConfig   `embed:"" prefix:"leader-election-" envprefix:"LEADER_ELECTION_"`
+	PolicyController    PolicyControllerConfig `embed:"" prefix:"policy-controller-" envprefix:"POLICY_CONTROLLER_"`
+	Schema              string                 `name:"accesslog-schema" env:"ACCESSLOG_SCHEMA" default:"caddy" help:"Access log field set: 'caddy', 'ecs' or a versioned strict set: 'custom-v1', 'custom-v2', 'custom-v3'."`
+	Format              string                 `name:"accesslog-format" env:"ACCESSLOG_FORMAT" enum:"json,clf,combined,custom" default:"json" help:"Entry format: 'json' (in --accesslog-schema), 'clf' (Common Log Format), 'combined' (Apache Combined) or 'custom' (--accesslog-log-format)."`
+	LogFormat           string                 `name:"accesslog-log-format" env:"ACCESSLOG_LOG_FORMAT" help:"Apache LogFormat string of --accesslog-format=custom, e.g. '%h %t \"%r\" %>s %D'."`
+	Encoder             string                 `name:"accesslog-encoder" env:"ACCESSLOG_ENCODER" enum:"json,fast" default:"json" help:"Entry encoder: 'json' (encoding/json) or 'fast' (allocation-free, for caddy and custom-vN; strings are not HTML-escaped)."`
+	OverridesFile       string                 `name:"overrides-file" env:"OVERRIDES_FILE" help:"YAML file or 'configmap://[namespace/]name/key' / 'secret://...' reference of per-host/per-route overrides (schema, output, sample_rate, exclude_headers, omit_headers); reloaded when modified."`
+	OverridesReload     time.Duration          `name:"overrides-reload-interval" env:"OVERRIDES_RELOAD_INTERVAL" default:"5s" help:"How often the overrides file is checked for changes."`
+	ExcludeHeaders      []string               `name:"exclude-headers" env:"EXCLUDE_HEADERS" help:"Comma-separated list of headers to exclude from logging."`
+	CountGRPCMessages   bool                   `name:"count-grpc-messages" env:"COUNT_GRPC_MESSAGES" help:"Stream gRPC bodies to the processor to log request and response message counts."`
+	TrackResponseEnd    bool                   `name:"track-response-end" env:"TRACK_RESPONSE_END" help:"Stream response bodies to the processor to log entries at the end of the response and flag responses reset mid-body."`
+	RouteExcludeHeaders map[string]string      `name:"route-exclude-headers" env:"ROUTE_EXCLUDE_HEADERS" help:"Per-route extra excluded headers keyed by --grpc-route-key value, e.g. 'admin.envoygateway=x-api-key,x-token;other=x-secret'."`
+	EncryptFields       []string               `name:"accesslog-encrypt-fields" env:"ACCESSLOG_ENCRYPT_FIELDS" help:"Comma-separated entry fields encrypted to --accesslog-encrypt-public-key: 'remote_ip', 'client_ip', 'remote_user' and 'header:<name>' (add 'header:x-forwarded-for' with client_ip)."`
+	EncryptPublicKey    string                 `name:"accesslog-encrypt-public-key" env:"ACCESSLOG_ENCRYPT_PUBLIC_KEY" help:"X25519 public key of 'fieldcrypt keygen' that --accesslog-encrypt-fields are encrypted to; 'fieldcrypt decrypt' restores them."`
+}
+
+// LogOutputConfig holds the access log output configuration.
+type LogOutputConfig struct {
+	Path          string        `name:"path" env:"PATH" default:"stdout" help:"Access log output: 'stdout', 'stderr', 'none' (e.g. with --loki-url or --kafka-brokers) or a file path; with time rotation it may hold strftime directives, e.g. 'access-%Y%m%d%H.log'."`
+	Rotate        string        `name:"rotate" env:"ROTATE" enum:"size,hourly,daily" default:"size" help:"File rotation: 'size', 'hourly' or 'daily'."`
+	LocalTime     bool          `name:"local-time" env:"LOCAL_TIME" help:"Use local time instead of UTC for time-based file names and rotation."`
+	Compression   string        `name:"compression" env:"COMPRESSION" enum:"none,gzip,zstd" default:"none" help:"Compress the output on the fly: 'none', 'gzip' or 'zstd'."`
+	FlushInterval time.Duration `name:"flush-interval" env:"FLUSH_INTERVAL" default:"1s" help:"Maximum time compressed entries stay buffered before being flushed."`
+	BatchEntries  int           `name:"batch-entries" env:"BATCH_ENTRIES" default:"0" help:"Coalesce file writes into batches of this many entries (0 writes each entry immediately)."`
+	BatchInterval time.Duration `name:"batch-interval" env:"BATCH_INTERVAL" default:"100ms" help:"Maximum time a batched entry stays buffered before being written."`
+	Fsync         string        `name:"fsync" env:"FSYNC" enum:"none,batch" default:"none" help:"When to fsync file output: 'none' (leave it to the kernel) or 'batch' (after every batch, or entry without batching)."`
+	MaxSize       int           `name:"max-size" env:"MAX_SIZE" default:"100" help:"Max size in MB before the output file is rotated with size rotation (0 disables rotation)."`
+	MaxAge        int           `name:"max-age" env:"MAX_AGE" default:"30" help:"Max age in days to retain rotated files (0 keeps all)."`
+	MaxBackups    int           `name:"max-backups" env:"MAX_BACKUPS" default:"10" help:"Max number of rotated files to retain (0 keeps all)."`
+	AnonymizeIPs  bool          `name:"anonymize-ips" env:"ANONYMIZE_IPS" help:"Truncate the IP addresses of entries written to this output (see --anonymize-ipv4-prefix)."`
+}
+
+// AnonymizeConfig holds how much of IP addresses anonymized outputs keep.
+type AnonymizeConfig struct {
+	IPv4Prefix int `name:"ipv4-prefix" env:"IPV4_PREFIX" default:"24" help:"Leading IPv4 bits kept by outputs with --*-anonymize-ips (24 zeroes the last octet)."`
+	IPv6Prefix int `name:"ipv6-prefix" env:"IPV6_PREFIX" default:"48" help:"Leading IPv6 bits kept by outputs with --*-anonymize-ips (48 zeroes the last 80 bits)."`
+}
+
+// ArchiveConfig holds the object storage upload configuration for rotated
+// access log files.
+type ArchiveConfig struct {
+	Provider     string        `name:"provider" env:"PROVIDER" enum:",s3,gcs,cos" default:"" help:"Upload rotated log files to object storage: 's3', 'gcs' or 'cos' (empty disables)."`
+	Endpoint     string        `name:"endpoint" env:"ENDPOINT" help:"Object storage endpoint URL, overriding the provider default (e.g. for MinIO)."`
+	Region       string        `name:"region" env:"REGION" help:"Bucket region, e.g. 'us-east-1' or 'ap-guangzhou'."`
+	Bucket       string        `name:"bucket" env:"BUCKET" help:"Bucket name (COS buckets include the APPID suffix)."`
+	AccessKey    string        `name:"access-key" env:"ACCESS_KEY" help:"Access key ID (HMAC key for GCS, SecretId for COS)."`
+	SecretKey    string        `name:"secret-key" env:"SECRET_KEY" help:"Secret access key."`
+	PathStyle    bool          `name:"path-style" env:"PATH_STYLE" help:"Use path-style instead of virtual-hosted-style object URLs."`
+	Prefix       string        `name:"prefix" env:"PREFIX" default:"{hostname}/%Y/%m/%d/" help:"Object key prefix; accepts strftime directives (file modification time, UTC) and {hostname}."`
+	KeepLocal    bool          `name:"keep-local" env:"KEEP_LOCAL" help:"Keep local files after a successful upload."`
+	MaxRetries   int           `name:"max-retries" env:"MAX_RETRIES" default:"5" help:"Upload retries per file before giving up."`
+	RetryBackoff time.Duration `name:"retry-backoff" env:"RETRY_BACKOFF" default:"1s" help:"Initial delay between upload retries, doubled on each attempt."`
+	Timeout      time.Duration `name:"timeout" env:"TIMEOUT" default:"5m" help:"Timeout for a single upload."`
+}
+
+// LokiConfig holds the Loki push settings of the access log.
+type LokiConfig struct {
+	URL           string            `name:"url" env:"URL" help:"Loki base or push URL access log entries are also shipped to, e.g. 'http://loki:3100' (empty disables)."`
+	Labels        map[string]string `name:"labels" env:"LABELS" default:"service=accesslog;host={hostname}" help:"Stream labels of the shipped entries, e.g. 'service=gateway;env=prod;host={hostname}'."`
+	TenantID      string            `name:"tenant-id" env:"TENANT_ID" help:"Tenant sent as X-Scope-OrgID to a multi-tenant Loki."`
+	Username      string            `name:"username" env:"USERNAME" help:"Basic auth username."`
+	Password      string            `name:"password" env:"PASSWORD" help:"Basic auth password."`
+	BatchEntries  int               `name:"batch-entries" env:"BATCH_ENTRIES" default:"1000" help:"Maximum entries per push request."`
+	BatchInterval time.Duration     `name:"batch-interval" env:"BATCH_INTERVAL" default:"1s" help:"Maximum time an entry waits before being pushed."`
+	QueueSize     int               `name:"queue-size" env:"QUEUE_SIZE" default:"100000" help:"Entries buffered while Loki is slow or down; further entries are dropped and counted in loki_entries_dropped_total."`
+	MaxRetries    int               `name:"max-retries" env:"MAX_RETRIES" default:"10" help:"Retries of a failed push before its entries are dropped."`
+	RetryBackoff  time.Duration     `name:"retry-backoff" env:"RETRY_BACKOFF" default:"500ms" help:"Initial delay between push retries, doubled on each attempt."`
+	MaxBackoff    time.Duration     `name:"max-backoff" env:"MAX_BACKOFF" default:"30s" help:"Maximum delay between push retries."`
+	Timeout       time.Duration     `name:"timeout" env:"TIMEOUT" default:"10s" help:"Timeout of a single push request."`
+	Compression   string            `name:"compression" env:"COMPRESSION" enum:"none,gzip" default:"gzip" help:"Push request body compression: 'none' or 'gzip'."`
+	AnonymizeIPs  bool              `name:"anonymize-ips" env:"ANONYMIZE_IPS" help:"Truncate the IP addresses of entries shipped to Loki (see --anonymize-ipv4-prefix)."`
+}
+
+// KafkaConfig holds the Kafka producer settings of the access log.
+type KafkaConfig struct {
+	Brokers               []string      `name:"brokers" env:"BROKERS" help:"Kafka bootstrap brokers (host:port) access log entries are also produced to (empty disables)."`
+	Topic                 string        `name:"topic" env:"TOPIC" default:"accesslog" help:"Topic the entries are produced to."`
+	ClientID              string        `name:"client-id" env:"CLIENT_ID" default:"envoy-ext-procs-accesslog" help:"Client ID identifying the producer to the brokers."`
+	Acks                  string        `name:"acks" env:"ACKS" enum:"0,1,all" default:"all" help:"Acknowledgement a produce request waits for: none (0), the partition leader (1) or all in-sync replicas (all)."`
+	Compression           string        `name:"compression" env:"COMPRESSION" enum:"none,gzip,zstd" default:"zstd" help:"Record batch compression: 'none', 'gzip' or 'zstd' (Kafka 2.1+)."`
+	TLS                   bool          `name:"tls" env:"TLS" help:"Connect to the brokers over TLS."`
+	TLSCAFile             string        `name:"tls-ca-file" env:"TLS_CA_FILE" type:"path" help:"CA bundle verifying the brokers (default system roots)."`
+	TLSCertFile           string        `name:"tls-cert-file" env:"TLS_CERT_FILE" type:"path" help:"Client certificate for broker mutual TLS."`
+	TLSKeyFile            string        `name:"tls-key-file" env:"TLS_KEY_FILE" type:"path" help:"Client private key for broker mutual TLS."`
+	TLSServerName         string        `name:"tls-server-name" env:"TLS_SERVER_NAME" help:"Server name to verify in broker certificates."`
+	TLSInsecureSkipVerify bool          `name:"tls-insecure-skip-verify" env:"TLS_INSECURE_SKIP_VERIFY" help:"Skip broker certificate verification (testing only)."`
+	SASLMechanism         string        `name:"sasl-mechanism" env:"SASL_MECHANISM" enum:"none,plain,scram-sha-256,scram-sha-512" default:"none" help:"SASL mechanism authenticating to the brokers: 'none', 'plain' (use with --kafka-tls) or 'scram-sha-256'/'scram-sha-512'."`
+	SASLUsername          string        `name:"sasl-username" env:"SASL_USERNAME" help:"SASL username."`
+	SASLPassword          string        `name:"sasl-password" env:"SASL_PASSWORD" help:"SASL password."`
+	BatchEntries          int           `name:"batch-entries" env:"BATCH_ENTRIES" default:"1000" help:"Maximum entries per record batch."`
+	BatchInterval         time.Duration `name:"batch-interval" env:"BATCH_INTERVAL" default:"1s" help:"Maximum time an entry waits before being produced."`
+	QueueSize             int           `name:"queue-size" env:"QUEUE_SIZE" default:"100000" help:"Entries buffered while Kafka is slow or down; further entries are dropped and counted in kafka_entries_dropped_total."`
+	MaxRetries            int           `name:"max-retries" env:"MAX_RETRIES" default:"10" help:"Retries of a failed produce request before its entries are dropped."`
+	RetryBackoff          time.Duration `name:"retry-backoff" env:"RETRY_BACKOFF" default:"500ms" help:"Initial delay between produce retries, doubled on each attempt."`
+	MaxBackoff            time.Duration `name:"max-backoff" env:"MAX_BACKOFF" default:"30s" help:"Maximum delay between produce retries."`
+	Timeout               time.Duration `name:"timeout" env:"TIMEOUT" default:"10s" help:"Timeout of connecting to a broker and of a single request."`
+	AnonymizeIPs          bool          `name:"anonymize-ips" env:"ANONYMIZE_IPS" help:"Truncate the IP addresses of entries produced to Kafka (see --anonymize-ipv4-prefix)."`
 }
@@ -0,0 +1,23 @@
+package config
+
+// APIVersionCLI is the CLI configuration for the API version negotiation processor.
+type APIVersionCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC    GRPCConfig       `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health  HealthConfig     `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin   AdminConfig      `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics MetricsConfig    `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log     LogConfig        `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Version APIVersionConfig `embed:"" prefix:"version-" envprefix:"VERSION_"`
+}
+
+// APIVersionConfig holds API version negotiation configuration.
+type APIVersionConfig struct {
+	Sources          []string `name:"sources" env:"SOURCES" enum:"path,header,accept" default:"path,header,accept" help:"Where versions are read from, in order; disagreeing sources are rejected."`
+	Supported        []string `name:"supported" env:"SUPPORTED" required:"" help:"Comma-separated supported versions, e.g. '1,2,2.1'."`
+	Default          string   `name:"default" env:"DEFAULT" help:"Version used when none is requested (empty requires one)."`
+	RequestHeader    string   `name:"request-header" env:"REQUEST_HEADER" default:"api-version" help:"Client header carrying the version."`
+	UpstreamHeader   string   `name:"upstream-header" env:"UPSTREAM_HEADER" default:"x-api-version" help:"Header receiving the normalized version for routing."`
+	StripPathVersion bool     `name:"strip-path-version" env:"STRIP_PATH_VERSION" help:"Remove the /vN prefix from the upstream path."`
+}
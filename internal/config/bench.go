@@ -0,0 +1,16 @@
+package config
+
+// BenchCLI is the CLI configuration of the benchmark tooling.
+type BenchCLI struct {
+	Compare BenchCompareCmd `cmd:"" help:"Compare two 'go test -bench' outputs with benchstat and fail on budget violations."`
+
+	Log LogConfig `embed:"" prefix:"log-" envprefix:"LOG_"`
+}
+
+// BenchCompareCmd compares a base and a new benchmark run.
+type BenchCompareCmd struct {
+	Old     string  `arg:"" type:"existingfile" help:"Benchmark output of the base revision."`
+	New     string  `arg:"" type:"existingfile" help:"Benchmark output of the revision under test."`
+	Budgets string  `name:"budgets" env:"BENCH_BUDGETS" type:"existingfile" default:"bench-budgets.yaml" help:"YAML performance budgets."`
+	Alpha   float64 `name:"alpha" env:"BENCH_ALPHA" default:"0.05" help:"p-value below which a time or memory change is significant."`
+}
@@ -0,0 +1,21 @@
+package config
+
+// BlueGreenCLI is the CLI configuration for the blue/green cutover processor.
+type BlueGreenCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC      GRPCConfig      `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health    HealthConfig    `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin     AdminConfig     `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics   MetricsConfig   `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log       LogConfig       `embed:"" prefix:"log-" envprefix:"LOG_"`
+	BlueGreen BlueGreenConfig `embed:"" prefix:"bluegreen-" envprefix:"BLUEGREEN_"`
+}
+
+// BlueGreenConfig holds blue/green cutover configuration.
+type BlueGreenConfig struct {
+	GreenPercent float64 `name:"green-percent" env:"GREEN_PERCENT" default:"0" help:"Initial percentage of requests sent to green, used until the state file exists."`
+	StateFile    string  `name:"state-file" env:"STATE_FILE" type:"path" help:"File the percentage set through the admin API is persisted to and restored from (empty to keep it in memory)."`
+	Header       string  `name:"header" env:"HEADER" default:"x-deployment-variant" help:"Request header set to 'blue' or 'green' for route matching."`
+	HashHeader   string  `name:"hash-header" env:"HASH_HEADER" help:"Header whose value keeps a client on one variant, e.g. a user ID (empty to assign each request randomly)."`
+}
@@ -0,0 +1,24 @@
+package config
+
+import "time"
+
+// CloudflareCLI is the CLI configuration for the Cloudflare real IP processor.
+type CloudflareCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC       GRPCConfig       `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health     HealthConfig     `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Cloudflare CloudflareConfig `embed:"" prefix:"cloudflare-" envprefix:"CLOUDFLARE_"`
+	Log        LogConfig        `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Admin      AdminConfig      `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics    MetricsConfig    `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	HTTPClient HTTPClientConfig `embed:"" prefix:"http-client-" envprefix:"HTTP_CLIENT_"`
+}
+
+// CloudflareConfig holds where Cloudflare's IP ranges are fetched from.
+type CloudflareConfig struct {
+	IPv4URL         string        `name:"ipv4-url" env:"IPV4_URL" default:"https://www.cloudflare.com/ips-v4" help:"URL of Cloudflare's IPv4 ranges, one CIDR per line."`
+	IPv6URL         string        `name:"ipv6-url" env:"IPV6_URL" default:"https://www.cloudflare.com/ips-v6" help:"URL of Cloudflare's IPv6 ranges, one CIDR per line."`
+	RefreshInterval time.Duration `name:"refresh-interval" env:"REFRESH_INTERVAL" default:"24h" help:"How often the ranges are fetched again; a failed fetch keeps the previous ranges."`
+	Timeout         time.Duration `name:"timeout" env:"TIMEOUT" default:"10s" help:"Request timeout for each range list."`
+}
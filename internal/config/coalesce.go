@@ -0,0 +1,24 @@
+package config
+
+import "time"
+
+// CoalesceCLI is the CLI configuration for the request coalescing processor.
+type CoalesceCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC     GRPCConfig     `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health   HealthConfig   `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin    AdminConfig    `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics  MetricsConfig  `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log      LogConfig      `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Coalesce CoalesceConfig `embed:"" prefix:"coalesce-" envprefix:"COALESCE_"`
+}
+
+// CoalesceConfig holds request coalescing configuration.
+type CoalesceConfig struct {
+	Routes               []string      `name:"routes" env:"ROUTES" default:"/" help:"Comma-separated path prefixes eligible for coalescing."`
+	MaxWait              time.Duration `name:"max-wait" env:"MAX_WAIT" default:"5s" help:"How long a parked request waits for the in-flight one before going upstream."`
+	VaryHeaders          []string      `name:"vary-headers" env:"VARY_HEADERS" default:"accept,accept-encoding,accept-language" help:"Request headers included in the coalescing key."`
+	IncludeAuthenticated bool          `name:"include-authenticated" env:"INCLUDE_AUTHENTICATED" help:"Also coalesce requests with Authorization or Cookie, keyed by them."`
+	MarkerHeader         string        `name:"marker-header" env:"MARKER_HEADER" default:"x-coalesced" help:"Header added to coalesced responses (empty disables)."`
+}
@@ -1,34 +1,127 @@
 package config
 
-import "github.com/rs/zerolog"
+import (
+	"time"
 
-// GRPCConfig holds gRPC server configuration.
-type GRPCConfig struct {
-	Port     int    `name:"port" env:"PORT" default:"9002" help:"gRPC server listen port."`
-	CertPath string `name:"cert-path" env:"CERT_PATH" type:"path" required:"" help:"Path to directory containing server.crt and server.key for TLS."`
-	CAFile   string `name:"ca-file" env:"CA_FILE" type:"path" help:"Path to CA certificate file for TLS."`
-}
+	"github.com/mnixry/envoy-ext-procs/pkg/flags"
+)
 
-// HealthConfig holds health check server configuration.
-type HealthConfig struct {
-	Port           int    `name:"port" env:"PORT" default:"8080" help:"Health check HTTP server listen port."`
-	DialServerName string `name:"dial-server-name" env:"DIAL_SERVER_NAME" default:"grpc-ext-proc.envoygateway" help:"TLS server name for health check gRPC dial."`
-}
+// ServeCmd runs the ext_proc gRPC server. It is the default command.
+type ServeCmd struct{}
 
-type LogFormat string
+// SelftestCmd runs synthetic requests through the processor in-process and
+// reports the produced mutations.
+type SelftestCmd struct{}
+
+// The flags shared by every processor are public, for custom processors
+// built on pkg/server.
+type (
+	GRPCConfig     = flags.GRPC
+	HealthConfig   = flags.Health
+	AdminConfig    = flags.Admin
+	MetricsConfig  = flags.Metrics
+	TracingConfig  = flags.Tracing
+	DecisionConfig = flags.Decision
+	LogFormat      = flags.LogFormat
+	LogConfig      = flags.Log
+	SentryConfig   = flags.Sentry
+)
 
 const (
-	LogFormatJSON    LogFormat = "json"
-	LogFormatConsole LogFormat = "console"
+	LogFormatJSON    = flags.LogFormatJSON
+	LogFormatConsole = flags.LogFormatConsole
 )
 
-// LogConfig holds logging configuration.
-type LogConfig struct {
-	Level      zerolog.Level `name:"level" env:"LEVEL" default:"info" help:"Log level (trace, debug, info, warn, error, fatal, panic)."`
-	Output     string        `name:"output" env:"OUTPUT" default:"stdout" help:"Log output location: 'stdout', 'stderr', or a file path."`
-	Format     LogFormat     `name:"format" env:"FORMAT" default:"json" enum:"json,console" help:"Log format: 'json' or 'console'."`
-	MaxSize    int           `name:"max-size" env:"MAX_SIZE" default:"100" help:"Max size in MB before log rotation (0 disables rotation)."`
-	MaxAge     int           `name:"max-age" env:"MAX_AGE" default:"30" help:"Max age in days to retain old log files (0 keeps all)."`
-	MaxBackups int           `name:"max-backups" env:"MAX_BACKUPS" default:"10" help:"Max number of old log files to retain (0 keeps all)."`
-	Compress   bool          `name:"compress" env:"COMPRESS" default:"true" help:"Compress rotated log files with gzip."`
+// LeaderElectionConfig holds Kubernetes Lease-based leader election settings
+// for singleton background work.
+type LeaderElectionConfig struct {
+	Enabled       bool          `name:"enabled" env:"ENABLED" help:"Elect one replica through a Kubernetes Lease to run singleton background work."`
+	Name          string        `name:"lease-name" env:"LEASE_NAME" default:"envoy-ext-procs" help:"Name of the Lease shared by all replicas."`
+	Namespace     string        `name:"namespace" env:"NAMESPACE" help:"Namespace of the Lease (default: the pod's namespace)."`
+	Identity      string        `name:"identity" env:"IDENTITY" help:"Identity of this replica (default: the hostname)."`
+	LeaseDuration time.Duration `name:"lease-duration" env:"LEASE_DURATION" default:"15s" help:"How long followers wait after the last renewal before taking over."`
+	RenewDeadline time.Duration `name:"renew-deadline" env:"RENEW_DEADLINE" default:"10s" help:"How long the leader retries renewal before giving up leadership."`
+	RetryPeriod   time.Duration `name:"retry-period" env:"RETRY_PERIOD" default:"2s" help:"Interval between acquire and renew attempts."`
+}
+
+// DynConfigConfig holds the dynamic configuration source settings.
+type DynConfigConfig struct {
+	Server       string        `name:"server" env:"SERVER" xor:"dynconfig-source" help:"Control plane host:port streaming processor configuration over the Envoy aggregated discovery service."`
+	File         string        `name:"file" env:"FILE" type:"path" xor:"dynconfig-source" help:"Versioned YAML file of processor configuration, re-applied when modified."`
+	PollInterval time.Duration `name:"poll-interval" env:"POLL_INTERVAL" default:"5s" help:"How often --dynconfig-file is checked for changes."`
+	NodeID       string        `name:"node-id" env:"NODE_ID" help:"Node ID sent to the control plane (default: the hostname)."`
+	Cluster      string        `name:"cluster" env:"CLUSTER" help:"Cluster name sent to the control plane."`
+	CAFile       string        `name:"ca-file" env:"CA_FILE" type:"path" help:"CA bundle verifying the control plane (default: system roots)."`
+	ServerName   string        `name:"server-name" env:"SERVER_NAME" help:"Server name to verify in the control plane certificate."`
+	Plaintext    bool          `name:"plaintext" env:"PLAINTEXT" help:"Connect to the control plane without TLS (e.g. a localhost sidecar)."`
+}
+
+// FeatureFlagsConfig holds the feature flag provider settings.
+type FeatureFlagsConfig struct {
+	Provider        string        `name:"provider" env:"PROVIDER" enum:"none,file,ofrep" default:"none" help:"Feature flag provider: 'none' (built-in behavior), 'file' or 'ofrep' (OpenFeature Remote Evaluation Protocol)."`
+	File            string        `name:"file" env:"FILE" help:"YAML flag definitions, or a 'configmap://[namespace/]name/key' / 'secret://...' reference; reloaded when modified."`
+	PollInterval    time.Duration `name:"poll-interval" env:"POLL_INTERVAL" default:"5s" help:"How often --feature-flags-file is checked for changes."`
+	OFREPURL        string        `name:"ofrep-url" env:"OFREP_URL" help:"Base URL of the OFREP flag service, e.g. http://flagd:8016."`
+	OFREPToken      string        `name:"ofrep-token" env:"OFREP_TOKEN" help:"Bearer token sent to the OFREP flag service."`
+	TargetingHeader string        `name:"targeting-header" env:"TARGETING_HEADER" default:"x-request-id" help:"Request header used as targeting key, keeping rollouts sticky per value (e.g. a user or session header)."`
+	Timeout         time.Duration `name:"timeout" env:"TIMEOUT" default:"100ms" help:"Maximum time of a single flag evaluation before the default applies."`
+	CacheSize       int           `name:"cache-size" env:"CACHE_SIZE" default:"10000" help:"Evaluation results cached locally (0 disables caching)."`
+	CacheTTL        time.Duration `name:"cache-ttl" env:"CACHE_TTL" default:"30s" help:"How long evaluation results are cached."`
+}
+
+// PolicyControllerConfig holds the ExtProcPolicy controller settings.
+type PolicyControllerConfig struct {
+	Enabled   bool   `name:"enabled" env:"ENABLED" help:"Watch ExtProcPolicy resources and apply their per-route settings."`
+	Namespace string `name:"namespace" env:"NAMESPACE" help:"Namespace to watch for ExtProcPolicy resources (default: all namespaces)."`
+}
+
+// KVStoreConfig holds the shared key-value store configuration.
+type KVStoreConfig struct {
+	Driver   string        `name:"driver" env:"DRIVER" enum:"memory,redis,memcached,gossip" default:"memory" help:"State store: 'memory' (per replica), 'redis' or 'memcached' (shared), or 'gossip' (approximate, exchanged between replicas)."`
+	Addrs    []string      `name:"addrs" env:"ADDRS" help:"Comma-separated host:port server addresses for redis or memcached."`
+	Username string        `name:"username" env:"USERNAME" help:"Redis ACL username."`
+	Password string        `name:"password" env:"PASSWORD" help:"Redis password."`
+	DB       int           `name:"db" env:"DB" default:"0" help:"Redis database number."`
+	Prefix   string        `name:"prefix" env:"PREFIX" default:"envoy-ext-procs:" help:"Prefix added to every key. With Redis Cluster, use a '{tag}' to keep keys in one slot."`
+	Timeout  time.Duration `name:"timeout" env:"TIMEOUT" default:"500ms" help:"Dial and per-operation timeout."`
+
+	Topology         string `name:"redis-topology" env:"REDIS_TOPOLOGY" enum:"standalone,sentinel,cluster" default:"standalone" help:"Redis deployment: 'standalone', 'sentinel' (addrs are sentinels) or 'cluster' (addrs are seed nodes)."`
+	MasterName       string `name:"redis-master-name" env:"REDIS_MASTER_NAME" help:"Redis Sentinel master set name."`
+	SentinelUsername string `name:"redis-sentinel-username" env:"REDIS_SENTINEL_USERNAME" help:"Redis Sentinel ACL username."`
+	SentinelPassword string `name:"redis-sentinel-password" env:"REDIS_SENTINEL_PASSWORD" help:"Redis Sentinel password."`
+	ReplicaReads     bool   `name:"redis-replica-reads" env:"REDIS_REPLICA_READS" help:"Send read-only commands to replicas (sentinel and cluster)."`
+
+	TLS                   bool   `name:"tls" env:"TLS" help:"Connect to Redis over TLS."`
+	TLSCAFile             string `name:"tls-ca-file" env:"TLS_CA_FILE" type:"path" help:"CA bundle verifying the Redis servers (default system roots)."`
+	TLSCertFile           string `name:"tls-cert-file" env:"TLS_CERT_FILE" type:"path" help:"Client certificate for Redis mutual TLS."`
+	TLSKeyFile            string `name:"tls-key-file" env:"TLS_KEY_FILE" type:"path" help:"Client private key for Redis mutual TLS."`
+	TLSServerName         string `name:"tls-server-name" env:"TLS_SERVER_NAME" help:"Server name to verify in Redis certificates."`
+	TLSInsecureSkipVerify bool   `name:"tls-insecure-skip-verify" env:"TLS_INSECURE_SKIP_VERIFY" help:"Skip Redis certificate verification (testing only)."`
+
+	PoolSize        int           `name:"pool-size" env:"POOL_SIZE" default:"0" help:"Max Redis connections per node (0 is 10 per CPU)."`
+	MinIdleConns    int           `name:"min-idle-conns" env:"MIN_IDLE_CONNS" default:"0" help:"Idle Redis connections kept open per node."`
+	MaxIdleConns    int           `name:"max-idle-conns" env:"MAX_IDLE_CONNS" default:"0" help:"Max idle Redis connections per node (0 is unlimited)."`
+	PoolTimeout     time.Duration `name:"pool-timeout" env:"POOL_TIMEOUT" default:"0s" help:"Wait for a free Redis connection (0 is timeout + 1s)."`
+	ConnMaxIdleTime time.Duration `name:"conn-max-idle-time" env:"CONN_MAX_IDLE_TIME" default:"30m" help:"Close Redis connections idle this long (0 keeps them)."`
+	ConnMaxLifetime time.Duration `name:"conn-max-lifetime" env:"CONN_MAX_LIFETIME" default:"0s" help:"Close Redis connections older than this (0 keeps them)."`
+	MaxRetries      int           `name:"max-retries" env:"MAX_RETRIES" default:"3" help:"Retries of failed Redis commands (-1 disables)."`
+
+	GossipBind      string        `name:"gossip-bind" env:"GOSSIP_BIND" default:":7946" help:"UDP address gossip listens on."`
+	GossipPeers     []string      `name:"gossip-peers" env:"GOSSIP_PEERS" help:"Comma-separated host:port seed peers, re-resolved periodically (e.g. a headless service)."`
+	GossipInterval  time.Duration `name:"gossip-interval" env:"GOSSIP_INTERVAL" default:"500ms" help:"How often changes are pushed to peers."`
+	GossipFanout    int           `name:"gossip-fanout" env:"GOSSIP_FANOUT" default:"3" help:"Peers changes are pushed to per interval."`
+	GossipSecretKey string        `name:"gossip-secret-key" env:"GOSSIP_SECRET_KEY" help:"Shared key authenticating gossip packets with HMAC-SHA256; required unless --store-gossip-insecure."`
+	GossipInsecure  bool          `name:"gossip-insecure" env:"GOSSIP_INSECURE" help:"Accept gossip packets from any sender when no --store-gossip-secret-key is set (testing only)."`
+	GossipNodeName  string        `name:"gossip-node-name" env:"GOSSIP_NODE_NAME" help:"Unique name of this replica (default the host name)."`
+	GossipMaxKeys   int           `name:"gossip-max-keys" env:"GOSSIP_MAX_KEYS" default:"100000" help:"Max counters and values held; keys learned from peers beyond it are dropped (0 is unbounded)."`
+}
+
+// HTTPClientConfig holds the settings shared by outbound HTTP clients.
+type HTTPClientConfig struct {
+	Proxy               string        `name:"proxy" env:"PROXY" help:"Proxy URL of outbound HTTP requests; empty uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY, 'direct' connects directly."`
+	CAFile              string        `name:"ca-file" env:"CA_FILE" type:"path" help:"PEM bundle of CAs trusted for outbound HTTPS in addition to the system roots."`
+	MaxIdleConnsPerHost int           `name:"max-idle-conns-per-host" env:"MAX_IDLE_CONNS_PER_HOST" default:"16" help:"Idle connections kept per host in the shared pool."`
+	IdleConnTimeout     time.Duration `name:"idle-conn-timeout" env:"IDLE_CONN_TIMEOUT" default:"90s" help:"How long an idle pooled connection is kept."`
+	MaxRetries          int           `name:"max-retries" env:"MAX_RETRIES" default:"2" help:"Retries of GET and HEAD requests failing with a network error, 429 or 502-504."`
+	RetryBackoff        time.Duration `name:"retry-backoff" env:"RETRY_BACKOFF" default:"200ms" help:"Initial delay between outbound request retries, doubled on each attempt."`
 }
@@ -0,0 +1,27 @@
+package config
+
+import "time"
+
+// ConnBudgetCLI is the CLI configuration for the connection budget
+// processor.
+type ConnBudgetCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC       GRPCConfig       `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health     HealthConfig     `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin      AdminConfig      `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics    MetricsConfig    `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log        LogConfig        `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision   DecisionConfig   `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	ConnBudget ConnBudgetConfig `embed:"" prefix:"budget-" envprefix:"BUDGET_"`
+}
+
+// ConnBudgetConfig holds connection budget configuration.
+type ConnBudgetConfig struct {
+	Window          time.Duration `name:"window" env:"WINDOW" default:"1m" help:"Length of the fixed time windows budgets apply to."`
+	Connections     int           `name:"connections" env:"CONNECTIONS" default:"60" help:"New downstream connections per client IP per window, told apart by the connection.id attribute (0 disables)."`
+	Requests        int           `name:"requests" env:"REQUESTS" default:"0" help:"Requests per client IP per window (0 disables)."`
+	PerListener     bool          `name:"per-listener" env:"PER_LISTENER" help:"Keep separate budgets per local address (destination.address attribute)."`
+	CacheSize       int           `name:"cache-size" env:"CACHE_SIZE" default:"100000" help:"Maximum number of client windows and admitted connections kept in memory (LRU evicted)."`
+	ResponseHeaders bool          `name:"response-headers" env:"RESPONSE_HEADERS" default:"true" help:"Add x-ratelimit-limit/remaining/reset headers to responses."`
+}
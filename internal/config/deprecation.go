@@ -0,0 +1,20 @@
+package config
+
+// DeprecationCLI is the CLI configuration for the deprecation/sunset processor.
+type DeprecationCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC        GRPCConfig        `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health      HealthConfig      `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin       AdminConfig       `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics     MetricsConfig     `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log         LogConfig         `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Deprecation DeprecationConfig `embed:"" prefix:"deprecation-" envprefix:"DEPRECATION_"`
+	DynConfig   DynConfigConfig   `embed:"" prefix:"dynconfig-" envprefix:"DYNCONFIG_"`
+}
+
+// DeprecationConfig holds API lifecycle configuration.
+type DeprecationConfig struct {
+	RulesFile         string `name:"rules-file" env:"RULES_FILE" required:"" help:"YAML mapping of route prefixes to deprecation/sunset dates: a file or a watched 'configmap://[namespace/]name/key' or 'secret://...' reference."`
+	RejectAfterSunset bool   `name:"reject-after-sunset" env:"REJECT_AFTER_SUNSET" help:"Answer requests past the sunset date with 410 Gone (routes may override)."`
+}
@@ -4,19 +4,59 @@ import "time"
 
 // EdgeOneCLI is the CLI configuration for the EdgeOne real IP processor.
 type EdgeOneCLI struct {
-	GRPC    GRPCConfig    `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
-	Health  HealthConfig  `embed:"" prefix:"health-" envprefix:"HEALTH_"`
-	EdgeOne EdgeOneConfig `embed:"" prefix:"edgeone-" envprefix:"EDGEONE_"`
-	Log     LogConfig     `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Serve    ServeCmd           `cmd:"" default:"1" help:"Run the ext_proc gRPC server."`
+	Selftest EdgeOneSelftestCmd `cmd:"" help:"Run synthetic requests through the processor and report pass/fail."`
+
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC     GRPCConfig     `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health   HealthConfig   `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	EdgeOne  EdgeOneConfig  `embed:"" prefix:"edgeone-" envprefix:"EDGEONE_"`
+	Log      LogConfig      `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision DecisionConfig `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	Admin    AdminConfig    `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics  MetricsConfig  `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+}
+
+// EdgeOneSelftestCmd runs the EdgeOne self-test battery.
+type EdgeOneSelftestCmd struct {
+	TrustedIP string `name:"trusted-ip" env:"SELFTEST_TRUSTED_IP" help:"Known EdgeOne node IP expected to validate as trusted (optional, requires TEO API access)."`
 }
 
 // EdgeOneConfig holds EdgeOne API configuration.
 type EdgeOneConfig struct {
-	SecretID    string        `name:"secret-id" env:"SECRET_ID" required:"" help:"Tencent Cloud SecretId for TEO API."`
-	SecretKey   string        `name:"secret-key" env:"SECRET_KEY" required:"" help:"Tencent Cloud SecretKey for TEO API."`
+	SecretID    string        `name:"secret-id" env:"SECRET_ID" help:"Tencent Cloud SecretId for TEO API (required unless --edgeone-fake-api-ips is set or --edgeone-validator=dns)."`
+	SecretKey   string        `name:"secret-key" env:"SECRET_KEY" help:"Tencent Cloud SecretKey for TEO API (required unless --edgeone-fake-api-ips is set or --edgeone-validator=dns)."`
 	APIEndpoint string        `name:"api-endpoint" env:"API_ENDPOINT" default:"teo.tencentcloudapi.com" help:"Tencent EdgeOne TEO API endpoint (hostname or URL)."`
 	Region      string        `name:"region" env:"REGION" default:"" help:"Tencent Cloud region for TEO client (optional)."`
-	CacheSize   int           `name:"cache-size" env:"CACHE_SIZE" default:"1000" help:"LRU cache size for IP validation results."`
-	CacheTTL    time.Duration `name:"cache-ttl" env:"CACHE_TTL" default:"1h" help:"Cache TTL for IP validation results (e.g. 1h, 30m)."`
+	CacheSize   int           `name:"cache-size" env:"CACHE_SIZE" default:"1000" help:"LRU cache size for each of the EdgeOne and non-EdgeOne validation results."`
+	PositiveTTL time.Duration `name:"positive-ttl" aliases:"edgeone-cache-ttl" env:"POSITIVE_TTL,CACHE_TTL" default:"1h" help:"How long an address validated as EdgeOne is cached (e.g. 1h, 30m). --edgeone-cache-ttl is a deprecated alias."`
+	NegativeTTL time.Duration `name:"negative-ttl" env:"NEGATIVE_TTL" default:"1m" help:"How long an address validated as not EdgeOne is cached; keep it short, as attackers rotate addresses."`
 	Timeout     time.Duration `name:"timeout" env:"TIMEOUT" default:"5s" help:"Tencent API request timeout (e.g. 5s, 10s)."`
+
+	FallbackCIDRs []string `name:"fallback-cidrs" env:"FALLBACK_CIDRS" placeholder:"CIDR" help:"EdgeOne addresses/CIDRs trusted when the TEO API fails or times out."`
+	FallbackFile  string   `name:"fallback-file" env:"FALLBACK_FILE" help:"File (or configmap:// / secret:// reference) of EdgeOne CIDRs, one per line, trusted when the TEO API fails or times out."`
+	FailurePolicy string   `name:"failure-policy" env:"FAILURE_POLICY" enum:"closed,open" default:"closed" help:"Trust decision when the TEO API fails and no fallback list is configured: 'closed' (untrusted) or 'open' (trusted)."`
+
+	Validator string           `name:"validator" env:"VALIDATOR" enum:"api,dns" default:"api" help:"How EdgeOne nodes are recognized: 'api' asks the TEO API, consulting DNS (if configured) when it fails; 'dns' uses DNS alone, without credentials."`
+	DNS       EdgeOneDNSConfig `embed:"" prefix:"dns-" envprefix:"DNS_"`
+
+	Fake EdgeOneFakeConfig `embed:"" prefix:"fake-api-" envprefix:"FAKE_API_"`
+}
+
+// EdgeOneDNSConfig holds DNS-based EdgeOne node validation settings.
+type EdgeOneDNSConfig struct {
+	Suffixes        []string      `name:"suffixes" env:"SUFFIXES" placeholder:"DOMAIN" help:"Domains of EdgeOne node PTR names; an address whose PTR name is in one and resolves back to it is an EdgeOne node."`
+	Hostnames       []string      `name:"hostnames" env:"HOSTNAMES" placeholder:"HOST" help:"Published EdgeOne node hostnames whose addresses are EdgeOne nodes."`
+	RefreshInterval time.Duration `name:"refresh-interval" env:"REFRESH_INTERVAL" default:"5m" help:"How often --edgeone-dns-hostnames are resolved again."`
+	Resolver        string        `name:"resolver" env:"RESOLVER" placeholder:"HOST:PORT" help:"DNS server queried directly instead of the system resolver."`
+	DNSSEC          bool          `name:"dnssec" env:"DNSSEC" help:"Require answers validated by --edgeone-dns-resolver (AD bit); it must be a trusted validating resolver."`
+	Timeout         time.Duration `name:"timeout" env:"TIMEOUT" default:"2s" help:"Timeout of the DNS lookups validating one address."`
+}
+
+// EdgeOneFakeConfig runs an in-process TEO API for local development.
+type EdgeOneFakeConfig struct {
+	IPs       []string      `name:"ips" env:"IPS" placeholder:"CIDR" help:"Serve the TEO API in-process, reporting these addresses/CIDRs as EdgeOne nodes, so no credentials or network access are needed. Development only."`
+	Latency   time.Duration `name:"latency" env:"LATENCY" default:"0s" help:"Delay of each fake API response."`
+	ErrorRate float64       `name:"error-rate" env:"ERROR_RATE" default:"0" help:"Fraction of fake API requests answered with InternalError, from 0 to 1."`
 }
@@ -0,0 +1,21 @@
+package config
+
+// ErrorHeadersCLI is the CLI configuration for the error header decoration processor.
+type ErrorHeadersCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC    GRPCConfig         `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health  HealthConfig       `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin   AdminConfig        `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics MetricsConfig      `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log     LogConfig          `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Errors  ErrorHeadersConfig `embed:"" prefix:"error-headers-" envprefix:"ERROR_HEADERS_"`
+}
+
+// ErrorHeadersConfig holds error response decoration configuration.
+type ErrorHeadersConfig struct {
+	Environment   string   `name:"environment" env:"ENVIRONMENT" enum:"production,staging,development" default:"production" help:"Deployment environment; outside production the upstream cluster is disclosed too."`
+	Classes       []string `name:"classes" env:"CLASSES" default:"4xx,5xx" help:"Comma-separated status classes to decorate."`
+	ErrorIDHeader string   `name:"error-id-header" env:"ERROR_ID_HEADER" default:"x-error-id" help:"Response header carrying the error ID logged with the error."`
+	ClusterHeader string   `name:"cluster-header" env:"CLUSTER_HEADER" default:"x-upstream-cluster" help:"Response header carrying the upstream cluster outside production."`
+}
@@ -0,0 +1,22 @@
+package config
+
+// ErrorPageCLI is the CLI configuration for the error normalization processor.
+type ErrorPageCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC      GRPCConfig      `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health    HealthConfig    `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin     AdminConfig     `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics   MetricsConfig   `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log       LogConfig       `embed:"" prefix:"log-" envprefix:"LOG_"`
+	ErrorPage ErrorPageConfig `embed:"" prefix:"error-" envprefix:"ERROR_"`
+}
+
+// ErrorPageConfig holds error response normalization configuration.
+type ErrorPageConfig struct {
+	TemplateFile      string `name:"template-file" env:"TEMPLATE_FILE" type:"existingfile" help:"Go html/template for HTML error pages (fields: Status, Title, Path, RequestID)."`
+	DefaultFormat     string `name:"default-format" env:"DEFAULT_FORMAT" enum:"json,html" default:"json" help:"Format used when Accept prefers neither HTML nor JSON."`
+	SkipStatuses      []int  `name:"skip-statuses" env:"SKIP_STATUSES" help:"Comma-separated status codes passed through untouched."`
+	CorrelationHeader string `name:"correlation-header" env:"CORRELATION_HEADER" default:"x-request-id" help:"Response header carrying the request ID."`
+	ProblemTypeBase   string `name:"problem-type-base" env:"PROBLEM_TYPE_BASE" help:"Base URI for problem types, joined with the status code (default: about:blank)."`
+}
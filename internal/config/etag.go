@@ -0,0 +1,22 @@
+package config
+
+import "time"
+
+// ETagCLI is the CLI configuration for the ETag generation processor.
+type ETagCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC    GRPCConfig    `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health  HealthConfig  `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin   AdminConfig   `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics MetricsConfig `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log     LogConfig     `embed:"" prefix:"log-" envprefix:"LOG_"`
+	ETag    ETagConfig    `embed:"" prefix:"etag-" envprefix:"ETAG_"`
+}
+
+// ETagConfig holds ETag generation configuration.
+type ETagConfig struct {
+	Routes    []string      `name:"routes" env:"ROUTES" default:"/" help:"Comma-separated path prefixes whose GET responses get ETags."`
+	CacheSize int           `name:"cache-size" env:"CACHE_SIZE" default:"10000" help:"Number of validators remembered for answering If-None-Match."`
+	CacheTTL  time.Duration `name:"cache-ttl" env:"CACHE_TTL" default:"30s" help:"How long a remembered validator answers If-None-Match without upstream."`
+}
@@ -0,0 +1,31 @@
+package config
+
+import "time"
+
+// FaultCLI is the CLI configuration for the fault injection processor.
+type FaultCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC         GRPCConfig         `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health       HealthConfig       `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin        AdminConfig        `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics      MetricsConfig      `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	HTTPClient   HTTPClientConfig   `embed:"" prefix:"http-client-" envprefix:"HTTP_CLIENT_"`
+	Log          LogConfig          `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Fault        FaultConfig        `embed:"" prefix:"fault-" envprefix:"FAULT_"`
+	FeatureFlags FeatureFlagsConfig `embed:"" prefix:"feature-flags-" envprefix:"FEATURE_FLAGS_"`
+}
+
+// FaultConfig holds fault injection configuration.
+type FaultConfig struct {
+	Routes         []string      `name:"routes" env:"ROUTES" help:"Comma-separated path prefixes eligible for faults (empty matches all)."`
+	GuardHeader    string        `name:"guard-header" env:"GUARD_HEADER" default:"x-fault-inject" help:"Header a request must carry to be eligible; removed before forwarding (empty targets all traffic)."`
+	GuardValue     string        `name:"guard-value" env:"GUARD_VALUE" help:"Required value of the guard header (empty accepts any value)."`
+	DelayPercent   float64       `name:"delay-percent" env:"DELAY_PERCENT" default:"0" help:"Percentage of eligible requests delayed."`
+	Delay          time.Duration `name:"delay" env:"DELAY" default:"1s" help:"Injected delay; keep below the filter's message_timeout."`
+	AbortPercent   float64       `name:"abort-percent" env:"ABORT_PERCENT" default:"0" help:"Percentage of eligible requests answered with the abort status."`
+	AbortStatus    int           `name:"abort-status" env:"ABORT_STATUS" default:"503" help:"HTTP status of injected error responses."`
+	CorruptPercent float64       `name:"corrupt-percent" env:"CORRUPT_PERCENT" default:"0" help:"Percentage of eligible responses whose body is corrupted."`
+	CorruptBytes   int           `name:"corrupt-bytes" env:"CORRUPT_BYTES" default:"1" help:"Random bytes overwritten in every corrupted body chunk."`
+	MarkerHeader   string        `name:"marker-header" env:"MARKER_HEADER" default:"x-fault-injected" help:"Response header listing injected faults (empty disables)."`
+}
@@ -0,0 +1,21 @@
+package config
+
+// FieldCryptCLI is the CLI configuration of the access log field encryption
+// tooling.
+type FieldCryptCLI struct {
+	Keygen  FieldCryptKeygenCmd  `cmd:"" help:"Generate a key pair; the private key goes to the security team, the public key to --accesslog-encrypt-public-key."`
+	Decrypt FieldCryptDecryptCmd `cmd:"" help:"Decrypt the encrypted fields of access log lines."`
+
+	Log LogConfig `embed:"" prefix:"log-" envprefix:"LOG_"`
+}
+
+// FieldCryptKeygenCmd generates a key pair.
+type FieldCryptKeygenCmd struct {
+	Output string `name:"output" short:"o" type:"path" help:"File the private key is written to (mode 0600) instead of standard output."`
+}
+
+// FieldCryptDecryptCmd decrypts access log lines.
+type FieldCryptDecryptCmd struct {
+	IdentityFile string   `name:"identity-file" short:"i" env:"FIELDCRYPT_IDENTITY_FILE" type:"existingfile" required:"" help:"File holding the private key of 'keygen'."`
+	Files        []string `arg:"" optional:"" type:"existingfile" help:"Access log files to decrypt (default standard input)."`
+}
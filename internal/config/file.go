@@ -0,0 +1,236 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the --config flag: a YAML file of flag values, keyed by flag
+// name without the leading dashes. Command-line flags take precedence over
+// the file, which takes precedence over environment variables and defaults.
+//
+//	grpc-port: 9002
+//	log-level: debug
+//	exclude-headers: [authorization, cookie]
+type ConfigFile = kong.ConfigFlag
+
+// ValidateFile checks the YAML configuration file at path against schema.
+func ValidateFile(path string, schema *Schema) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return oops.In("config").Code(errcode.ReadConfigFailed).With("path", path).Wrapf(err, "failed to read configuration file")
+	}
+	_, err = parseYAML(path, data, schema)
+	return err
+}
+
+// loadYAML is the kong configuration loader for --config files.
+func loadYAML(r io.Reader, schema *Schema) (kong.Resolver, error) {
+	name := "config"
+	if f, ok := r.(interface{ Name() string }); ok {
+		name = f.Name()
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, oops.In("config").Code(errcode.ReadConfigFailed).With("path", name).Wrapf(err, "failed to read configuration file")
+	}
+	values, err := parseYAML(name, data, schema)
+	if err != nil {
+		return nil, err
+	}
+	var resolver kong.ResolverFunc = func(_ *kong.Context, _ *kong.Path, flag *kong.Flag) (any, error) {
+		return values[flag.Name], nil
+	}
+	return resolver, nil
+}
+
+// parseYAML validates data against schema, reporting every problem with its
+// file:line:column, and returns the values to resolve flags from.
+func parseYAML(name string, data []byte, schema *Schema) (map[string]any, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, oops.In("config").Code(errcode.InvalidConfig).With("path", name).Wrapf(err, "%s: invalid YAML", name)
+	}
+	values := make(map[string]any)
+	if len(doc.Content) == 0 {
+		return values, nil
+	}
+	v := validator{name: name}
+	seen := make(map[string]bool)
+	root := resolveAlias(doc.Content[0])
+	if root.Kind != yaml.MappingNode {
+		v.errorf(root, "expected a mapping of option names to values, got %s", describe(root))
+		return nil, v.err()
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], resolveAlias(root.Content[i+1])
+		prop, ok := schema.Properties[key.Value]
+		switch {
+		case !ok:
+			v.errorf(key, "unknown option %q", key.Value)
+			continue
+		case seen[key.Value]:
+			v.errorf(key, "option %q is set more than once", key.Value)
+			continue
+		}
+		seen[key.Value] = true
+		if value.Tag == "!!null" {
+			continue
+		}
+		if v.check(key.Value, value, prop) {
+			values[key.Value] = decode(value)
+		}
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+type validator struct {
+	name   string
+	issues []string
+}
+
+func (v *validator) errorf(node *yaml.Node, format string, args ...any) {
+	v.issues = append(v.issues, fmt.Sprintf("%s:%d:%d: %s", v.name, node.Line, node.Column, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) err() error {
+	if len(v.issues) == 0 {
+		return nil
+	}
+	return oops.
+		In("config").
+		Code(errcode.InvalidConfig).
+		With("path", v.name).
+		Errorf("invalid configuration:\n%s", strings.Join(v.issues, "\n"))
+}
+
+// check reports whether node matches s, recording problems under the option
+// path.
+func (v *validator) check(path string, node *yaml.Node, s *Schema) bool {
+	node = resolveAlias(node)
+	ok := true
+	switch s.Type {
+	case "boolean", "integer", "number", "string":
+		if node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+			v.errorf(node, "%s: expected %s, got %s", path, s.Type, describe(node))
+			return false
+		}
+	}
+	switch s.Type {
+	case "boolean":
+		if node.Tag != "!!bool" {
+			v.errorf(node, "%s: expected boolean, got %s", path, describe(node))
+			return false
+		}
+	case "integer":
+		n, err := strconv.ParseInt(node.Value, 0, 64)
+		if node.Tag != "!!int" || err != nil {
+			v.errorf(node, "%s: expected integer, got %s", path, describe(node))
+			return false
+		}
+		if s.Minimum != nil && n < int64(*s.Minimum) {
+			v.errorf(node, "%s: must be at least %d, got %d", path, *s.Minimum, n)
+			ok = false
+		}
+	case "number":
+		if node.Tag != "!!int" && node.Tag != "!!float" {
+			v.errorf(node, "%s: expected number, got %s", path, describe(node))
+			return false
+		}
+	case "string":
+		if s.Format == "duration" {
+			if _, err := time.ParseDuration(node.Value); err != nil {
+				v.errorf(node, "%s: expected a duration such as 30s or 1h30m, got %q", path, node.Value)
+				ok = false
+			}
+		}
+	case "array":
+		if node.Kind != yaml.SequenceNode {
+			v.errorf(node, "%s: expected a list, got %s", path, describe(node))
+			return false
+		}
+		for i, item := range node.Content {
+			ok = v.check(fmt.Sprintf("%s[%d]", path, i), item, s.Items) && ok
+		}
+		return ok
+	case "object":
+		if node.Kind != yaml.MappingNode {
+			v.errorf(node, "%s: expected a mapping, got %s", path, describe(node))
+			return false
+		}
+		items, _ := s.AdditionalProperties.(*Schema)
+		for i := 0; i+1 < len(node.Content) && items != nil; i += 2 {
+			ok = v.check(path+"."+node.Content[i].Value, node.Content[i+1], items) && ok
+		}
+		return ok
+	}
+	if len(s.Enum) > 0 && !slices.Contains(s.Enum, any(node.Value)) {
+		v.errorf(node, "%s: %q is not one of %s", path, node.Value, enumList(s.Enum))
+		ok = false
+	}
+	return ok
+}
+
+// decode converts a validated node to the value kong parses the flag from.
+func decode(node *yaml.Node) any {
+	node = resolveAlias(node)
+	switch node.Kind {
+	case yaml.SequenceNode:
+		out := make([]any, 0, len(node.Content))
+		for _, item := range node.Content {
+			out = append(out, decode(item))
+		}
+		return out
+	case yaml.MappingNode:
+		out := make(map[string]any, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			out[node.Content[i].Value] = decode(node.Content[i+1])
+		}
+		return out
+	}
+	return node.Value
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+func describe(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		return "a list"
+	case yaml.MappingNode:
+		return "a mapping"
+	}
+	switch node.Tag {
+	case "!!null":
+		return "null"
+	case "!!bool", "!!int", "!!float":
+		return fmt.Sprintf("%s %s", strings.TrimPrefix(node.Tag, "!!"), node.Value)
+	}
+	return strconv.Quote(node.Value)
+}
+
+func enumList(enum []any) string {
+	parts := make([]string, 0, len(enum))
+	for _, e := range enum {
+		parts = append(parts, fmt.Sprint(e))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,27 @@
+package config
+
+// GeoCLI is the CLI configuration for the geo routing processor.
+type GeoCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC    GRPCConfig    `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health  HealthConfig  `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin   AdminConfig   `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics MetricsConfig `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log     LogConfig     `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Geo     GeoConfig     `embed:"" prefix:"geo-" envprefix:"GEO_"`
+}
+
+// GeoConfig holds geo routing configuration.
+type GeoConfig struct {
+	MMDBFile         string            `name:"mmdb-file" env:"MMDB_FILE" type:"path" help:"MaxMind-format country database (e.g. GeoLite2-Country.mmdb) used when no trusted CDN header is present."`
+	CDNHeaders       []string          `name:"cdn-headers" env:"CDN_HEADERS" default:"cf-ipcountry,cloudfront-viewer-country,eo-client-ipcountry" help:"CDN country headers, checked in order; believed only from trusted sources and removed otherwise."`
+	TrustedProxies   []string          `name:"trusted-proxies" env:"TRUSTED_PROXIES" placeholder:"CIDR" help:"Peer addresses/CIDRs whose CDN headers are believed."`
+	TrustHeader      string            `name:"trust-header" env:"TRUST_HEADER" placeholder:"NAME=VALUE" help:"Header set by an earlier filter marking CDN requests whose geo headers are believed, e.g. 'x-forwarded-from-edgeone=yes'."`
+	ClientIPHeader   string            `name:"client-ip-header" env:"CLIENT_IP_HEADER" help:"Header holding the client address looked up in the database, as set by an earlier real-IP filter (empty to use the downstream address)."`
+	Regions          map[string]string `name:"regions" env:"REGIONS" help:"Country to region mapping, e.g. 'US=us-east;CA=us-east;DE=eu-central'."`
+	ContinentRegions map[string]string `name:"continent-regions" env:"CONTINENT_REGIONS" help:"Continent to region mapping for unmapped countries, e.g. 'NA=us-east;EU=eu-central;AS=ap-east'."`
+	DefaultRegion    string            `name:"default-region" env:"DEFAULT_REGION" help:"Region for clients that map to no region (empty to leave the header unset)."`
+	RegionHeader     string            `name:"region-header" env:"REGION_HEADER" default:"x-client-region" help:"Request header set to the client's region."`
+	CountryHeader    string            `name:"country-header" env:"COUNTRY_HEADER" default:"x-client-country" help:"Request header set to the client's country code."`
+}
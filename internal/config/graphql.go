@@ -0,0 +1,29 @@
+package config
+
+// GraphQLCLI is the CLI configuration for the GraphQL inspection processor.
+type GraphQLCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC     GRPCConfig     `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health   HealthConfig   `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin    AdminConfig    `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics  MetricsConfig  `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log      LogConfig      `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision DecisionConfig `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	GraphQL  GraphQLConfig  `embed:"" prefix:"graphql-" envprefix:"GRAPHQL_"`
+}
+
+// GraphQLConfig holds GraphQL inspection configuration.
+type GraphQLConfig struct {
+	Paths              []string          `name:"paths" env:"PATHS" default:"/graphql" help:"Comma-separated path prefixes of GraphQL endpoints."`
+	MaxBodyBytes       int               `name:"max-body-bytes" env:"MAX_BODY_BYTES" default:"1048576" help:"Request bodies over this size are rejected with 413 (0 disables)."`
+	MaxDepth           int               `name:"max-depth" env:"MAX_DEPTH" default:"12" help:"Maximum field nesting depth of an operation (0 disables)."`
+	MaxComplexity      int64             `name:"max-complexity" env:"MAX_COMPLEXITY" default:"5000" help:"Maximum operation complexity: fields selected, multiplied by list arguments (0 disables)."`
+	ListArguments      []string          `name:"list-arguments" env:"LIST_ARGUMENTS" default:"first,last,limit" help:"Arguments whose integer value multiplies the complexity of a field's selections."`
+	MaxBatch           int               `name:"max-batch" env:"MAX_BATCH" default:"10" help:"Maximum operations in a batched request (0 rejects batches)."`
+	BlockIntrospection bool              `name:"block-introspection" env:"BLOCK_INTROSPECTION" default:"true" negatable:"" help:"Reject __schema and __type queries with 403; disable outside production."`
+	OperationLimits    map[string]string `name:"operation-limits" env:"OPERATION_LIMITS" help:"Rate limits per operation name and client address, e.g. 'Login=5/minute;Search=20/second'; anonymous operations are named '(anonymous)'."`
+	DefaultLimit       string            `name:"default-limit" env:"DEFAULT_LIMIT" help:"Rate limit per client address of operations without their own limit, e.g. '100/minute' (empty disables)."`
+	CacheSize          int               `name:"cache-size" env:"CACHE_SIZE" default:"100000" help:"Maximum number of rate limit buckets kept in memory (LRU evicted)."`
+	OperationHeader    string            `name:"operation-header" env:"OPERATION_HEADER" default:"x-graphql-operation" help:"Request header set to the operation name, comma separated for batches (empty disables)."`
+}
@@ -0,0 +1,22 @@
+package config
+
+// HeaderPolicyCLI is the CLI configuration for the response header policy processor.
+type HeaderPolicyCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC    GRPCConfig         `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health  HealthConfig       `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin   AdminConfig        `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics MetricsConfig      `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log     LogConfig          `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Policy  HeaderPolicyConfig `embed:"" prefix:"policy-" envprefix:"POLICY_"`
+}
+
+// HeaderPolicyConfig holds response header filtering configuration.
+type HeaderPolicyConfig struct {
+	Mode       string            `name:"mode" env:"MODE" enum:"denylist,allowlist" default:"denylist" help:"Remove denied headers (denylist) or everything not allowed (allowlist)."`
+	Allow      []string          `name:"allow" env:"ALLOW" help:"Extra allowed header patterns for allowlist mode; a trailing '*' matches a prefix."`
+	Deny       []string          `name:"deny" env:"DENY" help:"Extra denied header patterns for denylist mode; a trailing '*' matches a prefix."`
+	NoDefaults bool              `name:"no-defaults" env:"NO_DEFAULTS" help:"Do not include the built-in allow/deny patterns."`
+	Rewrite    map[string]string `name:"rewrite" env:"REWRITE" help:"Replace values of kept headers, e.g. 'server=edge'."`
+}
@@ -0,0 +1,31 @@
+package config
+
+import "time"
+
+// IntrospectionCLI is the CLI configuration for the token introspection processor.
+type IntrospectionCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC          GRPCConfig          `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health        HealthConfig        `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin         AdminConfig         `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics       MetricsConfig       `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	HTTPClient    HTTPClientConfig    `embed:"" prefix:"http-client-" envprefix:"HTTP_CLIENT_"`
+	Log           LogConfig           `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision      DecisionConfig      `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	Introspection IntrospectionConfig `embed:"" prefix:"introspection-" envprefix:"INTROSPECTION_"`
+}
+
+// IntrospectionConfig holds OAuth2 token introspection configuration.
+type IntrospectionConfig struct {
+	Endpoint       string            `name:"endpoint" env:"ENDPOINT" required:"" help:"RFC 7662 token introspection endpoint URL."`
+	ClientID       string            `name:"client-id" env:"CLIENT_ID" required:"" help:"OAuth2 client ID used to authenticate to the introspection endpoint."`
+	ClientSecret   string            `name:"client-secret" env:"CLIENT_SECRET" required:"" help:"OAuth2 client secret used to authenticate to the introspection endpoint."`
+	TokenTypeHint  string            `name:"token-type-hint" env:"TOKEN_TYPE_HINT" default:"access_token" help:"token_type_hint sent with introspection requests (empty to omit)."`
+	CacheSize      int               `name:"cache-size" env:"CACHE_SIZE" default:"10000" help:"LRU cache size for introspection results."`
+	CacheTTL       time.Duration     `name:"cache-ttl" env:"CACHE_TTL" default:"1m" help:"Cache TTL for introspection results; never exceeds the token's exp."`
+	Timeout        time.Duration     `name:"timeout" env:"TIMEOUT" default:"5s" help:"Introspection request timeout."`
+	RequiredScopes []string          `name:"required-scopes" env:"REQUIRED_SCOPES" help:"Comma-separated scopes every request must carry."`
+	RouteScopes    map[string]string `name:"route-scopes" env:"ROUTE_SCOPES" help:"Extra space-separated scopes required per path prefix, e.g. '/admin=admin;/orders=orders:write'."`
+	HeaderPrefix   string            `name:"header-prefix" env:"HEADER_PREFIX" default:"x-auth-" help:"Prefix of identity headers injected upstream (subject, scope, client-id, username)."`
+}
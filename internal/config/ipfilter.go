@@ -0,0 +1,28 @@
+package config
+
+import "time"
+
+// IPFilterCLI is the CLI configuration for the IP filter processor.
+type IPFilterCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC     GRPCConfig     `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health   HealthConfig   `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin    AdminConfig    `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics  MetricsConfig  `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log      LogConfig      `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision DecisionConfig `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	IPFilter IPFilterConfig `embed:"" prefix:"ipfilter-" envprefix:"IPFILTER_"`
+	Store    KVStoreConfig  `embed:"" prefix:"store-" envprefix:"STORE_"`
+}
+
+// IPFilterConfig holds the allow and deny lists.
+type IPFilterConfig struct {
+	AllowFiles     []string      `name:"allow-files" env:"ALLOW_FILES" help:"Files of allowed addresses and CIDRs, one per line: paths or watched 'configmap://[namespace/]name/key' or 'secret://...' references. Any allow entry makes the allowlist exclusive."`
+	DenyFiles      []string      `name:"deny-files" env:"DENY_FILES" help:"Files of denied addresses and CIDRs, one per line; checked before the allowlist."`
+	Allow          []string      `name:"allow" env:"ALLOW" help:"Comma-separated allowed addresses and CIDRs."`
+	Deny           []string      `name:"deny" env:"DENY" help:"Comma-separated denied addresses and CIDRs."`
+	ClientIPHeader string        `name:"client-ip-header" env:"CLIENT_IP_HEADER" help:"Header holding the client address, set by a trusted earlier filter (e.g. x-real-ip); empty uses the downstream peer address."`
+	ReloadInterval time.Duration `name:"reload-interval" env:"RELOAD_INTERVAL" default:"5s" help:"How often list files are checked for changes."`
+	Denylist       bool          `name:"runtime-denylist" env:"RUNTIME_DENYLIST" help:"Deny addresses added at runtime through /admin/ipfilter/deny, kept in the --store-* state store and so shared by replicas unless it is 'memory'."`
+}
@@ -0,0 +1,21 @@
+package config
+
+// JSONRedactCLI is the CLI configuration for the streaming JSON redaction processor.
+type JSONRedactCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC    GRPCConfig       `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health  HealthConfig     `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin   AdminConfig      `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics MetricsConfig    `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log     LogConfig        `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Redact  JSONRedactConfig `embed:"" prefix:"redact-" envprefix:"REDACT_"`
+}
+
+// JSONRedactConfig holds streaming JSON redaction configuration.
+type JSONRedactConfig struct {
+	Routes []string `name:"routes" env:"ROUTES" default:"/" help:"Comma-separated path prefixes whose JSON responses are redacted."`
+	Remove []string `name:"remove" env:"REMOVE" help:"JSON paths of object members to remove, e.g. 'user.password,**.secret'."`
+	Mask   []string `name:"mask" env:"MASK" help:"JSON paths of values to mask, e.g. 'items[*].ssn'."`
+	With   string   `name:"mask-value" env:"MASK_VALUE" default:"[REDACTED]" help:"String replacing masked values."`
+}
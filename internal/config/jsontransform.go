@@ -0,0 +1,23 @@
+package config
+
+import "time"
+
+// JSONTransformCLI is the CLI configuration for the JSON request body
+// transform processor.
+type JSONTransformCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC      GRPCConfig          `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health    HealthConfig        `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin     AdminConfig         `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics   MetricsConfig       `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log       LogConfig           `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Transform JSONTransformConfig `embed:"" prefix:"transform-" envprefix:"TRANSFORM_"`
+}
+
+// JSONTransformConfig holds JSON request body transform configuration.
+type JSONTransformConfig struct {
+	RulesFile    string        `name:"rules-file" env:"RULES_FILE" required:"" help:"YAML mapping of route prefixes to jq templates: a file or a watched 'configmap://[namespace/]name/key' or 'secret://...' reference."`
+	MaxBodyBytes int           `name:"max-body-bytes" env:"MAX_BODY_BYTES" default:"1048576" help:"Request bodies over this size are rejected with 413 on transformed routes (0 disables)."`
+	Timeout      time.Duration `name:"timeout" env:"TIMEOUT" default:"100ms" help:"Maximum time of a single template run (0 disables)."`
+}
@@ -0,0 +1,32 @@
+package config
+
+import "time"
+
+// JWTAuthCLI is the CLI configuration for the jwt-auth processor.
+type JWTAuthCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC       GRPCConfig       `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health     HealthConfig     `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin      AdminConfig      `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics    MetricsConfig    `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	HTTPClient HTTPClientConfig `embed:"" prefix:"http-client-" envprefix:"HTTP_CLIENT_"`
+	Log        LogConfig        `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision   DecisionConfig   `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	JWT        JWTAuthConfig    `embed:"" prefix:"jwt-" envprefix:"JWT_"`
+}
+
+// JWTAuthConfig holds JWT bearer token validation configuration.
+type JWTAuthConfig struct {
+	JWKSURL            string        `name:"jwks-url" env:"JWKS_URL" required:"" help:"URL of the JSON Web Key Set holding the token signing keys."`
+	Issuer             string        `name:"issuer" env:"ISSUER" help:"Required iss claim (empty to accept any issuer)."`
+	Audiences          []string      `name:"audiences" env:"AUDIENCES" help:"Comma-separated accepted audiences; the aud claim must contain one (empty to skip the check)."`
+	Algorithms         []string      `name:"algorithms" env:"ALGORITHMS" help:"Comma-separated accepted signature algorithms (default: all RSA, RSA-PSS, ECDSA and EdDSA algorithms)."`
+	Leeway             time.Duration `name:"leeway" env:"LEEWAY" default:"30s" help:"Clock skew tolerated when checking exp, nbf and iat."`
+	RefreshInterval    time.Duration `name:"refresh-interval" env:"REFRESH_INTERVAL" default:"1h" help:"How often the JWKS is fetched again."`
+	MinRefreshInterval time.Duration `name:"min-refresh-interval" env:"MIN_REFRESH_INTERVAL" default:"1m" help:"Minimum time between refreshes triggered by tokens with an unknown key ID, and between retries after a failed fetch."`
+	Timeout            time.Duration `name:"timeout" env:"TIMEOUT" default:"5s" help:"JWKS request timeout."`
+	Claims             []string      `name:"claims" env:"CLAIMS" help:"Comma-separated claims forwarded upstream as <header-prefix>claims-<claim> headers."`
+	HeaderPrefix       string        `name:"header-prefix" env:"HEADER_PREFIX" default:"x-jwt-" help:"Prefix of the claim headers injected upstream (sub, claims-*)."`
+	StripAuthorization bool          `name:"strip-authorization" env:"STRIP_AUTHORIZATION" help:"Remove the Authorization header once the token is verified."`
+}
@@ -0,0 +1,37 @@
+package config
+
+import "time"
+
+// LDAPAuthCLI is the CLI configuration for the LDAP group authorization processor.
+type LDAPAuthCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC     GRPCConfig     `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health   HealthConfig   `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin    AdminConfig    `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics  MetricsConfig  `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log      LogConfig      `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision DecisionConfig `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	LDAP     LDAPConfig     `embed:"" prefix:"ldap-" envprefix:"LDAP_"`
+}
+
+// LDAPConfig holds LDAP/AD connection and authorization configuration.
+type LDAPConfig struct {
+	URL            string            `name:"url" env:"URL" required:"" help:"LDAP server URL (ldap:// or ldaps://)."`
+	BindDN         string            `name:"bind-dn" env:"BIND_DN" help:"Service account DN used for searches."`
+	BindPassword   string            `name:"bind-password" env:"BIND_PASSWORD" help:"Service account password."`
+	StartTLS       bool              `name:"start-tls" env:"START_TLS" help:"Upgrade ldap:// connections with StartTLS."`
+	BaseDN         string            `name:"base-dn" env:"BASE_DN" required:"" help:"Search base DN."`
+	UserFilter     string            `name:"user-filter" env:"USER_FILTER" default:"(&(objectClass=user)(sAMAccountName=%s))" help:"User search filter; %s is replaced with the escaped identity."`
+	GroupAttribute string            `name:"group-attribute" env:"GROUP_ATTRIBUTE" default:"memberOf" help:"User attribute listing group DNs."`
+	NestedGroups   bool              `name:"nested-groups" env:"NESTED_GROUPS" help:"Resolve nested Active Directory groups (LDAP_MATCHING_RULE_IN_CHAIN)."`
+	PoolSize       int               `name:"pool-size" env:"POOL_SIZE" default:"4" help:"Maximum idle pooled LDAP connections."`
+	CacheSize      int               `name:"cache-size" env:"CACHE_SIZE" default:"10000" help:"LRU cache size for group lookups."`
+	CacheTTL       time.Duration     `name:"cache-ttl" env:"CACHE_TTL" default:"5m" help:"Cache TTL for group lookups."`
+	Timeout        time.Duration     `name:"timeout" env:"TIMEOUT" default:"5s" help:"LDAP dial and operation timeout."`
+	IdentityHeader string            `name:"identity-header" env:"IDENTITY_HEADER" default:"x-auth-subject" help:"Request header with the authenticated user, set by a trusted authenticator."`
+	GroupsHeader   string            `name:"groups-header" env:"GROUPS_HEADER" help:"Inject the user's group CNs upstream in this header (optional)."`
+	DefaultGroups  []string          `name:"default-groups" env:"DEFAULT_GROUPS" help:"Group DNs (any-of) required on paths without a route rule."`
+	RouteGroups    map[string]string `name:"route-groups" env:"ROUTE_GROUPS" help:"Group DNs required per path prefix, '|'-separated, e.g. '/admin=cn=Domain Admins,cn=Users,dc=corp,dc=example;/billing=cn=finance,ou=Groups,dc=corp,dc=example'."`
+	MatchCN        bool              `name:"match-cn" env:"MATCH_CN" help:"Also accept required groups given by CN alone; CNs are not unique across a directory."`
+}
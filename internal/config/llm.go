@@ -0,0 +1,27 @@
+package config
+
+// LLMCLI is the CLI configuration for the LLM inspection processor.
+type LLMCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC     GRPCConfig     `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health   HealthConfig   `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin    AdminConfig    `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics  MetricsConfig  `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log      LogConfig      `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision DecisionConfig `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	LLM      LLMConfig      `embed:"" prefix:"llm-" envprefix:"LLM_"`
+}
+
+// LLMConfig holds OpenAI-compatible API inspection configuration.
+type LLMConfig struct {
+	Routes              []string `name:"routes" env:"ROUTES" default:"/v1/" help:"Comma-separated path prefixes of OpenAI-compatible endpoints."`
+	MaxRequestBytes     int      `name:"max-request-bytes" env:"MAX_REQUEST_BYTES" default:"1048576" help:"Reject larger request bodies with 413."`
+	MaxPromptTokens     int      `name:"max-prompt-tokens" env:"MAX_PROMPT_TOKENS" default:"0" help:"Reject prompts estimated above this many tokens (0 disables)."`
+	MaxCompletionTokens int      `name:"max-completion-tokens" env:"MAX_COMPLETION_TOKENS" default:"0" help:"Reject requests asking for more output tokens (0 disables)."`
+	AllowedModels       []string `name:"allowed-models" env:"ALLOWED_MODELS" help:"Comma-separated models clients may request (empty allows all)."`
+	LogPrompts          bool     `name:"log-prompts" env:"LOG_PROMPTS" help:"Log prompts after redaction."`
+	LogMaxChars         int      `name:"log-max-chars" env:"LOG_MAX_CHARS" default:"2000" help:"Truncate logged prompts to this many bytes."`
+	RedactPatterns      []string `name:"redact-patterns" env:"REDACT_PATTERNS" sep:"none" help:"Extra regular expressions masked in logged prompts (repeatable)."`
+	UsageHeaderPrefix   string   `name:"usage-header-prefix" env:"USAGE_HEADER_PREFIX" default:"x-llm-" help:"Prefix of usage headers added to non-streaming responses (empty disables)."`
+}
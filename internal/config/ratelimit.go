@@ -0,0 +1,49 @@
+package config
+
+// RateLimitServiceCLI is the CLI configuration for the Envoy RateLimitService
+// compatible server.
+type RateLimitServiceCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC      GRPCConfig      `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health    HealthConfig    `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin     AdminConfig     `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics   MetricsConfig   `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log       LogConfig       `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision  DecisionConfig  `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	RateLimit RateLimitConfig `embed:"" prefix:"ratelimit-" envprefix:"RATELIMIT_"`
+	Store     KVStoreConfig   `embed:"" prefix:"store-" envprefix:"STORE_"`
+	DynConfig DynConfigConfig `embed:"" prefix:"dynconfig-" envprefix:"DYNCONFIG_"`
+}
+
+// RateLimitConfig holds rate limit rules and limiter configuration.
+type RateLimitConfig struct {
+	RulesFile       string `name:"rules-file" env:"RULES_FILE" required:"" help:"YAML descriptor rules in envoyproxy/ratelimit format: a file or a watched 'configmap://[namespace/]name/key' or 'secret://...' reference."`
+	CacheSize       int    `name:"cache-size" env:"CACHE_SIZE" default:"100000" help:"Maximum number of token buckets kept in memory (LRU evicted) with the memory store."`
+	ResponseHeaders bool   `name:"response-headers" env:"RESPONSE_HEADERS" default:"true" help:"Add x-ratelimit-limit/remaining/reset headers to responses."`
+}
+
+// RateLimitProcessorCLI is the CLI configuration for the rate limiting
+// processor.
+type RateLimitProcessorCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC      GRPCConfig               `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health    HealthConfig             `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin     AdminConfig              `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics   MetricsConfig            `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log       LogConfig                `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision  DecisionConfig           `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	RateLimit RateLimitProcessorConfig `embed:"" prefix:"ratelimit-" envprefix:"RATELIMIT_"`
+	Store     KVStoreConfig            `embed:"" prefix:"store-" envprefix:"STORE_"`
+}
+
+// RateLimitProcessorConfig holds rate limiting processor configuration.
+type RateLimitProcessorConfig struct {
+	Limit           string `name:"limit" env:"LIMIT" default:"100/minute" help:"Token bucket limit per client of requests matching no rule, e.g. '100/minute' or '10/30s' (empty disables)."`
+	Key             string `name:"key" env:"KEY" default:"ip" help:"Client key of the default limit and of rules without their own: 'ip' or 'header:<name>'."`
+	RulesFile       string `name:"rules-file" env:"RULES_FILE" help:"YAML rules of per-route limits: a file or a watched 'configmap://[namespace/]name/key' or 'secret://...' reference."`
+	CacheSize       int    `name:"cache-size" env:"CACHE_SIZE" default:"100000" help:"Maximum number of token buckets kept in memory (LRU evicted) with the memory store."`
+	ResponseHeaders bool   `name:"response-headers" env:"RESPONSE_HEADERS" default:"true" help:"Add x-ratelimit-limit/remaining/reset headers to responses."`
+	FailurePolicy   string `name:"failure-policy" env:"FAILURE_POLICY" enum:"open,closed" default:"open" help:"When the shared store fails: 'open' lets requests through, 'closed' rejects them with 503."`
+}
@@ -0,0 +1,32 @@
+package config
+
+// RecordCLI is the CLI configuration for the traffic recording processor.
+type RecordCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC         GRPCConfig         `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health       HealthConfig       `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin        AdminConfig        `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics      MetricsConfig      `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	HTTPClient   HTTPClientConfig   `embed:"" prefix:"http-client-" envprefix:"HTTP_CLIENT_"`
+	Log          LogConfig          `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Record       RecordConfig       `embed:"" prefix:"record-" envprefix:"RECORD_"`
+	FeatureFlags FeatureFlagsConfig `embed:"" prefix:"feature-flags-" envprefix:"FEATURE_FLAGS_"`
+}
+
+// RecordConfig holds traffic recording configuration.
+type RecordConfig struct {
+	Dir           string   `name:"dir" env:"DIR" type:"path" required:"" help:"Directory capture files are written to."`
+	Format        string   `name:"format" env:"FORMAT" enum:"har,extproc" default:"har" help:"Capture format: 'har' or 'extproc' (length-delimited ext_proc messages)."`
+	MaxFileSize   int      `name:"max-file-size" env:"MAX_FILE_SIZE" default:"100" help:"Size in MB after which a new capture file is started."`
+	MaxFiles      int      `name:"max-files" env:"MAX_FILES" default:"10" help:"Number of capture files kept (0 keeps all)."`
+	Routes        []string `name:"routes" env:"ROUTES" help:"Comma-separated path prefixes eligible for recording (empty matches all)."`
+	SamplePercent float64  `name:"sample-percent" env:"SAMPLE_PERCENT" default:"1" help:"Percentage of eligible exchanges recorded."`
+	MaxBodyBytes  int      `name:"max-body-bytes" env:"MAX_BODY_BYTES" default:"1048576" help:"Bytes kept of each request and response body."`
+	SpillBytes    int      `name:"spill-bytes" env:"SPILL_BYTES" default:"65536" help:"Bytes of each body kept in memory until the exchange is written; the rest waits in a temporary file (0 keeps bodies in memory)."`
+	SpillDir      string   `name:"spill-dir" env:"SPILL_DIR" type:"path" help:"Directory for temporary body files (default: the system temporary directory)."`
+	SpillDisk     int      `name:"spill-disk" env:"SPILL_DISK" default:"1024" help:"Disk space in MB temporary body files may use; bodies that do not fit are truncated."`
+	RedactHeaders []string `name:"redact-headers" env:"REDACT_HEADERS" default:"cookie,set-cookie,authorization,proxy-authorization" help:"Headers whose values are redacted."`
+	RedactQuery   []string `name:"redact-query" env:"REDACT_QUERY" help:"Query parameters whose values are redacted."`
+	RedactFields  []string `name:"redact-fields" env:"REDACT_FIELDS" help:"JSON body paths masked in captures, e.g. '**.password,card.number'."`
+}
@@ -0,0 +1,37 @@
+package config
+
+import "time"
+
+// SAMLCLI is the CLI configuration for the SAML SSO processor.
+type SAMLCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC       GRPCConfig       `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health     HealthConfig     `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin      AdminConfig      `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics    MetricsConfig    `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	HTTPClient HTTPClientConfig `embed:"" prefix:"http-client-" envprefix:"HTTP_CLIENT_"`
+	Log        LogConfig        `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision   DecisionConfig   `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	SAML       SAMLConfig       `embed:"" prefix:"saml-" envprefix:"SAML_"`
+}
+
+// SAMLConfig holds SAML service provider configuration.
+type SAMLConfig struct {
+	EntityID          string            `name:"entity-id" env:"ENTITY_ID" required:"" help:"Service provider entity ID."`
+	ACSURL            string            `name:"acs-url" env:"ACS_URL" required:"" help:"Absolute assertion consumer service URL, e.g. https://app.example.com/saml/acs."`
+	IDPMetadataURL    string            `name:"idp-metadata-url" env:"IDP_METADATA_URL" xor:"idp-metadata" help:"URL of the IdP metadata document."`
+	IDPMetadataFile   string            `name:"idp-metadata-file" env:"IDP_METADATA_FILE" type:"existingfile" xor:"idp-metadata" help:"Path to the IdP metadata document."`
+	SPCertFile        string            `name:"sp-cert-file" env:"SP_CERT_FILE" type:"existingfile" help:"SP certificate (PEM) published in metadata and used to sign requests (optional)."`
+	SPKeyFile         string            `name:"sp-key-file" env:"SP_KEY_FILE" type:"existingfile" help:"SP private key (PEM) for signing requests and decrypting assertions (optional)."`
+	SignRequests      bool              `name:"sign-requests" env:"SIGN_REQUESTS" help:"Sign AuthnRequests with the SP key."`
+	AllowIDPInitiated bool              `name:"allow-idp-initiated" env:"ALLOW_IDP_INITIATED" help:"Accept unsolicited IdP-initiated assertions."`
+	SessionKey        string            `name:"session-key" env:"SESSION_KEY" required:"" help:"Secret (at least 32 bytes) used to sign session and tracking cookies."`
+	SessionCookie     string            `name:"session-cookie" env:"SESSION_COOKIE" default:"saml_session" help:"Session cookie name."`
+	SessionTTL        time.Duration     `name:"session-ttl" env:"SESSION_TTL" default:"8h" help:"Session lifetime."`
+	SubjectHeader     string            `name:"subject-header" env:"SUBJECT_HEADER" default:"x-saml-subject" help:"Request header carrying the authenticated NameID."`
+	AttributeHeaders  map[string]string `name:"attribute-headers" env:"ATTRIBUTE_HEADERS" help:"SAML attribute to request header mapping, e.g. 'email=x-saml-email;groups=x-saml-groups'."`
+	MetadataPath      string            `name:"metadata-path" env:"METADATA_PATH" default:"/saml/metadata" help:"Path serving SP metadata (empty disables)."`
+	SkipPaths         []string          `name:"skip-paths" env:"SKIP_PATHS" help:"Path prefixes, matched on whole segments, that bypass authentication."`
+	MetadataTimeout   time.Duration     `name:"metadata-timeout" env:"METADATA_TIMEOUT" default:"10s" help:"Timeout for fetching IdP metadata."`
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+// Schema is the subset of JSON Schema (draft 2020-12) describing a
+// command's configuration file.
+type Schema struct {
+	SchemaURI            string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Minimum              *int               `json:"minimum,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Default              any                `json:"default,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"`
+}
+
+// durationPattern matches the strings accepted by time.ParseDuration.
+const durationPattern = `^[-+]?(0|([0-9]*(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`
+
+var (
+	durationType        = reflect.TypeFor[time.Duration]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// Parse parses the command line into cli like kong.Parse, adding the
+// --config YAML file loader and the "schema" subcommand to every command:
+//
+//	<command> schema                      print the JSON Schema of the configuration
+//	<command> schema validate FILE...     validate configuration files against it
+func Parse(cli any, description string) *kong.Context {
+	var schema *Schema
+	parser := kong.Must(cli,
+		kong.Description(description),
+		kong.UsageOnError(),
+		kong.Configuration(func(r io.Reader) (kong.Resolver, error) {
+			return loadYAML(r, schema)
+		}),
+	)
+	schema = SchemaFor(parser)
+
+	if args := os.Args[1:]; len(args) > 0 && args[0] == "schema" {
+		os.Exit(runSchema(parser, schema, args[1:]))
+	}
+
+	ctx, err := parser.Parse(os.Args[1:])
+	parser.FatalIfErrorf(err)
+	return ctx
+}
+
+// SchemaFor derives the configuration schema from the flags of every command
+// of parser. Keys are flag names without the leading dashes, as accepted by
+// --config files.
+func SchemaFor(parser *kong.Kong) *Schema {
+	schema := &Schema{
+		SchemaURI:            "https://json-schema.org/draft/2020-12/schema",
+		Title:                parser.Model.Name,
+		Description:          parser.Model.Help,
+		Type:                 "object",
+		Properties:           make(map[string]*Schema),
+		AdditionalProperties: false,
+	}
+	var walk func(node *kong.Node)
+	walk = func(node *kong.Node) {
+		for _, flag := range node.Flags {
+			if flag.Name == "help" || flag.Target.Type() == reflect.TypeFor[kong.ConfigFlag]() {
+				continue
+			}
+			if _, ok := schema.Properties[flag.Name]; !ok {
+				schema.Properties[flag.Name] = flagSchema(flag)
+			}
+		}
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	walk(parser.Model.Node)
+	return schema
+}
+
+func flagSchema(flag *kong.Flag) *Schema {
+	s := typeSchema(flag.Target.Type())
+	s.Description = flag.Help
+	if flag.Required {
+		s.Description = strings.TrimSpace(s.Description + " Required (here, on the command line or in the environment).")
+	}
+	if flag.Enum != "" {
+		for _, v := range strings.Split(flag.Enum, ",") {
+			enum := &s.Enum
+			if s.Items != nil {
+				enum = &s.Items.Enum
+			}
+			*enum = append(*enum, strings.TrimSpace(v))
+		}
+	}
+	if flag.HasDefault {
+		s.Default = defaultValue(s, flag.Default, flag.Tag.Sep)
+	}
+	return s
+}
+
+func typeSchema(t reflect.Type) *Schema {
+	switch {
+	case t == durationType:
+		return &Schema{Type: "string", Format: "duration", Pattern: durationPattern}
+	case reflect.PointerTo(t).Implements(textUnmarshalerType):
+		return &Schema{Type: "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		zero := 0
+		return &Schema{Type: "integer", Minimum: &zero}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice:
+		return &Schema{Type: "array", Items: typeSchema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: typeSchema(t.Elem())}
+	}
+	return &Schema{}
+}
+
+// defaultValue converts a flag default to the schema type, keeping the
+// string when it does not convert.
+func defaultValue(s *Schema, def string, sep rune) any {
+	switch s.Type {
+	case "boolean":
+		if v, err := strconv.ParseBool(def); err == nil {
+			return v
+		}
+	case "integer":
+		if v, err := strconv.ParseInt(def, 10, 64); err == nil {
+			return v
+		}
+	case "number":
+		if v, err := strconv.ParseFloat(def, 64); err == nil {
+			return v
+		}
+	case "array":
+		if def == "" {
+			return []any{}
+		}
+		parts := []string{def}
+		if sep != -1 {
+			parts = strings.Split(def, string(sep))
+		}
+		out := make([]any, 0, len(parts))
+		for _, p := range parts {
+			out = append(out, defaultValue(s.Items, p, -1))
+		}
+		return out
+	case "object":
+		return nil
+	}
+	return def
+}
+
+func runSchema(parser *kong.Kong, schema *Schema, args []string) int {
+	switch {
+	case len(args) == 0:
+		enc := json.NewEncoder(parser.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(schema); err != nil {
+			fmt.Fprintf(parser.Stderr, "%s: error: %v\n", parser.Model.Name, err)
+			return 1
+		}
+		return 0
+	case args[0] == "validate" && len(args) > 1:
+		status := 0
+		for _, path := range args[1:] {
+			if err := ValidateFile(path, schema); err != nil {
+				fmt.Fprintln(parser.Stderr, err)
+				status = 1
+				continue
+			}
+			fmt.Fprintf(parser.Stdout, "%s: ok\n", path)
+		}
+		return status
+	}
+	fmt.Fprintf(parser.Stderr, "usage: %s schema [validate FILE...]\n", parser.Model.Name)
+	return 2
+}
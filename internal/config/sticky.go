@@ -0,0 +1,25 @@
+package config
+
+import "time"
+
+// StickyCLI is the CLI configuration for the sticky session processor.
+type StickyCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC    GRPCConfig    `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health  HealthConfig  `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin   AdminConfig   `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics MetricsConfig `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log     LogConfig     `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Sticky  StickyConfig  `embed:"" prefix:"sticky-" envprefix:"STICKY_"`
+}
+
+// StickyConfig holds sticky session configuration.
+type StickyConfig struct {
+	Shards     []string      `name:"shards" env:"SHARDS" required:"" help:"Comma-separated backend shard identifiers clients are pinned to."`
+	CookieKey  string        `name:"cookie-key" env:"COOKIE_KEY" required:"" help:"Secret (at least 32 bytes) used to sign the session cookie."`
+	CookieName string        `name:"cookie-name" env:"COOKIE_NAME" default:"_sticky" help:"Session cookie name."`
+	CookieTTL  time.Duration `name:"cookie-ttl" env:"COOKIE_TTL" default:"24h" help:"Session cookie lifetime; it is renewed once half has passed."`
+	Insecure   bool          `name:"insecure-cookie" env:"INSECURE_COOKIE" help:"Do not mark the cookie Secure, for plain HTTP development setups."`
+	Header     string        `name:"header" env:"HEADER" default:"x-sticky-shard" help:"Request header carrying the shard to Envoy's hash policy and the upstream."`
+}
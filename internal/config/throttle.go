@@ -0,0 +1,28 @@
+package config
+
+import "time"
+
+// ThrottleCLI is the CLI configuration for the download throttling processor.
+type ThrottleCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC     GRPCConfig     `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health   HealthConfig   `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin    AdminConfig    `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics  MetricsConfig  `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log      LogConfig      `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision DecisionConfig `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	Throttle ThrottleConfig `embed:"" prefix:"throttle-" envprefix:"THROTTLE_"`
+}
+
+// ThrottleConfig holds download throttling configuration.
+type ThrottleConfig struct {
+	Routes         []string      `name:"routes" env:"ROUTES" default:"/" help:"Comma-separated path prefixes of large file routes to throttle."`
+	MaxConcurrent  int           `name:"max-concurrent" env:"MAX_CONCURRENT" default:"2" help:"Concurrent downloads allowed per client IP (0 disables)."`
+	BytesPerSecond int64         `name:"bytes-per-second" env:"BYTES_PER_SECOND" default:"1048576" help:"Response bandwidth per client IP, shared by its downloads (0 disables pacing)."`
+	Burst          int64         `name:"burst" env:"BURST" default:"262144" help:"Bytes a client may receive before pacing starts."`
+	MaxDelay       time.Duration `name:"max-delay" env:"MAX_DELAY" default:"150ms" help:"Maximum delay per body chunk; keep below the filter's message_timeout."`
+	MinSize        int64         `name:"min-size" env:"MIN_SIZE" default:"0" help:"Skip pacing for responses with a smaller Content-Length."`
+	MaxRanges      int           `name:"max-ranges" env:"MAX_RANGES" default:"8" help:"Reject Range headers with more ranges with 416 (0 disables)."`
+	CacheSize      int           `name:"cache-size" env:"CACHE_SIZE" default:"100000" help:"Number of client bandwidth pacers kept in memory."`
+}
@@ -0,0 +1,25 @@
+package config
+
+// XMLGuardCLI is the CLI configuration for the XML/SOAP guard processor.
+type XMLGuardCLI struct {
+	Config ConfigFile `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC     GRPCConfig     `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health   HealthConfig   `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin    AdminConfig    `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics  MetricsConfig  `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log      LogConfig      `embed:"" prefix:"log-" envprefix:"LOG_"`
+	Decision DecisionConfig `embed:"" prefix:"decision-" envprefix:"DECISION_"`
+	XML      XMLGuardConfig `embed:"" prefix:"xml-" envprefix:"XML_"`
+}
+
+// XMLGuardConfig holds XML/SOAP guard configuration.
+type XMLGuardConfig struct {
+	Routes          []string `name:"routes" env:"ROUTES" default:"/" help:"Comma-separated path prefixes whose XML request bodies are checked."`
+	MaxBodyBytes    int      `name:"max-body-bytes" env:"MAX_BODY_BYTES" default:"1048576" help:"XML request bodies over this size are rejected with 413 (0 disables)."`
+	MaxDepth        int      `name:"max-depth" env:"MAX_DEPTH" default:"64" help:"Maximum element nesting depth (0 disables)."`
+	MaxElements     int      `name:"max-elements" env:"MAX_ELEMENTS" default:"100000" help:"Maximum number of elements in a document (0 disables)."`
+	MaxAttributes   int      `name:"max-attributes" env:"MAX_ATTRIBUTES" default:"64" help:"Maximum number of attributes of one element (0 disables)."`
+	AllowDTD        bool     `name:"allow-dtd" env:"ALLOW_DTD" help:"Accept internal DTDs; external DTDs and entity declarations are always rejected."`
+	OperationHeader string   `name:"operation-header" env:"OPERATION_HEADER" default:"x-soap-operation" help:"Request header set to the SOAP operation, '{namespace}name' of the first body element (empty disables)."`
+}
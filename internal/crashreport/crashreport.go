@@ -0,0 +1,212 @@
+// Package crashreport sends panics and error-level log events to Sentry or a
+// Sentry-compatible service (GlitchTip, Bugsink), so crashes of production
+// sidecars are noticed. Events are tagged with the release, environment and
+// processor, and request data is scrubbed before it leaves the process.
+package crashreport
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// filtered replaces scrubbed values, as Sentry's own scrubbers do.
+const filtered = "[Filtered]"
+
+// scrubbed are words of log field names whose values are request data.
+var scrubbed = []string{
+	"header", "cookie", "body", "authorization", "token", "password", "secret",
+	"request", "response", "query", "attrs", "ip", "url", "user", "path", "addr",
+}
+
+// kept are log field names that match scrubbed words but only identify
+// the request, and are needed to find its logs.
+var kept = []string{"request_id"}
+
+var (
+	enabled      atomic.Bool
+	flushTimeout time.Duration
+)
+
+// Init configures the Sentry client and returns a writer reporting
+// error-level log events, or nil when cfg has no DSN.
+func Init(cfg config.SentryConfig) (zerolog.LevelWriter, error) {
+	if cfg.DSN == "" {
+		return nil, nil
+	}
+	processor := filepath.Base(os.Args[0])
+	release := cfg.Release
+	if release == "" {
+		release = processor + "@" + buildVersion()
+	}
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:         cfg.DSN,
+		Environment: cfg.Environment,
+		Release:     release,
+		// Log events are sampled by the writer so panics always go out.
+		SampleRate: 1,
+		BeforeSend: func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+			return scrub(event)
+		},
+	})
+	if err != nil {
+		return nil, oops.In("crashreport").Code(errcode.InvalidConfig).Wrapf(err, "invalid Sentry DSN")
+	}
+	sentry.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetTag("processor", processor)
+	})
+	flushTimeout = cfg.FlushTimeout
+	enabled.Store(true)
+	return &writer{sampleRate: cfg.SampleRate}, nil
+}
+
+// Recover reports a panic and re-panics, so the process still crashes; defer
+// it at the top of goroutines.
+func Recover() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if enabled.Load() {
+		sentry.CurrentHub().Clone().Recover(r)
+		sentry.Flush(flushTimeout)
+	}
+	panic(r)
+}
+
+// buildVersion returns the module version, or the VCS revision of
+// development builds.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value[:min(len(s.Value), 12)]
+		}
+	}
+	return "devel"
+}
+
+// scrub drops request data from event.
+func scrub(event *sentry.Event) *sentry.Event {
+	event.Request = nil
+	event.User = sentry.User{}
+	for _, fields := range event.Contexts {
+		scrubFields(fields)
+	}
+	for _, b := range event.Breadcrumbs {
+		scrubFields(b.Data)
+	}
+	return event
+}
+
+// scrubFields filters the sensitive values of fields and of the objects
+// nested in it.
+func scrubFields(fields map[string]any) {
+	for key, value := range fields {
+		if sensitive(key) {
+			fields[key] = filtered
+			continue
+		}
+		scrubValue(value)
+	}
+}
+
+func scrubValue(value any) {
+	switch v := value.(type) {
+	case map[string]any:
+		scrubFields(v)
+	case []any:
+		for _, elem := range v {
+			scrubValue(elem)
+		}
+	}
+}
+
+func sensitive(key string) bool {
+	lower := strings.ToLower(key)
+	if slices.Contains(kept, lower) {
+		return false
+	}
+	for _, word := range strings.FieldsFunc(lower, func(r rune) bool {
+		return r == '_' || r == '-' || r == '.'
+	}) {
+		for _, s := range scrubbed {
+			if strings.HasPrefix(word, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writer turns error-level JSON log lines into Sentry events.
+type writer struct {
+	sampleRate float64
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *writer) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level < zerolog.ErrorLevel || level == zerolog.NoLevel || level == zerolog.Disabled {
+		return len(p), nil
+	}
+	fatal := level >= zerolog.FatalLevel
+	if !fatal && w.sampleRate < 1 && rand.Float64() >= w.sampleRate {
+		return len(p), nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return len(p), nil
+	}
+
+	event := sentry.NewEvent()
+	event.Logger = "zerolog"
+	event.Level = sentry.LevelError
+	if fatal {
+		event.Level = sentry.LevelFatal
+	}
+	message, _ := fields[zerolog.MessageFieldName].(string)
+	event.Message = message
+	if errMsg, ok := fields[zerolog.ErrorFieldName].(string); ok {
+		event.Exception = []sentry.Exception{{Type: message, Value: errMsg}}
+	}
+	for _, key := range []string{
+		zerolog.LevelFieldName, zerolog.TimestampFieldName, zerolog.MessageFieldName, zerolog.ErrorFieldName,
+	} {
+		delete(fields, key)
+	}
+	if caller, ok := fields[zerolog.CallerFieldName].(string); ok {
+		event.Tags = map[string]string{"caller": caller}
+		delete(fields, zerolog.CallerFieldName)
+	}
+	event.Contexts["log"] = fields
+	sentry.CaptureEvent(event)
+	if fatal {
+		// zerolog exits right after writing a fatal event.
+		sentry.Flush(flushTimeout)
+	}
+	return len(p), nil
+}
+
+// Ensure writer implements zerolog.LevelWriter.
+var _ zerolog.LevelWriter = (*writer)(nil)
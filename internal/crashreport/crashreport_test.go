@@ -0,0 +1,129 @@
+package crashreport
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+)
+
+func TestSensitive(t *testing.T) {
+	for _, tt := range []struct {
+		key  string
+		want bool
+	}{
+		{"authorization", true},
+		{"Set-Cookie", true},
+		{"request_headers", true},
+		{"response.body", true},
+		{"client_ip", true},
+		{"upstream_url", true},
+		{"user_agent", true},
+		{"path", true},
+		{"remote_addr", true},
+		{"api_token", true},
+		{"request_id", false},
+		{"Request_ID", false},
+		{"status", false},
+		{"duration_ms", false},
+		{"processor", false},
+		{"error_code", false},
+	} {
+		if got := sensitive(tt.key); got != tt.want {
+			t.Errorf("sensitive(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestScrub(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		fields map[string]any
+		want   map[string]any
+	}{
+		{
+			name:   "flat",
+			fields: map[string]any{"request_id": "r1", "path": "/admin?token=x", "remote_addr": "192.0.2.1:4711", "status": 502.0},
+			want:   map[string]any{"request_id": "r1", "path": filtered, "remote_addr": filtered, "status": 502.0},
+		},
+		{
+			name: "nested",
+			fields: map[string]any{
+				"upstream": map[string]any{"cluster": "api", "authorization": "Bearer x", "tls": map[string]any{"client_ip": "192.0.2.1"}},
+				"hops":     []any{map[string]any{"host": "a", "cookie": "c"}, "plain"},
+			},
+			want: map[string]any{
+				"upstream": map[string]any{"cluster": "api", "authorization": filtered, "tls": map[string]any{"client_ip": filtered}},
+				"hops":     []any{map[string]any{"host": "a", "cookie": filtered}, "plain"},
+			},
+		},
+		{
+			name:   "sensitive object",
+			fields: map[string]any{"headers": map[string]any{"accept": "*/*"}},
+			want:   map[string]any{"headers": filtered},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			crumb := map[string]any{}
+			for k, v := range tt.fields {
+				crumb[k] = v
+			}
+			event := &sentry.Event{
+				Contexts:    map[string]sentry.Context{"log": tt.fields},
+				Breadcrumbs: []*sentry.Breadcrumb{{Data: crumb}},
+				Request:     &sentry.Request{URL: "https://example.com/"},
+				User:        sentry.User{IPAddress: "192.0.2.1"},
+			}
+			event = scrub(event)
+			if !reflect.DeepEqual(event.Contexts["log"], sentry.Context(tt.want)) {
+				t.Errorf("context = %v, want %v", event.Contexts["log"], tt.want)
+			}
+			if !reflect.DeepEqual(event.Breadcrumbs[0].Data, tt.want) {
+				t.Errorf("breadcrumb = %v, want %v", event.Breadcrumbs[0].Data, tt.want)
+			}
+			if event.Request != nil || event.User.IPAddress != "" {
+				t.Errorf("request %v, user %v not dropped", event.Request, event.User)
+			}
+		})
+	}
+}
+
+func TestWriteLevel(t *testing.T) {
+	transport := &sentry.MockTransport{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:       "https://key@sentry.example.com/1",
+		Transport: transport,
+		BeforeSend: func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+			return scrub(event)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := sentry.CurrentHub()
+	previous := hub.Client()
+	hub.BindClient(client)
+	defer hub.BindClient(previous)
+
+	log := zerolog.New(&writer{sampleRate: 1})
+	log.Info().Str("path", "/a").Msg("not reported")
+	log.Error().
+		Str("request_id", "r1").
+		Str("path", "/admin").
+		Dict("upstream", zerolog.Dict().Str("cluster", "api").Str("authorization", "Bearer x")).
+		Msg("upstream failed")
+
+	events := transport.Events()
+	if len(events) != 1 {
+		t.Fatalf("%d events, want 1", len(events))
+	}
+	want := sentry.Context{
+		"request_id": "r1",
+		"path":       filtered,
+		"upstream":   map[string]any{"cluster": "api", "authorization": filtered},
+	}
+	if got := events[0].Contexts["log"]; events[0].Message != "upstream failed" || !reflect.DeepEqual(got, want) {
+		t.Errorf("event %q with fields %v, want %v", events[0].Message, got, want)
+	}
+}
@@ -0,0 +1,255 @@
+// Package dnsverify checks whether an address belongs to a CDN using DNS, a
+// signal independent of the CDN's API. An address is a node if it is among
+// the addresses of the CDN's published node hostnames, or if its PTR name
+// ends in one of the CDN's node domains and resolves back to the address
+// (forward-confirmed reverse DNS, so a PTR record alone, which the owner of
+// any address controls, is not enough).
+package dnsverify
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"golang.org/x/sync/singleflight"
+)
+
+type Config struct {
+	// Suffixes are the domains of the CDN's node PTR names, e.g.
+	// "cdn.example.net"; a name matches if it is one or a subdomain.
+	Suffixes []string
+	// Hostnames are published node hostnames whose addresses are nodes,
+	// resolved again every RefreshInterval.
+	Hostnames       []string
+	RefreshInterval time.Duration
+	// Resolver is the host:port of the DNS server queried directly; empty
+	// uses the system resolver.
+	Resolver string
+	// DNSSEC requires Resolver to have validated every answer, rejecting
+	// answers without the Authenticated Data bit. Resolver must then be a
+	// trusted validating resolver, e.g. on localhost.
+	DNSSEC  bool
+	Timeout time.Duration
+	// CacheSize bounds each of the positive and negative PTR caches;
+	// PositiveTTL and NegativeTTL are how long their results are kept.
+	CacheSize   int
+	PositiveTTL time.Duration
+	NegativeTTL time.Duration
+}
+
+type Verifier struct {
+	cfg      Config
+	suffixes []string
+	resolver resolver
+	nodes    atomic.Pointer[map[netip.Addr]struct{}]
+	positive *expirable.LRU[string, struct{}]
+	negative *expirable.LRU[string, struct{}]
+	sg       singleflight.Group
+	stop     context.CancelFunc
+	log      zerolog.Logger
+}
+
+// New resolves the hostnames and refreshes them every RefreshInterval until
+// Close. A failed resolution keeps the previous addresses.
+func New(cfg Config, log zerolog.Logger) (*Verifier, error) {
+	if len(cfg.Suffixes) == 0 && len(cfg.Hostnames) == 0 {
+		return nil, oops.
+			In("dnsverify").
+			Code(errcode.InvalidConfig).
+			Errorf("DNS validation needs node domain suffixes or hostnames")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	var r resolver = systemResolver{r: net.DefaultResolver}
+	if cfg.Resolver != "" {
+		if _, _, err := net.SplitHostPort(cfg.Resolver); err != nil {
+			return nil, oops.
+				In("dnsverify").
+				Code(errcode.InvalidEndpoint).
+				With("resolver", cfg.Resolver).
+				Wrapf(err, "invalid DNS resolver address %q", cfg.Resolver)
+		}
+		r = serverResolver{addr: cfg.Resolver, dnssec: cfg.DNSSEC, timeout: cfg.Timeout}
+	} else if cfg.DNSSEC {
+		return nil, oops.
+			In("dnsverify").
+			Code(errcode.InvalidConfig).
+			Errorf("DNSSEC validation needs a validating resolver address")
+	}
+	return newVerifier(cfg, r, log), nil
+}
+
+func newVerifier(cfg Config, r resolver, log zerolog.Logger) *Verifier {
+	v := &Verifier{
+		cfg:      cfg,
+		resolver: r,
+		positive: expirable.NewLRU[string, struct{}](cfg.CacheSize, nil, cfg.PositiveTTL),
+		negative: expirable.NewLRU[string, struct{}](cfg.CacheSize, nil, cfg.NegativeTTL),
+		log:      log.With().Str("component", "dnsverify").Logger(),
+	}
+	for _, s := range cfg.Suffixes {
+		v.suffixes = append(v.suffixes, canonical(s))
+	}
+	v.nodes.Store(&map[netip.Addr]struct{}{})
+	ctx, cancel := context.WithCancel(context.Background())
+	v.stop = cancel
+	if len(cfg.Hostnames) > 0 {
+		if err := v.Refresh(ctx); err != nil {
+			v.log.Warn().Err(err).Msg("failed to resolve CDN node hostnames")
+		}
+		if cfg.RefreshInterval > 0 {
+			go v.refreshLoop(ctx)
+		}
+	}
+	return v
+}
+
+// Close stops refreshing the hostnames.
+func (v *Verifier) Close() {
+	v.stop()
+}
+
+// Refresh resolves the hostnames again. The addresses of the hostnames that
+// resolved replace the previous ones, unless none did.
+func (v *Verifier) Refresh(ctx context.Context) error {
+	nodes := map[netip.Addr]struct{}{}
+	var lastErr error
+	resolved := 0
+	for _, host := range v.cfg.Hostnames {
+		addrs, err := v.lookupAddrs(ctx, host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resolved++
+		for _, addr := range addrs {
+			nodes[addr.Unmap()] = struct{}{}
+		}
+	}
+	if resolved == 0 {
+		return lastErr
+	}
+	v.nodes.Store(&nodes)
+	v.log.Debug().Int("hostnames", resolved).Int("addresses", len(nodes)).Msg("CDN node hostnames resolved")
+	return lastErr
+}
+
+func (v *Verifier) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(v.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := v.Refresh(ctx); err != nil {
+				v.log.Warn().Err(err).Msg("failed to refresh CDN node hostnames, keeping previous addresses")
+			}
+		}
+	}
+}
+
+// Verify reports whether ip is a CDN node, from the hostname addresses or
+// a cached or fresh forward-confirmed PTR lookup.
+func (v *Verifier) Verify(ip netip.Addr) (bool, error) {
+	ip = ip.Unmap()
+	if _, ok := (*v.nodes.Load())[ip]; ok {
+		return true, nil
+	}
+	if len(v.suffixes) == 0 {
+		return false, nil
+	}
+	key := ip.String()
+	if cached, ok := v.cached(key); ok {
+		return cached, nil
+	}
+	val, err, _ := v.sg.Do(key, func() (any, error) {
+		if cached, ok := v.cached(key); ok {
+			return cached, nil
+		}
+		valid, err := v.confirm(ip)
+		if err != nil {
+			return false, err
+		}
+		if valid {
+			v.positive.Add(key, struct{}{})
+		} else {
+			v.negative.Add(key, struct{}{})
+		}
+		return valid, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return val.(bool), nil
+}
+
+func (v *Verifier) cached(key string) (bool, bool) {
+	if _, ok := v.positive.Get(key); ok {
+		return true, true
+	}
+	if _, ok := v.negative.Get(key); ok {
+		return false, true
+	}
+	return false, false
+}
+
+// confirm looks up the PTR names of ip and reports whether one in a node
+// domain resolves back to ip. Lookup errors are returned only if no name
+// confirmed ip.
+func (v *Verifier) confirm(ip netip.Addr) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.cfg.Timeout)
+	defer cancel()
+	names, err := v.resolver.lookupPTR(ctx, ip)
+	if err != nil {
+		return false, err
+	}
+	var lastErr error
+	for _, name := range names {
+		if !v.inNodeDomain(name) {
+			continue
+		}
+		addrs, err := v.resolver.lookupAddrs(ctx, name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.Unmap() == ip {
+				v.log.Debug().Str("ip", ip.String()).Str("name", name).Msg("address confirmed by reverse DNS")
+				return true, nil
+			}
+		}
+	}
+	return false, lastErr
+}
+
+func (v *Verifier) lookupAddrs(ctx context.Context, host string) ([]netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(ctx, v.cfg.Timeout)
+	defer cancel()
+	return v.resolver.lookupAddrs(ctx, host)
+}
+
+// inNodeDomain reports whether name is one of the suffixes or a subdomain.
+func (v *Verifier) inNodeDomain(name string) bool {
+	name = canonical(name)
+	for _, suffix := range v.suffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical lowercases name and strips its leading and trailing dots.
+func canonical(name string) string {
+	return strings.Trim(strings.ToLower(name), ".")
+}
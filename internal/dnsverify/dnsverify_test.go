@@ -0,0 +1,159 @@
+package dnsverify
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver answers from maps; names in fail error.
+type fakeResolver struct {
+	ptr   map[netip.Addr][]string
+	addrs map[string][]netip.Addr
+	fail  map[string]bool
+	calls int
+}
+
+func (f *fakeResolver) lookupPTR(_ context.Context, ip netip.Addr) ([]string, error) {
+	f.calls++
+	if f.fail[ip.String()] {
+		return nil, errors.New("SERVFAIL")
+	}
+	return f.ptr[ip], nil
+}
+
+func (f *fakeResolver) lookupAddrs(_ context.Context, host string) ([]netip.Addr, error) {
+	if f.fail[host] {
+		return nil, errors.New("SERVFAIL")
+	}
+	return f.addrs[host], nil
+}
+
+func TestVerify(t *testing.T) {
+	node := netip.MustParseAddr("203.0.113.10")
+	spoofed := netip.MustParseAddr("198.51.100.7")
+	published := netip.MustParseAddr("192.0.2.44")
+	unreachable := netip.MustParseAddr("198.51.100.99")
+	r := &fakeResolver{
+		ptr: map[netip.Addr][]string{
+			node: {"n10.Edge.CDN.example."},
+			// The owner of an address controls its PTR record, not the
+			// forward zone of the CDN.
+			spoofed: {"n10.edge.cdn.example."},
+		},
+		addrs: map[string][]netip.Addr{
+			"n10.Edge.CDN.example.": {node},
+			"n10.edge.cdn.example.": {node},
+			"nodes.cdn.example":     {published, netip.MustParseAddr("::ffff:192.0.2.45")},
+		},
+		fail: map[string]bool{unreachable.String(): true},
+	}
+	v := newVerifier(Config{
+		Suffixes:    []string{"edge.cdn.example."},
+		Hostnames:   []string{"nodes.cdn.example"},
+		PositiveTTL: time.Minute,
+		NegativeTTL: time.Minute,
+	}, r, zerolog.Nop())
+	defer v.Close()
+
+	for _, tc := range []struct {
+		ip      netip.Addr
+		want    bool
+		wantErr bool
+	}{
+		{ip: node, want: true},
+		{ip: netip.AddrFrom16(node.As16()), want: true},
+		{ip: spoofed},
+		{ip: published, want: true},
+		{ip: netip.MustParseAddr("192.0.2.45"), want: true},
+		{ip: netip.MustParseAddr("192.0.2.46")},
+		{ip: unreachable, wantErr: true},
+	} {
+		got, err := v.Verify(tc.ip)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("Verify(%s) = %v, %v; want %v, error %v", tc.ip, got, err, tc.want, tc.wantErr)
+		}
+	}
+
+	calls := r.calls
+	if ok, _ := v.Verify(node); !ok || r.calls != calls {
+		t.Errorf("cached result not used: %d lookups after %d", r.calls, calls)
+	}
+}
+
+func TestNewRequiresResolverForDNSSEC(t *testing.T) {
+	if _, err := New(Config{Suffixes: []string{"cdn.example"}, DNSSEC: true}, zerolog.Nop()); err == nil {
+		t.Error("DNSSEC without a resolver accepted")
+	}
+	if _, err := New(Config{}, zerolog.Nop()); err == nil {
+		t.Error("no suffixes or hostnames accepted")
+	}
+}
+
+// serveDNS answers A queries for every name with 192.0.2.1 over UDP,
+// setting the Authenticated Data bit if ad.
+func serveDNS(t *testing.T, ad bool) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true, AuthenticData: ad})
+			_ = b.StartQuestions()
+			_ = b.Question(q)
+			_ = b.StartAnswers()
+			if q.Type == dnsmessage.TypeA {
+				_ = b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+			}
+			msg, _ := b.Finish()
+			_, _ = pc.WriteTo(msg, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestServerResolverDNSSEC(t *testing.T) {
+	for _, ad := range []bool{true, false} {
+		r := serverResolver{addr: serveDNS(t, ad), dnssec: true, timeout: time.Second}
+		addrs, err := r.lookupAddrs(context.Background(), "node.cdn.example")
+		if ad && (err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.1")) {
+			t.Errorf("validated answer: %v, %v", addrs, err)
+		}
+		if !ad && err == nil {
+			t.Errorf("unvalidated answer accepted: %v", addrs)
+		}
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	for ip, want := range map[string]string{
+		"192.0.2.1":   "1.2.0.192.in-addr.arpa.",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+	} {
+		if got := reverseName(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("reverseName(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
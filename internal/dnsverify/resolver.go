@@ -0,0 +1,236 @@
+package dnsverify
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolver answers the lookups the Verifier needs. A name that does not
+// exist answers no records and no error.
+type resolver interface {
+	lookupPTR(ctx context.Context, ip netip.Addr) ([]string, error)
+	lookupAddrs(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+// systemResolver uses the system resolver; it cannot tell validated
+// answers apart.
+type systemResolver struct {
+	r *net.Resolver
+}
+
+func (s systemResolver) lookupPTR(ctx context.Context, ip netip.Addr) ([]string, error) {
+	names, err := s.r.LookupAddr(ctx, ip.String())
+	if notFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, oops.In("dnsverify").Code(errcode.APIRequestFailed).With("ip", ip.String()).Wrapf(err, "PTR lookup failed")
+	}
+	return names, nil
+}
+
+func (s systemResolver) lookupAddrs(ctx context.Context, host string) ([]netip.Addr, error) {
+	addrs, err := s.r.LookupNetIP(ctx, "ip", host)
+	if notFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, oops.In("dnsverify").Code(errcode.APIRequestFailed).With("host", host).Wrapf(err, "address lookup failed")
+	}
+	return addrs, nil
+}
+
+// notFound reports whether err is the system resolver's answer for a name
+// that does not exist.
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// serverResolver queries one DNS server directly, over UDP with a TCP retry
+// for truncated answers. With dnssec it asks for validation and rejects
+// answers without the Authenticated Data bit, so the server must be a
+// trusted, validating resolver reached over a trusted path.
+type serverResolver struct {
+	addr    string
+	dnssec  bool
+	timeout time.Duration
+}
+
+func (s serverResolver) lookupPTR(ctx context.Context, ip netip.Addr) ([]string, error) {
+	answers, err := s.query(ctx, reverseName(ip), dnsmessage.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, a := range answers {
+		if ptr, ok := a.Body.(*dnsmessage.PTRResource); ok {
+			names = append(names, ptr.PTR.String())
+		}
+	}
+	return names, nil
+}
+
+func (s serverResolver) lookupAddrs(ctx context.Context, host string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := s.query(ctx, host, t)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range answers {
+			switch body := a.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, netip.AddrFrom4(body.A))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// query asks for the records of type t of name, returning the answers of
+// that type.
+func (s serverResolver) query(ctx context.Context, name string, t dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, oops.In("dnsverify").Code(errcode.InvalidConfig).With("name", name).Wrapf(err, "invalid DNS name")
+	}
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true, AuthenticData: s.dnssec})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: qname, Type: t, Class: dnsmessage.ClassINET})
+	_ = b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	_ = opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, s.dnssec)
+	_ = b.OPTResource(opt, dnsmessage.OPTResource{})
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, oops.In("dnsverify").Code(errcode.RequestBuildFailed).Wrap(err)
+	}
+
+	resp, err := s.exchange(ctx, "udp", msg)
+	if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 { // truncated
+		resp, err = s.exchange(ctx, "tcp", msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil || h.ID != id || !h.Response {
+		return nil, oops.In("dnsverify").Code(errcode.InvalidResponse).With("name", name).Errorf("malformed DNS answer")
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, oops.
+			In("dnsverify").
+			Code(errcode.APIBadStatus).
+			With("name", name).
+			With("rcode", h.RCode.String()).
+			Errorf("DNS query for %s failed with %s", name, h.RCode)
+	}
+	if s.dnssec && !h.AuthenticData {
+		return nil, oops.
+			In("dnsverify").
+			Code(errcode.InvalidResponse).
+			With("name", name).
+			Errorf("DNS answer for %s is not DNSSEC validated", name)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, oops.In("dnsverify").Code(errcode.InvalidResponse).Wrap(err)
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil, oops.In("dnsverify").Code(errcode.InvalidResponse).Wrap(err)
+	}
+	matching := answers[:0]
+	for _, a := range answers {
+		if a.Header.Type == t {
+			matching = append(matching, a)
+		}
+	}
+	return matching, nil
+}
+
+// exchange sends msg to the server over network and reads the answer.
+func (s serverResolver) exchange(ctx context.Context, network string, msg []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, s.addr)
+	if err != nil {
+		return nil, oops.In("dnsverify").Code(errcode.DialFailed).With("resolver", s.addr).Wrapf(err, "failed to reach DNS resolver")
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+	if network == "tcp" {
+		msg = append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+	}
+	if _, err := c.Write(msg); err != nil {
+		return nil, oops.In("dnsverify").Code(errcode.APIRequestFailed).With("resolver", s.addr).Wrapf(err, "failed to send DNS query")
+	}
+	if network == "udp" {
+		buf := make([]byte, 4096)
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, oops.In("dnsverify").Code(errcode.APIRequestFailed).With("resolver", s.addr).Wrapf(err, "failed to read DNS answer")
+		}
+		return buf[:n], nil
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, oops.In("dnsverify").Code(errcode.APIRequestFailed).With("resolver", s.addr).Wrapf(err, "failed to read DNS answer")
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return nil, oops.In("dnsverify").Code(errcode.APIRequestFailed).With("resolver", s.addr).Wrapf(err, "failed to read DNS answer")
+	}
+	return buf, nil
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func reverseName(ip netip.Addr) string {
+	var b strings.Builder
+	if ip.Is4() {
+		a := ip.As4()
+		for i := 3; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(a[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString("in-addr.arpa.")
+		return b.String()
+	}
+	a := ip.As16()
+	const hex = "0123456789abcdef"
+	for i := 15; i >= 0; i-- {
+		b.WriteByte(hex[a[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[a[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
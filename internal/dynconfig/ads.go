@@ -0,0 +1,192 @@
+package dynconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/tlsutil"
+	"github.com/samber/oops"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// TypeURL is the type_url processors subscribe to. Each resource of a
+// response is an envoy.service.discovery.v3.Resource naming the processor
+// resource (e.g. "ratelimit-rules") and wrapping its contents as a
+// google.protobuf.Struct, StringValue (YAML or JSON text) or BytesValue.
+const TypeURL = "type.googleapis.com/envoy.service.discovery.v3.Resource"
+
+// ADSConfig holds the control plane connection settings.
+type ADSConfig struct {
+	// Address is the control plane host:port.
+	Address string
+	// NodeID and Cluster identify this instance to the control plane.
+	NodeID  string
+	Cluster string
+	// CAFile verifies the control plane; empty uses the system roots.
+	CAFile     string
+	ServerName string
+	// Plaintext disables TLS, e.g. for a control plane sidecar on localhost.
+	Plaintext bool
+}
+
+// ADS subscribes to processor resources over an Envoy aggregated discovery
+// service stream (state of the world), ACKing accepted versions and NACKing
+// rejected ones with the validation error.
+type ADS struct {
+	cfg      ADSConfig
+	registry *Registry
+	conn     *grpc.ClientConn
+}
+
+// NewADS creates the client; the connection is established lazily by Run.
+// An empty NodeID uses the hostname.
+func NewADS(cfg ADSConfig, registry *Registry) (*ADS, error) {
+	if cfg.NodeID == "" {
+		cfg.NodeID, _ = os.Hostname()
+	}
+	creds := insecure.NewCredentials()
+	if !cfg.Plaintext {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.ServerName}
+		if cfg.CAFile != "" {
+			pool, err := tlsutil.LoadCA(cfg.CAFile)
+			if err != nil {
+				return nil, oops.In("dynconfig").Wrap(err)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(cfg.Address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, oops.
+			In("dynconfig").
+			Code(errcode.DialFailed).
+			With("address", cfg.Address).
+			Wrapf(err, "failed to create control plane client")
+	}
+	return &ADS{cfg: cfg, registry: registry, conn: conn}, nil
+}
+
+// Run keeps a discovery stream open until ctx is done, reconnecting with
+// backoff.
+func (a *ADS) Run(ctx context.Context) {
+	defer a.conn.Close()
+	log := a.registry.log.With().Str("address", a.cfg.Address).Logger()
+	backoff := time.Second
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := a.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Warn().Err(err).Dur("backoff", backoff).Msg("control plane stream ended, reconnecting")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (a *ADS) stream(ctx context.Context) error {
+	client := envoy_service_discovery_v3.NewAggregatedDiscoveryServiceClient(a.conn)
+	stream, err := client.StreamAggregatedResources(ctx)
+	if err != nil {
+		return oops.In("dynconfig").Code(errcode.StreamFailed).Wrapf(err, "failed to open discovery stream")
+	}
+	node := &envoy_config_core_v3.Node{Id: a.cfg.NodeID, Cluster: a.cfg.Cluster}
+	names := a.registry.names()
+	// Resume from the last accepted version after a reconnect.
+	if err := stream.Send(&envoy_service_discovery_v3.DiscoveryRequest{
+		Node:          node,
+		TypeUrl:       TypeURL,
+		ResourceNames: names,
+		VersionInfo:   a.registry.version(),
+	}); err != nil {
+		return oops.In("dynconfig").Code(errcode.StreamFailed).Wrap(err)
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return oops.In("dynconfig").Code(errcode.StreamFailed).Wrap(err)
+		}
+		if resp.GetTypeUrl() != TypeURL {
+			continue
+		}
+		req := &envoy_service_discovery_v3.DiscoveryRequest{
+			Node:          node,
+			TypeUrl:       TypeURL,
+			ResourceNames: names,
+			ResponseNonce: resp.GetNonce(),
+		}
+		resources, err := decode(resp.GetResources())
+		if err != nil {
+			a.registry.reject("ads", resp.GetVersionInfo(), err)
+		} else {
+			err = a.registry.apply("ads", resp.GetVersionInfo(), resources)
+		}
+		if err != nil {
+			// NACK: repeat the last accepted version with the error.
+			req.VersionInfo = a.registry.version()
+			req.ErrorDetail = &status.Status{Code: int32(codes.InvalidArgument), Message: err.Error()}
+		} else {
+			req.VersionInfo = resp.GetVersionInfo()
+		}
+		if err := stream.Send(req); err != nil {
+			return oops.In("dynconfig").Code(errcode.StreamFailed).Wrap(err)
+		}
+	}
+}
+
+// decode unwraps discovery resources into raw contents by name.
+func decode(resources []*anypb.Any) (map[string][]byte, error) {
+	out := make(map[string][]byte, len(resources))
+	for _, r := range resources {
+		var res envoy_service_discovery_v3.Resource
+		if err := r.UnmarshalTo(&res); err != nil {
+			return nil, oops.
+				In("dynconfig").
+				Code(errcode.InvalidResource).
+				With("type_url", r.GetTypeUrl()).
+				Wrapf(err, "resource is not a %s", TypeURL)
+		}
+		msg, err := res.GetResource().UnmarshalNew()
+		if err != nil {
+			return nil, oops.In("dynconfig").Code(errcode.InvalidResource).With("resource", res.GetName()).Wrap(err)
+		}
+		var data []byte
+		switch v := msg.(type) {
+		case *structpb.Struct:
+			data, err = protojson.Marshal(v)
+		case *wrapperspb.StringValue:
+			data = []byte(v.GetValue())
+		case *wrapperspb.BytesValue:
+			data = v.GetValue()
+		default:
+			err = oops.Code(errcode.InvalidResource).Errorf("unsupported payload type %s", proto.MessageName(msg))
+		}
+		if err != nil {
+			return nil, oops.In("dynconfig").Code(errcode.InvalidResource).With("resource", res.GetName()).Wrap(err)
+		}
+		out[res.GetName()] = data
+	}
+	return out, nil
+}
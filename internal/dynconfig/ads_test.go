@@ -0,0 +1,112 @@
+package dynconfig
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// controlPlane is an ADS server that hands each stream to the test.
+type controlPlane struct {
+	envoy_service_discovery_v3.UnimplementedAggregatedDiscoveryServiceServer
+	streams chan envoy_service_discovery_v3.AggregatedDiscoveryService_StreamAggregatedResourcesServer
+}
+
+func (c *controlPlane) StreamAggregatedResources(stream envoy_service_discovery_v3.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	c.streams <- stream
+	<-stream.Context().Done()
+	return nil
+}
+
+func discoveryResponse(t *testing.T, version, nonce string, resources map[string]string) *envoy_service_discovery_v3.DiscoveryResponse {
+	t.Helper()
+	resp := &envoy_service_discovery_v3.DiscoveryResponse{TypeUrl: TypeURL, VersionInfo: version, Nonce: nonce}
+	for name, value := range resources {
+		payload, err := anypb.New(wrapperspb.String(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resource, err := anypb.New(&envoy_service_discovery_v3.Resource{Name: name, Resource: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Resources = append(resp.Resources, resource)
+	}
+	return resp
+}
+
+func TestADSAckNack(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &controlPlane{streams: make(chan envoy_service_discovery_v3.AggregatedDiscoveryService_StreamAggregatedResourcesServer, 1)}
+	srv := grpc.NewServer()
+	envoy_service_discovery_v3.RegisterAggregatedDiscoveryServiceServer(srv, cp)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	registry, limit, _ := newTestRegistry()
+	ads, err := NewADS(ADSConfig{Address: lis.Addr().String(), NodeID: "node-1", Plaintext: true}, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ads.Run(ctx)
+
+	var stream envoy_service_discovery_v3.AggregatedDiscoveryService_StreamAggregatedResourcesServer
+	select {
+	case stream = <-cp.streams:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no discovery stream")
+	}
+	recv := func() *envoy_service_discovery_v3.DiscoveryRequest {
+		t.Helper()
+		req, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	req := recv()
+	if req.GetNode().GetId() != "node-1" || req.GetTypeUrl() != TypeURL || req.GetVersionInfo() != "" {
+		t.Fatalf("subscription = %v", req)
+	}
+	if got := req.GetResourceNames(); len(got) != 2 || got[0] != "burst" || got[1] != "limit" {
+		t.Errorf("subscribed to %v", got)
+	}
+
+	if err := stream.Send(discoveryResponse(t, "v1", "n1", map[string]string{"limit": "10"})); err != nil {
+		t.Fatal(err)
+	}
+	req = recv()
+	if req.GetVersionInfo() != "v1" || req.GetResponseNonce() != "n1" || req.GetErrorDetail() != nil {
+		t.Errorf("ACK = %v", req)
+	}
+	if limit.get() != 10 {
+		t.Errorf("limit %d after v1, want 10", limit.get())
+	}
+
+	if err := stream.Send(discoveryResponse(t, "v2", "n2", map[string]string{"limit": "lots"})); err != nil {
+		t.Fatal(err)
+	}
+	req = recv()
+	// A NACK repeats the last accepted version and carries the error.
+	if req.GetVersionInfo() != "v1" || req.GetResponseNonce() != "n2" || req.GetErrorDetail().GetMessage() == "" {
+		t.Errorf("NACK = %v", req)
+	}
+	if limit.get() != 10 {
+		t.Errorf("limit %d after rejected v2, want 10", limit.get())
+	}
+	if status := registry.snapshot(); status.Source != "ads" || status.Version != "v1" || status.RejectedVersion != "v2" {
+		t.Errorf("status = %+v", status)
+	}
+}
@@ -0,0 +1,192 @@
+// Package dynconfig lets a control plane push processor configuration
+// (rules, limits, toggles) to running instances, either over an xDS-style
+// aggregated discovery stream with versioning and ACK/NACK, or from a
+// versioned file polled for changes.
+package dynconfig
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+var updatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "dynconfig_updates_total",
+	Help: "Dynamic configuration updates, by result (ack or nack).",
+}, []string{"result"})
+
+func init() {
+	metrics.Registry.MustRegister(updatesTotal)
+}
+
+// Handler validates the raw contents (YAML or JSON) of a resource and
+// returns a commit function that applies it. Nothing may change before
+// commit is called, so a rejected update leaves the previous configuration
+// in place.
+type Handler func(data []byte) (commit func(), err error)
+
+// Status describes the configuration state, as served by the admin
+// endpoint.
+type Status struct {
+	Source string `json:"source"`
+	// Version is the last accepted version.
+	Version string `json:"version"`
+	// Resources are the registered resource names.
+	Resources []string `json:"resources"`
+	// RejectedVersion is the last rejected version and Error why, if it came
+	// after Version.
+	RejectedVersion string    `json:"rejected_version,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at,omitzero"`
+}
+
+// Registry maps resource names to handlers and applies versioned updates
+// to them all-or-nothing.
+type Registry struct {
+	log zerolog.Logger
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	status   Status
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry(log zerolog.Logger) *Registry {
+	return &Registry{
+		log:      log.With().Str("component", "dynconfig").Logger(),
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Register adds the handler for resource name. Register before starting a
+// source.
+func (r *Registry) Register(name string, handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[name] = handler
+}
+
+// names returns the registered resource names, sorted.
+func (r *Registry) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.handlers))
+	for name := range r.handlers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// version returns the last accepted version.
+func (r *Registry) version() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status.Version
+}
+
+// apply validates every resource of version and commits them only if all
+// are valid. Unknown resource names are ignored; registered resources absent
+// from resources keep their configuration.
+func (r *Registry) apply(source, version string, resources map[string][]byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Source = source
+
+	commits := make([]func(), 0, len(resources))
+	applied := make([]string, 0, len(resources))
+	var errs []error
+	for name, data := range resources {
+		handler, ok := r.handlers[name]
+		if !ok {
+			r.log.Debug().Str("resource", name).Msg("ignoring unknown resource")
+			continue
+		}
+		commit, err := handler(data)
+		if err != nil {
+			errs = append(errs, oops.With("resource", name).Wrapf(err, "resource %q rejected", name))
+			continue
+		}
+		commits = append(commits, commit)
+		applied = append(applied, name)
+	}
+	if err := oops.Join(errs...); err != nil {
+		r.rejectLocked(source, version, err)
+		return err
+	}
+	for i, commit := range commits {
+		commit()
+		audit.Record("dynconfig/"+applied[i], audit.Trigger{Source: source, Version: version}, resources[applied[i]])
+	}
+	updatesTotal.WithLabelValues("ack").Inc()
+	r.status.Version, r.status.RejectedVersion, r.status.Error, r.status.UpdatedAt = version, "", "", time.Now()
+	r.log.Info().Str("version", version).Str("source", source).Int("resources", len(commits)).Msg("configuration update applied")
+	return nil
+}
+
+// reject records an update that could not be decoded.
+func (r *Registry) reject(source, version string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Source = source
+	r.rejectLocked(source, version, err)
+}
+
+// rejectLocked records a rejected update. The caller holds r.mu.
+func (r *Registry) rejectLocked(source, version string, err error) {
+	updatesTotal.WithLabelValues("nack").Inc()
+	r.status.RejectedVersion, r.status.Error, r.status.UpdatedAt = version, err.Error(), time.Now()
+	r.log.Error().Err(err).Str("version", version).Str("source", source).Msg("configuration update rejected")
+}
+
+// Config selects the configuration source; at most one of ADS.Address and
+// File is set.
+type Config struct {
+	ADS          ADSConfig
+	File         string
+	PollInterval time.Duration
+}
+
+// Start applies the file source once, failing on invalid contents, then
+// follows the configured source in the background until ctx is done. It does
+// nothing when no source is configured.
+func Start(ctx context.Context, cfg Config, registry *Registry) error {
+	switch {
+	case cfg.File != "":
+		f := NewFile(cfg.File, cfg.PollInterval, registry)
+		if err := f.Load(); err != nil {
+			return err
+		}
+		go f.Run(ctx)
+	case cfg.ADS.Address != "":
+		ads, err := NewADS(cfg.ADS, registry)
+		if err != nil {
+			return err
+		}
+		go ads.Run(ctx)
+	}
+	return nil
+}
+
+// ServeHTTP serves the Status as JSON.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	names := r.names()
+	r.mu.Lock()
+	status := r.status
+	r.mu.Unlock()
+	status.Resources = names
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// Ensure Registry implements http.Handler.
+var _ http.Handler = (*Registry)(nil)
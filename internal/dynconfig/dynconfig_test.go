@@ -0,0 +1,82 @@
+package dynconfig
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// intResource is a resource holding an integer, as a stand-in for
+// processor configuration.
+type intResource struct {
+	mu    sync.Mutex
+	value int
+}
+
+func (r *intResource) handler(data []byte) (func(), error) {
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.value = v
+	}, nil
+}
+
+func (r *intResource) get() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.value
+}
+
+func newTestRegistry() (*Registry, *intResource, *intResource) {
+	registry := NewRegistry(zerolog.Nop())
+	limit, burst := &intResource{}, &intResource{}
+	registry.Register("limit", limit.handler)
+	registry.Register("burst", burst.handler)
+	return registry, limit, burst
+}
+
+func (r *Registry) snapshot() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+func TestApplyAllOrNothing(t *testing.T) {
+	registry, limit, burst := newTestRegistry()
+	if err := registry.apply("test", "v1", map[string][]byte{"limit": []byte("10"), "burst": []byte("5"), "unknown": []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if limit.get() != 10 || burst.get() != 5 {
+		t.Fatalf("applied limit %d, burst %d", limit.get(), burst.get())
+	}
+
+	// One invalid resource rejects the whole version.
+	if err := registry.apply("test", "v2", map[string][]byte{"limit": []byte("20"), "burst": []byte("many")}); err == nil {
+		t.Fatal("invalid version applied")
+	}
+	if limit.get() != 10 || burst.get() != 5 {
+		t.Errorf("rejected version committed: limit %d, burst %d", limit.get(), burst.get())
+	}
+	status := registry.snapshot()
+	if status.Version != "v1" || status.RejectedVersion != "v2" || !strings.Contains(status.Error, `"burst"`) {
+		t.Errorf("status after rejection = %+v", status)
+	}
+
+	// Resources absent from a version keep their configuration.
+	if err := registry.apply("test", "v3", map[string][]byte{"limit": []byte("30")}); err != nil {
+		t.Fatal(err)
+	}
+	if limit.get() != 30 || burst.get() != 5 {
+		t.Errorf("applied limit %d, burst %d", limit.get(), burst.get())
+	}
+	if status := registry.snapshot(); status.Version != "v3" || status.RejectedVersion != "" || status.Error != "" {
+		t.Errorf("status after a later version = %+v", status)
+	}
+}
@@ -0,0 +1,96 @@
+package dynconfig
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+)
+
+// document is the file format:
+//
+//	version: "2024-06-01.1"
+//	resources:
+//	  ratelimit-rules:
+//	    domain: envoy-gateway
+//	    descriptors: [...]
+//
+// Resource values are YAML, or a string holding YAML or JSON.
+type document struct {
+	Version   string               `yaml:"version"`
+	Resources map[string]yaml.Node `yaml:"resources"`
+}
+
+// File applies a versioned configuration file, re-reading it whenever its
+// modification time changes.
+type File struct {
+	path     string
+	interval time.Duration
+	registry *Registry
+}
+
+// NewFile creates a file source polled every interval.
+func NewFile(path string, interval time.Duration, registry *Registry) *File {
+	return &File{path: path, interval: interval, registry: registry}
+}
+
+// Load applies the file once, returning validation errors, which the
+// registry also reports.
+func (f *File) Load() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return oops.In("dynconfig").Code(errcode.ReadConfigFailed).With("path", f.path).Wrapf(err, "failed to read dynamic configuration")
+	}
+	var doc document
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		err = oops.In("dynconfig").Code(errcode.InvalidResource).With("path", f.path).Wrapf(err, "failed to parse dynamic configuration")
+		f.registry.reject("file", "", err)
+		return err
+	}
+	resources := make(map[string][]byte, len(doc.Resources))
+	for name, node := range doc.Resources {
+		if node.Kind == yaml.ScalarNode {
+			resources[name] = []byte(node.Value)
+			continue
+		}
+		raw, err := yaml.Marshal(&node)
+		if err != nil {
+			err = oops.In("dynconfig").Code(errcode.InvalidResource).With("resource", name).Wrap(err)
+			f.registry.reject("file", doc.Version, err)
+			return err
+		}
+		resources[name] = raw
+	}
+	return f.registry.apply("file", doc.Version, resources)
+}
+
+// Run polls the file until ctx is done.
+func (f *File) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	var modTime time.Time
+	if info, err := os.Stat(f.path); err == nil {
+		modTime = info.ModTime()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(f.path)
+		if err != nil {
+			f.registry.log.Warn().Err(err).Str("path", f.path).Msg("failed to stat dynamic configuration")
+			continue
+		}
+		if !info.ModTime().After(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		// Errors are logged and reported by the registry.
+		_ = f.Load()
+	}
+}
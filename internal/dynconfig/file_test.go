@@ -0,0 +1,70 @@
+package dynconfig
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileReload(t *testing.T) {
+	registry, limit, burst := newTestRegistry()
+	path := filepath.Join(t.TempDir(), "dynconfig.yaml")
+	// Each write and touch moves the modification time forward, so polling
+	// sees it.
+	mtime := time.Now().Add(-time.Hour)
+	touch := func() {
+		t.Helper()
+		mtime = mtime.Add(time.Second)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(contents string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		touch()
+	}
+	write("version: v1\nresources:\n  limit: 10\n  burst: \"5\"\n")
+	f := NewFile(path, 5*time.Millisecond, registry)
+	if err := f.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if limit.get() != 10 || burst.get() != 5 {
+		t.Fatalf("loaded limit %d, burst %d", limit.get(), burst.get())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Run(ctx)
+	// waitFor touches the file until cond holds, in case Run had not taken
+	// its first look when it was written.
+	waitFor := func(what string, cond func(Status) bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond(registry.snapshot()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: status %+v", what, registry.snapshot())
+			}
+			time.Sleep(20 * time.Millisecond)
+			touch()
+		}
+	}
+
+	write("version: v2\nresources:\n  limit: 20\n  burst: many\n")
+	waitFor("invalid resource not rejected", func(s Status) bool { return s.RejectedVersion == "v2" })
+	write("version: v3\nresources: [not, a, map\n")
+	waitFor("unparsable file not rejected", func(s Status) bool { return s.RejectedVersion == "" && s.Error != "" })
+	if status := registry.snapshot(); status.Version != "v1" || limit.get() != 10 || burst.get() != 5 {
+		t.Errorf("invalid files changed the configuration: %+v, limit %d, burst %d", status, limit.get(), burst.get())
+	}
+
+	write("version: v4\nresources:\n  limit: 40\n")
+	waitFor("valid file not applied", func(s Status) bool { return s.Version == "v4" })
+	if limit.get() != 40 || burst.get() != 5 {
+		t.Errorf("reloaded limit %d, burst %d", limit.get(), burst.get())
+	}
+}
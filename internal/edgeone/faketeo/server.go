@@ -0,0 +1,171 @@
+// Package faketeo is an in-process stand-in for the Tencent Cloud TEO API.
+// It answers DescribeIPRegion from configured address ranges, with optional
+// latency and error injection, so the EdgeOne validator can be tested and
+// run without network access or credentials. Signatures are not checked.
+package faketeo
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Config is the behaviour of a Server.
+type Config struct {
+	// EdgeOneIPs are the ranges reported as EdgeOne nodes.
+	EdgeOneIPs []netip.Prefix
+	// Latency delays every response.
+	Latency time.Duration
+	// ErrorRate is the fraction of requests, from 0 to 1, answered with an
+	// InternalError.
+	ErrorRate float64
+}
+
+// Server implements the DescribeIPRegion action of the TEO API.
+type Server struct {
+	mu  sync.RWMutex
+	cfg Config
+
+	requests atomic.Int64
+}
+
+// New creates a Server answering with cfg.
+func New(cfg Config) *Server {
+	return &Server{cfg: cfg}
+}
+
+// SetConfig replaces the server's behaviour for subsequent requests.
+func (s *Server) SetConfig(cfg Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+}
+
+// Requests returns the number of API calls served.
+func (s *Server) Requests() int64 {
+	return s.requests.Load()
+}
+
+// ParsePrefixes parses addresses and CIDRs; a bare address is a single-IP
+// prefix.
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if addr, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, oops.In("faketeo").Code(errcode.InvalidConfig).With("value", v).Wrapf(err, "invalid address or CIDR")
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+type describeIPRegionRequest struct {
+	IPs []string `json:"IPs"`
+}
+
+type ipRegionInfo struct {
+	IP          string `json:"IP"`
+	IsEdgeOneIP string `json:"IsEdgeOneIP"`
+}
+
+type apiError struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+}
+
+type response struct {
+	IPRegionInfo []ipRegionInfo `json:"IPRegionInfo,omitempty"`
+	Error        *apiError      `json:"Error,omitempty"`
+	RequestID    string         `json:"RequestId"`
+}
+
+// ServeHTTP implements http.Handler. Like the real API, failures are
+// reported in the body of a 200 response.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := s.requests.Add(1)
+	s.mu.RLock()
+	cfg := s.cfg
+	s.mu.RUnlock()
+
+	if cfg.Latency > 0 {
+		select {
+		case <-time.After(cfg.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	resp := response{RequestID: "faketeo-" + strconv.FormatInt(n, 10)}
+	switch {
+	case r.Method != http.MethodPost:
+		resp.Error = &apiError{Code: "UnsupportedProtocol", Message: "only POST is supported"}
+	case r.Header.Get("X-TC-Action") != "DescribeIPRegion":
+		resp.Error = &apiError{Code: "InvalidAction", Message: "unsupported action " + strconv.Quote(r.Header.Get("X-TC-Action"))}
+	case cfg.ErrorRate > 0 && rand.Float64() < cfg.ErrorRate:
+		resp.Error = &apiError{Code: "InternalError", Message: "injected error"}
+	default:
+		resp.IPRegionInfo, resp.Error = describe(r, cfg.EdgeOneIPs)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-TC-RequestId", resp.RequestID)
+	_ = json.NewEncoder(w).Encode(map[string]response{"Response": resp})
+}
+
+func describe(r *http.Request, edgeOneIPs []netip.Prefix) ([]ipRegionInfo, *apiError) {
+	var req describeIPRegionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, &apiError{Code: "InvalidParameter", Message: err.Error()}
+	}
+	if len(req.IPs) == 0 {
+		return nil, &apiError{Code: "MissingParameter", Message: "IPs is required"}
+	}
+	infos := make([]ipRegionInfo, 0, len(req.IPs))
+	for _, ip := range req.IPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil, &apiError{Code: "InvalidParameterValue", Message: "invalid IP " + strconv.Quote(ip)}
+		}
+		info := ipRegionInfo{IP: ip, IsEdgeOneIP: "no"}
+		for _, prefix := range edgeOneIPs {
+			if prefix.Contains(addr.Unmap()) {
+				info.IsEdgeOneIP = "yes"
+				break
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Listen serves s on addr (e.g. "127.0.0.1:0") in the background and
+// returns its endpoint URL, to use as the validator's API endpoint, and a
+// function that stops it.
+func (s *Server) Listen(addr string) (string, func() error, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", nil, oops.In("faketeo").Code(errcode.ListenFailed).With("addr", addr).Wrapf(err, "failed to listen")
+	}
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			_ = lis.Close()
+		}
+	}()
+	return "http://" + lis.Addr().String(), srv.Close, nil
+}
@@ -2,11 +2,14 @@ package edgeone
 
 import (
 	"net/netip"
+	"net/url"
 	"slices"
 	"strings"
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/ipfilter"
 	"github.com/rs/zerolog"
 	"github.com/samber/oops"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
@@ -20,28 +23,77 @@ type Config struct {
 	SecretKey   string
 	APIEndpoint string
 	Region      string
-	CacheSize   int
-	CacheTTL    time.Duration
+	// CacheSize bounds each of the positive and negative caches, so churning
+	// non-EdgeOne addresses cannot evict known nodes.
+	CacheSize int
+	// PositiveTTL is how long an EdgeOne address is remembered, and
+	// NegativeTTL how long any other address is; keep the latter short, as
+	// attackers rotate addresses.
+	PositiveTTL time.Duration
+	NegativeTTL time.Duration
 	Timeout     time.Duration
+	// Fallback lists EdgeOne ranges consulted when the TEO API fails. Its
+	// answers are not cached, so the API is asked again next time.
+	Fallback []netip.Prefix
+	// FailOpen trusts addresses when the API fails and no Fallback is
+	// configured; otherwise they are untrusted.
+	FailOpen bool
+	// DNS, if set, is consulted when the TEO API fails, before Fallback:
+	// addresses it confirms are trusted, and without Fallback its other
+	// answers are final too.
+	DNS DNSVerifier
+	// DNSOnly validates addresses with DNS alone, in place of the TEO API,
+	// so no credentials are needed.
+	DNSOnly bool
+}
+
+// DNSVerifier checks an address against DNS, e.g. a *dnsverify.Verifier.
+type DNSVerifier interface {
+	Verify(ip netip.Addr) (bool, error)
 }
 
 type Validator struct {
-	cache  *expirable.LRU[string, bool]
-	client *teo.Client
-	sg     singleflight.Group
-	log    zerolog.Logger
+	positive *expirable.LRU[string, struct{}]
+	negative *expirable.LRU[string, struct{}]
+	client   *teo.Client
+	fallback *ipfilter.Ranges
+	failOpen bool
+	dns      DNSVerifier
+	dnsOnly  bool
+	sg       singleflight.Group
+	log      zerolog.Logger
 }
 
 func New(cfg Config, log zerolog.Logger) (*Validator, error) {
+	if cfg.DNSOnly {
+		if cfg.DNS == nil {
+			return nil, oops.
+				In("edgeone").
+				Code(errcode.InvalidConfig).
+				Errorf("DNS-only validation needs a DNS verifier")
+		}
+		return &Validator{
+			fallback: fallbackRanges(cfg.Fallback),
+			failOpen: cfg.FailOpen,
+			dns:      cfg.DNS,
+			dnsOnly:  true,
+			log:      log.With().Str("component", "edgeone").Logger(),
+		}, nil
+	}
 	if strings.TrimSpace(cfg.SecretID) == "" || strings.TrimSpace(cfg.SecretKey) == "" {
 		return nil, oops.
 			In("edgeone").
-			Code("MISSING_CREDENTIALS").
+			Code(errcode.MissingCredentials).
 			Errorf("missing SecretID or SecretKey")
 	}
 
 	cpf := profile.NewClientProfile()
 	cpf.HttpProfile.Endpoint = cfg.APIEndpoint
+	// A URL endpoint selects the scheme, e.g. a local fake API over HTTP.
+	if u, err := url.Parse(cfg.APIEndpoint); err == nil && u.Host != "" {
+		cpf.HttpProfile.Endpoint = u.Host
+		cpf.HttpProfile.Scheme = strings.ToUpper(u.Scheme)
+	}
 	cpf.HttpProfile.ReqTimeout = int(cfg.Timeout.Seconds())
 
 	credential := common.NewCredential(cfg.SecretID, cfg.SecretKey)
@@ -49,29 +101,87 @@ func New(cfg Config, log zerolog.Logger) (*Validator, error) {
 	if err != nil {
 		return nil, oops.
 			In("edgeone").
-			Code("CLIENT_INIT_FAILED").
+			Code(errcode.ClientInitFailed).
 			With("region", cfg.Region).
 			With("endpoint", cfg.APIEndpoint).
 			Wrapf(err, "failed to create tencent teo client")
 	}
 
 	return &Validator{
-		cache:  expirable.NewLRU[string, bool](cfg.CacheSize, nil, cfg.CacheTTL),
-		client: client,
-		log:    log.With().Str("component", "edgeone").Logger(),
+		positive: expirable.NewLRU[string, struct{}](cfg.CacheSize, nil, cfg.PositiveTTL),
+		negative: expirable.NewLRU[string, struct{}](cfg.CacheSize, nil, cfg.NegativeTTL),
+		client:   client,
+		fallback: fallbackRanges(cfg.Fallback),
+		failOpen: cfg.FailOpen,
+		dns:      cfg.DNS,
+		log:      log.With().Str("component", "edgeone").Logger(),
 	}, nil
 }
 
+func fallbackRanges(prefixes []netip.Prefix) *ipfilter.Ranges {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	return ipfilter.NewRanges(prefixes)
+}
+
+// IsEdgeOneIP reports whether ip is an EdgeOne node. When the TEO API fails,
+// DNS and then the fallback list answer instead; without either, the error
+// is returned along with the failure policy's decision.
 func (v *Validator) IsEdgeOneIP(ip netip.Addr) (bool, error) {
+	if v.dnsOnly {
+		return v.verifyDNS(ip)
+	}
+	valid, err := v.describe(ip)
+	if err == nil {
+		return valid, nil
+	}
+	if v.dns != nil {
+		valid, dnsErr := v.dns.Verify(ip)
+		if dnsErr == nil && (valid || v.fallback == nil) {
+			v.log.Warn().Err(err).Str("ip", ip.Unmap().String()).Bool("valid", valid).Msg("TEO API unavailable, used DNS validation")
+			return valid, nil
+		}
+	}
+	if v.fallback != nil {
+		valid = v.fallback.Contains(ip)
+		v.log.Warn().Err(err).Str("ip", ip.Unmap().String()).Bool("valid", valid).Msg("TEO API unavailable, used fallback ranges")
+		return valid, nil
+	}
+	return v.failOpen, err
+}
+
+// verifyDNS validates ip with DNS alone, answering from the fallback list
+// or the failure policy when DNS fails.
+func (v *Validator) verifyDNS(ip netip.Addr) (bool, error) {
+	ip = ip.Unmap()
+	// EdgeOne IPs are public; private/loopback can never be EdgeOne.
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false, nil
+	}
+	valid, err := v.dns.Verify(ip)
+	if err == nil {
+		return valid, nil
+	}
+	if v.fallback != nil {
+		valid = v.fallback.Contains(ip)
+		v.log.Warn().Err(err).Str("ip", ip.String()).Bool("valid", valid).Msg("DNS validation failed, used fallback ranges")
+		return valid, nil
+	}
+	return v.failOpen, err
+}
+
+// describe returns the cached or TEO API result for ip.
+func (v *Validator) describe(ip netip.Addr) (bool, error) {
 	ip = ip.Unmap()
 	ipStr := ip.String()
 
-	if cached, ok := v.cache.Get(ipStr); ok {
+	if cached, ok := v.cached(ipStr); ok {
 		return cached, nil
 	}
 
 	val, err, _ := v.sg.Do(ipStr, func() (any, error) {
-		if cached, ok := v.cache.Get(ipStr); ok {
+		if cached, ok := v.cached(ipStr); ok {
 			return cached, nil
 		}
 		start := time.Now()
@@ -84,12 +194,27 @@ func (v *Validator) IsEdgeOneIP(ip netip.Addr) (bool, error) {
 			Str("ip", ipStr).
 			Bool("valid", valid).
 			Msg("IP region validation result")
-		v.cache.Add(ipStr, valid)
+		if valid {
+			v.positive.Add(ipStr, struct{}{})
+		} else {
+			v.negative.Add(ipStr, struct{}{})
+		}
 		return valid, nil
 	})
 	return val.(bool), err
 }
 
+// cached returns the remembered result for ipStr, if any.
+func (v *Validator) cached(ipStr string) (valid, ok bool) {
+	if _, ok := v.positive.Get(ipStr); ok {
+		return true, true
+	}
+	if _, ok := v.negative.Get(ipStr); ok {
+		return false, true
+	}
+	return false, false
+}
+
 func (v *Validator) validateIP(ip netip.Addr) (bool, error) {
 	// EdgeOne IPs are public; private/loopback can never be EdgeOne.
 	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
@@ -103,7 +228,7 @@ func (v *Validator) validateIP(ip netip.Addr) (bool, error) {
 	if err != nil {
 		return false, oops.
 			In("edgeone").
-			Code("API_REQUEST_FAILED").
+			Code(errcode.APIRequestFailed).
 			With("ip", ip.String()).
 			Wrapf(err, "failed to describe IP region")
 	}
@@ -0,0 +1,248 @@
+package edgeone
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/edgeone/faketeo"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+var edgeOneIPs = []netip.Prefix{netip.MustParsePrefix("43.175.0.0/16"), netip.MustParsePrefix("2402:4e00::/32")}
+
+func newTestValidator(t *testing.T, cfg faketeo.Config) (*Validator, *faketeo.Server) {
+	t.Helper()
+	fake := faketeo.New(cfg)
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	v, err := New(Config{
+		SecretID:    "id",
+		SecretKey:   "key",
+		APIEndpoint: srv.URL,
+		CacheSize:   16,
+		PositiveTTL: time.Minute,
+		NegativeTTL: time.Minute,
+		Timeout:     5 * time.Second,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return v, fake
+}
+
+func TestIsEdgeOneIP(t *testing.T) {
+	v, fake := newTestValidator(t, faketeo.Config{EdgeOneIPs: edgeOneIPs})
+	for _, tc := range []struct {
+		ip       string
+		want     bool
+		requests int64
+	}{
+		{"43.175.1.1", true, 1},
+		{"::ffff:43.175.1.1", true, 1}, // cached under the unmapped address
+		{"2402:4e00::1", true, 2},
+		{"203.0.113.7", false, 3},
+		{"203.0.113.7", false, 3},
+		{"10.0.0.1", false, 3}, // private addresses never reach the API
+		{"127.0.0.1", false, 3},
+	} {
+		got, err := v.IsEdgeOneIP(netip.MustParseAddr(tc.ip))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.ip, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.ip, got, tc.want)
+		}
+		if n := fake.Requests(); n != tc.requests {
+			t.Errorf("%s: %d API requests, want %d", tc.ip, n, tc.requests)
+		}
+	}
+}
+
+func TestIsEdgeOneIPNegativeTTL(t *testing.T) {
+	fake := faketeo.New(faketeo.Config{EdgeOneIPs: edgeOneIPs})
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	v, err := New(Config{
+		SecretID:    "id",
+		SecretKey:   "key",
+		APIEndpoint: srv.URL,
+		CacheSize:   16,
+		PositiveTTL: time.Hour,
+		NegativeTTL: 50 * time.Millisecond,
+		Timeout:     5 * time.Second,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"43.175.1.1", "203.0.113.7"} {
+		if _, err := v.IsEdgeOneIP(netip.MustParseAddr(ip)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The negative result expired and is asked again; the positive one is
+	// still cached.
+	for _, ip := range []string{"43.175.1.1", "203.0.113.7"} {
+		if _, err := v.IsEdgeOneIP(netip.MustParseAddr(ip)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fake.Requests(); n != 3 {
+		t.Fatalf("%d API requests, want 3", n)
+	}
+}
+
+func TestIsEdgeOneIPAPIError(t *testing.T) {
+	v, fake := newTestValidator(t, faketeo.Config{EdgeOneIPs: edgeOneIPs, ErrorRate: 1})
+	ip := netip.MustParseAddr("43.175.1.1")
+	_, err := v.IsEdgeOneIP(ip)
+	if oopsErr, ok := oops.AsOops(err); !ok || oopsErr.Code() != errcode.APIRequestFailed {
+		t.Fatalf("got %v, want %s", err, errcode.APIRequestFailed)
+	}
+
+	// Failures are not cached.
+	fake.SetConfig(faketeo.Config{EdgeOneIPs: edgeOneIPs})
+	if got, err := v.IsEdgeOneIP(ip); err != nil || !got {
+		t.Fatalf("after recovery: got %v, %v", got, err)
+	}
+}
+
+func TestIsEdgeOneIPFallback(t *testing.T) {
+	fake := faketeo.New(faketeo.Config{EdgeOneIPs: edgeOneIPs, ErrorRate: 1})
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	newValidator := func(cfg Config) *Validator {
+		t.Helper()
+		cfg.SecretID, cfg.SecretKey, cfg.APIEndpoint = "id", "key", srv.URL
+		cfg.CacheSize, cfg.PositiveTTL, cfg.NegativeTTL, cfg.Timeout = 16, time.Hour, time.Hour, 5*time.Second
+		v, err := New(cfg, zerolog.Nop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	node, other := netip.MustParseAddr("43.175.1.1"), netip.MustParseAddr("203.0.113.7")
+
+	withList := newValidator(Config{Fallback: []netip.Prefix{netip.MustParsePrefix("43.175.0.0/16")}, FailOpen: true})
+	for ip, want := range map[netip.Addr]bool{node: true, other: false} {
+		if got, err := withList.IsEdgeOneIP(ip); err != nil || got != want {
+			t.Errorf("fallback list, %s: got %v, %v; want %v", ip, got, err, want)
+		}
+	}
+
+	for _, failOpen := range []bool{false, true} {
+		got, err := newValidator(Config{FailOpen: failOpen}).IsEdgeOneIP(other)
+		if !errcode.Is(err, errcode.APIRequestFailed) || got != failOpen {
+			t.Errorf("fail-open %v: got %v, %v", failOpen, got, err)
+		}
+	}
+
+	// Fallback answers are not cached.
+	fake.SetConfig(faketeo.Config{EdgeOneIPs: edgeOneIPs})
+	before := fake.Requests()
+	if got, err := withList.IsEdgeOneIP(node); err != nil || !got {
+		t.Fatalf("after recovery: got %v, %v", got, err)
+	}
+	if fake.Requests() == before {
+		t.Fatal("fallback answer was cached")
+	}
+}
+
+// dnsFunc is a DNSVerifier backed by a function.
+type dnsFunc func(netip.Addr) (bool, error)
+
+func (f dnsFunc) Verify(ip netip.Addr) (bool, error) { return f(ip) }
+
+func TestIsEdgeOneIPDNS(t *testing.T) {
+	fake := faketeo.New(faketeo.Config{EdgeOneIPs: edgeOneIPs, ErrorRate: 1})
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	node, other, broken := netip.MustParseAddr("43.175.1.1"), netip.MustParseAddr("203.0.113.7"), netip.MustParseAddr("203.0.113.8")
+	dns := dnsFunc(func(ip netip.Addr) (bool, error) {
+		if ip == broken {
+			return false, oops.Code(errcode.APIRequestFailed).Errorf("SERVFAIL")
+		}
+		return ip == node, nil
+	})
+	fallback := []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		ip      netip.Addr
+		want    bool
+		wantErr bool
+	}{
+		{name: "API down, DNS confirms", cfg: Config{}, ip: node, want: true},
+		{name: "API down, DNS denies", cfg: Config{}, ip: other},
+		{name: "API down, DNS denies, fallback trusts", cfg: Config{Fallback: fallback}, ip: other, want: true},
+		{name: "API and DNS down", cfg: Config{FailOpen: true}, ip: broken, want: true, wantErr: true},
+		{name: "DNS only", cfg: Config{DNSOnly: true}, ip: node, want: true},
+		{name: "DNS only, private", cfg: Config{DNSOnly: true}, ip: netip.MustParseAddr("10.0.0.1")},
+		{name: "DNS only, DNS down, fallback", cfg: Config{DNSOnly: true, Fallback: fallback}, ip: broken, want: true},
+	} {
+		cfg := tc.cfg
+		cfg.DNS = dns
+		if !cfg.DNSOnly {
+			cfg.SecretID, cfg.SecretKey, cfg.APIEndpoint = "id", "key", srv.URL
+			cfg.CacheSize, cfg.PositiveTTL, cfg.NegativeTTL, cfg.Timeout = 16, time.Hour, time.Hour, 5*time.Second
+		}
+		v, err := New(cfg, zerolog.Nop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := v.IsEdgeOneIP(tc.ip); got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("%s: got %v, %v; want %v, error %v", tc.name, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestIsEdgeOneIPTimeout(t *testing.T) {
+	fake := faketeo.New(faketeo.Config{EdgeOneIPs: edgeOneIPs, Latency: 2 * time.Second})
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	v, err := New(Config{SecretID: "id", SecretKey: "key", APIEndpoint: srv.URL, CacheSize: 16, PositiveTTL: time.Minute, NegativeTTL: time.Minute, Timeout: time.Second}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.IsEdgeOneIP(netip.MustParseAddr("43.175.1.1")); err == nil {
+		t.Fatal("expected a timeout")
+	}
+}
+
+func TestNewMissingCredentials(t *testing.T) {
+	_, err := New(Config{APIEndpoint: "teo.tencentcloudapi.com"}, zerolog.Nop())
+	if oopsErr, ok := oops.AsOops(err); !ok || oopsErr.Code() != errcode.MissingCredentials {
+		t.Fatalf("got %v, want %s", err, errcode.MissingCredentials)
+	}
+}
+
+// BenchmarkIsEdgeOneIPCached measures the validation of a peer whose result
+// is cached, the path every request of a known CDN node takes.
+func BenchmarkIsEdgeOneIPCached(b *testing.B) {
+	fake := faketeo.New(faketeo.Config{EdgeOneIPs: edgeOneIPs})
+	srv := httptest.NewServer(fake)
+	b.Cleanup(srv.Close)
+	v, err := New(Config{SecretID: "id", SecretKey: "key", APIEndpoint: srv.URL, CacheSize: 16, PositiveTTL: time.Hour, NegativeTTL: time.Hour, Timeout: 5 * time.Second}, zerolog.Nop())
+	if err != nil {
+		b.Fatal(err)
+	}
+	ip := netip.MustParseAddr("43.175.1.1")
+	if _, err := v.IsEdgeOneIP(ip); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		if ok, err := v.IsEdgeOneIP(ip); err != nil || !ok {
+			b.Fatal(ok, err)
+		}
+	}
+	if n := fake.Requests(); n != 1 {
+		b.Fatalf("%d API requests, want 1", n)
+	}
+}
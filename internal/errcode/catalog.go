@@ -0,0 +1,242 @@
+// Package errcode is the catalog of error codes attached to oops errors
+// (oops.Code). Every code belongs to a category, and classified errors are
+// counted in errors_total{category,code} and listed by the /admin/errors
+// endpoint, so failures can be alerted on and triaged by kind rather than by
+// message text.
+package errcode
+
+// Category groups codes by the kind of failure.
+type Category string
+
+const (
+	// CategoryConfig is invalid or unreadable configuration.
+	CategoryConfig Category = "CONFIG"
+	// CategoryTLS is certificate, key and TLS handshake setup.
+	CategoryTLS Category = "TLS"
+	// CategoryUpstreamAPI is a failing dependency: Kubernetes, LDAP, IdPs,
+	// flag services, shared stores and object storage.
+	CategoryUpstreamAPI Category = "UPSTREAM_API"
+	// CategoryProtocol is malformed traffic: bodies, cookies and addresses.
+	CategoryProtocol Category = "PROTOCOL"
+	// CategoryStorage is local file output.
+	CategoryStorage Category = "STORAGE"
+	// CategoryInternal is everything else, including unclassified errors.
+	CategoryInternal Category = "INTERNAL"
+)
+
+// Code is an error code, passed to oops.Code.
+type Code string
+
+// Codes, by category.
+const (
+	// CONFIG
+	InvalidConfig        Code = "INVALID_CONFIG"
+	ReadConfigFailed     Code = "READ_CONFIG_FAILED"
+	InvalidRules         Code = "INVALID_RULES"
+	ReadRulesFailed      Code = "READ_RULES_FAILED"
+	ParseRulesFailed     Code = "PARSE_RULES_FAILED"
+	InvalidOverrides     Code = "INVALID_OVERRIDES"
+	ParseOverridesFailed Code = "PARSE_OVERRIDES_FAILED"
+	InvalidMatch         Code = "INVALID_MATCH"
+	InvalidFlags         Code = "INVALID_FLAGS"
+	InvalidSchema        Code = "INVALID_SCHEMA"
+	InvalidPattern       Code = "INVALID_PATTERN"
+	InvalidPath          Code = "INVALID_PATH"
+	InvalidFormat        Code = "INVALID_FORMAT"
+	InvalidDriver        Code = "INVALID_DRIVER"
+	InvalidCompression   Code = "INVALID_COMPRESSION"
+	InvalidEndpoint      Code = "INVALID_ENDPOINT"
+	InvalidACSURL        Code = "INVALID_ACS_URL"
+	InvalidMetadataURL   Code = "INVALID_METADATA_URL"
+	InvalidRef           Code = "INVALID_REF"
+	InvalidPolicy        Code = "INVALID_POLICY"
+	InvalidCIDR          Code = "INVALID_CIDR"
+	InvalidResource      Code = "INVALID_RESOURCE"
+	InvalidLimit         Code = "INVALID_LIMIT"
+	ReadOpenAPIFailed    Code = "READ_OPENAPI_FAILED"
+	ParseOpenAPIFailed   Code = "PARSE_OPENAPI_FAILED"
+	ReadMetadataFailed   Code = "READ_METADATA_FAILED"
+	ParseMetadataFailed  Code = "PARSE_METADATA_FAILED"
+	MissingMetadata      Code = "MISSING_METADATA"
+	KeyTooShort          Code = "KEY_TOO_SHORT"
+	MissingCredentials   Code = "MISSING_CREDENTIALS"
+	NotInCluster         Code = "NOT_IN_CLUSTER"
+	TokenReadFailed      Code = "TOKEN_READ_FAILED"
+	CacheInitFailed      Code = "CACHE_INIT_FAILED"
+	ClientInitFailed     Code = "CLIENT_INIT_FAILED"
+
+	// TLS
+	LoadKeypairFailed Code = "LOAD_KEYPAIR_FAILED"
+	MissingKeypair    Code = "MISSING_KEYPAIR"
+	ReadCAFailed      Code = "READ_CA_FAILED"
+	AppendCertsFailed Code = "APPEND_CERTS_FAILED"
+	ParseCertFailed   Code = "PARSE_CERT_FAILED"
+	StatFailed        Code = "STAT_FAILED"
+	StartTLSFailed    Code = "STARTTLS_FAILED"
+	UnsupportedKey    Code = "UNSUPPORTED_KEY"
+	CertExpiring      Code = "CERT_EXPIRING"
+	CertExpired       Code = "CERT_EXPIRED"
+	CertRevoked       Code = "CERT_REVOKED"
+	RevocationFailed  Code = "REVOCATION_CHECK_FAILED"
+	DecryptKeyFailed  Code = "DECRYPT_KEY_FAILED"
+	PinMismatch       Code = "PIN_MISMATCH"
+	ClientNotAllowed  Code = "CLIENT_NOT_ALLOWED"
+
+	// UPSTREAM_API
+	DialFailed           Code = "DIAL_FAILED"
+	APIRequestFailed     Code = "API_REQUEST_FAILED"
+	APIBadStatus         Code = "API_BAD_STATUS"
+	APIDecodeFailed      Code = "API_DECODE_FAILED"
+	RequestBuildFailed   Code = "REQUEST_BUILD_FAILED"
+	KubernetesAPIError   Code = "KUBERNETES_API_ERROR"
+	InvalidResponse      Code = "INVALID_RESPONSE"
+	WatchError           Code = "WATCH_ERROR"
+	NotFound             Code = "NOT_FOUND"
+	KeyNotFound          Code = "KEY_NOT_FOUND"
+	SearchFailed         Code = "SEARCH_FAILED"
+	BindFailed           Code = "BIND_FAILED"
+	AmbiguousUser        Code = "AMBIGUOUS_USER"
+	FetchMetadataFailed  Code = "FETCH_METADATA_FAILED"
+	ProviderNotReady     Code = "PROVIDER_NOT_READY"
+	FlagNotFound         Code = "FLAG_NOT_FOUND"
+	FlagEvaluationFailed Code = "FLAG_EVALUATION_FAILED"
+	TypeMismatch         Code = "TYPE_MISMATCH"
+	ParseError           Code = "PARSE_ERROR"
+	StoreFailed          Code = "STORE_FAILED"
+	UploadFailed         Code = "UPLOAD_FAILED"
+	StreamFailed         Code = "STREAM_FAILED"
+
+	// PROTOCOL
+	Malformed                Code = "MALFORMED"
+	Expired                  Code = "EXPIRED"
+	BadSignature             Code = "BAD_SIGNATURE"
+	InvalidClaims            Code = "INVALID_CLAIMS"
+	SyntaxError              Code = "SYNTAX_ERROR"
+	UnexpectedEOF            Code = "UNEXPECTED_EOF"
+	NotAnInteger             Code = "NOT_AN_INTEGER"
+	ParseIPFromAddressFailed Code = "PARSE_IP_FROM_ADDRESS_FAILED"
+	MissingAttribute         Code = "MISSING_ATTRIBUTE"
+	UnexpectedResponse       Code = "UNEXPECTED_RESPONSE"
+	TransformFailed          Code = "TRANSFORM_FAILED"
+	InvalidXML               Code = "INVALID_XML"
+	ForbiddenDTD             Code = "FORBIDDEN_DTD"
+	LimitExceeded            Code = "LIMIT_EXCEEDED"
+	InvalidMultipart         Code = "INVALID_MULTIPART"
+	InvalidGraphQL           Code = "INVALID_GRAPHQL"
+	InvalidJSON              Code = "INVALID_JSON"
+
+	// STORAGE
+	WriteFailed Code = "WRITE_FAILED"
+	ReadFailed  Code = "READ_FAILED"
+
+	// INTERNAL
+	SelftestFailed Code = "SELFTEST_FAILED"
+	ListenFailed   Code = "LISTEN_FAILED"
+	EncodeFailed   Code = "ENCODE_FAILED"
+	Unclassified   Code = "UNCLASSIFIED"
+)
+
+// Entry describes a code.
+type Entry struct {
+	Code        Code     `json:"code"`
+	Category    Category `json:"category"`
+	Description string   `json:"description"`
+}
+
+// catalog lists every code.
+var catalog = []Entry{
+	{InvalidConfig, CategoryConfig, "A configuration file or command-line value is invalid."},
+	{ReadConfigFailed, CategoryConfig, "A configuration file could not be read."},
+	{InvalidRules, CategoryConfig, "A rules file failed validation."},
+	{ReadRulesFailed, CategoryConfig, "A rules file could not be read."},
+	{ParseRulesFailed, CategoryConfig, "A rules file is not valid YAML."},
+	{InvalidOverrides, CategoryConfig, "An access log override file failed validation."},
+	{ParseOverridesFailed, CategoryConfig, "An access log override file is not valid YAML."},
+	{InvalidMatch, CategoryConfig, "A request match specification is invalid."},
+	{InvalidFlags, CategoryConfig, "A feature flag file failed validation."},
+	{InvalidSchema, CategoryConfig, "An unknown access log schema was selected."},
+	{InvalidPattern, CategoryConfig, "A path template pattern is invalid."},
+	{InvalidPath, CategoryConfig, "A JSON path expression is invalid."},
+	{InvalidFormat, CategoryConfig, "An unknown output format was selected or a log format string is invalid."},
+	{InvalidDriver, CategoryConfig, "An unknown store driver was selected."},
+	{InvalidCompression, CategoryConfig, "An unknown compression was selected."},
+	{InvalidEndpoint, CategoryConfig, "A configured endpoint URL is invalid."},
+	{InvalidACSURL, CategoryConfig, "The SAML assertion consumer service URL is invalid."},
+	{InvalidMetadataURL, CategoryConfig, "The SAML metadata URL is invalid."},
+	{InvalidRef, CategoryConfig, "A ConfigMap/Secret reference is malformed."},
+	{InvalidPolicy, CategoryConfig, "An ExtProcPolicy or processor policy is invalid."},
+	{InvalidCIDR, CategoryConfig, "An IP list entry is not an address or CIDR prefix."},
+	{InvalidResource, CategoryConfig, "A dynamic configuration resource could not be decoded."},
+	{InvalidLimit, CategoryConfig, "A rate limit is not of the form 'requests/unit'."},
+	{ReadOpenAPIFailed, CategoryConfig, "The OpenAPI document could not be read."},
+	{ParseOpenAPIFailed, CategoryConfig, "The OpenAPI document could not be parsed."},
+	{ReadMetadataFailed, CategoryConfig, "The SAML IdP metadata file could not be read."},
+	{ParseMetadataFailed, CategoryConfig, "The SAML IdP metadata could not be parsed."},
+	{MissingMetadata, CategoryConfig, "No SAML IdP metadata source was configured."},
+	{KeyTooShort, CategoryConfig, "A secret key is shorter than required."},
+	{MissingCredentials, CategoryConfig, "Required upstream credentials are not configured."},
+	{NotInCluster, CategoryConfig, "Kubernetes integration was requested outside a cluster."},
+	{TokenReadFailed, CategoryConfig, "The service account token could not be read."},
+	{CacheInitFailed, CategoryConfig, "A cache could not be created with the configured size."},
+	{ClientInitFailed, CategoryConfig, "An upstream API client could not be created."},
+	{LoadKeypairFailed, CategoryTLS, "A certificate and key pair could not be loaded."},
+	{MissingKeypair, CategoryTLS, "A certificate or key file is missing."},
+	{ReadCAFailed, CategoryTLS, "A CA bundle could not be read."},
+	{AppendCertsFailed, CategoryTLS, "A CA bundle holds no usable certificates."},
+	{ParseCertFailed, CategoryTLS, "A certificate could not be parsed."},
+	{StatFailed, CategoryTLS, "A certificate file could not be checked for changes."},
+	{StartTLSFailed, CategoryTLS, "The StartTLS upgrade failed."},
+	{UnsupportedKey, CategoryTLS, "A private key type cannot be used for signing."},
+	{CertExpiring, CategoryTLS, "A served certificate expires within a configured lead time."},
+	{CertExpired, CategoryTLS, "A served certificate has expired or a reloaded one was already expired."},
+	{CertRevoked, CategoryTLS, "A certificate was reported revoked by OCSP or a CRL."},
+	{RevocationFailed, CategoryTLS, "The revocation status of a certificate could not be determined."},
+	{DecryptKeyFailed, CategoryTLS, "An encrypted private key or PKCS#12 bundle could not be decrypted."},
+	{PinMismatch, CategoryTLS, "A peer certificate matches neither the configured SPKI pins nor the served certificate."},
+	{ClientNotAllowed, CategoryTLS, "A verified client certificate matches no allowed SAN or SPIFFE ID."},
+	{DialFailed, CategoryUpstreamAPI, "A connection to an upstream service could not be established."},
+	{APIRequestFailed, CategoryUpstreamAPI, "An upstream API request failed."},
+	{APIBadStatus, CategoryUpstreamAPI, "An upstream API answered with an error status."},
+	{APIDecodeFailed, CategoryUpstreamAPI, "An upstream API response could not be decoded."},
+	{RequestBuildFailed, CategoryUpstreamAPI, "An upstream API request could not be built."},
+	{KubernetesAPIError, CategoryUpstreamAPI, "The Kubernetes API answered with an error."},
+	{InvalidResponse, CategoryUpstreamAPI, "The Kubernetes API returned an unexpected response."},
+	{WatchError, CategoryUpstreamAPI, "A Kubernetes watch returned an error event."},
+	{NotFound, CategoryUpstreamAPI, "A referenced Kubernetes object does not exist."},
+	{KeyNotFound, CategoryUpstreamAPI, "A ConfigMap/Secret lacks the referenced key."},
+	{SearchFailed, CategoryUpstreamAPI, "An LDAP search failed."},
+	{BindFailed, CategoryUpstreamAPI, "An LDAP bind failed."},
+	{AmbiguousUser, CategoryUpstreamAPI, "An LDAP search matched several users."},
+	{FetchMetadataFailed, CategoryUpstreamAPI, "The SAML IdP metadata could not be fetched."},
+	{ProviderNotReady, CategoryUpstreamAPI, "The feature flag service is unreachable."},
+	{FlagNotFound, CategoryUpstreamAPI, "A feature flag is not defined."},
+	{FlagEvaluationFailed, CategoryUpstreamAPI, "The feature flag service failed to evaluate a flag."},
+	{TypeMismatch, CategoryUpstreamAPI, "A feature flag value has an unexpected type."},
+	{ParseError, CategoryUpstreamAPI, "A feature flag service response could not be parsed."},
+	{StoreFailed, CategoryUpstreamAPI, "A shared store (Redis, Memcached) operation failed."},
+	{UploadFailed, CategoryUpstreamAPI, "An archive upload to object storage failed."},
+	{StreamFailed, CategoryUpstreamAPI, "A gRPC stream to a control plane or processor failed."},
+	{Malformed, CategoryProtocol, "A signed cookie or token is malformed."},
+	{Expired, CategoryProtocol, "A signed cookie or token has expired."},
+	{BadSignature, CategoryProtocol, "A signature does not verify."},
+	{InvalidClaims, CategoryProtocol, "A token's issuer, audience or validity times are not accepted."},
+	{SyntaxError, CategoryProtocol, "A streamed JSON body is not valid JSON."},
+	{UnexpectedEOF, CategoryProtocol, "A streamed JSON body ended early."},
+	{NotAnInteger, CategoryProtocol, "A stored counter is not an integer."},
+	{ParseIPFromAddressFailed, CategoryProtocol, "A client address could not be parsed."},
+	{MissingAttribute, CategoryProtocol, "A request lacks a required ext_proc attribute or header."},
+	{UnexpectedResponse, CategoryProtocol, "A processor answered with an unexpected message."},
+	{TransformFailed, CategoryProtocol, "A body transformation template failed or produced no value."},
+	{InvalidXML, CategoryProtocol, "An XML body is not well-formed or not a valid SOAP envelope."},
+	{ForbiddenDTD, CategoryProtocol, "An XML body declares a DTD or entities, which are refused to prevent XXE and entity expansion."},
+	{LimitExceeded, CategoryProtocol, "A body exceeds a configured size, depth or count limit."},
+	{InvalidMultipart, CategoryProtocol, "A multipart body is malformed or ends before its closing boundary."},
+	{InvalidGraphQL, CategoryProtocol, "A GraphQL request is not valid JSON or its document does not parse."},
+	{InvalidJSON, CategoryProtocol, "A JSON body is not an object or repeats a key, possibly differing only in case."},
+	{WriteFailed, CategoryStorage, "A local file (log output, capture, spill) could not be written."},
+	{ReadFailed, CategoryStorage, "A local file could not be read."},
+	{SelftestFailed, CategoryInternal, "A self-test case failed."},
+	{ListenFailed, CategoryInternal, "A server could not listen on its port."},
+	{EncodeFailed, CategoryInternal, "A log entry or capture record could not be encoded."},
+	{Unclassified, CategoryInternal, "An error without a catalog code."},
+}
@@ -0,0 +1,133 @@
+package errcode
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samber/oops"
+)
+
+var errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "errors_total",
+	Help: "Errors logged, by catalog category and code.",
+}, []string{"category", "code"})
+
+func init() {
+	metrics.Registry.MustRegister(errorsTotal)
+}
+
+var byCode = func() map[Code]Entry {
+	m := make(map[Code]Entry, len(catalog))
+	for _, e := range catalog {
+		m[e.Code] = e
+	}
+	return m
+}()
+
+// Catalog returns every entry, ordered by category as declared.
+func Catalog() []Entry {
+	return slices.Clone(catalog)
+}
+
+// Lookup returns the entry of code.
+func Lookup(code Code) (Entry, bool) {
+	e, ok := byCode[code]
+	return e, ok
+}
+
+// Classify returns the catalog entry of err: the deepest oops code of its
+// chain. Errors without a code, or with one missing from the catalog, are
+// UNCLASSIFIED.
+func Classify(err error) Entry {
+	if oopsErr, ok := oops.AsOops(err); ok {
+		var code Code
+		switch c := oopsErr.Code().(type) {
+		case Code:
+			code = c
+		case string:
+			code = Code(c)
+		}
+		if e, ok := byCode[code]; ok {
+			return e
+		}
+	}
+	return byCode[Unclassified]
+}
+
+// Is reports whether err carries code.
+func Is(err error, code Code) bool {
+	return err != nil && Classify(err).Code == code
+}
+
+// Stat is what Observe recorded of a code.
+type Stat struct {
+	Entry
+	Count       uint64    `json:"count"`
+	LastMessage string    `json:"last_message"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+var (
+	mu    sync.Mutex
+	stats = map[Code]*Stat{}
+)
+
+// Observe classifies err, counts it in errors_total and records it for the
+// admin endpoint. Nil errors are ignored.
+func Observe(err error) {
+	if err == nil {
+		return
+	}
+	e := Classify(err)
+	errorsTotal.WithLabelValues(string(e.Category), string(e.Code)).Inc()
+
+	mu.Lock()
+	defer mu.Unlock()
+	s, ok := stats[e.Code]
+	if !ok {
+		s = &Stat{Entry: e}
+		stats[e.Code] = s
+	}
+	s.Count++
+	s.LastMessage = err.Error()
+	s.LastSeen = time.Now()
+}
+
+// Stats returns the observed codes, most frequent first.
+func Stats() []Stat {
+	mu.Lock()
+	out := make([]Stat, 0, len(stats))
+	for _, s := range stats {
+		out = append(out, *s)
+	}
+	mu.Unlock()
+	slices.SortFunc(out, func(a, b Stat) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Code, b.Code)
+	})
+	return out
+}
+
+// Handler serves the observed errors and, with ?catalog=true, the full
+// catalog, as JSON.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out := struct {
+			Errors  []Stat  `json:"errors"`
+			Catalog []Entry `json:"catalog,omitempty"`
+		}{Errors: Stats()}
+		if r.URL.Query().Get("catalog") == "true" {
+			out.Catalog = Catalog()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
@@ -0,0 +1,108 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+func TestResponseFlags(t *testing.T) {
+	attrs := map[string]string{"request.id": "abort-1", "source.address": "192.0.2.10:40000"}
+	tests := []struct {
+		name  string
+		opts  []Option
+		run   func(t *testing.T, p extproc.Processor)
+		flags any
+	}{
+		{
+			name: "complete",
+			run: func(t *testing.T, p extproc.Processor) {
+				p.ProcessRequestHeaders(extproctest.NewContext(attrs, ":method", "GET", ":path", "/"))
+				p.ProcessResponseHeaders(extproctest.NewContext(attrs, ":status", "200"))
+			},
+			flags: nil,
+		},
+		{
+			name: "client abort",
+			run: func(t *testing.T, p extproc.Processor) {
+				p.ProcessRequestHeaders(extproctest.NewContext(attrs, ":method", "GET", ":path", "/slow"))
+			},
+			flags: FlagClientAbort,
+		},
+		{
+			name: "upstream reset",
+			run: func(t *testing.T, p extproc.Processor) {
+				p.ProcessRequestHeaders(extproctest.NewContext(attrs,
+					":method", "POST", ":path", "/helloworld.Greeter/SayHello", "content-type", "application/grpc"))
+				p.ProcessResponseHeaders(extproctest.NewContext(attrs, ":status", "200", "content-type", "application/grpc"))
+			},
+			flags: FlagUpstreamReset,
+		},
+		{
+			name: "response end",
+			opts: []Option{WithResponseEnd()},
+			run: func(t *testing.T, p extproc.Processor) {
+				p.ProcessRequestHeaders(extproctest.NewContext(attrs, ":method", "GET", ":path", "/download"))
+				result := p.ProcessResponseHeaders(extproctest.NewContext(attrs, ":status", "200"))
+				if result.ModeOverride.GetResponseBodyMode() != envoy_extensions_ext_proc_v3.ProcessingMode_STREAMED {
+					t.Error("response body not streamed")
+				}
+				p.ProcessResponseBody(extproctest.NewContext(attrs), []byte("partial"), false)
+				p.ProcessResponseBody(extproctest.NewContext(attrs), []byte("rest"), true)
+			},
+			flags: nil,
+		},
+		{
+			name: "reset mid-body",
+			opts: []Option{WithResponseEnd()},
+			run: func(t *testing.T, p extproc.Processor) {
+				p.ProcessRequestHeaders(extproctest.NewContext(attrs, ":method", "GET", ":path", "/download"))
+				p.ProcessResponseHeaders(extproctest.NewContext(attrs, ":status", "200"))
+				p.ProcessResponseBody(extproctest.NewContext(attrs), []byte("partial"), false)
+			},
+			flags: FlagUpstreamReset,
+		},
+		{
+			// Without response end tracking the body is not seen, so a
+			// reset mid-body cannot be told from a complete response.
+			name: "reset mid-body untracked",
+			run: func(t *testing.T, p extproc.Processor) {
+				p.ProcessRequestHeaders(extproctest.NewContext(attrs, ":method", "GET", ":path", "/download"))
+				p.ProcessResponseHeaders(extproctest.NewContext(attrs, ":status", "200"))
+			},
+			flags: nil,
+		},
+	}
+	for _, tt := range tests {
+		for _, schema := range []*Schema{SchemaCaddy, SchemaCustomV3} {
+			t.Run(tt.name+"/"+schema.Name, func(t *testing.T) {
+				var out bytes.Buffer
+				p := NewProcessorFactory(&out, zerolog.Nop(), append(tt.opts, WithSchema(schema))...).NewProcessor()
+				tt.run(t, p)
+				p.(extproc.RequestEndHandler).OnRequestEnd()
+				p.(extproc.StreamEndHandler).OnStreamEnd()
+
+				entries := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+				if len(entries) != 1 {
+					t.Fatalf("got %d entries, want 1:\n%s", len(entries), out.Bytes())
+				}
+				var entry map[string]any
+				if err := json.Unmarshal(entries[0], &entry); err != nil {
+					t.Fatal(err)
+				}
+				flags, present := entry["response_flags"]
+				if schema == SchemaCaddy && tt.flags == nil && present {
+					t.Errorf("response_flags = %v, want absent", flags)
+				}
+				if flags != tt.flags {
+					t.Errorf("response_flags = %v, want %v", flags, tt.flags)
+				}
+			})
+		}
+	}
+}
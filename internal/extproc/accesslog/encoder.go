@@ -0,0 +1,276 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// The fast encoder writes the same fields as the schema emitters, in the
+// same order, but through zerolog's typed methods and LogObjectMarshalers
+// instead of encoding/json and Interface, so an entry is written into
+// zerolog's pooled event buffer without intermediate allocations. Values are
+// identical; strings are not HTML-escaped as encoding/json does.
+
+var null = []byte("null")
+
+// scratch holds pooled buffers for formatting timestamps and sorting keys,
+// and the value being marshaled, so the marshalers below are pointers into
+// it rather than values boxed on every call.
+type scratch struct {
+	buf     []byte
+	keys    []string
+	request *requestInfo
+	headers map[string][]string
+}
+
+var scratches = sync.Pool{
+	New: func() any { return &scratch{buf: make([]byte, 0, 64), keys: make([]string, 0, 32)} },
+}
+
+// rawTime appends t in RFC 3339 as a JSON string.
+func (s *scratch) rawTime(t time.Time) []byte {
+	s.buf = append(s.buf[:0], '"')
+	s.buf = t.AppendFormat(s.buf, time.RFC3339Nano)
+	return append(s.buf, '"')
+}
+
+func optStr(e *zerolog.Event, key string, v *string) *zerolog.Event {
+	if v == nil {
+		return e.RawJSON(key, null)
+	}
+	return e.Str(key, *v)
+}
+
+func optInt(e *zerolog.Event, key string, v *int) *zerolog.Event {
+	if v == nil {
+		return e.RawJSON(key, null)
+	}
+	return e.Int(key, *v)
+}
+
+func optUint64(e *zerolog.Event, key string, v *uint64) *zerolog.Event {
+	if v == nil {
+		return e.RawJSON(key, null)
+	}
+	return e.Uint64(key, *v)
+}
+
+func optFloat64(e *zerolog.Event, key string, v *float64) *zerolog.Event {
+	if v == nil {
+		return e.RawJSON(key, null)
+	}
+	return e.Float64(key, *v)
+}
+
+// nonEmpty returns nil for empty strings, like nullable without allocating.
+func nonEmpty(s *string) *string {
+	if *s == "" {
+		return nil
+	}
+	return s
+}
+
+// firstHeader is entry.requestHeader for an already canonical name.
+func firstHeader(headers map[string][]string, name string) *string {
+	if values := headers[name]; len(values) > 0 {
+		return &values[0]
+	}
+	return nil
+}
+
+// headerObject writes scratch.headers with sorted keys, as encoding/json
+// does.
+type headerObject scratch
+
+func (h *headerObject) MarshalZerologObject(e *zerolog.Event) {
+	keys := h.keys[:0]
+	for key := range h.headers {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		e.Strs(key, h.headers[key])
+	}
+	clear(keys)
+	h.keys = keys[:0]
+}
+
+func (s *scratch) headerMap(e *zerolog.Event, key string, headers map[string][]string) *zerolog.Event {
+	if headers == nil {
+		return e.RawJSON(key, null)
+	}
+	s.headers = headers
+	e = e.Object(key, (*headerObject)(s))
+	s.headers = nil
+	return e
+}
+
+// requestObject writes scratch.request like its JSON encoding.
+type requestObject scratch
+
+func (r *requestObject) MarshalZerologObject(e *zerolog.Event) {
+	s := (*scratch)(r)
+	req := s.request
+	e.Str("id", req.ID).
+		Str("remote_ip", req.RemoteIP).
+		Str("client_ip", req.ClientIP).
+		Str("proto", req.Proto).
+		Str("method", req.Method).
+		Str("host", req.Host).
+		Str("uri", req.URI)
+	if req.Route != "" {
+		e.Str("route", req.Route)
+	}
+	if len(req.Headers) > 0 {
+		s.headerMap(e, "headers", req.Headers)
+	}
+	e.RawJSON("start_time", s.rawTime(req.StartTime))
+	optUint64(e, "size", req.Size)
+}
+
+// MarshalZerologObject writes g like its JSON encoding.
+func (g *grpcInfo) MarshalZerologObject(e *zerolog.Event) {
+	e.Str("service", g.Service).Str("method", g.Method)
+	if g.Web {
+		e.Bool("web", true)
+	}
+	optInt(e, "status", g.Status)
+	if g.StatusName != "" {
+		e.Str("status_name", g.StatusName)
+	}
+	if g.Message != "" {
+		e.Str("message", g.Message)
+	}
+	if g.RequestMessages != nil {
+		e.Int("request_messages", *g.RequestMessages)
+	}
+	if g.ResponseMessages != nil {
+		e.Int("response_messages", *g.ResponseMessages)
+	}
+}
+
+// MarshalZerologObject writes t like its JSON encoding.
+func (t *timingInfo) MarshalZerologObject(e *zerolog.Event) {
+	optFloat64(e, "request_body_ms", t.RequestBody)
+	optFloat64(e, "upstream_ms", t.Upstream)
+	optFloat64(e, "response_body_ms", t.ResponseBody)
+	e.Float64("header_processing_ms", t.HeaderProcessing).
+		Float64("body_processing_ms", t.BodyProcessing)
+}
+
+// emitCaddyFast is emitCaddy on the fast encoder. Envoy attributes are
+// rare and keep the encoding/json path.
+func emitCaddyFast(log zerolog.Logger, e *entry) error {
+	s := scratches.Get().(*scratch)
+	s.request = e.request
+	defer func() {
+		s.request = nil
+		scratches.Put(s)
+	}()
+
+	event := log.WithLevel(e.level).Object("request", (*requestObject)(s))
+	switch {
+	case e.attrs == nil:
+		event = event.RawJSON("attrs", null)
+	case len(e.attrs) == 0:
+		event = event.RawJSON("attrs", []byte("{}"))
+	default:
+		jsonAttr, err := json.Marshal(e.attrs)
+		if err != nil {
+			event.Discard()
+			return oops.Code(errcode.EncodeFailed).With("attrs", e.attrs).Wrapf(err, "failed to marshal attributes")
+		}
+		event = event.RawJSON("attrs", jsonAttr)
+	}
+
+	if e.grpc != nil {
+		event = event.Str("protocol", "grpc").Object("grpc", e.grpc)
+	} else {
+		event = optUint64(event, "size", e.response.Size).Int("status", e.response.Status)
+	}
+
+	event = event.Str("id", e.request.ID).Dur("duration", e.duration)
+	event = s.headerMap(event, "resp_headers", e.response.Headers)
+	if e.respTime.IsZero() {
+		event = event.RawJSON("resp_start_time", null)
+	} else {
+		event = event.RawJSON("resp_start_time", s.rawTime(e.respTime.UTC()))
+	}
+	if e.timing == nil {
+		event = event.RawJSON("timings", null)
+	} else {
+		event = event.Object("timings", e.timing)
+	}
+	if e.response.Flags != "" {
+		event = event.Str("response_flags", e.response.Flags)
+	}
+	event.Msg("request processed")
+	return nil
+}
+
+// emitCustomFast is emitCustom on the fast encoder.
+func emitCustomFast(log zerolog.Logger, e *entry, version int) error {
+	s := scratches.Get().(*scratch)
+	defer scratches.Put(s)
+
+	var grpcService, grpcMethod, grpcMessage *string
+	var grpcStatus *int
+	if e.grpc != nil {
+		grpcService, grpcMethod, grpcStatus = &e.grpc.Service, &e.grpc.Method, e.grpc.Status
+		grpcMessage = nonEmpty(&e.grpc.Message)
+	}
+	req := e.request
+
+	event := log.Log().Str("schema", customSchemaNames[version])
+	event = event.RawJSON("timestamp", s.rawTime(req.StartTime.UTC())).
+		Str("level", e.level.String()).
+		Str("id", req.ID).
+		Str("protocol", e.protocol())
+	event = optStr(event, "remote_ip", nonEmpty(&req.RemoteIP))
+	event = optStr(event, "client_ip", nonEmpty(&req.ClientIP))
+	event = optStr(event, "scheme", nonEmpty(&req.Proto))
+	event = event.Str("method", req.Method).Str("host", req.Host).Str("uri", req.URI)
+	event = optStr(event, "route", nonEmpty(&req.Route))
+	event = optStr(event, "user_agent", firstHeader(req.Headers, "User-Agent"))
+	event = optStr(event, "referer", firstHeader(req.Headers, "Referer"))
+	event = optInt(event, "status", httpStatus(e))
+	event = optUint64(event, "request_bytes", req.Size)
+	event = optUint64(event, "response_bytes", e.response.Size)
+	event = event.Float64("duration_ms", float64(e.duration)/float64(time.Millisecond))
+	event = optStr(event, "grpc_service", grpcService)
+	event = optStr(event, "grpc_method", grpcMethod)
+	event = optInt(event, "grpc_status", grpcStatus)
+	event = optStr(event, "grpc_message", grpcMessage)
+	if version >= 2 {
+		timing := e.timing
+		if timing == nil {
+			timing = &timingInfo{}
+		}
+		event = optFloat64(event, "request_body_ms", timing.RequestBody)
+		event = optFloat64(event, "upstream_ms", timing.Upstream)
+		event = optFloat64(event, "response_body_ms", timing.ResponseBody)
+		event = event.Float64("processing_ms", timing.HeaderProcessing+timing.BodyProcessing)
+	}
+	if version >= 3 {
+		event = optStr(event, "response_flags", nonEmpty(&e.response.Flags))
+	}
+	event.Send()
+	return nil
+}
+
+// customSchemaNames avoids formatting the schema name of every entry.
+var customSchemaNames = map[int]string{1: "custom-v1", 2: "custom-v2", 3: "custom-v3"}
+
+// Ensure the fast encoder's marshalers implement zerolog.LogObjectMarshaler.
+var (
+	_ zerolog.LogObjectMarshaler = (*headerObject)(nil)
+	_ zerolog.LogObjectMarshaler = (*requestObject)(nil)
+	_ zerolog.LogObjectMarshaler = (*grpcInfo)(nil)
+	_ zerolog.LogObjectMarshaler = (*timingInfo)(nil)
+)
@@ -0,0 +1,121 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func testEntries() map[string]*entry {
+	start := time.Date(2025, 3, 14, 15, 9, 26, 535897932, time.FixedZone("CST", 8*3600))
+	size := uint64(1234)
+	reqMs, upMs := 0.25, 12.5
+	status, count := 13, 3
+	http := &entry{
+		request: &requestInfo{
+			ID:       "8c4f1a7e-4b1d-4c6f-9d3e-2f1c0a9b8e7d",
+			RemoteIP: "10.0.0.12",
+			ClientIP: "203.0.113.7",
+			Proto:    "https",
+			Method:   "POST",
+			Host:     "api.example.com",
+			URI:      "/v1/orders?limit=10&q=<a>",
+			Route:    "/v1/orders",
+			Headers: map[string][]string{
+				"Accept":        {"application/json"},
+				"Authorization": redacted,
+				"User-Agent":    {"curl/8.5.0"},
+				"Referer":       {"https://example.com/"},
+				"X-Multi":       {"a", "b"},
+			},
+			StartTime: start,
+			Size:      &size,
+		},
+		response: &responseInfo{
+			Headers: map[string][]string{"Content-Type": {"application/json"}, "Set-Cookie": redacted},
+			Size:    &size,
+			Status:  201,
+		},
+		timing:   &timingInfo{RequestBody: &reqMs, Upstream: &upMs, HeaderProcessing: 0.031, BodyProcessing: 0.002},
+		duration: 13*time.Millisecond + 250*time.Microsecond,
+		respTime: start.Add(13 * time.Millisecond),
+		level:    zerolog.InfoLevel,
+	}
+	grpc := &entry{
+		request: &requestInfo{
+			ID:        "grpc-1",
+			Method:    "POST",
+			Host:      "grpc.example.com",
+			URI:       "/pkg.Service/Method",
+			StartTime: start,
+		},
+		response: &responseInfo{},
+		grpc: &grpcInfo{
+			Service: "pkg.Service", Method: "Method", Web: true,
+			Status: &status, StatusName: "INTERNAL", Message: "boom",
+			RequestMessages: &count, ResponseMessages: &count,
+		},
+		timing:   &timingInfo{},
+		duration: time.Second,
+		level:    zerolog.ErrorLevel,
+	}
+	return map[string]*entry{"http": http, "grpc": grpc}
+}
+
+func emitted(t *testing.T, emit func(zerolog.Logger, *entry) error, e *entry) any {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := emit(zerolog.New(&buf), e); err != nil {
+		t.Fatalf("emit: %v", err)
+	}
+	var out any
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	return out
+}
+
+func TestFastEncoderMatchesJSON(t *testing.T) {
+	for _, schema := range schemas {
+		if schema.emitFast == nil {
+			continue
+		}
+		for name, e := range testEntries() {
+			want := emitted(t, schema.emit, e)
+			got := emitted(t, schema.emitFast, e)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s/%s:\n fast %v\n json %v", schema.Name, name, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkEmit(b *testing.B) {
+	e := testEntries()["http"]
+	log := zerolog.New(io.Discard)
+	for _, schema := range schemas {
+		encoders := map[string]func(zerolog.Logger, *entry) error{"json": schema.emit}
+		if schema.emitFast != nil {
+			encoders["fast"] = schema.emitFast
+		}
+		for _, encoder := range []string{"json", "fast"} {
+			emit, ok := encoders[encoder]
+			if !ok {
+				continue
+			}
+			b.Run(schema.Name+"/"+encoder, func(b *testing.B) {
+				b.ReportAllocs()
+				for b.Loop() {
+					if err := emit(log, e); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
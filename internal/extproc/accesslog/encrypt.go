@@ -0,0 +1,117 @@
+package accesslog
+
+import (
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/fieldcrypt"
+	"github.com/samber/oops"
+)
+
+// Fields FieldEncryption can encrypt, besides "header:<name>".
+const (
+	FieldRemoteIP   = "remote_ip"
+	FieldClientIP   = "client_ip"
+	FieldRemoteUser = "remote_user"
+)
+
+// FieldEncryption replaces selected entry values by fieldcrypt tokens that
+// only the holder of the recipient's private key can decrypt.
+type FieldEncryption struct {
+	enc        *fieldcrypt.Encryptor
+	remoteIP   bool
+	clientIP   bool
+	remoteUser bool
+	headers    headerSet
+}
+
+// NewFieldEncryption encrypts fields to publicKey. Fields are remote_ip,
+// client_ip, remote_user and header:<name> for request and response
+// headers; headers excluded from logging stay redacted.
+func NewFieldEncryption(publicKey string, fields []string) (*FieldEncryption, error) {
+	enc, err := fieldcrypt.NewEncryptor(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	fe := &FieldEncryption{enc: enc, headers: make(headerSet)}
+	for _, field := range fields {
+		switch field = strings.TrimSpace(field); {
+		case field == FieldRemoteIP:
+			fe.remoteIP = true
+		case field == FieldClientIP:
+			fe.clientIP = true
+		case field == FieldRemoteUser:
+			fe.remoteUser = true
+		case strings.HasPrefix(field, "header:") && len(field) > len("header:"):
+			fe.headers[headerKey(strings.TrimPrefix(field, "header:"))] = struct{}{}
+		default:
+			return nil, oops.
+				In("accesslog").
+				Code(errcode.InvalidConfig).
+				With("field", field).
+				Errorf("unknown encrypted field %q: want remote_ip, client_ip, remote_user or header:<name>", field)
+		}
+	}
+	return fe, nil
+}
+
+// WithFieldEncryption encrypts the fields selected by fe in every entry.
+func WithFieldEncryption(fe *FieldEncryption) Option {
+	return func(f *ProcessorFactory) {
+		f.encryption = fe
+	}
+}
+
+// encrypt returns the token of value, or "" for an empty value so absent
+// fields stay recognizable.
+func (fe *FieldEncryption) encrypt(value string) string {
+	if value == "" {
+		return ""
+	}
+	token, err := fe.enc.Encrypt(value)
+	if err != nil {
+		// Never log a value that should have been encrypted.
+		return "ENCRYPTION_FAILED"
+	}
+	return token
+}
+
+// apply encrypts the selected fields of info.
+func (fe *FieldEncryption) apply(info *requestInfo) {
+	if fe.remoteIP {
+		info.RemoteIP = fe.encrypt(info.RemoteIP)
+	}
+	if fe.clientIP {
+		info.ClientIP = fe.encrypt(info.ClientIP)
+	}
+	if fe.remoteUser {
+		info.RemoteUser = fe.encrypt(info.RemoteUser)
+	}
+	info.Headers, info.pooledHeaders = fe.applyHeaders(info.Headers, info.pooledHeaders)
+}
+
+// applyHeaders encrypts the selected headers of a map returned by
+// redactHeaders, copying it first unless it is pooled.
+func (fe *FieldEncryption) applyHeaders(headers map[string][]string, pooled bool) (map[string][]string, bool) {
+	if len(fe.headers) == 0 || headers == nil {
+		return headers, pooled
+	}
+	for key, values := range headers {
+		if !fe.headers.has(key) || len(values) == 0 || &values[0] == &redacted[0] {
+			continue
+		}
+		if !pooled {
+			copied := headerMaps.Get().(map[string][]string)
+			for k, v := range headers {
+				copied[k] = v
+			}
+			headers, pooled = copied, true
+		}
+		encrypted := make([]string, len(values))
+		for i, value := range values {
+			encrypted[i] = fe.encrypt(value)
+		}
+		headers[key] = encrypted
+	}
+	return headers, pooled
+}
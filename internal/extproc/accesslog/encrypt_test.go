@@ -0,0 +1,81 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/fieldcrypt"
+	"github.com/mnixry/envoy-ext-procs/internal/selftest"
+	"github.com/rs/zerolog"
+)
+
+func TestFieldEncryption(t *testing.T) {
+	id, err := fieldcrypt.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe, err := NewFieldEncryption(id.PublicKey(), []string{
+		"client_ip", "remote_ip", "header:x-forwarded-for", "header:Authorization", "header:content-type",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFieldEncryption(id.PublicKey(), []string{"uri"}); err == nil {
+		t.Error("accepted an unknown field")
+	}
+
+	var out bytes.Buffer
+	factory := NewProcessorFactory(&out, zerolog.Nop(), WithFieldEncryption(fe))
+	cases := []selftest.Case{{Name: "http_get", Requests: goldenCases()["http_get"]}}
+	if err := selftest.Run(context.Background(), factory, cases, io.Discard, zerolog.Nop()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var entry struct {
+		Request struct {
+			RemoteIP string              `json:"remote_ip"`
+			ClientIP string              `json:"client_ip"`
+			Headers  map[string][]string `json:"headers"`
+		} `json:"request"`
+		RespHeaders map[string][]string `json:"resp_headers"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid entry %q: %v", out.Bytes(), err)
+	}
+	if strings.Contains(out.String(), "203.0.113.7") || strings.Contains(out.String(), "192.0.2.10") {
+		t.Errorf("entry leaks an encrypted address: %s", out.Bytes())
+	}
+
+	for field, want := range map[string]string{
+		"remote_ip":       "192.0.2.10",
+		"client_ip":       "203.0.113.7",
+		"x-forwarded-for": "203.0.113.7, 10.0.0.1",
+		"content-type":    "text/html",
+	} {
+		token := map[string]string{
+			"remote_ip":       entry.Request.RemoteIP,
+			"client_ip":       entry.Request.ClientIP,
+			"x-forwarded-for": first(entry.Request.Headers["X-Forwarded-For"]),
+			"content-type":    first(entry.RespHeaders["Content-Type"]),
+		}[field]
+		if got, err := id.Decrypt(token); err != nil || got != want {
+			t.Errorf("%s: Decrypt(%q) = %q, %v; want %q", field, token, got, err, want)
+		}
+	}
+	if got := first(entry.Request.Headers["Authorization"]); got != "REDACTED" {
+		t.Errorf("Authorization = %q, want it to stay REDACTED", got)
+	}
+	if got := first(entry.Request.Headers["User-Agent"]); got != "curl/8.5.0" {
+		t.Errorf("User-Agent = %q, want it unencrypted", got)
+	}
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
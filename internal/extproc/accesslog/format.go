@@ -0,0 +1,294 @@
+package accesslog
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/samber/oops"
+)
+
+// Formatter writes finished exchanges to the access log output. The
+// processor hands every entry to its settings' Formatter, so a format is
+// added here, next to the others, without touching the processor.
+type Formatter interface {
+	format(s *settings, e *entry) error
+}
+
+// Formats accepted by NewFormatter.
+const (
+	// FormatJSON writes entries in the selected Schema.
+	FormatJSON = "json"
+	// FormatCLF writes the Common Log Format.
+	FormatCLF = "clf"
+	// FormatCombined writes the Apache Combined Log Format.
+	FormatCombined = "combined"
+	// FormatCustom writes lines of an Apache LogFormat string.
+	FormatCustom = "custom"
+)
+
+// Apache LogFormat strings of the predefined text formats.
+const (
+	LogFormatCLF      = `%h %l %u %t "%r" %>s %b`
+	LogFormatCombined = LogFormatCLF + ` "%{Referer}i" "%{User-Agent}i"`
+)
+
+// NewFormatter returns the formatter of a format name; custom takes an
+// Apache LogFormat string (see ParseLogFormat).
+func NewFormatter(name, logFormat string) (Formatter, error) {
+	switch name {
+	case "", FormatJSON:
+		return jsonFormatter{}, nil
+	case FormatCLF:
+		return ParseLogFormat(LogFormatCLF)
+	case FormatCombined:
+		return ParseLogFormat(LogFormatCombined)
+	case FormatCustom:
+		if logFormat == "" {
+			return nil, oops.
+				In("accesslog").
+				Code(errcode.InvalidFormat).
+				Errorf("the custom access log format needs a log format string")
+		}
+		return ParseLogFormat(logFormat)
+	}
+	return nil, oops.
+		In("accesslog").
+		Code(errcode.InvalidFormat).
+		With("format", name).
+		Errorf("unknown access log format %q (expected json, clf, combined or custom)", name)
+}
+
+// jsonFormatter writes entries in the settings' schema, with the fast
+// encoder if selected and the schema has one.
+type jsonFormatter struct{}
+
+func (jsonFormatter) format(s *settings, e *entry) error {
+	emit := s.schema.emit
+	if s.fast && s.schema.emitFast != nil {
+		emit = s.schema.emitFast
+	}
+	return emit(s.log, e)
+}
+
+// logFormat writes one line per entry from Apache LogFormat directives.
+type logFormat []logPart
+
+// logPart is a literal, or a directive with its {argument}.
+type logPart struct {
+	literal   string
+	directive byte
+	arg       string
+}
+
+// ParseLogFormat parses an Apache LogFormat string. Supported directives:
+//
+//	%%            a literal %
+//	%a            client IP: the first X-Forwarded-For address, else %h
+//	%h            downstream peer address
+//	%l            always -
+//	%u            user of Basic authorization, or -
+//	%t            request start time, [02/Jan/2006:15:04:05 +0000]
+//	%r            request line: method, URI and protocol
+//	%m %U %q %H   method, path, query string with its ? and protocol
+//	%s %>s        response status, 0 if none was received
+//	%b %B         response Content-Length, - or 0 if unknown
+//	%D %T         duration in microseconds and in seconds
+//	%v            forwarded host or authority
+//	%L            Envoy request ID
+//	%{Name}i      request header, after redaction
+//	%{Name}o      response header, after redaction
+//
+// Values are escaped as Apache does: quotes, backslashes and control
+// characters become \", \\ and \xhh, and missing values are written as -.
+func ParseLogFormat(format string) (Formatter, error) {
+	var parts logFormat
+	var literal strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+		i++
+		var arg string
+		if i < len(format) && format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return nil, invalidLogFormat(format, "unterminated {")
+			}
+			arg, i = format[i+1:i+end], i+end+1
+		}
+		if i < len(format) && (format[i] == '>' || format[i] == '<') {
+			i++
+		}
+		if i >= len(format) {
+			return nil, invalidLogFormat(format, "trailing %")
+		}
+		d := format[i]
+		if d == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+		if !strings.ContainsRune("ahlutrmUqHsbBDTvLio", rune(d)) {
+			return nil, invalidLogFormat(format, "unsupported directive %"+string(d))
+		}
+		if (d == 'i' || d == 'o') != (arg != "") {
+			return nil, invalidLogFormat(format, "%{Name} goes with i and o only, which need it")
+		}
+		if literal.Len() > 0 {
+			parts = append(parts, logPart{literal: literal.String()})
+			literal.Reset()
+		}
+		parts = append(parts, logPart{directive: d, arg: headerKey(arg)})
+	}
+	if literal.Len() > 0 {
+		parts = append(parts, logPart{literal: literal.String()})
+	}
+	return parts, nil
+}
+
+func invalidLogFormat(format, reason string) error {
+	return oops.
+		In("accesslog").
+		Code(errcode.InvalidFormat).
+		With("log_format", format).
+		Errorf("invalid access log format string: %s", reason)
+}
+
+var lineBuffers = sync.Pool{
+	New: func() any { b := make([]byte, 0, 256); return &b },
+}
+
+// format writes the entry's line in a single Write, so lines of concurrent
+// streams do not interleave.
+func (f logFormat) format(s *settings, e *entry) error {
+	bp := lineBuffers.Get().(*[]byte)
+	defer lineBuffers.Put(bp)
+	buf := (*bp)[:0]
+	for _, part := range f {
+		if part.directive == 0 {
+			buf = append(buf, part.literal...)
+			continue
+		}
+		buf = part.appendValue(buf, e)
+	}
+	buf = append(buf, '\n')
+	*bp = buf
+	if _, err := s.out.Write(buf); err != nil {
+		return oops.In("accesslog").Code(errcode.WriteFailed).Wrapf(err, "failed to write access log line")
+	}
+	return nil
+}
+
+func (p logPart) appendValue(buf []byte, e *entry) []byte {
+	req := e.request
+	switch p.directive {
+	case 'a':
+		return appendField(buf, extproc.FirstNonEmpty(req.ClientIP, req.RemoteIP))
+	case 'h':
+		return appendField(buf, req.RemoteIP)
+	case 'l':
+		return append(buf, '-')
+	case 'u':
+		return appendField(buf, req.RemoteUser)
+	case 't':
+		buf = append(buf, '[')
+		buf = req.StartTime.UTC().AppendFormat(buf, "02/Jan/2006:15:04:05 -0700")
+		return append(buf, ']')
+	case 'r':
+		buf = appendEscaped(buf, req.Method)
+		buf = append(buf, ' ')
+		buf = appendEscaped(buf, req.URI)
+		buf = append(buf, ' ')
+		return appendEscaped(buf, req.protocol())
+	case 'm':
+		return appendField(buf, req.Method)
+	case 'U':
+		path, _, _ := strings.Cut(req.URI, "?")
+		return appendField(buf, path)
+	case 'q':
+		if _, query, ok := strings.Cut(req.URI, "?"); ok {
+			buf = append(buf, '?')
+			return appendEscaped(buf, query)
+		}
+		return buf
+	case 'H':
+		return appendEscaped(buf, req.protocol())
+	case 's':
+		return strconv.AppendInt(buf, int64(e.response.Status), 10)
+	case 'b':
+		if e.response.Size == nil {
+			return append(buf, '-')
+		}
+		return strconv.AppendUint(buf, *e.response.Size, 10)
+	case 'B':
+		if e.response.Size == nil {
+			return append(buf, '0')
+		}
+		return strconv.AppendUint(buf, *e.response.Size, 10)
+	case 'D':
+		return strconv.AppendInt(buf, e.duration.Microseconds(), 10)
+	case 'T':
+		return strconv.AppendInt(buf, int64(e.duration/time.Second), 10)
+	case 'v':
+		return appendField(buf, req.Host)
+	case 'L':
+		return appendField(buf, req.ID)
+	case 'i':
+		return appendHeader(buf, req.Headers, p.arg)
+	case 'o':
+		return appendHeader(buf, e.response.Headers, p.arg)
+	}
+	return buf
+}
+
+// protocol returns the request's HTTP version, HTTP/1.1 unless Envoy sends
+// the request.protocol attribute.
+func (r *requestInfo) protocol() string {
+	if r.Protocol == "" {
+		return "HTTP/1.1"
+	}
+	return r.Protocol
+}
+
+func appendHeader(buf []byte, headers map[string][]string, name string) []byte {
+	if values := headers[name]; len(values) > 0 {
+		return appendField(buf, values[0])
+	}
+	return append(buf, '-')
+}
+
+// appendField appends an escaped value, or - if it is empty.
+func appendField(buf []byte, s string) []byte {
+	if s == "" {
+		return append(buf, '-')
+	}
+	return appendEscaped(buf, s)
+}
+
+// appendEscaped appends s with quotes, backslashes and control characters
+// escaped, as Apache's mod_log_config does, so values cannot break a line
+// or a quoted field apart.
+func appendEscaped(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			buf = append(buf, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+// Ensure the formats implement Formatter.
+var (
+	_ Formatter = jsonFormatter{}
+	_ Formatter = logFormat(nil)
+)
@@ -0,0 +1,78 @@
+package accesslog
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func formatted(t *testing.T, f Formatter, e *entry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := f.format(&settings{out: &buf, log: zerolog.New(&buf)}, e); err != nil {
+		t.Fatalf("format: %v", err)
+	}
+	return buf.String()
+}
+
+func TestLogFormats(t *testing.T) {
+	entries := testEntries()
+	entries["http"].request.RemoteUser = "alice"
+	entries["http"].request.Protocol = "HTTP/2"
+	for _, tt := range []struct {
+		format, logFormat, entry, want string
+	}{
+		{
+			format: FormatCLF, entry: "http",
+			want: `10.0.0.12 - alice [14/Mar/2025:07:09:26 +0000] "POST /v1/orders?limit=10&q=<a> HTTP/2" 201 1234` + "\n",
+		},
+		{
+			format: FormatCombined, entry: "http",
+			want: `10.0.0.12 - alice [14/Mar/2025:07:09:26 +0000] "POST /v1/orders?limit=10&q=<a> HTTP/2" 201 1234 "https://example.com/" "curl/8.5.0"` + "\n",
+		},
+		{
+			format: FormatCombined, entry: "grpc",
+			want: `- - - [14/Mar/2025:07:09:26 +0000] "POST /pkg.Service/Method HTTP/1.1" 0 - "-" "-"` + "\n",
+		},
+		{
+			format: FormatCustom, logFormat: `%a %v %m %U %q %D %T %B %L 100%% %{authorization}i %{content-type}o`, entry: "http",
+			want: `203.0.113.7 api.example.com POST /v1/orders ?limit=10&q=<a> 13250 0 1234 8c4f1a7e-4b1d-4c6f-9d3e-2f1c0a9b8e7d 100% REDACTED application/json` + "\n",
+		},
+	} {
+		f, err := NewFormatter(tt.format, tt.logFormat)
+		if err != nil {
+			t.Fatalf("NewFormatter(%q, %q): %v", tt.format, tt.logFormat, err)
+		}
+		if got := formatted(t, f, entries[tt.entry]); got != tt.want {
+			t.Errorf("%s %s:\ngot  %q\nwant %q", tt.format, tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestLogFormatEscaping(t *testing.T) {
+	e := testEntries()["http"]
+	e.request.URI = "/a\"b\\c\n"
+	e.request.Headers["User-Agent"] = []string{"evil\x1b[31m"}
+	f, err := ParseLogFormat(`"%U" "%{User-Agent}i"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := formatted(t, f, e), `"/a\"b\\c\x0a" "evil\x1b[31m"`+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseLogFormatErrors(t *testing.T) {
+	for _, format := range []string{"%", "%{Referer", "%z", "%{Referer}s", "%i"} {
+		if _, err := ParseLogFormat(format); err == nil {
+			t.Errorf("ParseLogFormat(%q) succeeded", format)
+		}
+	}
+	if _, err := NewFormatter(FormatCustom, ""); err == nil {
+		t.Error("custom format without a log format string accepted")
+	}
+	if _, err := NewFormatter("xml", ""); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -0,0 +1,49 @@
+package accesslog
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func FuzzClientIPFromXFF(f *testing.F) {
+	for _, seed := range []string{
+		"203.0.113.7", "203.0.113.7, 10.0.0.1", " 2001:db8::1 ,10.0.0.1", "[2001:db8::1]:443",
+		"unknown, 10.0.0.1", ",", "", "1.2.3.4:5:6",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, xff string) {
+		ip, err := clientIPFromXFF(xff)
+		if err == nil && !ip.IsValid() {
+			t.Fatalf("clientIPFromXFF(%q) returned an invalid address without error", xff)
+		}
+	})
+}
+
+// FuzzEmit feeds attacker-controlled request data through every schema and
+// checks that entries stay valid JSON and that the fast encoder agrees with
+// encoding/json.
+func FuzzEmit(f *testing.F) {
+	f.Add("/v1/orders?q=<script>", "api.example.com", "curl/8.5.0", "X-Custom", "value", 200)
+	f.Add("/\x00\xff\"\\", "h ost", "\xc3\x28", "", "\t\n", 503)
+	f.Add("", "", "", "Authorization", "Bearer x", 0)
+	f.Fuzz(func(t *testing.T, uri, host, userAgent, headerName, headerValue string, status int) {
+		e := testEntries()["http"]
+		e.request.URI, e.request.Host = uri, host
+		e.request.Headers = map[string][]string{
+			"User-Agent":                        {userAgent},
+			http.CanonicalHeaderKey(headerName): {headerValue},
+		}
+		e.response.Status = status
+		for _, schema := range schemas {
+			want := emitted(t, schema.emit, e)
+			if schema.emitFast == nil {
+				continue
+			}
+			if got := emitted(t, schema.emitFast, e); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: fast encoder differs:\n fast %v\n json %v", schema.Name, got, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,217 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/selftest"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// volatile are fields holding times and durations, replaced before
+// comparison. A null stays null, so a field that stops being measured is
+// still caught.
+var volatile = map[string]bool{
+	"@timestamp":           true,
+	"timestamp":            true,
+	"start_time":           true,
+	"resp_start_time":      true,
+	"duration":             true,
+	"duration_ms":          true,
+	"request_body_ms":      true,
+	"upstream_ms":          true,
+	"response_body_ms":     true,
+	"header_processing_ms": true,
+	"body_processing_ms":   true,
+	"processing_ms":        true,
+}
+
+// goldenCases are canned ext_proc exchanges, one stream each.
+func goldenCases() map[string][]*selftest.Request {
+	return map[string][]*selftest.Request{
+		"http_get": {
+			headersMessage(true, "get-1", true,
+				":method", "GET", ":path", "/index.html?q=go", ":authority", "www.example.com", ":scheme", "https",
+				"x-forwarded-for", "203.0.113.7, 10.0.0.1", "x-forwarded-proto", "https",
+				"user-agent", "curl/8.5.0", "referer", "https://example.com/",
+				"authorization", "Bearer secret", "cookie", "session=secret"),
+			headersMessage(false, "get-1", true,
+				":status", "200", "content-type", "text/html", "content-length", "512", "set-cookie", "session=secret"),
+		},
+		"http_post_error": {
+			headersMessage(true, "post-1", false,
+				":method", "POST", ":path", "/v1/orders", ":authority", "api.example.com", ":scheme", "http",
+				"content-type", "application/json", "content-length", "13"),
+			bodyMessage(true, []byte(`{"qty": 1024}`), true),
+			headersMessage(false, "post-1", false, ":status", "503", "content-length", "19"),
+			bodyMessage(false, []byte("upstream overloaded"), true),
+		},
+		"grpc": {
+			headersMessage(true, "grpc-1", false,
+				":method", "POST", ":path", "/helloworld.Greeter/SayHello", ":authority", "grpc.example.com",
+				":scheme", "http", "content-type", "application/grpc", "te", "trailers"),
+			bodyMessage(true, grpcFrame(0, []byte("hello")), true),
+			headersMessage(false, "grpc-1", false, ":status", "200", "content-type", "application/grpc"),
+			bodyMessage(false, grpcFrame(0, []byte("world")), false),
+			trailersMessage("grpc-status", "13", "grpc-message", "internal%20error"),
+		},
+		"grpc_trailers_only": {
+			headersMessage(true, "grpc-2", true,
+				":method", "POST", ":path", "/helloworld.Greeter/SayHello", ":authority", "grpc.example.com",
+				"content-type", "application/grpc"),
+			headersMessage(false, "grpc-2", true,
+				":status", "200", "content-type", "application/grpc", "grpc-status", "5", "grpc-message", "not found"),
+		},
+		"grpc_web": {
+			headersMessage(true, "grpc-web-1", true,
+				":method", "POST", ":path", "/helloworld.Greeter/SayHello", ":authority", "web.example.com",
+				"content-type", "application/grpc-web+proto"),
+			headersMessage(false, "grpc-web-1", false, ":status", "200", "content-type", "application/grpc-web+proto"),
+			bodyMessage(false, append(grpcFrame(0, []byte("world")), grpcFrame(0x80, []byte("grpc-status:0\r\n"))...), true),
+		},
+	}
+}
+
+func TestGoldenEntries(t *testing.T) {
+	for name, requests := range goldenCases() {
+		for _, schema := range schemas {
+			// The json encoder writes the golden file; the fast one must
+			// match it.
+			encoders := []string{"json"}
+			if schema.emitFast != nil {
+				encoders = append(encoders, "fast")
+			}
+			path := filepath.Join("testdata", "golden", name+"."+schema.Name+".json")
+			for _, encoder := range encoders {
+				opts := []Option{WithSchema(schema), WithGRPCMessageCounts()}
+				if encoder == "fast" {
+					opts = append(opts, WithFastEncoder())
+				}
+				t.Run(name+"/"+schema.Name+"/"+encoder, func(t *testing.T) {
+					var out bytes.Buffer
+					factory := NewProcessorFactory(&out, zerolog.Nop(), opts...)
+					cases := []selftest.Case{{Name: name, Requests: requests}}
+					if err := selftest.Run(context.Background(), factory, cases, io.Discard, zerolog.Nop()); err != nil {
+						t.Fatalf("run: %v", err)
+					}
+					got := normalize(t, out.Bytes())
+					if *update && encoder == "json" {
+						if err := os.WriteFile(path, got, 0o644); err != nil {
+							t.Fatal(err)
+						}
+						return
+					}
+					want, err := os.ReadFile(path)
+					if err != nil {
+						t.Fatalf("read golden (run with -update to create it): %v", err)
+					}
+					if !bytes.Equal(got, want) {
+						t.Errorf("%s mismatch (run with -update to accept):\ngot:\n%s\nwant:\n%s", path, got, want)
+					}
+				})
+			}
+		}
+	}
+}
+
+// normalize decodes the emitted entries, replaces volatile fields and
+// re-encodes them indented with sorted keys.
+func normalize(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var entries []any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var entry any
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("invalid entry in %q: %v", data, err)
+		}
+		entries = append(entries, scrub(entry))
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(entries); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func scrub(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if volatile[key] && value != nil {
+				v[key] = "<volatile>"
+			} else {
+				v[key] = scrub(value)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = scrub(v[i])
+		}
+	}
+	return v
+}
+
+func headersMessage(request bool, id string, endOfStream bool, kv ...string) *selftest.Request {
+	headers := make([]*envoy_api_v3_core.HeaderValue, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		headers = append(headers, &envoy_api_v3_core.HeaderValue{Key: kv[i], RawValue: []byte(kv[i+1])})
+	}
+	msg := &envoy_service_proc_v3.HttpHeaders{
+		Headers:     &envoy_api_v3_core.HeaderMap{Headers: headers},
+		EndOfStream: endOfStream,
+	}
+	attrs := map[string]*structpb.Value{"request.id": structpb.NewStringValue(id)}
+	req := &selftest.Request{}
+	if request {
+		attrs["source.address"] = structpb.NewStringValue("192.0.2.10:40000")
+		req.Request = &envoy_service_proc_v3.ProcessingRequest_RequestHeaders{RequestHeaders: msg}
+	} else {
+		req.Request = &envoy_service_proc_v3.ProcessingRequest_ResponseHeaders{ResponseHeaders: msg}
+	}
+	req.Attributes = map[string]*structpb.Struct{extproc.EnvoyAttributesKey: {Fields: attrs}}
+	return req
+}
+
+func bodyMessage(request bool, body []byte, endOfStream bool) *selftest.Request {
+	msg := &envoy_service_proc_v3.HttpBody{Body: body, EndOfStream: endOfStream}
+	if request {
+		return &selftest.Request{Request: &envoy_service_proc_v3.ProcessingRequest_RequestBody{RequestBody: msg}}
+	}
+	return &selftest.Request{Request: &envoy_service_proc_v3.ProcessingRequest_ResponseBody{ResponseBody: msg}}
+}
+
+func trailersMessage(kv ...string) *selftest.Request {
+	trailers := make([]*envoy_api_v3_core.HeaderValue, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		trailers = append(trailers, &envoy_api_v3_core.HeaderValue{Key: kv[i], RawValue: []byte(kv[i+1])})
+	}
+	return &selftest.Request{Request: &envoy_service_proc_v3.ProcessingRequest_ResponseTrailers{
+		ResponseTrailers: &envoy_service_proc_v3.HttpTrailers{Trailers: &envoy_api_v3_core.HeaderMap{Headers: trailers}},
+	}}
+}
+
+// grpcFrame is a length-prefixed gRPC message; flags 0x80 marks a gRPC-Web
+// trailers frame.
+func grpcFrame(flags byte, payload []byte) []byte {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
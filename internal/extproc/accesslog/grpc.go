@@ -0,0 +1,163 @@
+package accesslog
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// grpcStatusNames maps gRPC status codes to their canonical names.
+var grpcStatusNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED",
+	"NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+// grpcInfo is the grpc section of an access log entry.
+type grpcInfo struct {
+	Service          string `json:"service"`
+	Method           string `json:"method"`
+	Web              bool   `json:"web,omitempty"`
+	Status           *int   `json:"status"`
+	StatusName       string `json:"status_name,omitempty"`
+	Message          string `json:"message,omitempty"`
+	RequestMessages  *int   `json:"request_messages,omitempty"`
+	ResponseMessages *int   `json:"response_messages,omitempty"`
+}
+
+// serverError reports whether the status indicates a server-side failure.
+func (g *grpcInfo) serverError() bool {
+	if g == nil || g.Status == nil {
+		return false
+	}
+	switch *g.Status {
+	case 2, 4, 12, 13, 14, 15: // UNKNOWN, DEADLINE_EXCEEDED, UNIMPLEMENTED, INTERNAL, UNAVAILABLE, DATA_LOSS
+		return true
+	}
+	return false
+}
+
+// isGRPC reports whether a content type is gRPC or gRPC-Web.
+func isGRPC(contentType string) (grpc, web bool) {
+	ct := strings.ToLower(contentType)
+	switch {
+	case strings.HasPrefix(ct, "application/grpc-web-text"):
+		// Base64-encoded frames are not parsed; the status is only known
+		// for trailers-only responses.
+		return true, false
+	case strings.HasPrefix(ct, "application/grpc-web"):
+		return true, true
+	case ct == "application/grpc", strings.HasPrefix(ct, "application/grpc+"), strings.HasPrefix(ct, "application/grpc;"):
+		return true, false
+	}
+	return false, false
+}
+
+// newGRPCInfo splits a gRPC :path of the form /package.Service/Method.
+func newGRPCInfo(path string, web bool) *grpcInfo {
+	service, method, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return &grpcInfo{Service: service, Method: method, Web: web}
+}
+
+// setStatus records grpc-status and grpc-message from headers or trailers.
+// It reports whether a status was present.
+func (g *grpcInfo) setStatus(h http.Header) bool {
+	raw := h.Get("grpc-status")
+	if raw == "" {
+		return false
+	}
+	code, err := strconv.Atoi(raw)
+	if err != nil {
+		return false
+	}
+	g.Status = &code
+	if code >= 0 && code < len(grpcStatusNames) {
+		g.StatusName = grpcStatusNames[code]
+	}
+	g.Message = decodeGRPCMessage(h.Get("grpc-message"))
+	return true
+}
+
+// decodeGRPCMessage undoes the percent-encoding of grpc-message.
+func decodeGRPCMessage(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// frameCounter counts length-prefixed gRPC messages across body chunks. For
+// gRPC-Web it also captures the trailers frame.
+type frameCounter struct {
+	count int
+	// header buffers a partially received 5-byte frame header.
+	header []byte
+	// remaining is the number of payload bytes left in the current frame.
+	remaining uint32
+	// trailer collects the payload of a gRPC-Web trailers frame.
+	trailer    []byte
+	inTrailer  bool
+	inTrailers bool
+}
+
+const grpcTrailerFlag = 0x80
+
+func (c *frameCounter) write(chunk []byte) {
+	for len(chunk) > 0 {
+		if c.remaining > 0 {
+			n := min(uint32(len(chunk)), c.remaining)
+			if c.inTrailer {
+				c.trailer = append(c.trailer, chunk[:n]...)
+			}
+			c.remaining -= n
+			chunk = chunk[n:]
+			continue
+		}
+
+		need := 5 - len(c.header)
+		if len(chunk) < need {
+			c.header = append(c.header, chunk...)
+			return
+		}
+		c.header = append(c.header, chunk[:need]...)
+		chunk = chunk[need:]
+		c.inTrailer = c.header[0]&grpcTrailerFlag != 0
+		if c.inTrailer {
+			c.inTrailers = true
+		} else {
+			c.count++
+		}
+		c.remaining = binary.BigEndian.Uint32(c.header[1:])
+		c.header = c.header[:0]
+	}
+}
+
+// trailers parses a gRPC-Web trailers frame, which carries HTTP/1-style
+// header lines.
+func (c *frameCounter) trailers() http.Header {
+	if !c.inTrailers {
+		return nil
+	}
+	h := make(http.Header)
+	for _, line := range strings.Split(string(c.trailer), "\n") {
+		name, value, ok := strings.Cut(strings.TrimRight(line, "\r"), ":")
+		if ok {
+			h.Add(textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)), strings.TrimSpace(value))
+		}
+	}
+	return h
+}
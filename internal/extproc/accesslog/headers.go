@@ -0,0 +1,82 @@
+package accesslog
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// redacted is the logged value of excluded headers. It is shared by every
+// entry and must not be modified.
+var redacted = []string{"REDACTED"}
+
+// headerMaps recycles the redacted copies of header maps.
+var headerMaps = sync.Pool{
+	New: func() any { return make(map[string][]string, 32) },
+}
+
+// headerSet is a set of header names in the form ext_proc headers are keyed
+// by: canonical, or lowercase for pseudo-headers.
+type headerSet map[string]struct{}
+
+func newHeaderSet(lists ...[]string) headerSet {
+	set := make(headerSet)
+	for _, names := range lists {
+		for _, name := range names {
+			set[headerKey(name)] = struct{}{}
+		}
+	}
+	return set
+}
+
+// headerKey canonicalizes name; it does not allocate for names that are
+// already canonical.
+func headerKey(name string) string {
+	if strings.HasPrefix(name, ":") {
+		return strings.ToLower(name)
+	}
+	return http.CanonicalHeaderKey(name)
+}
+
+func (set headerSet) has(key string) bool {
+	_, ok := set[key]
+	return ok
+}
+
+// redactHeaders returns the headers to log for s. Unless a header is
+// excluded or not canonical, that is headers itself, which the caller must
+// not modify; otherwise it is a pooled copy, reported by pooled, that
+// releaseHeaders recycles once the entry is written.
+func redactHeaders(s *settings, headers http.Header) (out map[string][]string, pooled bool) {
+	if s.omitHeaders {
+		return nil, false
+	}
+	clean := true
+	for key := range headers {
+		if k := headerKey(key); k != key || s.redact.has(k) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return headers, false
+	}
+	out = headerMaps.Get().(map[string][]string)
+	for key, values := range headers {
+		key = headerKey(key)
+		if s.redact.has(key) {
+			out[key] = redacted
+		} else {
+			out[key] = values
+		}
+	}
+	return out, true
+}
+
+// releaseHeaders recycles a map returned by redactHeaders.
+func releaseHeaders(headers map[string][]string, pooled bool) {
+	if pooled {
+		clear(headers)
+		headerMaps.Put(headers)
+	}
+}
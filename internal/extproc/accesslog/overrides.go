@@ -0,0 +1,356 @@
+package accesslog
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/logsink"
+	"github.com/mnixry/envoy-ext-procs/internal/match"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+)
+
+// OverrideRules is the per-host/per-route override file.
+type OverrideRules struct {
+	Overrides []OverrideRule `yaml:"overrides"`
+}
+
+// OverrideRule changes the access log settings of matching requests. The
+// first matching rule wins; unset fields keep the command-line settings.
+type OverrideRule struct {
+	// Hosts match the request host, ignoring the port; "*.example.com"
+	// matches subdomains. Empty matches every host.
+	Hosts []string `yaml:"hosts,omitempty"`
+	// Routes match the stream's route metadata value (--grpc-route-key).
+	// Empty matches every route.
+	Routes []string `yaml:"routes,omitempty"`
+	// Schema selects the field set, e.g. "ecs".
+	Schema string `yaml:"schema,omitempty"`
+	// Output sends entries to another sink, opened with the command-line
+	// output settings: "stdout", "stderr" or a file path.
+	Output string `yaml:"output,omitempty"`
+	// AnonymizeIPs truncates the IP addresses written to Output; unset
+	// follows --output-anonymize-ips.
+	AnonymizeIPs *bool `yaml:"anonymize_ips,omitempty"`
+	// SampleRate logs this fraction of requests, from 0 to 1.
+	SampleRate *float64 `yaml:"sample_rate,omitempty"`
+	// ExcludeHeaders are redacted in addition to the default set.
+	ExcludeHeaders []string `yaml:"exclude_headers,omitempty"`
+	// OmitHeaders drops the header maps entirely.
+	OmitHeaders bool `yaml:"omit_headers,omitempty"`
+	// Match adds request conditions (see package match), e.g. paths,
+	// headers or client IP ranges.
+	Match *match.Spec `yaml:"match,omitempty"`
+
+	hosts, matcher *match.Matcher
+}
+
+// ParseOverrideRules parses and validates an override file.
+func ParseOverrideRules(data []byte) (*OverrideRules, error) {
+	var rules OverrideRules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, oops.
+			In("accesslog").
+			Code(errcode.ParseOverridesFailed).
+			Wrapf(err, "failed to parse access log overrides")
+	}
+	for i, r := range rules.Overrides {
+		if len(r.Hosts) == 0 && len(r.Routes) == 0 && r.Match == nil {
+			return nil, oops.
+				In("accesslog").
+				Code(errcode.InvalidOverrides).
+				With("index", i).
+				Errorf("override needs hosts, routes or match")
+		}
+		hosts, err := match.Compile(match.Spec{Hosts: r.Hosts})
+		if err != nil {
+			return nil, oops.In("accesslog").Code(errcode.InvalidOverrides).With("index", i).Wrap(err)
+		}
+		rules.Overrides[i].hosts = hosts
+		if r.Match != nil {
+			matcher, err := match.Compile(*r.Match)
+			if err != nil {
+				return nil, oops.In("accesslog").Code(errcode.InvalidOverrides).With("index", i).Wrap(err)
+			}
+			rules.Overrides[i].matcher = matcher
+		}
+		if r.Schema != "" {
+			if _, err := LookupSchema(r.Schema); err != nil {
+				return nil, oops.In("accesslog").With("index", i).Wrap(err)
+			}
+		}
+		if r.AnonymizeIPs != nil && r.Output == "" {
+			return nil, oops.
+				In("accesslog").
+				Code(errcode.InvalidOverrides).
+				With("index", i).
+				Errorf("anonymize_ips needs output")
+		}
+		if r.SampleRate != nil && (*r.SampleRate < 0 || *r.SampleRate > 1) {
+			return nil, oops.
+				In("accesslog").
+				Code(errcode.InvalidOverrides).
+				With("index", i).
+				With("sample_rate", *r.SampleRate).
+				Errorf("sample_rate must be between 0 and 1")
+		}
+	}
+	return &rules, nil
+}
+
+// settings are the effective access log settings of a request.
+type settings struct {
+	// out is the sink; log writes JSON entries to it.
+	out       io.Writer
+	log       zerolog.Logger
+	formatter Formatter
+	schema    *Schema
+	fast      bool
+	// excludeHeaders are the command-line exclusions; redact adds the
+	// override's and is what entries are checked against.
+	excludeHeaders []string
+	redact         headerSet
+	omitHeaders    bool
+	sampleRate     float64
+}
+
+// sampled reports whether a request should be logged.
+func (s *settings) sampled() bool {
+	return s.sampleRate >= 1 || rand.Float64() < s.sampleRate
+}
+
+// override is a compiled OverrideRule.
+type override struct {
+	hosts          *match.Matcher
+	matcher        *match.Matcher
+	routes         []string
+	schema         *Schema
+	out            io.Writer
+	sampleRate     *float64
+	excludeHeaders []string
+	omitHeaders    bool
+
+	// applied caches the settings derived from each base, one per
+	// factory sharing the overrides.
+	applied sync.Map
+}
+
+func (o *override) matches(req match.Request, route string) bool {
+	if len(o.routes) > 0 && !slices.ContainsFunc(o.routes, func(r string) bool { return strings.EqualFold(r, route) }) {
+		return false
+	}
+	return o.hosts.Match(req) && o.matcher.Match(req)
+}
+
+// apply returns base with the rule's fields set. The result is computed
+// once per base, keeping per-request lookups allocation-free.
+func (o *override) apply(base *settings) *settings {
+	if s, ok := o.applied.Load(base); ok {
+		return s.(*settings)
+	}
+	s := *base
+	if o.schema != nil {
+		s.schema = o.schema
+	}
+	if o.out != nil {
+		s.out, s.log = o.out, zerolog.New(o.out)
+	}
+	if o.sampleRate != nil {
+		s.sampleRate = *o.sampleRate
+	}
+	s.redact = newHeaderSet(base.excludeHeaders, o.excludeHeaders)
+	s.omitHeaders = s.omitHeaders || o.omitHeaders
+	o.applied.Store(base, &s)
+	return &s
+}
+
+// Overrides holds the rules loaded from a YAML file and reloads them when
+// the file's mtime changes, checking at most once per reload interval. A
+// ConfigMap/Secret reference is watched through the API server instead.
+type Overrides struct {
+	path     string
+	interval time.Duration
+	sinkCfg  logsink.Config
+	log      zerolog.Logger
+	watched  bool
+	stop     context.CancelFunc
+
+	mu        sync.Mutex
+	modTime   time.Time
+	overrides atomic.Pointer[[]*override]
+	lastCheck atomic.Int64
+	// sinks are kept open for the process lifetime, since streams started
+	// before a reload may still write to them.
+	sinks map[string]io.WriteCloser
+}
+
+// NewOverrides loads the override file at path. Outputs are opened with
+// sinkCfg, replacing its Output.
+func NewOverrides(path string, interval time.Duration, sinkCfg logsink.Config, log zerolog.Logger) (*Overrides, error) {
+	o := &Overrides{
+		path:     path,
+		interval: interval,
+		sinkCfg:  sinkCfg,
+		log:      log.With().Str("component", "accesslog_overrides").Logger(),
+		sinks:    make(map[string]io.WriteCloser),
+		watched:  kube.IsRef(path),
+		stop:     func() {},
+	}
+	if !o.watched {
+		if err := o.reload(); err != nil {
+			return nil, err
+		}
+		return o, nil
+	}
+	data, err := kube.ReadFile(context.Background(), path)
+	if err != nil {
+		return nil, oops.In("accesslog").Code(errcode.ReadConfigFailed).With("path", path).Wrapf(err, "failed to read access log overrides")
+	}
+	if err := o.apply(data, time.Time{}); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	o.stop = cancel
+	go kube.WatchFile(ctx, path, o.log, func(data []byte) {
+		if err := o.apply(data, time.Time{}); err != nil {
+			o.log.Error().Err(err).Msg("failed to reload access log overrides, keeping previous")
+		}
+	})
+	return o, nil
+}
+
+// reload reads and compiles the file. On error the previous rules stay.
+func (o *Overrides) reload() error {
+	info, err := os.Stat(o.path)
+	if err != nil {
+		return oops.In("accesslog").Code(errcode.ReadConfigFailed).With("path", o.path).Wrapf(err, "failed to stat access log overrides")
+	}
+	data, err := os.ReadFile(o.path)
+	if err != nil {
+		return oops.In("accesslog").Code(errcode.ReadConfigFailed).With("path", o.path).Wrapf(err, "failed to read access log overrides")
+	}
+	return o.apply(data, info.ModTime())
+}
+
+// apply compiles data and swaps it in. On error the previous rules stay.
+func (o *Overrides) apply(data []byte, modTime time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	rules, err := ParseOverrideRules(data)
+	if err != nil {
+		return oops.With("path", o.path).Wrap(err)
+	}
+
+	compiled := make([]*override, 0, len(rules.Overrides))
+	for _, r := range rules.Overrides {
+		ov := &override{
+			hosts:          r.hosts,
+			matcher:        r.matcher,
+			routes:         r.Routes,
+			sampleRate:     r.SampleRate,
+			excludeHeaders: r.ExcludeHeaders,
+			omitHeaders:    r.OmitHeaders,
+		}
+		if r.Schema != "" {
+			ov.schema, _ = LookupSchema(r.Schema)
+		}
+		if r.Output != "" {
+			w, err := o.sink(r.Output, r.AnonymizeIPs)
+			if err != nil {
+				return err
+			}
+			ov.out = w
+		}
+		compiled = append(compiled, ov)
+	}
+	o.overrides.Store(&compiled)
+	o.modTime = modTime
+	audit.Record("accesslog-overrides", audit.File(o.path), data)
+	o.log.Info().Str("path", o.path).Int("overrides", len(compiled)).Msg("access log overrides loaded")
+	return nil
+}
+
+// sink returns the writer for output, opening it once; entries of rules
+// anonymizing and not anonymizing it share the file. The caller holds o.mu.
+func (o *Overrides) sink(output string, anonymize *bool) (io.Writer, error) {
+	cfg := o.sinkCfg
+	anonymized := cfg.AnonymizeIPs
+	if anonymize != nil {
+		anonymized = *anonymize
+	}
+	w, ok := o.sinks[output]
+	if !ok {
+		cfg.Output = output
+		cfg.AnonymizeIPs = false
+		var err error
+		if w, err = logsink.Open(cfg); err != nil {
+			return nil, err
+		}
+		o.sinks[output] = w
+	}
+	if anonymized {
+		return logsink.Anonymize(w, cfg.Anonymizer), nil
+	}
+	return w, nil
+}
+
+// maybeReload reloads the file if its mtime changed since the last load.
+func (o *Overrides) maybeReload() {
+	if o.watched {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := o.lastCheck.Load()
+	if now-last < int64(o.interval) || !o.lastCheck.CompareAndSwap(last, now) {
+		return
+	}
+	info, err := os.Stat(o.path)
+	if err != nil {
+		o.log.Warn().Err(err).Msg("failed to stat access log overrides")
+		return
+	}
+	o.mu.Lock()
+	changed := info.ModTime().After(o.modTime)
+	o.mu.Unlock()
+	if !changed {
+		return
+	}
+	if err := o.reload(); err != nil {
+		o.log.Error().Err(err).Msg("failed to reload access log overrides, keeping previous")
+	}
+}
+
+// lookup returns the first matching rule, or nil.
+func (o *Overrides) lookup(req match.Request, route string) *override {
+	o.maybeReload()
+	for _, ov := range *o.overrides.Load() {
+		if ov.matches(req, route) {
+			return ov
+		}
+	}
+	return nil
+}
+
+// Close stops watching and closes the override sinks.
+func (o *Overrides) Close() error {
+	o.stop()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var errs []error
+	for _, w := range o.sinks {
+		errs = append(errs, w.Close())
+	}
+	return oops.In("accesslog").Wrap(oops.Join(errs...))
+}
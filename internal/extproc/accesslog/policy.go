@@ -0,0 +1,50 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// PolicySettings are the access log settings of an ExtProcPolicy.
+type PolicySettings struct {
+	// ExcludeHeaders are added to the processor's excluded headers.
+	ExcludeHeaders []string `json:"excludeHeaders,omitempty"`
+	// Schema replaces the field set.
+	Schema string `json:"schema,omitempty"`
+	// CountGRPCMessages logs gRPC message counts.
+	CountGRPCMessages bool `json:"countGRPCMessages,omitempty"`
+}
+
+// PolicyOptions decodes ExtProcPolicy settings into options, applied after
+// the processor's own.
+func PolicyOptions(settings json.RawMessage) ([]Option, error) {
+	var s PolicySettings
+	if len(settings) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(settings))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&s); err != nil {
+			return nil, oops.
+				In("accesslog").
+				Code(errcode.InvalidPolicy).
+				Wrapf(err, "failed to decode access log policy settings")
+		}
+	}
+	var opts []Option
+	if len(s.ExcludeHeaders) > 0 {
+		opts = append(opts, WithExcludeHeaders(s.ExcludeHeaders...))
+	}
+	if s.Schema != "" {
+		schema, err := LookupSchema(s.Schema)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithSchema(schema))
+	}
+	if s.CountGRPCMessages {
+		opts = append(opts, WithGRPCMessageCounts())
+	}
+	return opts, nil
+}
@@ -1,18 +1,22 @@
 package accesslog
 
 import (
-	"encoding/json"
 	"io"
 	"net/http"
-	"slices"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+
 	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
 	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/match"
 	"github.com/rs/zerolog"
-	"github.com/samber/oops"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 var sensitiveHeaders = []string{
@@ -23,9 +27,21 @@ var sensitiveHeaders = []string{
 }
 
 type ProcessorFactory struct {
-	accessLog      zerolog.Logger
+	out            io.Writer
+	formatter      Formatter
 	errLog         zerolog.Logger
 	excludeHeaders []string
+	paths          extproc.PathTemplater
+	countMessages  bool
+	responseEnd    bool
+	schema         *Schema
+	fast           bool
+	overrides      *Overrides
+	routeKey       string
+	clock          clock.Clock
+	encryption     *FieldEncryption
+	// base is the settings of requests no override matches.
+	base *settings
 }
 
 type Option func(*ProcessorFactory)
@@ -36,18 +52,109 @@ func WithExcludeHeaders(headers ...string) Option {
 	}
 }
 
+// WithPathTemplater adds a "route" field holding the templated request path.
+func WithPathTemplater(paths extproc.PathTemplater) Option {
+	return func(f *ProcessorFactory) {
+		f.paths = paths
+	}
+}
+
+// WithGRPCMessageCounts streams gRPC bodies to the processor to count
+// request and response messages.
+func WithGRPCMessageCounts() Option {
+	return func(f *ProcessorFactory) {
+		f.countMessages = true
+	}
+}
+
+// WithResponseEnd streams response bodies to the processor and writes
+// entries at the end of the response rather than at its headers, so the
+// duration covers the body and a response reset mid-body is flagged
+// FlagUpstreamReset. Without it such responses are logged as complete.
+func WithResponseEnd() Option {
+	return func(f *ProcessorFactory) {
+		f.responseEnd = true
+	}
+}
+
+// WithSchema selects the field set of entries; the default is SchemaCaddy.
+func WithSchema(schema *Schema) Option {
+	return func(f *ProcessorFactory) {
+		f.schema = schema
+	}
+}
+
+// WithFastEncoder writes entries with an encoder that skips encoding/json
+// and reflection, for schemas that have one (all but ecs). Entries are the
+// same except that strings are not HTML-escaped.
+func WithFastEncoder() Option {
+	return func(f *ProcessorFactory) {
+		f.fast = true
+	}
+}
+
+// WithFormatter selects the entry format; the default writes JSON in the
+// selected schema.
+func WithFormatter(formatter Formatter) Option {
+	return func(f *ProcessorFactory) {
+		f.formatter = formatter
+	}
+}
+
+// WithClock sets the clock request times and durations are read from.
+func WithClock(c clock.Clock) Option {
+	return func(f *ProcessorFactory) {
+		f.clock = clock.Or(c)
+	}
+}
+
+// WithOverrides applies per-host/per-route overrides. Route rules match the
+// stream metadata value of routeKey.
+func WithOverrides(overrides *Overrides, routeKey string) Option {
+	return func(f *ProcessorFactory) {
+		f.overrides = overrides
+		f.routeKey = routeKey
+	}
+}
+
 func NewProcessorFactory(writer io.Writer, log zerolog.Logger, opts ...Option) *ProcessorFactory {
 	f := &ProcessorFactory{
-		accessLog:      zerolog.New(writer),
+		out:            writer,
+		formatter:      jsonFormatter{},
 		errLog:         log.With().Str("processor", "accesslog").Logger(),
 		excludeHeaders: append([]string(nil), sensitiveHeaders...),
+		schema:         SchemaCaddy,
+		clock:          clock.Real,
 	}
 	for _, opt := range opts {
 		opt(f)
 	}
+	f.base = &settings{
+		out:            f.out,
+		log:            zerolog.New(f.out),
+		formatter:      f.formatter,
+		schema:         f.schema,
+		fast:           f.fast,
+		excludeHeaders: f.excludeHeaders,
+		redact:         newHeaderSet(f.excludeHeaders),
+		sampleRate:     1,
+	}
+	if f.routeKey == "" {
+		f.routeKey = extproc.MetadataAuthority
+	}
 	return f
 }
 
+// settingsFor returns the settings of req on route.
+func (f *ProcessorFactory) settingsFor(req match.Request, route string) *settings {
+	if f.overrides != nil {
+		if ov := f.overrides.lookup(req, route); ov != nil {
+			return ov.apply(f.base)
+		}
+	}
+	return f.base
+}
+
 // NewProcessor creates a new access log processor for a single request.
 func (f *ProcessorFactory) NewProcessor() extproc.Processor {
 	records, err := lru.New[string, *requestInfo](1000)
@@ -58,7 +165,25 @@ func (f *ProcessorFactory) NewProcessor() extproc.Processor {
 	return &Processor{
 		factory: f,
 		records: records,
+		timing:  timings{clock: f.clock},
+	}
+}
+
+// NewStreamProcessor creates a processor that matches route overrides
+// against the stream's route metadata.
+func (f *ProcessorFactory) NewStreamProcessor(info extproc.StreamInfo) extproc.Processor {
+	p := f.NewProcessor()
+	if processor, ok := p.(*Processor); ok {
+		processor.route = info.Get(f.routeKey)
 	}
+	return p
+}
+
+// clientIPFromXFF returns the first, client-supplied address of an
+// X-Forwarded-For header.
+func clientIPFromXFF(xff string) (netip.Addr, error) {
+	first, _, _ := strings.Cut(xff, ",")
+	return extproc.ParseIPFromAddress(strings.TrimSpace(first))
 }
 
 type requestInfo struct {
@@ -69,25 +194,76 @@ type requestInfo struct {
 	Method    string              `json:"method"`
 	Host      string              `json:"host"`
 	URI       string              `json:"uri"`
+	Route     string              `json:"route,omitempty"`
 	Headers   map[string][]string `json:"headers,omitempty"`
 	StartTime time.Time           `json:"start_time"`
 	Size      *uint64             `json:"size"`
+	// RemoteUser is the user of Basic authorization and Protocol the
+	// request.protocol attribute; only text formats write them.
+	RemoteUser string `json:"-"`
+	Protocol   string `json:"-"`
+
+	settings      *settings
+	pooledHeaders bool
 }
 
+// Response flags mark entries of exchanges whose stream ended early.
+const (
+	// FlagClientAbort marks a request whose stream ended before the
+	// response headers. Envoy answers upstream failures before the headers
+	// itself, so this is the client going away.
+	FlagClientAbort = "client_abort"
+	// FlagUpstreamReset marks a gRPC exchange whose stream ended after the
+	// response headers but before its status.
+	FlagUpstreamReset = "upstream_reset"
+)
+
 type responseInfo struct {
 	Headers map[string][]string `json:"headers,omitempty"`
 	Size    *uint64             `json:"size"`
 	Status  int                 `json:"status"`
+	// Flags is FlagClientAbort, FlagUpstreamReset or empty.
+	Flags string `json:"-"`
+
+	pooledHeaders bool
 }
 
 type Processor struct {
 	extproc.BaseProcessor
 	factory *ProcessorFactory
 	records *lru.Cache[string, *requestInfo]
+	// route is the stream's route metadata value.
+	route string
+
+	mu sync.Mutex
+	// skipped is set when the request was not sampled.
+	skipped bool
+	// grpc is set for gRPC requests, whose entries are emitted once the
+	// status is known from the trailers.
+	grpc *grpcInfo
+	// pending is the entry of a response whose end has not arrived yet.
+	pending               *pendingLog
+	reqFrames, respFrames frameCounter
+	timing                timings
+	// open is the request whose response headers have not arrived yet.
+	open *requestInfo
+}
+
+// pendingLog is an exchange waiting for its gRPC status or the end of its
+// response body.
+type pendingLog struct {
+	request  *requestInfo
+	response *responseInfo
+	attrs    map[string]*structpb.Struct
 }
 
 // ProcessRequestHeaders captures request metadata for logging.
 func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	// Durations are measured from the request's arrival, not from when the
+	// processor was created, which may be much earlier.
+	received := p.factory.clock.Now()
+	defer p.trackHeaders(received)
+
 	requestID := ctx.GetRequestID()
 	if requestID == "" {
 		p.factory.errLog.Warn().Msg("request ID not found")
@@ -95,7 +271,8 @@ func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.
 	}
 
 	var remoteIP string
-	if ip, err := ctx.GetDownstreamRemoteIP(); err == nil {
+	ip, err := ctx.GetDownstreamRemoteIP()
+	if err == nil {
 		remoteIP = ip.String()
 	} else {
 		p.factory.errLog.Warn().Err(err).Msg("failed to get downstream remote IP")
@@ -103,24 +280,52 @@ func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.
 
 	var clientIP string
 	if xff := ctx.Headers.Get("x-forwarded-for"); xff != "" {
-		first, _, _ := strings.Cut(xff, ",")
-		if ip, err := extproc.ParseIPFromAddress(first); err == nil {
+		if ip, err := clientIPFromXFF(xff); err == nil {
 			clientIP = ip.String()
 		} else {
 			p.factory.errLog.Warn().Err(err).Str("xff", xff).Msg("failed to parse client IP from X-Forwarded-For")
 		}
 	}
 
+	host := extproc.FirstNonEmpty(ctx.Headers.Get("x-forwarded-host"), ctx.Headers.Get(":authority"), ctx.Headers.Get("host"))
+	req := match.NewRequest(ctx.Headers, ip)
+	req.Host = match.NormalizeHost(host)
+	settings := p.factory.settingsFor(req, p.route)
+	if !settings.sampled() {
+		p.mu.Lock()
+		p.skipped = true
+		p.mu.Unlock()
+		result := extproc.ContinueResult()
+		result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+			ResponseHeaderMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		}
+		return result
+	}
+
 	info := &requestInfo{
 		ID:        requestID,
 		RemoteIP:  remoteIP,
 		ClientIP:  clientIP,
 		Proto:     extproc.FirstNonEmpty(ctx.Headers.Get("x-forwarded-proto"), ctx.Headers.Get(":protocol")),
-		Host:      extproc.FirstNonEmpty(ctx.Headers.Get("x-forwarded-host"), ctx.Headers.Get(":authority"), ctx.Headers.Get("host")),
+		Host:      host,
 		Method:    ctx.Headers.Get(":method"),
 		URI:       extproc.FirstNonEmpty(ctx.Headers.Get("x-envoy-original-path"), ctx.Headers.Get(":path")),
-		Headers:   p.redactHeaders(ctx.Headers),
-		StartTime: time.Now(),
+		StartTime: received,
+		settings:  settings,
+	}
+	if user, _, ok := (&http.Request{Header: ctx.Headers}).BasicAuth(); ok {
+		info.RemoteUser = user
+	}
+	if protocol, ok := ctx.GetEnvoyAttributeValue("request.protocol"); ok {
+		info.Protocol = protocol.GetStringValue()
+	}
+	info.Headers, info.pooledHeaders = redactHeaders(settings, ctx.Headers)
+	if p.factory.encryption != nil {
+		p.factory.encryption.apply(info)
+	}
+
+	if p.factory.paths != nil {
+		info.Route = p.factory.paths.Template(info.URI)
 	}
 
 	if cl := ctx.Headers.Get("content-length"); cl != "" {
@@ -132,10 +337,162 @@ func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.
 	}
 
 	p.records.Add(requestID, info)
+
+	p.mu.Lock()
+	p.open = info
+	p.timing.start = info.StartTime
+	if ctx.EndOfStream {
+		p.timing.requestEnd = info.StartTime
+	}
+	p.mu.Unlock()
+
+	grpc, web := isGRPC(ctx.Headers.Get("content-type"))
+	if !grpc {
+		return extproc.ContinueResult()
+	}
+	p.mu.Lock()
+	p.grpc = newGRPCInfo(ctx.Headers.Get(":path"), web)
+	p.mu.Unlock()
+
+	// gRPC status arrives in trailers, or in the final body frame for
+	// gRPC-Web.
+	mode := &envoy_extensions_ext_proc_v3.ProcessingMode{
+		ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+		RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+	}
+	if p.factory.countMessages {
+		mode.RequestBodyMode = envoy_extensions_ext_proc_v3.ProcessingMode_STREAMED
+	}
+	if p.factory.countMessages || web {
+		mode.ResponseBodyMode = envoy_extensions_ext_proc_v3.ProcessingMode_STREAMED
+	}
+	result := extproc.ContinueResult()
+	result.ModeOverride = mode
+	return result
+}
+
+// ProcessRequestBody counts gRPC request messages.
+func (p *Processor) ProcessRequestBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.timing.body(p.factory.clock.Now())
+	if endOfStream {
+		p.timing.requestEnd = p.factory.clock.Now()
+	}
+	if p.grpc != nil {
+		p.reqFrames.write(body)
+	}
+	return extproc.ContinueResult()
+}
+
+// ProcessResponseBody counts gRPC response messages, reads the gRPC-Web
+// trailers frame and completes entries held for the end of the body.
+func (p *Processor) ProcessResponseBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.timing.body(p.factory.clock.Now())
+	if endOfStream {
+		p.timing.responseEnd = p.factory.clock.Now()
+	}
+	if p.grpc == nil {
+		if endOfStream {
+			p.flush()
+		}
+		return extproc.ContinueResult()
+	}
+	p.respFrames.write(body)
+	if endOfStream && p.grpc.Web {
+		if trailers := p.respFrames.trailers(); trailers != nil {
+			p.grpc.setStatus(trailers)
+		}
+		p.flush()
+	}
+	return extproc.ContinueResult()
+}
+
+// ProcessResponseTrailers completes gRPC entries with the status, and
+// entries held for the end of the body.
+func (p *Processor) ProcessResponseTrailers(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.timing.headers(p.factory.clock.Now())
+	p.timing.responseEnd = p.factory.clock.Now()
+	if p.grpc != nil {
+		p.grpc.setStatus(ctx.Headers)
+	}
+	p.flush()
 	return extproc.ContinueResult()
 }
 
+// OnStreamEnd emits the entries of exchanges the stream ended early, such
+// as cancelled calls.
+func (p *Processor) OnStreamEnd() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.abort()
+}
+
+// OnRequestEnd emits a pending entry and resets the per-request state when
+// the stream carries another request.
+func (p *Processor) OnRequestEnd() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.abort()
+	p.grpc, p.skipped = nil, false
+	p.reqFrames, p.respFrames = frameCounter{}, frameCounter{}
+	p.timing = timings{clock: p.factory.clock}
+}
+
+// abort emits the entry of a request that got no response headers, flagged
+// FlagClientAbort, and a pending entry, flagged FlagUpstreamReset unless it
+// is a gRPC entry that got its status. The caller holds p.mu.
+func (p *Processor) abort() {
+	if request := p.open; request != nil {
+		p.open = nil
+		p.records.Remove(request.ID)
+		response := &responseInfo{Flags: FlagClientAbort}
+		if err := request.settings.emitLog(request, response, p.grpc, &p.timing, nil); err != nil {
+			p.factory.errLog.Error().Err(err).Msg("failed to emit access log")
+		}
+	}
+	if p.pending != nil && (p.grpc == nil || p.grpc.Status == nil) {
+		p.pending.response.Flags = FlagUpstreamReset
+	}
+	p.flush()
+}
+
+// flush emits the pending entry. The caller holds p.mu.
+func (p *Processor) flush() {
+	if p.pending == nil {
+		return
+	}
+	pending := p.pending
+	p.pending = nil
+	if p.factory.countMessages && p.grpc != nil {
+		reqCount, respCount := p.reqFrames.count, p.respFrames.count
+		p.grpc.RequestMessages, p.grpc.ResponseMessages = &reqCount, &respCount
+	}
+	if err := pending.request.settings.emitLog(pending.request, pending.response, p.grpc, &p.timing, pending.attrs); err != nil {
+		p.factory.errLog.Error().Err(err).Msg("failed to emit access log")
+	}
+}
+
 func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	received := p.factory.clock.Now()
+	defer p.trackHeaders(received)
+
+	p.mu.Lock()
+	skipped := p.skipped
+	p.timing.responseStart = received
+	if ctx.EndOfStream {
+		p.timing.responseEnd = p.timing.responseStart
+	}
+	p.mu.Unlock()
+	if skipped {
+		return extproc.ContinueResult()
+	}
+
 	var request *requestInfo
 	if id := ctx.GetRequestID(); id == "" {
 		p.factory.errLog.Warn().Msg("request ID not found")
@@ -148,8 +505,10 @@ func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc
 		p.records.Remove(id)
 	}
 
-	response := &responseInfo{
-		Headers: p.redactHeaders(ctx.Headers),
+	response := &responseInfo{}
+	response.Headers, response.pooledHeaders = redactHeaders(request.settings, ctx.Headers)
+	if p.factory.encryption != nil {
+		response.Headers, response.pooledHeaders = p.factory.encryption.applyHeaders(response.Headers, response.pooledHeaders)
 	}
 
 	if statusStr := ctx.Headers.Get(":status"); statusStr != "" {
@@ -166,58 +525,71 @@ func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc
 		}
 	}
 
-	if err := emitLog(p.factory.accessLog, request, response, ctx); err != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.open != request {
+		// The stream ended concurrently and abort emitted the entry.
+		releaseHeaders(response.Headers, response.pooledHeaders)
+		return extproc.ContinueResult()
+	}
+	p.open = nil
+	if p.grpc != nil {
+		// Trailers-only responses carry the status in the headers.
+		p.pending = &pendingLog{request: request, response: response, attrs: ctx.Attributes}
+		if p.grpc.setStatus(ctx.Headers) || ctx.EndOfStream {
+			p.flush()
+		}
+		return extproc.ContinueResult()
+	}
+	if p.factory.responseEnd && !ctx.EndOfStream {
+		p.pending = &pendingLog{request: request, response: response, attrs: ctx.Attributes}
+		result := extproc.ContinueResult()
+		result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+			ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_STREAMED,
+			ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+		}
+		return result
+	}
+
+	if err := request.settings.emitLog(request, response, nil, &p.timing, ctx.Attributes); err != nil {
 		p.factory.errLog.Error().Err(err).Msg("failed to emit access log")
 	}
 	return extproc.ContinueResult()
 }
 
-func (p *Processor) redactHeaders(headers http.Header) map[string][]string {
-	out := make(map[string][]string, len(headers))
-	for key, values := range headers {
-		if !strings.HasPrefix(key, ":") {
-			key = http.CanonicalHeaderKey(key)
-		}
-		if slices.ContainsFunc(p.factory.excludeHeaders, func(h string) bool {
-			return strings.EqualFold(h, key)
-		}) {
-			out[key] = []string{"REDACTED"}
-		} else {
-			out[key] = values
-		}
-	}
-	return out
+// trackHeaders records time spent in a header handler started at begin.
+func (p *Processor) trackHeaders(begin time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timing.headers(begin)
 }
 
-func emitLog(log zerolog.Logger, request *requestInfo, response *responseInfo, ctx *extproc.RequestContext) error {
+// emitLog writes an entry in the request's format.
+func (s *settings) emitLog(request *requestInfo, response *responseInfo, grpc *grpcInfo, timing *timings, attrs map[string]*structpb.Struct) error {
+	defer releaseHeaders(request.Headers, request.pooledHeaders)
+	defer releaseHeaders(response.Headers, response.pooledHeaders)
 	level := zerolog.InfoLevel
-	if response.Status >= 500 {
+	if response.Status >= 500 || grpc.serverError() {
 		level = zerolog.ErrorLevel
 	}
-	event := log.WithLevel(level)
-
-	if jsonReq, err := json.Marshal(request); err == nil {
-		event = event.RawJSON("request", jsonReq)
-	} else {
-		return oops.With("request", request).Wrapf(err, "failed to marshal request")
-	}
-
-	if jsonAttr, err := json.Marshal(ctx.Attributes); err == nil {
-		event = event.RawJSON("attrs", jsonAttr)
-	} else {
-		return oops.With("attrs", ctx.Attributes).Wrapf(err, "failed to marshal attributes")
-	}
-
-	event.
-		Str("id", request.ID).
-		Dur("duration", time.Since(request.StartTime)).
-		Interface("size", response.Size).
-		Int("status", response.Status).
-		Interface("resp_headers", response.Headers).
-		Msg("request processed")
-	return nil
+	return s.formatter.format(s, &entry{
+		request:  request,
+		response: response,
+		grpc:     grpc,
+		timing:   timing.info(),
+		attrs:    attrs,
+		duration: timing.duration(),
+		respTime: timing.responseStart,
+		level:    level,
+	})
 }
 
 var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
 
 var _ extproc.Processor = (*Processor)(nil)
+
+var _ extproc.StreamEndHandler = (*Processor)(nil)
+
+var _ extproc.RequestEndHandler = (*Processor)(nil)
+
+var _ extproc.StreamProcessorFactory = (*ProcessorFactory)(nil)
@@ -0,0 +1,410 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Schema is a named access log field set. Strict schemas always emit
+// exactly their documented fields, with null for unknown values, so that
+// parsers keep working when the processor learns to log more; new fields
+// only ever appear in a new schema version.
+type Schema struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Strict      bool    `json:"strict"`
+	Fields      []Field `json:"fields"`
+
+	emit func(log zerolog.Logger, e *entry) error
+	// emitFast writes the same entry with the fast encoder; nil if the
+	// schema has none.
+	emitFast func(log zerolog.Logger, e *entry) error
+}
+
+// Field documents one field of a schema. Nested fields use dotted names.
+type Field struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+// entry is everything known about a finished exchange.
+type entry struct {
+	request  *requestInfo
+	response *responseInfo
+	grpc     *grpcInfo
+	timing   *timingInfo
+	attrs    map[string]*structpb.Struct
+	duration time.Duration
+	// respTime is when the response headers arrived, zero if they did not.
+	respTime time.Time
+	level    zerolog.Level
+}
+
+// requestHeader returns the first value of a logged (possibly redacted)
+// request header.
+func (e *entry) requestHeader(name string) *string {
+	if values := e.request.Headers[http.CanonicalHeaderKey(name)]; len(values) > 0 {
+		return &values[0]
+	}
+	return nil
+}
+
+// protocol returns "grpc" or "http".
+func (e *entry) protocol() string {
+	if e.grpc != nil {
+		return "grpc"
+	}
+	return "http"
+}
+
+// SchemaCaddy is the default schema, modelled on Caddy's JSON access log.
+// It is not strict: header maps and the grpc section vary per request.
+var SchemaCaddy = &Schema{
+	Name:        "caddy",
+	Description: "Caddy-style nested entries; header maps and the grpc section vary per request.",
+	Fields: []Field{
+		{"level", "string", "info, or error for 5xx and server-side gRPC failures."},
+		{"message", "string", "Always \"request processed\"."},
+		{"id", "string", "Envoy request ID."},
+		{"duration", "number", "Milliseconds from the request headers to the end of the response (the response headers if its end is not observed)."},
+		{"resp_start_time", "string", "RFC 3339 time the response headers arrived, or null."},
+		{"request.id", "string", "Envoy request ID."},
+		{"request.remote_ip", "string", "Downstream peer address."},
+		{"request.client_ip", "string", "First X-Forwarded-For address."},
+		{"request.proto", "string", "Forwarded protocol."},
+		{"request.method", "string", "HTTP method."},
+		{"request.host", "string", "Forwarded host or authority."},
+		{"request.uri", "string", "Original path and query."},
+		{"request.route", "string", "Templated path; present when metrics are enabled."},
+		{"request.headers", "object", "Request headers with excluded ones redacted."},
+		{"request.start_time", "string", "RFC 3339 start time."},
+		{"request.size", "number", "Request Content-Length, or null."},
+		{"attrs", "object", "Envoy attributes by namespace."},
+		{"status", "number", "HTTP status; absent for gRPC."},
+		{"size", "number", "Response Content-Length, or null; absent for gRPC."},
+		{"protocol", "string", "\"grpc\" for gRPC; absent otherwise."},
+		{"grpc", "object", "gRPC service, method, status, status_name, message and message counts."},
+		{"resp_headers", "object", "Response headers with excluded ones redacted."},
+		{"response_flags", "string", "\"client_abort\" or \"upstream_reset\" when the stream ended early; absent otherwise."},
+		{"timings.request_body_ms", "number", "Request headers to end of request body, or null if the body was not observed."},
+		{"timings.upstream_ms", "number", "End of request to response headers."},
+		{"timings.response_body_ms", "number", "Response headers to end of response, or null if not observed."},
+		{"timings.header_processing_ms", "number", "Time spent in this processor's header handlers."},
+		{"timings.body_processing_ms", "number", "Time spent in this processor's body handlers."},
+	},
+	emit:     emitCaddy,
+	emitFast: emitCaddyFast,
+}
+
+// SchemaECS maps entries onto Elastic Common Schema fields.
+var SchemaECS = &Schema{
+	Name:        "ecs",
+	Description: "Elastic Common Schema 8.11 nested fields.",
+	Strict:      true,
+	Fields: []Field{
+		{"@timestamp", "date", "Request start time."},
+		{"log.level", "keyword", "info or error."},
+		{"message", "text", "Always \"request processed\"."},
+		{"ecs.version", "keyword", "Always \"8.11.0\"."},
+		{"event.kind", "keyword", "Always \"event\"."},
+		{"event.category", "keyword", "Always [\"web\"]."},
+		{"event.duration", "long", "Nanoseconds from the request headers to the end of the response (the response headers if its end is not observed)."},
+		{"http.request.id", "keyword", "Envoy request ID."},
+		{"http.request.method", "keyword", "HTTP method."},
+		{"http.request.body.bytes", "long", "Request Content-Length, or null."},
+		{"http.request.referrer", "keyword", "Referer header, or null."},
+		{"http.response.status_code", "long", "HTTP status, or null."},
+		{"http.response.body.bytes", "long", "Response Content-Length, or null."},
+		{"url.original", "wildcard", "Original path and query."},
+		{"url.domain", "keyword", "Forwarded host or authority."},
+		{"url.scheme", "keyword", "Forwarded protocol, or null."},
+		{"url.path", "wildcard", "Templated path, or null without metrics."},
+		{"source.ip", "ip", "Downstream peer address, or null."},
+		{"client.ip", "ip", "First X-Forwarded-For address, or null."},
+		{"user_agent.original", "keyword", "User-Agent header, or null."},
+		{"network.protocol", "keyword", "\"grpc\" or \"http\"."},
+		{"rpc.service", "keyword", "gRPC service, or null."},
+		{"rpc.method", "keyword", "gRPC method, or null."},
+		{"rpc.status_code", "long", "gRPC status, or null."},
+	},
+	emit: emitECS,
+}
+
+// customV1Fields is the field set of custom-v1; later versions extend it.
+var customV1Fields = []Field{
+	{"schema", "string", "Schema name, e.g. \"custom-v1\"."},
+	{"timestamp", "string", "RFC 3339 request start time."},
+	{"level", "string", "info or error."},
+	{"id", "string", "Envoy request ID."},
+	{"protocol", "string", "\"grpc\" or \"http\"."},
+	{"remote_ip", "string", "Downstream peer address, or null."},
+	{"client_ip", "string", "First X-Forwarded-For address, or null."},
+	{"scheme", "string", "Forwarded protocol, or null."},
+	{"method", "string", "HTTP method."},
+	{"host", "string", "Forwarded host or authority."},
+	{"uri", "string", "Original path and query."},
+	{"route", "string", "Templated path, or null without metrics."},
+	{"user_agent", "string", "User-Agent header, or null."},
+	{"referer", "string", "Referer header, or null."},
+	{"status", "number", "HTTP status, or null."},
+	{"request_bytes", "number", "Request Content-Length, or null."},
+	{"response_bytes", "number", "Response Content-Length, or null."},
+	{"duration_ms", "number", "Milliseconds from the request headers to the end of the response (the response headers if its end is not observed)."},
+	{"grpc_service", "string", "gRPC service, or null."},
+	{"grpc_method", "string", "gRPC method, or null."},
+	{"grpc_status", "number", "gRPC status, or null."},
+	{"grpc_message", "string", "gRPC status message, or null."},
+}
+
+// SchemaCustomV1 is a flat, versioned field set of this project.
+var SchemaCustomV1 = &Schema{
+	Name:        "custom-v1",
+	Description: "Flat snake_case fields, frozen at version 1.",
+	Strict:      true,
+	Fields:      customV1Fields,
+	emit:        func(log zerolog.Logger, e *entry) error { return emitCustom(log, e, 1) },
+	emitFast:    func(log zerolog.Logger, e *entry) error { return emitCustomFast(log, e, 1) },
+}
+
+// SchemaCustomV2 adds the duration breakdown to custom-v1.
+var SchemaCustomV2 = &Schema{
+	Name:        "custom-v2",
+	Description: "custom-v1 plus the per-phase duration breakdown.",
+	Strict:      true,
+	Fields: append(slices.Clip(customV1Fields),
+		Field{"request_body_ms", "number", "Request headers to end of request body, or null if the body was not observed."},
+		Field{"upstream_ms", "number", "End of request to response headers: upstream time to first byte."},
+		Field{"response_body_ms", "number", "Response headers to end of response, or null if not observed."},
+		Field{"processing_ms", "number", "Time spent in the processor's handlers (ext_proc overhead)."},
+	),
+	emit:     func(log zerolog.Logger, e *entry) error { return emitCustom(log, e, 2) },
+	emitFast: func(log zerolog.Logger, e *entry) error { return emitCustomFast(log, e, 2) },
+}
+
+// SchemaCustomV3 adds the response flags of early stream ends to custom-v2.
+var SchemaCustomV3 = &Schema{
+	Name:        "custom-v3",
+	Description: "custom-v2 plus response flags for client aborts and upstream resets.",
+	Strict:      true,
+	Fields: append(slices.Clip(SchemaCustomV2.Fields),
+		Field{"response_flags", "string", "\"client_abort\" if the stream ended before the response headers, \"upstream_reset\" if a gRPC stream ended before its status or, with response end tracking, a response before its body ended, or null."},
+	),
+	emit:     func(log zerolog.Logger, e *entry) error { return emitCustom(log, e, 3) },
+	emitFast: func(log zerolog.Logger, e *entry) error { return emitCustomFast(log, e, 3) },
+}
+
+// schemas lists the selectable schemas by name.
+var schemas = []*Schema{SchemaCaddy, SchemaECS, SchemaCustomV1, SchemaCustomV2, SchemaCustomV3}
+
+// SchemaNames returns the names accepted by LookupSchema.
+func SchemaNames() []string {
+	names := make([]string, len(schemas))
+	for i, s := range schemas {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// LookupSchema returns the schema with the given name; empty selects caddy.
+func LookupSchema(name string) (*Schema, error) {
+	if name == "" {
+		return SchemaCaddy, nil
+	}
+	if i := slices.IndexFunc(schemas, func(s *Schema) bool { return s.Name == name }); i >= 0 {
+		return schemas[i], nil
+	}
+	return nil, oops.
+		In("accesslog").
+		Code(errcode.InvalidSchema).
+		With("schema", name).
+		Errorf("unknown access log schema %q (expected one of %s)", name, strings.Join(SchemaNames(), ", "))
+}
+
+// SchemaHandler serves the active schema as JSON, or another one selected
+// with ?name=.
+func SchemaHandler(active *Schema) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		schema := active
+		if name := r.URL.Query().Get("name"); name != "" {
+			var err error
+			if schema, err = LookupSchema(name); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			*Schema
+			Active    bool     `json:"active"`
+			Available []string `json:"available"`
+		}{schema, schema == active, SchemaNames()})
+	})
+}
+
+// emitCaddy writes an entry. gRPC entries carry a grpc section in place of
+// the HTTP status and size.
+func emitCaddy(log zerolog.Logger, e *entry) error {
+	event := log.WithLevel(e.level)
+
+	if jsonReq, err := json.Marshal(e.request); err == nil {
+		event = event.RawJSON("request", jsonReq)
+	} else {
+		return oops.Code(errcode.EncodeFailed).With("request", e.request).Wrapf(err, "failed to marshal request")
+	}
+
+	if jsonAttr, err := json.Marshal(e.attrs); err == nil {
+		event = event.RawJSON("attrs", jsonAttr)
+	} else {
+		return oops.Code(errcode.EncodeFailed).With("attrs", e.attrs).Wrapf(err, "failed to marshal attributes")
+	}
+
+	if e.grpc != nil {
+		jsonGRPC, err := json.Marshal(e.grpc)
+		if err != nil {
+			return oops.Code(errcode.EncodeFailed).With("grpc", e.grpc).Wrapf(err, "failed to marshal gRPC info")
+		}
+		event = event.Str("protocol", "grpc").RawJSON("grpc", jsonGRPC)
+	} else {
+		event = event.
+			Interface("size", e.response.Size).
+			Int("status", e.response.Status)
+	}
+
+	event = event.
+		Str("id", e.request.ID).
+		Dur("duration", e.duration).
+		Interface("resp_headers", e.response.Headers).
+		Interface("resp_start_time", nullableTime(e.respTime)).
+		Interface("timings", e.timing)
+	if e.response.Flags != "" {
+		event = event.Str("response_flags", e.response.Flags)
+	}
+	event.Msg("request processed")
+	return nil
+}
+
+func emitECS(log zerolog.Logger, e *entry) error {
+	var rpcService, rpcMethod *string
+	var rpcStatus *int
+	if e.grpc != nil {
+		rpcService, rpcMethod, rpcStatus = &e.grpc.Service, &e.grpc.Method, e.grpc.Status
+	}
+
+	log.Log().
+		Str("@timestamp", e.request.StartTime.UTC().Format(time.RFC3339Nano)).
+		Dict("log", zerolog.Dict().Str("level", e.level.String())).
+		Str("message", "request processed").
+		Dict("ecs", zerolog.Dict().Str("version", "8.11.0")).
+		Dict("event", zerolog.Dict().
+			Str("kind", "event").
+			Strs("category", []string{"web"}).
+			Int64("duration", e.duration.Nanoseconds())).
+		Dict("http", zerolog.Dict().
+			Dict("request", zerolog.Dict().
+				Str("id", e.request.ID).
+				Str("method", e.request.Method).
+				Dict("body", zerolog.Dict().Interface("bytes", e.request.Size)).
+				Interface("referrer", e.requestHeader("referer"))).
+			Dict("response", zerolog.Dict().
+				Interface("status_code", httpStatus(e)).
+				Dict("body", zerolog.Dict().Interface("bytes", e.response.Size)))).
+		Dict("url", zerolog.Dict().
+			Str("original", e.request.URI).
+			Str("domain", e.request.Host).
+			Interface("scheme", nullable(e.request.Proto)).
+			Interface("path", nullable(e.request.Route))).
+		Dict("source", zerolog.Dict().Interface("ip", nullable(e.request.RemoteIP))).
+		Dict("client", zerolog.Dict().Interface("ip", nullable(e.request.ClientIP))).
+		Dict("user_agent", zerolog.Dict().Interface("original", e.requestHeader("user-agent"))).
+		Dict("network", zerolog.Dict().Str("protocol", e.protocol())).
+		Dict("rpc", zerolog.Dict().
+			Interface("service", rpcService).
+			Interface("method", rpcMethod).
+			Interface("status_code", rpcStatus)).
+		Send()
+	return nil
+}
+
+// emitCustom writes the custom-vN field set.
+func emitCustom(log zerolog.Logger, e *entry, version int) error {
+	var grpcService, grpcMethod, grpcMessage *string
+	var grpcStatus *int
+	if e.grpc != nil {
+		grpcService, grpcMethod, grpcStatus = &e.grpc.Service, &e.grpc.Method, e.grpc.Status
+		grpcMessage = nullable(e.grpc.Message)
+	}
+
+	event := log.Log().
+		Str("schema", "custom-v"+strconv.Itoa(version)).
+		Str("timestamp", e.request.StartTime.UTC().Format(time.RFC3339Nano)).
+		Str("level", e.level.String()).
+		Str("id", e.request.ID).
+		Str("protocol", e.protocol()).
+		Interface("remote_ip", nullable(e.request.RemoteIP)).
+		Interface("client_ip", nullable(e.request.ClientIP)).
+		Interface("scheme", nullable(e.request.Proto)).
+		Str("method", e.request.Method).
+		Str("host", e.request.Host).
+		Str("uri", e.request.URI).
+		Interface("route", nullable(e.request.Route)).
+		Interface("user_agent", e.requestHeader("user-agent")).
+		Interface("referer", e.requestHeader("referer")).
+		Interface("status", httpStatus(e)).
+		Interface("request_bytes", e.request.Size).
+		Interface("response_bytes", e.response.Size).
+		Float64("duration_ms", float64(e.duration)/float64(time.Millisecond)).
+		Interface("grpc_service", grpcService).
+		Interface("grpc_method", grpcMethod).
+		Interface("grpc_status", grpcStatus).
+		Interface("grpc_message", grpcMessage)
+	if version >= 2 {
+		timing := e.timing
+		if timing == nil {
+			timing = &timingInfo{}
+		}
+		event = event.
+			Interface("request_body_ms", timing.RequestBody).
+			Interface("upstream_ms", timing.Upstream).
+			Interface("response_body_ms", timing.ResponseBody).
+			Float64("processing_ms", timing.HeaderProcessing+timing.BodyProcessing)
+	}
+	if version >= 3 {
+		event = event.Interface("response_flags", nullable(e.response.Flags))
+	}
+	event.Send()
+	return nil
+}
+
+// httpStatus returns the HTTP status, or nil if none was seen.
+func httpStatus(e *entry) *int {
+	if e.response.Status == 0 {
+		return nil
+	}
+	return &e.response.Status
+}
+
+// nullableTime formats t as RFC 3339, or returns nil for the zero time.
+func nullableTime(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+	return nullable(t.UTC().Format(time.RFC3339Nano))
+}
+
+// nullable returns nil for empty strings so strict schemas emit null.
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
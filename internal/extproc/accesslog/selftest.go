@@ -0,0 +1,53 @@
+package accesslog
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/selftest"
+	"github.com/samber/oops"
+)
+
+const selftestRequestID = "selftest-request"
+
+// SelfTestCases returns synthetic exchanges for a factory writing its access
+// log to out, asserting that an entry is emitted with sensitive headers
+// redacted.
+func SelfTestCases(out *bytes.Buffer) []selftest.Case {
+	return []selftest.Case{
+		{
+			Name: "request and response logged",
+			Requests: []*selftest.Request{
+				selftest.RequestHeaders(
+					map[string]string{"request.id": selftestRequestID, "source.address": "192.0.2.10:40000"},
+					":method", "GET", ":path", "/selftest", ":authority", "selftest.local",
+					"authorization", "Bearer selftest-secret",
+				),
+				selftest.ResponseHeaders(
+					map[string]string{"request.id": selftestRequestID},
+					":status", "200", "content-length", "0",
+				),
+			},
+			Expect: func(responses []*selftest.Response) error {
+				entry := out.String()
+				switch {
+				case len(responses) != 2:
+					return oops.Code(errcode.SelftestFailed).Errorf("got %d responses, want 2", len(responses))
+				case !strings.Contains(entry, selftestRequestID):
+					return oops.Code(errcode.SelftestFailed).Errorf("no access log entry emitted for %s", selftestRequestID)
+				case strings.Contains(entry, "selftest-secret"):
+					return oops.Code(errcode.SelftestFailed).Errorf("authorization header was not redacted")
+				}
+				return nil
+			},
+		},
+		{
+			Name: "missing request id",
+			Requests: []*selftest.Request{
+				selftest.RequestHeaders(nil, ":method", "GET", ":path", "/"),
+			},
+			Expect: selftest.ExpectHeaders(0, nil),
+		},
+	}
+}
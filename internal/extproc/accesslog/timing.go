@@ -0,0 +1,94 @@
+package accesslog
+
+import (
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+)
+
+// timings records when each phase reached the processor and how long its
+// handlers ran, to separate upstream latency from processor overhead.
+type timings struct {
+	clock clock.Clock
+
+	start         time.Time
+	requestEnd    time.Time
+	responseStart time.Time
+	responseEnd   time.Time
+
+	headerProcessing time.Duration
+	bodyProcessing   time.Duration
+}
+
+// timingInfo is the timings section of an access log entry. Phases the
+// processor did not observe, such as bodies that are not sent to it, are
+// null.
+type timingInfo struct {
+	// RequestBody is from the request headers to the end of the request body.
+	RequestBody *float64 `json:"request_body_ms"`
+	// Upstream is from the end of the request to the response headers: the
+	// upstream's time to first byte plus Envoy's own queuing.
+	Upstream *float64 `json:"upstream_ms"`
+	// ResponseBody is from the response headers to the end of the response.
+	ResponseBody *float64 `json:"response_body_ms"`
+	// HeaderProcessing and BodyProcessing are the time spent in this
+	// processor's handlers, the ext_proc overhead excluding gRPC transport.
+	HeaderProcessing float64 `json:"header_processing_ms"`
+	BodyProcessing   float64 `json:"body_processing_ms"`
+}
+
+// headers records time spent handling a header or trailer message that
+// started at begin.
+func (t *timings) headers(begin time.Time) {
+	t.headerProcessing += t.clock.Since(begin)
+}
+
+// body records time spent handling a body message that started at begin.
+func (t *timings) body(begin time.Time) {
+	t.bodyProcessing += t.clock.Since(begin)
+}
+
+// duration is from the request's arrival to the end of the response, or to
+// the response headers if the end was not observed.
+func (t *timings) duration() time.Duration {
+	end := t.responseEnd
+	if end.IsZero() {
+		end = t.responseStart
+	}
+	if end.IsZero() {
+		// The stream ended before a response, e.g. a cancelled call.
+		end = t.clock.Now()
+	}
+	return max(end.Sub(t.start), 0)
+}
+
+// info summarizes the timings.
+func (t *timings) info() *timingInfo {
+	info := &timingInfo{
+		HeaderProcessing: millis(t.headerProcessing),
+		BodyProcessing:   millis(t.bodyProcessing),
+	}
+	if !t.requestEnd.IsZero() && t.requestEnd.After(t.start) {
+		info.RequestBody = millisBetween(t.start, t.requestEnd)
+	}
+	if !t.responseStart.IsZero() {
+		requestEnd := t.requestEnd
+		if requestEnd.IsZero() {
+			requestEnd = t.start
+		}
+		info.Upstream = millisBetween(requestEnd, t.responseStart)
+	}
+	if !t.responseStart.IsZero() && !t.responseEnd.IsZero() {
+		info.ResponseBody = millisBetween(t.responseStart, t.responseEnd)
+	}
+	return info
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func millisBetween(from, to time.Time) *float64 {
+	ms := millis(max(to.Sub(from), 0))
+	return &ms
+}
@@ -0,0 +1,102 @@
+package extproc
+
+import (
+	"net/netip"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/pkg/extproc"
+	"github.com/rs/zerolog"
+)
+
+// The processor API is defined by the public extproc package, so that
+// custom processors are served like the bundled ones; the server and the
+// bundled processors refer to it through these names.
+type (
+	Processor         = extproc.Processor
+	ProcessorFactory  = extproc.ProcessorFactory
+	BaseProcessor     = extproc.BaseProcessor
+	RequestContext    = extproc.RequestContext
+	ProcessingResult  = extproc.ProcessingResult
+	HeaderMutations   = extproc.HeaderMutations
+	StreamEndHandler  = extproc.StreamEndHandler
+	RequestEndHandler = extproc.RequestEndHandler
+	Phase             = extproc.Phase
+	PhaseAware        = extproc.PhaseAware
+	Named             = extproc.Named
+	DecisionMode      = extproc.DecisionMode
+	Decider           = extproc.Decider
+	MemoryBudget      = extproc.MemoryBudget
+	MemoryAccount     = extproc.MemoryAccount
+)
+
+const (
+	EnvoyAttributesKey      = extproc.EnvoyAttributesKey
+	HeaderEnvoyExternalAddr = extproc.HeaderEnvoyExternalAddr
+
+	MetadataNamespaceJWTAuthn  = extproc.MetadataNamespaceJWTAuthn
+	MetadataNamespaceRateLimit = extproc.MetadataNamespaceRateLimit
+	MetadataNamespaceExtAuthz  = extproc.MetadataNamespaceExtAuthz
+	MetadataNamespaceRBAC      = extproc.MetadataNamespaceRBAC
+
+	PhaseRequestHeaders   = extproc.PhaseRequestHeaders
+	PhaseRequestBody      = extproc.PhaseRequestBody
+	PhaseRequestTrailers  = extproc.PhaseRequestTrailers
+	PhaseResponseHeaders  = extproc.PhaseResponseHeaders
+	PhaseResponseBody     = extproc.PhaseResponseBody
+	PhaseResponseTrailers = extproc.PhaseResponseTrailers
+
+	DecisionEnforce   = extproc.DecisionEnforce
+	DecisionHeaderTag = extproc.DecisionHeaderTag
+	DecisionLogOnly   = extproc.DecisionLogOnly
+	HeaderWouldBlock  = extproc.HeaderWouldBlock
+)
+
+// ContinueResult returns a ProcessingResult that continues processing.
+func ContinueResult() *ProcessingResult {
+	return extproc.ContinueResult()
+}
+
+// ContinueWithHeaders returns a ProcessingResult that continues with header mutations.
+func ContinueWithHeaders(setHeaders []*envoy_api_v3_core.HeaderValueOption) *ProcessingResult {
+	return extproc.ContinueWithHeaders(setHeaders)
+}
+
+// ContinueWithBody returns a ProcessingResult that continues with the body
+// chunk replaced by body.
+func ContinueWithBody(body []byte) *ProcessingResult {
+	return extproc.ContinueWithBody(body)
+}
+
+// ImmediateResult returns a ProcessingResult that stops processing and sends
+// the given status, headers and body to the client.
+func ImmediateResult(status int, headers []*envoy_api_v3_core.HeaderValueOption, body []byte) *ProcessingResult {
+	return extproc.ImmediateResult(status, headers, body)
+}
+
+// SetHeader creates a header value option that overwrites existing headers.
+func SetHeader(key, value string) *envoy_api_v3_core.HeaderValueOption {
+	return extproc.SetHeader(key, value)
+}
+
+// AppendHeader creates a header value option that adds a value, keeping any
+// existing ones (e.g. multiple set-cookie headers).
+func AppendHeader(key, value string) *envoy_api_v3_core.HeaderValueOption {
+	return extproc.AppendHeader(key, value)
+}
+
+// NewDecider creates a Decider for the named processor; log receives the
+// rejections that are not enforced.
+func NewDecider(processor string, mode DecisionMode, log zerolog.Logger) Decider {
+	return extproc.NewDecider(processor, mode, log)
+}
+
+// NewMemoryBudget creates a MemoryBudget of limit bytes.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return extproc.NewMemoryBudget(limit)
+}
+
+// ParseIPFromAddress returns the IP of addr, an IP address with or without
+// a port.
+func ParseIPFromAddress(addr string) (netip.Addr, error) {
+	return extproc.ParseIPFromAddress(addr)
+}
@@ -0,0 +1,195 @@
+// Package apiversion provides an ext_proc processor that resolves the
+// requested API version from the path, a header or Accept, validates it and
+// exposes it to routing as a normalized header.
+package apiversion
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+)
+
+// Source is where a version can be requested.
+type Source string
+
+const (
+	SourcePath   Source = "path"
+	SourceHeader Source = "header"
+	SourceAccept Source = "accept"
+)
+
+var (
+	pathVersion = regexp.MustCompile(`^/v(\d+(?:\.\d+)?)(/|$)`)
+	// vendorVersion matches media types like application/vnd.acme.v2+json.
+	vendorVersion = regexp.MustCompile(`^application/vnd\.[^.]+(?:\.[^.]+)*\.v(\d+(?:\.\d+)?)(\+[a-z]+)?$`)
+)
+
+// Config holds version negotiation settings.
+type Config struct {
+	// Sources are consulted in order; disagreeing sources are rejected.
+	Sources []Source
+	// Supported lists the accepted versions, without a "v" prefix.
+	Supported []string
+	// Default is used when no version is requested; empty requires one.
+	Default string
+	// RequestHeader is the client header carrying the version.
+	RequestHeader string
+	// UpstreamHeader receives the normalized version.
+	UpstreamHeader string
+	// StripPathVersion removes the /vN prefix from the path sent upstream.
+	StripPathVersion bool
+}
+
+// ProcessorFactory creates version negotiation processors.
+type ProcessorFactory struct {
+	cfg Config
+	log zerolog.Logger
+}
+
+// NewProcessorFactory creates a new version negotiation ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	return &ProcessorFactory{
+		cfg: cfg,
+		log: log.With().Str("processor", "apiversion").Logger(),
+	}
+}
+
+// NewProcessor creates a new version negotiation processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+}
+
+// ProcessRequestHeaders resolves and validates the requested version.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	path := ctx.Headers.Get(":path")
+
+	var (
+		version string
+		from    Source
+	)
+	for _, source := range f.cfg.Sources {
+		v := f.lookup(source, ctx.Headers)
+		if v == "" {
+			continue
+		}
+		if version != "" && v != version {
+			return f.reject(http.StatusBadRequest, "conflicting API versions requested via "+string(from)+" ("+version+") and "+string(source)+" ("+v+")", v)
+		}
+		if version == "" {
+			version, from = v, source
+		}
+	}
+	if version == "" {
+		if f.cfg.Default == "" {
+			return f.reject(http.StatusBadRequest, "an API version is required", "")
+		}
+		version = f.cfg.Default
+	}
+	if !slices.Contains(f.cfg.Supported, version) {
+		status := http.StatusBadRequest
+		if from == SourceAccept {
+			status = http.StatusNotAcceptable
+		}
+		f.log.Debug().Str("version", version).Str("source", string(from)).Str("request_id", ctx.GetRequestID()).Msg("unsupported API version")
+		return f.reject(status, "unsupported API version "+version, version)
+	}
+
+	headers := []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader(f.cfg.UpstreamHeader, version),
+	}
+	if f.cfg.StripPathVersion {
+		if m := pathVersion.FindStringSubmatchIndex(path); m != nil {
+			headers = append(headers, extproc.SetHeader(":path", "/"+strings.TrimPrefix(path[m[1]:], "/")))
+		}
+	}
+	result := extproc.ContinueWithHeaders(headers)
+	result.ClearRouteCache = true
+	return result
+}
+
+func (f *ProcessorFactory) lookup(source Source, h http.Header) string {
+	switch source {
+	case SourcePath:
+		if m := pathVersion.FindStringSubmatch(h.Get(":path")); m != nil {
+			return m[1]
+		}
+	case SourceHeader:
+		return normalize(h.Get(f.cfg.RequestHeader))
+	case SourceAccept:
+		for part := range strings.SplitSeq(h.Get("accept"), ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			if v := params["version"]; v != "" {
+				return normalize(v)
+			}
+			if m := vendorVersion.FindStringSubmatch(mediaType); m != nil {
+				return m[1]
+			}
+		}
+	}
+	return ""
+}
+
+// normalize strips whitespace and a leading "v" from a version.
+func normalize(v string) string {
+	v = strings.TrimSpace(v)
+	return strings.TrimPrefix(strings.TrimPrefix(v, "v"), "V")
+}
+
+func (f *ProcessorFactory) reject(status int, message, requested string) *extproc.ProcessingResult {
+	body, _ := json.Marshal(map[string]any{
+		"error":     message,
+		"requested": requested,
+		"supported": f.cfg.Supported,
+		"hint":      f.hint(),
+	})
+	return extproc.ImmediateResult(status, []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("content-type", "application/json"),
+	}, body)
+}
+
+// hint explains how clients can request a version.
+func (f *ProcessorFactory) hint() string {
+	var ways []string
+	for _, source := range f.cfg.Sources {
+		switch source {
+		case SourcePath:
+			ways = append(ways, "a /v{version}/ path prefix")
+		case SourceHeader:
+			ways = append(ways, "the "+f.cfg.RequestHeader+" header")
+		case SourceAccept:
+			ways = append(ways, "Accept: application/json; version={version}")
+		}
+	}
+	return "request a supported version using " + strings.Join(ways, ", or ")
+}
+
+// Phases reports that only request headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
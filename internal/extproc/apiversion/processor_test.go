@@ -0,0 +1,90 @@
+package apiversion
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+func newFactory(def string) *ProcessorFactory {
+	return NewProcessorFactory(Config{
+		Sources:          []Source{SourcePath, SourceHeader, SourceAccept},
+		Supported:        []string{"1", "2", "2.1"},
+		Default:          def,
+		RequestHeader:    "api-version",
+		UpstreamHeader:   "x-api-version",
+		StripPathVersion: true,
+	}, zerolog.Nop())
+}
+
+func negotiate(f *ProcessorFactory, headers ...string) *extproc.ProcessingResult {
+	return f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, append([]string{":method", "GET"}, headers...)...))
+}
+
+func TestResolveVersion(t *testing.T) {
+	f := newFactory("1")
+	for _, tc := range []struct {
+		headers []string
+		version string
+		path    string
+	}{
+		{[]string{":path", "/v2/orders?x=1"}, "2", "/orders?x=1"},
+		{[]string{":path", "/v2.1"}, "2.1", "/"},
+		{[]string{":path", "/orders", "api-version", " v2 "}, "2", ""},
+		{[]string{":path", "/orders", "accept", "application/vnd.acme.v2+json"}, "2", ""},
+		{[]string{":path", "/orders", "accept", "text/plain, application/json; version=2.1"}, "2.1", ""},
+		{[]string{":path", "/v2/orders", "api-version", "2"}, "2", "/orders"},
+		{[]string{":path", "/orders"}, "1", ""},
+		// Only a whole leading segment is a version.
+		{[]string{":path", "/v2orders"}, "1", ""},
+	} {
+		result := negotiate(f, tc.headers...)
+		expectations := []extproctest.Expectation{
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderSet("x-api-version", tc.version),
+		}
+		if tc.path != "" {
+			expectations = append(expectations, extproctest.ExpectHeaderSet(":path", tc.path))
+		}
+		extproctest.Check(t, result, expectations...)
+		if !result.ClearRouteCache {
+			t.Errorf("%q: route cache not cleared", tc.headers)
+		}
+	}
+}
+
+func TestRejectVersion(t *testing.T) {
+	for _, tc := range []struct {
+		f       *ProcessorFactory
+		headers []string
+		status  int
+		message string
+	}{
+		{newFactory("1"), []string{":path", "/v1/orders", "api-version", "2"}, http.StatusBadRequest, "conflicting API versions requested via path (1) and header (2)"},
+		{newFactory("1"), []string{":path", "/v3/orders"}, http.StatusBadRequest, "unsupported API version 3"},
+		{newFactory("1"), []string{":path", "/orders", "accept", "application/vnd.acme.v3+json"}, http.StatusNotAcceptable, "unsupported API version 3"},
+		{newFactory(""), []string{":path", "/orders"}, http.StatusBadRequest, "an API version is required"},
+	} {
+		result := negotiate(tc.f, tc.headers...)
+		extproctest.Check(t, result,
+			extproctest.ExpectDenied(tc.status),
+			extproctest.ExpectHeaderSet("content-type", "application/json"),
+		)
+		var body struct {
+			Error     string   `json:"error"`
+			Supported []string `json:"supported"`
+			Hint      string   `json:"hint"`
+		}
+		if err := json.Unmarshal(result.ImmediateResponse.GetBody(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error != tc.message || len(body.Supported) != 3 || !strings.Contains(body.Hint, "the api-version header") {
+			t.Errorf("%q: body = %+v", tc.headers, body)
+		}
+	}
+}
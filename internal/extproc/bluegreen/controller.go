@@ -0,0 +1,238 @@
+package bluegreen
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+var (
+	assignmentsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bluegreen_assignments_total",
+		Help: "Requests assigned to each blue/green variant.",
+	}, []string{"variant"})
+	greenPercent = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bluegreen_green_percent",
+		Help: "Configured percentage of requests sent to the green variant.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(assignmentsTotal, greenPercent)
+}
+
+// State is the persisted cutover state.
+type State struct {
+	GreenPercent float64   `json:"green_percent"`
+	Updated      time.Time `json:"updated"`
+}
+
+// Controller holds the green percentage, persists it to a state file and
+// counts assignments since it last changed.
+type Controller struct {
+	path  string
+	clock clock.Clock
+	log   zerolog.Logger
+
+	// green is the percentage in basis points, read on every request.
+	green atomic.Int64
+
+	mu      sync.Mutex
+	state   State
+	blue    atomic.Int64
+	greenN  atomic.Int64
+	resetAt time.Time
+}
+
+// NewController loads the state file, or starts from initialPercent if it
+// does not exist yet. An empty path keeps the state in memory only.
+func NewController(path string, initialPercent float64, clk clock.Clock, log zerolog.Logger) (*Controller, error) {
+	c := &Controller{
+		path:  path,
+		clock: clock.Or(clk),
+		log:   log.With().Str("component", "bluegreen").Logger(),
+	}
+	state := State{GreenPercent: initialPercent, Updated: c.clock.Now()}
+	trigger := audit.Trigger{Source: "flags"}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return nil, oops.In("bluegreen").Code(errcode.ReadFailed).With("path", path).Wrapf(err, "failed to read state file")
+		default:
+			if err := json.Unmarshal(data, &state); err != nil {
+				return nil, oops.In("bluegreen").Code(errcode.InvalidConfig).With("path", path).Wrapf(err, "invalid state file")
+			}
+			c.log.Info().Float64("green_percent", state.GreenPercent).Time("updated", state.Updated).Msg("restored blue/green state")
+			trigger = audit.File(path)
+		}
+	}
+	if err := validPercent(state.GreenPercent); err != nil {
+		return nil, err
+	}
+	c.apply(state)
+	audit.Record("bluegreen", trigger, map[string]float64{"green_percent": state.GreenPercent})
+	return c, nil
+}
+
+func validPercent(p float64) error {
+	if math.IsNaN(p) || p < 0 || p > 100 {
+		return oops.In("bluegreen").Code(errcode.InvalidConfig).With("green_percent", p).Errorf("green percentage %v is not between 0 and 100", p)
+	}
+	return nil
+}
+
+func (c *Controller) apply(state State) {
+	c.state = state
+	c.green.Store(int64(math.Round(state.GreenPercent * 100)))
+	c.blue.Store(0)
+	c.greenN.Store(0)
+	c.resetAt = c.clock.Now()
+	greenPercent.Set(state.GreenPercent)
+}
+
+// SetGreenPercent changes the green percentage and persists it. The
+// distribution counts start over.
+func (c *Controller) SetGreenPercent(p float64) error {
+	if err := validPercent(p); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := State{GreenPercent: p, Updated: c.clock.Now()}
+	if err := c.save(state); err != nil {
+		return err
+	}
+	c.log.Info().Float64("from", c.state.GreenPercent).Float64("to", p).Msg("blue/green weight changed")
+	c.apply(state)
+	return nil
+}
+
+// save writes state to a temporary file and renames it over the state file,
+// so a crash never leaves a torn file behind.
+func (c *Controller) save(state State) error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return oops.In("bluegreen").Code(errcode.EncodeFailed).Wrap(err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), "."+filepath.Base(c.path)+".*")
+	if err != nil {
+		return oops.In("bluegreen").Code(errcode.WriteFailed).With("path", c.path).Wrapf(err, "failed to write state file")
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		return oops.In("bluegreen").Code(errcode.WriteFailed).With("path", c.path).Wrapf(err, "failed to write state file")
+	}
+	return nil
+}
+
+// isGreen reports whether bucket, from 0 to 9999, falls in the green share.
+func (c *Controller) isGreen(bucket uint64) bool {
+	return bucket < uint64(c.green.Load())
+}
+
+func (c *Controller) count(green bool) {
+	if green {
+		c.greenN.Add(1)
+		assignmentsTotal.WithLabelValues(VariantGreen).Inc()
+	} else {
+		c.blue.Add(1)
+		assignmentsTotal.WithLabelValues(VariantBlue).Inc()
+	}
+}
+
+// Status is the admin API view of the controller.
+type Status struct {
+	State
+	BluePercent float64 `json:"blue_percent"`
+	// Since is when the counts below started, at the last change.
+	Since    time.Time        `json:"since"`
+	Assigned map[string]int64 `json:"assigned"`
+	// ObservedGreenPercent is the share of assigned requests that went to
+	// green; null before any request.
+	ObservedGreenPercent *float64 `json:"observed_green_percent"`
+}
+
+// Status returns the current weights and the distribution since the last
+// change.
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blue, green := c.blue.Load(), c.greenN.Load()
+	s := Status{
+		State:       c.state,
+		BluePercent: 100 - c.state.GreenPercent,
+		Since:       c.resetAt,
+		Assigned:    map[string]int64{VariantBlue: blue, VariantGreen: green},
+	}
+	if total := blue + green; total > 0 {
+		observed := math.Round(float64(green)/float64(total)*10000) / 100
+		s.ObservedGreenPercent = &observed
+	}
+	return s
+}
+
+// ServeHTTP serves the status on GET and changes the weight on PUT with a
+// body of {"green_percent": N}. Callers are not authenticated here: the
+// admin listener refuses unauthenticated PUTs (see adminauth.Require).
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			GreenPercent *float64 `json:"green_percent"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || req.GreenPercent == nil {
+			http.Error(w, `body must be {"green_percent": <0-100>}`, http.StatusBadRequest)
+			return
+		}
+		if err := c.SetGreenPercent(*req.GreenPercent); err != nil {
+			status := http.StatusInternalServerError
+			if errcode.Is(err, errcode.InvalidConfig) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		audit.Record("bluegreen", audit.Admin(r), map[string]float64{"green_percent": *req.GreenPercent})
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c.Status())
+}
+
+// Ensure Controller implements http.Handler.
+var _ http.Handler = (*Controller)(nil)
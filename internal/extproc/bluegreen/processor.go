@@ -0,0 +1,105 @@
+// Package bluegreen provides an ext_proc processor that splits requests
+// between blue and green deployments by an adjustable percentage and sets a
+// routing header, so cutovers are driven from the admin API rather than
+// Envoy config changes.
+package bluegreen
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+)
+
+// Variants, as set in the routing header.
+const (
+	VariantBlue  = "blue"
+	VariantGreen = "green"
+)
+
+// Config holds the routing header settings.
+type Config struct {
+	// Header carries the variant to the route match.
+	Header string
+	// HashHeader, if set, names a header (e.g. a user ID set by an auth
+	// filter) whose value keeps a client on one variant while the
+	// percentage is unchanged. Requests without it are assigned randomly.
+	HashHeader string
+}
+
+// ProcessorFactory creates blue/green processors.
+type ProcessorFactory struct {
+	cfg        Config
+	controller *Controller
+	log        zerolog.Logger
+}
+
+// NewProcessorFactory creates a new blue/green ProcessorFactory.
+func NewProcessorFactory(cfg Config, controller *Controller, log zerolog.Logger) *ProcessorFactory {
+	if cfg.Header == "" {
+		cfg.Header = "x-deployment-variant"
+	}
+	cfg.Header = strings.ToLower(cfg.Header)
+	return &ProcessorFactory{
+		cfg:        cfg,
+		controller: controller,
+		log:        log.With().Str("processor", "bluegreen").Logger(),
+	}
+}
+
+// NewProcessor creates a new blue/green processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+}
+
+// ProcessRequestHeaders assigns the request to a variant and sets the
+// routing header, overwriting any the client sent.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	var bucket uint64
+	if key := ctx.Headers.Get(f.cfg.HashHeader); f.cfg.HashHeader != "" && key != "" {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		bucket = h.Sum64() % 10000
+	} else {
+		bucket = rand.Uint64N(10000)
+	}
+	green := f.controller.isGreen(bucket)
+	f.controller.count(green)
+
+	variant := VariantBlue
+	if green {
+		variant = VariantGreen
+	}
+	return &extproc.ProcessingResult{
+		Status: extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{
+			SetHeaders: []*envoy_api_v3_core.HeaderValueOption{extproc.SetHeader(f.cfg.Header, variant)},
+		},
+		// The header selects the route.
+		ClearRouteCache: true,
+	}
+}
+
+// Phases reports that only request headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
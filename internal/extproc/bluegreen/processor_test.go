@@ -0,0 +1,127 @@
+package bluegreen
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/adminauth"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+func assign(t *testing.T, f *ProcessorFactory, headers ...string) string {
+	t.Helper()
+	result := f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, append(headers, "x-deployment-variant", "green")...))
+	extproctest.Check(t, result, extproctest.ExpectContinue())
+	if !result.ClearRouteCache {
+		t.Fatal("route cache not cleared")
+	}
+	return string(result.HeaderMutations.SetHeaders[0].GetHeader().GetRawValue())
+}
+
+func TestProcessRequestHeaders(t *testing.T) {
+	c, err := NewController("", 0, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewProcessorFactory(Config{HashHeader: "x-user-id"}, c, zerolog.Nop())
+
+	for range 100 {
+		if v := assign(t, f); v != VariantBlue {
+			t.Fatalf("0%% green assigned %s", v)
+		}
+	}
+
+	if err := c.SetGreenPercent(30); err != nil {
+		t.Fatal(err)
+	}
+	const n = 10000
+	for i := range n {
+		assign(t, f, "x-user-id", fmt.Sprintf("user-%d", i))
+	}
+	status := c.Status()
+	if status.Assigned[VariantBlue]+status.Assigned[VariantGreen] != n {
+		t.Fatalf("counts not reset on change: %v", status.Assigned)
+	}
+	if got := *status.ObservedGreenPercent; got < 27 || got > 33 {
+		t.Errorf("observed green = %v%%, want about 30%%", got)
+	}
+
+	// A hashed client stays on its variant.
+	first := assign(t, f, "x-user-id", "alice")
+	for range 10 {
+		if v := assign(t, f, "x-user-id", "alice"); v != first {
+			t.Fatalf("client moved from %s to %s", first, v)
+		}
+	}
+}
+
+func TestControllerPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bluegreen.json")
+	c, err := NewController(path, 10, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	put := func(body string) int {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := put(`{"green_percent": 150}`); code != http.StatusBadRequest {
+		t.Fatalf("out of range: status %d", code)
+	}
+	if code := put(`{}`); code != http.StatusBadRequest {
+		t.Fatalf("missing field: status %d", code)
+	}
+	if code := put(`{"green_percent": 75.5}`); code != http.StatusOK {
+		t.Fatalf("valid update: status %d", code)
+	}
+
+	restarted, err := NewController(path, 10, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.Status().GreenPercent; got != 75.5 {
+		t.Fatalf("restored green = %v, want 75.5", got)
+	}
+}
+
+func TestControllerRefusesUnauthenticatedPUT(t *testing.T) {
+	c, err := NewController("", 10, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := adminauth.Require(adminauth.Config{Token: "s3cret"}, c)
+	put := func(authorization string) int {
+		r := httptest.NewRequest(http.MethodPut, "/admin/bluegreen", strings.NewReader(`{"green_percent": 100}`))
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := put(""); code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated PUT: status %d", code)
+	}
+	if got := c.Status().GreenPercent; got != 10 {
+		t.Fatalf("green = %v after a refused PUT, want 10", got)
+	}
+	if code := put("Bearer s3cret"); code != http.StatusOK {
+		t.Fatalf("authenticated PUT: status %d", code)
+	}
+	if got := c.Status().GreenPercent; got != 100 {
+		t.Errorf("green = %v, want 100", got)
+	}
+}
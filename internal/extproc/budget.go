@@ -0,0 +1,26 @@
+package extproc
+
+import (
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+)
+
+// shedBuffering turns off body processing for the rest of the stream when
+// the budget is exceeded, so Envoy stops sending (and buffering) bodies for
+// it. Envoy honors this only with allow_mode_override. The override goes on a
+// copy of result, which a processor may share between streams.
+func (s *Server) shedBuffering(result *ProcessingResult) *ProcessingResult {
+	if result == nil || result.ImmediateResponse != nil || !s.budget.Shed() {
+		return result
+	}
+	mode := &envoy_extensions_ext_proc_v3.ProcessingMode{}
+	if result.ModeOverride != nil {
+		mode.RequestHeaderMode = result.ModeOverride.GetRequestHeaderMode()
+		mode.ResponseHeaderMode = result.ModeOverride.GetResponseHeaderMode()
+		mode.RequestTrailerMode = result.ModeOverride.GetRequestTrailerMode()
+		mode.ResponseTrailerMode = result.ModeOverride.GetResponseTrailerMode()
+	}
+	shed := *result
+	shed.ModeOverride = mode
+	s.log.Debug().Int64("used", s.budget.Used()).Msg("memory budget exceeded, switching stream to passthrough")
+	return &shed
+}
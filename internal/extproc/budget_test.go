@@ -0,0 +1,33 @@
+package extproc
+
+import (
+	"testing"
+
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/rs/zerolog"
+)
+
+func TestShedBufferingCopiesResult(t *testing.T) {
+	budget := NewMemoryBudget(10)
+	s := NewServer(&countingFactory{}, zerolog.Nop(), WithMemoryBudget(budget))
+
+	shared := &ProcessingResult{}
+	if got := s.shedBuffering(shared); got != shared {
+		t.Fatal("result replaced while the budget is not exceeded")
+	}
+
+	account := budget.NewAccount()
+	account.Charge(10)
+	defer account.Release(10)
+	got := s.shedBuffering(shared)
+	if got == shared {
+		t.Fatal("shed result is the processor's result")
+	}
+	if shared.ModeOverride != nil {
+		t.Errorf("processor's result modified: %v", shared.ModeOverride)
+	}
+	if got.ModeOverride.GetRequestBodyMode() != envoy_extensions_ext_proc_v3.ProcessingMode_NONE ||
+		got.ModeOverride.GetResponseBodyMode() != envoy_extensions_ext_proc_v3.ProcessingMode_NONE {
+		t.Errorf("body modes not shed: %v", got.ModeOverride)
+	}
+}
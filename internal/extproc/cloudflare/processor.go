@@ -0,0 +1,126 @@
+// Package cloudflare provides an ext_proc processor that validates requests
+// arriving through Cloudflare and sets the real client IP headers.
+package cloudflare
+
+import (
+	"fmt"
+	"net/netip"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+)
+
+const (
+	HeaderTrusted          = "x-forwarded-from-cloudflare"
+	HeaderDownstreamRealIP = "cf-connecting-ip"
+	HeaderXFF              = "x-forwarded-for"
+	HeaderXRealIP          = "x-real-ip"
+)
+
+// TrustLevel indicates whether a request is from a Cloudflare edge address.
+type TrustLevel string
+
+const (
+	TrustLevelNo      TrustLevel = "no"
+	TrustLevelYes     TrustLevel = "yes"
+	TrustLevelUnknown TrustLevel = "unknown"
+)
+
+// Validator checks if an IP address belongs to Cloudflare's network.
+type Validator interface {
+	IsCloudflareIP(ip netip.Addr) (bool, error)
+}
+
+// ProcessorFactory creates Cloudflare processors.
+type ProcessorFactory struct {
+	validator Validator
+	log       zerolog.Logger
+}
+
+// NewProcessorFactory creates a new Cloudflare ProcessorFactory.
+func NewProcessorFactory(validator Validator, log zerolog.Logger) *ProcessorFactory {
+	return &ProcessorFactory{
+		validator: validator,
+		log:       log.With().Str("processor", "cloudflare").Logger(),
+	}
+}
+
+// NewProcessor creates a new Cloudflare processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{
+		validator: f.validator,
+		log:       f.log,
+	}
+}
+
+// Processor handles Cloudflare IP validation for a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	validator Validator
+	log       zerolog.Logger
+}
+
+// ProcessRequestHeaders validates the source IP and sets trust headers.
+// Only a Cloudflare peer's CF-Connecting-IP is believed; anyone else gets
+// X-Forwarded-For and X-Real-IP overwritten with their own address.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	remoteIP, err := ctx.GetDownstreamRemoteIP()
+	if err != nil {
+		p.log.Warn().Err(err).Msg("failed to get downstream remote IP")
+		return extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
+			extproc.SetHeader(HeaderTrusted, string(TrustLevelUnknown)),
+		})
+	}
+
+	trusted, err := p.validator.IsCloudflareIP(remoteIP)
+	if err != nil {
+		p.log.Error().
+			Err(err).
+			Str("remote_ip", remoteIP.String()).
+			Msg("cloudflare validation failed")
+	}
+
+	remoteIPStr := remoteIP.String()
+	untrusted := func(level TrustLevel) *extproc.ProcessingResult {
+		return extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
+			extproc.SetHeader(HeaderTrusted, string(level)),
+			extproc.SetHeader(HeaderXFF, remoteIPStr),
+			extproc.SetHeader(HeaderXRealIP, remoteIPStr),
+		})
+	}
+	if err != nil || !trusted {
+		return untrusted(TrustLevelNo)
+	}
+
+	downstreamRaw := ctx.Headers.Get(HeaderDownstreamRealIP)
+	downstreamIP, err := extproc.ParseIPFromAddress(downstreamRaw)
+	if err != nil {
+		p.log.Warn().
+			Err(err).
+			Str("header", HeaderDownstreamRealIP).
+			Str("remote_ip", remoteIPStr).
+			Msg("cloudflare missing or invalid header")
+		return untrusted(TrustLevelYes)
+	}
+	downstreamIPStr := downstreamIP.String()
+	return extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader(HeaderTrusted, string(TrustLevelYes)),
+		extproc.SetHeader(HeaderXFF, fmt.Sprintf("%s, %s", downstreamIPStr, remoteIPStr)),
+		extproc.SetHeader(HeaderXRealIP, downstreamIPStr),
+	})
+}
+
+// Phases reports that only request headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
@@ -0,0 +1,264 @@
+// Package coalesce provides an ext_proc processor that collapses concurrent
+// identical GET requests into one upstream request, answering the others
+// with the winner's response.
+package coalesce
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+)
+
+// hopHeaders are not replayed to coalesced requests.
+var hopHeaders = []string{
+	"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade",
+	"trailer", "te", "content-length", "set-cookie",
+}
+
+// Config holds request coalescing settings.
+type Config struct {
+	// Routes are the path prefixes eligible for coalescing.
+	Routes []string
+	// MaxWait bounds how long a parked request waits for the winner before
+	// going upstream itself.
+	MaxWait time.Duration
+	// VaryHeaders are request headers included in the coalescing key.
+	VaryHeaders []string
+	// IncludeAuthenticated also coalesces requests carrying Authorization or
+	// Cookie headers, keyed by those headers.
+	IncludeAuthenticated bool
+	// MarkerHeader, if set, is added to coalesced responses.
+	MarkerHeader string
+}
+
+// response is a completed upstream response shared with parked requests.
+type response struct {
+	status  int
+	headers []*envoy_api_v3_core.HeaderValueOption
+	body    []byte
+}
+
+// flight is an upstream request other requests can wait on.
+type flight struct {
+	done chan struct{}
+	// resp is nil when the response cannot be shared.
+	resp *response
+}
+
+// ProcessorFactory creates coalescing processors.
+type ProcessorFactory struct {
+	cfg Config
+	log zerolog.Logger
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// NewProcessorFactory creates a new coalescing ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	return &ProcessorFactory{
+		cfg:     cfg,
+		log:     log.With().Str("processor", "coalesce").Logger(),
+		flights: make(map[string]*flight),
+	}
+}
+
+// NewProcessor creates a new coalescing processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f, done: make(chan struct{})}
+}
+
+// Processor handles a single request, either as the leader of a flight or
+// as a parked follower.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	mu     sync.Mutex
+	key    string
+	flight *flight
+	resp   *response
+	end    sync.Once
+	done   chan struct{}
+}
+
+// ProcessRequestHeaders joins an in-flight identical request or starts one.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	key, ok := f.key(ctx.Headers)
+	if !ok {
+		return extproc.ContinueResult()
+	}
+
+	f.mu.Lock()
+	existing, inFlight := f.flights[key]
+	if !inFlight {
+		fl := &flight{done: make(chan struct{})}
+		f.flights[key] = fl
+		f.mu.Unlock()
+
+		p.mu.Lock()
+		p.key, p.flight = key, fl
+		p.mu.Unlock()
+
+		result := extproc.ContinueResult()
+		result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+			ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+			ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_BUFFERED_PARTIAL,
+			RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+			ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		}
+		return result
+	}
+	f.mu.Unlock()
+
+	timer := time.NewTimer(f.cfg.MaxWait)
+	defer timer.Stop()
+	select {
+	case <-existing.done:
+	case <-timer.C:
+		f.log.Debug().Str("key", key).Msg("coalesced request timed out, going upstream")
+		return extproc.ContinueResult()
+	case <-p.done:
+		return extproc.ContinueResult()
+	}
+	if existing.resp == nil {
+		return extproc.ContinueResult()
+	}
+
+	f.log.Debug().Str("key", key).Str("request_id", ctx.GetRequestID()).Msg("served coalesced response")
+	headers := existing.resp.headers
+	if f.cfg.MarkerHeader != "" {
+		headers = append(slices.Clip(headers), extproc.SetHeader(f.cfg.MarkerHeader, "true"))
+	}
+	return extproc.ImmediateResult(existing.resp.status, headers, existing.resp.body)
+}
+
+// ProcessResponseHeaders captures the leader's response headers.
+func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.flight == nil {
+		return extproc.ContinueResult()
+	}
+
+	status, err := strconv.Atoi(ctx.Headers.Get(":status"))
+	if err != nil || ctx.Headers.Get("set-cookie") != "" ||
+		extproc.IsStreamingContentType(ctx.Headers.Get("content-type")) ||
+		strings.Contains(strings.ToLower(ctx.Headers.Get("cache-control")), "private") {
+		p.finish(nil)
+		return extproc.ContinueResult()
+	}
+	resp := &response{status: status}
+	for name, values := range ctx.Headers {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, ":") || slices.Contains(hopHeaders, name) {
+			continue
+		}
+		for _, v := range values {
+			resp.headers = append(resp.headers, extproc.AppendHeader(name, v))
+		}
+	}
+	if ctx.EndOfStream {
+		p.finish(resp)
+		return extproc.ContinueResult()
+	}
+	p.resp = resp
+	return extproc.ContinueResult()
+}
+
+// ProcessResponseBody shares the leader's complete body. Bodies over
+// Envoy's buffer limit arrive partially and are not shared.
+func (p *Processor) ProcessResponseBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.flight == nil {
+		return extproc.ContinueResult()
+	}
+	if endOfStream && p.resp != nil {
+		p.resp.body = slices.Clone(body)
+		p.finish(p.resp)
+	} else {
+		p.finish(nil)
+	}
+	return extproc.ContinueResult()
+}
+
+// OnStreamEnd releases parked requests if the leader never completed, and
+// stops waiting if this request was parked.
+func (p *Processor) OnStreamEnd() {
+	p.end.Do(func() { close(p.done) })
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.flight != nil {
+		p.finish(nil)
+	}
+}
+
+// finish publishes resp to parked requests and retires the flight. The
+// caller holds p.mu.
+func (p *Processor) finish(resp *response) {
+	f := p.factory
+	f.mu.Lock()
+	if f.flights[p.key] == p.flight {
+		delete(f.flights, p.key)
+	}
+	f.mu.Unlock()
+
+	p.flight.resp = resp
+	close(p.flight.done)
+	p.flight, p.resp = nil, nil
+}
+
+// key returns the coalescing key of a request, or false if it is not
+// eligible.
+func (f *ProcessorFactory) key(h http.Header) (string, bool) {
+	if h.Get(":method") != http.MethodGet {
+		return "", false
+	}
+	path := h.Get(":path")
+	prefix, _, _ := strings.Cut(path, "?")
+	if !slices.ContainsFunc(f.cfg.Routes, func(route string) bool { return strings.HasPrefix(prefix, route) }) {
+		return "", false
+	}
+	cacheControl := strings.ToLower(h.Get("cache-control"))
+	if strings.Contains(cacheControl, "no-cache") || strings.Contains(cacheControl, "no-store") {
+		return "", false
+	}
+
+	vary := f.cfg.VaryHeaders
+	if h.Get("authorization") != "" || h.Get("cookie") != "" {
+		if !f.cfg.IncludeAuthenticated {
+			return "", false
+		}
+		vary = append(slices.Clip(vary), "authorization", "cookie")
+	}
+
+	var b strings.Builder
+	b.WriteString(h.Get(":authority"))
+	b.WriteString(path)
+	for _, name := range vary {
+		b.WriteByte('\n')
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(h.Values(name), ","))
+	}
+	return b.String(), true
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.StreamEndHandler.
+var _ extproc.StreamEndHandler = (*Processor)(nil)
@@ -0,0 +1,211 @@
+package coalesce
+
+import (
+	"net/http"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+var get = []string{":method", "GET", ":path", "/api/items?page=1", ":authority", "example.com"}
+
+func newFactory() *ProcessorFactory {
+	return NewProcessorFactory(Config{
+		Routes:       []string{"/api/"},
+		MaxWait:      time.Second,
+		VaryHeaders:  []string{"accept"},
+		MarkerHeader: "x-coalesced",
+	}, zerolog.Nop())
+}
+
+// lead starts a flight and checks that the processor leads it.
+func lead(t *testing.T, f *ProcessorFactory, headers ...string) extproc.Processor {
+	t.Helper()
+	p := f.NewProcessor()
+	result := p.ProcessRequestHeaders(extproctest.NewContext(nil, headers...))
+	extproctest.Check(t, result, extproctest.ExpectContinue())
+	if result.ModeOverride == nil {
+		t.Fatal("request did not lead a flight")
+	}
+	return p
+}
+
+// follow parks a request for headers and returns its processor and the
+// channel receiving its result. Call synctest.Wait before completing the
+// leader to be sure the request is parked.
+func follow(f *ProcessorFactory, headers ...string) (extproc.Processor, <-chan *extproc.ProcessingResult) {
+	p := f.NewProcessor()
+	results := make(chan *extproc.ProcessingResult, 1)
+	go func() { results <- p.ProcessRequestHeaders(extproctest.NewContext(nil, headers...)) }()
+	return p, results
+}
+
+func TestFollowerSharesResponse(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		f := newFactory()
+		leader := lead(t, f, get...)
+		_, results := follow(f, get...)
+		synctest.Wait()
+
+		leader.ProcessResponseHeaders(extproctest.NewContext(nil,
+			":status", "200", "content-type", "application/json", "content-length", "2", "x-upstream", "a"))
+		leader.ProcessResponseBody(nil, []byte("[]"), true)
+
+		result := <-results
+		extproctest.Check(t, result,
+			extproctest.ExpectDenied(http.StatusOK),
+			extproctest.ExpectHeaderSet("x-upstream", "a"),
+			extproctest.ExpectHeaderSet("x-coalesced", "true"),
+		)
+		if body := string(result.ImmediateResponse.GetBody()); body != "[]" {
+			t.Errorf("body = %q", body)
+		}
+		if _, ok := immediateHeader(result, "content-length"); ok {
+			t.Error("hop-by-hop content-length replayed")
+		}
+
+		// The flight is retired, so the next request leads its own.
+		lead(t, f, get...)
+	})
+}
+
+func TestKey(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		f := newFactory()
+		lead(t, f, get...)
+
+		// Requests differing in a vary header do not share a flight.
+		lead(t, f, append(get, "accept", "text/csv")...)
+
+		// Ineligible requests neither lead nor park.
+		for _, headers := range [][]string{
+			{":method", "POST", ":path", "/api/items?page=1", ":authority", "example.com"},
+			{":method", "GET", ":path", "/other", ":authority", "example.com"},
+			append(get, "cache-control", "no-cache"),
+			append(get, "authorization", "Bearer x"),
+			append(get, "cookie", "a=b"),
+		} {
+			result := f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, headers...))
+			if result.ImmediateResponse != nil || result.ModeOverride != nil {
+				t.Errorf("%q: %s", headers, extproctest.Describe(result))
+			}
+		}
+
+		// Authenticated requests are coalesced by their credentials if enabled.
+		f.cfg.IncludeAuthenticated = true
+		lead(t, f, append(get, "authorization", "Bearer x")...)
+		lead(t, f, append(get, "authorization", "Bearer y")...)
+	})
+}
+
+func TestMaxWait(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		f := newFactory()
+		lead(t, f, get...)
+		start := time.Now()
+		_, results := follow(f, get...)
+
+		// The leader never answers; the follower gives up after MaxWait.
+		result := <-results
+		if waited := time.Since(start); waited != f.cfg.MaxWait {
+			t.Errorf("waited %v, want %v", waited, f.cfg.MaxWait)
+		}
+		if result.ImmediateResponse != nil || result.ModeOverride != nil {
+			t.Errorf("timed out follower: %s", extproctest.Describe(result))
+		}
+	})
+}
+
+func TestLeaderStreamEnd(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		f := newFactory()
+		leader := lead(t, f, get...)
+		_, results := follow(f, get...)
+		synctest.Wait()
+
+		// The leader's stream ends before its response: the follower goes
+		// upstream at once instead of waiting out MaxWait.
+		start := time.Now()
+		leader.(extproc.StreamEndHandler).OnStreamEnd()
+		result := <-results
+		if time.Since(start) != 0 {
+			t.Errorf("follower waited %v after the leader ended", time.Since(start))
+		}
+		if result.ImmediateResponse != nil {
+			t.Errorf("follower answered: %s", extproctest.Describe(result))
+		}
+		lead(t, f, get...)
+	})
+}
+
+func TestFollowerStreamEnd(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		f := newFactory()
+		lead(t, f, get...)
+		follower, results := follow(f, get...)
+		synctest.Wait()
+
+		follower.(extproc.StreamEndHandler).OnStreamEnd()
+		if result := <-results; result.ImmediateResponse != nil {
+			t.Errorf("ended follower answered: %s", extproctest.Describe(result))
+		}
+	})
+}
+
+func TestNotShareable(t *testing.T) {
+	for name, tc := range map[string]struct {
+		headers []string
+		body    string
+		eos     bool
+	}{
+		"set-cookie":   {[]string{":status", "200", "set-cookie", "session=1"}, "[]", true},
+		"private":      {[]string{":status", "200", "cache-control", "private, max-age=60"}, "[]", true},
+		"streaming":    {[]string{":status", "200", "content-type", "text/event-stream"}, "data: x\n\n", true},
+		"partial body": {[]string{":status", "200"}, "[", false},
+		"bad status":   {[]string{":status", "ok"}, "[]", true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				f := newFactory()
+				leader := lead(t, f, get...)
+				_, results := follow(f, get...)
+				synctest.Wait()
+
+				leader.ProcessResponseHeaders(extproctest.NewContext(nil, tc.headers...))
+				leader.ProcessResponseBody(nil, []byte(tc.body), tc.eos)
+				if result := <-results; result.ImmediateResponse != nil {
+					t.Errorf("shared the response: %s", extproctest.Describe(result))
+				}
+				// The flight is retired either way.
+				lead(t, f, get...)
+			})
+		})
+	}
+}
+
+func TestHeadersOnlyResponse(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		f := newFactory()
+		leader := lead(t, f, get...)
+		_, results := follow(f, get...)
+		synctest.Wait()
+
+		ctx := extproctest.NewContext(nil, ":status", "204")
+		ctx.EndOfStream = true
+		leader.ProcessResponseHeaders(ctx)
+		extproctest.Check(t, <-results, extproctest.ExpectDenied(http.StatusNoContent))
+	})
+}
+
+func immediateHeader(r *extproc.ProcessingResult, key string) (string, bool) {
+	for _, opt := range r.ImmediateResponse.GetHeaders().GetSetHeaders() {
+		if opt.GetHeader().GetKey() == key {
+			return string(opt.GetHeader().GetRawValue()), true
+		}
+	}
+	return "", false
+}
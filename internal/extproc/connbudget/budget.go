@@ -0,0 +1,97 @@
+package connbudget
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// window counts what a client used in one fixed time window.
+type window struct {
+	index       int64
+	connections int
+	requests    int
+}
+
+// verdict is the outcome of charging a request to its client's window.
+type verdict struct {
+	// exceeded names the budget that was exhausted, "" when admitted.
+	exceeded  string
+	limit     int
+	remaining int
+	reset     time.Duration
+}
+
+// budgets tracks the windows of clients and the connections already
+// admitted, both bounded by LRU eviction.
+type budgets struct {
+	mu          sync.Mutex
+	windows     *lru.Cache[string, *window]
+	connections *lru.Cache[string, struct{}]
+}
+
+func newBudgets(size int) (*budgets, error) {
+	windows, err := lru.New[string, *window](size)
+	if err != nil {
+		return nil, cacheError(err, size)
+	}
+	connections, err := lru.New[string, struct{}](size)
+	if err != nil {
+		return nil, cacheError(err, size)
+	}
+	return &budgets{windows: windows, connections: connections}, nil
+}
+
+func cacheError(err error, size int) error {
+	return oops.
+		In("connbudget").
+		Code(errcode.CacheInitFailed).
+		With("size", size).
+		Wrapf(err, "failed to create budget cache")
+}
+
+// charge counts a request of client, on connection conn if known, against
+// the budgets of the window containing now. A connection not seen before
+// is new and also counts against maxConnections. Rejected requests are not
+// counted, and their connection stays new.
+func (b *budgets) charge(client, conn string, now time.Time, period time.Duration, maxConnections, maxRequests int) verdict {
+	index := now.UnixNano() / int64(period)
+	reset := time.Duration((index+1)*int64(period) - now.UnixNano())
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w, ok := b.windows.Get(client)
+	if !ok || w.index != index {
+		w = &window{index: index}
+		b.windows.Add(client, w)
+	}
+	newConn := false
+	if conn != "" {
+		newConn = !b.connections.Contains(conn)
+	}
+
+	v := verdict{reset: reset}
+	switch {
+	case newConn && maxConnections > 0 && w.connections >= maxConnections:
+		v.exceeded, v.limit = "connection", maxConnections
+		return v
+	case maxRequests > 0 && w.requests >= maxRequests:
+		v.exceeded, v.limit = "request", maxRequests
+		return v
+	}
+	if newConn {
+		b.connections.Add(conn, struct{}{})
+		w.connections++
+	}
+	w.requests++
+
+	// Report the budget closest to running out.
+	v.limit, v.remaining = maxRequests, maxRequests-w.requests
+	if maxConnections > 0 && (maxRequests == 0 || maxConnections-w.connections < v.remaining) {
+		v.limit, v.remaining = maxConnections, maxConnections-w.connections
+	}
+	return v
+}
@@ -0,0 +1,197 @@
+// Package connbudget provides an ext_proc processor that enforces per-IP
+// budgets of new connections and requests per fixed time window, using the
+// downstream connection ID and local address Envoy sends as attributes.
+// It complements L4 connection limits at the HTTP layer, answering clients
+// over budget with 429 and the headers of the rate limit processor.
+package connbudget
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/ratelimit"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Attributes read by the processor; Envoy must be asked to send them.
+const (
+	AttrConnectionID = "connection.id"
+	AttrLocalAddress = "destination.address"
+)
+
+// Config holds connection budget settings.
+type Config struct {
+	// Window is the length of the fixed time windows budgets apply to.
+	Window time.Duration
+	// Connections is the number of new downstream connections a client IP
+	// may open per window; 0 disables the budget.
+	Connections int
+	// Requests is the number of requests a client IP may send per window;
+	// 0 disables the budget.
+	Requests int
+	// PerListener keeps separate budgets per local address, so listeners
+	// or ports do not share a client's budget.
+	PerListener bool
+	// CacheSize bounds the client windows and the admitted connections
+	// tracked.
+	CacheSize int
+	// ResponseHeaders adds x-ratelimit-limit/remaining/reset to responses
+	// of admitted requests.
+	ResponseHeaders bool
+	// DecisionMode selects whether requests over budget are rejected.
+	DecisionMode extproc.DecisionMode
+}
+
+// ProcessorFactory creates connection budget processors.
+type ProcessorFactory struct {
+	cfg     Config
+	budgets *budgets
+	clock   clock.Clock
+	log     zerolog.Logger
+	decider extproc.Decider
+}
+
+// Option configures a ProcessorFactory.
+type Option func(*ProcessorFactory)
+
+// WithClock sets the clock windows are measured on.
+func WithClock(c clock.Clock) Option {
+	return func(f *ProcessorFactory) {
+		f.clock = clock.Or(c)
+	}
+}
+
+// NewProcessorFactory creates a new connection budget ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger, opts ...Option) (*ProcessorFactory, error) {
+	if cfg.Window <= 0 {
+		return nil, oops.
+			In("connbudget").
+			Code(errcode.InvalidConfig).
+			With("window", cfg.Window).
+			Errorf("budget window must be positive")
+	}
+	if cfg.Connections <= 0 && cfg.Requests <= 0 {
+		return nil, oops.
+			In("connbudget").
+			Code(errcode.InvalidConfig).
+			Errorf("neither a connection nor a request budget is configured")
+	}
+	budgets, err := newBudgets(cfg.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	f := &ProcessorFactory{
+		cfg:     cfg,
+		budgets: budgets,
+		clock:   clock.Real,
+		log:     log.With().Str("processor", "connbudget").Logger(),
+	}
+	f.decider = extproc.NewDecider("connbudget", cfg.DecisionMode, f.log)
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f, nil
+}
+
+// NewProcessor creates a new connection budget processor for a single
+// request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor charges a single request to its client's budgets.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	decision *ratelimit.Decision
+}
+
+// ProcessRequestHeaders charges the request, and its connection when Envoy
+// sees it for the first time, to the client IP's window and rejects it when
+// a budget is exhausted. Requests without a client IP are let through;
+// without a connection ID only the request budget applies.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	ip, err := ctx.GetDownstreamRemoteIP()
+	if err != nil {
+		f.log.Debug().Err(err).Str("request_id", ctx.GetRequestID()).Msg("request has no client IP, not budgeting")
+		return extproc.ContinueResult()
+	}
+	client := ip.String()
+	if f.cfg.PerListener {
+		client = attribute(ctx, AttrLocalAddress) + "|" + client
+	}
+	conn := ""
+	if id := attribute(ctx, AttrConnectionID); id != "" {
+		// Connection IDs are only unique per Envoy instance; the client's
+		// address and port tell apart connections of different instances.
+		source, _ := ctx.GetEnvoyAttributeValue("source.address")
+		conn = id + "|" + source.GetStringValue() + "|" + attribute(ctx, AttrLocalAddress)
+	}
+
+	v := f.budgets.charge(client, conn, f.clock.Now(), f.cfg.Window, f.cfg.Connections, f.cfg.Requests)
+	decision := ratelimit.Decision{
+		Allowed:    v.exceeded == "",
+		Limit:      ratelimit.Limit{Requests: uint32(v.limit), Per: f.cfg.Window},
+		Remaining:  uint32(max(v.remaining, 0)),
+		ResetAfter: v.reset,
+	}
+	if decision.Allowed {
+		p.decision = &decision
+		return extproc.ContinueResult()
+	}
+
+	f.log.Info().
+		Str("client", client).
+		Str("budget", v.exceeded).
+		Int("limit", v.limit).
+		Str("request_id", ctx.GetRequestID()).
+		Msg("connection budget exhausted")
+	headers := []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("retry-after", strconv.FormatInt(int64(max(1, math.Ceil(v.reset.Seconds()))), 10)),
+	}
+	headers = append(headers, rateLimitHeaders(decision)...)
+	return f.decider.Reject(ctx.GetRequestID(), v.exceeded+"_budget",
+		extproc.ImmediateResult(http.StatusTooManyRequests, headers, []byte(v.exceeded+" budget exhausted\n")), nil)
+}
+
+// ProcessResponseHeaders adds the remaining budget of the request's client.
+func (p *Processor) ProcessResponseHeaders(*extproc.RequestContext) *extproc.ProcessingResult {
+	if p.decision == nil || !p.factory.cfg.ResponseHeaders {
+		return extproc.ContinueResult()
+	}
+	return extproc.ContinueWithHeaders(rateLimitHeaders(*p.decision))
+}
+
+func rateLimitHeaders(d ratelimit.Decision) []*envoy_api_v3_core.HeaderValueOption {
+	var opts []*envoy_api_v3_core.HeaderValueOption
+	for _, h := range ratelimit.RateLimitHeaders(d) {
+		opts = append(opts, extproc.SetHeader(h.Key, h.Value))
+	}
+	return opts
+}
+
+// attribute returns an Envoy attribute as a string, formatting numbers
+// such as connection.id as integers; "" if it is missing.
+func attribute(ctx *extproc.RequestContext, key string) string {
+	value, ok := ctx.GetEnvoyAttributeValue(key)
+	if !ok {
+		return ""
+	}
+	switch v := value.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return v.StringValue
+	case *structpb.Value_NumberValue:
+		return strconv.FormatUint(uint64(v.NumberValue), 10)
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package connbudget
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+func newFactory(t *testing.T, cfg Config) (*ProcessorFactory, *clock.Fake) {
+	t.Helper()
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	cfg.Window = time.Minute
+	cfg.CacheSize = 16
+	cfg.ResponseHeaders = true
+	factory, err := NewProcessorFactory(cfg, zerolog.Nop(), WithClock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return factory, clk
+}
+
+// request sends the request headers of a request on connection id from
+// the client source, e.g. "203.0.113.7:4711", to local.
+func request(factory *ProcessorFactory, source, local, id string) *extproc.ProcessingResult {
+	attrs := map[string]string{"source.address": source, AttrLocalAddress: local}
+	if id != "" {
+		attrs[AttrConnectionID] = id
+	}
+	return factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(attrs, ":method", "GET", ":path", "/"))
+}
+
+func TestConnectionBudget(t *testing.T) {
+	factory, clk := newFactory(t, Config{Connections: 2})
+	const local = "10.0.0.1:443"
+
+	// Requests on admitted connections are not new connections.
+	for range 3 {
+		extproctest.Check(t, request(factory, "203.0.113.7:1000", local, "1"), extproctest.ExpectContinue())
+	}
+	extproctest.Check(t, request(factory, "203.0.113.7:1001", local, "2"), extproctest.ExpectContinue())
+	extproctest.Check(t, request(factory, "203.0.113.7:1002", local, "3"),
+		extproctest.ExpectDenied(429),
+		extproctest.ExpectHeaderSet("retry-after", "40"),
+		extproctest.ExpectHeaderSet("x-ratelimit-limit", "2"),
+		extproctest.ExpectHeaderSet("x-ratelimit-remaining", "0"),
+		extproctest.ExpectHeaderSet("x-ratelimit-reset", "40"),
+	)
+	extproctest.Check(t, request(factory, "203.0.113.7:1000", local, "1"), extproctest.ExpectContinue())
+	extproctest.Check(t, request(factory, "203.0.113.8:1000", local, "4"), extproctest.ExpectContinue())
+
+	// The rejected connection is still new in the next window.
+	clk.Advance(40 * time.Second)
+	extproctest.Check(t, request(factory, "203.0.113.7:1002", local, "3"), extproctest.ExpectContinue())
+	extproctest.Check(t, request(factory, "203.0.113.7:1003", local, "5"), extproctest.ExpectContinue())
+	extproctest.Check(t, request(factory, "203.0.113.7:1004", local, "6"), extproctest.ExpectDenied(429))
+}
+
+func TestRequestBudget(t *testing.T) {
+	factory, _ := newFactory(t, Config{Requests: 2, PerListener: true})
+
+	extproctest.Check(t, request(factory, "203.0.113.7:1000", "10.0.0.1:443", ""), extproctest.ExpectContinue())
+	extproctest.Check(t, request(factory, "203.0.113.7:1000", "10.0.0.1:443", ""), extproctest.ExpectContinue())
+	extproctest.Check(t, request(factory, "203.0.113.7:1000", "10.0.0.1:443", ""), extproctest.ExpectDenied(429))
+	// Listeners have their own budgets.
+	extproctest.Check(t, request(factory, "203.0.113.7:1000", "10.0.0.1:8443", ""), extproctest.ExpectContinue())
+}
+
+func TestResponseHeaders(t *testing.T) {
+	factory, _ := newFactory(t, Config{Connections: 2, Requests: 10})
+	p := factory.NewProcessor()
+	ctx := extproctest.NewContext(map[string]string{"source.address": "203.0.113.7:1000", AttrConnectionID: "1"})
+	extproctest.Check(t, p.ProcessRequestHeaders(ctx), extproctest.ExpectContinue())
+	// The connection budget is closer to running out.
+	extproctest.Check(t, p.ProcessResponseHeaders(extproctest.NewContext(nil, ":status", "200")),
+		extproctest.ExpectHeaderSet("x-ratelimit-limit", "2"),
+		extproctest.ExpectHeaderSet("x-ratelimit-remaining", "1"),
+		extproctest.ExpectHeaderSet("x-ratelimit-reset", "40"),
+	)
+}
@@ -0,0 +1,135 @@
+// Package deprecation provides an ext_proc processor that announces API
+// deprecation and sunset dates and optionally rejects sunset endpoints.
+package deprecation
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/match"
+	"github.com/rs/zerolog"
+)
+
+// ProcessorFactory creates deprecation processors.
+type ProcessorFactory struct {
+	rules             atomic.Pointer[Rules]
+	rejectAfterSunset bool
+	clock             clock.Clock
+	log               zerolog.Logger
+}
+
+// Option configures a ProcessorFactory.
+type Option func(*ProcessorFactory)
+
+// WithRejectAfterSunset answers requests to sunset routes with 410 Gone,
+// unless the route overrides it.
+func WithRejectAfterSunset(reject bool) Option {
+	return func(f *ProcessorFactory) {
+		f.rejectAfterSunset = reject
+	}
+}
+
+// WithClock sets the clock sunset dates are compared with.
+func WithClock(c clock.Clock) Option {
+	return func(f *ProcessorFactory) {
+		f.clock = clock.Or(c)
+	}
+}
+
+// NewProcessorFactory creates a new deprecation ProcessorFactory.
+func NewProcessorFactory(rules *Rules, log zerolog.Logger, opts ...Option) *ProcessorFactory {
+	f := &ProcessorFactory{
+		clock: clock.Real,
+		log:   log.With().Str("processor", "deprecation").Logger(),
+	}
+	f.rules.Store(rules)
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// SetRules replaces the rules used by new requests.
+func (f *ProcessorFactory) SetRules(rules *Rules) {
+	f.rules.Store(rules)
+}
+
+// NewProcessor creates a new deprecation processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	route *Route
+}
+
+// ProcessRequestHeaders matches the route and rejects sunset endpoints.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	ip, _ := ctx.GetDownstreamRemoteIP()
+	req := match.NewRequest(ctx.Headers, ip)
+	route, ok := f.rules.Load().Match(req)
+	if !ok {
+		return extproc.ContinueResult()
+	}
+	p.route = route
+
+	reject := f.rejectAfterSunset
+	if route.RejectAfterSunset != nil {
+		reject = *route.RejectAfterSunset
+	}
+	if !reject || route.Sunset == nil || f.clock.Now().Before(*route.Sunset) {
+		return extproc.ContinueResult()
+	}
+
+	f.log.Info().
+		Str("path", req.Path).
+		Str("route", route.Prefix).
+		Time("sunset", *route.Sunset).
+		Str("request_id", ctx.GetRequestID()).
+		Msg("rejected request to sunset endpoint")
+	body := "this endpoint was sunset on " + route.Sunset.UTC().Format(time.DateOnly)
+	if route.Successor != "" {
+		body += "; use " + route.Successor + " instead"
+	}
+	return extproc.ImmediateResult(http.StatusGone, headerOptions(route.Headers()), []byte(body+"\n"))
+}
+
+// ProcessResponseHeaders adds the lifecycle headers to responses of
+// deprecated routes.
+func (p *Processor) ProcessResponseHeaders(*extproc.RequestContext) *extproc.ProcessingResult {
+	if p.route == nil {
+		return extproc.ContinueResult()
+	}
+	return extproc.ContinueWithHeaders(headerOptions(p.route.Headers()))
+}
+
+// headerOptions converts h to header mutations, appending Link values to
+// any the upstream already sent and overwriting the rest.
+func headerOptions(h http.Header) []*envoy_api_v3_core.HeaderValueOption {
+	var opts []*envoy_api_v3_core.HeaderValueOption
+	for name, values := range h {
+		for _, v := range values {
+			if name == "Link" {
+				opts = append(opts, extproc.AppendHeader(name, v))
+			} else {
+				opts = append(opts, extproc.SetHeader(name, v))
+			}
+		}
+	}
+	return opts
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
@@ -0,0 +1,134 @@
+package deprecation
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+const testRules = `
+routes:
+  - prefix: /v1/
+    deprecation: 2024-01-01T00:00:00Z
+    sunset: 2025-01-01T00:00:00Z
+    link: https://docs.example.com/v1
+    successor: /v2/
+  - prefix: /v1/reports
+    methods: [get]
+    deprecation: 2024-06-01T00:00:00Z
+  - prefix: /legacy/
+    sunset: 2024-01-01T00:00:00Z
+    reject_after_sunset: false
+`
+
+func newFactory(t *testing.T, now time.Time, opts ...Option) *ProcessorFactory {
+	t.Helper()
+	rules, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProcessorFactory(rules, zerolog.Nop(), append(opts, WithClock(clock.NewFake(now)))...)
+}
+
+func respond(f *ProcessorFactory, method, path string) (request, response *extproc.ProcessingResult) {
+	p := f.NewProcessor()
+	request = p.ProcessRequestHeaders(extproctest.NewContext(nil, ":method", method, ":path", path))
+	if request.ImmediateResponse != nil {
+		return request, nil
+	}
+	return request, p.ProcessResponseHeaders(extproctest.NewContext(nil, ":status", "200"))
+}
+
+func TestLifecycleHeaders(t *testing.T) {
+	f := newFactory(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), WithRejectAfterSunset(true))
+
+	_, response := respond(f, "POST", "/v1/orders")
+	extproctest.Check(t, response,
+		extproctest.ExpectContinue(),
+		extproctest.ExpectHeaderSet("Deprecation", "@1704067200"),
+		extproctest.ExpectHeaderSet("Sunset", "Wed, 01 Jan 2025 00:00:00 GMT"),
+		extproctest.ExpectHeaderSet("Link", `</v2/>; rel="successor-version"`),
+	)
+	// Link values are added to the upstream's rather than replacing them.
+	links := 0
+	for _, opt := range response.HeaderMutations.SetHeaders {
+		if opt.GetHeader().GetKey() != "link" {
+			continue
+		}
+		links++
+		if opt.GetAppendAction() != envoy_api_v3_core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD {
+			t.Errorf("Link %q overwrites the upstream's", opt.GetHeader().GetRawValue())
+		}
+	}
+	if links != 3 {
+		t.Errorf("got %d Link values, want 3", links)
+	}
+
+	// The longest prefix wins, but only for its methods.
+	_, response = respond(f, "GET", "/v1/reports/7")
+	extproctest.Check(t, response, extproctest.ExpectHeaderSet("Deprecation", "@1717200000"))
+	_, response = respond(f, "DELETE", "/v1/reports/7")
+	extproctest.Check(t, response, extproctest.ExpectHeaderSet("Deprecation", "@1704067200"))
+
+	_, response = respond(f, "GET", "/v2/orders")
+	if response.HeaderMutations != nil {
+		t.Errorf("undeprecated route: %s", extproctest.Describe(response))
+	}
+}
+
+func TestRejectAfterSunset(t *testing.T) {
+	f := newFactory(t, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC), WithRejectAfterSunset(true))
+
+	request, _ := respond(f, "GET", "/v1/orders")
+	extproctest.Check(t, request,
+		extproctest.ExpectDenied(http.StatusGone),
+		extproctest.ExpectHeaderSet("Sunset", "Wed, 01 Jan 2025 00:00:00 GMT"),
+	)
+	if body := string(request.ImmediateResponse.GetBody()); body != "this endpoint was sunset on 2025-01-01; use /v2/ instead\n" {
+		t.Errorf("body = %q", body)
+	}
+
+	// Routes can opt out, and rejection is off by default.
+	request, _ = respond(f, "GET", "/legacy/x")
+	extproctest.Check(t, request, extproctest.ExpectContinue())
+	request, _ = respond(newFactory(t, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)), "GET", "/v1/orders")
+	extproctest.Check(t, request, extproctest.ExpectContinue())
+}
+
+// TestRoutePerRequest checks that a request on a reused stream does not
+// get the headers of the previous request's route.
+func TestRoutePerRequest(t *testing.T) {
+	f := newFactory(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC))
+	sent := extproctest.Run(t, f,
+		extproctest.RequestHeaders(nil, ":method", "GET", ":path", "/v1/orders"),
+		extproctest.ResponseHeaders(":status", "200"),
+		extproctest.RequestHeaders(nil, ":method", "GET", ":path", "/v2/orders"),
+		extproctest.ResponseHeaders(":status", "200"),
+	)
+	if sent[1].GetResponseHeaders().GetResponse().GetHeaderMutation() == nil {
+		t.Error("deprecated route got no headers")
+	}
+	if mutation := sent[3].GetResponseHeaders().GetResponse().GetHeaderMutation(); mutation != nil {
+		t.Errorf("undeprecated route got %v", mutation)
+	}
+}
+
+func TestParseRulesRejectsInvalid(t *testing.T) {
+	for rules, code := range map[string]errcode.Code{
+		"routes: [{prefix: v1, sunset: 2025-01-01T00:00:00Z}]": errcode.InvalidRules,
+		"routes: [{prefix: /v1}]":                              errcode.InvalidRules,
+		"routes: [{prefix: /v1, deprecation: 2025-01-01T00:00:00Z, sunset: 2024-01-01T00:00:00Z}]": errcode.InvalidRules,
+		"routes: [{prefix: /v1, sunset: 2025-01-01T00:00:00Z, match: {ips: [nope]}}]":              errcode.InvalidMatch,
+	} {
+		if _, err := ParseRules([]byte(rules)); !errcode.Is(err, code) {
+			t.Errorf("ParseRules(%q) error = %v, want %s", rules, err, code)
+		}
+	}
+}
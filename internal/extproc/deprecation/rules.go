@@ -0,0 +1,146 @@
+package deprecation
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/match"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+)
+
+// Rules is the route to deprecation mapping file.
+type Rules struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// Route describes the lifecycle of the endpoints under Prefix.
+type Route struct {
+	Prefix string `yaml:"prefix"`
+	// Methods restricts the route to these methods; empty matches all.
+	Methods []string `yaml:"methods,omitempty"`
+	// Deprecation is when the endpoints were (or will be) deprecated.
+	Deprecation *time.Time `yaml:"deprecation,omitempty"`
+	// Sunset is when the endpoints stop being served.
+	Sunset *time.Time `yaml:"sunset,omitempty"`
+	// Link points to human-readable deprecation information.
+	Link string `yaml:"link,omitempty"`
+	// Successor points to the replacing endpoint or version.
+	Successor string `yaml:"successor,omitempty"`
+	// RejectAfterSunset overrides the global rejection setting.
+	RejectAfterSunset *bool `yaml:"reject_after_sunset,omitempty"`
+	// Match narrows the route further, e.g. to some hosts or clients (see
+	// package match).
+	Match *match.Spec `yaml:"match,omitempty"`
+
+	matcher *match.Matcher
+}
+
+// LoadRules reads and validates a YAML mapping file or ConfigMap/Secret
+// reference (see kube.ParseRef).
+func LoadRules(path string) (*Rules, error) {
+	data, err := kube.ReadFile(context.Background(), path)
+	if err != nil {
+		return nil, oops.
+			In("deprecation").
+			Code(errcode.ReadRulesFailed).
+			With("path", path).
+			Wrapf(err, "failed to read deprecation rules")
+	}
+	return ParseRules(data)
+}
+
+// ParseRules parses and validates a YAML mapping.
+func ParseRules(data []byte) (*Rules, error) {
+	var rules Rules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, oops.
+			In("deprecation").
+			Code(errcode.ParseRulesFailed).
+			Wrapf(err, "failed to parse deprecation rules")
+	}
+	for i, r := range rules.Routes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, oops.
+				In("deprecation").
+				Code(errcode.InvalidRules).
+				With("index", i).
+				With("prefix", r.Prefix).
+				Errorf("route prefix must start with '/'")
+		}
+		if r.Deprecation == nil && r.Sunset == nil {
+			return nil, oops.
+				In("deprecation").
+				Code(errcode.InvalidRules).
+				With("prefix", r.Prefix).
+				Errorf("route needs a deprecation or sunset date")
+		}
+		if r.Deprecation != nil && r.Sunset != nil && r.Sunset.Before(*r.Deprecation) {
+			return nil, oops.
+				In("deprecation").
+				Code(errcode.InvalidRules).
+				With("prefix", r.Prefix).
+				Errorf("sunset must not be before deprecation")
+		}
+		for j, m := range r.Methods {
+			rules.Routes[i].Methods[j] = strings.ToUpper(m)
+		}
+		if r.Match != nil {
+			matcher, err := match.Compile(*r.Match)
+			if err != nil {
+				return nil, oops.
+					In("deprecation").
+					Code(errcode.InvalidRules).
+					With("prefix", r.Prefix).
+					Wrap(err)
+			}
+			rules.Routes[i].matcher = matcher
+		}
+	}
+	return &rules, nil
+}
+
+// Match returns the route with the longest prefix matching the request.
+func (r *Rules) Match(req match.Request) (*Route, bool) {
+	var best *Route
+	for i := range r.Routes {
+		route := &r.Routes[i]
+		if !strings.HasPrefix(req.Path, route.Prefix) ||
+			(len(route.Methods) > 0 && !slices.Contains(route.Methods, req.Method)) ||
+			!route.matcher.Match(req) {
+			continue
+		}
+		if best == nil || len(route.Prefix) > len(best.Prefix) {
+			best = route
+		}
+	}
+	return best, best != nil
+}
+
+// Headers returns the RFC 9745 Deprecation, RFC 8594 Sunset and Link header
+// values for the route.
+func (r *Route) Headers() http.Header {
+	h := make(http.Header)
+	if r.Deprecation != nil {
+		h.Set("Deprecation", "@"+strconv.FormatInt(r.Deprecation.Unix(), 10))
+	}
+	if r.Sunset != nil {
+		h.Set("Sunset", r.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if r.Link != "" {
+		h.Add("Link", "<"+r.Link+`>; rel="deprecation"; type="text/html"`)
+		if r.Sunset != nil {
+			h.Add("Link", "<"+r.Link+`>; rel="sunset"; type="text/html"`)
+		}
+	}
+	if r.Successor != "" {
+		h.Add("Link", "<"+r.Successor+`>; rel="successor-version"`)
+	}
+	return h
+}
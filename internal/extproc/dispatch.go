@@ -0,0 +1,182 @@
+package extproc
+
+import (
+	"context"
+	"sync"
+
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/crashreport"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// DispatchMode selects how the messages of a stream are handled and how
+// their responses are sent. Envoy matches responses to requests by order,
+// so every mode but DispatchUnordered sends them in the order received.
+type DispatchMode int
+
+const (
+	// DispatchOrdered handles messages concurrently and sends each response
+	// once all earlier ones were sent. It is the default.
+	DispatchOrdered DispatchMode = iota
+	// DispatchSequential handles messages one at a time, in order, on a
+	// per-stream worker.
+	DispatchSequential
+	// DispatchUnordered handles messages concurrently and sends each
+	// response as soon as it is ready. Only safe for processors whose
+	// handlers finish in order, e.g. ones that never block.
+	DispatchUnordered
+)
+
+// DefaultDispatchQueue is the default number of messages of a stream queued
+// or in flight before the server stops reading from it.
+const DefaultDispatchQueue = 64
+
+var dispatchModeNames = map[string]DispatchMode{
+	"ordered":    DispatchOrdered,
+	"sequential": DispatchSequential,
+	"unordered":  DispatchUnordered,
+}
+
+// ParseDispatchMode parses "ordered", "sequential" or "unordered".
+func ParseDispatchMode(name string) (DispatchMode, error) {
+	mode, ok := dispatchModeNames[name]
+	if !ok {
+		return 0, oops.In("extproc").Code(errcode.InvalidConfig).With("dispatch", name).Errorf("unknown dispatch mode %q", name)
+	}
+	return mode, nil
+}
+
+// DispatchAware is implemented by processors choosing the DispatchMode of
+// their streams, overriding the server's.
+type DispatchAware interface {
+	DispatchMode() DispatchMode
+}
+
+// dispatchModeOf returns the DispatchMode processor asks for, or fallback.
+func dispatchModeOf(processor Processor, fallback DispatchMode) DispatchMode {
+	if es, ok := processor.(*eventSplitter); ok {
+		processor = es.EventProcessor
+	}
+	if da, ok := processor.(DispatchAware); ok {
+		return da.DispatchMode()
+	}
+	return fallback
+}
+
+// WithDispatch sets the DispatchMode of streams and how many messages of a
+// stream may be queued or in flight; a non-positive queue keeps
+// DefaultDispatchQueue.
+func WithDispatch(mode DispatchMode, queue int) ServerOption {
+	return func(s *Server) {
+		s.dispatch = mode
+		if queue > 0 {
+			s.dispatchQueue = queue
+		}
+	}
+}
+
+// pending is a received message and, once handled, its response.
+type pending struct {
+	req     *envoy_service_proc_v3.ProcessingRequest
+	request int
+	// processor is the Processor of the message's request.
+	processor Processor
+	r         *response
+	resp      *envoy_service_proc_v3.ProcessingResponse
+	// trace is the parent context of the message's span; nil unless
+	// tracing is enabled.
+	trace context.Context
+	// handled is closed once resp is set, in DispatchOrdered.
+	handled chan struct{}
+}
+
+// dispatcher runs the handlers of one stream and sends their responses.
+// submit is only called by the stream's receive loop.
+type dispatcher struct {
+	mode   DispatchMode
+	handle func(*pending)
+	send   func(*pending)
+	queue  chan *pending
+	// inflight counts running handlers in DispatchUnordered.
+	inflight sync.WaitGroup
+	// done is closed when the sender or worker has drained the queue.
+	done   chan struct{}
+	closed sync.Once
+}
+
+func newDispatcher(mode DispatchMode, queue int, handle, send func(*pending)) *dispatcher {
+	d := &dispatcher{mode: mode, handle: handle, send: send, done: make(chan struct{})}
+	switch mode {
+	case DispatchOrdered:
+		d.queue = make(chan *pending, queue)
+		go d.sendInOrder()
+	case DispatchSequential:
+		d.queue = make(chan *pending, queue)
+		go d.work()
+	default:
+		close(d.done)
+	}
+	return d
+}
+
+// submit dispatches p, blocking while the queue is full.
+func (d *dispatcher) submit(p *pending) {
+	switch d.mode {
+	case DispatchSequential:
+		d.queue <- p
+	case DispatchOrdered:
+		p.handled = make(chan struct{})
+		d.queue <- p
+		go func() {
+			defer crashreport.Recover()
+			defer close(p.handled)
+			d.handle(p)
+		}()
+	default:
+		d.inflight.Add(1)
+		go func() {
+			defer crashreport.Recover()
+			defer d.inflight.Done()
+			d.handle(p)
+			d.send(p)
+		}()
+	}
+}
+
+// sendInOrder sends responses in the order their messages were submitted.
+func (d *dispatcher) sendInOrder() {
+	defer crashreport.Recover()
+	defer close(d.done)
+	for p := range d.queue {
+		<-p.handled
+		d.send(p)
+	}
+}
+
+// work handles and answers submitted messages one at a time.
+func (d *dispatcher) work() {
+	defer crashreport.Recover()
+	defer close(d.done)
+	for p := range d.queue {
+		d.handle(p)
+		d.send(p)
+	}
+}
+
+// drain stops accepting messages and waits until every submitted one was
+// answered.
+func (d *dispatcher) drain() {
+	d.close()
+	<-d.done
+	d.inflight.Wait()
+}
+
+// close stops accepting messages; those submitted are still answered.
+func (d *dispatcher) close() {
+	d.closed.Do(func() {
+		if d.queue != nil {
+			close(d.queue)
+		}
+	})
+}
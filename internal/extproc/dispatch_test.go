@@ -0,0 +1,119 @@
+package extproc
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// fakeStream replays requests and collects the responses sent.
+type fakeStream struct {
+	grpc.ServerStream
+	requests []*envoy_service_proc_v3.ProcessingRequest
+
+	mu    sync.Mutex
+	sent  []*envoy_service_proc_v3.ProcessingResponse
+	calls int
+}
+
+func (f *fakeStream) Context() context.Context { return context.Background() }
+
+func (f *fakeStream) Recv() (*envoy_service_proc_v3.ProcessingRequest, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == len(f.requests) {
+		return nil, io.EOF
+	}
+	f.calls++
+	return f.requests[f.calls-1], nil
+}
+
+func (f *fakeStream) Send(resp *envoy_service_proc_v3.ProcessingResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Responses are pooled and reused once sent.
+	f.sent = append(f.sent, proto.Clone(resp).(*envoy_service_proc_v3.ProcessingResponse))
+	return nil
+}
+
+// slowHeadersProcessor takes longer on request headers than on the body
+// chunks that follow them.
+type slowHeadersProcessor struct {
+	BaseProcessor
+	mode DispatchMode
+}
+
+func (p *slowHeadersProcessor) ProcessRequestHeaders(*RequestContext) *ProcessingResult {
+	time.Sleep(50 * time.Millisecond)
+	return ContinueResult()
+}
+
+func (p *slowHeadersProcessor) DispatchMode() DispatchMode { return p.mode }
+
+type slowHeadersFactory struct{ mode DispatchMode }
+
+func (f slowHeadersFactory) NewProcessor() Processor { return &slowHeadersProcessor{mode: f.mode} }
+
+func TestProcessSendsInOrder(t *testing.T) {
+	headers := benchRequests()["request_headers"]
+	body := benchRequests()["request_body"]
+	for _, mode := range []DispatchMode{DispatchOrdered, DispatchSequential} {
+		stream := &fakeStream{requests: []*envoy_service_proc_v3.ProcessingRequest{headers, body, body, body}}
+		s := NewServer(slowHeadersFactory{mode: mode}, zerolog.Nop(), WithDispatch(DispatchUnordered, 2))
+		if err := s.Process(stream); err != nil {
+			t.Fatalf("mode %d: %v", mode, err)
+		}
+		if len(stream.sent) != len(stream.requests) {
+			t.Fatalf("mode %d: sent %d responses for %d requests", mode, len(stream.sent), len(stream.requests))
+		}
+		if stream.sent[0].GetRequestHeaders() == nil {
+			t.Errorf("mode %d: first response is %T, want request headers", mode, stream.sent[0].Response)
+		}
+		for i, resp := range stream.sent[1:] {
+			if resp.GetRequestBody() == nil {
+				t.Errorf("mode %d: response %d is %T, want request body", mode, i+1, resp.Response)
+			}
+		}
+	}
+}
+
+func TestParseDispatchMode(t *testing.T) {
+	for name, want := range dispatchModeNames {
+		if got, err := ParseDispatchMode(name); err != nil || got != want {
+			t.Errorf("ParseDispatchMode(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseDispatchMode("random"); err == nil {
+		t.Error("ParseDispatchMode accepted an unknown mode")
+	}
+}
+
+// metadataFactory emits dynamic metadata with every request headers result.
+type metadataFactory struct{}
+
+func (metadataFactory) NewProcessor() Processor { return &metadataProcessor{} }
+
+type metadataProcessor struct{ BaseProcessor }
+
+func (p *metadataProcessor) ProcessRequestHeaders(*RequestContext) *ProcessingResult {
+	return ContinueResult().SetMetadata("example", "trusted", structpb.NewBoolValue(true))
+}
+
+func TestProcessSendsDynamicMetadata(t *testing.T) {
+	stream := &fakeStream{requests: []*envoy_service_proc_v3.ProcessingRequest{benchRequests()["request_headers"]}}
+	if err := NewServer(metadataFactory{}, zerolog.Nop()).Process(stream); err != nil {
+		t.Fatal(err)
+	}
+	got := stream.sent[0].GetDynamicMetadata().GetFields()["example"].GetStructValue().GetFields()["trusted"]
+	if !got.GetBoolValue() {
+		t.Fatalf("dynamic metadata = %v, want example.trusted true", stream.sent[0].GetDynamicMetadata())
+	}
+}
@@ -9,6 +9,7 @@ import (
 	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	"github.com/mnixry/envoy-ext-procs/internal/extproc"
 	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 const (
@@ -18,6 +19,11 @@ const (
 	HeaderXRealIP          = "x-real-ip"
 )
 
+// MetadataNamespace is the dynamic metadata namespace the trust level and
+// client IP are published under, as "trusted" and "client_ip"; the Envoy
+// filter must list it in metadata_options.receiving_namespaces.untyped.
+const MetadataNamespace = "envoy-ext-procs.edgeone"
+
 // TrustLevel indicates whether a request is from a trusted EdgeOne IP.
 type TrustLevel string
 
@@ -27,29 +33,49 @@ const (
 	TrustLevelUnknown TrustLevel = "unknown"
 )
 
-// Validator checks if an IP address belongs to EdgeOne's network.
+// Validator checks if an IP address belongs to EdgeOne's network. With an
+// error, the result is the decision of the validator's failure policy.
 type Validator interface {
 	IsEdgeOneIP(ip netip.Addr) (bool, error)
 }
 
 // ProcessorFactory creates EdgeOne processors.
 type ProcessorFactory struct {
-	validator Validator
-	log       zerolog.Logger
+	validator    Validator
+	decisionMode extproc.DecisionMode
+	log          zerolog.Logger
+	decider      extproc.Decider
+}
+
+type Option func(*ProcessorFactory)
+
+// WithDecisionMode selects whether the forwarding headers of requests not
+// coming from EdgeOne are overwritten with the peer address, or left as the
+// client sent them. The trust header is set in every mode.
+func WithDecisionMode(mode extproc.DecisionMode) Option {
+	return func(f *ProcessorFactory) {
+		f.decisionMode = mode
+	}
 }
 
 // NewProcessorFactory creates a new EdgeOne ProcessorFactory.
-func NewProcessorFactory(validator Validator, log zerolog.Logger) *ProcessorFactory {
-	return &ProcessorFactory{
+func NewProcessorFactory(validator Validator, log zerolog.Logger, opts ...Option) *ProcessorFactory {
+	f := &ProcessorFactory{
 		validator: validator,
 		log:       log.With().Str("processor", "edgeone").Logger(),
 	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	f.decider = extproc.NewDecider("edgeone", f.decisionMode, f.log)
+	return f
 }
 
 // NewProcessor creates a new EdgeOne processor for a single request.
 func (f *ProcessorFactory) NewProcessor() extproc.Processor {
 	return &Processor{
 		validator: f.validator,
+		decider:   f.decider,
 		log:       f.log,
 	}
 }
@@ -58,6 +84,7 @@ func (f *ProcessorFactory) NewProcessor() extproc.Processor {
 type Processor struct {
 	extproc.BaseProcessor
 	validator Validator
+	decider   extproc.Decider
 	log       zerolog.Logger
 }
 
@@ -66,20 +93,23 @@ func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.
 	remoteIP, err := ctx.GetDownstreamRemoteIP()
 	if err != nil {
 		p.log.Warn().Err(err).Msg("failed to get downstream remote IP")
-		return extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
+		return withMetadata(extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
 			extproc.SetHeader(HeaderTrusted, string(TrustLevelUnknown)),
-		})
+		}), TrustLevelUnknown, "")
 	}
 
 	trustedVal := TrustLevelNo
-	if isEdgeOne, err := p.validator.IsEdgeOneIP(remoteIP); err == nil && isEdgeOne {
-		trustedVal = TrustLevelYes
-	} else if err != nil {
+	isEdgeOne, err := p.validator.IsEdgeOneIP(remoteIP)
+	if err != nil {
 		p.log.Error().
 			Err(err).
 			Str("remote_ip", remoteIP.String()).
+			Bool("trusted", isEdgeOne).
 			Msg("edgeone validation failed")
 	}
+	if isEdgeOne {
+		trustedVal = TrustLevelYes
+	}
 
 	remoteIPStr := remoteIP.String()
 	headers := []*envoy_api_v3_core.HeaderValueOption{
@@ -87,11 +117,10 @@ func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.
 	}
 
 	if trustedVal == TrustLevelNo {
-		headers = append(headers,
+		return withMetadata(p.decider.Reject(ctx.GetRequestID(), "untrusted_source", extproc.ContinueWithHeaders(append(headers,
 			extproc.SetHeader(HeaderXFF, remoteIPStr),
 			extproc.SetHeader(HeaderXRealIP, remoteIPStr),
-		)
-		return extproc.ContinueWithHeaders(headers)
+		)), extproc.ContinueWithHeaders(headers)), trustedVal, remoteIPStr)
 	}
 
 	// Trusted EdgeOne request - extract real client IP from EdgeOne header.
@@ -102,7 +131,7 @@ func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.
 				extproc.SetHeader(HeaderXFF, fmt.Sprintf("%s, %s", downstreamIPStr, remoteIPStr)),
 				extproc.SetHeader(HeaderXRealIP, downstreamIPStr),
 			)
-			return extproc.ContinueWithHeaders(headers)
+			return withMetadata(extproc.ContinueWithHeaders(headers), trustedVal, downstreamIPStr)
 		} else {
 			p.log.Warn().Err(err).Msg("failed to parse downstream IP")
 		}
@@ -112,11 +141,26 @@ func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.
 		Str("header", HeaderDownstreamRealIP).
 		Str("remote_ip", remoteIPStr).
 		Msg("edgeone missing or invalid header")
-	headers = append(headers,
+	return withMetadata(p.decider.Reject(ctx.GetRequestID(), "missing_client_ip", extproc.ContinueWithHeaders(append(headers,
 		extproc.SetHeader(HeaderXFF, remoteIPStr),
 		extproc.SetHeader(HeaderXRealIP, remoteIPStr),
-	)
-	return extproc.ContinueWithHeaders(headers)
+	)), extproc.ContinueWithHeaders(headers)), trustedVal, remoteIPStr)
+}
+
+// withMetadata publishes the trust level and, when known, the client IP
+// the request is attributed to, whatever the decision mode did to the
+// headers.
+func withMetadata(result *extproc.ProcessingResult, trusted TrustLevel, clientIP string) *extproc.ProcessingResult {
+	result.SetMetadata(MetadataNamespace, "trusted", structpb.NewStringValue(string(trusted)))
+	if clientIP != "" {
+		result.SetMetadata(MetadataNamespace, "client_ip", structpb.NewStringValue(clientIP))
+	}
+	return result
+}
+
+// Phases reports that only request headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders
 }
 
 // Ensure ProcessorFactory implements extproc.ProcessorFactory.
@@ -124,3 +168,6 @@ var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
 
 // Ensure Processor implements extproc.Processor.
 var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
@@ -0,0 +1,71 @@
+package edgeone
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+// staticValidator trusts the addresses of one prefix.
+type staticValidator struct{ prefix netip.Prefix }
+
+func (v staticValidator) IsEdgeOneIP(ip netip.Addr) (bool, error) { return v.prefix.Contains(ip), nil }
+
+func TestProcessRequestHeaders(t *testing.T) {
+	factory := NewProcessorFactory(staticValidator{netip.MustParsePrefix("43.175.0.0/16")}, zerolog.Nop())
+	tests := []struct {
+		name    string
+		attrs   map[string]string
+		headers []string
+		expect  []extproctest.Expectation
+	}{
+		{
+			name: "missing attributes",
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderSet(HeaderTrusted, string(TrustLevelUnknown)),
+				extproctest.ExpectMetadata(MetadataNamespace, "trusted", string(TrustLevelUnknown)),
+			},
+		},
+		{
+			name:    "untrusted peer",
+			attrs:   map[string]string{"source.address": "198.51.100.1:54321"},
+			headers: []string{HeaderDownstreamRealIP, "203.0.113.7"},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderSet(HeaderTrusted, string(TrustLevelNo)),
+				extproctest.ExpectHeaderSet(HeaderXRealIP, "198.51.100.1"),
+				extproctest.ExpectXFFAppended("198.51.100.1"),
+				extproctest.ExpectMetadata(MetadataNamespace, "trusted", string(TrustLevelNo)),
+				extproctest.ExpectMetadata(MetadataNamespace, "client_ip", "198.51.100.1"),
+			},
+		},
+		{
+			name:    "trusted peer",
+			attrs:   map[string]string{"source.address": "43.175.1.2:443"},
+			headers: []string{HeaderDownstreamRealIP, "203.0.113.7"},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderSet(HeaderTrusted, string(TrustLevelYes)),
+				extproctest.ExpectHeaderSet(HeaderXRealIP, "203.0.113.7"),
+				extproctest.ExpectHeaderSet(HeaderXFF, "203.0.113.7, 43.175.1.2"),
+				extproctest.ExpectXFFAppended("43.175.1.2"),
+				extproctest.ExpectMetadata(MetadataNamespace, "trusted", string(TrustLevelYes)),
+				extproctest.ExpectMetadata(MetadataNamespace, "client_ip", "203.0.113.7"),
+			},
+		},
+		{
+			name:  "trusted peer without client header",
+			attrs: map[string]string{"source.address": "43.175.1.2:443"},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderSet(HeaderTrusted, string(TrustLevelYes)),
+				extproctest.ExpectXFFAppended("43.175.1.2"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(tt.attrs, tt.headers...))
+			extproctest.Check(t, result, append([]extproctest.Expectation{extproctest.ExpectContinue()}, tt.expect...)...)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package edgeone
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/mnixry/envoy-ext-procs/internal/selftest"
+)
+
+const selftestClientIP = "203.0.113.7"
+
+// SelfTestCases returns synthetic exchanges covering the trust decisions. If
+// trustedIP is a valid address, a case asserting that it validates as an
+// EdgeOne node is included; this requires a working TEO API.
+func SelfTestCases(trustedIP string) []selftest.Case {
+	cases := []selftest.Case{
+		{
+			Name:     "missing attributes",
+			Requests: []*selftest.Request{selftest.RequestHeaders(nil, ":method", "GET", ":path", "/")},
+			Expect: selftest.ExpectHeaders(0, map[string]string{
+				HeaderTrusted: string(TrustLevelUnknown),
+			}),
+		},
+		{
+			Name: "spoofed header from untrusted peer",
+			Requests: []*selftest.Request{selftest.RequestHeaders(
+				map[string]string{"source.address": "127.0.0.1:54321"},
+				":method", "GET", ":path", "/", HeaderDownstreamRealIP, selftestClientIP,
+			)},
+			Expect: selftest.ExpectHeaders(0, map[string]string{
+				HeaderTrusted: string(TrustLevelNo),
+				HeaderXFF:     "127.0.0.1",
+				HeaderXRealIP: "127.0.0.1",
+			}),
+		},
+	}
+
+	if ip, err := netip.ParseAddr(trustedIP); err == nil {
+		cases = append(cases, selftest.Case{
+			Name: "trusted CDN IP",
+			Requests: []*selftest.Request{selftest.RequestHeaders(
+				map[string]string{"source.address": net.JoinHostPort(ip.String(), "443")},
+				":method", "GET", ":path", "/", HeaderDownstreamRealIP, selftestClientIP,
+			)},
+			Expect: selftest.ExpectHeaders(0, map[string]string{
+				HeaderTrusted: string(TrustLevelYes),
+				HeaderXFF:     selftestClientIP + ", " + ip.String(),
+				HeaderXRealIP: selftestClientIP,
+			}),
+		})
+	}
+	return cases
+}
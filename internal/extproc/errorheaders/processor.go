@@ -0,0 +1,183 @@
+// Package errorheaders provides an ext_proc processor that decorates error
+// responses with diagnostic headers, so a failing request can be traced
+// without exposing internals where they do not belong.
+package errorheaders
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// Environment is the deployment environment, which decides what may be
+// disclosed.
+type Environment string
+
+const (
+	// EnvProduction only adds the error ID and strips upstream details.
+	EnvProduction Environment = "production"
+	// EnvStaging and EnvDevelopment also disclose the upstream cluster.
+	EnvStaging     Environment = "staging"
+	EnvDevelopment Environment = "development"
+)
+
+// AttrClusterName is the Envoy attribute holding the upstream cluster.
+const AttrClusterName = "xds.cluster_name"
+
+// Config holds error header decoration settings.
+type Config struct {
+	Environment Environment
+	// Classes are the decorated status classes, e.g. 5 for 5xx.
+	Classes []int
+	// ErrorIDHeader carries the ID logged with the error; the request ID
+	// when Envoy provides one.
+	ErrorIDHeader string
+	// ClusterHeader carries the upstream cluster outside production.
+	ClusterHeader string
+}
+
+// ParseClasses parses status classes such as "4xx" and "5xx".
+func ParseClasses(classes []string) ([]int, error) {
+	out := make([]int, 0, len(classes))
+	for _, c := range classes {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if len(c) != 3 || c[1:] != "xx" || c[0] < '1' || c[0] > '5' {
+			return nil, oops.
+				In("errorheaders").
+				Code(errcode.InvalidConfig).
+				With("class", c).
+				Errorf("invalid status class %q, want 1xx through 5xx", c)
+		}
+		out = append(out, int(c[0]-'0'))
+	}
+	return out, nil
+}
+
+// ProcessorFactory creates error header processors.
+type ProcessorFactory struct {
+	cfg     Config
+	classes [6]bool
+	log     zerolog.Logger
+}
+
+// NewProcessorFactory creates a new error header ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	if cfg.Environment == "" {
+		cfg.Environment = EnvProduction
+	}
+	if cfg.ErrorIDHeader == "" {
+		cfg.ErrorIDHeader = "x-error-id"
+	}
+	if cfg.ClusterHeader == "" {
+		cfg.ClusterHeader = "x-upstream-cluster"
+	}
+	cfg.ErrorIDHeader = strings.ToLower(cfg.ErrorIDHeader)
+	cfg.ClusterHeader = strings.ToLower(cfg.ClusterHeader)
+	f := &ProcessorFactory{
+		cfg: cfg,
+		log: log.With().Str("processor", "errorheaders").Logger(),
+	}
+	for _, c := range cfg.Classes {
+		if c > 0 && c < len(f.classes) {
+			f.classes[c] = true
+		}
+	}
+	return f
+}
+
+// NewProcessor creates a new error header processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	method string
+	path   string
+}
+
+// ProcessRequestHeaders remembers the request line for the error log.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	p.method = ctx.Headers.Get(":method")
+	p.path, _, _ = strings.Cut(ctx.Headers.Get(":path"), "?")
+	return extproc.ContinueResult()
+}
+
+// ProcessResponseHeaders adds the diagnostic headers to responses in the
+// configured status classes. In production the cluster header is removed
+// from every response, including one set by the upstream.
+func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	prod := f.cfg.Environment == EnvProduction
+
+	result := &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{},
+	}
+	if prod && ctx.Headers.Get(f.cfg.ClusterHeader) != "" {
+		result.HeaderMutations.RemoveHeaders = append(result.HeaderMutations.RemoveHeaders, f.cfg.ClusterHeader)
+	}
+
+	status, err := strconv.Atoi(ctx.Headers.Get(":status"))
+	if err != nil || status < 100 || status > 599 || !f.classes[status/100] {
+		if len(result.HeaderMutations.RemoveHeaders) == 0 {
+			return extproc.ContinueResult()
+		}
+		return result
+	}
+
+	errorID := ctx.GetRequestID()
+	if errorID == "" {
+		errorID = newErrorID()
+	}
+	set := []*envoy_api_v3_core.HeaderValueOption{extproc.SetHeader(f.cfg.ErrorIDHeader, errorID)}
+	var cluster string
+	if value, ok := ctx.GetEnvoyAttributeValue(AttrClusterName); ok {
+		cluster = value.GetStringValue()
+	}
+	if !prod && cluster != "" {
+		set = append(set, extproc.SetHeader(f.cfg.ClusterHeader, cluster))
+	}
+	result.HeaderMutations.SetHeaders = set
+
+	// The log entry is what the error ID correlates with, so it always
+	// carries the details withheld from production responses.
+	f.log.Info().
+		Str("error_id", errorID).
+		Int("status", status).
+		Str("method", p.method).
+		Str("path", p.path).
+		Str("upstream_cluster", cluster).
+		Msg("error response")
+	return result
+}
+
+func newErrorID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Phases reports that request and response headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders | extproc.PhaseResponseHeaders
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
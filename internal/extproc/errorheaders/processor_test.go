@@ -0,0 +1,56 @@
+package errorheaders
+
+import (
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+func TestProcessResponseHeaders(t *testing.T) {
+	attrs := map[string]string{"request.id": "req-1", AttrClusterName: "orders-v2"}
+	newFactory := func(env Environment) *ProcessorFactory {
+		return NewProcessorFactory(Config{Environment: env, Classes: []int{5}}, zerolog.Nop())
+	}
+
+	t.Run("staging error", func(t *testing.T) {
+		result := newFactory(EnvStaging).NewProcessor().ProcessResponseHeaders(extproctest.NewContext(attrs, ":status", "503"))
+		extproctest.Check(t, result,
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderSet("x-error-id", "req-1"),
+			extproctest.ExpectHeaderSet("x-upstream-cluster", "orders-v2"),
+		)
+	})
+
+	t.Run("production error", func(t *testing.T) {
+		result := newFactory(EnvProduction).NewProcessor().ProcessResponseHeaders(extproctest.NewContext(attrs,
+			":status", "500",
+			"x-upstream-cluster", "leaked",
+		))
+		extproctest.Check(t, result,
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderSet("x-error-id", "req-1"),
+			extproctest.ExpectHeaderRemoved("x-upstream-cluster"),
+		)
+	})
+
+	t.Run("other class", func(t *testing.T) {
+		result := newFactory(EnvDevelopment).NewProcessor().ProcessResponseHeaders(extproctest.NewContext(attrs, ":status", "404"))
+		extproctest.Check(t, result, extproctest.ExpectContinue())
+		if result.HeaderMutations != nil {
+			t.Fatalf("404 was decorated: %s", extproctest.Describe(result))
+		}
+	})
+}
+
+func TestParseClasses(t *testing.T) {
+	got, err := ParseClasses([]string{"4xx", " 5XX "})
+	if err != nil || len(got) != 2 || got[0] != 4 || got[1] != 5 {
+		t.Fatalf("ParseClasses = %v, %v", got, err)
+	}
+	for _, bad := range []string{"6xx", "50x", "5"} {
+		if _, err := ParseClasses([]string{bad}); err == nil {
+			t.Errorf("ParseClasses(%q) succeeded", bad)
+		}
+	}
+}
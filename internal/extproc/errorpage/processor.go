@@ -0,0 +1,223 @@
+// Package errorpage provides an ext_proc processor that replaces upstream
+// 4xx/5xx bodies with RFC 7807 problem+json or branded HTML error pages.
+package errorpage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+)
+
+// DefaultTemplate is the HTML error page used when no template is configured.
+const DefaultTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+<p>Request ID: <code>{{.RequestID}}</code></p>
+</body>
+</html>
+`
+
+// preservedHeaders are upstream response headers kept on the replaced
+// response because clients act on them.
+var preservedHeaders = []string{"retry-after", "www-authenticate", "proxy-authenticate", "allow", "cache-control"}
+
+// Config holds error normalization settings.
+type Config struct {
+	// Template renders HTML error pages; see Page for its data.
+	Template *template.Template
+	// DefaultFormat is "json" or "html", used when Accept prefers neither.
+	DefaultFormat string
+	// SkipStatuses are passed through untouched.
+	SkipStatuses []int
+	// CorrelationHeader carries the request ID on replaced responses.
+	CorrelationHeader string
+	// ProblemTypeBase, if set, is joined with the status code to form the
+	// problem type URI; otherwise "about:blank" is used.
+	ProblemTypeBase string
+}
+
+// Page is the data passed to the HTML template.
+type Page struct {
+	Status    int
+	Title     string
+	Path      string
+	RequestID string
+}
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id"`
+}
+
+// ProcessorFactory creates error normalization processors.
+type ProcessorFactory struct {
+	cfg Config
+	log zerolog.Logger
+}
+
+// NewProcessorFactory creates a new error normalization ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	if cfg.Template == nil {
+		cfg.Template = template.Must(template.New("error").Parse(DefaultTemplate))
+	}
+	if cfg.CorrelationHeader == "" {
+		cfg.CorrelationHeader = "x-request-id"
+	}
+	return &ProcessorFactory{
+		cfg: cfg,
+		log: log.With().Str("processor", "errorpage").Logger(),
+	}
+}
+
+// NewProcessor creates a new error normalization processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	accept    string
+	path      string
+	requestID string
+}
+
+// ProcessRequestHeaders remembers what the client accepts and its request ID.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	p.accept = ctx.Headers.Get("accept")
+	p.path, _, _ = strings.Cut(ctx.Headers.Get(":path"), "?")
+	p.requestID = ctx.GetRequestID()
+	return extproc.ContinueResult()
+}
+
+// ProcessResponseHeaders replaces error responses with a normalized body,
+// keeping the original status.
+func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	status, err := strconv.Atoi(ctx.Headers.Get(":status"))
+	if err != nil || status < 400 || slices.Contains(f.cfg.SkipStatuses, status) {
+		return extproc.ContinueResult()
+	}
+	if mediaType, _, _ := mime.ParseMediaType(ctx.Headers.Get("content-type")); mediaType == "application/problem+json" {
+		return extproc.ContinueResult()
+	}
+
+	if p.requestID == "" {
+		p.requestID = newRequestID()
+	}
+	headers := []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader(f.cfg.CorrelationHeader, p.requestID),
+	}
+	for _, name := range preservedHeaders {
+		if v := ctx.Headers.Get(name); v != "" {
+			headers = append(headers, extproc.SetHeader(name, v))
+		}
+	}
+
+	var body []byte
+	if f.format(p.accept) == "html" {
+		var buf bytes.Buffer
+		if err := f.cfg.Template.Execute(&buf, Page{
+			Status:    status,
+			Title:     http.StatusText(status),
+			Path:      p.path,
+			RequestID: p.requestID,
+		}); err != nil {
+			f.log.Error().Err(err).Int("status", status).Msg("failed to render error page")
+			return extproc.ContinueResult()
+		}
+		body = buf.Bytes()
+		headers = append(headers, extproc.SetHeader("content-type", "text/html; charset=utf-8"))
+	} else {
+		body, _ = json.Marshal(Problem{
+			Type:      f.problemType(status),
+			Title:     http.StatusText(status),
+			Status:    status,
+			Instance:  p.path,
+			RequestID: p.requestID,
+		})
+		headers = append(headers, extproc.SetHeader("content-type", "application/problem+json"))
+	}
+
+	f.log.Debug().
+		Int("status", status).
+		Str("path", p.path).
+		Str("request_id", p.requestID).
+		Msg("normalized error response")
+	return extproc.ImmediateResult(status, headers, body)
+}
+
+func (f *ProcessorFactory) problemType(status int) string {
+	if f.cfg.ProblemTypeBase == "" {
+		return "about:blank"
+	}
+	return strings.TrimSuffix(f.cfg.ProblemTypeBase, "/") + "/" + strconv.Itoa(status)
+}
+
+// format picks "html" or "json" from the Accept header by quality value,
+// falling back to the configured default.
+func (f *ProcessorFactory) format(accept string) string {
+	best, bestQ := "", 0.0
+	for part := range strings.SplitSeq(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		var format string
+		switch {
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			format = "html"
+		case mediaType == "application/json" || mediaType == "application/problem+json" || strings.HasSuffix(mediaType, "+json"):
+			format = "json"
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	if best == "" {
+		if f.cfg.DefaultFormat == "html" {
+			return "html"
+		}
+		return "json"
+	}
+	return best
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
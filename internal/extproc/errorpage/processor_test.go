@@ -0,0 +1,121 @@
+package errorpage
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+func respond(f *ProcessorFactory, accept string, response ...string) *extproc.ProcessingResult {
+	p := f.NewProcessor()
+	p.ProcessRequestHeaders(extproctest.NewContext(nil,
+		":method", "GET", ":path", "/orders/7?debug=1", "accept", accept, "x-request-id", "req-1"))
+	return p.ProcessResponseHeaders(extproctest.NewContext(nil, response...))
+}
+
+func TestProblemJSON(t *testing.T) {
+	f := NewProcessorFactory(Config{ProblemTypeBase: "https://errors.example.com/", SkipStatuses: []int{404}}, zerolog.Nop())
+
+	result := respond(f, "application/json", ":status", "503", "retry-after", "30", "set-cookie", "a=b")
+	extproctest.Check(t, result,
+		extproctest.ExpectDenied(http.StatusServiceUnavailable),
+		extproctest.ExpectHeaderSet("content-type", "application/problem+json"),
+		extproctest.ExpectHeaderSet("x-request-id", "req-1"),
+		extproctest.ExpectHeaderSet("retry-after", "30"),
+	)
+	var problem Problem
+	if err := json.Unmarshal(result.ImmediateResponse.GetBody(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	want := Problem{
+		Type:      "https://errors.example.com/503",
+		Title:     "Service Unavailable",
+		Status:    503,
+		Instance:  "/orders/7",
+		RequestID: "req-1",
+	}
+	if problem != want {
+		t.Errorf("problem = %+v, want %+v", problem, want)
+	}
+	if _, ok := immediateHeader(result, "set-cookie"); ok {
+		t.Error("set-cookie carried over to the error page")
+	}
+
+	// Successes, skipped statuses and upstream problems pass through.
+	for _, response := range [][]string{
+		{":status", "200"},
+		{":status", "404"},
+		{":status", "500", "content-type", "application/problem+json; charset=utf-8"},
+	} {
+		extproctest.Check(t, respond(f, "", response...), extproctest.ExpectContinue())
+	}
+}
+
+func TestHTMLPage(t *testing.T) {
+	f := NewProcessorFactory(Config{DefaultFormat: "json"}, zerolog.Nop())
+	result := respond(f, "application/json;q=0.5, text/html", ":status", "502")
+	extproctest.Check(t, result,
+		extproctest.ExpectDenied(http.StatusBadGateway),
+		extproctest.ExpectHeaderSet("content-type", "text/html; charset=utf-8"),
+	)
+	if body := string(result.ImmediateResponse.GetBody()); !strings.Contains(body, "502 Bad Gateway") || !strings.Contains(body, "req-1") {
+		t.Errorf("page = %q", body)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	f := NewProcessorFactory(Config{DefaultFormat: "html"}, zerolog.Nop())
+	for accept, want := range map[string]string{
+		"":                                  "html",
+		"*/*":                               "html",
+		"application/json":                  "json",
+		"application/vnd.api+json":          "json",
+		"text/html;q=0.9, application/json": "json",
+		"text/html, application/json;q=0.1": "html",
+		"application/json;q=bad":            "html",
+	} {
+		if got := f.format(accept); got != want {
+			t.Errorf("format(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+// TestRequestIDPerRequest checks that a generated request ID is not
+// reused by the next request on the stream.
+func TestRequestIDPerRequest(t *testing.T) {
+	f := NewProcessorFactory(Config{}, zerolog.Nop())
+	sent := extproctest.Run(t, f,
+		extproctest.RequestHeaders(nil, ":method", "GET", ":path", "/a"),
+		extproctest.ResponseHeaders(":status", "500"),
+		extproctest.RequestHeaders(nil, ":method", "GET", ":path", "/b"),
+		extproctest.ResponseHeaders(":status", "500"),
+	)
+	var ids []string
+	for _, resp := range []int{1, 3} {
+		if status := extproctest.ImmediateStatus(sent[resp]); status != http.StatusInternalServerError {
+			t.Fatalf("response %d: status %d", resp, status)
+		}
+		var problem Problem
+		if err := json.Unmarshal(sent[resp].GetImmediateResponse().GetBody(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, problem.RequestID)
+	}
+	if ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("request IDs = %q", ids)
+	}
+}
+
+func immediateHeader(r *extproc.ProcessingResult, key string) (string, bool) {
+	for _, opt := range r.ImmediateResponse.GetHeaders().GetSetHeaders() {
+		if strings.EqualFold(opt.GetHeader().GetKey(), key) {
+			return string(opt.GetHeader().GetRawValue()), true
+		}
+	}
+	return "", false
+}
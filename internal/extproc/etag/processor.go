@@ -0,0 +1,164 @@
+// Package etag provides an ext_proc processor that adds strong ETags to
+// upstream responses lacking them and answers conditional requests with 304.
+package etag
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/match"
+	"github.com/rs/zerolog"
+)
+
+// Config holds ETag generation settings.
+type Config struct {
+	// Routes are the path prefixes whose responses get ETags.
+	Routes []string
+	// CacheSize is the number of validators remembered.
+	CacheSize int
+	// CacheTTL bounds how long a remembered validator answers If-None-Match
+	// without asking upstream.
+	CacheTTL time.Duration
+}
+
+// ProcessorFactory creates ETag processors.
+type ProcessorFactory struct {
+	cfg        Config
+	validators *expirable.LRU[string, string]
+	log        zerolog.Logger
+}
+
+// NewProcessorFactory creates a new ETag ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	return &ProcessorFactory{
+		cfg:        cfg,
+		validators: expirable.NewLRU[string, string](cfg.CacheSize, nil, cfg.CacheTTL),
+		log:        log.With().Str("processor", "etag").Logger(),
+	}
+}
+
+// NewProcessor creates a new ETag processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	key         string
+	ifNoneMatch string
+	// cacheable is false for requests or responses that must not share
+	// validators with other clients.
+	cacheable bool
+	eligible  bool
+}
+
+// ProcessRequestHeaders answers conditional requests from the validator
+// cache and buffers the response body of eligible requests.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	pathWithQuery := ctx.Headers.Get(":path")
+	if ctx.Headers.Get(":method") != http.MethodGet || !f.matches(match.NormalizePath(pathWithQuery)) {
+		return extproc.ContinueResult()
+	}
+
+	p.key = ctx.Headers.Get(":authority") + pathWithQuery
+	p.ifNoneMatch = ctx.Headers.Get("if-none-match")
+	p.cacheable = ctx.Headers.Get("authorization") == "" && ctx.Headers.Get("cookie") == ""
+
+	if p.ifNoneMatch != "" && p.cacheable {
+		if tag, ok := f.validators.Get(p.key); ok && matchesAny(p.ifNoneMatch, tag) {
+			f.log.Debug().Str("key", p.key).Str("etag", tag).Msg("validator cache hit")
+			return notModified(tag)
+		}
+	}
+
+	result := extproc.ContinueResult()
+	result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+		ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+		ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_BUFFERED_PARTIAL,
+		RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+	}
+	return result
+}
+
+// ProcessResponseHeaders decides whether the response gets an ETag.
+func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	if p.key == "" || ctx.EndOfStream {
+		return extproc.ContinueResult()
+	}
+	h := ctx.Headers
+	p.eligible = h.Get(":status") == "200" &&
+		h.Get("etag") == "" &&
+		!strings.Contains(strings.ToLower(h.Get("cache-control")), "no-store")
+	if h.Get("vary") != "" || h.Get("set-cookie") != "" {
+		p.cacheable = false
+	}
+	return extproc.ContinueResult()
+}
+
+// ProcessResponseBody hashes the complete body into a strong ETag. Bodies
+// larger than Envoy's buffer limit arrive partially and are left untouched.
+func (p *Processor) ProcessResponseBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	if !p.eligible || !endOfStream {
+		return extproc.ContinueResult()
+	}
+	p.eligible = false
+
+	sum := sha256.Sum256(body)
+	tag := `"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`
+	if p.cacheable {
+		p.factory.validators.Add(p.key, tag)
+	}
+	if p.ifNoneMatch != "" && matchesAny(p.ifNoneMatch, tag) {
+		return notModified(tag)
+	}
+	return extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("etag", tag),
+	})
+}
+
+// matches reports whether path, normalized, is under one of the routes, by
+// whole segments.
+func (f *ProcessorFactory) matches(path string) bool {
+	for _, prefix := range f.cfg.Routes {
+		if match.PathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether an If-None-Match value matches tag using weak
+// comparison, as RFC 9110 requires for If-None-Match.
+func matchesAny(ifNoneMatch, tag string) bool {
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func notModified(tag string) *extproc.ProcessingResult {
+	return extproc.ImmediateResult(http.StatusNotModified, []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("etag", tag),
+	}, nil)
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
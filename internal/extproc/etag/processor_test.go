@@ -0,0 +1,106 @@
+package etag
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+const body = `{"items":[]}`
+
+func strongTag(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`
+}
+
+// fetch runs a GET of /api/items through p and returns the result of the
+// last phase.
+func fetch(f *ProcessorFactory, headers []string, response ...string) *extproc.ProcessingResult {
+	p := f.NewProcessor()
+	req := append([]string{":method", "GET", ":path", "/api/items", ":authority", "example.com"}, headers...)
+	if result := p.ProcessRequestHeaders(extproctest.NewContext(nil, req...)); result.ImmediateResponse != nil {
+		return result
+	}
+	p.ProcessResponseHeaders(extproctest.NewContext(nil, append([]string{":status", "200"}, response...)...))
+	return p.ProcessResponseBody(nil, []byte(body), true)
+}
+
+func TestETag(t *testing.T) {
+	f := NewProcessorFactory(Config{Routes: []string{"/api/"}, CacheSize: 16, CacheTTL: time.Minute}, zerolog.Nop())
+	tag := strongTag(body)
+
+	extproctest.Check(t, fetch(f, nil), extproctest.ExpectContinue(), extproctest.ExpectHeaderSet("etag", tag))
+	// The validator is remembered, so a matching request is answered
+	// without the upstream.
+	p := f.NewProcessor()
+	extproctest.Check(t, p.ProcessRequestHeaders(extproctest.NewContext(nil,
+		":method", "GET", ":path", "/api/items", ":authority", "example.com", "if-none-match", "W/"+tag)),
+		extproctest.ExpectDenied(http.StatusNotModified),
+		extproctest.ExpectHeaderSet("etag", tag))
+}
+
+func TestETagPrivate(t *testing.T) {
+	f := NewProcessorFactory(Config{Routes: []string{"/api/"}, CacheSize: 16, CacheTTL: time.Minute}, zerolog.Nop())
+	tag := strongTag(body)
+
+	// Credentialed requests and responses setting cookies get a tag, and a
+	// matching validator is still answered from the body, but neither
+	// populates the shared cache.
+	extproctest.Check(t, fetch(f, []string{"authorization", "Bearer x", "if-none-match", tag}), extproctest.ExpectDenied(http.StatusNotModified))
+	extproctest.Check(t, fetch(f, nil, "set-cookie", "a=b"), extproctest.ExpectHeaderSet("etag", tag))
+	extproctest.Check(t, f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil,
+		":method", "GET", ":path", "/api/items", ":authority", "example.com", "if-none-match", tag)),
+		extproctest.ExpectContinue())
+
+	// no-store responses are left alone.
+	if result := fetch(f, nil, "cache-control", "no-store"); result.HeaderMutations != nil {
+		t.Errorf("no-store response: %s", extproctest.Describe(result))
+	}
+}
+
+// TestETagReusedStream checks that a request does not inherit the cache
+// key of the previous one on its stream.
+func TestETagReusedStream(t *testing.T) {
+	f := NewProcessorFactory(Config{Routes: []string{"/api/"}, CacheSize: 16, CacheTTL: time.Minute}, zerolog.Nop())
+	sent := extproctest.Run(t, f,
+		extproctest.RequestHeaders(nil, ":method", "GET", ":path", "/api/items", ":authority", "example.com"),
+		extproctest.ResponseHeaders(":status", "200"),
+		extproctest.ResponseBody(body, true),
+		// Not an ETag route: its response must not be tagged or cached.
+		extproctest.RequestHeaders(nil, ":method", "GET", ":path", "/other", ":authority", "example.com"),
+		extproctest.ResponseHeaders(":status", "200"),
+		extproctest.ResponseBody("other", true),
+	)
+	if mutation := sent[5].GetResponseBody().GetResponse().GetHeaderMutation(); mutation != nil {
+		t.Errorf("second request's response mutated: %v", mutation)
+	}
+	if _, ok := f.validators.Get("example.com/other"); ok {
+		t.Error("cached a validator for a request outside the routes")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	f := NewProcessorFactory(Config{Routes: []string{"/api", "/static/"}, CacheSize: 16, CacheTTL: time.Minute}, zerolog.Nop())
+	for path, want := range map[string]bool{
+		"/api":             true,
+		"/api/items?q=1":   true,
+		"//api/items":      true,
+		"/%61pi/items":     true,
+		"/public/../api/x": true,
+		"/apiary":          false,
+		"/static":          false,
+		"/static/app.js":   true,
+		"/staticfiles/x":   false,
+	} {
+		result := f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, ":method", "GET", ":path", path))
+		if got := result.ModeOverride != nil; got != want {
+			t.Errorf("%s eligible = %v, want %v", path, got, want)
+		}
+	}
+}
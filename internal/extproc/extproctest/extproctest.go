@@ -0,0 +1,206 @@
+// Package extproctest provides helpers for unit testing processors: building
+// a RequestContext and asserting on the ProcessingResult of a phase.
+//
+//	p := factory.NewProcessor()
+//	result := p.ProcessRequestHeaders(extproctest.NewContext(
+//		map[string]string{"source.address": "198.51.100.1:443"},
+//		":method", "GET", ":path", "/",
+//	))
+//	extproctest.Check(t, result,
+//		extproctest.ExpectContinue(),
+//		extproctest.ExpectXFFAppended("198.51.100.1"),
+//	)
+package extproctest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+)
+
+// HeaderXFF is the header ExpectXFFAppended inspects.
+const HeaderXFF = "x-forwarded-for"
+
+// NewContext builds a RequestContext with the given ext_proc attributes and
+// header key/value pairs, as the server would for a headers phase followed
+// by a body. Set EndOfStream for a message without one.
+func NewContext(attrs map[string]string, headers ...string) *extproc.RequestContext {
+	ctx := &extproc.RequestContext{Headers: make(http.Header)}
+	for i := 0; i+1 < len(headers); i += 2 {
+		ctx.Headers.Add(headers[i], headers[i+1])
+	}
+	ctx.Attributes = attributes(attrs)
+	return ctx
+}
+
+// Expectation checks one aspect of a ProcessingResult.
+type Expectation func(*extproc.ProcessingResult) error
+
+// Check reports each expectation that result fails as a test error.
+func Check(t testing.TB, result *extproc.ProcessingResult, expectations ...Expectation) {
+	t.Helper()
+	if result == nil {
+		t.Error("processor returned a nil result")
+		return
+	}
+	for _, expect := range expectations {
+		if err := expect(result); err != nil {
+			t.Errorf("%v; result: %s", err, Describe(result))
+		}
+	}
+}
+
+// ExpectContinue asserts that the result continues processing rather than
+// answering the request.
+func ExpectContinue() Expectation {
+	return func(r *extproc.ProcessingResult) error {
+		if r.ImmediateResponse != nil {
+			return fmt.Errorf("got immediate response %d, want continue", r.ImmediateResponse.GetStatus().GetCode())
+		}
+		if r.Status != envoy_service_proc_v3.CommonResponse_CONTINUE {
+			return fmt.Errorf("got status %s, want CONTINUE", r.Status)
+		}
+		return nil
+	}
+}
+
+// ExpectDenied asserts that the result answers the request with status.
+func ExpectDenied(status int) Expectation {
+	return func(r *extproc.ProcessingResult) error {
+		if r.ImmediateResponse == nil {
+			return fmt.Errorf("got continue, want immediate response %d", status)
+		}
+		if got := int(r.ImmediateResponse.GetStatus().GetCode()); got != status {
+			return fmt.Errorf("got immediate response %d, want %d", got, status)
+		}
+		return nil
+	}
+}
+
+// ExpectHeaderSet asserts that the result sets key to value, either as a
+// header mutation or on the immediate response.
+func ExpectHeaderSet(key, value string) Expectation {
+	return func(r *extproc.ProcessingResult) error {
+		got, ok := setHeader(r, key)
+		if !ok {
+			return fmt.Errorf("header %q not set, want %q", key, value)
+		}
+		if got != value {
+			return fmt.Errorf("header %q set to %q, want %q", key, got, value)
+		}
+		return nil
+	}
+}
+
+// ExpectHeaderRemoved asserts that the result removes key.
+func ExpectHeaderRemoved(key string) Expectation {
+	return func(r *extproc.ProcessingResult) error {
+		if r.HeaderMutations != nil {
+			for _, name := range r.HeaderMutations.RemoveHeaders {
+				if strings.EqualFold(name, key) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("header %q not removed", key)
+	}
+}
+
+// ExpectXFFAppended asserts that the result sets x-forwarded-for, or
+// appends to it, with hop as the last address.
+func ExpectXFFAppended(hop string) Expectation {
+	return func(r *extproc.ProcessingResult) error {
+		got, ok := setHeader(r, HeaderXFF)
+		if !ok {
+			return fmt.Errorf("%s not set, want last hop %q", HeaderXFF, hop)
+		}
+		hops := strings.Split(got, ",")
+		if last := strings.TrimSpace(hops[len(hops)-1]); last != hop {
+			return fmt.Errorf("%s is %q, want last hop %q", HeaderXFF, got, hop)
+		}
+		return nil
+	}
+}
+
+// ExpectBody asserts that the result replaces the body chunk with body.
+func ExpectBody(body string) Expectation {
+	return func(r *extproc.ProcessingResult) error {
+		if r.BodyMutation == nil {
+			return fmt.Errorf("body not mutated, want %q", body)
+		}
+		if got := string(r.BodyMutation.GetBody()); got != body {
+			return fmt.Errorf("body replaced with %q, want %q", got, body)
+		}
+		return nil
+	}
+}
+
+// ExpectMetadata asserts that the result emits value as the string key of
+// the namespace's dynamic metadata.
+func ExpectMetadata(namespace, key, value string) Expectation {
+	return func(r *extproc.ProcessingResult) error {
+		v, ok := r.DynamicMetadata.GetFields()[namespace].GetStructValue().GetFields()[key]
+		if !ok {
+			return fmt.Errorf("metadata %s.%s not set, want %q", namespace, key, value)
+		}
+		if got := v.GetStringValue(); got != value {
+			return fmt.Errorf("metadata %s.%s set to %q, want %q", namespace, key, got, value)
+		}
+		return nil
+	}
+}
+
+// setHeader returns the last value the result sets for key.
+func setHeader(r *extproc.ProcessingResult, key string) (string, bool) {
+	var options []*envoy_api_v3_core.HeaderValueOption
+	if r.HeaderMutations != nil {
+		options = r.HeaderMutations.SetHeaders
+	}
+	if r.ImmediateResponse != nil {
+		options = append(options, r.ImmediateResponse.GetHeaders().GetSetHeaders()...)
+	}
+	value, found := "", false
+	for _, opt := range options {
+		if strings.EqualFold(opt.GetHeader().GetKey(), key) {
+			value, found = headerValue(opt.GetHeader()), true
+		}
+	}
+	return value, found
+}
+
+func headerValue(h *envoy_api_v3_core.HeaderValue) string {
+	if raw := h.GetRawValue(); len(raw) > 0 {
+		return string(raw)
+	}
+	return h.GetValue()
+}
+
+// Describe summarizes a result for failure messages.
+func Describe(r *extproc.ProcessingResult) string {
+	var b strings.Builder
+	if r.ImmediateResponse != nil {
+		fmt.Fprintf(&b, "immediate %d", r.ImmediateResponse.GetStatus().GetCode())
+	} else {
+		b.WriteString(r.Status.String())
+	}
+	if r.HeaderMutations != nil {
+		for _, opt := range r.HeaderMutations.SetHeaders {
+			fmt.Fprintf(&b, " set %s=%q", opt.GetHeader().GetKey(), headerValue(opt.GetHeader()))
+		}
+		for _, name := range r.HeaderMutations.RemoveHeaders {
+			fmt.Fprintf(&b, " remove %s", name)
+		}
+	}
+	if r.BodyMutation != nil {
+		fmt.Fprintf(&b, " body %d bytes", len(r.BodyMutation.GetBody()))
+	}
+	if r.DynamicMetadata != nil {
+		fmt.Fprintf(&b, " metadata %v", r.DynamicMetadata.AsMap())
+	}
+	return b.String()
+}
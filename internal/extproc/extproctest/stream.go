@@ -0,0 +1,139 @@
+package extproctest
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Run feeds messages to a Server for factory as one ext_proc stream, the
+// way Envoy would, and returns the responses in the order they were sent.
+// Use it for behavior spanning phases or requests, e.g. several requests
+// on one stream:
+//
+//	sent := extproctest.Run(t, factory,
+//		extproctest.RequestHeaders(attrs, ":method", "GET", ":path", "/"),
+//		extproctest.ResponseHeaders(":status", "200"),
+//		extproctest.RequestHeaders(attrs, ":method", "GET", ":path", "/"),
+//	)
+func Run(
+	t testing.TB,
+	factory extproc.ProcessorFactory,
+	messages ...*envoy_service_proc_v3.ProcessingRequest,
+) []*envoy_service_proc_v3.ProcessingResponse {
+	t.Helper()
+	stream := &stream{requests: messages}
+	s := extproc.NewServer(factory, zerolog.Nop(), extproc.WithDispatch(extproc.DispatchSequential, 1))
+	if err := s.Process(stream); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if len(stream.sent) != len(messages) {
+		t.Fatalf("sent %d responses to %d messages", len(stream.sent), len(messages))
+	}
+	return stream.sent
+}
+
+// RequestHeaders builds a request headers message with the given ext_proc
+// attributes and header key/value pairs.
+func RequestHeaders(attrs map[string]string, headers ...string) *envoy_service_proc_v3.ProcessingRequest {
+	return &envoy_service_proc_v3.ProcessingRequest{
+		Request: &envoy_service_proc_v3.ProcessingRequest_RequestHeaders{
+			RequestHeaders: &envoy_service_proc_v3.HttpHeaders{Headers: headerMap(headers)},
+		},
+		Attributes: attributes(attrs),
+	}
+}
+
+// RequestBody builds a request body message.
+func RequestBody(body string, endOfStream bool) *envoy_service_proc_v3.ProcessingRequest {
+	return &envoy_service_proc_v3.ProcessingRequest{
+		Request: &envoy_service_proc_v3.ProcessingRequest_RequestBody{
+			RequestBody: &envoy_service_proc_v3.HttpBody{Body: []byte(body), EndOfStream: endOfStream},
+		},
+	}
+}
+
+// ResponseHeaders builds a response headers message with the given header
+// key/value pairs.
+func ResponseHeaders(headers ...string) *envoy_service_proc_v3.ProcessingRequest {
+	return &envoy_service_proc_v3.ProcessingRequest{
+		Request: &envoy_service_proc_v3.ProcessingRequest_ResponseHeaders{
+			ResponseHeaders: &envoy_service_proc_v3.HttpHeaders{Headers: headerMap(headers)},
+		},
+	}
+}
+
+// ResponseBody builds a response body message.
+func ResponseBody(body string, endOfStream bool) *envoy_service_proc_v3.ProcessingRequest {
+	return &envoy_service_proc_v3.ProcessingRequest{
+		Request: &envoy_service_proc_v3.ProcessingRequest_ResponseBody{
+			ResponseBody: &envoy_service_proc_v3.HttpBody{Body: []byte(body), EndOfStream: endOfStream},
+		},
+	}
+}
+
+// ImmediateStatus returns the status of an immediate response, or 0 if
+// resp lets the message through.
+func ImmediateStatus(resp *envoy_service_proc_v3.ProcessingResponse) int {
+	return int(resp.GetImmediateResponse().GetStatus().GetCode())
+}
+
+func headerMap(headers []string) *envoy_api_v3_core.HeaderMap {
+	m := &envoy_api_v3_core.HeaderMap{}
+	for i := 0; i+1 < len(headers); i += 2 {
+		m.Headers = append(m.Headers, &envoy_api_v3_core.HeaderValue{Key: headers[i], RawValue: []byte(headers[i+1])})
+	}
+	return m
+}
+
+func attributes(attrs map[string]string) map[string]*structpb.Struct {
+	if len(attrs) == 0 {
+		return nil
+	}
+	fields := make(map[string]*structpb.Value, len(attrs))
+	for k, v := range attrs {
+		fields[k] = structpb.NewStringValue(v)
+	}
+	return map[string]*structpb.Struct{extproc.EnvoyAttributesKey: {Fields: fields}}
+}
+
+// stream is an ext_proc stream replaying requests.
+type stream struct {
+	grpc.ServerStream
+	requests []*envoy_service_proc_v3.ProcessingRequest
+
+	mu   sync.Mutex
+	sent []*envoy_service_proc_v3.ProcessingResponse
+}
+
+func (s *stream) Context() context.Context { return context.Background() }
+
+func (s *stream) Recv() (*envoy_service_proc_v3.ProcessingRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		return nil, io.EOF
+	}
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+	return req, nil
+}
+
+func (s *stream) Send(resp *envoy_service_proc_v3.ProcessingResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Responses are pooled and reused once sent.
+	s.sent = append(s.sent, proto.Clone(resp).(*envoy_service_proc_v3.ProcessingResponse))
+	return nil
+}
@@ -0,0 +1,212 @@
+// Package fault provides an ext_proc processor that injects delays, error
+// responses and response body corruption into a share of matching requests,
+// for chaos experiments that do not require changing Envoy configuration.
+package fault
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/featureflag"
+	"github.com/rs/zerolog"
+)
+
+// Config holds fault injection settings. Percentages are in the range 0-100.
+type Config struct {
+	// Routes are the path prefixes eligible for faults; empty matches all.
+	Routes []string
+	// GuardHeader must be present on a request for it to be eligible. It is
+	// removed before the request is forwarded.
+	GuardHeader string
+	// GuardValue, if set, must equal the guard header's value.
+	GuardValue string
+
+	// DelayPercent of eligible requests are held for Delay before being
+	// forwarded.
+	DelayPercent float64
+	Delay        time.Duration
+	// AbortPercent of eligible requests are answered with AbortStatus.
+	AbortPercent float64
+	AbortStatus  int
+	// CorruptPercent of eligible responses have CorruptBytes random bytes
+	// of every body chunk overwritten.
+	CorruptPercent float64
+	CorruptBytes   int
+
+	// MarkerHeader, if set, is added to responses listing injected faults.
+	MarkerHeader string
+
+	// Flags, if set, are evaluated per eligible request: "fault.enabled"
+	// turns injection off, and "fault.delay-percent", "fault.abort-percent"
+	// and "fault.corrupt-percent" override the percentages.
+	Flags *featureflag.Client
+}
+
+// ProcessorFactory creates fault injection processors.
+type ProcessorFactory struct {
+	cfg Config
+	log zerolog.Logger
+}
+
+// NewProcessorFactory creates a new fault injection ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	return &ProcessorFactory{
+		cfg: cfg,
+		log: log.With().Str("processor", "fault").Logger(),
+	}
+}
+
+// NewProcessor creates a new fault injection processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f, done: make(chan struct{})}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	mu      sync.Mutex
+	faults  []string
+	corrupt bool
+	end     sync.Once
+	done    chan struct{}
+}
+
+// ProcessRequestHeaders decides which faults apply to the request, then
+// delays or aborts it.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	if !f.eligible(ctx.Headers) {
+		return extproc.ContinueResult()
+	}
+
+	delayPercent, abortPercent, corruptPercent := f.cfg.DelayPercent, f.cfg.AbortPercent, f.cfg.CorruptPercent
+	if flags := f.cfg.Flags; flags != nil {
+		ec := flags.Context(ctx.Headers)
+		if !flags.Bool(context.Background(), "fault.enabled", true, ec) {
+			return extproc.ContinueResult()
+		}
+		delayPercent = flags.Float(context.Background(), "fault.delay-percent", delayPercent, ec)
+		abortPercent = flags.Float(context.Background(), "fault.abort-percent", abortPercent, ec)
+		corruptPercent = flags.Float(context.Background(), "fault.corrupt-percent", corruptPercent, ec)
+	}
+
+	var faults []string
+	log := f.log.Debug().Str("request_id", ctx.GetRequestID()).Str("path", ctx.Headers.Get(":path"))
+
+	if roll(delayPercent) && f.cfg.Delay > 0 {
+		faults = append(faults, "delay")
+		timer := time.NewTimer(f.cfg.Delay)
+		select {
+		case <-timer.C:
+		case <-p.done:
+			timer.Stop()
+			return extproc.ContinueResult()
+		}
+	}
+
+	if roll(abortPercent) {
+		faults = append(faults, "abort")
+		log.Strs("faults", faults).Msg("injected faults")
+		var headers []*envoy_api_v3_core.HeaderValueOption
+		if f.cfg.MarkerHeader != "" {
+			headers = append(headers, extproc.SetHeader(f.cfg.MarkerHeader, strings.Join(faults, ",")))
+		}
+		return extproc.ImmediateResult(f.cfg.AbortStatus, headers, []byte("fault injected: "+http.StatusText(f.cfg.AbortStatus)+"\n"))
+	}
+
+	result := extproc.ContinueResult()
+	if f.cfg.GuardHeader != "" {
+		result.HeaderMutations = &extproc.HeaderMutations{RemoveHeaders: []string{f.cfg.GuardHeader}}
+	}
+	corrupt := roll(corruptPercent) && f.cfg.CorruptBytes > 0
+	if corrupt {
+		faults = append(faults, "corrupt")
+		result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+			ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+			ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_STREAMED,
+			RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+			ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		}
+	}
+	if len(faults) > 0 {
+		log.Strs("faults", faults).Msg("injected faults")
+	}
+
+	p.mu.Lock()
+	p.faults, p.corrupt = faults, corrupt
+	p.mu.Unlock()
+	return result
+}
+
+// ProcessResponseHeaders adds the marker header listing injected faults.
+func (p *Processor) ProcessResponseHeaders(*extproc.RequestContext) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.factory.cfg.MarkerHeader == "" || len(p.faults) == 0 {
+		return extproc.ContinueResult()
+	}
+	return extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader(p.factory.cfg.MarkerHeader, strings.Join(p.faults, ",")),
+	})
+}
+
+// ProcessResponseBody overwrites random bytes of each chunk. The body length
+// is unchanged, so Content-Length stays valid.
+func (p *Processor) ProcessResponseBody(_ *extproc.RequestContext, body []byte, _ bool) *extproc.ProcessingResult {
+	p.mu.Lock()
+	corrupt := p.corrupt
+	p.mu.Unlock()
+	if !corrupt || len(body) == 0 {
+		return extproc.ContinueResult()
+	}
+
+	body = slices.Clone(body)
+	for range min(p.factory.cfg.CorruptBytes, len(body)) {
+		body[rand.IntN(len(body))] = byte(rand.UintN(256))
+	}
+	return extproc.ContinueWithBody(body)
+}
+
+// OnStreamEnd stops a pending delay when the client goes away.
+func (p *Processor) OnStreamEnd() {
+	p.end.Do(func() { close(p.done) })
+}
+
+// eligible reports whether a request matches a route and carries the guard.
+func (f *ProcessorFactory) eligible(h http.Header) bool {
+	if f.cfg.GuardHeader != "" {
+		values := h.Values(f.cfg.GuardHeader)
+		if len(values) == 0 || (f.cfg.GuardValue != "" && !slices.Contains(values, f.cfg.GuardValue)) {
+			return false
+		}
+	}
+	if len(f.cfg.Routes) == 0 {
+		return true
+	}
+	path, _, _ := strings.Cut(h.Get(":path"), "?")
+	return slices.ContainsFunc(f.cfg.Routes, func(route string) bool { return strings.HasPrefix(path, route) })
+}
+
+// roll reports whether an event with the given percentage chance happens.
+func roll(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.StreamEndHandler.
+var _ extproc.StreamEndHandler = (*Processor)(nil)
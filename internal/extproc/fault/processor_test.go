@@ -0,0 +1,37 @@
+package fault
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+func TestProcessRequestHeaders(t *testing.T) {
+	factory := NewProcessorFactory(Config{
+		Routes:       []string{"/api/"},
+		GuardHeader:  "x-chaos",
+		AbortPercent: 100,
+		AbortStatus:  http.StatusServiceUnavailable,
+		MarkerHeader: "x-fault",
+	}, zerolog.Nop())
+
+	t.Run("eligible", func(t *testing.T) {
+		result := factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, ":path", "/api/users", "x-chaos", "1"))
+		extproctest.Check(t, result,
+			extproctest.ExpectDenied(http.StatusServiceUnavailable),
+			extproctest.ExpectHeaderSet("x-fault", "abort"),
+		)
+	})
+
+	t.Run("without guard header", func(t *testing.T) {
+		result := factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, ":path", "/api/users"))
+		extproctest.Check(t, result, extproctest.ExpectContinue())
+	})
+
+	t.Run("other route", func(t *testing.T) {
+		result := factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, ":path", "/static/app.js", "x-chaos", "1"))
+		extproctest.Check(t, result, extproctest.ExpectContinue())
+	})
+}
@@ -0,0 +1,107 @@
+package extproc
+
+import (
+	"net/netip"
+	"testing"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+func FuzzParseIPFromAddress(f *testing.F) {
+	for _, seed := range []string{
+		"203.0.113.7", "203.0.113.7:443", "[2001:db8::1]:8443", "[2001:db8::1]", "2001:db8::1",
+		"::ffff:10.0.0.1", "fe80::1%eth0", "", ":", "[]", "[::1", "1.2.3.4:99999", "1.2.3.04",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, addr string) {
+		ip, err := ParseIPFromAddress(addr)
+		if err != nil {
+			if ip.IsValid() {
+				t.Fatalf("ParseIPFromAddress(%q) returned %v with error %v", addr, ip, err)
+			}
+			return
+		}
+		if !ip.IsValid() {
+			t.Fatalf("ParseIPFromAddress(%q) returned an invalid address without error", addr)
+		}
+		again, err := ParseIPFromAddress(ip.String())
+		if err != nil || again != ip {
+			t.Fatalf("ParseIPFromAddress(%q) = %v does not round-trip: %v, %v", addr, ip, again, err)
+		}
+		if _, err := netip.ParseAddr(ip.String()); err != nil {
+			t.Fatalf("ParseIPFromAddress(%q) = %v is not a valid address: %v", addr, ip, err)
+		}
+	})
+}
+
+func FuzzParseHeaderMap(f *testing.F) {
+	f.Add(":authority", "example.com", []byte(nil), "content-type", "", []byte("text/event-stream"))
+	f.Add("X-Mixed-Case", "v", []byte("raw"), "x-mixed-case", "w", []byte(nil))
+	f.Add("", "", []byte{0xff, 0x00}, "\x00", "\r\n", []byte("\xc3\x28"))
+	f.Fuzz(func(t *testing.T, k1, v1 string, raw1 []byte, k2, v2 string, raw2 []byte) {
+		m := &envoy_api_v3_core.HeaderMap{Headers: []*envoy_api_v3_core.HeaderValue{
+			{Key: k1, Value: v1, RawValue: raw1},
+			{Key: k2, Value: v2, RawValue: raw2},
+		}}
+		headers := parseHeaderMap(m)
+		values := 0
+		for _, v := range headers {
+			values += len(v)
+		}
+		if values != 2 {
+			t.Fatalf("parsed %d values from 2 headers: %v", values, headers)
+		}
+		want := headerValue(v1, raw1)
+		if got := findHeader(m, k1); got != want {
+			t.Fatalf("findHeader(%q) = %q, want %q", k1, got, want)
+		}
+	})
+}
+
+func FuzzMultipartParser(f *testing.F) {
+	const contentType = "multipart/form-data; boundary=xyz"
+	for _, seed := range []string{
+		"--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nhello\r\n--xyz--\r\n",
+		"--xyz\r\nContent-Disposition: form-data; name=\"f\"; filename=\"../x.txt\"\r\n\r\n\r\n--xy\r\n--xyz--",
+		"preamble\r\n--xyz\r\n\r\n\r\n--xyz--", "--xyz--", "--xyz", "", "\r\n--xyz\r\nbad header\r\n\r\n",
+	} {
+		f.Add([]byte(seed), uint8(3))
+	}
+	f.Fuzz(func(t *testing.T, body []byte, chunk uint8) {
+		run := func(n int) (sizes []int64, err error) {
+			p, err := NewMultipartParser(contentType, MultipartLimits{}, MultipartCallbacks{
+				OnPartEnd: func(part *MultipartPart) error {
+					sizes = append(sizes, part.Size)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rest := body; len(rest) > 0; {
+				c := rest[:min(n, len(rest))]
+				rest = rest[len(c):]
+				if err := p.Write(c); err != nil {
+					return sizes, err
+				}
+			}
+			return sizes, p.Close()
+		}
+		whole, wholeErr := run(len(body) + 1)
+		split, splitErr := run(int(chunk%16) + 1)
+		if (wholeErr == nil) != (splitErr == nil) || len(whole) != len(split) {
+			t.Fatalf("chunking changed the result: %v (%v) vs %v (%v)", whole, wholeErr, split, splitErr)
+		}
+		var total int64
+		for i := range whole {
+			if whole[i] != split[i] {
+				t.Fatalf("part %d size %d vs %d across chunkings", i, whole[i], split[i])
+			}
+			total += whole[i]
+		}
+		if total > int64(len(body)) {
+			t.Fatalf("parts total %d bytes from a %d byte body", total, len(body))
+		}
+	})
+}
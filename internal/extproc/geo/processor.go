@@ -0,0 +1,214 @@
+// Package geo provides an ext_proc processor that resolves the client to a
+// region, from trusted CDN geo headers or an mmdb database, and injects it
+// as a header for locality-aware routing.
+package geo
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/geo"
+	"github.com/rs/zerolog"
+)
+
+// Resolver looks up the location of an address.
+type Resolver interface {
+	Lookup(ip netip.Addr) (geo.Location, bool)
+}
+
+// Config holds where locations come from and how they map to regions.
+type Config struct {
+	// DB, if set, resolves addresses without a trusted CDN header.
+	DB Resolver
+	// CDNHeaders are CDN country headers (e.g. cf-ipcountry), checked in
+	// order. They are believed only from trusted sources and removed
+	// otherwise.
+	CDNHeaders []string
+	// TrustedProxies are peers whose CDN headers are believed.
+	TrustedProxies []netip.Prefix
+	// TrustHeader and TrustValue, if set, also trust CDN headers of
+	// requests an earlier filter marked, e.g. x-forwarded-from-edgeone: yes.
+	TrustHeader string
+	TrustValue  string
+	// ClientIPHeader, if set, holds the address looked up in DB, as set by
+	// a trusted earlier filter; otherwise the downstream peer address is
+	// used.
+	ClientIPHeader string
+	// Regions maps countries, and ContinentRegions continents, to regions.
+	Regions          map[string]string
+	ContinentRegions map[string]string
+	// DefaultRegion is used for clients that map to no region; empty
+	// leaves the region header unset.
+	DefaultRegion string
+	// RegionHeader and CountryHeader carry the result upstream.
+	RegionHeader  string
+	CountryHeader string
+}
+
+// ProcessorFactory creates geo processors.
+type ProcessorFactory struct {
+	cfg Config
+	log zerolog.Logger
+}
+
+// NewProcessorFactory creates a new geo ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	if cfg.RegionHeader == "" {
+		cfg.RegionHeader = "x-client-region"
+	}
+	if cfg.CountryHeader == "" {
+		cfg.CountryHeader = "x-client-country"
+	}
+	cfg.RegionHeader = strings.ToLower(cfg.RegionHeader)
+	cfg.CountryHeader = strings.ToLower(cfg.CountryHeader)
+	cfg.Regions = upperKeys(cfg.Regions)
+	cfg.ContinentRegions = upperKeys(cfg.ContinentRegions)
+	for i, h := range cfg.CDNHeaders {
+		cfg.CDNHeaders[i] = strings.ToLower(h)
+	}
+	return &ProcessorFactory{
+		cfg: cfg,
+		log: log.With().Str("processor", "geo").Logger(),
+	}
+}
+
+func upperKeys(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[strings.ToUpper(strings.TrimSpace(k))] = v
+	}
+	return out
+}
+
+// NewProcessor creates a new geo processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+}
+
+// ProcessRequestHeaders resolves the client's location and sets the region
+// and country headers, overwriting or removing any the client sent.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	result := &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{},
+		// The region header may select the route.
+		ClearRouteCache: true,
+	}
+	m := result.HeaderMutations
+
+	var loc geo.Location
+	source := "none"
+	trusted := p.trusted(ctx)
+	for _, h := range f.cfg.CDNHeaders {
+		raw := ctx.Headers.Get(h)
+		if raw == "" {
+			continue
+		}
+		country, ok := geo.NormalizeCountry(raw)
+		switch {
+		case !trusted:
+			m.RemoveHeaders = append(m.RemoveHeaders, h)
+		case !ok:
+			m.RemoveHeaders = append(m.RemoveHeaders, h)
+		default:
+			if country != raw {
+				m.SetHeaders = append(m.SetHeaders, extproc.SetHeader(h, country))
+			}
+			if loc.Country == "" {
+				loc.Country, source = country, "cdn"
+			}
+		}
+	}
+	if loc.Country == "" && f.cfg.DB != nil {
+		if ip, ok := p.clientIP(ctx); ok {
+			if found, ok := f.cfg.DB.Lookup(ip); ok {
+				loc, source = found, "mmdb"
+			}
+		}
+	}
+
+	region := f.region(loc)
+	set := func(name, value string) {
+		if value != "" {
+			m.SetHeaders = append(m.SetHeaders, extproc.SetHeader(name, value))
+		} else {
+			m.RemoveHeaders = append(m.RemoveHeaders, name)
+		}
+	}
+	set(f.cfg.RegionHeader, region)
+	set(f.cfg.CountryHeader, loc.Country)
+
+	f.log.Debug().
+		Str("request_id", ctx.GetRequestID()).
+		Str("source", source).
+		Bool("trusted", trusted).
+		Str("country", loc.Country).
+		Str("region", region).
+		Msg("resolved client region")
+	return result
+}
+
+// trusted reports whether the request's CDN headers are believed.
+func (p *Processor) trusted(ctx *extproc.RequestContext) bool {
+	f := p.factory
+	if f.cfg.TrustHeader != "" && ctx.Headers.Get(f.cfg.TrustHeader) == f.cfg.TrustValue {
+		return true
+	}
+	if len(f.cfg.TrustedProxies) == 0 {
+		return false
+	}
+	peer, err := ctx.GetDownstreamRemoteIP()
+	if err != nil {
+		return false
+	}
+	peer = peer.Unmap()
+	for _, prefix := range f.cfg.TrustedProxies {
+		if prefix.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Processor) clientIP(ctx *extproc.RequestContext) (netip.Addr, bool) {
+	if h := p.factory.cfg.ClientIPHeader; h != "" {
+		ip, err := extproc.ParseIPFromAddress(strings.TrimSpace(ctx.Headers.Get(h)))
+		return ip, err == nil
+	}
+	ip, err := ctx.GetDownstreamRemoteIP()
+	return ip, err == nil
+}
+
+// region maps loc to a region: by country, then continent, then the
+// default.
+func (f *ProcessorFactory) region(loc geo.Location) string {
+	if r, ok := f.cfg.Regions[loc.Country]; ok && loc.Country != "" {
+		return r
+	}
+	if r, ok := f.cfg.ContinentRegions[loc.Continent]; ok && loc.Continent != "" {
+		return r
+	}
+	return f.cfg.DefaultRegion
+}
+
+// Phases reports that only request headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
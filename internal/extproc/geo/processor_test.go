@@ -0,0 +1,137 @@
+package geo
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/geo"
+	"github.com/rs/zerolog"
+)
+
+// staticDB resolves addresses from a fixed table.
+type staticDB map[netip.Addr]geo.Location
+
+func (db staticDB) Lookup(ip netip.Addr) (geo.Location, bool) {
+	loc, ok := db[ip.Unmap()]
+	return loc, ok
+}
+
+func TestProcessRequestHeaders(t *testing.T) {
+	factory := NewProcessorFactory(Config{
+		DB: staticDB{
+			netip.MustParseAddr("198.51.100.1"): {Country: "DE", Continent: "EU"},
+			netip.MustParseAddr("198.51.100.2"): {Country: "FR", Continent: "EU"},
+			netip.MustParseAddr("198.51.100.3"): {Country: "BR", Continent: "SA"},
+			netip.MustParseAddr("203.0.113.7"):  {Country: "JP", Continent: "AS"},
+		},
+		CDNHeaders:       []string{"cf-ipcountry"},
+		TrustedProxies:   []netip.Prefix{netip.MustParsePrefix("173.245.48.0/20")},
+		TrustHeader:      "x-forwarded-from-edgeone",
+		TrustValue:       "yes",
+		Regions:          map[string]string{"us": "us-east", "de": "eu-central", "jp": "ap-east"},
+		ContinentRegions: map[string]string{"eu": "eu-west"},
+		DefaultRegion:    "us-east",
+	}, zerolog.Nop())
+
+	tests := []struct {
+		name    string
+		attrs   map[string]string
+		headers []string
+		expect  []extproctest.Expectation
+	}{
+		{
+			name:  "database country",
+			attrs: map[string]string{"source.address": "198.51.100.1:1234"},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderSet("x-client-region", "eu-central"),
+				extproctest.ExpectHeaderSet("x-client-country", "DE"),
+			},
+		},
+		{
+			name:  "database continent",
+			attrs: map[string]string{"source.address": "198.51.100.2:1234"},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderSet("x-client-region", "eu-west"),
+				extproctest.ExpectHeaderSet("x-client-country", "FR"),
+			},
+		},
+		{
+			name:  "default region",
+			attrs: map[string]string{"source.address": "198.51.100.3:1234"},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderSet("x-client-region", "us-east"),
+				extproctest.ExpectHeaderSet("x-client-country", "BR"),
+			},
+		},
+		{
+			name:    "untrusted cdn header ignored and removed",
+			attrs:   map[string]string{"source.address": "198.51.100.1:1234"},
+			headers: []string{"cf-ipcountry", "US", "x-client-region", "ap-east"},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderRemoved("cf-ipcountry"),
+				extproctest.ExpectHeaderSet("x-client-region", "eu-central"),
+				extproctest.ExpectHeaderSet("x-client-country", "DE"),
+			},
+		},
+		{
+			name:    "trusted peer cdn header normalized",
+			attrs:   map[string]string{"source.address": "173.245.48.9:443"},
+			headers: []string{"cf-ipcountry", " jp "},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderSet("cf-ipcountry", "JP"),
+				extproctest.ExpectHeaderSet("x-client-region", "ap-east"),
+				extproctest.ExpectHeaderSet("x-client-country", "JP"),
+			},
+		},
+		{
+			name:    "trust header",
+			attrs:   map[string]string{"source.address": "198.51.100.1:1234"},
+			headers: []string{"cf-ipcountry", "US", "x-forwarded-from-edgeone", "yes"},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderSet("x-client-region", "us-east"),
+				extproctest.ExpectHeaderSet("x-client-country", "US"),
+			},
+		},
+		{
+			name:    "invalid trusted cdn header falls back to database",
+			attrs:   map[string]string{"source.address": "173.245.48.9:443"},
+			headers: []string{"cf-ipcountry", "XX"},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderRemoved("cf-ipcountry"),
+				extproctest.ExpectHeaderSet("x-client-region", "us-east"),
+				extproctest.ExpectHeaderRemoved("x-client-country"),
+			},
+		},
+		{
+			name:    "spoofed headers replaced for unknown client",
+			headers: []string{"x-client-country", "JP"},
+			expect: []extproctest.Expectation{
+				extproctest.ExpectHeaderSet("x-client-region", "us-east"),
+				extproctest.ExpectHeaderRemoved("x-client-country"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(tt.attrs, tt.headers...))
+			extproctest.Check(t, result, append([]extproctest.Expectation{extproctest.ExpectContinue()}, tt.expect...)...)
+			if !result.ClearRouteCache {
+				t.Error("route cache not cleared")
+			}
+		})
+	}
+}
+
+func TestClientIPHeader(t *testing.T) {
+	factory := NewProcessorFactory(Config{
+		DB:             staticDB{netip.MustParseAddr("203.0.113.7"): {Country: "JP", Continent: "AS"}},
+		ClientIPHeader: "x-real-ip",
+		Regions:        map[string]string{"JP": "ap-east"},
+	}, zerolog.Nop())
+	ctx := extproctest.NewContext(map[string]string{"source.address": "198.51.100.1:1234"}, "x-real-ip", "203.0.113.7")
+	extproctest.Check(t, factory.NewProcessor().ProcessRequestHeaders(ctx),
+		extproctest.ExpectContinue(),
+		extproctest.ExpectHeaderSet("x-client-region", "ap-east"),
+	)
+}
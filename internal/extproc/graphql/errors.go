@@ -0,0 +1,36 @@
+package graphql
+
+import (
+	"encoding/json"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+)
+
+// errorResponse is a GraphQL response carrying only errors, so clients
+// handle rejections like any other failed operation.
+type errorResponse struct {
+	Errors []responseError `json:"errors"`
+}
+
+type responseError struct {
+	Message    string            `json:"message"`
+	Extensions map[string]string `json:"extensions"`
+}
+
+// errorResult answers with status and a GraphQL error of code.
+func errorResult(status int, code, message string, headers ...*envoy_api_v3_core.HeaderValueOption) *extproc.ProcessingResult {
+	body, _ := json.Marshal(errorResponse{Errors: []responseError{{
+		Message:    message,
+		Extensions: map[string]string{"code": code},
+	}}})
+	headers = append(headers, extproc.SetHeader("content-type", "application/graphql-response+json"))
+	return extproc.ImmediateResult(status, headers, body)
+}
+
+// reject answers request requestID with status and a GraphQL error of code,
+// unless the decision mode lets it continue with pass.
+func (f *ProcessorFactory) reject(requestID string, pass *extproc.ProcessingResult, status int, code, message string, headers ...*envoy_api_v3_core.HeaderValueOption) *extproc.ProcessingResult {
+	return f.decider.Reject(requestID, strings.ToLower(code), errorResult(status, code, message, headers...), pass)
+}
@@ -0,0 +1,373 @@
+// Package graphql provides an ext_proc processor that inspects GraphQL
+// requests: it limits query depth and complexity, blocks schema
+// introspection, rate limits operations per client and logs the operations
+// executed.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/graphql"
+	"github.com/mnixry/envoy-ext-procs/internal/jsonstrict"
+	"github.com/mnixry/envoy-ext-procs/internal/ratelimit"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// anonymous is the operation name anonymous operations are logged and rate
+// limited under.
+const anonymous = "(anonymous)"
+
+// Config holds GraphQL inspection settings.
+type Config struct {
+	// Paths are the path prefixes of GraphQL endpoints.
+	Paths []string
+	// MaxBodyBytes rejects larger request bodies with 413; 0 disables.
+	MaxBodyBytes int
+	// MaxDepth and MaxComplexity reject deeper or costlier operations;
+	// 0 disables.
+	MaxDepth      int
+	MaxComplexity int64
+	// MaxBatch rejects batches of more operations; 0 rejects batches.
+	MaxBatch int
+	// BlockIntrospection rejects operations selecting __schema or __type.
+	BlockIntrospection bool
+	// Analysis configures how complexity is measured.
+	Analysis graphql.Options
+	// OperationLimits rate limit operations by name, per client address.
+	// Anonymous operations are limited under "(anonymous)".
+	OperationLimits map[string]ratelimit.Limit
+	// DefaultLimit applies to operations without their own limit; a zero
+	// Requests disables it.
+	DefaultLimit ratelimit.Limit
+	// CacheSize is the number of rate limit buckets kept.
+	CacheSize int
+	// OperationHeader, if set, carries the operation name upstream, comma
+	// separated for batches.
+	OperationHeader string
+	// DecisionMode selects whether rejected requests are answered with a
+	// GraphQL error or let through.
+	DecisionMode extproc.DecisionMode
+}
+
+// ProcessorFactory creates GraphQL inspection processors.
+type ProcessorFactory struct {
+	cfg     Config
+	limiter ratelimit.Limiter
+	log     zerolog.Logger
+	decider extproc.Decider
+}
+
+// NewProcessorFactory creates a new GraphQL inspection ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) (*ProcessorFactory, error) {
+	cfg.OperationHeader = strings.ToLower(cfg.OperationHeader)
+	f := &ProcessorFactory{
+		cfg: cfg,
+		log: log.With().Str("processor", "graphql").Logger(),
+	}
+	f.decider = extproc.NewDecider("graphql", cfg.DecisionMode, f.log)
+	if len(cfg.OperationLimits) > 0 || cfg.DefaultLimit.Requests > 0 {
+		limiter, err := ratelimit.NewMemoryLimiter(cfg.CacheSize)
+		if err != nil {
+			return nil, oops.In("graphql").Wrapf(err, "failed to create operation rate limiter")
+		}
+		f.limiter = limiter
+	}
+	return f, nil
+}
+
+// NewProcessor creates a new GraphQL inspection processor for a single
+// request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor inspects a single GraphQL request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	mu        sync.Mutex
+	matched   bool
+	mediaType string
+	params    url.Values
+	client    string
+	requestID string
+	body      []byte
+}
+
+// request is a GraphQL-over-HTTP request.
+type request struct {
+	Query         string
+	OperationName string
+	Variables     map[string]any
+}
+
+// UnmarshalJSON decodes r by its exact keys, as GraphQL servers do:
+// encoding/json would also match "Query" and keep the last of repeated
+// keys, so such requests are rejected rather than inspected differently
+// from how they execute.
+func (r *request) UnmarshalJSON(data []byte) error {
+	members, err := jsonstrict.Object(data)
+	if err != nil {
+		return err
+	}
+	for key, v := range map[string]any{"query": &r.Query, "operationName": &r.OperationName} {
+		if raw, ok := members[key]; ok {
+			if err := json.Unmarshal(raw, v); err != nil {
+				return oops.In("graphql").Code(errcode.InvalidGraphQL).With("key", key).Wrapf(err, "invalid %s", key)
+			}
+		}
+	}
+	if raw, ok := members["variables"]; ok {
+		return decodeJSON(raw, &r.Variables)
+	}
+	return nil
+}
+
+// ProcessRequestHeaders checks GET requests from their query string and
+// buffers POST bodies of GraphQL endpoints.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	result := &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{},
+	}
+	if f.cfg.OperationHeader != "" {
+		// Only set from an inspected request.
+		result.HeaderMutations.RemoveHeaders = []string{f.cfg.OperationHeader}
+	}
+	path, rawQuery, _ := strings.Cut(ctx.Headers.Get(":path"), "?")
+	if !f.matches(path) {
+		return result
+	}
+	params, _ := url.ParseQuery(rawQuery)
+	client := ""
+	if ip, err := ctx.GetDownstreamRemoteIP(); err == nil {
+		client = ip.String()
+	}
+
+	switch ctx.Headers.Get(":method") {
+	case http.MethodGet:
+		if !params.Has("query") {
+			return result
+		}
+		var variables map[string]any
+		if raw := params.Get("variables"); raw != "" {
+			if err := decodeJSON([]byte(raw), &variables); err != nil {
+				return f.reject(ctx.GetRequestID(), result, http.StatusBadRequest, "BAD_REQUEST", "variables are not a JSON object")
+			}
+		}
+		return f.inspect(ctx.GetRequestID(), client, []request{{
+			Query:         params.Get("query"),
+			OperationName: params.Get("operationName"),
+			Variables:     variables,
+		}}, result)
+	case http.MethodPost:
+	default:
+		return result
+	}
+	if ctx.EndOfStream {
+		return f.reject(ctx.GetRequestID(), result, http.StatusBadRequest, "BAD_REQUEST", "request body is empty")
+	}
+	if encoding := ctx.Headers.Get("content-encoding"); encoding != "" && encoding != "identity" {
+		// Encoded bodies cannot be inspected, so they must not get through.
+		return f.reject(ctx.GetRequestID(), result, http.StatusUnsupportedMediaType, "BAD_REQUEST", "encoded request bodies are not accepted")
+	}
+	if length, err := strconv.Atoi(ctx.Headers.Get("content-length")); err == nil && f.cfg.MaxBodyBytes > 0 && length > f.cfg.MaxBodyBytes {
+		return f.reject(ctx.GetRequestID(), result, http.StatusRequestEntityTooLarge, "REQUEST_TOO_LARGE", "request body too large")
+	}
+	mediaType, _, _ := mime.ParseMediaType(ctx.Headers.Get("content-type"))
+
+	p.mu.Lock()
+	p.matched = true
+	p.mediaType = mediaType
+	p.params = params
+	p.client = client
+	p.requestID = ctx.GetRequestID()
+	p.mu.Unlock()
+
+	result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+		RequestBodyMode:     envoy_extensions_ext_proc_v3.ProcessingMode_BUFFERED,
+		RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_NONE,
+		ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+	}
+	return result
+}
+
+// ProcessRequestBody decodes the buffered body and inspects its
+// operations. application/graphql bodies hold the document itself; any
+// other body must be a JSON request or batch.
+func (p *Processor) ProcessRequestBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	f := p.factory
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.matched {
+		return extproc.ContinueResult()
+	}
+
+	p.body = append(p.body, body...)
+	if f.cfg.MaxBodyBytes > 0 && len(p.body) > f.cfg.MaxBodyBytes {
+		p.matched = false
+		return f.reject(p.requestID, nil, http.StatusRequestEntityTooLarge, "REQUEST_TOO_LARGE", "request body too large")
+	}
+	if !endOfStream {
+		return extproc.ContinueResult()
+	}
+	p.matched = false
+	data := p.body
+	p.body = nil
+
+	result := &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{},
+	}
+	var requests []request
+	switch {
+	case p.mediaType == "application/graphql":
+		requests = []request{{Query: string(data), OperationName: p.params.Get("operationName")}}
+	case bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("[")):
+		if err := decodeJSON(data, &requests); err != nil {
+			return f.invalid(p.requestID, err, result)
+		}
+		if len(requests) == 0 || len(requests) > f.cfg.MaxBatch {
+			return f.reject(p.requestID, result, http.StatusBadRequest, "BATCH_LIMIT_EXCEEDED", "batch of "+strconv.Itoa(len(requests))+" operations is not accepted")
+		}
+	default:
+		var req request
+		if err := decodeJSON(data, &req); err != nil {
+			return f.invalid(p.requestID, err, result)
+		}
+		requests = []request{req}
+	}
+	return f.inspect(p.requestID, p.client, requests, result)
+}
+
+// inspect analyzes and rate limits requests, returning result with the
+// operation header set if all are accepted. Requests let through by the
+// decision mode stop at their first rejection, without the header.
+func (f *ProcessorFactory) inspect(requestID, client string, requests []request, result *extproc.ProcessingResult) *extproc.ProcessingResult {
+	names := make([]string, 0, len(requests))
+	for _, req := range requests {
+		op, err := graphql.Analyze(req.Query, req.OperationName, req.Variables, f.cfg.Analysis)
+		if err != nil {
+			return f.invalid(requestID, err, result)
+		}
+		name := extproc.FirstNonEmpty(op.Name, anonymous)
+		names = append(names, name)
+		event := f.log.Info().
+			Str("request_id", requestID).
+			Str("client", client).
+			Str("operation_name", name).
+			Str("operation_type", op.Type).
+			Strs("root_fields", op.RootFields).
+			Int("depth", op.Depth).
+			Int64("complexity", op.Complexity)
+
+		switch {
+		case f.cfg.BlockIntrospection && op.Introspection:
+			event.Msg("rejected introspection query")
+			return f.reject(requestID, result, http.StatusForbidden, "INTROSPECTION_DISABLED", "introspection is disabled")
+		case f.cfg.MaxDepth > 0 && op.Depth > f.cfg.MaxDepth:
+			event.Int("max_depth", f.cfg.MaxDepth).Msg("rejected GraphQL operation exceeding the depth limit")
+			return f.reject(requestID, result, http.StatusBadRequest, "DEPTH_LIMIT_EXCEEDED", "operation depth "+strconv.Itoa(op.Depth)+" exceeds the limit of "+strconv.Itoa(f.cfg.MaxDepth))
+		case f.cfg.MaxComplexity > 0 && op.Complexity > f.cfg.MaxComplexity:
+			event.Int64("max_complexity", f.cfg.MaxComplexity).Msg("rejected GraphQL operation exceeding the complexity limit")
+			return f.reject(requestID, result, http.StatusBadRequest, "COMPLEXITY_LIMIT_EXCEEDED", "operation complexity "+strconv.FormatInt(op.Complexity, 10)+" exceeds the limit of "+strconv.FormatInt(f.cfg.MaxComplexity, 10))
+		}
+		if headers, limited := f.limit(event, client, name); limited {
+			return f.reject(requestID, result, http.StatusTooManyRequests, "RATE_LIMITED", "operation "+name+" is rate limited", headers...)
+		}
+		event.Msg("GraphQL operation")
+	}
+
+	if f.cfg.OperationHeader != "" {
+		result.HeaderMutations.SetHeaders = append(result.HeaderMutations.SetHeaders,
+			extproc.SetHeader(f.cfg.OperationHeader, strings.Join(names, ",")))
+	}
+	return result
+}
+
+// limit takes a token for the operation from the client's bucket, logging
+// event and returning the headers of a 429 response when none is left.
+// Limiter failures let the operation through.
+func (f *ProcessorFactory) limit(event *zerolog.Event, client, name string) ([]*envoy_api_v3_core.HeaderValueOption, bool) {
+	if f.limiter == nil || client == "" {
+		return nil, false
+	}
+	limit, ok := f.cfg.OperationLimits[name]
+	if !ok {
+		limit = f.cfg.DefaultLimit
+	}
+	if limit.Requests == 0 {
+		return nil, false
+	}
+	decision, err := f.limiter.Allow(context.Background(), client+"|"+name, limit, 1)
+	if err != nil {
+		f.log.Warn().Err(err).Str("operation_name", name).Msg("operation rate limit check failed, allowing")
+		return nil, false
+	}
+	if decision.Allowed {
+		return nil, false
+	}
+	event.Dur("retry_after", decision.RetryAfter).Msg("rejected rate limited GraphQL operation")
+	headers := []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("retry-after", strconv.Itoa(int(max(1, decision.RetryAfter.Round(time.Second).Seconds())))),
+	}
+	for _, h := range ratelimit.RateLimitHeaders(decision) {
+		headers = append(headers, &envoy_api_v3_core.HeaderValueOption{Header: h})
+	}
+	return headers, true
+}
+
+// invalid logs and rejects a request that could not be decoded or parsed.
+func (f *ProcessorFactory) invalid(requestID string, err error, pass *extproc.ProcessingResult) *extproc.ProcessingResult {
+	f.log.Debug().Err(err).Str("request_id", requestID).Msg("rejected invalid GraphQL request")
+	if errcode.Is(err, errcode.LimitExceeded) {
+		return f.reject(requestID, pass, http.StatusBadRequest, "DEPTH_LIMIT_EXCEEDED", "document is nested too deeply")
+	}
+	return f.reject(requestID, pass, http.StatusBadRequest, "GRAPHQL_PARSE_FAILED", err.Error())
+}
+
+func (f *ProcessorFactory) matches(path string) bool {
+	for _, prefix := range f.cfg.Paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJSON decodes a single JSON value, keeping numbers exact.
+func decodeJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return oops.In("graphql").Code(errcode.InvalidGraphQL).Wrapf(err, "request is not valid JSON")
+	}
+	if dec.More() {
+		return oops.In("graphql").Code(errcode.InvalidGraphQL).Errorf("request has data after the JSON value")
+	}
+	return nil
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
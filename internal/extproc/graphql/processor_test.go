@@ -0,0 +1,229 @@
+package graphql
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/ratelimit"
+	"github.com/rs/zerolog"
+)
+
+func newFactory(t *testing.T) *ProcessorFactory {
+	t.Helper()
+	factory, err := NewProcessorFactory(Config{
+		Paths:              []string{"/graphql"},
+		MaxBodyBytes:       512,
+		MaxDepth:           3,
+		MaxComplexity:      50,
+		MaxBatch:           2,
+		BlockIntrospection: true,
+		OperationLimits:    map[string]ratelimit.Limit{"Login": {Requests: 1, Per: time.Minute}},
+		CacheSize:          16,
+		OperationHeader:    "X-GraphQL-Operation",
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return factory
+}
+
+// post runs a POST of body with content type through a new processor.
+func post(t *testing.T, factory *ProcessorFactory, contentType, body string) *extproc.ProcessingResult {
+	t.Helper()
+	p := factory.NewProcessor()
+	ctx := extproctest.NewContext(map[string]string{"source.address": "203.0.113.7:4711"},
+		":method", "POST", ":path", "/graphql", "content-type", contentType)
+	ctx.EndOfStream = false
+	result := p.ProcessRequestHeaders(ctx)
+	extproctest.Check(t, result, extproctest.ExpectHeaderRemoved("x-graphql-operation"))
+	if result.ModeOverride == nil {
+		t.Fatalf("request body not buffered: %s", extproctest.Describe(result))
+	}
+	return p.ProcessRequestBody(ctx, []byte(body), true)
+}
+
+func TestProcessRequestBody(t *testing.T) {
+	factory := newFactory(t)
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expect      []extproctest.Expectation
+		code        string
+	}{
+		{
+			name:        "query",
+			contentType: "application/json",
+			body:        `{"query":"query Me { me { id } }"}`,
+			expect: []extproctest.Expectation{
+				extproctest.ExpectContinue(),
+				extproctest.ExpectHeaderSet("x-graphql-operation", "Me"),
+			},
+		},
+		{
+			name:        "graphql media type",
+			contentType: "application/graphql",
+			body:        `{ me { id } }`,
+			expect: []extproctest.Expectation{
+				extproctest.ExpectContinue(),
+				extproctest.ExpectHeaderSet("x-graphql-operation", "(anonymous)"),
+			},
+		},
+		{
+			name:        "batch",
+			contentType: "application/json",
+			body:        `[{"query":"query A { a }"},{"query":"query B { b }"}]`,
+			expect: []extproctest.Expectation{
+				extproctest.ExpectContinue(),
+				extproctest.ExpectHeaderSet("x-graphql-operation", "A,B"),
+			},
+		},
+		{
+			name:        "batch too large",
+			contentType: "application/json",
+			body:        `[{"query":"{ a }"},{"query":"{ a }"},{"query":"{ a }"}]`,
+			expect:      []extproctest.Expectation{extproctest.ExpectDenied(400)},
+			code:        "BATCH_LIMIT_EXCEEDED",
+		},
+		{
+			name:        "introspection",
+			contentType: "application/json",
+			body:        `{"query":"{ __schema { types { name } } }"}`,
+			expect:      []extproctest.Expectation{extproctest.ExpectDenied(403)},
+			code:        "INTROSPECTION_DISABLED",
+		},
+		{
+			name:        "introspection behind a case-variant key",
+			contentType: "application/json",
+			body:        `{"query":"{ __schema { types { name } } }","Query":"query Me { me { id } }"}`,
+			expect:      []extproctest.Expectation{extproctest.ExpectDenied(400)},
+			code:        "GRAPHQL_PARSE_FAILED",
+		},
+		{
+			name:        "repeated key",
+			contentType: "application/json",
+			body:        `{"query":"{ a { b { c { d } } } }","query":"{ a }"}`,
+			expect:      []extproctest.Expectation{extproctest.ExpectDenied(400)},
+			code:        "GRAPHQL_PARSE_FAILED",
+		},
+		{
+			name:        "case-variant key in a batch",
+			contentType: "application/json",
+			body:        `[{"query":"{ a }"},{"query":"{ a { b { c { d } } } }","QUERY":"{ a }"}]`,
+			expect:      []extproctest.Expectation{extproctest.ExpectDenied(400)},
+			code:        "GRAPHQL_PARSE_FAILED",
+		},
+		{
+			name:        "too deep",
+			contentType: "application/json",
+			body:        `{"query":"{ a { b { c { d } } } }"}`,
+			expect:      []extproctest.Expectation{extproctest.ExpectDenied(400)},
+			code:        "DEPTH_LIMIT_EXCEEDED",
+		},
+		{
+			name:        "too complex",
+			contentType: "application/json",
+			body:        `{"query":"query($n: Int) { posts(first: $n) { id } }","variables":{"n":100}}`,
+			expect:      []extproctest.Expectation{extproctest.ExpectDenied(400)},
+			code:        "COMPLEXITY_LIMIT_EXCEEDED",
+		},
+		{
+			name:        "not json",
+			contentType: "application/json",
+			body:        `query { a }`,
+			expect:      []extproctest.Expectation{extproctest.ExpectDenied(400)},
+			code:        "GRAPHQL_PARSE_FAILED",
+		},
+		{
+			name:        "syntax error",
+			contentType: "application/json",
+			body:        `{"query":"{ a "}`,
+			expect:      []extproctest.Expectation{extproctest.ExpectDenied(400)},
+			code:        "GRAPHQL_PARSE_FAILED",
+		},
+		{
+			name:        "too large",
+			contentType: "application/json",
+			body:        `{"query":"{ a }","pad":"` + string(make([]byte, 512)) + `"}`,
+			expect:      []extproctest.Expectation{extproctest.ExpectDenied(413)},
+			code:        "REQUEST_TOO_LARGE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := post(t, factory, tt.contentType, tt.body)
+			extproctest.Check(t, result, tt.expect...)
+			if tt.code != "" {
+				checkErrorCode(t, result, tt.code)
+			}
+		})
+	}
+}
+
+func TestOperationRateLimit(t *testing.T) {
+	factory := newFactory(t)
+	login := `{"query":"mutation Login { login { token } }"}`
+	extproctest.Check(t, post(t, factory, "application/json", login), extproctest.ExpectContinue())
+	result := post(t, factory, "application/json", login)
+	extproctest.Check(t, result,
+		extproctest.ExpectDenied(429),
+		extproctest.ExpectHeaderSet("x-ratelimit-limit", "1"),
+	)
+	checkErrorCode(t, result, "RATE_LIMITED")
+	// Other operations have no limit.
+	extproctest.Check(t, post(t, factory, "application/json", `{"query":"query Me { me { id } }"}`), extproctest.ExpectContinue())
+}
+
+func TestProcessRequestHeaders(t *testing.T) {
+	factory := newFactory(t)
+	for name, tt := range map[string]struct {
+		headers []string
+		expect  []extproctest.Expectation
+	}{
+		"other path": {
+			[]string{":method", "GET", ":path", "/api?query={__schema{types{name}}}"},
+			[]extproctest.Expectation{extproctest.ExpectContinue()},
+		},
+		"get query": {
+			[]string{":method", "GET", ":path", "/graphql?query=query%20Me%7Bme%7Bid%7D%7D"},
+			[]extproctest.Expectation{extproctest.ExpectContinue(), extproctest.ExpectHeaderSet("x-graphql-operation", "Me")},
+		},
+		"get introspection": {
+			[]string{":method", "GET", ":path", "/graphql?query=%7B__type(name:%22User%22)%7Bname%7D%7D"},
+			[]extproctest.Expectation{extproctest.ExpectDenied(403)},
+		},
+		"get without query": {
+			[]string{":method", "GET", ":path", "/graphql"},
+			[]extproctest.Expectation{extproctest.ExpectContinue(), extproctest.ExpectHeaderRemoved("x-graphql-operation")},
+		},
+		"encoded": {
+			[]string{":method", "POST", ":path", "/graphql", "content-encoding", "gzip"},
+			[]extproctest.Expectation{extproctest.ExpectDenied(415)},
+		},
+		"length too big": {
+			[]string{":method", "POST", ":path", "/graphql", "content-length", "513"},
+			[]extproctest.Expectation{extproctest.ExpectDenied(413)},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := extproctest.NewContext(nil, tt.headers...)
+			ctx.EndOfStream = tt.headers[1] == "GET"
+			extproctest.Check(t, factory.NewProcessor().ProcessRequestHeaders(ctx), tt.expect...)
+		})
+	}
+}
+
+// checkErrorCode checks the GraphQL error code of a rejection.
+func checkErrorCode(t *testing.T, result *extproc.ProcessingResult, code string) {
+	t.Helper()
+	var resp errorResponse
+	if err := json.Unmarshal(result.ImmediateResponse.GetBody(), &resp); err != nil {
+		t.Fatalf("rejection body is not a GraphQL response: %v", err)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != code {
+		t.Errorf("errors = %+v, want code %s", resp.Errors, code)
+	}
+}
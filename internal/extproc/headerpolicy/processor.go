@@ -0,0 +1,180 @@
+// Package headerpolicy provides an ext_proc processor that strips or rewrites
+// upstream response headers that leak implementation details.
+package headerpolicy
+
+import (
+	"slices"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+)
+
+// Mode selects how response headers are filtered.
+type Mode string
+
+const (
+	// ModeDenylist removes headers matching the deny patterns.
+	ModeDenylist Mode = "denylist"
+	// ModeAllowlist removes every header not matching the allow patterns.
+	ModeAllowlist Mode = "allowlist"
+)
+
+// DefaultDeny lists headers that commonly disclose upstream software,
+// versions, internal routing or stack traces.
+var DefaultDeny = []string{
+	"server",
+	"x-powered-by",
+	"x-aspnet-version",
+	"x-aspnetmvc-version",
+	"x-runtime",
+	"x-generator",
+	"x-drupal-*",
+	"x-debug-*",
+	"x-stacktrace",
+	"x-exception*",
+	"x-backend-*",
+	"x-upstream-*",
+	"x-internal-*",
+	"x-envoy-upstream-service-time",
+}
+
+// DefaultAllow lists the standard response headers kept in allowlist mode.
+var DefaultAllow = []string{
+	"accept-ranges",
+	"access-control-*",
+	"age",
+	"allow",
+	"cache-control",
+	"content-*",
+	"cross-origin-*",
+	"date",
+	"etag",
+	"expires",
+	"last-modified",
+	"link",
+	"location",
+	"permissions-policy",
+	"referrer-policy",
+	"retry-after",
+	"set-cookie",
+	"strict-transport-security",
+	"vary",
+	"www-authenticate",
+	"x-content-type-options",
+	"x-frame-options",
+	"x-request-id",
+	"x-ratelimit-*",
+}
+
+// Config holds the response header policy.
+type Config struct {
+	Mode Mode
+	// Allow and Deny are header name patterns; a trailing "*" matches any
+	// suffix. Names are matched case-insensitively.
+	Allow []string
+	Deny  []string
+	// Rewrite replaces the value of a header that survives filtering.
+	Rewrite map[string]string
+}
+
+// ProcessorFactory creates header policy processors.
+type ProcessorFactory struct {
+	mode    Mode
+	allow   []string
+	deny    []string
+	rewrite map[string]string
+	log     zerolog.Logger
+}
+
+// NewProcessorFactory creates a new header policy ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	rewrite := make(map[string]string, len(cfg.Rewrite))
+	for name, value := range cfg.Rewrite {
+		rewrite[strings.ToLower(name)] = value
+	}
+	return &ProcessorFactory{
+		mode:    cfg.Mode,
+		allow:   lower(cfg.Allow),
+		deny:    lower(cfg.Deny),
+		rewrite: rewrite,
+		log:     log.With().Str("processor", "headerpolicy").Logger(),
+	}
+}
+
+// NewProcessor creates a new header policy processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+}
+
+// ProcessResponseHeaders applies the policy to the upstream response headers.
+func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	var (
+		remove []string
+		set    []*envoy_api_v3_core.HeaderValueOption
+	)
+	for name := range ctx.Headers {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		if !f.keep(name) {
+			remove = append(remove, name)
+			continue
+		}
+		if value, ok := f.rewrite[name]; ok {
+			set = append(set, extproc.SetHeader(name, value))
+		}
+	}
+	if len(remove) == 0 && len(set) == 0 {
+		return extproc.ContinueResult()
+	}
+	slices.Sort(remove)
+
+	f.log.Debug().Strs("removed", remove).Int("rewritten", len(set)).Msg("applied response header policy")
+	return &extproc.ProcessingResult{
+		Status: extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{
+			SetHeaders:    set,
+			RemoveHeaders: remove,
+		},
+	}
+}
+
+func (f *ProcessorFactory) keep(name string) bool {
+	if f.mode == ModeAllowlist {
+		return matchAny(f.allow, name) || f.rewrite[name] != ""
+	}
+	return !matchAny(f.deny, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			return strings.HasPrefix(name, prefix)
+		}
+		return pattern == name
+	})
+}
+
+func lower(names []string) []string {
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+	return out
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
@@ -0,0 +1,44 @@
+package headerpolicy
+
+import (
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+func TestProcessResponseHeaders(t *testing.T) {
+	headers := []string{
+		":status", "200",
+		"server", "nginx/1.25.3",
+		"x-powered-by", "PHP/8.3",
+		"x-debug-token", "abc",
+		"content-type", "text/html",
+	}
+
+	t.Run("denylist", func(t *testing.T) {
+		factory := NewProcessorFactory(Config{
+			Mode:    ModeDenylist,
+			Deny:    []string{"x-powered-by", "x-debug-*"},
+			Rewrite: map[string]string{"Server": "envoy"},
+		}, zerolog.Nop())
+		result := factory.NewProcessor().ProcessResponseHeaders(extproctest.NewContext(nil, headers...))
+		extproctest.Check(t, result,
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderRemoved("x-powered-by"),
+			extproctest.ExpectHeaderRemoved("x-debug-token"),
+			extproctest.ExpectHeaderSet("server", "envoy"),
+		)
+	})
+
+	t.Run("allowlist", func(t *testing.T) {
+		factory := NewProcessorFactory(Config{Mode: ModeAllowlist, Allow: []string{"content-*"}}, zerolog.Nop())
+		result := factory.NewProcessor().ProcessResponseHeaders(extproctest.NewContext(nil, headers...))
+		extproctest.Check(t, result,
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderRemoved("server"),
+			extproctest.ExpectHeaderRemoved("x-powered-by"),
+			extproctest.ExpectHeaderRemoved("x-debug-token"),
+		)
+	})
+}
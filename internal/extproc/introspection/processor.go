@@ -0,0 +1,212 @@
+// Package introspection provides an ext_proc processor that authorizes
+// requests carrying opaque OAuth2 bearer tokens via RFC 7662 introspection.
+package introspection
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/introspection"
+	"github.com/mnixry/envoy-ext-procs/internal/match"
+	"github.com/rs/zerolog"
+)
+
+const (
+	HeaderAuthorization   = "authorization"
+	HeaderWWWAuthenticate = "www-authenticate"
+
+	headerSuffixSubject  = "subject"
+	headerSuffixScope    = "scope"
+	headerSuffixClientID = "client-id"
+	headerSuffixUsername = "username"
+)
+
+// Introspector resolves an access token to its introspection result.
+type Introspector interface {
+	Introspect(ctx context.Context, token string) (*introspection.Result, error)
+}
+
+// ProcessorFactory creates introspection processors.
+type ProcessorFactory struct {
+	introspector   Introspector
+	requiredScopes []string
+	routeScopes    map[string][]string
+	headerPrefix   string
+	decisionMode   extproc.DecisionMode
+	decider        extproc.Decider
+	log            zerolog.Logger
+}
+
+type Option func(*ProcessorFactory)
+
+// WithRequiredScopes requires every request to carry all of scopes.
+func WithRequiredScopes(scopes ...string) Option {
+	return func(f *ProcessorFactory) {
+		f.requiredScopes = append(f.requiredScopes, scopes...)
+	}
+}
+
+// WithRouteScopes requires additional scopes for requests whose normalized
+// path is prefix or below it, matching whole segments. The longest matching
+// prefix wins.
+func WithRouteScopes(prefix string, scopes ...string) Option {
+	return func(f *ProcessorFactory) {
+		f.routeScopes[prefix] = append(f.routeScopes[prefix], scopes...)
+	}
+}
+
+// WithHeaderPrefix sets the prefix of the identity headers injected upstream.
+func WithHeaderPrefix(prefix string) Option {
+	return func(f *ProcessorFactory) {
+		f.headerPrefix = strings.ToLower(prefix)
+	}
+}
+
+// WithDecisionMode selects whether unauthorized requests are rejected; those
+// let through without an active token carry no identity headers.
+func WithDecisionMode(mode extproc.DecisionMode) Option {
+	return func(f *ProcessorFactory) {
+		f.decisionMode = mode
+	}
+}
+
+// NewProcessorFactory creates a new introspection ProcessorFactory.
+func NewProcessorFactory(introspector Introspector, log zerolog.Logger, opts ...Option) *ProcessorFactory {
+	f := &ProcessorFactory{
+		introspector: introspector,
+		routeScopes:  make(map[string][]string),
+		headerPrefix: "x-auth-",
+		log:          log.With().Str("processor", "introspection").Logger(),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	f.decider = extproc.NewDecider("introspection", f.decisionMode, f.log)
+	return f
+}
+
+// NewProcessor creates a new introspection processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor authorizes a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+}
+
+// ProcessRequestHeaders introspects the bearer token, checks scopes, and
+// injects identity headers for the upstream.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+
+	token, ok := bearerToken(ctx.Headers.Get(HeaderAuthorization))
+	if !ok {
+		return f.decider.Reject(ctx.GetRequestID(), "missing_token", unauthorized(`Bearer`), f.identity(nil))
+	}
+
+	info, err := f.introspector.Introspect(context.Background(), token)
+	if err != nil {
+		f.log.Error().Err(err).Str("request_id", ctx.GetRequestID()).Msg("token introspection failed")
+		return f.decider.Reject(ctx.GetRequestID(), "unavailable",
+			extproc.ImmediateResult(http.StatusServiceUnavailable, nil, []byte("authorization service unavailable\n")), f.identity(nil))
+	}
+	if !info.Active {
+		return f.decider.Reject(ctx.GetRequestID(), "inactive_token",
+			unauthorized(`Bearer error="invalid_token", error_description="token is not active"`), f.identity(nil))
+	}
+
+	result := f.identity(info)
+	required := p.requiredScopes(ctx.Headers.Get(":path"))
+	granted := info.Scopes()
+	for _, scope := range required {
+		if !slices.Contains(granted, scope) {
+			f.log.Debug().
+				Str("request_id", ctx.GetRequestID()).
+				Str("client_id", info.ClientID).
+				Strs("required", required).
+				Strs("granted", granted).
+				Msg("insufficient scope")
+			return f.decider.Reject(ctx.GetRequestID(), "insufficient_scope", extproc.ImmediateResult(http.StatusForbidden, []*envoy_api_v3_core.HeaderValueOption{
+				extproc.SetHeader(HeaderWWWAuthenticate, fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(required, " "))),
+			}, []byte("insufficient scope\n")), result)
+		}
+	}
+	return result
+}
+
+// identity returns the result continuing with the identity headers of info,
+// or with them removed if info is nil.
+func (f *ProcessorFactory) identity(info *introspection.Result) *extproc.ProcessingResult {
+	if info == nil {
+		info = &introspection.Result{}
+	}
+	result := &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{},
+	}
+	for _, h := range [...]struct{ suffix, value string }{
+		{headerSuffixSubject, info.Subject},
+		{headerSuffixScope, info.Scope},
+		{headerSuffixClientID, info.ClientID},
+		{headerSuffixUsername, info.Username},
+	} {
+		// Always overwrite or strip so clients cannot spoof identity headers.
+		if h.value != "" {
+			result.HeaderMutations.SetHeaders = append(result.HeaderMutations.SetHeaders, extproc.SetHeader(f.headerPrefix+h.suffix, h.value))
+		} else {
+			result.HeaderMutations.RemoveHeaders = append(result.HeaderMutations.RemoveHeaders, f.headerPrefix+h.suffix)
+		}
+	}
+	return result
+}
+
+// requiredScopes returns the scopes a request for target, its :path, needs.
+func (p *Processor) requiredScopes(target string) []string {
+	path := match.NormalizePath(target)
+	required := slices.Clone(p.factory.requiredScopes)
+	longest := -1
+	var routeScopes []string
+	for prefix, scopes := range p.factory.routeScopes {
+		if match.PathPrefix(path, prefix) && len(prefix) > longest {
+			longest = len(prefix)
+			routeScopes = scopes
+		}
+	}
+	return append(required, routeScopes...)
+}
+
+func bearerToken(authorization string) (string, bool) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func unauthorized(challenge string) *extproc.ProcessingResult {
+	return extproc.ImmediateResult(http.StatusUnauthorized, []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader(HeaderWWWAuthenticate, challenge),
+	}, []byte("unauthorized\n"))
+}
+
+// Phases reports that only request headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
@@ -0,0 +1,85 @@
+package introspection
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/introspection"
+	"github.com/rs/zerolog"
+)
+
+// fakeIntrospector resolves tokens from a map; unknown tokens fail.
+type fakeIntrospector map[string]*introspection.Result
+
+func (f fakeIntrospector) Introspect(_ context.Context, token string) (*introspection.Result, error) {
+	if result, ok := f[token]; ok {
+		return result, nil
+	}
+	return nil, errors.New("endpoint down")
+}
+
+var tokens = fakeIntrospector{
+	"alice":    {Active: true, Subject: "alice", Scope: "read", ClientID: "web"},
+	"admin":    {Active: true, Subject: "root", Scope: "read admin", ClientID: "cli"},
+	"inactive": {Active: false},
+}
+
+func TestProcessRequestHeaders(t *testing.T) {
+	f := NewProcessorFactory(tokens, zerolog.Nop(),
+		WithRequiredScopes("read"),
+		WithRouteScopes("/admin", "admin"),
+	)
+	for _, tt := range []struct {
+		name, auth, path string
+		expect           []extproctest.Expectation
+	}{
+		{"active", "Bearer alice", "/", []extproctest.Expectation{
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderSet("x-auth-subject", "alice"),
+			extproctest.ExpectHeaderSet("x-auth-client-id", "web"),
+			// Claims the token lacks are stripped, not passed through.
+			extproctest.ExpectHeaderRemoved("x-auth-username"),
+		}},
+		{"missing", "", "/", []extproctest.Expectation{extproctest.ExpectDenied(http.StatusUnauthorized)}},
+		{"not bearer", "Basic YTpi", "/", []extproctest.Expectation{extproctest.ExpectDenied(http.StatusUnauthorized)}},
+		{"inactive", "Bearer inactive", "/", []extproctest.Expectation{
+			extproctest.ExpectDenied(http.StatusUnauthorized),
+			extproctest.ExpectHeaderSet("www-authenticate", `Bearer error="invalid_token", error_description="token is not active"`),
+		}},
+		{"endpoint down", "Bearer unknown", "/", []extproctest.Expectation{extproctest.ExpectDenied(http.StatusServiceUnavailable)}},
+		{"route scope", "Bearer alice", "/admin/users", []extproctest.Expectation{extproctest.ExpectDenied(http.StatusForbidden)}},
+		{"route scope granted", "Bearer admin", "/admin/users", []extproctest.Expectation{
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderSet("x-auth-scope", "read admin"),
+		}},
+		{"route scope encoded", "Bearer alice", "/%61dmin/users", []extproctest.Expectation{extproctest.ExpectDenied(http.StatusForbidden)}},
+		{"route scope double slash", "Bearer alice", "//admin", []extproctest.Expectation{extproctest.ExpectDenied(http.StatusForbidden)}},
+		{"route scope dot segment", "Bearer alice", "/public/../admin?x=1", []extproctest.Expectation{extproctest.ExpectDenied(http.StatusForbidden)}},
+		{"route scope segment boundary", "Bearer alice", "/administrators", []extproctest.Expectation{extproctest.ExpectContinue()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := extproctest.NewContext(nil, ":path", tt.path, "authorization", tt.auth)
+			extproctest.Check(t, f.NewProcessor().ProcessRequestHeaders(ctx), tt.expect...)
+		})
+	}
+}
+
+// TestIdentityHeadersStripped checks that requests let through without an
+// active token never carry client-supplied identity headers.
+func TestIdentityHeadersStripped(t *testing.T) {
+	f := NewProcessorFactory(tokens, zerolog.Nop(), WithDecisionMode(extproc.DecisionLogOnly))
+	for _, auth := range []string{"", "Bearer inactive", "Bearer unknown"} {
+		ctx := extproctest.NewContext(nil, ":path", "/", "authorization", auth, "x-auth-subject", "root")
+		extproctest.Check(t, f.NewProcessor().ProcessRequestHeaders(ctx),
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderRemoved("x-auth-subject"),
+			extproctest.ExpectHeaderRemoved("x-auth-scope"),
+			extproctest.ExpectHeaderRemoved("x-auth-client-id"),
+			extproctest.ExpectHeaderRemoved("x-auth-username"),
+		)
+	}
+}
@@ -0,0 +1,118 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/kvstore"
+	"github.com/samber/oops"
+)
+
+// denylistKeyPrefix namespaces runtime denylist entries in the store.
+const denylistKeyPrefix = "ipfilter:deny:"
+
+// Denylist holds addresses denied at runtime in a kvstore.Store, so every
+// replica sharing the store, or gossiping with the others, denies them.
+type Denylist struct {
+	store kvstore.Store
+}
+
+// NewDenylist creates a Denylist kept in store.
+func NewDenylist(store kvstore.Store) *Denylist {
+	return &Denylist{store: store}
+}
+
+func denylistKey(addr netip.Addr) string {
+	return denylistKeyPrefix + addr.Unmap().String()
+}
+
+// Contains reports whether addr is denied.
+func (d *Denylist) Contains(ctx context.Context, addr netip.Addr) (bool, error) {
+	_, err := d.store.Get(ctx, denylistKey(addr))
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Add denies addr for ttl; 0 denies it until removed.
+func (d *Denylist) Add(ctx context.Context, addr netip.Addr, ttl time.Duration) error {
+	return d.store.Set(ctx, denylistKey(addr), []byte{'1'}, ttl)
+}
+
+// Remove lifts the denial of addr.
+func (d *Denylist) Remove(ctx context.Context, addr netip.Addr) error {
+	return d.store.Delete(ctx, denylistKey(addr))
+}
+
+// denylistEntry is the body of admin requests and responses.
+type denylistEntry struct {
+	Address string `json:"address"`
+	TTL     string `json:"ttl,omitempty"`
+	Denied  bool   `json:"denied"`
+}
+
+// ServeHTTP reports whether ?address= is denied on GET, denies a body of
+// {"address": "192.0.2.1", "ttl": "1h"} on POST, and lifts the denial of
+// ?address= on DELETE. Callers are not authenticated here: the admin listener
+// refuses unauthenticated POSTs and DELETEs (see adminauth.Require).
+func (d *Denylist) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var entry denylistEntry
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		entry.Address = r.URL.Query().Get("address")
+	case http.MethodPost:
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&entry); err != nil {
+			http.Error(w, `body must be {"address": "<ip>", "ttl": "<duration>"}`, http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	addr, err := netip.ParseAddr(entry.Address)
+	if err != nil {
+		http.Error(w, "address must be a single IP address", http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if entry.TTL != "" {
+		if ttl, err = time.ParseDuration(entry.TTL); err != nil || ttl < 0 {
+			http.Error(w, "ttl must be a non-negative duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry.Denied, err = d.Contains(r.Context(), addr)
+	case http.MethodPost:
+		if err = d.Add(r.Context(), addr, ttl); err == nil {
+			entry.Denied = true
+			audit.Record("ipfilter-denylist", audit.Admin(r), map[string]string{"deny": addr.String(), "ttl": entry.TTL})
+		}
+	case http.MethodDelete:
+		if err = d.Remove(r.Context(), addr); err == nil {
+			audit.Record("ipfilter-denylist", audit.Admin(r), map[string]string{"allow": addr.String()})
+		}
+	}
+	if err != nil {
+		err = oops.In("ipfilter").Code(errcode.StoreFailed).With("address", addr).Wrapf(err, "runtime denylist unavailable")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	entry.Address = addr.String()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entry)
+}
+
+// Ensure Denylist implements http.Handler.
+var _ http.Handler = (*Denylist)(nil)
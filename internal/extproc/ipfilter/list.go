@@ -0,0 +1,128 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// ParseList parses an IP list: one address or CIDR prefix per line. Blank
+// lines and text after '#' are ignored.
+func ParseList(data []byte) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		prefix, err := ParseEntry(entry)
+		if err != nil {
+			return nil, oops.With("line", line).Wrap(err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, oops.In("ipfilter").Code(errcode.InvalidCIDR).Wrapf(err, "failed to read IP list")
+	}
+	return prefixes, nil
+}
+
+// ParseEntry parses an address or CIDR prefix. IPv4-mapped IPv6 entries are
+// converted to IPv4.
+func ParseEntry(entry string) (netip.Prefix, error) {
+	var prefix netip.Prefix
+	if strings.Contains(entry, "/") {
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, oops.In("ipfilter").Code(errcode.InvalidCIDR).With("entry", entry).Wrapf(err, "invalid CIDR prefix")
+		}
+		prefix = p
+	} else {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return netip.Prefix{}, oops.In("ipfilter").Code(errcode.InvalidCIDR).With("entry", entry).Wrapf(err, "invalid IP address")
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// span is an inclusive address range.
+type span struct{ from, to netip.Addr }
+
+// Ranges is a set of prefixes, merged into sorted ranges for lookups in
+// logarithmic time.
+type Ranges struct {
+	spans []span
+}
+
+// NewRanges builds the set of addresses covered by prefixes.
+func NewRanges(prefixes []netip.Prefix) *Ranges {
+	spans := make([]span, 0, len(prefixes))
+	for _, p := range prefixes {
+		p = p.Masked()
+		spans = append(spans, span{from: p.Addr(), to: lastAddr(p)})
+	}
+	slices.SortFunc(spans, func(a, b span) int { return a.from.Compare(b.from) })
+
+	merged := spans[:0]
+	for _, s := range spans {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			// Ranges of different families never merge, even when the last
+			// IPv4 range ends at 255.255.255.255.
+			if last.to.BitLen() == s.from.BitLen() && (!last.to.Next().IsValid() || s.from.Compare(last.to.Next()) <= 0) {
+				if s.to.Compare(last.to) > 0 {
+					last.to = s.to
+				}
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+	return &Ranges{spans: slices.Clip(merged)}
+}
+
+// Contains reports whether addr is in the set.
+func (r *Ranges) Contains(addr netip.Addr) bool {
+	if r == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	i, _ := slices.BinarySearchFunc(r.spans, addr, func(s span, addr netip.Addr) int { return s.to.Compare(addr) })
+	return i < len(r.spans) && r.spans[i].from.Compare(addr) <= 0
+}
+
+// Len returns the number of merged ranges.
+func (r *Ranges) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.spans)
+}
+
+// lastAddr returns the highest address of p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	addr := p.Addr()
+	if addr.Is4() {
+		b := addr.As4()
+		for i := p.Bits(); i < 32; i++ {
+			b[i/8] |= 1 << (7 - i%8)
+		}
+		return netip.AddrFrom4(b)
+	}
+	b := addr.As16()
+	for i := p.Bits(); i < 128; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	return netip.AddrFrom16(b)
+}
@@ -0,0 +1,286 @@
+// Package ipfilter provides an ext_proc processor that allows or denies
+// requests by client address against static CIDR lists and an optional
+// runtime denylist shared through a key-value store.
+package ipfilter
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// Config holds the IP lists and how the client address is found.
+type Config struct {
+	// AllowFiles and DenyFiles are IP list files (see ParseList), or
+	// ConfigMap/Secret references, reloaded when they change.
+	AllowFiles []string
+	DenyFiles  []string
+	// Allow and Deny are addresses or CIDR prefixes given inline.
+	Allow []string
+	Deny  []string
+	// ClientIPHeader, if set, holds the client address, as set by a trusted
+	// earlier filter; otherwise the downstream peer address is used.
+	ClientIPHeader string
+	// ReloadInterval is how often files are checked for changes.
+	ReloadInterval time.Duration
+	// Denylist, if set, denies addresses added at runtime, after the static
+	// deny lists. When it is unavailable, requests are let through.
+	Denylist *Denylist
+	// DecisionMode selects whether denied clients are rejected.
+	DecisionMode extproc.DecisionMode
+}
+
+// lists is a consistent snapshot of both lists.
+type lists struct {
+	allow, deny *Ranges
+	// allowlist is set when any allow entry or file is configured, even an
+	// empty one, so an emptied allowlist denies everyone.
+	allowlist bool
+}
+
+// ProcessorFactory creates IP filter processors.
+type ProcessorFactory struct {
+	cfg     Config
+	log     zerolog.Logger
+	decider extproc.Decider
+	lists   atomic.Pointer[lists]
+
+	mu    sync.Mutex
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	// files holds the prefixes last loaded from each file.
+	files map[string][]netip.Prefix
+	stop  context.CancelFunc
+}
+
+// NewProcessorFactory loads the lists and follows changes to their files
+// until Close.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) (*ProcessorFactory, error) {
+	f := &ProcessorFactory{
+		cfg:   cfg,
+		log:   log.With().Str("processor", "ipfilter").Logger(),
+		files: make(map[string][]netip.Prefix),
+	}
+	f.decider = extproc.NewDecider("ipfilter", cfg.DecisionMode, f.log)
+	var err error
+	if f.allow, err = parseEntries(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseEntries(cfg.Deny); err != nil {
+		return nil, err
+	}
+	for _, path := range append(append([]string(nil), cfg.AllowFiles...), cfg.DenyFiles...) {
+		data, err := kube.ReadFile(context.Background(), path)
+		if err != nil {
+			return nil, oops.In("ipfilter").Code(errcode.ReadConfigFailed).With("path", path).Wrapf(err, "failed to read IP list")
+		}
+		prefixes, err := ParseList(data)
+		if err != nil {
+			return nil, oops.With("path", path).Wrap(err)
+		}
+		f.files[path] = prefixes
+		audit.Record("ip-list:"+path, audit.File(path), data)
+	}
+	f.rebuild()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.stop = cancel
+	var polled []string
+	for path := range f.files {
+		if kube.IsRef(path) {
+			go kube.WatchFile(ctx, path, f.log, func(data []byte) { f.apply(path, data) })
+		} else {
+			polled = append(polled, path)
+		}
+	}
+	if len(polled) > 0 {
+		go f.poll(ctx, polled)
+	}
+	return f, nil
+}
+
+func parseEntries(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		prefix, err := ParseEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// rebuild swaps in lists built from the inline entries and the files'
+// last good contents.
+func (f *ProcessorFactory) rebuild() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	collect := func(inline []netip.Prefix, paths []string) []netip.Prefix {
+		prefixes := append([]netip.Prefix(nil), inline...)
+		for _, path := range paths {
+			prefixes = append(prefixes, f.files[path]...)
+		}
+		return prefixes
+	}
+	l := &lists{
+		allow:     NewRanges(collect(f.allow, f.cfg.AllowFiles)),
+		deny:      NewRanges(collect(f.deny, f.cfg.DenyFiles)),
+		allowlist: len(f.cfg.Allow) > 0 || len(f.cfg.AllowFiles) > 0,
+	}
+	f.lists.Store(l)
+	f.log.Info().Int("allow_ranges", l.allow.Len()).Int("deny_ranges", l.deny.Len()).Msg("IP lists loaded")
+}
+
+// apply replaces the contents of one file; an invalid file keeps the
+// previous contents.
+func (f *ProcessorFactory) apply(path string, data []byte) {
+	prefixes, err := ParseList(data)
+	if err != nil {
+		f.log.Error().Err(err).Str("path", path).Msg("invalid IP list, keeping previous")
+		return
+	}
+	f.mu.Lock()
+	f.files[path] = prefixes
+	f.mu.Unlock()
+	f.rebuild()
+	audit.Record("ip-list:"+path, audit.File(path), data)
+}
+
+func (f *ProcessorFactory) poll(ctx context.Context, paths []string) {
+	interval := f.cfg.ReloadInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	modTimes := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				f.log.Warn().Err(err).Str("path", path).Msg("failed to stat IP list")
+				continue
+			}
+			if !info.ModTime().After(modTimes[path]) {
+				continue
+			}
+			modTimes[path] = info.ModTime()
+			data, err := os.ReadFile(path)
+			if err != nil {
+				f.log.Warn().Err(err).Str("path", path).Msg("failed to read IP list")
+				continue
+			}
+			f.apply(path, data)
+		}
+	}
+}
+
+// Close stops following changes.
+func (f *ProcessorFactory) Close() error {
+	f.stop()
+	return nil
+}
+
+// Allowed reports whether addr may pass and, if not, why: "denylist" or
+// "not_allowlisted". An invalid addr passes only without an allowlist.
+func (f *ProcessorFactory) Allowed(addr netip.Addr) (bool, string) {
+	l := f.lists.Load()
+	if addr.IsValid() && l.deny.Contains(addr) {
+		return false, "denylist"
+	}
+	if l.allowlist && !(addr.IsValid() && l.allow.Contains(addr)) {
+		return false, "not_allowlisted"
+	}
+	return true, ""
+}
+
+// NewProcessor creates a new IP filter processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+}
+
+// ProcessRequestHeaders answers denied clients with 403 Forbidden, or lets
+// them through as the decision mode selects.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	addr, err := p.clientIP(ctx)
+	if err != nil {
+		f.log.Warn().Err(err).Msg("failed to get client IP")
+	}
+	allowed, reason := f.Allowed(addr)
+	if allowed && f.cfg.Denylist != nil && addr.IsValid() {
+		denied, err := f.cfg.Denylist.Contains(context.Background(), addr)
+		if err != nil {
+			f.log.Warn().Err(err).Str("request_id", ctx.GetRequestID()).Msg("runtime denylist unavailable, letting request through")
+		}
+		allowed, reason = !denied, "denylist"
+	}
+	if allowed {
+		return extproc.ContinueResult()
+	}
+	f.log.Debug().
+		Str("request_id", ctx.GetRequestID()).
+		Str("client_ip", addr.String()).
+		Str("reason", reason).
+		Msg("request denied")
+	return f.decider.Reject(ctx.GetRequestID(), reason, extproc.ImmediateResult(http.StatusForbidden, nil, []byte("forbidden\n")), nil)
+}
+
+func (p *Processor) clientIP(ctx *extproc.RequestContext) (netip.Addr, error) {
+	header := p.factory.cfg.ClientIPHeader
+	if header == "" {
+		return ctx.GetDownstreamRemoteIP()
+	}
+	value := ctx.Headers.Get(header)
+	if value == "" {
+		return netip.Addr{}, oops.
+			In("ipfilter").
+			Code(errcode.MissingAttribute).
+			With("header", header).
+			Errorf("client IP header %q not found", header)
+	}
+	addr, err := extproc.ParseIPFromAddress(value)
+	return oops.Wrap2(addr, err)
+}
+
+// Phases reports that only request headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
@@ -0,0 +1,220 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/adminauth"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/kvstore"
+	"github.com/rs/zerolog"
+)
+
+func TestRangesContains(t *testing.T) {
+	prefixes, err := ParseList([]byte(`
+# office
+192.0.2.0/25
+192.0.2.128/25   # merged with the line above
+198.51.100.7
+255.255.255.255/32
+::/127
+2001:db8::/32
+::ffff:203.0.113.0/120
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRanges(prefixes)
+	for addr, want := range map[string]bool{
+		"192.0.2.0":           true,
+		"192.0.2.255":         true,
+		"192.0.3.0":           false,
+		"198.51.100.7":        true,
+		"198.51.100.8":        false,
+		"255.255.255.255":     true,
+		"::":                  true,
+		"::1":                 true,
+		"::2":                 false,
+		"2001:db8:1::1":       true,
+		"2001:db9::1":         false,
+		"203.0.113.9":         true,
+		"::ffff:192.0.2.1":    true,
+		"::ffff:198.51.100.8": false,
+	} {
+		if got := r.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if r.Len() != 6 {
+		t.Errorf("Len() = %d, want 6 merged ranges", r.Len())
+	}
+}
+
+func TestParseListRejectsInvalidEntries(t *testing.T) {
+	if _, err := ParseList([]byte("192.0.2.0/24\n192.0.2.300\n")); err == nil {
+		t.Fatal("ParseList accepted an invalid address")
+	}
+}
+
+func TestProcessRequestHeaders(t *testing.T) {
+	factory, err := NewProcessorFactory(Config{
+		Allow: []string{"192.0.2.0/24", "2001:db8::/32"},
+		Deny:  []string{"192.0.2.66"},
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+
+	for peer, allowed := range map[string]bool{
+		"192.0.2.10:40000":   true,
+		"192.0.2.66:40000":   false,
+		"198.51.100.1:40000": false,
+		"[2001:db8::1]:443":  true,
+	} {
+		result := factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(map[string]string{"source.address": peer}))
+		if allowed {
+			extproctest.Check(t, result, extproctest.ExpectContinue())
+		} else {
+			extproctest.Check(t, result, extproctest.ExpectDenied(http.StatusForbidden))
+		}
+	}
+
+	// Without a known client address, the allowlist denies.
+	extproctest.Check(t, factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil)),
+		extproctest.ExpectDenied(http.StatusForbidden),
+	)
+}
+
+func TestClientIPHeader(t *testing.T) {
+	factory, err := NewProcessorFactory(Config{Deny: []string{"203.0.113.0/24"}, ClientIPHeader: "x-real-ip"}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+	attrs := map[string]string{"source.address": "192.0.2.10:40000"}
+
+	extproctest.Check(t, factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(attrs, "x-real-ip", "203.0.113.7")),
+		extproctest.ExpectDenied(http.StatusForbidden),
+	)
+	// Without an allowlist, a missing header passes.
+	extproctest.Check(t, factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(attrs)),
+		extproctest.ExpectContinue(),
+	)
+}
+
+func TestReloadsListFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte("192.0.2.1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	factory, err := NewProcessorFactory(Config{DenyFiles: []string{path}, ReloadInterval: 10 * time.Millisecond}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+
+	allowed := func(addr string) bool {
+		ok, _ := factory.Allowed(netip.MustParseAddr(addr))
+		return ok
+	}
+	if allowed("192.0.2.1") || !allowed("192.0.2.2") {
+		t.Fatal("initial list not applied")
+	}
+
+	// An invalid file keeps the previous list.
+	mtime := time.Now().Add(time.Second)
+	if err := os.WriteFile(path, []byte("not-an-ip\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(path, mtime, mtime)
+	time.Sleep(50 * time.Millisecond)
+	if allowed("192.0.2.1") {
+		t.Fatal("invalid file replaced the list")
+	}
+
+	mtime = mtime.Add(time.Second)
+	if err := os.WriteFile(path, []byte("192.0.2.2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(path, mtime, mtime)
+	deadline := time.Now().Add(2 * time.Second)
+	for allowed("192.0.2.2") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if allowed("192.0.2.2") || !allowed("192.0.2.1") {
+		t.Fatal("changed file not reloaded")
+	}
+}
+
+func TestRuntimeDenylist(t *testing.T) {
+	denylist := NewDenylist(kvstore.NewMemory(0))
+	factory, err := NewProcessorFactory(Config{Denylist: denylist}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+	admin := func(method, target, body string) int {
+		rec := httptest.NewRecorder()
+		denylist.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec.Code
+	}
+	request := func() *extproc.ProcessingResult {
+		return factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(map[string]string{"source.address": "192.0.2.7:40000"}))
+	}
+
+	extproctest.Check(t, request(), extproctest.ExpectContinue())
+	if code := admin(http.MethodPost, "/admin/ipfilter/deny", `{"address": "192.0.2.7", "ttl": "1h"}`); code != http.StatusOK {
+		t.Fatalf("POST = %d, want 200", code)
+	}
+	extproctest.Check(t, request(), extproctest.ExpectDenied(http.StatusForbidden))
+	if code := admin(http.MethodPost, "/admin/ipfilter/deny", `{"address": "192.0.2.0/24"}`); code != http.StatusBadRequest {
+		t.Fatalf("POST of a prefix = %d, want 400", code)
+	}
+	if code := admin(http.MethodDelete, "/admin/ipfilter/deny?address=192.0.2.7", ""); code != http.StatusOK {
+		t.Fatalf("DELETE = %d, want 200", code)
+	}
+	extproctest.Check(t, request(), extproctest.ExpectContinue())
+}
+
+func TestRuntimeDenylistRefusesUnauthenticated(t *testing.T) {
+	denylist := NewDenylist(kvstore.NewMemory(0))
+	addr := netip.MustParseAddr("192.0.2.7")
+	if err := denylist.Add(t.Context(), addr, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Without a token or client CA only loopback callers may change it.
+	h := adminauth.Require(adminauth.Config{}, denylist)
+	admin := func(method, target, body, remote string) int {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if code := admin(http.MethodDelete, "/admin/ipfilter/deny?address=192.0.2.7", "", "192.0.2.7:40000"); code != http.StatusUnauthorized {
+		t.Fatalf("remote DELETE = %d, want 401", code)
+	}
+	if code := admin(http.MethodPost, "/admin/ipfilter/deny", `{"address": "192.0.2.8"}`, "192.0.2.7:40000"); code != http.StatusUnauthorized {
+		t.Fatalf("remote POST = %d, want 401", code)
+	}
+	for addr, want := range map[string]bool{"192.0.2.7": true, "192.0.2.8": false} {
+		if denied, err := denylist.Contains(t.Context(), netip.MustParseAddr(addr)); err != nil || denied != want {
+			t.Errorf("%s denied = %v, %v after refused changes, want %v", addr, denied, err, want)
+		}
+	}
+	if code := admin(http.MethodGet, "/admin/ipfilter/deny?address=192.0.2.7", "", "192.0.2.7:40000"); code != http.StatusOK {
+		t.Errorf("remote GET = %d, want 200", code)
+	}
+	if code := admin(http.MethodDelete, "/admin/ipfilter/deny?address=192.0.2.7", "", "127.0.0.1:40000"); code != http.StatusOK {
+		t.Errorf("loopback DELETE = %d, want 200", code)
+	}
+}
@@ -0,0 +1,135 @@
+// Package jsonredact provides an ext_proc processor that removes or masks
+// JSON fields in streamed response bodies.
+package jsonredact
+
+import (
+	"mime"
+	"strings"
+	"sync"
+
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/jsonredact"
+	"github.com/rs/zerolog"
+)
+
+// Config holds JSON redaction settings.
+type Config struct {
+	// Routes are the path prefixes whose JSON responses are redacted.
+	Routes []string
+	Rules  []jsonredact.Rule
+	// Mask replaces masked values.
+	Mask string
+}
+
+// ProcessorFactory creates JSON redaction processors.
+type ProcessorFactory struct {
+	cfg Config
+	log zerolog.Logger
+}
+
+// NewProcessorFactory creates a new JSON redaction ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	return &ProcessorFactory{
+		cfg: cfg,
+		log: log.With().Str("processor", "jsonredact").Logger(),
+	}
+}
+
+// NewProcessor creates a new JSON redaction processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor redacts a single response.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	mu        sync.Mutex
+	matched   bool
+	requestID string
+	redactor  *jsonredact.Redactor
+}
+
+// ProcessRequestHeaders switches matching routes to a streamed response body.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	path, _, _ := strings.Cut(ctx.Headers.Get(":path"), "?")
+	if !p.factory.matches(path) {
+		return extproc.ContinueResult()
+	}
+	p.mu.Lock()
+	p.matched = true
+	p.requestID = ctx.GetRequestID()
+	p.mu.Unlock()
+
+	result := extproc.ContinueResult()
+	result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+		ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+		ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_STREAMED,
+		RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+	}
+	return result
+}
+
+// ProcessResponseHeaders starts redaction for uncompressed JSON bodies. The
+// body length changes, so Content-Length is dropped.
+func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.matched || ctx.EndOfStream {
+		return extproc.ContinueResult()
+	}
+	mediaType, _, _ := mime.ParseMediaType(ctx.Headers.Get("content-type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return extproc.ContinueResult()
+	}
+	if encoding := ctx.Headers.Get("content-encoding"); encoding != "" && encoding != "identity" {
+		p.factory.log.Warn().
+			Str("content_encoding", encoding).
+			Str("request_id", p.requestID).
+			Msg("cannot redact encoded JSON response, passing through")
+		return extproc.ContinueResult()
+	}
+
+	p.redactor = jsonredact.New(p.factory.cfg.Rules, p.factory.cfg.Mask)
+	return &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{RemoveHeaders: []string{"content-length"}},
+	}
+}
+
+// ProcessResponseBody rewrites each chunk as it streams through.
+func (p *Processor) ProcessResponseBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.redactor == nil {
+		return extproc.ContinueResult()
+	}
+
+	hadErr := p.redactor.Err() != nil
+	out := p.redactor.Write(body)
+	if endOfStream {
+		out = append(out, p.redactor.Close()...)
+	}
+	if err := p.redactor.Err(); err != nil && !hadErr {
+		p.factory.log.Warn().Err(err).Str("request_id", p.requestID).Msg("invalid JSON response, passing remainder through")
+	}
+	return extproc.ContinueWithBody(out)
+}
+
+func (f *ProcessorFactory) matches(path string) bool {
+	for _, prefix := range f.cfg.Routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
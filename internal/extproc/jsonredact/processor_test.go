@@ -0,0 +1,33 @@
+package jsonredact
+
+import (
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/jsonredact"
+	"github.com/rs/zerolog"
+)
+
+func TestProcessResponseBody(t *testing.T) {
+	factory := NewProcessorFactory(Config{
+		Routes: []string{"/api/"},
+		Rules: []jsonredact.Rule{
+			{Path: []string{"password"}, Action: jsonredact.ActionRemove},
+			{Path: []string{"ssn"}, Action: jsonredact.ActionMask},
+		},
+		Mask: "***",
+	}, zerolog.Nop())
+	p := factory.NewProcessor()
+
+	extproctest.Check(t, p.ProcessRequestHeaders(extproctest.NewContext(nil, ":method", "GET", ":path", "/api/me")),
+		extproctest.ExpectContinue(),
+	)
+	extproctest.Check(t, p.ProcessResponseHeaders(extproctest.NewContext(nil, ":status", "200", "content-type", "application/json")),
+		extproctest.ExpectContinue(),
+		extproctest.ExpectHeaderRemoved("content-length"),
+	)
+	extproctest.Check(t, p.ProcessResponseBody(extproctest.NewContext(nil), []byte(`{"name":"a","password":"x","ssn":"123"}`), true),
+		extproctest.ExpectContinue(),
+		extproctest.ExpectBody(`{"name":"a","ssn":"***"}`),
+	)
+}
@@ -0,0 +1,202 @@
+// Package jsontransform provides an ext_proc processor that rewrites JSON
+// request bodies with per-route jq templates, adapting legacy clients at
+// the edge.
+package jsontransform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/match"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// Config holds limits shared by all routes.
+type Config struct {
+	// MaxBodyBytes rejects larger request bodies with 413.
+	MaxBodyBytes int
+	// Timeout bounds a single template run.
+	Timeout time.Duration
+}
+
+// ProcessorFactory creates JSON transform processors.
+type ProcessorFactory struct {
+	cfg   Config
+	rules atomic.Pointer[Rules]
+	log   zerolog.Logger
+}
+
+// NewProcessorFactory creates a new JSON transform ProcessorFactory.
+func NewProcessorFactory(cfg Config, rules *Rules, log zerolog.Logger) *ProcessorFactory {
+	f := &ProcessorFactory{
+		cfg: cfg,
+		log: log.With().Str("processor", "jsontransform").Logger(),
+	}
+	f.rules.Store(rules)
+	return f
+}
+
+// SetRules replaces the rules used by new requests.
+func (f *ProcessorFactory) SetRules(rules *Rules) {
+	f.rules.Store(rules)
+}
+
+// NewProcessor creates a new JSON transform processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor transforms a single request body.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	mu        sync.Mutex
+	route     *Route
+	method    string
+	path      string
+	requestID string
+	body      []byte
+}
+
+// ProcessRequestHeaders matches JSON requests to a route and buffers their
+// bodies.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	if ctx.EndOfStream {
+		return extproc.ContinueResult()
+	}
+	mediaType, _, _ := mime.ParseMediaType(ctx.Headers.Get("content-type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return extproc.ContinueResult()
+	}
+	ip, _ := ctx.GetDownstreamRemoteIP()
+	req := match.NewRequest(ctx.Headers, ip)
+	route, ok := f.rules.Load().Match(req)
+	if !ok {
+		return extproc.ContinueResult()
+	}
+	if encoding := ctx.Headers.Get("content-encoding"); encoding != "" && encoding != "identity" {
+		f.log.Warn().
+			Str("content_encoding", encoding).
+			Str("request_id", ctx.GetRequestID()).
+			Msg("cannot transform encoded JSON request, passing through")
+		return extproc.ContinueResult()
+	}
+	if length, err := strconv.Atoi(ctx.Headers.Get("content-length")); err == nil && f.cfg.MaxBodyBytes > 0 && length > f.cfg.MaxBodyBytes {
+		return extproc.ImmediateResult(http.StatusRequestEntityTooLarge, nil, []byte("request body too large\n"))
+	}
+
+	p.mu.Lock()
+	p.route = route
+	p.method = req.Method
+	p.path = req.Path
+	p.requestID = ctx.GetRequestID()
+	p.mu.Unlock()
+
+	result := extproc.ContinueResult()
+	result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+		RequestBodyMode:     envoy_extensions_ext_proc_v3.ProcessingMode_BUFFERED,
+		RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_NONE,
+		ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+	}
+	return result
+}
+
+// ProcessRequestBody replaces the buffered body with the template's output
+// and updates Content-Length to match.
+func (p *Processor) ProcessRequestBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	f := p.factory
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.route == nil {
+		return extproc.ContinueResult()
+	}
+
+	p.body = append(p.body, body...)
+	if f.cfg.MaxBodyBytes > 0 && len(p.body) > f.cfg.MaxBodyBytes {
+		return extproc.ImmediateResult(http.StatusRequestEntityTooLarge, nil, []byte("request body too large\n"))
+	}
+	if !endOfStream {
+		return extproc.ContinueResult()
+	}
+	route := p.route
+	p.route = nil
+	in := p.body
+	p.body = nil
+
+	out, err := f.transform(route, in, p.method, p.path)
+	if err != nil {
+		event := f.log.Warn().Err(err).Str("request_id", p.requestID).Str("route", route.Prefix)
+		if route.PassOnError {
+			event.Msg("transform failed, passing original body through")
+			return extproc.ContinueResult()
+		}
+		event.Msg("transform failed, rejecting request")
+		return extproc.ImmediateResult(http.StatusBadRequest, nil, []byte("request body could not be transformed\n"))
+	}
+
+	result := extproc.ContinueWithBody(out)
+	result.HeaderMutations = &extproc.HeaderMutations{
+		SetHeaders: []*envoy_api_v3_core.HeaderValueOption{
+			extproc.SetHeader("content-length", strconv.Itoa(len(out))),
+		},
+	}
+	f.log.Debug().
+		Str("request_id", p.requestID).
+		Str("route", route.Prefix).
+		Int("bytes_in", len(in)).
+		Int("bytes_out", len(out)).
+		Msg("request body transformed")
+	return result
+}
+
+// transform decodes body, keeping numbers exact, runs the route's template
+// on it and encodes the result.
+func (f *ProcessorFactory) transform(route *Route, body []byte, method, path string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var in any
+	if err := dec.Decode(&in); err != nil {
+		return nil, oops.In("jsontransform").Code(errcode.SyntaxError).Wrapf(err, "request body is not JSON")
+	}
+	if dec.More() {
+		return nil, oops.In("jsontransform").Code(errcode.SyntaxError).Errorf("request body holds more than one JSON value")
+	}
+	ctx := context.Background()
+	if f.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.cfg.Timeout)
+		defer cancel()
+	}
+	out, err := route.Apply(ctx, in, method, path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, oops.In("jsontransform").Code(errcode.TransformFailed).Wrapf(err, "failed to encode transformed body")
+	}
+	return data, nil
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
@@ -0,0 +1,133 @@
+package jsontransform
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+const testRules = `
+routes:
+  - prefix: /v1/users
+    methods: [post]
+    template: |
+      .data
+      | .name = (.full_name // .name)
+      | del(.full_name)
+      | .role //= "member"
+      | .source = $method + " " + $path
+  - prefix: /v1/users/import
+    template: .
+    pass_on_error: true
+  - prefix: /v1/loop
+    template: 'def f: f; f'
+  - prefix: /v1/empty
+    template: empty
+`
+
+func TestProcessRequestBody(t *testing.T) {
+	rules, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := NewProcessorFactory(Config{MaxBodyBytes: 64, Timeout: 50 * time.Millisecond}, rules, zerolog.Nop())
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		headers []extproctest.Expectation
+		expect  []extproctest.Expectation
+	}{
+		{
+			name:   "rename, default and unwrap",
+			method: "POST",
+			path:   "/v1/users?dry_run=1",
+			body:   `{"data":{"full_name":"Ada","id":12345678901234567890}}`,
+			expect: []extproctest.Expectation{
+				extproctest.ExpectContinue(),
+				extproctest.ExpectBody(`{"id":12345678901234567890,"name":"Ada","role":"member","source":"POST /v1/users"}`),
+				extproctest.ExpectHeaderSet("content-length", "82"),
+			},
+		},
+		{
+			name:   "invalid JSON rejected",
+			method: "POST",
+			path:   "/v1/users",
+			body:   `{"data":`,
+			expect: []extproctest.Expectation{extproctest.ExpectDenied(400)},
+		},
+		{
+			name:   "invalid JSON passed through",
+			method: "POST",
+			path:   "/v1/users/import",
+			body:   `not json`,
+			expect: []extproctest.Expectation{extproctest.ExpectContinue()},
+		},
+		{
+			name:   "body too large",
+			method: "POST",
+			path:   "/v1/users/import",
+			body:   `{"padding":"` + string(make([]byte, 64)) + `"}`,
+			expect: []extproctest.Expectation{extproctest.ExpectDenied(413)},
+		},
+		{
+			name:   "template timeout",
+			method: "POST",
+			path:   "/v1/loop",
+			body:   `{}`,
+			expect: []extproctest.Expectation{extproctest.ExpectDenied(400)},
+		},
+		{
+			name:   "template without output",
+			method: "POST",
+			path:   "/v1/empty",
+			body:   `{}`,
+			expect: []extproctest.Expectation{extproctest.ExpectDenied(400)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := factory.NewProcessor()
+			ctx := extproctest.NewContext(nil, ":method", tt.method, ":path", tt.path, "content-type", "application/json")
+			ctx.EndOfStream = false
+			result := p.ProcessRequestHeaders(ctx)
+			if result.ModeOverride == nil {
+				t.Fatalf("request body not buffered: %s", extproctest.Describe(result))
+			}
+			result = p.ProcessRequestBody(ctx, []byte(tt.body), true)
+			extproctest.Check(t, result, tt.expect...)
+		})
+	}
+}
+
+func TestProcessRequestHeadersSkips(t *testing.T) {
+	rules, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := NewProcessorFactory(Config{}, rules, zerolog.Nop())
+	for name, headers := range map[string][]string{
+		"unmatched route":  {":method", "POST", ":path", "/v2/users", "content-type", "application/json"},
+		"unmatched method": {":method", "GET", ":path", "/v1/users", "content-type", "application/json"},
+		"not JSON":         {":method", "POST", ":path", "/v1/users", "content-type", "text/plain"},
+		"encoded":          {":method", "POST", ":path", "/v1/users", "content-type", "application/json", "content-encoding", "gzip"},
+	} {
+		ctx := extproctest.NewContext(nil, headers...)
+		ctx.EndOfStream = false
+		if result := factory.NewProcessor().ProcessRequestHeaders(ctx); result.ModeOverride != nil {
+			t.Errorf("%s: body buffered", name)
+		}
+	}
+}
+
+func TestParseRulesInvalidTemplate(t *testing.T) {
+	_, err := ParseRules([]byte("routes:\n  - prefix: /v1\n    template: '.a |'\n"))
+	if !errcode.Is(err, errcode.InvalidRules) {
+		t.Fatalf("ParseRules error = %v, want %s", err, errcode.InvalidRules)
+	}
+}
@@ -0,0 +1,148 @@
+package jsontransform
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/itchyny/gojq"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/match"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+)
+
+// Variables are available to every template: the request method and path
+// (without the query).
+var Variables = []string{"$method", "$path"}
+
+// Rules is the route to template mapping file.
+type Rules struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// Route transforms the JSON request bodies of the endpoints under Prefix.
+type Route struct {
+	Prefix string `yaml:"prefix"`
+	// Methods restricts the route to these methods; empty matches all.
+	Methods []string `yaml:"methods,omitempty"`
+	// Template is a jq program whose first output replaces the body, e.g.
+	// '.data | .name = (.full_name // "") | del(.full_name)'.
+	Template string `yaml:"template"`
+	// PassOnError forwards the original body when it is not JSON or the
+	// template fails, instead of answering 400.
+	PassOnError bool `yaml:"pass_on_error,omitempty"`
+	// Match narrows the route further, e.g. to some hosts or clients (see
+	// package match).
+	Match *match.Spec `yaml:"match,omitempty"`
+
+	code    *gojq.Code
+	matcher *match.Matcher
+}
+
+// LoadRules reads and validates a YAML mapping file or ConfigMap/Secret
+// reference (see kube.ParseRef).
+func LoadRules(path string) (*Rules, error) {
+	data, err := kube.ReadFile(context.Background(), path)
+	if err != nil {
+		return nil, oops.
+			In("jsontransform").
+			Code(errcode.ReadRulesFailed).
+			With("path", path).
+			Wrapf(err, "failed to read transform rules")
+	}
+	return ParseRules(data)
+}
+
+// ParseRules parses the YAML mapping and compiles its templates.
+func ParseRules(data []byte) (*Rules, error) {
+	var rules Rules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, oops.
+			In("jsontransform").
+			Code(errcode.ParseRulesFailed).
+			Wrapf(err, "failed to parse transform rules")
+	}
+	for i, r := range rules.Routes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, oops.
+				In("jsontransform").
+				Code(errcode.InvalidRules).
+				With("index", i).
+				With("prefix", r.Prefix).
+				Errorf("route prefix must start with '/'")
+		}
+		query, err := gojq.Parse(r.Template)
+		if err != nil {
+			return nil, oops.
+				In("jsontransform").
+				Code(errcode.InvalidRules).
+				With("prefix", r.Prefix).
+				Wrapf(err, "invalid template")
+		}
+		code, err := gojq.Compile(query, gojq.WithVariables(Variables))
+		if err != nil {
+			return nil, oops.
+				In("jsontransform").
+				Code(errcode.InvalidRules).
+				With("prefix", r.Prefix).
+				Wrapf(err, "invalid template")
+		}
+		rules.Routes[i].code = code
+		for j, m := range r.Methods {
+			rules.Routes[i].Methods[j] = strings.ToUpper(m)
+		}
+		if r.Match != nil {
+			matcher, err := match.Compile(*r.Match)
+			if err != nil {
+				return nil, oops.
+					In("jsontransform").
+					Code(errcode.InvalidRules).
+					With("prefix", r.Prefix).
+					Wrap(err)
+			}
+			rules.Routes[i].matcher = matcher
+		}
+	}
+	return &rules, nil
+}
+
+// Match returns the route with the longest prefix matching the request.
+func (r *Rules) Match(req match.Request) (*Route, bool) {
+	var best *Route
+	for i := range r.Routes {
+		route := &r.Routes[i]
+		if !strings.HasPrefix(req.Path, route.Prefix) ||
+			(len(route.Methods) > 0 && !slices.Contains(route.Methods, req.Method)) ||
+			!route.matcher.Match(req) {
+			continue
+		}
+		if best == nil || len(route.Prefix) > len(best.Prefix) {
+			best = route
+		}
+	}
+	return best, best != nil
+}
+
+// Apply runs the template on body and returns its first output. The
+// variables are bound in the order of Variables.
+func (r *Route) Apply(ctx context.Context, body any, method, path string) (any, error) {
+	iter := r.code.RunWithContext(ctx, body, method, path)
+	v, ok := iter.Next()
+	if !ok {
+		return nil, oops.
+			In("jsontransform").
+			Code(errcode.TransformFailed).
+			With("prefix", r.Prefix).
+			Errorf("template produced no value")
+	}
+	if err, ok := v.(error); ok {
+		return nil, oops.
+			In("jsontransform").
+			Code(errcode.TransformFailed).
+			With("prefix", r.Prefix).
+			Wrap(err)
+	}
+	return v, nil
+}
@@ -0,0 +1,231 @@
+// Package jwtauth provides an ext_proc processor that authenticates requests
+// carrying JWT bearer tokens and forwards the verified claims upstream.
+package jwtauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/jwtauth"
+	"github.com/rs/zerolog"
+)
+
+const (
+	HeaderAuthorization   = "authorization"
+	HeaderWWWAuthenticate = "www-authenticate"
+
+	headerSuffixSubject = "sub"
+	headerInfixClaims   = "claims-"
+)
+
+// Verifier verifies a token and returns its claims.
+type Verifier interface {
+	Verify(ctx context.Context, token string) (jwtauth.Claims, error)
+}
+
+// ProcessorFactory creates jwt-auth processors.
+type ProcessorFactory struct {
+	verifier           Verifier
+	claims             []string
+	headerPrefix       string
+	stripAuthorization bool
+	decisionMode       extproc.DecisionMode
+	decider            extproc.Decider
+	log                zerolog.Logger
+}
+
+type Option func(*ProcessorFactory)
+
+// WithClaims forwards the named claims as <prefix>claims-<name> headers.
+func WithClaims(names ...string) Option {
+	return func(f *ProcessorFactory) {
+		for _, name := range names {
+			if name = strings.TrimSpace(name); name != "" {
+				f.claims = append(f.claims, name)
+			}
+		}
+	}
+}
+
+// WithHeaderPrefix sets the prefix of the claim headers injected upstream.
+func WithHeaderPrefix(prefix string) Option {
+	return func(f *ProcessorFactory) {
+		f.headerPrefix = strings.ToLower(prefix)
+	}
+}
+
+// WithStripAuthorization removes the Authorization header once the token
+// is verified, so the upstream only sees the claim headers.
+func WithStripAuthorization(strip bool) Option {
+	return func(f *ProcessorFactory) {
+		f.stripAuthorization = strip
+	}
+}
+
+// WithDecisionMode selects whether requests failing authentication are
+// rejected; those let through carry no claim headers.
+func WithDecisionMode(mode extproc.DecisionMode) Option {
+	return func(f *ProcessorFactory) {
+		f.decisionMode = mode
+	}
+}
+
+// NewProcessorFactory creates a new jwt-auth ProcessorFactory.
+func NewProcessorFactory(verifier Verifier, log zerolog.Logger, opts ...Option) *ProcessorFactory {
+	f := &ProcessorFactory{
+		verifier:     verifier,
+		headerPrefix: "x-jwt-",
+		log:          log.With().Str("processor", "jwt-auth").Logger(),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	f.decider = extproc.NewDecider("jwt-auth", f.decisionMode, f.log)
+	return f
+}
+
+// NewProcessor creates a new jwt-auth processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor authenticates a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+}
+
+// ProcessRequestHeaders verifies the bearer token and injects its claims as
+// headers for the upstream.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+
+	token, ok := bearerToken(ctx.Headers.Get(HeaderAuthorization))
+	if !ok {
+		return f.decider.Reject(ctx.GetRequestID(), "missing_token", unauthorized(`Bearer`), f.anonymous())
+	}
+
+	claims, err := f.verifier.Verify(context.Background(), token)
+	if err != nil {
+		if !rejected(err) {
+			f.log.Error().Err(err).Str("request_id", ctx.GetRequestID()).Msg("JWKS unavailable")
+			return f.decider.Reject(ctx.GetRequestID(), "unavailable",
+				extproc.ImmediateResult(http.StatusServiceUnavailable, nil, []byte("authorization service unavailable\n")), f.anonymous())
+		}
+		f.log.Debug().Err(err).Str("request_id", ctx.GetRequestID()).Msg("token rejected")
+		return f.decider.Reject(ctx.GetRequestID(), "invalid_token", unauthorized(`Bearer error="invalid_token"`), f.anonymous())
+	}
+
+	result := &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{},
+	}
+	// Always overwrite or strip so clients cannot spoof claim headers.
+	set := func(name, value string) {
+		if value != "" {
+			result.HeaderMutations.SetHeaders = append(result.HeaderMutations.SetHeaders, extproc.SetHeader(name, value))
+		} else {
+			result.HeaderMutations.RemoveHeaders = append(result.HeaderMutations.RemoveHeaders, name)
+		}
+	}
+	set(f.headerPrefix+headerSuffixSubject, claims.Subject())
+	for _, name := range f.claims {
+		set(f.headerPrefix+headerInfixClaims+strings.ToLower(name), claimValue(claims[name]))
+	}
+	if f.stripAuthorization {
+		result.HeaderMutations.RemoveHeaders = append(result.HeaderMutations.RemoveHeaders, HeaderAuthorization)
+	}
+	return result
+}
+
+// anonymous returns the result letting an unauthenticated request through,
+// with any claim headers sent by the client removed.
+func (f *ProcessorFactory) anonymous() *extproc.ProcessingResult {
+	remove := []string{f.headerPrefix + headerSuffixSubject}
+	for _, name := range f.claims {
+		remove = append(remove, f.headerPrefix+headerInfixClaims+strings.ToLower(name))
+	}
+	return &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{RemoveHeaders: remove},
+	}
+}
+
+// rejected reports whether err is a fault of the token rather than of the
+// JWKS endpoint.
+func rejected(err error) bool {
+	return errcode.Classify(err).Category == errcode.CategoryProtocol || errcode.Is(err, errcode.KeyNotFound)
+}
+
+// claimValue renders a claim as a header value: strings as-is, arrays of
+// strings comma-joined, and anything else as JSON.
+func claimValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return jsonValue(v)
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ",")
+	}
+	return jsonValue(v)
+}
+
+func jsonValue(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func bearerToken(authorization string) (string, bool) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func unauthorized(challenge string) *extproc.ProcessingResult {
+	return extproc.ImmediateResult(http.StatusUnauthorized, []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader(HeaderWWWAuthenticate, challenge),
+	}, []byte("unauthorized\n"))
+}
+
+// Phases reports that only request headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders
+}
+
+// Name reports the processor as jwt-auth, matching its log lines.
+func (p *Processor) Name() string {
+	return "jwt-auth"
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
+
+// Ensure Processor implements extproc.Named.
+var _ extproc.Named = (*Processor)(nil)
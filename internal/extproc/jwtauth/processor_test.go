@@ -0,0 +1,114 @@
+package jwtauth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/jwtauth"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+type staticVerifier map[string]jwtauth.Claims
+
+func (v staticVerifier) Verify(_ context.Context, token string) (jwtauth.Claims, error) {
+	switch token {
+	case "down":
+		return nil, oops.Code(errcode.APIRequestFailed).Errorf("JWKS request failed")
+	case "unknown-kid":
+		return nil, oops.Code(errcode.KeyNotFound).Errorf("no JWKS key")
+	}
+	claims, ok := v[token]
+	if !ok {
+		return nil, oops.Code(errcode.BadSignature).Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+func TestProcessRequestHeaders(t *testing.T) {
+	verifier := staticVerifier{
+		"good": {
+			"sub":    "alice",
+			"email":  "alice@example.com",
+			"groups": []any{"admin", "dev"},
+			"tenant": map[string]any{"id": float64(7)},
+		},
+	}
+	factory := NewProcessorFactory(verifier, zerolog.Nop(),
+		WithClaims("email", "groups", "tenant", "missing"),
+		WithStripAuthorization(true),
+	)
+
+	t.Run("verified", func(t *testing.T) {
+		result := factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil,
+			"authorization", "Bearer good",
+			"x-jwt-sub", "mallory",
+		))
+		extproctest.Check(t, result,
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderSet("x-jwt-sub", "alice"),
+			extproctest.ExpectHeaderSet("x-jwt-claims-email", "alice@example.com"),
+			extproctest.ExpectHeaderSet("x-jwt-claims-groups", "admin,dev"),
+			extproctest.ExpectHeaderSet("x-jwt-claims-tenant", `{"id":7}`),
+			extproctest.ExpectHeaderRemoved("x-jwt-claims-missing"),
+			extproctest.ExpectHeaderRemoved("authorization"),
+		)
+	})
+
+	for _, tt := range []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"basic", "Basic Zm9vOmJhcg==", http.StatusUnauthorized},
+		{"invalid", "Bearer forged", http.StatusUnauthorized},
+		{"unknown kid", "Bearer unknown-kid", http.StatusUnauthorized},
+		{"jwks down", "Bearer down", http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var headers []string
+			if tt.authorization != "" {
+				headers = []string{"authorization", tt.authorization}
+			}
+			result := factory.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, headers...))
+			extproctest.Check(t, result, extproctest.ExpectDenied(tt.status))
+		})
+	}
+}
+
+func TestDecisionMode(t *testing.T) {
+	ctx := func() *extproc.RequestContext {
+		return extproctest.NewContext(nil, "authorization", "Bearer forged", "x-jwt-sub", "mallory")
+	}
+
+	t.Run("log-only", func(t *testing.T) {
+		factory := NewProcessorFactory(staticVerifier{}, zerolog.Nop(), WithDecisionMode(extproc.DecisionLogOnly))
+		result := factory.NewProcessor().ProcessRequestHeaders(ctx())
+		extproctest.Check(t, result,
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderRemoved("x-jwt-sub"),
+		)
+		if len(result.HeaderMutations.SetHeaders) > 0 {
+			t.Errorf("log-only result sets headers: %s", extproctest.Describe(result))
+		}
+	})
+
+	t.Run("header-tag-only", func(t *testing.T) {
+		factory := NewProcessorFactory(staticVerifier{}, zerolog.Nop(), WithDecisionMode(extproc.DecisionHeaderTag))
+		extproctest.Check(t, factory.NewProcessor().ProcessRequestHeaders(ctx()),
+			extproctest.ExpectContinue(),
+			extproctest.ExpectHeaderRemoved("x-jwt-sub"),
+			extproctest.ExpectHeaderSet(extproc.HeaderWouldBlock, "jwt-auth; reason=invalid_token"),
+		)
+	})
+
+	t.Run("enforce", func(t *testing.T) {
+		factory := NewProcessorFactory(staticVerifier{}, zerolog.Nop(), WithDecisionMode(extproc.DecisionEnforce))
+		extproctest.Check(t, factory.NewProcessor().ProcessRequestHeaders(ctx()), extproctest.ExpectDenied(http.StatusUnauthorized))
+	})
+}
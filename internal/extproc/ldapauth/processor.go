@@ -0,0 +1,242 @@
+// Package ldapauth provides an ext_proc processor that authorizes an already
+// authenticated identity by its LDAP/Active Directory group membership.
+package ldapauth
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+)
+
+// GroupResolver returns the group DNs a user belongs to.
+type GroupResolver interface {
+	Groups(user string) ([]string, error)
+}
+
+// ProcessorFactory creates LDAP authorization processors.
+type ProcessorFactory struct {
+	resolver       GroupResolver
+	identityHeader string
+	groupsHeader   string
+	defaultGroups  []string
+	routeGroups    map[string][]string
+	matchCN        bool
+	decisionMode   extproc.DecisionMode
+	decider        extproc.Decider
+	log            zerolog.Logger
+}
+
+type Option func(*ProcessorFactory)
+
+// WithIdentityHeader sets the header carrying the authenticated user name.
+// It must be set by a trusted authenticator earlier in the filter chain.
+func WithIdentityHeader(header string) Option {
+	return func(f *ProcessorFactory) {
+		f.identityHeader = header
+	}
+}
+
+// WithGroupsHeader injects the user's group names upstream as a
+// comma-separated header. Empty disables it.
+func WithGroupsHeader(header string) Option {
+	return func(f *ProcessorFactory) {
+		f.groupsHeader = header
+	}
+}
+
+// WithDefaultGroups requires membership in any of groups on paths without a
+// route rule. Without default groups such paths are not checked.
+func WithDefaultGroups(groups ...string) Option {
+	return func(f *ProcessorFactory) {
+		f.defaultGroups = append(f.defaultGroups, groups...)
+	}
+}
+
+// WithRouteGroups requires membership in any of groups for paths starting
+// with prefix. The longest matching prefix wins.
+func WithRouteGroups(prefix string, groups ...string) Option {
+	return func(f *ProcessorFactory) {
+		f.routeGroups[prefix] = append(f.routeGroups[prefix], groups...)
+	}
+}
+
+// WithCNMatching also lets a required group name a group by its CN alone.
+// CNs are not unique across a directory, so by default groups must be
+// given as full DNs.
+func WithCNMatching() Option {
+	return func(f *ProcessorFactory) {
+		f.matchCN = true
+	}
+}
+
+// WithDecisionMode selects whether unauthorized requests are rejected.
+func WithDecisionMode(mode extproc.DecisionMode) Option {
+	return func(f *ProcessorFactory) {
+		f.decisionMode = mode
+	}
+}
+
+// NewProcessorFactory creates a new LDAP authorization ProcessorFactory.
+func NewProcessorFactory(resolver GroupResolver, log zerolog.Logger, opts ...Option) *ProcessorFactory {
+	f := &ProcessorFactory{
+		resolver:       resolver,
+		identityHeader: "x-auth-subject",
+		routeGroups:    make(map[string][]string),
+		log:            log.With().Str("processor", "ldapauth").Logger(),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	f.decider = extproc.NewDecider("ldapauth", f.decisionMode, f.log)
+	if !f.matchCN {
+		f.warnNotDN(f.defaultGroups)
+		for _, groups := range f.routeGroups {
+			f.warnNotDN(groups)
+		}
+	}
+	return f
+}
+
+// warnNotDN logs the required groups that are not DNs and so never match.
+func (f *ProcessorFactory) warnNotDN(groups []string) {
+	for _, group := range groups {
+		if dn, err := ldap.ParseDN(group); err != nil || len(dn.RDNs) == 0 {
+			f.log.Warn().Str("group", group).Msg("required group is not a DN and never matches without CN matching")
+		}
+	}
+}
+
+// NewProcessor creates a new LDAP authorization processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor authorizes a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+}
+
+// ProcessRequestHeaders checks that the identity belongs to a required group.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	path, _, _ := strings.Cut(ctx.Headers.Get(":path"), "?")
+	required := f.requiredGroups(path)
+	if len(required) == 0 && f.groupsHeader == "" {
+		return extproc.ContinueResult()
+	}
+
+	user := strings.TrimSpace(ctx.Headers.Get(f.identityHeader))
+	if user == "" {
+		if len(required) == 0 {
+			return removeHeader(f.groupsHeader)
+		}
+		return f.decider.Reject(ctx.GetRequestID(), "unauthenticated",
+			extproc.ImmediateResult(http.StatusUnauthorized, nil, []byte("authentication required\n")), f.anonymous())
+	}
+
+	groups, err := f.resolver.Groups(user)
+	if err != nil {
+		f.log.Error().Err(err).Str("user", user).Str("request_id", ctx.GetRequestID()).Msg("group lookup failed")
+		return f.decider.Reject(ctx.GetRequestID(), "unavailable",
+			extproc.ImmediateResult(http.StatusServiceUnavailable, nil, []byte("authorization service unavailable\n")), f.anonymous())
+	}
+
+	result := extproc.ContinueResult()
+	if f.groupsHeader != "" {
+		names := make([]string, 0, len(groups))
+		for _, dn := range groups {
+			names = append(names, commonName(dn))
+		}
+		result = extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
+			extproc.SetHeader(f.groupsHeader, strings.Join(names, ",")),
+		})
+	}
+
+	if len(required) > 0 && !slices.ContainsFunc(required, func(want string) bool {
+		return slices.ContainsFunc(groups, func(dn string) bool { return f.groupMatches(want, dn) })
+	}) {
+		f.log.Info().
+			Str("user", user).
+			Str("path", path).
+			Strs("required", required).
+			Str("request_id", ctx.GetRequestID()).
+			Msg("user lacks required group")
+		return f.decider.Reject(ctx.GetRequestID(), "missing_group",
+			extproc.ImmediateResult(http.StatusForbidden, nil, []byte("forbidden\n")), result)
+	}
+	return result
+}
+
+// anonymous returns the result letting a request without resolved groups
+// through, with any groups header sent by the client removed.
+func (f *ProcessorFactory) anonymous() *extproc.ProcessingResult {
+	if f.groupsHeader == "" {
+		return nil
+	}
+	return removeHeader(f.groupsHeader)
+}
+
+func (f *ProcessorFactory) requiredGroups(path string) []string {
+	longest := -1
+	required := f.defaultGroups
+	for prefix, groups := range f.routeGroups {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			longest = len(prefix)
+			required = groups
+		}
+	}
+	return required
+}
+
+// groupMatches reports whether want names the group dn: as the same DN,
+// compared attribute by attribute, or as its CN with CN matching.
+func (f *ProcessorFactory) groupMatches(want, dn string) bool {
+	if f.matchCN && strings.EqualFold(want, commonName(dn)) {
+		return true
+	}
+	wantDN, err := ldap.ParseDN(want)
+	if err != nil {
+		return false
+	}
+	groupDN, err := ldap.ParseDN(dn)
+	if err != nil {
+		return false
+	}
+	return len(wantDN.RDNs) > 0 && wantDN.EqualFold(groupDN)
+}
+
+// commonName returns the value of the first RDN of dn.
+func commonName(dn string) string {
+	rdn, _, _ := strings.Cut(dn, ",")
+	if _, value, ok := strings.Cut(rdn, "="); ok {
+		return strings.TrimSpace(value)
+	}
+	return dn
+}
+
+func removeHeader(header string) *extproc.ProcessingResult {
+	return &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{RemoveHeaders: []string{header}},
+	}
+}
+
+// Phases reports that only request headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
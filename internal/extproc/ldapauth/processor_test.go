@@ -0,0 +1,82 @@
+package ldapauth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+// fakeResolver resolves groups from a map; unknown users fail.
+type fakeResolver map[string][]string
+
+func (f fakeResolver) Groups(user string) ([]string, error) {
+	if groups, ok := f[user]; ok {
+		return groups, nil
+	}
+	return nil, errors.New("ldap down")
+}
+
+const (
+	adminsDN = "CN=Domain Admins,CN=Users,DC=corp,DC=example"
+	// otherAdminsDN shares the CN of adminsDN in another domain.
+	otherAdminsDN = "CN=Domain Admins,CN=Users,DC=lab,DC=example"
+)
+
+var directory = fakeResolver{
+	"alice":   {adminsDN, "CN=ops,OU=Groups,DC=corp,DC=example"},
+	"mallory": {otherAdminsDN},
+	"bob":     {},
+}
+
+func check(t *testing.T, f *ProcessorFactory, user, path string, expect ...extproctest.Expectation) {
+	t.Helper()
+	headers := []string{":path", path, "x-groups", "spoofed"}
+	if user != "" {
+		headers = append(headers, "x-auth-subject", user)
+	}
+	extproctest.Check(t, f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, headers...)), expect...)
+}
+
+func TestGroupMatching(t *testing.T) {
+	f := NewProcessorFactory(directory, zerolog.Nop(),
+		WithGroupsHeader("x-groups"),
+		// DNs match attribute by attribute, case-insensitively.
+		WithRouteGroups("/admin", "cn=domain admins, cn=users, dc=corp, dc=example"),
+		WithRouteGroups("/ops", "ops"),
+	)
+	check(t, f, "alice", "/admin", extproctest.ExpectContinue(), extproctest.ExpectHeaderSet("x-groups", "Domain Admins,ops"))
+	// A group of the same name elsewhere does not match the DN.
+	check(t, f, "mallory", "/admin", extproctest.ExpectDenied(http.StatusForbidden))
+	check(t, f, "bob", "/admin", extproctest.ExpectDenied(http.StatusForbidden))
+	// A CN alone never matches without CN matching.
+	check(t, f, "alice", "/ops", extproctest.ExpectDenied(http.StatusForbidden))
+	// Paths without a rule are not checked, but the header is still
+	// replaced.
+	check(t, f, "bob", "/", extproctest.ExpectContinue(), extproctest.ExpectHeaderSet("x-groups", ""))
+
+	f = NewProcessorFactory(directory, zerolog.Nop(), WithCNMatching(), WithRouteGroups("/admin", "Domain Admins"))
+	check(t, f, "alice", "/admin", extproctest.ExpectContinue())
+	check(t, f, "mallory", "/admin", extproctest.ExpectContinue())
+	check(t, f, "bob", "/admin", extproctest.ExpectDenied(http.StatusForbidden))
+}
+
+// TestFailClosed checks that requests are rejected when the identity or
+// its groups are unknown, and that permissive modes never pass on a
+// client-supplied groups header.
+func TestFailClosed(t *testing.T) {
+	f := NewProcessorFactory(directory, zerolog.Nop(), WithGroupsHeader("x-groups"), WithDefaultGroups(adminsDN))
+	check(t, f, "", "/", extproctest.ExpectDenied(http.StatusUnauthorized))
+	check(t, f, "unknown", "/", extproctest.ExpectDenied(http.StatusServiceUnavailable))
+
+	f = NewProcessorFactory(directory, zerolog.Nop(),
+		WithGroupsHeader("x-groups"),
+		WithDefaultGroups(adminsDN),
+		WithDecisionMode(extproc.DecisionLogOnly),
+	)
+	check(t, f, "", "/", extproctest.ExpectContinue(), extproctest.ExpectHeaderRemoved("x-groups"))
+	check(t, f, "unknown", "/", extproctest.ExpectContinue(), extproctest.ExpectHeaderRemoved("x-groups"))
+}
@@ -0,0 +1,76 @@
+package extproc
+
+import (
+	"sync"
+
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// requestTracker finds request boundaries on a stream. Phases of one
+// request arrive in order and only bodies repeat, so a phase that goes back,
+// or a repeated header or trailer phase, starts the next request. It is only
+// touched by the stream's receive loop.
+type requestTracker struct {
+	// index is the position of the current request on the stream.
+	index int
+	last  int
+	seen  bool
+	// inflight counts handlers of the current request still running.
+	inflight sync.WaitGroup
+}
+
+// advance records req and reports whether it starts a new request.
+func (t *requestTracker) advance(req *envoy_service_proc_v3.ProcessingRequest) bool {
+	phase, body := phaseOrder(req)
+	if phase < 0 {
+		return false
+	}
+	boundary := t.seen && (phase < t.last || phase == t.last && !body)
+	if boundary {
+		t.index++
+	}
+	t.last, t.seen = phase, true
+	return boundary
+}
+
+// phaseOrder returns the position of req's phase within a request, or -1
+// for unknown messages, and whether the phase may repeat.
+func phaseOrder(req *envoy_service_proc_v3.ProcessingRequest) (int, bool) {
+	switch req.Request.(type) {
+	case *envoy_service_proc_v3.ProcessingRequest_RequestHeaders:
+		return 0, false
+	case *envoy_service_proc_v3.ProcessingRequest_RequestBody:
+		return 1, true
+	case *envoy_service_proc_v3.ProcessingRequest_RequestTrailers:
+		return 2, false
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseHeaders:
+		return 3, false
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseBody:
+		return 4, true
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseTrailers:
+		return 5, false
+	default:
+		return -1, false
+	}
+}
+
+// reusable reports whether processor resets its own per-request state, so
+// it can serve every request of a stream. Other processors are replaced by
+// a fresh instance for each request.
+func reusable(processor Processor) bool {
+	if s, ok := processor.(*eventSplitter); ok {
+		processor = s.EventProcessor
+	}
+	_, ok := processor.(RequestEndHandler)
+	return ok
+}
+
+// endProcessor ends the current request of processor and then its stream.
+func endProcessor(processor Processor) {
+	if h, ok := processor.(RequestEndHandler); ok {
+		h.OnRequestEnd()
+	}
+	if h, ok := processor.(StreamEndHandler); ok {
+		h.OnStreamEnd()
+	}
+}
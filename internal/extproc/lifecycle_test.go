@@ -0,0 +1,59 @@
+package extproc
+
+import (
+	"testing"
+
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/rs/zerolog"
+)
+
+// countingProcessor records its lifecycle calls in its factory.
+type countingProcessor struct {
+	BaseProcessor
+	f *countingFactory
+}
+
+func (p *countingProcessor) OnStreamEnd() { p.f.streamEnds++ }
+
+type resettingProcessor struct{ countingProcessor }
+
+func (p *resettingProcessor) OnRequestEnd() { p.f.requestEnds++ }
+
+type countingFactory struct {
+	resets                           bool
+	created, streamEnds, requestEnds int
+}
+
+func (f *countingFactory) NewProcessor() Processor {
+	f.created++
+	if f.resets {
+		return &resettingProcessor{countingProcessor{f: f}}
+	}
+	return &countingProcessor{f: f}
+}
+
+func TestProcessorPerRequest(t *testing.T) {
+	reqs := benchRequests()
+	messages := []*envoy_service_proc_v3.ProcessingRequest{
+		reqs["request_headers"], reqs["response_headers"],
+		reqs["request_headers"], reqs["response_headers"],
+		reqs["request_headers"],
+	}
+	for _, tt := range []struct {
+		resets                           bool
+		created, streamEnds, requestEnds int
+	}{
+		{resets: false, created: 3, streamEnds: 3},
+		{resets: true, created: 1, streamEnds: 1, requestEnds: 3},
+	} {
+		f := &countingFactory{resets: tt.resets}
+		s := NewServer(f, zerolog.Nop(), WithDispatch(DispatchSequential, 1))
+		if err := s.Process(&fakeStream{requests: messages}); err != nil {
+			t.Fatal(err)
+		}
+		if f.created != tt.created || f.streamEnds != tt.streamEnds || f.requestEnds != tt.requestEnds {
+			t.Errorf("resets=%t: created %d, stream ends %d, request ends %d; want %d, %d, %d",
+				tt.resets, f.created, f.streamEnds, f.requestEnds, tt.created, tt.streamEnds, tt.requestEnds)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/jsonstrict"
+	"github.com/samber/oops"
+)
+
+// chatRequest is the subset of an OpenAI-compatible completion, chat or
+// embeddings request the processor inspects.
+type chatRequest struct {
+	Model string
+	// Prompt concatenates every text fragment of the messages, prompt and
+	// input.
+	Prompt string
+	// MaxOutputTokens is the completion limit requested by the client.
+	MaxOutputTokens int
+	Stream          bool
+}
+
+// maxTokens bounds token counts read from requests, which may be floats
+// beyond the range of int.
+const maxTokens = 1 << 53
+
+// parseRequest decodes an OpenAI-compatible request body by its exact keys,
+// as the upstream does: repeated or case-variant keys and fields of the
+// wrong type are errors rather than values the upstream would not use.
+func parseRequest(body []byte) (*chatRequest, error) {
+	members, err := jsonstrict.Object(body)
+	if err != nil {
+		return nil, err
+	}
+	var req chatRequest
+	if raw, ok := members["model"]; ok {
+		if err := json.Unmarshal(raw, &req.Model); err != nil {
+			return nil, oops.In("llm").Code(errcode.InvalidJSON).Wrapf(err, "invalid model")
+		}
+	}
+	if raw, ok := members["stream"]; ok {
+		if err := json.Unmarshal(raw, &req.Stream); err != nil {
+			return nil, oops.In("llm").Code(errcode.InvalidJSON).Wrapf(err, "invalid stream")
+		}
+	}
+	for _, key := range []string{"max_tokens", "max_completion_tokens", "max_output_tokens"} {
+		raw, ok := members[key]
+		if !ok {
+			continue
+		}
+		n, err := tokens(raw)
+		if err != nil {
+			return nil, oops.In("llm").Code(errcode.InvalidJSON).With("key", key).Wrapf(err, "invalid %s", key)
+		}
+		req.MaxOutputTokens = max(req.MaxOutputTokens, n)
+	}
+
+	var b strings.Builder
+	if raw, ok := members["messages"]; ok {
+		var messages []json.RawMessage
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			return nil, oops.In("llm").Code(errcode.InvalidJSON).Wrapf(err, "invalid messages")
+		}
+		for _, raw := range messages {
+			message, err := jsonstrict.Object(raw)
+			if err != nil {
+				return nil, err
+			}
+			if err := appendText(&b, message["content"]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, key := range []string{"prompt", "input"} {
+		if err := appendText(&b, members[key]); err != nil {
+			return nil, err
+		}
+	}
+	req.Prompt = b.String()
+	return &req, nil
+}
+
+// tokens decodes a token count, rounding fractions up; null is 0.
+func tokens(raw json.RawMessage) (int, error) {
+	var n *json.Number
+	if err := json.Unmarshal(raw, &n); err != nil || n == nil {
+		return 0, err
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return 0, err
+	}
+	return int(min(math.Ceil(f), maxTokens)), nil
+}
+
+// usage is the token accounting reported by the upstream.
+type usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	// Responses API names.
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func (u *usage) normalize() {
+	if u.PromptTokens == 0 {
+		u.PromptTokens = u.InputTokens
+	}
+	if u.CompletionTokens == 0 {
+		u.CompletionTokens = u.OutputTokens
+	}
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+}
+
+// completion is the subset of a response body or stream chunk the processor
+// inspects.
+type completion struct {
+	Model string `json:"model"`
+	Usage *usage `json:"usage"`
+	// Responses API streams nest the final response.
+	Response *completion `json:"response"`
+}
+
+// appendText extracts text from a string, an array of strings, or an array
+// of content parts / messages carrying "text" or "content".
+func appendText(b *strings.Builder, raw json.RawMessage) error {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil
+	}
+	switch raw[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return oops.In("llm").Code(errcode.InvalidJSON).Wrapf(err, "invalid prompt text")
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(s)
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return oops.In("llm").Code(errcode.InvalidJSON).Wrapf(err, "invalid prompt")
+		}
+		for _, item := range items {
+			if err := appendText(b, item); err != nil {
+				return err
+			}
+		}
+	case '{':
+		part, err := jsonstrict.Object(raw)
+		if err != nil {
+			return err
+		}
+		if err := appendText(b, part["text"]); err != nil {
+			return err
+		}
+		return appendText(b, part["content"])
+	}
+	return nil
+}
+
+// estimateTokens approximates a token count at four characters per token,
+// the usual rule of thumb for English text with BPE tokenizers.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// apiError renders an OpenAI-style error body.
+func apiError(message, errType, code string) []byte {
+	body, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    errType,
+			"code":    code,
+		},
+	})
+	return body
+}
@@ -0,0 +1,358 @@
+// Package llm provides an ext_proc processor for AI gateway use: it inspects
+// OpenAI-compatible requests and responses, including SSE streams, enforces
+// size and token limits, logs redacted prompts and reports token usage.
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+)
+
+// DefaultRedactPatterns mask common secrets and personal data in logged prompts.
+var DefaultRedactPatterns = []string{
+	`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}\b`,
+	`\b(?:\d[ -]?){13,16}\b`,
+	`(?i)bearer\s+[A-Za-z0-9._~+/=-]{16,}`,
+}
+
+// Config holds LLM inspection settings.
+type Config struct {
+	// Routes are the path prefixes of OpenAI-compatible endpoints.
+	Routes []string
+	// MaxRequestBytes rejects larger request bodies with 413.
+	MaxRequestBytes int
+	// MaxPromptTokens rejects prompts estimated above it; zero disables.
+	MaxPromptTokens int
+	// MaxCompletionTokens rejects requests asking for more output tokens;
+	// zero disables.
+	MaxCompletionTokens int
+	// AllowedModels, if set, rejects other models with 403.
+	AllowedModels []string
+	// LogPrompts logs prompts after redaction, truncated to LogMaxChars.
+	LogPrompts  bool
+	LogMaxChars int
+	// RedactPatterns are regular expressions masked in logged prompts.
+	RedactPatterns []*regexp.Regexp
+	// UsageHeaderPrefix names the usage headers added to non-streaming
+	// responses; empty disables them.
+	UsageHeaderPrefix string
+	// DecisionMode selects whether requests over the limits are rejected.
+	DecisionMode extproc.DecisionMode
+}
+
+// ProcessorFactory creates LLM inspection processors.
+type ProcessorFactory struct {
+	cfg     Config
+	log     zerolog.Logger
+	decider extproc.Decider
+}
+
+// NewProcessorFactory creates a new LLM inspection ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	log = log.With().Str("processor", "llm").Logger()
+	return &ProcessorFactory{
+		cfg:     cfg,
+		log:     log,
+		decider: extproc.NewDecider("llm", cfg.DecisionMode, log),
+	}
+}
+
+// NewProcessor creates a new LLM inspection processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor inspects a single LLM API exchange.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	mu        sync.Mutex
+	matched   bool
+	path      string
+	requestID string
+	start     time.Time
+	body      []byte
+
+	model           string
+	stream          bool
+	promptEstimate  int
+	status          string
+	buffered        bool
+	usage           *usage
+	completionChars int
+	logged          sync.Once
+}
+
+// ProcessRequestHeaders selects API requests and buffers their bodies.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	path, _, _ := strings.Cut(ctx.Headers.Get(":path"), "?")
+	if ctx.Headers.Get(":method") != http.MethodPost || ctx.EndOfStream || !f.matches(path) {
+		return extproc.ContinueResult()
+	}
+	if length, err := strconv.Atoi(ctx.Headers.Get("content-length")); err == nil && length > f.cfg.MaxRequestBytes {
+		return f.reject(ctx.GetRequestID(), http.StatusRequestEntityTooLarge, "request body too large", "invalid_request_error", "request_too_large")
+	}
+
+	p.mu.Lock()
+	p.matched = true
+	p.path = path
+	p.requestID = ctx.GetRequestID()
+	p.start = time.Now()
+	p.mu.Unlock()
+
+	result := extproc.ContinueResult()
+	result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+		RequestBodyMode:     envoy_extensions_ext_proc_v3.ProcessingMode_BUFFERED,
+		RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+		ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_NONE,
+		ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+	}
+	return result
+}
+
+// ProcessRequestBody parses the request and enforces the configured limits.
+func (p *Processor) ProcessRequestBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	f := p.factory
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.matched {
+		return extproc.ContinueResult()
+	}
+
+	p.body = append(p.body, body...)
+	if len(p.body) > f.cfg.MaxRequestBytes {
+		// A request let through is not inspected further.
+		p.matched, p.body = false, nil
+		return f.reject(p.requestID, http.StatusRequestEntityTooLarge, "request body too large", "invalid_request_error", "request_too_large")
+	}
+	if !endOfStream {
+		return extproc.ContinueResult()
+	}
+
+	req, err := parseRequest(p.body)
+	p.body = nil
+	if err != nil {
+		if f.limited() {
+			f.log.Info().Err(err).Str("request_id", p.requestID).Msg("request body is not a valid API request")
+			return f.reject(p.requestID, http.StatusBadRequest, "request body is not a valid JSON API request", "invalid_request_error", "invalid_request")
+		}
+		f.log.Debug().Err(err).Str("request_id", p.requestID).Msg("request body is not JSON, passing through")
+		return extproc.ContinueResult()
+	}
+	prompt := req.Prompt
+	p.model = req.Model
+	p.stream = req.Stream
+	p.promptEstimate = estimateTokens(prompt)
+
+	event := f.log.Info().
+		Str("request_id", p.requestID).
+		Str("path", p.path).
+		Str("model", req.Model).
+		Bool("stream", req.Stream).
+		Int("prompt_tokens_estimate", p.promptEstimate).
+		Int("max_output_tokens", req.MaxOutputTokens)
+	if f.cfg.LogPrompts {
+		event = event.Str("prompt", f.redact(prompt))
+	}
+	event.Msg("llm request")
+
+	switch {
+	case len(f.cfg.AllowedModels) > 0 && !slices.Contains(f.cfg.AllowedModels, req.Model):
+		return f.reject(p.requestID, http.StatusForbidden, "model "+strconv.Quote(req.Model)+" is not allowed", "permission_error", "model_not_allowed")
+	case f.cfg.MaxPromptTokens > 0 && p.promptEstimate > f.cfg.MaxPromptTokens:
+		return f.reject(p.requestID, http.StatusBadRequest, "prompt exceeds "+strconv.Itoa(f.cfg.MaxPromptTokens)+" tokens", "invalid_request_error", "context_length_exceeded")
+	case f.cfg.MaxCompletionTokens > 0 && req.MaxOutputTokens > f.cfg.MaxCompletionTokens:
+		return f.reject(p.requestID, http.StatusBadRequest, "max tokens exceeds "+strconv.Itoa(f.cfg.MaxCompletionTokens), "invalid_request_error", "max_tokens_exceeded")
+	}
+	return extproc.ContinueResult()
+}
+
+// ProcessResponseHeaders buffers JSON responses so usage can be attached
+// as headers; SSE streams are handled event by event.
+func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.matched {
+		return extproc.ContinueResult()
+	}
+	p.status = ctx.Headers.Get(":status")
+	mediaType, _, _ := mime.ParseMediaType(ctx.Headers.Get("content-type"))
+	if ctx.EndOfStream || mediaType != "application/json" {
+		return extproc.ContinueResult()
+	}
+
+	p.buffered = true
+	result := extproc.ContinueResult()
+	result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+		ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_BUFFERED_PARTIAL,
+		ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+	}
+	return result
+}
+
+// ProcessResponseBody reads usage from a buffered JSON response and adds
+// usage headers. Responses over Envoy's buffer limit pass through as is.
+func (p *Processor) ProcessResponseBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.buffered {
+		return extproc.ContinueResult()
+	}
+	p.buffered = false
+	if !endOfStream {
+		return extproc.ContinueResult()
+	}
+
+	var resp completion
+	if json.Unmarshal(body, &resp) != nil {
+		return extproc.ContinueResult()
+	}
+	p.observe(&resp)
+	prefix := p.factory.cfg.UsageHeaderPrefix
+	if prefix == "" || p.usage == nil {
+		return extproc.ContinueResult()
+	}
+	return extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader(prefix+"model", p.model),
+		extproc.SetHeader(prefix+"prompt-tokens", strconv.Itoa(p.usage.PromptTokens)),
+		extproc.SetHeader(prefix+"completion-tokens", strconv.Itoa(p.usage.CompletionTokens)),
+		extproc.SetHeader(prefix+"total-tokens", strconv.Itoa(p.usage.TotalTokens)),
+	})
+}
+
+// ProcessResponseEvent reads model, usage and generated text from SSE
+// chunks, forwarding each event unchanged.
+func (p *Processor) ProcessResponseEvent(_ *extproc.RequestContext, event []byte) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.matched {
+		return event
+	}
+	for line := range bytes.Lines(event) {
+		data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+		data = bytes.TrimSpace(data)
+		if !ok || len(data) == 0 || data[0] != '{' {
+			continue
+		}
+		var chunk struct {
+			completion
+			Choices []struct {
+				Text  string `json:"text"`
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Delta string `json:"delta"`
+		}
+		if json.Unmarshal(data, &chunk) != nil {
+			continue
+		}
+		p.observe(&chunk.completion)
+		p.completionChars += len(chunk.Delta)
+		for _, choice := range chunk.Choices {
+			p.completionChars += len(choice.Text) + len(choice.Delta.Content)
+		}
+	}
+	return event
+}
+
+// OnStreamEnd logs the usage of the exchange.
+func (p *Processor) OnStreamEnd() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.matched {
+		return
+	}
+	p.logged.Do(func() {
+		event := p.factory.log.Info().
+			Str("request_id", p.requestID).
+			Str("path", p.path).
+			Str("model", p.model).
+			Str("status", p.status).
+			Bool("stream", p.stream).
+			Dur("duration", time.Since(p.start))
+		if p.usage != nil {
+			event = event.
+				Int("prompt_tokens", p.usage.PromptTokens).
+				Int("completion_tokens", p.usage.CompletionTokens).
+				Int("total_tokens", p.usage.TotalTokens)
+		} else {
+			event = event.
+				Int("prompt_tokens_estimate", p.promptEstimate).
+				Int("completion_tokens_estimate", (p.completionChars+3)/4)
+		}
+		event.Msg("llm response")
+	})
+}
+
+func (p *Processor) observe(c *completion) {
+	if c.Response != nil {
+		c = c.Response
+	}
+	if c.Model != "" {
+		p.model = c.Model
+	}
+	if c.Usage != nil {
+		c.Usage.normalize()
+		p.usage = c.Usage
+	}
+}
+
+func (f *ProcessorFactory) redact(prompt string) string {
+	for _, re := range f.cfg.RedactPatterns {
+		prompt = re.ReplaceAllString(prompt, "[REDACTED]")
+	}
+	if f.cfg.LogMaxChars > 0 && len(prompt) > f.cfg.LogMaxChars {
+		prompt = strings.ToValidUTF8(prompt[:f.cfg.LogMaxChars], "") + "…"
+	}
+	return prompt
+}
+
+func (f *ProcessorFactory) matches(path string) bool {
+	for _, prefix := range f.cfg.Routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// limited reports whether requests are checked against a model allowlist
+// or token limit, which bodies that do not parse must not bypass.
+func (f *ProcessorFactory) limited() bool {
+	return len(f.cfg.AllowedModels) > 0 || f.cfg.MaxPromptTokens > 0 || f.cfg.MaxCompletionTokens > 0
+}
+
+// reject answers with an OpenAI-style error under the decision mode; code
+// is the decision reason.
+func (f *ProcessorFactory) reject(requestID string, status int, message, errType, code string) *extproc.ProcessingResult {
+	return f.decider.Reject(requestID, code, extproc.ImmediateResult(status, []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("content-type", "application/json"),
+	}, apiError(message, errType, code)), nil)
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.EventProcessor.
+var _ extproc.EventProcessor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.StreamEndHandler.
+var _ extproc.StreamEndHandler = (*Processor)(nil)
@@ -0,0 +1,153 @@
+package llm
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+// request runs the request phases of a chat completion with body.
+func request(f *ProcessorFactory, body string) *extproc.ProcessingResult {
+	p := f.NewProcessor()
+	ctx := extproctest.NewContext(nil, ":method", "POST", ":path", "/v1/chat/completions")
+	if result := p.ProcessRequestHeaders(ctx); result.ImmediateResponse != nil {
+		return result
+	}
+	return p.ProcessRequestBody(ctx, []byte(body), true)
+}
+
+func TestDecisionMode(t *testing.T) {
+	cfg := Config{Routes: []string{"/v1/"}, MaxRequestBytes: 1 << 20, AllowedModels: []string{"small"}}
+	body := `{"model":"large","messages":[{"role":"user","content":"hi"}]}`
+
+	extproctest.Check(t, request(NewProcessorFactory(cfg, zerolog.Nop()), body),
+		extproctest.ExpectDenied(http.StatusForbidden))
+
+	cfg.DecisionMode = extproc.DecisionHeaderTag
+	extproctest.Check(t, request(NewProcessorFactory(cfg, zerolog.Nop()), body),
+		extproctest.ExpectContinue(),
+		extproctest.ExpectHeaderSet(extproc.HeaderWouldBlock, "llm; reason=model_not_allowed"))
+}
+
+func TestLimits(t *testing.T) {
+	f := NewProcessorFactory(Config{
+		Routes:              []string{"/v1/"},
+		MaxRequestBytes:     256,
+		MaxPromptTokens:     4,
+		MaxCompletionTokens: 100,
+	}, zerolog.Nop())
+
+	for body, code := range map[string]string{
+		`{"model":"m","messages":[{"role":"user","content":"hi"}],"max_tokens":10}`:                                   "",
+		`{"model":"m","messages":[{"role":"user","content":[{"type":"text","text":"this prompt is far too long"}]}]}`: "context_length_exceeded",
+		`{"model":"m","prompt":"hi","max_completion_tokens":101}`:                                                     "max_tokens_exceeded",
+		`{"model":"m","input":"` + strings.Repeat("x", 256) + `"}`:                                                    "request_too_large",
+		`not json`: "invalid_request",
+		`{"model":"m","messages":[{"role":"user","content":"hi","Content":"this prompt is far too long"}]}`: "invalid_request",
+		`{"model":"m","prompt":[{"text":"hi","TEXT":"this prompt is far too long"}]}`:                       "invalid_request",
+	} {
+		result := request(f, body)
+		if code == "" {
+			extproctest.Check(t, result, extproctest.ExpectContinue())
+			continue
+		}
+		var resp struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		if result.ImmediateResponse == nil || json.Unmarshal(result.ImmediateResponse.GetBody(), &resp) != nil || resp.Error.Code != code {
+			t.Errorf("%.40s: %s, want error %s", body, extproctest.Describe(result), code)
+		}
+	}
+
+	// A declared length over the limit is refused before buffering.
+	extproctest.Check(t, f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil,
+		":method", "POST", ":path", "/v1/completions", "content-length", "257")),
+		extproctest.ExpectDenied(http.StatusRequestEntityTooLarge))
+	// Other routes are not inspected.
+	extproctest.Check(t, f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil,
+		":method", "POST", ":path", "/admin", "content-length", "257")),
+		extproctest.ExpectContinue())
+}
+
+func TestPolicyBypass(t *testing.T) {
+	f := NewProcessorFactory(Config{
+		Routes:              []string{"/v1/"},
+		MaxRequestBytes:     1024,
+		MaxCompletionTokens: 100,
+		AllowedModels:       []string{"small"},
+	}, zerolog.Nop())
+
+	for body, code := range map[string]string{
+		// encoding/json would read the last, case-insensitively matching key.
+		`{"model":"large","Model":"small","messages":[{"role":"user","content":"hi"}]}`: "invalid_request",
+		`{"model":"large","model":"small"}`:                                             "invalid_request",
+		`{"Model":"small"}`:                                                             "model_not_allowed",
+		// Overflowing int must not skip the checks.
+		`{"model":"small","max_tokens":1e6}`:                "max_tokens_exceeded",
+		`{"model":"small","max_tokens":1e400}`:              "invalid_request",
+		`{"model":"small","max_completion_tokens":"lots"}`:  "invalid_request",
+		`{"model":"small","max_output_tokens":100.5}`:       "max_tokens_exceeded",
+		`{"model":"small","max_tokens":100,"stream":true}`:  "",
+		`{"model":"small","max_tokens":null,"stream":null}`: "",
+	} {
+		result := request(f, body)
+		if code == "" {
+			extproctest.Check(t, result, extproctest.ExpectContinue())
+			continue
+		}
+		var resp struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		if result.ImmediateResponse == nil || json.Unmarshal(result.ImmediateResponse.GetBody(), &resp) != nil || resp.Error.Code != code {
+			t.Errorf("%s: %s, want error %s", body, extproctest.Describe(result), code)
+		}
+	}
+
+	// Without limits, bodies that do not parse are only inspected.
+	extproctest.Check(t, request(NewProcessorFactory(Config{Routes: []string{"/v1/"}, MaxRequestBytes: 1024}, zerolog.Nop()), `not json`),
+		extproctest.ExpectContinue())
+}
+
+func TestUsageHeaders(t *testing.T) {
+	f := NewProcessorFactory(Config{Routes: []string{"/v1/"}, MaxRequestBytes: 1024, UsageHeaderPrefix: "x-llm-"}, zerolog.Nop())
+	sent := extproctest.Run(t, f,
+		extproctest.RequestHeaders(nil, ":method", "POST", ":path", "/v1/responses"),
+		extproctest.RequestBody(`{"model":"m","input":"hi"}`, true),
+		extproctest.ResponseHeaders(":status", "200", "content-type", "application/json"),
+		extproctest.ResponseBody(`{"model":"m-2024","usage":{"input_tokens":3,"output_tokens":5}}`, true),
+	)
+	got := map[string]string{}
+	for _, opt := range sent[3].GetResponseBody().GetResponse().GetHeaderMutation().GetSetHeaders() {
+		got[opt.GetHeader().GetKey()] = string(opt.GetHeader().GetRawValue())
+	}
+	want := map[string]string{
+		"x-llm-model":             "m-2024",
+		"x-llm-prompt-tokens":     "3",
+		"x-llm-completion-tokens": "5",
+		"x-llm-total-tokens":      "8",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("usage headers = %v, want %v", got, want)
+	}
+}
+
+func TestRedactPrompt(t *testing.T) {
+	f := NewProcessorFactory(Config{
+		RedactPatterns: []*regexp.Regexp{regexp.MustCompile(`sk-[a-z0-9]+`)},
+		LogMaxChars:    24,
+	}, zerolog.Nop())
+	if got, want := f.redact("my key is sk-abc123, héllo world"), "my key is [REDACTED], h…"; got != want {
+		t.Errorf("redact = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,143 @@
+package extproc
+
+import (
+	"time"
+
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PathTemplater maps request paths to bounded route templates for metric
+// labels.
+type PathTemplater interface {
+	Template(path string) string
+}
+
+var durationBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+
+var (
+	streamsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "extproc_streams_active",
+		Help: "Number of open ext_proc streams.",
+	})
+	messagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_messages_total",
+		Help: "ext_proc messages processed, by processor and phase.",
+	}, []string{"processor", "phase"})
+	messageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "extproc_message_duration_seconds",
+		Help:    "Time spent processing an ext_proc message, by processor and phase.",
+		Buckets: durationBuckets,
+	}, []string{"processor", "phase"})
+	processorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "extproc_processor_duration_seconds",
+		Help:    "Time the processor itself spent on an ext_proc message, by processor and phase.",
+		Buckets: durationBuckets,
+	}, []string{"processor", "phase"})
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_http_requests_total",
+		Help: "HTTP requests seen by the processor, by method, route template and status.",
+	}, []string{"method", "route", "status"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(streamsActive, messagesTotal, messageDuration, processorDuration, requestsTotal)
+}
+
+// phaseName returns the metric label of a message's phase.
+func phaseName(req *envoy_service_proc_v3.ProcessingRequest) string {
+	switch req.Request.(type) {
+	case *envoy_service_proc_v3.ProcessingRequest_RequestHeaders:
+		return "request_headers"
+	case *envoy_service_proc_v3.ProcessingRequest_RequestBody:
+		return "request_body"
+	case *envoy_service_proc_v3.ProcessingRequest_RequestTrailers:
+		return "request_trailers"
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseHeaders:
+		return "response_headers"
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseBody:
+		return "response_body"
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseTrailers:
+		return "response_trailers"
+	default:
+		return "unknown"
+	}
+}
+
+// phaseOf returns the phase of req, 0 for unknown messages.
+func phaseOf(req *envoy_service_proc_v3.ProcessingRequest) Phase {
+	switch req.Request.(type) {
+	case *envoy_service_proc_v3.ProcessingRequest_RequestHeaders:
+		return PhaseRequestHeaders
+	case *envoy_service_proc_v3.ProcessingRequest_RequestBody:
+		return PhaseRequestBody
+	case *envoy_service_proc_v3.ProcessingRequest_RequestTrailers:
+		return PhaseRequestTrailers
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseHeaders:
+		return PhaseResponseHeaders
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseBody:
+		return PhaseResponseBody
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseTrailers:
+		return PhaseResponseTrailers
+	default:
+		return 0
+	}
+}
+
+// observeMessage records a processed message. duration is the server's
+// whole handling time and processing the processor's share of it; the
+// difference is the server's overhead.
+func observeMessage(processor, phase string, duration, processing time.Duration) {
+	messagesTotal.WithLabelValues(processor, phase).Inc()
+	messageDuration.WithLabelValues(processor, phase).Observe(duration.Seconds())
+	processorDuration.WithLabelValues(processor, phase).Observe(processing.Seconds())
+}
+
+// requestStats collects the labels of the HTTP request carried by a stream.
+// It is only touched by the stream's receive loop.
+type requestStats struct {
+	method string
+	path   string
+	status string
+}
+
+func (r *requestStats) observe(req *envoy_service_proc_v3.ProcessingRequest) {
+	switch v := req.Request.(type) {
+	case *envoy_service_proc_v3.ProcessingRequest_RequestHeaders:
+		for _, h := range v.RequestHeaders.GetHeaders().GetHeaders() {
+			switch h.GetKey() {
+			case ":method":
+				r.method = headerValue(h.GetValue(), h.GetRawValue())
+			case ":path":
+				r.path = headerValue(h.GetValue(), h.GetRawValue())
+			}
+		}
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseHeaders:
+		for _, h := range v.ResponseHeaders.GetHeaders().GetHeaders() {
+			if h.GetKey() == ":status" {
+				r.status = headerValue(h.GetValue(), h.GetRawValue())
+			}
+		}
+	}
+}
+
+// record counts the request once the stream ends. Requests that never saw
+// response headers are counted with status "none".
+func (r *requestStats) record(paths PathTemplater) {
+	if r.method == "" {
+		return
+	}
+	status := r.status
+	if status == "" {
+		status = "none"
+	}
+	requestsTotal.WithLabelValues(r.method, paths.Template(r.path), status).Inc()
+}
+
+func headerValue(value string, raw []byte) string {
+	if len(raw) > 0 {
+		return string(raw)
+	}
+	return value
+}
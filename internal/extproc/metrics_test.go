@@ -0,0 +1,66 @@
+package extproc
+
+import (
+	"strings"
+	"testing"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/mnixry/envoy-ext-procs/internal/pathtemplate"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// TestMetricsOmitClientAddresses checks that client addresses, wherever a
+// request carries them, never become metric labels, as anonymized sinks
+// rely on.
+func TestMetricsOmitClientAddresses(t *testing.T) {
+	paths, err := pathtemplate.New(pathtemplate.Config{Heuristics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := &envoy_api_v3_core.HeaderMap{}
+	for _, kv := range [][2]string{
+		{":method", "GET"}, {":path", "/hosts/203.0.113.7/peers/2001:db8:beef::7?from=203.0.113.7"},
+		{"x-forwarded-for", "203.0.113.7, 10.0.0.1"}, {"x-real-ip", "203.0.113.7"}, {":status", "200"},
+	} {
+		headers.Headers = append(headers.Headers, &envoy_api_v3_core.HeaderValue{Key: kv[0], RawValue: []byte(kv[1])})
+	}
+	attrs := map[string]*structpb.Struct{EnvoyAttributesKey: {Fields: map[string]*structpb.Value{
+		"source.address": structpb.NewStringValue("203.0.113.7:40000"),
+	}}}
+	stream := &fakeStream{requests: []*envoy_service_proc_v3.ProcessingRequest{
+		{Attributes: attrs, Request: &envoy_service_proc_v3.ProcessingRequest_RequestHeaders{
+			RequestHeaders: &envoy_service_proc_v3.HttpHeaders{Headers: headers},
+		}},
+		{Attributes: attrs, Request: &envoy_service_proc_v3.ProcessingRequest_ResponseHeaders{
+			ResponseHeaders: &envoy_service_proc_v3.HttpHeaders{Headers: headers},
+		}},
+	}}
+	s := NewServer(&countingFactory{}, zerolog.Nop(), WithRequestMetrics(paths))
+	if err := s.Process(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := 0
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if strings.Contains(label.GetValue(), "203.0.113") || strings.Contains(label.GetValue(), "2001:db8") {
+					t.Errorf("%s{%s=%q} carries a client address", family.GetName(), label.GetName(), label.GetValue())
+				}
+				if label.GetName() == "route" && label.GetValue() == "/hosts/{id}/peers/{id}" {
+					routes++
+				}
+			}
+		}
+	}
+	if routes != 1 {
+		t.Error("request not counted under its templated route")
+	}
+}
@@ -0,0 +1,373 @@
+package extproc
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/textproto"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// DefaultMultipartHeaderBytes bounds the headers of a part when
+// MultipartLimits.MaxHeaderBytes is zero.
+const DefaultMultipartHeaderBytes = 16 << 10
+
+// MultipartLimits bound a multipart body; zero disables a limit.
+type MultipartLimits struct {
+	// MaxParts is the number of parts.
+	MaxParts int
+	// MaxPartBytes is the content size of a single part.
+	MaxPartBytes int64
+	// MaxTotalBytes is the size of the whole body, including framing.
+	MaxTotalBytes int64
+	// MaxHeaderBytes is the size of the headers of a single part; zero
+	// means DefaultMultipartHeaderBytes.
+	MaxHeaderBytes int
+}
+
+// MultipartPart describes a part of a multipart body.
+type MultipartPart struct {
+	// Index is the position of the part, from 0.
+	Index  int
+	Header textproto.MIMEHeader
+	// FormName is the name parameter of Content-Disposition.
+	FormName string
+	// FileName is the sanitized filename parameter of Content-Disposition
+	// (see SanitizeFilename); RawFileName is the value the client sent.
+	FileName    string
+	RawFileName string
+	// Size is the number of content bytes seen so far, and the part's
+	// size once it ends.
+	Size int64
+}
+
+// MultipartCallbacks receive the parts of a body as they are parsed. Each
+// is optional; an error returned by one stops parsing and is returned by
+// MultipartParser.Write.
+type MultipartCallbacks struct {
+	// OnPartStart is called once the headers of a part are parsed.
+	OnPartStart func(part *MultipartPart) error
+	// OnPartData is called with consecutive pieces of the part's content.
+	// data is only valid during the call.
+	OnPartData func(part *MultipartPart, data []byte) error
+	// OnPartEnd is called after the last piece of the part's content.
+	OnPartEnd func(part *MultipartPart) error
+}
+
+type multipartState int
+
+const (
+	mpPreamble multipartState = iota
+	mpAfterBoundary
+	mpHeaders
+	mpData
+	mpDone
+)
+
+// MultipartParser parses a multipart body (RFC 2046, e.g. multipart/form-data)
+// incrementally as chunks arrive, so uploads can be checked without
+// buffering them. Only a part's headers and a partial boundary are held.
+type MultipartParser struct {
+	limits    MultipartLimits
+	callbacks MultipartCallbacks
+
+	delimiter []byte // CRLF "--" boundary
+	state     multipartState
+	buf       []byte
+	total     int64
+	part      *MultipartPart
+	parts     int
+	err       error
+}
+
+// MultipartBoundary returns the boundary of a multipart content type.
+func MultipartBoundary(contentType string) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return "", false
+	}
+	boundary := params["boundary"]
+	return boundary, boundary != "" && len(boundary) <= 70
+}
+
+// NewMultipartParser creates a parser for a body of contentType.
+func NewMultipartParser(contentType string, limits MultipartLimits, callbacks MultipartCallbacks) (*MultipartParser, error) {
+	boundary, ok := MultipartBoundary(contentType)
+	if !ok {
+		return nil, oops.
+			In("extproc").
+			Code(errcode.InvalidMultipart).
+			With("content_type", contentType).
+			Errorf("not a multipart content type with a valid boundary")
+	}
+	if limits.MaxHeaderBytes == 0 {
+		limits.MaxHeaderBytes = DefaultMultipartHeaderBytes
+	}
+	return &MultipartParser{
+		limits:    limits,
+		callbacks: callbacks,
+		delimiter: []byte("\r\n--" + boundary),
+		buf:       []byte("\r\n"),
+	}, nil
+}
+
+// Write parses the next chunk of the body, calling back for every part
+// event it completes. After an error, Write keeps returning it.
+func (m *MultipartParser) Write(chunk []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.total += int64(len(chunk))
+	if m.limits.MaxTotalBytes > 0 && m.total > m.limits.MaxTotalBytes {
+		return m.fail(limitExceeded("total_bytes", m.limits.MaxTotalBytes))
+	}
+	if m.state == mpDone {
+		// The epilogue is ignored.
+		return nil
+	}
+	m.buf = append(m.buf, chunk...)
+	for {
+		progressed, err := m.step()
+		if err != nil {
+			return m.fail(err)
+		}
+		if !progressed {
+			break
+		}
+	}
+	m.buf = bytes.Clone(m.buf)
+	return nil
+}
+
+// Close reports an error if the body ended before its closing boundary.
+func (m *MultipartParser) Close() error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.state != mpDone {
+		return m.fail(oops.
+			In("extproc").
+			Code(errcode.InvalidMultipart).
+			Errorf("body ended before the closing boundary"))
+	}
+	return nil
+}
+
+// Parts returns the number of parts started so far.
+func (m *MultipartParser) Parts() int {
+	return m.parts
+}
+
+func (m *MultipartParser) fail(err error) error {
+	m.err = err
+	m.buf = nil
+	return err
+}
+
+// step consumes what it can from buf and reports whether it made progress.
+func (m *MultipartParser) step() (bool, error) {
+	switch m.state {
+	case mpPreamble:
+		return m.skipPreamble(), nil
+	case mpAfterBoundary:
+		return m.afterBoundary()
+	case mpHeaders:
+		return m.readHeaders()
+	case mpData:
+		return m.readData()
+	default:
+		m.buf = m.buf[:0]
+		return false, nil
+	}
+}
+
+// skipPreamble looks for the first delimiter. The buffer starts with a line
+// break so that a boundary at the very start of the body matches as well.
+func (m *MultipartParser) skipPreamble() bool {
+	if i := bytes.Index(m.buf, m.delimiter); i >= 0 {
+		m.buf = m.buf[i+len(m.delimiter):]
+		m.state = mpAfterBoundary
+		return true
+	}
+	// Keep what may be the start of a delimiter.
+	if keep := len(m.delimiter) - 1; len(m.buf) > keep {
+		m.buf = m.buf[len(m.buf)-keep:]
+	}
+	return false
+}
+
+// afterBoundary handles what follows a boundary: "--" closes the body,
+// otherwise optional whitespace and a line break start the next part.
+func (m *MultipartParser) afterBoundary() (bool, error) {
+	if len(m.buf) < 2 {
+		return false, nil
+	}
+	if m.buf[0] == '-' && m.buf[1] == '-' {
+		m.buf = m.buf[:0]
+		m.state = mpDone
+		return false, nil
+	}
+	i := bytes.IndexByte(m.buf, '\n')
+	if i < 0 {
+		if len(m.buf) > m.limits.MaxHeaderBytes {
+			return false, invalidMultipart("boundary line too long")
+		}
+		return false, nil
+	}
+	if len(bytes.TrimRight(m.buf[:i], " \t\r")) > 0 {
+		return false, invalidMultipart("unexpected data after boundary")
+	}
+	m.buf = m.buf[i+1:]
+	m.state = mpHeaders
+	return true, nil
+}
+
+// readHeaders parses the headers of a part once they are complete.
+func (m *MultipartParser) readHeaders() (bool, error) {
+	var end int
+	switch {
+	case bytes.HasPrefix(m.buf, []byte("\r\n")):
+		end = 2
+	default:
+		i := bytes.Index(m.buf, []byte("\r\n\r\n"))
+		if i < 0 {
+			if len(m.buf) > m.limits.MaxHeaderBytes {
+				return false, limitExceeded("header_bytes", int64(m.limits.MaxHeaderBytes))
+			}
+			return false, nil
+		}
+		end = i + 4
+	}
+	if end > m.limits.MaxHeaderBytes {
+		return false, limitExceeded("header_bytes", int64(m.limits.MaxHeaderBytes))
+	}
+	if m.limits.MaxParts > 0 && m.parts >= m.limits.MaxParts {
+		return false, limitExceeded("parts", int64(m.limits.MaxParts))
+	}
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(m.buf[:end]))).ReadMIMEHeader()
+	if err != nil {
+		return false, oops.In("extproc").Code(errcode.InvalidMultipart).Wrapf(err, "invalid part headers")
+	}
+	m.buf = m.buf[end:]
+
+	part := &MultipartPart{Index: m.parts, Header: header}
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.FormName = params["name"]
+		part.RawFileName = params["filename"]
+		part.FileName = SanitizeFilename(part.RawFileName)
+	}
+	m.parts++
+	m.part = part
+	m.state = mpData
+	if cb := m.callbacks.OnPartStart; cb != nil {
+		if err := cb(part); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// readData passes on the part's content up to the next delimiter, holding
+// back what may be the start of one.
+func (m *MultipartParser) readData() (bool, error) {
+	i := bytes.Index(m.buf, m.delimiter)
+	n := i
+	if i < 0 {
+		n = max(len(m.buf)-(len(m.delimiter)-1), 0)
+	}
+	if n > 0 {
+		if err := m.data(m.buf[:n]); err != nil {
+			return false, err
+		}
+	}
+	if i < 0 {
+		m.buf = m.buf[n:]
+		return false, nil
+	}
+	m.buf = m.buf[i+len(m.delimiter):]
+	part := m.part
+	m.part = nil
+	m.state = mpAfterBoundary
+	if cb := m.callbacks.OnPartEnd; cb != nil {
+		if err := cb(part); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (m *MultipartParser) data(data []byte) error {
+	m.part.Size += int64(len(data))
+	if m.limits.MaxPartBytes > 0 && m.part.Size > m.limits.MaxPartBytes {
+		return limitExceeded("part_bytes", m.limits.MaxPartBytes)
+	}
+	if cb := m.callbacks.OnPartData; cb != nil {
+		return cb(m.part, data)
+	}
+	return nil
+}
+
+// windowsReserved are device names Windows refuses as file names, with any
+// extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFilename makes a client-supplied file name safe to store: it
+// keeps only the last path element (of / or \ separated paths), drops
+// invalid UTF-8, control and shell or Windows special characters, trims
+// leading dots and surrounding spaces, prefixes Windows device names with
+// "_" and truncates to 255 bytes keeping the extension. It returns "" if
+// nothing usable is left.
+func SanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return ""
+	}
+	if device, _, _ := strings.Cut(name, "."); windowsReserved[strings.ToUpper(strings.TrimSpace(device))] {
+		name = "_" + name
+	}
+	const maxLen = 255
+	if len(name) > maxLen {
+		ext := path.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		stem := strings.TrimSuffix(name, ext)[:maxLen-len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = stem + ext
+	}
+	return name
+}
+
+func invalidMultipart(reason string) error {
+	return oops.In("extproc").Code(errcode.InvalidMultipart).Errorf("%s", reason)
+}
+
+func limitExceeded(limit string, max int64) error {
+	return oops.
+		In("extproc").
+		Code(errcode.LimitExceeded).
+		With("limit", limit).
+		With("max", max).
+		Errorf("multipart body exceeds the %s limit of %d", limit, max)
+}
@@ -0,0 +1,154 @@
+package extproc
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+)
+
+// collectedPart is what the callbacks saw of a part.
+type collectedPart struct {
+	name, file, raw string
+	data            string
+	size            int64
+	ended           bool
+}
+
+// collect parses body fed in chunks of size n and returns the parts seen.
+func collect(t *testing.T, contentType string, body []byte, n int, limits MultipartLimits) ([]*collectedPart, error) {
+	t.Helper()
+	var parts []*collectedPart
+	var data bytes.Buffer
+	p, err := NewMultipartParser(contentType, limits, MultipartCallbacks{
+		OnPartStart: func(part *MultipartPart) error {
+			parts = append(parts, &collectedPart{name: part.FormName, file: part.FileName, raw: part.RawFileName})
+			data.Reset()
+			return nil
+		},
+		OnPartData: func(_ *MultipartPart, b []byte) error {
+			data.Write(b)
+			return nil
+		},
+		OnPartEnd: func(part *MultipartPart) error {
+			last := parts[len(parts)-1]
+			last.data, last.size, last.ended = data.String(), part.Size, true
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(body) > 0 {
+		chunk := body[:min(n, len(body))]
+		body = body[len(chunk):]
+		if err := p.Write(chunk); err != nil {
+			return parts, err
+		}
+	}
+	return parts, p.Close()
+}
+
+func testMultipartBody(t *testing.T) (string, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString("preamble\r\n")
+	w := multipart.NewWriter(&buf)
+	if err := w.WriteField("title", "quarterly report"); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := w.CreateFormFile("upload", `..\..\reports/Q3 "final".pdf`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Content that resembles, but is not, a delimiter.
+	fmt.Fprintf(fw, "%%PDF\r\n--%s-not\r\n-", w.Boundary()[:10])
+	if err := w.WriteField("empty", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("epilogue")
+	return w.FormDataContentType(), buf.Bytes()
+}
+
+func TestMultipartParser(t *testing.T) {
+	contentType, body := testMultipartBody(t)
+	want := []collectedPart{
+		{name: "title", data: "quarterly report", size: 16, ended: true},
+		{name: "upload", file: "Q3 final.pdf", raw: `..\..\reports/Q3 "final".pdf`, ended: true},
+		{name: "empty", ended: true},
+	}
+	want[1].data = fmt.Sprintf("%%PDF\r\n--%s-not\r\n-", strings.TrimPrefix(contentType, "multipart/form-data; boundary=")[:10])
+	want[1].size = int64(len(want[1].data))
+	for n := 1; n <= len(body); n++ {
+		parts, err := collect(t, contentType, body, n, MultipartLimits{})
+		if err != nil {
+			t.Fatalf("chunk size %d: %v", n, err)
+		}
+		if len(parts) != len(want) {
+			t.Fatalf("chunk size %d: %d parts, want %d", n, len(parts), len(want))
+		}
+		for i, p := range parts {
+			if *p != want[i] {
+				t.Fatalf("chunk size %d: part %d = %+v, want %+v", n, i, *p, want[i])
+			}
+		}
+	}
+}
+
+func TestMultipartParserErrors(t *testing.T) {
+	contentType, body := testMultipartBody(t)
+	tests := []struct {
+		name   string
+		body   []byte
+		limits MultipartLimits
+		code   errcode.Code
+	}{
+		{name: "truncated", body: body[:len(body)/2], code: errcode.InvalidMultipart},
+		{name: "no boundary", body: []byte("just text"), code: errcode.InvalidMultipart},
+		{name: "parts", body: body, limits: MultipartLimits{MaxParts: 2}, code: errcode.LimitExceeded},
+		{name: "part size", body: body, limits: MultipartLimits{MaxPartBytes: 16}, code: errcode.LimitExceeded},
+		{name: "total size", body: body, limits: MultipartLimits{MaxTotalBytes: int64(len(body) - 1)}, code: errcode.LimitExceeded},
+		{name: "header size", body: body, limits: MultipartLimits{MaxHeaderBytes: 32}, code: errcode.LimitExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, n := range []int{1, 7, len(tt.body)} {
+				if _, err := collect(t, contentType, tt.body, n, tt.limits); !errcode.Is(err, tt.code) {
+					t.Fatalf("chunk size %d: error %v, want %s", n, err, tt.code)
+				}
+			}
+		})
+	}
+	if _, err := NewMultipartParser("application/json", MultipartLimits{}, MultipartCallbacks{}); !errcode.Is(err, errcode.InvalidMultipart) {
+		t.Errorf("NewMultipartParser(application/json) error = %v", err)
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	for in, want := range map[string]string{
+		"report.pdf":                      "report.pdf",
+		"../../etc/passwd":                "passwd",
+		`C:\Users\me\photo.jpg`:           "photo.jpg",
+		"..hidden":                        "hidden",
+		"name. ":                          "name",
+		"a\x00b\nc<d>e|f?.txt":            "abcdef.txt",
+		"CON":                             "_CON",
+		"com1.tar.gz":                     "_com1.tar.gz",
+		"console.log":                     "console.log",
+		"résumé.docx":                     "résumé.docx",
+		"bad\xffutf8.txt":                 "badutf8.txt",
+		"/":                               "",
+		"..":                              "",
+		strings.Repeat("é", 200) + ".png": strings.Repeat("é", 125) + ".png",
+	} {
+		if got := SanitizeFilename(in); got != want {
+			t.Errorf("SanitizeFilename(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package extproc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataAuthority is the gRPC pseudo-header carrying the :authority Envoy
+// dialed, which Envoy Gateway derives from the policy backend reference.
+const MetadataAuthority = ":authority"
+
+// StreamInfo describes an incoming ext_proc stream before any message is read.
+type StreamInfo struct {
+	// Metadata is the initial gRPC metadata sent by Envoy, including
+	// :authority and any initial_metadata configured on the grpc_service.
+	Metadata metadata.MD
+}
+
+// StreamInfoFromContext extracts StreamInfo from a gRPC stream context.
+func StreamInfoFromContext(ctx context.Context) StreamInfo {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return StreamInfo{Metadata: md}
+}
+
+// Get returns the first metadata value for key, or "" if absent.
+func (i StreamInfo) Get(key string) string {
+	if values := i.Metadata.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// StreamProcessorFactory is implemented by factories that choose a Processor
+// based on the stream's initial metadata. The Server prefers it over
+// NewProcessor when available.
+type StreamProcessorFactory interface {
+	ProcessorFactory
+	NewStreamProcessor(info StreamInfo) Processor
+}
+
+// Mux dispatches streams to different ProcessorFactory instances keyed by a
+// metadata value, so one listener can serve several policies.
+type Mux struct {
+	key      string
+	fallback ProcessorFactory
+
+	mu     sync.RWMutex
+	routes map[string]ProcessorFactory
+}
+
+// NewMux creates a Mux selecting on the given metadata key (":authority" if
+// empty). Streams without a matching route use fallback, which is required.
+func NewMux(key string, fallback ProcessorFactory) (*Mux, error) {
+	if fallback == nil {
+		return nil, oops.In("extproc").Code(errcode.InvalidConfig).With("key", key).Errorf("mux needs a fallback processor factory")
+	}
+	if key == "" {
+		key = MetadataAuthority
+	}
+	return &Mux{
+		key:      strings.ToLower(key),
+		fallback: fallback,
+		routes:   make(map[string]ProcessorFactory),
+	}, nil
+}
+
+// Handle registers factory for streams whose metadata value equals value.
+// Registering an existing value replaces the previous factory.
+func (m *Mux) Handle(value string, factory ProcessorFactory) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes[strings.ToLower(value)] = factory
+}
+
+// Route returns the factory registered for exactly value.
+func (m *Mux) Route(value string) (ProcessorFactory, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	factory, ok := m.routes[strings.ToLower(value)]
+	return factory, ok
+}
+
+// Remove unregisters the factory for value.
+func (m *Mux) Remove(value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.routes, strings.ToLower(value))
+}
+
+// Routes returns the currently registered route values.
+func (m *Mux) Routes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	routes := make([]string, 0, len(m.routes))
+	for route := range m.routes {
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// NewProcessor creates a Processor from the fallback factory.
+func (m *Mux) NewProcessor() Processor {
+	return m.fallback.NewProcessor()
+}
+
+// NewStreamProcessor selects a factory by the stream's metadata value. For
+// :authority, a value with a port also matches a route registered without it.
+// Stream-aware factories receive info as well.
+func (m *Mux) NewStreamProcessor(info StreamInfo) Processor {
+	factory := m.lookup(info.Get(m.key))
+	if sf, ok := factory.(StreamProcessorFactory); ok {
+		return sf.NewStreamProcessor(info)
+	}
+	return factory.NewProcessor()
+}
+
+func (m *Mux) lookup(value string) ProcessorFactory {
+	value = strings.ToLower(value)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if factory, ok := m.routes[value]; ok {
+		return factory
+	}
+	if m.key != MetadataAuthority {
+		return m.fallback
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if factory, ok := m.routes[host]; ok {
+			return factory
+		}
+	}
+	return m.fallback
+}
+
+// Ensure Mux implements StreamProcessorFactory.
+var _ StreamProcessorFactory = (*Mux)(nil)
@@ -0,0 +1,104 @@
+package extproc
+
+import (
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"google.golang.org/grpc/metadata"
+)
+
+// routedProcessor is a Processor telling which factory created it.
+type routedProcessor struct {
+	BaseProcessor
+	name string
+}
+
+type routeFactory string
+
+func (f routeFactory) NewProcessor() Processor { return &routedProcessor{name: string(f)} }
+
+// streamFactory records the StreamInfo it was handed.
+type streamFactory struct {
+	routeFactory
+	info *StreamInfo
+}
+
+func (f streamFactory) NewStreamProcessor(info StreamInfo) Processor {
+	*f.info = info
+	return f.NewProcessor()
+}
+
+func routed(m *Mux, pairs ...string) string {
+	return m.NewStreamProcessor(StreamInfo{Metadata: metadata.Pairs(pairs...)}).(*routedProcessor).name
+}
+
+func TestNewMuxNeedsFallback(t *testing.T) {
+	if _, err := NewMux("", nil); !errcode.Is(err, errcode.InvalidConfig) {
+		t.Errorf("err = %v, want %s", err, errcode.InvalidConfig)
+	}
+}
+
+func TestMuxRouting(t *testing.T) {
+	m, err := NewMux("", routeFactory("fallback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Handle("api.example.com", routeFactory("api"))
+	m.Handle("API.example.com:8443", routeFactory("api-8443"))
+	m.Handle("[2001:db8::1]", routeFactory("v6"))
+
+	for _, tt := range []struct{ authority, want string }{
+		{"api.example.com", "api"},
+		{"Api.Example.COM", "api"},
+		{"api.example.com:443", "api"},
+		{"api.example.com:8443", "api-8443"},
+		{"[2001:db8::1]:443", "v6"},
+		{"www.example.com", "fallback"},
+		{"api.example.com.evil", "fallback"},
+		{"", "fallback"},
+	} {
+		if got := routed(m, MetadataAuthority, tt.authority); got != tt.want {
+			t.Errorf("%q routed to %s, want %s", tt.authority, got, tt.want)
+		}
+	}
+	if got := m.NewProcessor().(*routedProcessor).name; got != "fallback" {
+		t.Errorf("NewProcessor used %s, want the fallback", got)
+	}
+
+	m.Remove("API.EXAMPLE.COM")
+	if got := routed(m, MetadataAuthority, "api.example.com"); got != "fallback" {
+		t.Errorf("removed route still served by %s", got)
+	}
+	if _, ok := m.Route("api.example.com"); ok {
+		t.Error("Route found a removed route")
+	}
+	if got, ok := m.Route("api.example.com:8443"); !ok || got != routeFactory("api-8443") {
+		t.Errorf("Route = %v, %v", got, ok)
+	}
+	if got := len(m.Routes()); got != 2 {
+		t.Errorf("%d routes left, want 2", got)
+	}
+}
+
+func TestMuxCustomKey(t *testing.T) {
+	var info StreamInfo
+	m, err := NewMux("X-Route", routeFactory("fallback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Handle("Billing", streamFactory{routeFactory("billing"), &info})
+
+	// Only the authority has its port stripped.
+	for _, tt := range []struct{ value, want string }{
+		{"billing", "billing"},
+		{"BILLING", "billing"},
+		{"billing:80", "fallback"},
+	} {
+		if got := routed(m, "x-route", tt.value, MetadataAuthority, "billing"); got != tt.want {
+			t.Errorf("%q routed to %s, want %s", tt.value, got, tt.want)
+		}
+	}
+	if got := info.Get("x-route"); got != "BILLING" {
+		t.Errorf("stream factory got x-route %q", got)
+	}
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/samber/oops"
+)
+
+// KeyFunc extracts the client key a request is counted under, reporting
+// false when the request has none and is not limited.
+type KeyFunc func(ctx *extproc.RequestContext) (string, bool)
+
+// ClientIP keys requests by the downstream client address.
+func ClientIP(ctx *extproc.RequestContext) (string, bool) {
+	ip, err := ctx.GetDownstreamRemoteIP()
+	if err != nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// Header keys requests by the value of the named header, e.g. an API key
+// or a tenant set by an earlier authenticator.
+func Header(name string) KeyFunc {
+	return func(ctx *extproc.RequestContext) (string, bool) {
+		v := ctx.Headers.Get(name)
+		return v, v != ""
+	}
+}
+
+// ParseKey parses a key written as "ip" or "header:<name>".
+func ParseKey(s string) (KeyFunc, error) {
+	if s == "ip" {
+		return ClientIP, nil
+	}
+	if name, ok := strings.CutPrefix(s, "header:"); ok && strings.TrimSpace(name) != "" {
+		return Header(strings.TrimSpace(name)), nil
+	}
+	return nil, oops.
+		In("ratelimit").
+		Code(errcode.InvalidConfig).
+		With("key", s).
+		Errorf("invalid rate limit key %q, want 'ip' or 'header:<name>'", s)
+}
@@ -0,0 +1,205 @@
+// Package ratelimit provides an ext_proc processor that limits requests per
+// client with token buckets, answering requests over the limit with 429 and
+// Retry-After.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/match"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/mnixry/envoy-ext-procs/internal/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// defaultRule is the name buckets of the default limit are kept under.
+const defaultRule = "default"
+
+var (
+	checksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_checks_total",
+		Help: "Rate limit checks, by result (allowed, limited or error).",
+	}, []string{"result"})
+	checkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ratelimit_check_duration_seconds",
+		Help:    "Rate limit check latency, including the shared store, by result.",
+		Buckets: []float64{.00005, .0001, .0005, .001, .005, .01, .05, .1, .5},
+	}, []string{"result"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(checksTotal, checkDuration)
+}
+
+// Config holds rate limiting settings.
+type Config struct {
+	// DefaultLimit applies to requests matching no rule; a zero Requests
+	// lets them through.
+	DefaultLimit ratelimit.Limit
+	// DefaultKey keys the default limit and rules without their own key;
+	// nil keys by client IP.
+	DefaultKey KeyFunc
+	// CacheSize is the number of buckets kept by the in-memory limiter.
+	CacheSize int
+	// FailClosed rejects requests with 503 when the limiter fails, e.g.
+	// its shared store is unreachable; otherwise they are let through.
+	FailClosed bool
+	// ResponseHeaders adds x-ratelimit-limit/remaining/reset to responses
+	// of limited requests.
+	ResponseHeaders bool
+	// DecisionMode selects whether requests over the limit are rejected.
+	DecisionMode extproc.DecisionMode
+}
+
+// ProcessorFactory creates rate limiting processors.
+type ProcessorFactory struct {
+	cfg     Config
+	rules   atomic.Pointer[Rules]
+	limiter ratelimit.Limiter
+	log     zerolog.Logger
+	decider extproc.Decider
+}
+
+// Option configures a ProcessorFactory.
+type Option func(*ProcessorFactory)
+
+// WithLimiter replaces the in-memory limiter, e.g. with a shared store.
+func WithLimiter(l ratelimit.Limiter) Option {
+	return func(f *ProcessorFactory) {
+		f.limiter = l
+	}
+}
+
+// NewProcessorFactory creates a new rate limiting ProcessorFactory; rules
+// may be nil.
+func NewProcessorFactory(cfg Config, rules *Rules, log zerolog.Logger, opts ...Option) (*ProcessorFactory, error) {
+	if cfg.DefaultKey == nil {
+		cfg.DefaultKey = ClientIP
+	}
+	f := &ProcessorFactory{
+		cfg: cfg,
+		log: log.With().Str("processor", "ratelimit").Logger(),
+	}
+	f.decider = extproc.NewDecider("ratelimit", cfg.DecisionMode, f.log)
+	f.rules.Store(rules)
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.limiter == nil {
+		limiter, err := ratelimit.NewMemoryLimiter(cfg.CacheSize)
+		if err != nil {
+			return nil, oops.In("ratelimit").Wrapf(err, "failed to create rate limiter")
+		}
+		f.limiter = limiter
+	}
+	return f, nil
+}
+
+// SetRules replaces the rules used by new requests.
+func (f *ProcessorFactory) SetRules(rules *Rules) {
+	f.rules.Store(rules)
+}
+
+// NewProcessor creates a new rate limiting processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor limits a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	decision *ratelimit.Decision
+}
+
+// ProcessRequestHeaders takes a token from the client's bucket of the
+// matching rule and rejects the request when none is left. Limiter failures
+// let the request through unless the factory fails closed.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	name, limit, keyFunc := defaultRule, f.cfg.DefaultLimit, f.cfg.DefaultKey
+	ip, _ := ctx.GetDownstreamRemoteIP()
+	if rule, ok := f.rules.Load().Find(match.NewRequest(ctx.Headers, ip)); ok {
+		name, limit = rule.Name, rule.limit
+		if rule.key != nil {
+			keyFunc = rule.key
+		}
+	}
+	if limit.Requests == 0 {
+		return extproc.ContinueResult()
+	}
+	key, ok := keyFunc(ctx)
+	if !ok {
+		f.log.Debug().Str("rule", name).Str("request_id", ctx.GetRequestID()).Msg("request has no rate limit key, not limiting")
+		return extproc.ContinueResult()
+	}
+
+	start := time.Now()
+	decision, err := f.limiter.Allow(context.Background(), name+"|"+key, limit, 1)
+	result := "allowed"
+	switch {
+	case err != nil:
+		result = "error"
+	case !decision.Allowed:
+		result = "limited"
+	}
+	checkDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	checksTotal.WithLabelValues(result).Inc()
+	if err != nil {
+		if !f.cfg.FailClosed {
+			f.log.Warn().Err(err).Str("rule", name).Str("request_id", ctx.GetRequestID()).Msg("rate limit check failed, allowing")
+			return extproc.ContinueResult()
+		}
+		f.log.Error().Err(err).Str("rule", name).Str("request_id", ctx.GetRequestID()).Msg("rate limit check failed, rejecting")
+		return f.decider.Reject(ctx.GetRequestID(), "limiter_unavailable",
+			extproc.ImmediateResult(http.StatusServiceUnavailable,
+				[]*envoy_api_v3_core.HeaderValueOption{extproc.SetHeader("retry-after", "1")},
+				[]byte("rate limiter unavailable\n")), nil)
+	}
+	p.decision = &decision
+	if decision.Allowed {
+		return extproc.ContinueResult()
+	}
+
+	f.log.Info().
+		Str("rule", name).
+		Str("key", key).
+		Dur("retry_after", decision.RetryAfter).
+		Str("request_id", ctx.GetRequestID()).
+		Msg("rate limit exceeded")
+	headers := []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("retry-after", strconv.FormatInt(int64(max(1, math.Ceil(decision.RetryAfter.Seconds()))), 10)),
+	}
+	if f.cfg.ResponseHeaders {
+		headers = append(headers, rateLimitHeaders(decision)...)
+	}
+	return f.decider.Reject(ctx.GetRequestID(), "rate_limited",
+		extproc.ImmediateResult(http.StatusTooManyRequests, headers, []byte("rate limit exceeded\n")), nil)
+}
+
+// ProcessResponseHeaders adds the rate limit headers of the request's
+// bucket.
+func (p *Processor) ProcessResponseHeaders(*extproc.RequestContext) *extproc.ProcessingResult {
+	if p.decision == nil || !p.factory.cfg.ResponseHeaders {
+		return extproc.ContinueResult()
+	}
+	return extproc.ContinueWithHeaders(rateLimitHeaders(*p.decision))
+}
+
+func rateLimitHeaders(d ratelimit.Decision) []*envoy_api_v3_core.HeaderValueOption {
+	var opts []*envoy_api_v3_core.HeaderValueOption
+	for _, h := range ratelimit.RateLimitHeaders(d) {
+		opts = append(opts, extproc.SetHeader(h.Key, h.Value))
+	}
+	return opts
+}
@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/ratelimit"
+	"github.com/rs/zerolog"
+)
+
+const testRules = `
+rules:
+  - name: login
+    match: {paths: [/login], methods: [POST]}
+    limit: 1/minute
+  - name: api
+    match: {paths: [/api/]}
+    limit: 2/minute
+    key: header:x-api-key
+`
+
+func newFactory(t *testing.T, clk clock.Clock) *ProcessorFactory {
+	t.Helper()
+	rules, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := ratelimit.NewMemoryLimiter(16, ratelimit.WithClock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory, err := NewProcessorFactory(Config{
+		DefaultLimit:    ratelimit.Limit{Requests: 3, Per: time.Minute},
+		ResponseHeaders: true,
+	}, rules, zerolog.Nop(), WithLimiter(limiter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return factory
+}
+
+func request(factory *ProcessorFactory, ip string, headers ...string) *extproc.ProcessingResult {
+	ctx := extproctest.NewContext(map[string]string{"source.address": ip + ":4711"}, headers...)
+	return factory.NewProcessor().ProcessRequestHeaders(ctx)
+}
+
+func TestProcessRequestHeaders(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	factory := newFactory(t, clk)
+	login := []string{":method", "POST", ":path", "/login"}
+
+	extproctest.Check(t, request(factory, "203.0.113.7", login...), extproctest.ExpectContinue())
+	extproctest.Check(t, request(factory, "203.0.113.7", login...),
+		extproctest.ExpectDenied(429),
+		extproctest.ExpectHeaderSet("retry-after", "60"),
+		extproctest.ExpectHeaderSet("x-ratelimit-limit", "1"),
+		extproctest.ExpectHeaderSet("x-ratelimit-remaining", "0"),
+	)
+	// Buckets are per client and per rule.
+	extproctest.Check(t, request(factory, "203.0.113.8", login...), extproctest.ExpectContinue())
+	extproctest.Check(t, request(factory, "203.0.113.7", ":method", "GET", ":path", "/"), extproctest.ExpectContinue())
+
+	clk.Advance(time.Minute)
+	extproctest.Check(t, request(factory, "203.0.113.7", login...), extproctest.ExpectContinue())
+}
+
+func TestHeaderKey(t *testing.T) {
+	factory := newFactory(t, clock.NewFake(time.Unix(1700000000, 0)))
+	api := func(ip, key string) *extproc.ProcessingResult {
+		return request(factory, ip, ":method", "GET", ":path", "/api/items", "x-api-key", key)
+	}
+
+	extproctest.Check(t, api("203.0.113.7", "alpha"), extproctest.ExpectContinue())
+	extproctest.Check(t, api("203.0.113.8", "alpha"), extproctest.ExpectContinue())
+	extproctest.Check(t, api("203.0.113.9", "alpha"), extproctest.ExpectDenied(429))
+	extproctest.Check(t, api("203.0.113.7", "beta"), extproctest.ExpectContinue())
+	// Requests without the key are not limited by the rule.
+	for range 5 {
+		extproctest.Check(t, request(factory, "203.0.113.7", ":method", "GET", ":path", "/api/items"), extproctest.ExpectContinue())
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	factory := newFactory(t, clock.NewFake(time.Unix(1700000000, 0)))
+	p := factory.NewProcessor()
+	ctx := extproctest.NewContext(map[string]string{"source.address": "203.0.113.7:4711"}, ":method", "GET", ":path", "/")
+	extproctest.Check(t, p.ProcessRequestHeaders(ctx), extproctest.ExpectContinue())
+	extproctest.Check(t, p.ProcessResponseHeaders(extproctest.NewContext(nil, ":status", "200")),
+		extproctest.ExpectHeaderSet("x-ratelimit-limit", "3"),
+		extproctest.ExpectHeaderSet("x-ratelimit-remaining", "2"),
+		extproctest.ExpectHeaderSet("x-ratelimit-reset", "20"),
+	)
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(context.Context, string, ratelimit.Limit, uint32) (ratelimit.Decision, error) {
+	return ratelimit.Decision{}, errors.New("store unreachable")
+}
+
+func TestFailurePolicy(t *testing.T) {
+	for _, failClosed := range []bool{false, true} {
+		factory, err := NewProcessorFactory(Config{
+			DefaultLimit: ratelimit.Limit{Requests: 3, Per: time.Minute},
+			FailClosed:   failClosed,
+		}, nil, zerolog.Nop(), WithLimiter(failingLimiter{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := request(factory, "203.0.113.7", ":method", "GET", ":path", "/")
+		if failClosed {
+			extproctest.Check(t, result, extproctest.ExpectDenied(503), extproctest.ExpectHeaderSet("retry-after", "1"))
+		} else {
+			extproctest.Check(t, result, extproctest.ExpectContinue())
+		}
+	}
+}
+
+func TestParseRulesRejectsInvalid(t *testing.T) {
+	for _, rules := range []string{
+		"rules: [{limit: 1/minute}]",
+		"rules: [{name: a, limit: 1/minute}, {name: a, limit: 2/minute}]",
+		"rules: [{name: a, limit: often}]",
+		"rules: [{name: a, limit: 1/minute, key: cookie}]",
+		"rules: [{name: a, limit: 1/minute, match: {ips: [nope]}}]",
+	} {
+		if _, err := ParseRules([]byte(rules)); err == nil {
+			t.Errorf("ParseRules(%q) succeeded", rules)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/match"
+	"github.com/mnixry/envoy-ext-procs/internal/ratelimit"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+)
+
+// Rules is the rate limit rules file.
+type Rules struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule limits the requests it matches, per client key. The first matching
+// rule applies.
+type Rule struct {
+	// Name identifies the rule's buckets, logs and metrics.
+	Name string `yaml:"name"`
+	// Match selects the requests (see package match); empty matches all.
+	Match *match.Spec `yaml:"match,omitempty"`
+	// Limit is written as "requests/unit", e.g. "100/minute".
+	Limit string `yaml:"limit"`
+	// Key is "ip" or "header:<name>"; empty uses the default key.
+	Key string `yaml:"key,omitempty"`
+
+	limit   ratelimit.Limit
+	key     KeyFunc
+	matcher *match.Matcher
+}
+
+// LoadRules reads and validates a YAML rules file or ConfigMap/Secret
+// reference (see kube.ParseRef).
+func LoadRules(path string) (*Rules, error) {
+	data, err := kube.ReadFile(context.Background(), path)
+	if err != nil {
+		return nil, oops.
+			In("ratelimit").
+			Code(errcode.ReadRulesFailed).
+			With("path", path).
+			Wrapf(err, "failed to read rate limit rules")
+	}
+	return ParseRules(data)
+}
+
+// ParseRules parses and validates YAML rules.
+func ParseRules(data []byte) (*Rules, error) {
+	var rules Rules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, oops.
+			In("ratelimit").
+			Code(errcode.ParseRulesFailed).
+			Wrapf(err, "failed to parse rate limit rules")
+	}
+	names := make(map[string]bool, len(rules.Rules))
+	for i := range rules.Rules {
+		r := &rules.Rules[i]
+		if r.Name == "" || names[r.Name] {
+			return nil, oops.
+				In("ratelimit").
+				Code(errcode.InvalidRules).
+				With("index", i).
+				With("name", r.Name).
+				Errorf("rule needs a unique name")
+		}
+		names[r.Name] = true
+		limit, err := ratelimit.ParseLimit(r.Limit)
+		if err != nil {
+			return nil, oops.In("ratelimit").Code(errcode.InvalidRules).With("name", r.Name).Wrap(err)
+		}
+		r.limit = limit
+		if r.Key != "" {
+			if r.key, err = ParseKey(r.Key); err != nil {
+				return nil, oops.In("ratelimit").Code(errcode.InvalidRules).With("name", r.Name).Wrap(err)
+			}
+		}
+		if r.Match != nil {
+			if r.matcher, err = match.Compile(*r.Match); err != nil {
+				return nil, oops.In("ratelimit").Code(errcode.InvalidRules).With("name", r.Name).Wrap(err)
+			}
+		}
+	}
+	return &rules, nil
+}
+
+// Find returns the first rule matching the request.
+func (r *Rules) Find(req match.Request) (*Rule, bool) {
+	if r == nil {
+		return nil, false
+	}
+	for i := range r.Rules {
+		if r.Rules[i].matcher.Match(req) {
+			return &r.Rules[i], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,344 @@
+// Package record provides an ext_proc processor that captures a sample of
+// complete request/response exchanges, with sensitive data redacted, for
+// debugging and building regression corpora.
+package record
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/featureflag"
+	"github.com/mnixry/envoy-ext-procs/internal/jsonredact"
+	"github.com/mnixry/envoy-ext-procs/internal/recording"
+	"github.com/mnixry/envoy-ext-procs/internal/spill"
+	"github.com/rs/zerolog"
+)
+
+const redactedValue = "REDACTED"
+
+// Config holds traffic recording settings.
+type Config struct {
+	// Routes are the path prefixes eligible for recording; empty matches all.
+	Routes []string
+	// SamplePercent of eligible exchanges are recorded, in the range 0-100.
+	SamplePercent float64
+	// MaxBodyBytes caps the bytes kept of each body.
+	MaxBodyBytes int
+	// SpillBytes is how much of each body is kept in memory until the
+	// exchange is written; the rest waits in a temporary file in SpillDir.
+	// Zero keeps whole bodies in memory.
+	SpillBytes int
+	SpillDir   string
+	// SpillBudget, if set, bounds the disk space used by all exchanges;
+	// bodies that do not fit are truncated.
+	SpillBudget *spill.Budget
+	// RedactHeaders have their values replaced.
+	RedactHeaders []string
+	// RedactQuery lists query parameters whose values are replaced.
+	RedactQuery []string
+	// RedactFields are JSON body paths masked in both directions.
+	RedactFields []jsonredact.Rule
+	// Flags, if set, are evaluated per eligible request: "record.enabled"
+	// turns recording off and "record.sample-percent" overrides
+	// SamplePercent.
+	Flags *featureflag.Client
+}
+
+// ProcessorFactory creates traffic recording processors.
+type ProcessorFactory struct {
+	cfg    Config
+	writer *recording.Writer
+	log    zerolog.Logger
+}
+
+// NewProcessorFactory creates a new traffic recording ProcessorFactory
+// writing captures to writer.
+func NewProcessorFactory(cfg Config, writer *recording.Writer, log zerolog.Logger) *ProcessorFactory {
+	return &ProcessorFactory{
+		cfg:    cfg,
+		writer: writer,
+		log:    log.With().Str("processor", "record").Logger(),
+	}
+}
+
+// NewProcessor creates a new traffic recording processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor records a single exchange.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	mu       sync.Mutex
+	exchange *recording.Exchange
+	written  bool
+	mem      *extproc.MemoryAccount
+	reserved int64
+	// Bodies are buffered here and moved to the exchange when it is
+	// written.
+	requestBody, responseBody *spill.Buffer
+}
+
+// ProcessRequestHeaders samples the request and, if recorded, asks Envoy to
+// send both bodies.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	path, _, _ := strings.Cut(ctx.Headers.Get(":path"), "?")
+	if !f.matches(path) {
+		return extproc.ContinueResult()
+	}
+	percent := f.cfg.SamplePercent
+	if flags := f.cfg.Flags; flags != nil {
+		ec := flags.Context(ctx.Headers)
+		if !flags.Bool(context.Background(), "record.enabled", true, ec) {
+			return extproc.ContinueResult()
+		}
+		percent = flags.Float(context.Background(), "record.sample-percent", percent, ec)
+	}
+	if percent <= 0 || rand.Float64()*100 >= percent {
+		return extproc.ContinueResult()
+	}
+
+	p.mu.Lock()
+	p.exchange = &recording.Exchange{
+		Started:        time.Now(),
+		RequestHeaders: ctx.Headers.Clone(),
+	}
+	p.mem = ctx.Memory
+	p.requestBody, p.responseBody = f.newBuffer(), f.newBuffer()
+	p.mu.Unlock()
+
+	// Bodies over Envoy's buffer limit arrive partially instead of failing
+	// the request.
+	result := extproc.ContinueResult()
+	result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+		RequestBodyMode:     envoy_extensions_ext_proc_v3.ProcessingMode_BUFFERED_PARTIAL,
+		ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+		ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_BUFFERED_PARTIAL,
+		RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+	}
+	return result
+}
+
+// ProcessRequestBody captures the request body.
+func (p *Processor) ProcessRequestBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exchange != nil {
+		p.exchange.RequestTruncated = p.capture(p.requestBody, body, endOfStream)
+	}
+	return extproc.ContinueResult()
+}
+
+// ProcessResponseHeaders captures the response headers.
+func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exchange != nil {
+		p.exchange.ResponseHeaders = ctx.Headers.Clone()
+		if ctx.EndOfStream {
+			p.flush()
+		}
+	}
+	return extproc.ContinueResult()
+}
+
+// ProcessResponseBody captures the response body and writes the exchange.
+func (p *Processor) ProcessResponseBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exchange != nil {
+		p.exchange.ResponseTruncated = p.capture(p.responseBody, body, endOfStream)
+		// A partial buffer is the only body message Envoy sends.
+		p.flush()
+	}
+	return extproc.ContinueResult()
+}
+
+// OnStreamEnd writes exchanges that ended without a complete response.
+func (p *Processor) OnStreamEnd() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exchange != nil {
+		p.flush()
+	}
+}
+
+// OnRequestEnd writes the exchange and resets the processor for the next
+// request on the stream.
+func (p *Processor) OnRequestEnd() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exchange != nil {
+		p.flush()
+	}
+	p.exchange, p.written = nil, false
+	p.requestBody, p.responseBody = nil, nil
+}
+
+// flush redacts and writes the exchange once. The caller holds p.mu.
+func (p *Processor) flush() {
+	if p.written {
+		return
+	}
+	p.written = true
+	f := p.factory
+	ex := p.exchange
+	ex.Duration = time.Since(ex.Started)
+	ex.RequestBody = p.body(p.requestBody, &ex.RequestTruncated)
+	ex.ResponseBody = p.body(p.responseBody, &ex.ResponseTruncated)
+	f.redact(ex)
+	if err := f.writer.Write(ex); err != nil {
+		f.log.Error().Err(err).Msg("failed to write captured exchange")
+	}
+	ex.RequestBody, ex.ResponseBody = nil, nil
+	p.mem.Release(p.reserved)
+	p.reserved = 0
+}
+
+// body reads back a buffered body and closes its buffer, marking the body
+// truncated if it cannot be read. The caller holds p.mu.
+func (p *Processor) body(buf *spill.Buffer, truncated *bool) []byte {
+	defer func() {
+		if err := buf.Close(); err != nil {
+			p.factory.log.Warn().Err(err).Msg("failed to close body buffer")
+		}
+	}()
+	data, err := buf.Bytes()
+	if err != nil {
+		p.factory.log.Warn().Err(err).Msg("failed to read buffered body")
+		*truncated = true
+		return nil
+	}
+	return data
+}
+
+// capture appends chunk to buf up to MaxBodyBytes, the memory budget and
+// the spill limits, reporting whether the body was cut short. Only bytes
+// held in memory count against the memory budget. The caller holds p.mu.
+func (p *Processor) capture(buf *spill.Buffer, chunk []byte, endOfStream bool) bool {
+	keep := min(len(chunk), max(p.factory.cfg.MaxBodyBytes-int(buf.Len()), 0))
+	if !buf.Spilled() {
+		if !p.mem.Reserve(int64(keep)) {
+			return true
+		}
+		p.reserved += int64(keep)
+	}
+	_, err := buf.Write(chunk[:keep])
+	if held := p.held(); held < p.reserved {
+		p.mem.Release(p.reserved - held)
+		p.reserved = held
+	}
+	if err != nil {
+		if !errors.Is(err, spill.ErrTooLarge) {
+			p.factory.log.Warn().Err(err).Msg("failed to buffer body")
+		}
+		return true
+	}
+	return keep < len(chunk) || !endOfStream
+}
+
+// held returns the body bytes held in memory. The caller holds p.mu.
+func (p *Processor) held() int64 {
+	var n int64
+	for _, buf := range []*spill.Buffer{p.requestBody, p.responseBody} {
+		if !buf.Spilled() {
+			n += buf.Len()
+		}
+	}
+	return n
+}
+
+// redact replaces sensitive header values, query parameters and JSON fields.
+func (f *ProcessorFactory) redact(ex *recording.Exchange) {
+	f.redactHeaders(ex.RequestHeaders)
+	f.redactHeaders(ex.ResponseHeaders)
+
+	if path := ex.RequestHeaders.Get(":path"); len(f.cfg.RedactQuery) > 0 && strings.Contains(path, "?") {
+		ex.RequestHeaders.Set(":path", f.redactQuery(path))
+	}
+
+	ex.RequestBody = f.redactBody(ex.RequestHeaders, ex.RequestBody)
+	ex.ResponseBody = f.redactBody(ex.ResponseHeaders, ex.ResponseBody)
+}
+
+func (f *ProcessorFactory) redactHeaders(h http.Header) {
+	for name := range h {
+		if slices.ContainsFunc(f.cfg.RedactHeaders, func(r string) bool { return strings.EqualFold(r, name) }) {
+			for i := range h[name] {
+				h[name][i] = redactedValue
+			}
+		}
+	}
+}
+
+// redactQuery rewrites matching parameter values in place, keeping the
+// order and encoding of the others.
+func (f *ProcessorFactory) redactQuery(path string) string {
+	prefix, query, _ := strings.Cut(path, "?")
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if slices.Contains(f.cfg.RedactQuery, name) {
+			params[i] = name + "=" + redactedValue
+		}
+	}
+	return prefix + "?" + strings.Join(params, "&")
+}
+
+// redactBody masks JSON fields. Truncated documents are redacted up to the
+// cut.
+func (f *ProcessorFactory) redactBody(h http.Header, body []byte) []byte {
+	if len(f.cfg.RedactFields) == 0 || len(body) == 0 || h == nil {
+		return body
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("content-type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return body
+	}
+	r := jsonredact.New(f.cfg.RedactFields, redactedValue)
+	return append(r.Write(body), r.Close()...)
+}
+
+func (f *ProcessorFactory) newBuffer() *spill.Buffer {
+	memory := f.cfg.SpillBytes
+	if memory <= 0 {
+		memory = f.cfg.MaxBodyBytes
+	}
+	return spill.New(spill.Config{
+		MemoryLimit: int64(memory),
+		Dir:         f.cfg.SpillDir,
+		Budget:      f.cfg.SpillBudget,
+	})
+}
+
+func (f *ProcessorFactory) matches(path string) bool {
+	if len(f.cfg.Routes) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(f.cfg.Routes, func(route string) bool { return strings.HasPrefix(path, route) })
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.StreamEndHandler.
+var _ extproc.StreamEndHandler = (*Processor)(nil)
+
+// Ensure Processor implements extproc.RequestEndHandler.
+var _ extproc.RequestEndHandler = (*Processor)(nil)
@@ -0,0 +1,167 @@
+package record
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/jsonredact"
+	"github.com/mnixry/envoy-ext-procs/internal/recording"
+	"github.com/mnixry/envoy-ext-procs/internal/spill"
+	"github.com/rs/zerolog"
+)
+
+type entry struct {
+	Request struct {
+		Method  string `json:"method"`
+		URL     string `json:"url"`
+		Headers []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"headers"`
+		PostData struct {
+			Text string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status  int `json:"status"`
+		Content struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	} `json:"response"`
+	Comment string `json:"comment"`
+}
+
+// newFactory returns a factory recording every exchange and a function
+// returning the exchanges written so far.
+func newFactory(t *testing.T, cfg Config) (*ProcessorFactory, func() []entry) {
+	t.Helper()
+	dir := t.TempDir()
+	writer, err := recording.NewWriter(recording.WriterConfig{Dir: dir, Format: recording.FormatHAR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SamplePercent = 100
+	return NewProcessorFactory(cfg, writer, zerolog.Nop()), func() []entry {
+		t.Helper()
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+		var entries []entry
+		for _, name := range files {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var har struct {
+				Log struct {
+					Entries []entry `json:"entries"`
+				} `json:"log"`
+			}
+			if err := json.Unmarshal(data, &har); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			entries = append(entries, har.Log.Entries...)
+		}
+		return entries
+	}
+}
+
+func TestRecordRedacts(t *testing.T) {
+	password, err := jsonredact.ParsePath("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, entries := newFactory(t, Config{
+		Routes:        []string{"/api/"},
+		MaxBodyBytes:  1024,
+		RedactHeaders: []string{"Authorization"},
+		RedactQuery:   []string{"token"},
+		RedactFields:  []jsonredact.Rule{{Path: password, Action: jsonredact.ActionMask}},
+	})
+	extproctest.Run(t, f,
+		extproctest.RequestHeaders(nil, ":method", "POST", ":path", "/api/login?token=s3cret&next=/",
+			":authority", "example.com", "authorization", "Bearer s3cret", "content-type", "application/json"),
+		extproctest.RequestBody(`{"user":"alice","password":"s3cret"}`, true),
+		extproctest.ResponseHeaders(":status", "200", "content-type", "text/plain"),
+		extproctest.ResponseBody("welcome", true),
+		// Outside the routes: not recorded.
+		extproctest.RequestHeaders(nil, ":method", "GET", ":path", "/health"),
+		extproctest.ResponseHeaders(":status", "200"),
+	)
+
+	got := entries()
+	if len(got) != 1 {
+		t.Fatalf("recorded %d exchanges, want 1", len(got))
+	}
+	e := got[0]
+	if want := "http://example.com/api/login?token=REDACTED&next=/"; e.Request.URL != want {
+		t.Errorf("url = %q, want %q", e.Request.URL, want)
+	}
+	for _, h := range e.Request.Headers {
+		if h.Name == "authorization" && h.Value != redactedValue {
+			t.Errorf("authorization = %q", h.Value)
+		}
+	}
+	if want := `{"user":"alice","password":"REDACTED"}`; e.Request.PostData.Text != want {
+		t.Errorf("request body = %q, want %q", e.Request.PostData.Text, want)
+	}
+	if e.Response.Status != 200 || e.Response.Content.Text != "welcome" || e.Comment != "" {
+		t.Errorf("response = %+v, comment %q", e.Response, e.Comment)
+	}
+}
+
+func TestRecordTruncates(t *testing.T) {
+	f, entries := newFactory(t, Config{MaxBodyBytes: 4})
+	extproctest.Run(t, f,
+		extproctest.RequestHeaders(nil, ":method", "GET", ":path", "/a"),
+		extproctest.ResponseHeaders(":status", "200"),
+		extproctest.ResponseBody("0123456789", true),
+		// A request that ends without a response is still written.
+		extproctest.RequestHeaders(nil, ":method", "GET", ":path", "/b"),
+	)
+
+	got := entries()
+	if len(got) != 2 {
+		t.Fatalf("recorded %d exchanges, want 2", len(got))
+	}
+	if got[0].Response.Content.Text != "0123" || got[0].Comment != "response body truncated" {
+		t.Errorf("first exchange: body %q, comment %q", got[0].Response.Content.Text, got[0].Comment)
+	}
+	if got[1].Comment != "no response" {
+		t.Errorf("second exchange comment = %q, want %q", got[1].Comment, "no response")
+	}
+}
+
+func TestRecordSpills(t *testing.T) {
+	budget := spill.NewBudget(16)
+	f, entries := newFactory(t, Config{MaxBodyBytes: 64, SpillBytes: 4, SpillDir: t.TempDir(), SpillBudget: budget})
+
+	p := f.NewProcessor().(*Processor)
+	p.ProcessRequestHeaders(extproctest.NewContext(nil, ":method", "POST", ":path", "/upload"))
+	p.ProcessRequestBody(nil, []byte("0123456789"), true)
+	if !p.requestBody.Spilled() || budget.Used() != 10 {
+		t.Fatalf("request body not spilled (disk used %d)", budget.Used())
+	}
+	p.ProcessResponseHeaders(extproctest.NewContext(nil, ":status", "200"))
+	// The response body does not fit the rest of the disk budget.
+	p.ProcessResponseBody(nil, []byte("abcdefghij"), true)
+	if budget.Used() != 0 {
+		t.Errorf("disk used %d after the exchange was written, want 0", budget.Used())
+	}
+	p.OnStreamEnd()
+
+	got := entries()
+	if len(got) != 1 {
+		t.Fatalf("recorded %d exchanges, want 1", len(got))
+	}
+	if got[0].Request.PostData.Text != "0123456789" {
+		t.Errorf("request body = %q", got[0].Request.PostData.Text)
+	}
+	if got[0].Response.Content.Text != "" || got[0].Comment != "response body truncated" {
+		t.Errorf("response body = %q, comment %q", got[0].Response.Content.Text, got[0].Comment)
+	}
+}
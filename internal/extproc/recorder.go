@@ -0,0 +1,183 @@
+package extproc
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const redactedValue = "REDACTED"
+
+// RecordedMessage is a single processed request/response pair.
+type RecordedMessage struct {
+	Time     time.Time
+	Duration time.Duration
+	Request  *envoy_service_proc_v3.ProcessingRequest
+	Response *envoy_service_proc_v3.ProcessingResponse
+}
+
+// MessageRecorder keeps a ring buffer of the last N processed messages so
+// operators can inspect live decisions without enabling trace logging.
+// Recorded messages are deep copies with sensitive headers redacted and,
+// unless configured otherwise, bodies stripped.
+type MessageRecorder struct {
+	redactHeaders []string
+	keepBodies    bool
+
+	mu      sync.Mutex
+	entries []RecordedMessage
+	next    int
+	full    bool
+}
+
+// NewMessageRecorder creates a recorder holding up to size messages.
+func NewMessageRecorder(size int, redactHeaders []string, keepBodies bool) *MessageRecorder {
+	return &MessageRecorder{
+		redactHeaders: redactHeaders,
+		keepBodies:    keepBodies,
+		entries:       make([]RecordedMessage, size),
+	}
+}
+
+// Record stores a redacted copy of the request/response pair.
+func (r *MessageRecorder) Record(
+	req *envoy_service_proc_v3.ProcessingRequest,
+	resp *envoy_service_proc_v3.ProcessingResponse,
+	duration time.Duration,
+) {
+	if len(r.entries) == 0 {
+		return
+	}
+	msg := RecordedMessage{
+		Time:     time.Now(),
+		Duration: duration,
+		Request:  r.redactRequest(proto.Clone(req).(*envoy_service_proc_v3.ProcessingRequest)),
+		Response: r.redactResponse(proto.Clone(resp).(*envoy_service_proc_v3.ProcessingResponse)),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = msg
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Snapshot returns the recorded messages, oldest first.
+func (r *MessageRecorder) Snapshot() []RecordedMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return slices.Clone(r.entries[:r.next])
+	}
+	return append(slices.Clone(r.entries[r.next:]), r.entries[:r.next]...)
+}
+
+// ServeHTTP writes the recorded messages as a JSON array.
+func (r *MessageRecorder) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	type entry struct {
+		Time     time.Time       `json:"time"`
+		Duration string          `json:"duration"`
+		Request  json.RawMessage `json:"request"`
+		Response json.RawMessage `json:"response"`
+	}
+
+	snapshot := r.Snapshot()
+	out := make([]entry, 0, len(snapshot))
+	for _, msg := range snapshot {
+		reqJSON, _ := protojson.Marshal(msg.Request)
+		respJSON, _ := protojson.Marshal(msg.Response)
+		out = append(out, entry{
+			Time:     msg.Time,
+			Duration: msg.Duration.String(),
+			Request:  reqJSON,
+			Response: respJSON,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func (r *MessageRecorder) redactRequest(req *envoy_service_proc_v3.ProcessingRequest) *envoy_service_proc_v3.ProcessingRequest {
+	switch v := req.Request.(type) {
+	case *envoy_service_proc_v3.ProcessingRequest_RequestHeaders:
+		r.redactHeaderMap(v.RequestHeaders.GetHeaders())
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseHeaders:
+		r.redactHeaderMap(v.ResponseHeaders.GetHeaders())
+	case *envoy_service_proc_v3.ProcessingRequest_RequestTrailers:
+		r.redactHeaderMap(v.RequestTrailers.GetTrailers())
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseTrailers:
+		r.redactHeaderMap(v.ResponseTrailers.GetTrailers())
+	case *envoy_service_proc_v3.ProcessingRequest_RequestBody:
+		if !r.keepBodies && v.RequestBody != nil {
+			v.RequestBody.Body = nil
+		}
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseBody:
+		if !r.keepBodies && v.ResponseBody != nil {
+			v.ResponseBody.Body = nil
+		}
+	}
+	return req
+}
+
+func (r *MessageRecorder) redactResponse(resp *envoy_service_proc_v3.ProcessingResponse) *envoy_service_proc_v3.ProcessingResponse {
+	var common *envoy_service_proc_v3.CommonResponse
+	switch v := resp.Response.(type) {
+	case *envoy_service_proc_v3.ProcessingResponse_RequestHeaders:
+		common = v.RequestHeaders.GetResponse()
+	case *envoy_service_proc_v3.ProcessingResponse_ResponseHeaders:
+		common = v.ResponseHeaders.GetResponse()
+	case *envoy_service_proc_v3.ProcessingResponse_RequestBody:
+		common = v.RequestBody.GetResponse()
+	case *envoy_service_proc_v3.ProcessingResponse_ResponseBody:
+		common = v.ResponseBody.GetResponse()
+	case *envoy_service_proc_v3.ProcessingResponse_ImmediateResponse:
+		if v.ImmediateResponse != nil {
+			r.redactHeaderOptions(v.ImmediateResponse.GetHeaders().GetSetHeaders())
+			if !r.keepBodies {
+				v.ImmediateResponse.Body = nil
+			}
+		}
+	}
+	if common != nil {
+		r.redactHeaderOptions(common.GetHeaderMutation().GetSetHeaders())
+		if !r.keepBodies {
+			common.BodyMutation = nil
+		}
+	}
+	return resp
+}
+
+func (r *MessageRecorder) redactHeaderMap(headers *envoy_api_v3_core.HeaderMap) {
+	for _, hdr := range headers.GetHeaders() {
+		r.redactHeader(hdr)
+	}
+}
+
+func (r *MessageRecorder) redactHeaderOptions(options []*envoy_api_v3_core.HeaderValueOption) {
+	for _, opt := range options {
+		r.redactHeader(opt.GetHeader())
+	}
+}
+
+func (r *MessageRecorder) redactHeader(hdr *envoy_api_v3_core.HeaderValue) {
+	if hdr == nil {
+		return
+	}
+	if slices.ContainsFunc(r.redactHeaders, func(h string) bool {
+		return strings.EqualFold(h, hdr.GetKey())
+	}) {
+		hdr.Value = redactedValue
+		hdr.RawValue = []byte(redactedValue)
+	}
+}
@@ -0,0 +1,371 @@
+// Package saml provides an ext_proc processor performing SP-initiated SAML
+// SSO at the edge: unauthenticated navigations are redirected to the IdP,
+// the POSTed assertion is consumed on the ACS path, and a signed session
+// cookie identifies the user on subsequent requests.
+package saml
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/securecookie"
+	"github.com/rs/zerolog"
+)
+
+const (
+	trackingCookiePrefix = "saml_req_"
+	trackingTTL          = 5 * time.Minute
+	maxACSBodySize       = 1 << 20
+)
+
+// Config holds the SAML processor settings.
+type Config struct {
+	ServiceProvider *saml.ServiceProvider
+	Cookies         *securecookie.Codec
+	SessionCookie   string
+	SessionTTL      time.Duration
+	SubjectHeader   string
+	// AttributeHeaders maps SAML attribute names (or friendly names) to the
+	// request headers they are injected as.
+	AttributeHeaders map[string]string
+	MetadataPath     string
+	SkipPaths        []string
+	// DecisionMode selects whether requests without a session are sent to
+	// sign in; those let through carry no identity headers. The ACS and
+	// metadata paths answer in every mode.
+	DecisionMode extproc.DecisionMode
+}
+
+// ProcessorFactory creates SAML processors.
+type ProcessorFactory struct {
+	cfg     Config
+	acsPath string
+	clock   clock.Clock
+	log     zerolog.Logger
+	decider extproc.Decider
+}
+
+// Option configures a ProcessorFactory.
+type Option func(*ProcessorFactory)
+
+// WithClock sets the clock session and tracking cookies expire on.
+func WithClock(c clock.Clock) Option {
+	return func(f *ProcessorFactory) {
+		f.clock = clock.Or(c)
+	}
+}
+
+// NewProcessorFactory creates a new SAML ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger, opts ...Option) *ProcessorFactory {
+	log = log.With().Str("processor", "saml").Logger()
+	f := &ProcessorFactory{
+		cfg:     cfg,
+		acsPath: cfg.ServiceProvider.AcsURL.Path,
+		clock:   clock.Real,
+		log:     log,
+		decider: extproc.NewDecider("saml", cfg.DecisionMode, log),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// NewProcessor creates a new SAML processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+type session struct {
+	Subject    string            `json:"sub"`
+	Attributes map[string]string `json:"attrs,omitempty"`
+}
+
+// Processor handles SAML authentication for a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	acs     bool
+	headers *extproc.RequestContext
+	body    []byte
+}
+
+// ProcessRequestHeaders enforces the session and starts SSO when missing.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	method := ctx.Headers.Get(":method")
+	path, _, _ := strings.Cut(ctx.Headers.Get(":path"), "?")
+
+	switch {
+	case path == f.acsPath && method == http.MethodPost:
+		if ctx.EndOfStream {
+			return extproc.ImmediateResult(http.StatusBadRequest, nil, []byte("missing SAML response\n"))
+		}
+		p.acs = true
+		p.headers = ctx
+		// The assertion is consumed from the body; the request never
+		// reaches the upstream with client-supplied identity headers.
+		result := p.stripIdentity()
+		result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+			RequestBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_BUFFERED,
+			ResponseHeaderMode: envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+		}
+		return result
+	case f.cfg.MetadataPath != "" && path == f.cfg.MetadataPath:
+		return p.metadata()
+	}
+	for _, prefix := range f.cfg.SkipPaths {
+		if underPath(path, prefix) {
+			return p.stripIdentity()
+		}
+	}
+
+	if cookie, ok := ctx.Cookie(f.cfg.SessionCookie); ok {
+		if raw, err := f.cfg.Cookies.Decode(f.cfg.SessionCookie, cookie.Value, f.clock.Now()); err == nil {
+			var sess session
+			if err := json.Unmarshal(raw, &sess); err == nil {
+				return p.identify(&sess)
+			}
+		} else {
+			f.log.Debug().Err(err).Msg("invalid session cookie")
+		}
+	}
+
+	if method != http.MethodGet && method != http.MethodHead {
+		return f.decider.Reject(ctx.GetRequestID(), "unauthenticated",
+			extproc.ImmediateResult(http.StatusUnauthorized, nil, []byte("authentication required\n")), p.stripIdentity())
+	}
+	return f.decider.Reject(ctx.GetRequestID(), "unauthenticated", p.redirectToIdP(ctx.Headers.Get(":path")), p.stripIdentity())
+}
+
+// ProcessRequestBody consumes the IdP's POSTed assertion on the ACS path.
+func (p *Processor) ProcessRequestBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	if !p.acs {
+		return extproc.ContinueResult()
+	}
+	if len(p.body)+len(body) > maxACSBodySize {
+		return extproc.ImmediateResult(http.StatusRequestEntityTooLarge, nil, []byte("SAML response too large\n"))
+	}
+	p.body = append(p.body, body...)
+	if !endOfStream {
+		return extproc.ContinueResult()
+	}
+	return p.consumeAssertion()
+}
+
+// ProcessResponseHeaders denies ACS requests whose body was never
+// processed, e.g. because the filter does not send request bodies: the
+// assertion was not verified, so the upstream's answer must not be served.
+func (p *Processor) ProcessResponseHeaders(*extproc.RequestContext) *extproc.ProcessingResult {
+	if p.acs {
+		p.factory.log.Error().Str("request_id", p.headers.GetRequestID()).Msg("SAML response body was not sent to the processor")
+		return extproc.ImmediateResult(http.StatusForbidden, nil, []byte("SAML response not processed\n"))
+	}
+	return extproc.ContinueResult()
+}
+
+func (p *Processor) redirectToIdP(returnTo string) *extproc.ProcessingResult {
+	f := p.factory
+	sp := f.cfg.ServiceProvider
+
+	authnReq, err := sp.MakeAuthenticationRequest(
+		sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		saml.HTTPRedirectBinding,
+		saml.HTTPPostBinding,
+	)
+	if err != nil {
+		f.log.Error().Err(err).Msg("failed to create authn request")
+		return extproc.ImmediateResult(http.StatusInternalServerError, nil, []byte("failed to start sign-in\n"))
+	}
+
+	relayState := randomToken()
+	redirectURL, err := authnReq.Redirect(relayState, sp)
+	if err != nil {
+		f.log.Error().Err(err).Msg("failed to build IdP redirect")
+		return extproc.ImmediateResult(http.StatusInternalServerError, nil, []byte("failed to start sign-in\n"))
+	}
+
+	name := trackingCookiePrefix + relayState
+	tracking := f.cfg.Cookies.Encode(name, []byte(authnReq.ID+"\n"+returnTo), f.clock.Now().Add(trackingTTL))
+	return extproc.ImmediateResult(http.StatusFound, []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("location", redirectURL.String()),
+		extproc.SetHeader("cache-control", "no-store"),
+		extproc.AppendHeader("set-cookie", (&http.Cookie{
+			Name:     name,
+			Value:    tracking,
+			Path:     f.acsPath,
+			MaxAge:   int(trackingTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   true,
+			// The assertion is POSTed cross-site by the IdP.
+			SameSite: http.SameSiteNoneMode,
+		}).String()),
+	}, nil)
+}
+
+func (p *Processor) consumeAssertion() *extproc.ProcessingResult {
+	f := p.factory
+	sp := f.cfg.ServiceProvider
+
+	form, err := url.ParseQuery(string(p.body))
+	if err != nil {
+		return extproc.ImmediateResult(http.StatusBadRequest, nil, []byte("malformed SAML POST\n"))
+	}
+
+	var possibleIDs []string
+	returnTo := "/"
+	name := trackingCookiePrefix + form.Get("RelayState")
+	if cookie, ok := p.headers.Cookie(name); ok {
+		if raw, err := f.cfg.Cookies.Decode(name, cookie.Value, f.clock.Now()); err == nil {
+			id, target, _ := strings.Cut(string(raw), "\n")
+			possibleIDs = append(possibleIDs, id)
+			if localTarget(target) {
+				returnTo = target
+			}
+		}
+	}
+	if len(possibleIDs) == 0 && !sp.AllowIDPInitiated {
+		return extproc.ImmediateResult(http.StatusForbidden, nil, []byte("unknown or expired sign-in request\n"))
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(form.Get("SAMLResponse"))
+	if err != nil {
+		return extproc.ImmediateResult(http.StatusBadRequest, nil, []byte("malformed SAML response\n"))
+	}
+	assertion, err := sp.ParseXMLResponse(raw, possibleIDs, sp.AcsURL)
+	if err != nil {
+		var detail error = err
+		if invalid, ok := err.(*saml.InvalidResponseError); ok {
+			detail = invalid.PrivateErr
+		}
+		f.log.Warn().Err(detail).Str("request_id", p.headers.GetRequestID()).Msg("SAML assertion rejected")
+		return extproc.ImmediateResult(http.StatusForbidden, nil, []byte("SAML assertion rejected\n"))
+	}
+
+	sess := session{Attributes: make(map[string]string)}
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		sess.Subject = assertion.Subject.NameID.Value
+	}
+	for _, stmt := range assertion.AttributeStatements {
+		for _, attr := range stmt.Attributes {
+			if len(attr.Values) == 0 {
+				continue
+			}
+			for _, key := range []string{attr.Name, attr.FriendlyName} {
+				if _, ok := f.cfg.AttributeHeaders[key]; ok && key != "" {
+					sess.Attributes[key] = attr.Values[0].Value
+				}
+			}
+		}
+	}
+	payload, _ := json.Marshal(sess)
+
+	f.log.Info().
+		Str("subject", sess.Subject).
+		Str("request_id", p.headers.GetRequestID()).
+		Msg("SAML sign-in completed")
+
+	return extproc.ImmediateResult(http.StatusFound, []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("location", returnTo),
+		extproc.SetHeader("cache-control", "no-store"),
+		extproc.AppendHeader("set-cookie", (&http.Cookie{
+			Name:     f.cfg.SessionCookie,
+			Value:    f.cfg.Cookies.Encode(f.cfg.SessionCookie, payload, f.clock.Now().Add(f.cfg.SessionTTL)),
+			Path:     "/",
+			MaxAge:   int(f.cfg.SessionTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		}).String()),
+		extproc.AppendHeader("set-cookie", (&http.Cookie{
+			Name:   name,
+			Path:   f.acsPath,
+			MaxAge: -1,
+		}).String()),
+	}, nil)
+}
+
+func (p *Processor) metadata() *extproc.ProcessingResult {
+	body, err := xml.MarshalIndent(p.factory.cfg.ServiceProvider.Metadata(), "", "  ")
+	if err != nil {
+		p.factory.log.Error().Err(err).Msg("failed to render SP metadata")
+		return extproc.ImmediateResult(http.StatusInternalServerError, nil, nil)
+	}
+	return extproc.ImmediateResult(http.StatusOK, []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("content-type", "application/samlmetadata+xml"),
+	}, append([]byte(xml.Header), body...))
+}
+
+// identify injects the session identity, overwriting anything the client sent.
+func (p *Processor) identify(sess *session) *extproc.ProcessingResult {
+	f := p.factory
+	headers := []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader(f.cfg.SubjectHeader, sess.Subject),
+	}
+	var remove []string
+	for attr, header := range f.cfg.AttributeHeaders {
+		if value, ok := sess.Attributes[attr]; ok {
+			headers = append(headers, extproc.SetHeader(header, value))
+		} else {
+			remove = append(remove, header)
+		}
+	}
+	result := extproc.ContinueWithHeaders(headers)
+	result.HeaderMutations.RemoveHeaders = remove
+	return result
+}
+
+// stripIdentity removes identity headers on unauthenticated skip paths.
+func (p *Processor) stripIdentity() *extproc.ProcessingResult {
+	f := p.factory
+	remove := []string{f.cfg.SubjectHeader}
+	for _, header := range f.cfg.AttributeHeaders {
+		remove = append(remove, header)
+	}
+	return &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{RemoveHeaders: remove},
+	}
+}
+
+// localTarget reports whether target is a path on this site. Browsers
+// treat "//host" and "/\host" as other sites.
+func localTarget(target string) bool {
+	return strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") && !strings.ContainsAny(target, "\\\r\n")
+}
+
+// underPath reports whether path is prefix or below it, matching whole
+// segments: /public covers /public/a but not /publicity.
+func underPath(path, prefix string) bool {
+	if !strings.HasSuffix(prefix, "/") {
+		if path == prefix {
+			return true
+		}
+		prefix += "/"
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
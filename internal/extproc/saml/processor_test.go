@@ -0,0 +1,180 @@
+package saml
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/securecookie"
+	"github.com/rs/zerolog"
+)
+
+func newTestFactory(t *testing.T, opts ...Option) *ProcessorFactory {
+	t.Helper()
+	cookies, err := securecookie.New([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acsURL, _ := url.Parse("https://app.example.com/saml/acs")
+	return NewProcessorFactory(Config{
+		ServiceProvider: &saml.ServiceProvider{
+			EntityID: "https://app.example.com/saml/metadata",
+			AcsURL:   *acsURL,
+			IDPMetadata: &saml.EntityDescriptor{
+				EntityID: "https://idp.example.com",
+				IDPSSODescriptors: []saml.IDPSSODescriptor{{
+					SingleSignOnServices: []saml.Endpoint{{
+						Binding:  saml.HTTPRedirectBinding,
+						Location: "https://idp.example.com/sso",
+					}},
+				}},
+			},
+		},
+		Cookies:          cookies,
+		SessionCookie:    "session",
+		SessionTTL:       time.Hour,
+		SubjectHeader:    "x-user",
+		AttributeHeaders: map[string]string{"email": "x-user-email"},
+		SkipPaths:        []string{"/public"},
+	}, zerolog.Nop(), opts...)
+}
+
+func TestRedirectToIdP(t *testing.T) {
+	f := newTestFactory(t)
+	result := f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, ":method", "GET", ":path", "/reports?q=1"))
+	extproctest.Check(t, result, extproctest.ExpectDenied(http.StatusFound))
+	var location, tracking string
+	for _, opt := range result.ImmediateResponse.GetHeaders().GetSetHeaders() {
+		switch opt.GetHeader().GetKey() {
+		case "location":
+			location = string(opt.GetHeader().GetRawValue())
+		case "set-cookie":
+			tracking = string(opt.GetHeader().GetRawValue())
+		}
+	}
+	if !strings.HasPrefix(location, "https://idp.example.com/sso?") {
+		t.Errorf("location = %q, want the IdP", location)
+	}
+	if !strings.HasPrefix(tracking, trackingCookiePrefix) || !strings.Contains(tracking, "Path=/saml/acs") {
+		t.Errorf("tracking cookie = %q", tracking)
+	}
+
+	// Requests that cannot follow a redirect are refused.
+	result = f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil, ":method", "POST", ":path", "/reports"))
+	extproctest.Check(t, result, extproctest.ExpectDenied(http.StatusUnauthorized))
+}
+
+func TestSession(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	f := newTestFactory(t, WithClock(clk))
+	payload, _ := json.Marshal(session{Subject: "alice", Attributes: map[string]string{}})
+	cookie := f.cfg.Cookies.Encode("session", payload, clk.Now().Add(time.Hour))
+
+	result := f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil,
+		":method", "GET", ":path", "/", "cookie", "session="+cookie, "x-user", "mallory", "x-user-email", "m@example.com"))
+	extproctest.Check(t, result,
+		extproctest.ExpectContinue(),
+		extproctest.ExpectHeaderSet("x-user", "alice"),
+		extproctest.ExpectHeaderRemoved("x-user-email"),
+	)
+
+	// A forged cookie starts sign-in instead.
+	result = f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil,
+		":method", "GET", ":path", "/", "cookie", "session="+cookie+"x"))
+	extproctest.Check(t, result, extproctest.ExpectDenied(http.StatusFound))
+
+	// So does an expired one.
+	clk.Advance(2 * time.Hour)
+	result = f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil,
+		":method", "GET", ":path", "/", "cookie", "session="+cookie))
+	extproctest.Check(t, result, extproctest.ExpectDenied(http.StatusFound))
+}
+
+func TestSkipPaths(t *testing.T) {
+	f := newTestFactory(t)
+	for path, skipped := range map[string]bool{
+		"/public":       true,
+		"/public/a.css": true,
+		"/publicity":    false,
+		"/private":      false,
+	} {
+		result := f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil,
+			":method", "GET", ":path", path, "x-user", "mallory"))
+		if skipped {
+			extproctest.Check(t, result, extproctest.ExpectContinue(), extproctest.ExpectHeaderRemoved("x-user"))
+		} else {
+			extproctest.Check(t, result, extproctest.ExpectDenied(http.StatusFound))
+		}
+	}
+}
+
+func TestACS(t *testing.T) {
+	f := newTestFactory(t)
+
+	// Identity headers are stripped and the body is requested.
+	p := f.NewProcessor().(*Processor)
+	result := p.ProcessRequestHeaders(extproctest.NewContext(nil,
+		":method", "POST", ":path", "/saml/acs", "x-user", "mallory"))
+	extproctest.Check(t, result, extproctest.ExpectContinue(), extproctest.ExpectHeaderRemoved("x-user"))
+	if result.ModeOverride == nil {
+		t.Error("ACS request did not request its body")
+	}
+	// If the body is never sent, the upstream's answer is not served.
+	extproctest.Check(t, p.ProcessResponseHeaders(extproctest.NewContext(nil, ":status", "200")),
+		extproctest.ExpectDenied(http.StatusForbidden))
+
+	// A POST without a body carries no assertion.
+	ctx := extproctest.NewContext(nil, ":method", "POST", ":path", "/saml/acs")
+	ctx.EndOfStream = true
+	extproctest.Check(t, f.NewProcessor().ProcessRequestHeaders(ctx), extproctest.ExpectDenied(http.StatusBadRequest))
+
+	// Responses to unknown sign-in requests are refused.
+	p = f.NewProcessor().(*Processor)
+	p.ProcessRequestHeaders(extproctest.NewContext(nil, ":method", "POST", ":path", "/saml/acs"))
+	extproctest.Check(t, p.ProcessRequestBody(nil, []byte("RelayState=unknown&SAMLResponse=PHg%2B"), true),
+		extproctest.ExpectDenied(http.StatusForbidden))
+
+	// A tracked sign-in with an invalid assertion is refused.
+	tracking := f.cfg.Cookies.Encode(trackingCookiePrefix+"r1", []byte("id-1\n/reports"), time.Now().Add(time.Minute))
+	p = f.NewProcessor().(*Processor)
+	p.ProcessRequestHeaders(extproctest.NewContext(nil,
+		":method", "POST", ":path", "/saml/acs", "cookie", trackingCookiePrefix+"r1="+tracking))
+	extproctest.Check(t, p.ProcessRequestBody(nil, []byte("RelayState=r1&SAMLResponse=PHg%2B"), true),
+		extproctest.ExpectDenied(http.StatusForbidden))
+}
+
+func TestLocalTarget(t *testing.T) {
+	for target, want := range map[string]bool{
+		"/reports?q=1":      true,
+		"/":                 true,
+		"//evil.com":        false,
+		`/\evil.com`:        false,
+		"https://evil.com":  false,
+		"/a\r\nset-cookie:": false,
+	} {
+		if got := localTarget(target); got != want {
+			t.Errorf("localTarget(%q) = %t, want %t", target, got, want)
+		}
+	}
+}
+
+func TestLogOnly(t *testing.T) {
+	f := newTestFactory(t)
+	f.decider = extproc.NewDecider("saml", extproc.DecisionLogOnly, zerolog.Nop())
+	for _, method := range []string{"GET", "POST"} {
+		result := f.NewProcessor().ProcessRequestHeaders(extproctest.NewContext(nil,
+			":method", method, ":path", "/reports", "x-user", "mallory"))
+		extproctest.Check(t, result, extproctest.ExpectContinue(), extproctest.ExpectHeaderRemoved("x-user"))
+	}
+	// The ACS path still completes sign-in.
+	ctx := extproctest.NewContext(nil, ":method", "POST", ":path", "/saml/acs")
+	ctx.EndOfStream = true
+	extproctest.Check(t, f.NewProcessor().ProcessRequestHeaders(ctx), extproctest.ExpectDenied(http.StatusBadRequest))
+}
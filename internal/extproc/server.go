@@ -1,15 +1,21 @@
 package extproc
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/crashreport"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
 	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -19,22 +25,120 @@ import (
 type Server struct {
 	envoy_service_proc_v3.UnimplementedExternalProcessorServer
 
-	factory ProcessorFactory
-	log     zerolog.Logger
+	factory  ProcessorFactory
+	log      zerolog.Logger
+	recorder *MessageRecorder
+	paths    PathTemplater
+	budget   *MemoryBudget
+	watchdog *Watchdog
+
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+
+	dispatch      DispatchMode
+	dispatchQueue int
+
+	phaseTimeout  time.Duration
+	timeoutPolicy TimeoutPolicy
+}
+
+// ServerOption configures optional Server behavior.
+type ServerOption func(*Server)
+
+// WithMessageRecorder records every processed message pair into recorder.
+func WithMessageRecorder(recorder *MessageRecorder) ServerOption {
+	return func(s *Server) {
+		s.recorder = recorder
+	}
+}
+
+// WithRequestMetrics counts HTTP requests by method, status and the route
+// template paths derives from the request path.
+func WithRequestMetrics(paths PathTemplater) ServerOption {
+	return func(s *Server) {
+		s.paths = paths
+	}
+}
+
+// WithMemoryBudget accounts body bytes against budget and sheds body
+// buffering for new streams while it is exceeded.
+func WithMemoryBudget(budget *MemoryBudget) ServerOption {
+	return func(s *Server) {
+		s.budget = budget
+	}
+}
+
+// WithWatchdog tracks streams in watchdog's stream table.
+func WithWatchdog(watchdog *Watchdog) ServerOption {
+	return func(s *Server) {
+		s.watchdog = watchdog
+	}
 }
 
 // NewServer creates a new ext_proc Server with the given ProcessorFactory.
-func NewServer(factory ProcessorFactory, log zerolog.Logger) *Server {
-	return &Server{
-		factory: factory,
-		log:     log.With().Str("component", "extproc").Logger(),
+func NewServer(factory ProcessorFactory, log zerolog.Logger, opts ...ServerOption) *Server {
+	s := &Server{
+		factory:       factory,
+		log:           log.With().Str("component", "extproc").Logger(),
+		dispatchQueue: DefaultDispatchQueue,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // Process handles the bidirectional streaming RPC for external processing.
 func (s *Server) Process(srv envoy_service_proc_v3.ExternalProcessor_ProcessServer) error {
+	defer crashreport.Recover()
 	ctx := srv.Context()
-	processor := s.factory.NewProcessor()
+	processor := s.newProcessor(srv)
+	name := processorName(processor)
+	log := s.log.With().Str("processor", name).Logger()
+	defer func() { endProcessor(processor) }()
+	streamsActive.Inc()
+	defer streamsActive.Dec()
+	entry := s.watchdog.open(ctx, processor)
+	defer s.watchdog.close(entry)
+	mem := s.budget.NewAccount()
+	defer mem.Close()
+	var stats requestStats
+	if s.paths != nil {
+		defer func() { stats.record(s.paths) }()
+	}
+	var requests requestTracker
+	var traceParent context.Context
+	var overran atomic.Bool
+
+	d := newDispatcher(dispatchModeOf(processor, s.dispatch), s.dispatchQueue, func(p *pending) {
+		defer requests.inflight.Done()
+		entry.goroutineStarted()
+		defer entry.goroutineDone()
+		mem.Charge(heldBytes(p.req))
+
+		start := time.Now()
+		s.processTimed(p.processor, name, p, mem, &overran, log)
+		duration := time.Since(start)
+		observeMessage(name, phaseName(p.req), duration, p.r.processing)
+		if s.recorder != nil {
+			s.recorder.Record(p.req, p.resp, duration)
+		}
+		s.traceMessage(name, p, start, duration)
+		log.Trace().
+			Dur("duration", duration).
+			Dur("processor_duration", p.r.processing).
+			Interface("request", p.req).
+			Interface("response", p.resp).
+			Msg("request processed")
+	}, func(p *pending) {
+		defer p.r.release()
+		defer mem.Release(heldBytes(p.req))
+		if err := srv.Send(p.resp); err != nil {
+			err = oops.In("extproc").Code(errcode.StreamFailed).Wrap(err)
+			log.Error().Err(err).Msg("failed to send response")
+		}
+	})
+	defer d.close()
 
 	for {
 		select {
@@ -45,56 +149,148 @@ func (s *Server) Process(srv envoy_service_proc_v3.ExternalProcessor_ProcessServ
 
 		req, err := srv.Recv()
 		if err != nil {
-			if status.Code(err) == codes.Canceled || errors.Is(err, io.EOF) {
+			if errors.Is(err, io.EOF) {
+				// Envoy closed its side; answer what was received.
+				d.drain()
+				return nil
+			}
+			if status.Code(err) == codes.Canceled {
 				return nil
 			}
-			s.log.Error().Err(err).Msg("failed to receive request")
+			err = oops.In("extproc").Code(errcode.StreamFailed).Wrap(err)
+			log.Error().Err(err).Msg("failed to receive request")
 			return status.Errorf(codes.Unknown, "cannot receive stream request: %v", err)
 		}
 
-		go func() {
-			start := time.Now()
-			resp := s.processOne(processor, req)
-			s.log.Trace().
-				Dur("duration", time.Since(start)).
-				Interface("request", req).
-				Interface("response", resp).
-				Msg("request processed")
-			if err := srv.Send(resp); err != nil {
-				s.log.Error().Err(err).Msg("failed to send response")
+		newRequest := requests.advance(req)
+		if newRequest {
+			// The previous request on this stream is complete.
+			requests.inflight.Wait()
+			overran.Store(false)
+			if reusable(processor) {
+				processor.(RequestEndHandler).OnRequestEnd()
+			} else {
+				endProcessor(processor)
+				processor = s.newProcessor(srv)
 			}
-		}()
+			if s.paths != nil {
+				stats.record(s.paths)
+				stats = requestStats{}
+			}
+		}
+		if s.paths != nil {
+			stats.observe(req)
+		}
+
+		entry.received(req, requests.index)
+		requests.inflight.Add(1)
+		traceParent = s.traceParent(ctx, traceParent, req, newRequest)
+		d.submit(&pending{req: req, request: requests.index, processor: processor, trace: traceParent})
+	}
+}
+
+// heldBytes is the body data a message holds while it is in flight.
+func heldBytes(req *envoy_service_proc_v3.ProcessingRequest) int64 {
+	return int64(len(req.GetRequestBody().GetBody()) + len(req.GetResponseBody().GetBody()))
+}
+
+// newProcessor creates the Processor for a stream, letting a
+// StreamProcessorFactory choose one based on the stream metadata.
+// EventProcessors are wrapped to receive streaming bodies event by event.
+func (s *Server) newProcessor(srv envoy_service_proc_v3.ExternalProcessor_ProcessServer) Processor {
+	var processor Processor
+	if sf, ok := s.factory.(StreamProcessorFactory); ok {
+		processor = sf.NewStreamProcessor(StreamInfoFromContext(srv.Context()))
+	} else {
+		processor = s.factory.NewProcessor()
 	}
+	if ep, ok := processor.(EventProcessor); ok {
+		return newEventSplitter(ep)
+	}
+	return processor
 }
 
 func (s *Server) processOne(
 	processor Processor,
 	req *envoy_service_proc_v3.ProcessingRequest,
+	mem *MemoryAccount,
+	request int,
+	r *response,
+	log zerolog.Logger,
 ) *envoy_service_proc_v3.ProcessingResponse {
-	s.log.Debug().
+	log.Debug().
 		Interface("request", req.Request).
 		Type("request_type", req.Request).
 		Msg("processing request")
 
+	if resp := s.skipPhase(processor, req, r); resp != nil {
+		return resp
+	}
+
 	switch v := req.Request.(type) {
 	case *envoy_service_proc_v3.ProcessingRequest_RequestHeaders:
-		return s.handleRequestHeaders(processor, req, v.RequestHeaders)
+		return s.handleRequestHeaders(processor, req, v.RequestHeaders, mem, request, r)
 	case *envoy_service_proc_v3.ProcessingRequest_ResponseHeaders:
-		return s.handleResponseHeaders(processor, req, v.ResponseHeaders)
+		return s.handleResponseHeaders(processor, req, v.ResponseHeaders, mem, request, r)
 	case *envoy_service_proc_v3.ProcessingRequest_RequestBody:
-		return s.handleRequestBody(processor, req, v.RequestBody)
+		return s.handleRequestBody(processor, req, v.RequestBody, mem, request, r)
 	case *envoy_service_proc_v3.ProcessingRequest_ResponseBody:
-		return s.handleResponseBody(processor, req, v.ResponseBody)
+		return s.handleResponseBody(processor, req, v.ResponseBody, mem, request, r)
 	case *envoy_service_proc_v3.ProcessingRequest_RequestTrailers:
-		return s.handleRequestTrailers(processor, req, v.RequestTrailers)
+		return s.handleRequestTrailers(processor, req, v.RequestTrailers, mem, request, r)
 	case *envoy_service_proc_v3.ProcessingRequest_ResponseTrailers:
-		return s.handleResponseTrailers(processor, req, v.ResponseTrailers)
+		return s.handleResponseTrailers(processor, req, v.ResponseTrailers, mem, request, r)
 	default:
-		s.log.Warn().
+		log.Warn().
 			Interface("request", req.Request).
 			Type("request_type", v).
 			Msg("unknown request type")
-		return &envoy_service_proc_v3.ProcessingResponse{}
+		return &r.msg
+	}
+}
+
+// continueResult is the result of phases a PhaseAware processor ignores. It
+// is shared and must not be modified.
+var continueResult = ContinueResult()
+
+// skipPhase answers a message of a phase the processor does not handle, or
+// returns nil to process it normally. Headers messages still go to the
+// processor when the server adjusts their result: while the memory budget
+// is exceeded, or for streaming responses.
+func (s *Server) skipPhase(
+	processor Processor,
+	req *envoy_service_proc_v3.ProcessingRequest,
+	r *response,
+) *envoy_service_proc_v3.ProcessingResponse {
+	pa, ok := processor.(PhaseAware)
+	if !ok {
+		return nil
+	}
+	phase := phaseOf(req)
+	if phase == 0 || pa.Phases()&phase != 0 {
+		return nil
+	}
+	switch v := req.Request.(type) {
+	case *envoy_service_proc_v3.ProcessingRequest_RequestHeaders:
+		if s.budget.Exceeded() {
+			return nil
+		}
+		return r.headersResponse(continueResult, true)
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseHeaders:
+		h := v.ResponseHeaders
+		if s.budget.Exceeded() ||
+			!h.GetEndOfStream() && IsStreamingContentType(findHeader(h.GetHeaders(), "content-type")) {
+			return nil
+		}
+		return r.headersResponse(continueResult, false)
+	case *envoy_service_proc_v3.ProcessingRequest_RequestBody:
+		return r.bodyResponse(continueResult, true)
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseBody:
+		return r.bodyResponse(continueResult, false)
+	case *envoy_service_proc_v3.ProcessingRequest_RequestTrailers:
+		return r.trailersResponse(continueResult, true)
+	default:
+		return r.trailersResponse(continueResult, false)
 	}
 }
 
@@ -102,130 +298,150 @@ func (s *Server) handleRequestHeaders(
 	processor Processor,
 	req *envoy_service_proc_v3.ProcessingRequest,
 	h *envoy_service_proc_v3.HttpHeaders,
+	mem *MemoryAccount,
+	request int,
+	r *response,
 ) *envoy_service_proc_v3.ProcessingResponse {
 	ctx := &RequestContext{
+		Memory:      mem,
+		Request:     request,
 		Attributes:  req.GetAttributes(),
+		Metadata:    req.GetMetadataContext(),
 		Headers:     parseHeaders(h),
 		EndOfStream: h.GetEndOfStream(),
 	}
 
+	start := time.Now()
 	result := processor.ProcessRequestHeaders(ctx)
-	return buildHeadersResponse(result, func(resp *envoy_service_proc_v3.HeadersResponse) *envoy_service_proc_v3.ProcessingResponse {
-		return &envoy_service_proc_v3.ProcessingResponse{
-			Response: &envoy_service_proc_v3.ProcessingResponse_RequestHeaders{
-				RequestHeaders: resp,
-			},
-		}
-	})
+	r.processing = time.Since(start)
+	result = s.shedBuffering(result)
+	return r.headersResponse(result, true)
 }
 
 func (s *Server) handleResponseHeaders(
 	processor Processor,
 	req *envoy_service_proc_v3.ProcessingRequest,
 	h *envoy_service_proc_v3.HttpHeaders,
+	mem *MemoryAccount,
+	request int,
+	r *response,
 ) *envoy_service_proc_v3.ProcessingResponse {
 	ctx := &RequestContext{
+		Memory:      mem,
+		Request:     request,
 		Attributes:  req.GetAttributes(),
+		Metadata:    req.GetMetadataContext(),
 		Headers:     parseHeaders(h),
 		EndOfStream: h.GetEndOfStream(),
 	}
 
+	start := time.Now()
 	result := processor.ProcessResponseHeaders(ctx)
-	return buildHeadersResponse(result, func(resp *envoy_service_proc_v3.HeadersResponse) *envoy_service_proc_v3.ProcessingResponse {
-		return &envoy_service_proc_v3.ProcessingResponse{
-			Response: &envoy_service_proc_v3.ProcessingResponse_ResponseHeaders{
-				ResponseHeaders: resp,
-			},
-		}
-	})
+	r.processing = time.Since(start)
+	applyStreamingMode(processor, ctx.Headers, ctx.EndOfStream, result)
+	result = s.shedBuffering(result)
+	return r.headersResponse(result, false)
 }
 
 func (s *Server) handleRequestBody(
 	processor Processor,
 	req *envoy_service_proc_v3.ProcessingRequest,
 	b *envoy_service_proc_v3.HttpBody,
+	mem *MemoryAccount,
+	request int,
+	r *response,
 ) *envoy_service_proc_v3.ProcessingResponse {
 	ctx := &RequestContext{
+		Memory:      mem,
+		Request:     request,
 		Attributes:  req.GetAttributes(),
+		Metadata:    req.GetMetadataContext(),
 		EndOfStream: b.GetEndOfStream(),
 	}
 
+	start := time.Now()
 	result := processor.ProcessRequestBody(ctx, b.GetBody(), b.GetEndOfStream())
-	return buildBodyResponse(result, func(resp *envoy_service_proc_v3.BodyResponse) *envoy_service_proc_v3.ProcessingResponse {
-		return &envoy_service_proc_v3.ProcessingResponse{
-			Response: &envoy_service_proc_v3.ProcessingResponse_RequestBody{
-				RequestBody: resp,
-			},
-		}
-	})
+	r.processing = time.Since(start)
+	return r.bodyResponse(result, true)
 }
 
 func (s *Server) handleResponseBody(
 	processor Processor,
 	req *envoy_service_proc_v3.ProcessingRequest,
 	b *envoy_service_proc_v3.HttpBody,
+	mem *MemoryAccount,
+	request int,
+	r *response,
 ) *envoy_service_proc_v3.ProcessingResponse {
 	ctx := &RequestContext{
+		Memory:      mem,
+		Request:     request,
 		Attributes:  req.GetAttributes(),
+		Metadata:    req.GetMetadataContext(),
 		EndOfStream: b.GetEndOfStream(),
 	}
 
+	start := time.Now()
 	result := processor.ProcessResponseBody(ctx, b.GetBody(), b.GetEndOfStream())
-	return buildBodyResponse(result, func(resp *envoy_service_proc_v3.BodyResponse) *envoy_service_proc_v3.ProcessingResponse {
-		return &envoy_service_proc_v3.ProcessingResponse{
-			Response: &envoy_service_proc_v3.ProcessingResponse_ResponseBody{
-				ResponseBody: resp,
-			},
-		}
-	})
+	r.processing = time.Since(start)
+	return r.bodyResponse(result, false)
 }
 
 func (s *Server) handleRequestTrailers(
 	processor Processor,
 	req *envoy_service_proc_v3.ProcessingRequest,
-	_ *envoy_service_proc_v3.HttpTrailers,
+	t *envoy_service_proc_v3.HttpTrailers,
+	mem *MemoryAccount,
+	request int,
+	r *response,
 ) *envoy_service_proc_v3.ProcessingResponse {
 	ctx := &RequestContext{
-		Attributes: req.GetAttributes(),
+		Memory:      mem,
+		Request:     request,
+		Attributes:  req.GetAttributes(),
+		Metadata:    req.GetMetadataContext(),
+		Headers:     parseHeaderMap(t.GetTrailers()),
+		EndOfStream: true,
 	}
 
+	start := time.Now()
 	result := processor.ProcessRequestTrailers(ctx)
-	return buildTrailersResponse(result, func(resp *envoy_service_proc_v3.TrailersResponse) *envoy_service_proc_v3.ProcessingResponse {
-		return &envoy_service_proc_v3.ProcessingResponse{
-			Response: &envoy_service_proc_v3.ProcessingResponse_RequestTrailers{
-				RequestTrailers: resp,
-			},
-		}
-	})
+	r.processing = time.Since(start)
+	return r.trailersResponse(result, true)
 }
 
 func (s *Server) handleResponseTrailers(
 	processor Processor,
 	req *envoy_service_proc_v3.ProcessingRequest,
-	_ *envoy_service_proc_v3.HttpTrailers,
+	t *envoy_service_proc_v3.HttpTrailers,
+	mem *MemoryAccount,
+	request int,
+	r *response,
 ) *envoy_service_proc_v3.ProcessingResponse {
 	ctx := &RequestContext{
-		Attributes: req.GetAttributes(),
+		Memory:      mem,
+		Request:     request,
+		Attributes:  req.GetAttributes(),
+		Metadata:    req.GetMetadataContext(),
+		Headers:     parseHeaderMap(t.GetTrailers()),
+		EndOfStream: true,
 	}
 
+	start := time.Now()
 	result := processor.ProcessResponseTrailers(ctx)
-	return buildTrailersResponse(result, func(resp *envoy_service_proc_v3.TrailersResponse) *envoy_service_proc_v3.ProcessingResponse {
-		return &envoy_service_proc_v3.ProcessingResponse{
-			Response: &envoy_service_proc_v3.ProcessingResponse_ResponseTrailers{
-				ResponseTrailers: resp,
-			},
-		}
-	})
+	r.processing = time.Since(start)
+	return r.trailersResponse(result, false)
 }
 
 // Helper functions for building responses.
 
 func parseHeaders(h *envoy_service_proc_v3.HttpHeaders) http.Header {
-	if h == nil {
-		return make(http.Header)
-	}
+	return parseHeaderMap(h.GetHeaders())
+}
+
+func parseHeaderMap(m *envoy_api_v3_core.HeaderMap) http.Header {
 	headers := make(http.Header)
-	for _, hdr := range h.GetHeaders().GetHeaders() {
+	for _, hdr := range m.GetHeaders() {
 		if raw := hdr.GetRawValue(); len(raw) > 0 {
 			headers.Add(hdr.GetKey(), string(raw))
 		} else {
@@ -235,72 +451,13 @@ func parseHeaders(h *envoy_service_proc_v3.HttpHeaders) http.Header {
 	return headers
 }
 
-func buildHeadersResponse(
-	result *ProcessingResult,
-	wrapper func(*envoy_service_proc_v3.HeadersResponse) *envoy_service_proc_v3.ProcessingResponse,
-) *envoy_service_proc_v3.ProcessingResponse {
-	if result.ImmediateResponse != nil {
-		return &envoy_service_proc_v3.ProcessingResponse{
-			Response: &envoy_service_proc_v3.ProcessingResponse_ImmediateResponse{
-				ImmediateResponse: result.ImmediateResponse,
-			},
-		}
-	}
-
-	common := &envoy_service_proc_v3.CommonResponse{
-		Status: result.Status,
-	}
-	if result.HeaderMutations != nil && len(result.HeaderMutations.SetHeaders) > 0 {
-		common.HeaderMutation = &envoy_service_proc_v3.HeaderMutation{
-			SetHeaders:    result.HeaderMutations.SetHeaders,
-			RemoveHeaders: result.HeaderMutations.RemoveHeaders,
-		}
-	}
-	return wrapper(&envoy_service_proc_v3.HeadersResponse{Response: common})
-}
-
-func buildBodyResponse(
-	result *ProcessingResult,
-	wrapper func(*envoy_service_proc_v3.BodyResponse) *envoy_service_proc_v3.ProcessingResponse,
-) *envoy_service_proc_v3.ProcessingResponse {
-	if result.ImmediateResponse != nil {
-		return &envoy_service_proc_v3.ProcessingResponse{
-			Response: &envoy_service_proc_v3.ProcessingResponse_ImmediateResponse{
-				ImmediateResponse: result.ImmediateResponse,
-			},
-		}
-	}
-
-	return wrapper(&envoy_service_proc_v3.BodyResponse{
-		Response: &envoy_service_proc_v3.CommonResponse{
-			Status: result.Status,
-		},
-	})
-}
-
-func buildTrailersResponse(
-	result *ProcessingResult,
-	wrapper func(*envoy_service_proc_v3.TrailersResponse) *envoy_service_proc_v3.ProcessingResponse,
-) *envoy_service_proc_v3.ProcessingResponse {
-	if result.ImmediateResponse != nil {
-		return &envoy_service_proc_v3.ProcessingResponse{
-			Response: &envoy_service_proc_v3.ProcessingResponse_ImmediateResponse{
-				ImmediateResponse: result.ImmediateResponse,
-			},
+// findHeader returns the first value of the named header in m without
+// parsing the whole map. Envoy sends lowercase names.
+func findHeader(m *envoy_api_v3_core.HeaderMap, name string) string {
+	for _, h := range m.GetHeaders() {
+		if h.GetKey() == name {
+			return headerValue(h.GetValue(), h.GetRawValue())
 		}
 	}
-
-	return wrapper(&envoy_service_proc_v3.TrailersResponse{})
-}
-
-// SetHeader creates a header value option that overwrites existing headers.
-func SetHeader(key, value string) *envoy_api_v3_core.HeaderValueOption {
-	return &envoy_api_v3_core.HeaderValueOption{
-		Header: &envoy_api_v3_core.HeaderValue{
-			Key:      strings.ToLower(key),
-			Value:    value,
-			RawValue: []byte(value),
-		},
-		AppendAction: envoy_api_v3_core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
-	}
+	return ""
 }
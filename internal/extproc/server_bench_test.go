@@ -0,0 +1,109 @@
+package extproc
+
+import (
+	"io"
+	"testing"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+)
+
+// mutatingProcessor sets a header on request headers and continues
+// everything else, like most processors.
+type mutatingProcessor struct {
+	BaseProcessor
+	set []*envoy_api_v3_core.HeaderValueOption
+}
+
+func (p *mutatingProcessor) ProcessRequestHeaders(*RequestContext) *ProcessingResult {
+	return ContinueWithHeaders(p.set)
+}
+
+// requestHeadersProcessor is mutatingProcessor declaring that it only
+// handles request headers.
+type requestHeadersProcessor struct {
+	mutatingProcessor
+}
+
+func (p *requestHeadersProcessor) Phases() Phase {
+	return PhaseRequestHeaders
+}
+
+func benchRequests() map[string]*envoy_service_proc_v3.ProcessingRequest {
+	headers := &envoy_api_v3_core.HeaderMap{}
+	for _, kv := range [][2]string{
+		{":method", "GET"}, {":path", "/v1/items?limit=10"}, {":authority", "api.example.com"},
+		{"user-agent", "curl/8.5.0"}, {"accept", "*/*"}, {"x-request-id", "8c4f1a7e-4b1d"},
+	} {
+		headers.Headers = append(headers.Headers, &envoy_api_v3_core.HeaderValue{Key: kv[0], RawValue: []byte(kv[1])})
+	}
+	return map[string]*envoy_service_proc_v3.ProcessingRequest{
+		"request_headers": {Request: &envoy_service_proc_v3.ProcessingRequest_RequestHeaders{
+			RequestHeaders: &envoy_service_proc_v3.HttpHeaders{Headers: headers},
+		}},
+		"response_headers": {Request: &envoy_service_proc_v3.ProcessingRequest_ResponseHeaders{
+			ResponseHeaders: &envoy_service_proc_v3.HttpHeaders{Headers: headers},
+		}},
+		"request_body": {Request: &envoy_service_proc_v3.ProcessingRequest_RequestBody{
+			RequestBody: &envoy_service_proc_v3.HttpBody{Body: make([]byte, 1024)},
+		}},
+		"response_trailers": {Request: &envoy_service_proc_v3.ProcessingRequest_ResponseTrailers{
+			ResponseTrailers: &envoy_service_proc_v3.HttpTrailers{Trailers: &envoy_api_v3_core.HeaderMap{}},
+		}},
+	}
+}
+
+// BenchmarkProcessMessage measures building and marshaling the response to
+// one message, as Process does between Recv and Send, with pooled response
+// messages, with freshly allocated ones and for a processor skipping every
+// phase but request headers.
+func BenchmarkProcessMessage(b *testing.B) {
+	s := NewServer(nil, zerolog.New(io.Discard).Level(zerolog.InfoLevel))
+	processor := &mutatingProcessor{set: []*envoy_api_v3_core.HeaderValueOption{SetHeader("x-processed", "1")}}
+	for name, req := range benchRequests() {
+		b.Run(name+"/pooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				r := newResponse()
+				if _, err := proto.Marshal(s.processOne(processor, req, nil, 0, r, s.log)); err != nil {
+					b.Fatal(err)
+				}
+				r.release()
+			}
+		})
+		b.Run(name+"/phase_aware", func(b *testing.B) {
+			processor := &requestHeadersProcessor{*processor}
+			b.ReportAllocs()
+			for b.Loop() {
+				r := newResponse()
+				if _, err := proto.Marshal(s.processOne(processor, req, nil, 0, r, s.log)); err != nil {
+					b.Fatal(err)
+				}
+				r.release()
+			}
+		})
+		b.Run(name+"/unpooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := proto.Marshal(s.processOne(processor, req, nil, 0, new(response), s.log)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkParseHeaders measures converting Envoy's header map to the
+// http.Header every RequestContext carries.
+func BenchmarkParseHeaders(b *testing.B) {
+	req := benchRequests()["request_headers"]
+	headers := req.GetRequestHeaders()
+	b.ReportAllocs()
+	for b.Loop() {
+		if len(parseHeaders(headers)) == 0 {
+			b.Fatal("no headers parsed")
+		}
+	}
+}
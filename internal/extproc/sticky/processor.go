@@ -0,0 +1,220 @@
+// Package sticky provides an ext_proc processor that pins clients to a
+// backend shard with a signed cookie and exposes the shard as a request
+// header, for Envoy ring-hash or header-based routing.
+package sticky
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/securecookie"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// Config holds the shards and the session cookie settings.
+type Config struct {
+	// Shards are the backend shard identifiers.
+	Shards []string
+	// Cookies signs the session cookie.
+	Cookies *securecookie.Codec
+	// CookieName names the session cookie.
+	CookieName string
+	// CookieTTL is the cookie lifetime; the cookie is reissued when less
+	// than half of it remains, so active clients keep their shard.
+	CookieTTL time.Duration
+	// Secure marks the cookie Secure.
+	Secure bool
+	// Header carries the shard to Envoy and the upstream.
+	Header string
+	// Clock is used for cookie expiry; nil is the system clock.
+	Clock clock.Clock
+}
+
+// ProcessorFactory creates sticky session processors.
+type ProcessorFactory struct {
+	cfg   Config
+	clock clock.Clock
+	log   zerolog.Logger
+}
+
+// NewProcessorFactory creates a new sticky session ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) (*ProcessorFactory, error) {
+	if len(cfg.Shards) == 0 {
+		return nil, oops.In("sticky").Code(errcode.InvalidConfig).Errorf("no shards configured")
+	}
+	for _, shard := range cfg.Shards {
+		if shard == "" || strings.ContainsAny(shard, "\n\x00") {
+			return nil, oops.In("sticky").Code(errcode.InvalidConfig).With("shard", shard).Errorf("invalid shard identifier %q", shard)
+		}
+	}
+	if cfg.CookieName == "" {
+		cfg.CookieName = "_sticky"
+	}
+	if cfg.Header == "" {
+		cfg.Header = "x-sticky-shard"
+	}
+	cfg.Header = strings.ToLower(cfg.Header)
+	return &ProcessorFactory{
+		cfg:   cfg,
+		clock: clock.Or(cfg.Clock),
+		log:   log.With().Str("processor", "sticky").Logger(),
+	}, nil
+}
+
+// Shard returns the shard of sessionID by rendezvous hashing: the shard with
+// the highest hash of the pair wins, so adding or removing a shard only
+// moves the sessions it gains or loses.
+func (f *ProcessorFactory) Shard(sessionID string) string {
+	var best string
+	var bestScore uint64
+	for _, shard := range f.cfg.Shards {
+		if score := score(sessionID, shard); best == "" || score > bestScore {
+			best, bestScore = shard, score
+		}
+	}
+	return best
+}
+
+func score(sessionID, shard string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(sessionID))
+	h.Write([]byte{0})
+	h.Write([]byte(shard))
+	// FNV alone clusters for similar inputs; finish with the splitmix64
+	// mixer so scores are evenly spread.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// NewProcessor creates a new sticky session processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor handles a single request.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	// cookie, if set, is issued with the response.
+	cookie *http.Cookie
+}
+
+// session is the signed cookie payload.
+type session struct {
+	id    string
+	shard string
+}
+
+// ProcessRequestHeaders resolves the client's shard from its cookie, or
+// assigns one, and sets the shard header.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	now := f.clock.Now()
+
+	sess, expires, ok := p.decode(ctx, now)
+	switch {
+	case !ok:
+		sess = session{id: newSessionID()}
+		sess.shard = f.Shard(sess.id)
+		p.issue(sess, now)
+	case !slices.Contains(f.cfg.Shards, sess.shard):
+		// The shard is gone; hashing the same session ID moves it to the
+		// shard that would have won without it.
+		f.log.Debug().Str("shard", sess.shard).Msg("session shard removed, reassigning")
+		sess.shard = f.Shard(sess.id)
+		p.issue(sess, now)
+	case expires.Sub(now) < f.cfg.CookieTTL/2:
+		p.issue(sess, now)
+	}
+
+	// Always overwrite, so clients cannot pick their own shard.
+	return extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader(f.cfg.Header, sess.shard),
+	})
+}
+
+// decode returns the session of a valid cookie and when it expires.
+func (p *Processor) decode(ctx *extproc.RequestContext, now time.Time) (session, time.Time, bool) {
+	f := p.factory
+	cookie, ok := ctx.Cookie(f.cfg.CookieName)
+	if !ok {
+		return session{}, time.Time{}, false
+	}
+	value, err := f.cfg.Cookies.Decode(f.cfg.CookieName, cookie.Value, now)
+	if err != nil {
+		f.log.Debug().Err(err).Str("request_id", ctx.GetRequestID()).Msg("invalid sticky session cookie")
+		return session{}, time.Time{}, false
+	}
+	// The payload starts with the expiry the cookie was issued with.
+	expiry, rest, ok := strings.Cut(string(value), "\n")
+	id, shard, ok2 := strings.Cut(rest, "\n")
+	at, err := time.Parse(time.RFC3339, expiry)
+	if !ok || !ok2 || err != nil || id == "" {
+		return session{}, time.Time{}, false
+	}
+	return session{id: id, shard: shard}, at, true
+}
+
+func (p *Processor) issue(sess session, now time.Time) {
+	f := p.factory
+	expires := now.Add(f.cfg.CookieTTL).Truncate(time.Second)
+	payload := expires.UTC().Format(time.RFC3339) + "\n" + sess.id + "\n" + sess.shard
+	p.cookie = &http.Cookie{
+		Name:     f.cfg.CookieName,
+		Value:    f.cfg.Cookies.Encode(f.cfg.CookieName, []byte(payload), expires),
+		Path:     "/",
+		MaxAge:   int(f.cfg.CookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   f.cfg.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ProcessResponseHeaders issues a new or refreshed cookie.
+func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	if p.cookie == nil {
+		return extproc.ContinueResult()
+	}
+	return &extproc.ProcessingResult{
+		Status: extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{
+			SetHeaders: []*envoy_api_v3_core.HeaderValueOption{extproc.AppendHeader("set-cookie", p.cookie.String())},
+		},
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Phases reports that request and response headers are processed.
+func (p *Processor) Phases() extproc.Phase {
+	return extproc.PhaseRequestHeaders | extproc.PhaseResponseHeaders
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.PhaseAware.
+var _ extproc.PhaseAware = (*Processor)(nil)
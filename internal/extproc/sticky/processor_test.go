@@ -0,0 +1,131 @@
+package sticky
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/securecookie"
+	"github.com/rs/zerolog"
+)
+
+func newFactory(t *testing.T, clk clock.Clock, shards ...string) *ProcessorFactory {
+	t.Helper()
+	cookies, err := securecookie.New([]byte(strings.Repeat("k", securecookie.MinKeyLength)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewProcessorFactory(Config{
+		Shards:    shards,
+		Cookies:   cookies,
+		CookieTTL: time.Hour,
+		Secure:    true,
+		Clock:     clk,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// exchange runs one request with cookie (if any) and returns the shard
+// header and the issued cookie value.
+func exchange(t *testing.T, f *ProcessorFactory, cookie string) (shard, issued string) {
+	t.Helper()
+	p := f.NewProcessor()
+	var headers []string
+	if cookie != "" {
+		headers = []string{"cookie", "_sticky=" + cookie}
+	}
+	req := p.ProcessRequestHeaders(extproctest.NewContext(nil, append(headers, "x-sticky-shard", "spoofed")...))
+	extproctest.Check(t, req, extproctest.ExpectContinue())
+	for _, h := range req.HeaderMutations.SetHeaders {
+		if h.GetHeader().GetKey() == "x-sticky-shard" {
+			shard = string(h.GetHeader().GetRawValue())
+		}
+	}
+	resp := p.ProcessResponseHeaders(extproctest.NewContext(nil, ":status", "200"))
+	if resp.HeaderMutations != nil {
+		for _, h := range resp.HeaderMutations.SetHeaders {
+			if h.GetHeader().GetKey() == "set-cookie" {
+				c, err := http.ParseSetCookie(string(h.GetHeader().GetRawValue()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				issued = c.Value
+			}
+		}
+	}
+	return shard, issued
+}
+
+func TestStickySession(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	f := newFactory(t, clk, "a", "b", "c")
+
+	shard, cookie := exchange(t, f, "")
+	if shard == "" || shard == "spoofed" || cookie == "" {
+		t.Fatalf("first request: shard %q, cookie %q", shard, cookie)
+	}
+	for range 3 {
+		got, reissued := exchange(t, f, cookie)
+		if got != shard || reissued != "" {
+			t.Fatalf("with cookie: shard %q (want %q), reissued %q", got, shard, reissued)
+		}
+	}
+
+	// Past half the TTL the cookie is renewed for the same shard.
+	clk.Advance(40 * time.Minute)
+	got, renewed := exchange(t, f, cookie)
+	if got != shard || renewed == "" {
+		t.Fatalf("renewal: shard %q (want %q), renewed %q", got, shard, renewed)
+	}
+
+	// A tampered cookie starts a new session.
+	if _, issued := exchange(t, f, cookie[:len(cookie)-2]+"xx"); issued == "" {
+		t.Fatal("tampered cookie was accepted")
+	}
+
+	// Removing the shard moves the session elsewhere.
+	var rest []string
+	for _, s := range []string{"a", "b", "c"} {
+		if s != shard {
+			rest = append(rest, s)
+		}
+	}
+	moved, issued := exchange(t, newFactory(t, clk, rest...), renewed)
+	if moved == shard || issued == "" {
+		t.Fatalf("removed shard: got %q, reissued %q", moved, issued)
+	}
+}
+
+func TestShardConsistency(t *testing.T) {
+	before := newFactory(t, nil, "a", "b", "c", "d")
+	after := newFactory(t, nil, "a", "b", "c", "d", "e")
+	counts := map[string]int{}
+	moved := 0
+	const n = 10000
+	for i := range n {
+		id := fmt.Sprintf("session-%d", i)
+		s1, s2 := before.Shard(id), after.Shard(id)
+		counts[s1]++
+		if s1 != s2 {
+			if s2 != "e" {
+				t.Fatalf("session %s moved from %s to %s, not to the new shard", id, s1, s2)
+			}
+			moved++
+		}
+	}
+	for shard, c := range counts {
+		if c < n/4*8/10 || c > n/4*12/10 {
+			t.Errorf("shard %s got %d of %d sessions", shard, c, n)
+		}
+	}
+	if moved < n/5*8/10 || moved > n/5*12/10 {
+		t.Errorf("%d of %d sessions moved to the new shard, want about a fifth", moved, n)
+	}
+}
@@ -0,0 +1,198 @@
+package extproc
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"sync"
+
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+)
+
+// Streaming response content types.
+const (
+	ContentTypeEventStream = "text/event-stream"
+	ContentTypeNDJSON      = "application/x-ndjson"
+)
+
+// IsStreamingContentType reports whether contentType is an incremental
+// format (SSE or newline-delimited JSON) that must not be buffered.
+func IsStreamingContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case ContentTypeEventStream, ContentTypeNDJSON, "application/jsonl", "application/stream+json":
+		return true
+	}
+	return false
+}
+
+// StreamingMode is how a processor handles streaming response bodies.
+type StreamingMode int
+
+const (
+	// StreamingPassthrough disables response body processing for streaming
+	// responses. It is the default for processors.
+	StreamingPassthrough StreamingMode = iota
+	// StreamingChunks keeps the configured body mode and delivers raw chunks
+	// to ProcessResponseBody.
+	StreamingChunks
+	// StreamingEvents streams the body and delivers complete events to
+	// ProcessResponseEvent. It is the default for EventProcessors.
+	StreamingEvents
+)
+
+// StreamingAware is implemented by processors choosing their StreamingMode.
+type StreamingAware interface {
+	StreamingMode() StreamingMode
+}
+
+// EventProcessor is implemented by processors that inspect streaming
+// responses one event at a time: an SSE event including its terminating
+// blank line, or an NDJSON line including its newline.
+type EventProcessor interface {
+	Processor
+	// ProcessResponseEvent returns the bytes sent in place of event; an
+	// empty result drops the event.
+	ProcessResponseEvent(ctx *RequestContext, event []byte) []byte
+}
+
+func streamingModeOf(p Processor) StreamingMode {
+	if sa, ok := p.(StreamingAware); ok {
+		return sa.StreamingMode()
+	}
+	if _, ok := p.(EventProcessor); ok {
+		return StreamingEvents
+	}
+	return StreamingPassthrough
+}
+
+// applyStreamingMode adjusts the response headers result of a streaming
+// response according to the processor's StreamingMode. A mode override set
+// by the processor itself wins.
+func applyStreamingMode(p Processor, headers http.Header, endOfStream bool, result *ProcessingResult) {
+	if result.ImmediateResponse != nil || result.ModeOverride != nil || endOfStream ||
+		!IsStreamingContentType(headers.Get("content-type")) {
+		return
+	}
+	switch streamingModeOf(p) {
+	case StreamingPassthrough:
+		result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+			ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_NONE,
+			ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		}
+	case StreamingEvents:
+		result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+			ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_STREAMED,
+			ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		}
+		if result.HeaderMutations == nil {
+			result.HeaderMutations = &HeaderMutations{}
+		}
+		result.HeaderMutations.RemoveHeaders = append(result.HeaderMutations.RemoveHeaders, "content-length")
+	}
+}
+
+// eventSplitter adapts an EventProcessor, reassembling streamed body chunks
+// into events.
+type eventSplitter struct {
+	EventProcessor
+
+	mu     sync.Mutex
+	active bool
+	sse    bool
+	buf    []byte
+}
+
+func newEventSplitter(p EventProcessor) *eventSplitter {
+	return &eventSplitter{EventProcessor: p}
+}
+
+// ProcessResponseHeaders detects the event framing of the response.
+func (s *eventSplitter) ProcessResponseHeaders(ctx *RequestContext) *ProcessingResult {
+	result := s.EventProcessor.ProcessResponseHeaders(ctx)
+	contentType := ctx.Headers.Get("content-type")
+	if s.StreamingMode() == StreamingEvents && IsStreamingContentType(contentType) {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		s.mu.Lock()
+		s.active = true
+		s.sse = mediaType == ContentTypeEventStream
+		s.mu.Unlock()
+	}
+	return result
+}
+
+// ProcessResponseBody splits streaming bodies into events; other bodies go
+// to the wrapped processor unchanged.
+func (s *eventSplitter) ProcessResponseBody(ctx *RequestContext, body []byte, endOfStream bool) *ProcessingResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active {
+		return s.EventProcessor.ProcessResponseBody(ctx, body, endOfStream)
+	}
+
+	s.buf = append(s.buf, body...)
+	var out []byte
+	for {
+		end := s.eventEnd()
+		if end < 0 {
+			break
+		}
+		out = append(out, s.EventProcessor.ProcessResponseEvent(ctx, s.buf[:end])...)
+		s.buf = s.buf[end:]
+	}
+	if endOfStream && len(s.buf) > 0 {
+		out = append(out, s.EventProcessor.ProcessResponseEvent(ctx, s.buf)...)
+		s.buf = nil
+	}
+	s.buf = bytes.Clone(s.buf)
+	return ContinueWithBody(out)
+}
+
+// StreamingMode reports the wrapped processor's StreamingMode.
+func (s *eventSplitter) StreamingMode() StreamingMode {
+	return streamingModeOf(s.EventProcessor)
+}
+
+// OnStreamEnd forwards to the wrapped processor.
+func (s *eventSplitter) OnStreamEnd() {
+	if h, ok := s.EventProcessor.(StreamEndHandler); ok {
+		h.OnStreamEnd()
+	}
+}
+
+// OnRequestEnd resets the event framing and forwards to the wrapped
+// processor.
+func (s *eventSplitter) OnRequestEnd() {
+	s.mu.Lock()
+	s.active, s.sse, s.buf = false, false, nil
+	s.mu.Unlock()
+	if h, ok := s.EventProcessor.(RequestEndHandler); ok {
+		h.OnRequestEnd()
+	}
+}
+
+// eventEnd returns the length of the first complete event in buf, or -1.
+func (s *eventSplitter) eventEnd() int {
+	if !s.sse {
+		if i := bytes.IndexByte(s.buf, '\n'); i >= 0 {
+			return i + 1
+		}
+		return -1
+	}
+	end := -1
+	for _, sep := range [][]byte{[]byte("\n\n"), []byte("\r\n\r\n"), []byte("\r\r")} {
+		if i := bytes.Index(s.buf, sep); i >= 0 && (end < 0 || i+len(sep) < end) {
+			end = i + len(sep)
+		}
+	}
+	return end
+}
+
+// Ensure eventSplitter implements EventProcessor, StreamingAware,
+// StreamEndHandler and RequestEndHandler.
+var (
+	_ EventProcessor    = (*eventSplitter)(nil)
+	_ StreamingAware    = (*eventSplitter)(nil)
+	_ StreamEndHandler  = (*eventSplitter)(nil)
+	_ RequestEndHandler = (*eventSplitter)(nil)
+)
@@ -0,0 +1,93 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// pacer spreads a client's response bytes over time at a fixed rate, letting
+// up to burst bytes through without delay.
+type pacer struct {
+	mu sync.Mutex
+	// next is when the bytes reserved so far have been sent at the rate,
+	// less the burst allowance.
+	next time.Time
+}
+
+// reserve accounts n bytes and returns how long to hold them back.
+func (p *pacer) reserve(n int, rate, burst int64, now time.Time) time.Duration {
+	burstDur := time.Duration(float64(burst) / float64(rate) * float64(time.Second))
+	cost := time.Duration(float64(n) / float64(rate) * float64(time.Second))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := p.next
+	if floor := now.Add(-burstDur); start.Before(floor) {
+		start = floor
+	}
+	p.next = start.Add(cost)
+	return max(p.next.Sub(now), 0)
+}
+
+// clients tracks per-client concurrent downloads and bandwidth pacers.
+type clients struct {
+	mu      sync.Mutex
+	active  map[string]int
+	pacers  *lru.Cache[string, *pacer]
+	maxConc int
+}
+
+func newClients(size, maxConcurrent int) (*clients, error) {
+	pacers, err := lru.New[string, *pacer](size)
+	if err != nil {
+		return nil, oops.
+			In("throttle").
+			Code(errcode.CacheInitFailed).
+			With("size", size).
+			Wrapf(err, "failed to create pacer cache")
+	}
+	return &clients{
+		active:  make(map[string]int),
+		pacers:  pacers,
+		maxConc: maxConcurrent,
+	}, nil
+}
+
+// acquire takes a download slot for key, reporting false when the client
+// already has the maximum number of downloads in flight.
+func (c *clients) acquire(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.maxConc > 0 && c.active[key] >= c.maxConc {
+		return false
+	}
+	c.active[key]++
+	return true
+}
+
+// release returns a download slot taken by acquire.
+func (c *clients) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active[key] <= 1 {
+		delete(c.active, key)
+		return
+	}
+	c.active[key]--
+}
+
+// pacer returns the bandwidth pacer shared by all downloads of key.
+func (c *clients) pacer(key string) *pacer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pacers.Get(key)
+	if !ok {
+		p = &pacer{}
+		c.pacers.Add(key, p)
+	}
+	return p
+}
@@ -0,0 +1,236 @@
+// Package throttle provides an ext_proc processor that limits concurrent
+// downloads and paces response bandwidth per client on large file routes.
+package throttle
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// Config holds download throttling settings.
+type Config struct {
+	// Routes are the path prefixes to throttle.
+	Routes []string
+	// MaxConcurrent is the number of downloads a client may have in flight;
+	// zero disables the limit.
+	MaxConcurrent int
+	// BytesPerSecond is the response bandwidth shared by a client's
+	// downloads; zero disables pacing.
+	BytesPerSecond int64
+	// Burst is the number of bytes a client may receive without delay.
+	Burst int64
+	// MaxDelay caps how long a single body chunk is held back. It must stay
+	// below the filter's message_timeout.
+	MaxDelay time.Duration
+	// MinSize skips pacing for responses whose Content-Length is smaller.
+	MinSize int64
+	// MaxRanges rejects Range headers with more ranges; zero disables it.
+	MaxRanges int
+	// CacheSize is the number of client pacers kept.
+	CacheSize int
+	// DecisionMode selects whether downloads over the limits are rejected;
+	// those let through are not paced.
+	DecisionMode extproc.DecisionMode
+}
+
+// ProcessorFactory creates download throttling processors.
+type ProcessorFactory struct {
+	cfg     Config
+	clients *clients
+	clock   clock.Clock
+	log     zerolog.Logger
+	decider extproc.Decider
+}
+
+// Option configures a ProcessorFactory.
+type Option func(*ProcessorFactory)
+
+// WithClock sets the clock downloads are paced on.
+func WithClock(c clock.Clock) Option {
+	return func(f *ProcessorFactory) {
+		f.clock = clock.Or(c)
+	}
+}
+
+// NewProcessorFactory creates a new throttling ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger, opts ...Option) (*ProcessorFactory, error) {
+	if cfg.BytesPerSecond < 0 || cfg.Burst < 0 || cfg.MaxConcurrent < 0 {
+		return nil, oops.
+			In("throttle").
+			Code(errcode.InvalidConfig).
+			With("bytes_per_second", cfg.BytesPerSecond).
+			With("burst", cfg.Burst).
+			With("max_concurrent", cfg.MaxConcurrent).
+			New("throttle limits must not be negative")
+	}
+	clients, err := newClients(cfg.CacheSize, cfg.MaxConcurrent)
+	if err != nil {
+		return nil, err
+	}
+	log = log.With().Str("processor", "throttle").Logger()
+	f := &ProcessorFactory{
+		cfg:     cfg,
+		clients: clients,
+		clock:   clock.Real,
+		log:     log,
+		decider: extproc.NewDecider("throttle", cfg.DecisionMode, log),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f, nil
+}
+
+// NewProcessor creates a new throttling processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f, done: make(chan struct{})}
+}
+
+// Processor throttles a single download.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	client    string
+	pacing    atomic.Bool
+	release   sync.Once
+	holdsSlot atomic.Bool
+	done      chan struct{}
+	end       sync.Once
+}
+
+// ProcessRequestHeaders admits the download and switches the response body
+// to streamed mode so chunks can be paced.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	path, _, _ := strings.Cut(ctx.Headers.Get(":path"), "?")
+	if ctx.Headers.Get(":method") != http.MethodGet || !f.matches(path) {
+		return extproc.ContinueResult()
+	}
+
+	if f.cfg.MaxRanges > 0 && countRanges(ctx.Headers.Get("range")) > f.cfg.MaxRanges {
+		return f.decider.Reject(ctx.GetRequestID(), "too_many_ranges",
+			extproc.ImmediateResult(http.StatusRequestedRangeNotSatisfiable, nil, []byte("too many ranges\n")), nil)
+	}
+
+	ip, err := ctx.GetDownstreamRemoteIP()
+	if err != nil {
+		f.log.Debug().Err(err).Str("request_id", ctx.GetRequestID()).Msg("client address unknown, not throttling")
+		return extproc.ContinueResult()
+	}
+	p.client = ip.String()
+
+	if !f.clients.acquire(p.client) {
+		f.log.Info().
+			Str("client", p.client).
+			Str("path", path).
+			Int("max_concurrent", f.cfg.MaxConcurrent).
+			Str("request_id", ctx.GetRequestID()).
+			Msg("concurrent download limit exceeded")
+		return f.decider.Reject(ctx.GetRequestID(), "max_concurrent", extproc.ImmediateResult(http.StatusTooManyRequests, []*envoy_api_v3_core.HeaderValueOption{
+			extproc.SetHeader("retry-after", "1"),
+		}, []byte("too many concurrent downloads\n")), nil)
+	}
+	p.holdsSlot.Store(true)
+	p.pacing.Store(f.cfg.BytesPerSecond > 0)
+
+	result := extproc.ContinueResult()
+	result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+		ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SEND,
+		ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_STREAMED,
+		RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+	}
+	return result
+}
+
+// ProcessResponseHeaders stops throttling error and small responses.
+func (p *Processor) ProcessResponseHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	if !p.holdsSlot.Load() {
+		return extproc.ContinueResult()
+	}
+	status, _ := strconv.Atoi(ctx.Headers.Get(":status"))
+	length, err := strconv.ParseInt(ctx.Headers.Get("content-length"), 10, 64)
+	small := err == nil && length < p.factory.cfg.MinSize
+	if ctx.EndOfStream || status < 200 || status >= 300 || small {
+		p.pacing.Store(false)
+		p.releaseSlot()
+	}
+	return extproc.ContinueResult()
+}
+
+// ProcessResponseBody holds each chunk back until the client's bandwidth
+// allows it.
+func (p *Processor) ProcessResponseBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	if p.pacing.Load() && len(body) > 0 {
+		cfg := p.factory.cfg
+		delay := p.factory.clients.pacer(p.client).reserve(len(body), cfg.BytesPerSecond, cfg.Burst, p.factory.clock.Now())
+		if cfg.MaxDelay > 0 {
+			delay = min(delay, cfg.MaxDelay)
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-p.done:
+				timer.Stop()
+			}
+		}
+	}
+	if endOfStream {
+		p.releaseSlot()
+	}
+	return extproc.ContinueResult()
+}
+
+// OnStreamEnd releases the download slot when the stream ends early.
+func (p *Processor) OnStreamEnd() {
+	p.end.Do(func() { close(p.done) })
+	p.releaseSlot()
+}
+
+func (p *Processor) releaseSlot() {
+	if !p.holdsSlot.Load() {
+		return
+	}
+	p.release.Do(func() { p.factory.clients.release(p.client) })
+}
+
+func (f *ProcessorFactory) matches(path string) bool {
+	for _, prefix := range f.cfg.Routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// countRanges returns the number of byte ranges in a Range header value.
+func countRanges(header string) int {
+	_, spec, ok := strings.Cut(header, "=")
+	if !ok {
+		return 0
+	}
+	return strings.Count(spec, ",") + 1
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
+
+// Ensure Processor implements extproc.StreamEndHandler.
+var _ extproc.StreamEndHandler = (*Processor)(nil)
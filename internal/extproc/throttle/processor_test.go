@@ -0,0 +1,255 @@
+package throttle
+
+import (
+	"net/http"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/rs/zerolog"
+)
+
+const client = "198.51.100.1"
+
+func newFactory(t *testing.T, cfg Config, opts ...Option) *ProcessorFactory {
+	t.Helper()
+	cfg.Routes = []string{"/files/"}
+	cfg.CacheSize = 16
+	f, err := NewProcessorFactory(cfg, zerolog.Nop(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// start admits a download for client and returns its processor.
+func start(t *testing.T, f *ProcessorFactory, headers ...string) (*Processor, *extproc.ProcessingResult) {
+	t.Helper()
+	p := f.NewProcessor().(*Processor)
+	ctx := extproctest.NewContext(map[string]string{"source.address": client + ":40000"},
+		append([]string{":method", "GET", ":path", "/files/a.iso"}, headers...)...)
+	return p, p.ProcessRequestHeaders(ctx)
+}
+
+// active returns the number of download slots client holds.
+func active(f *ProcessorFactory) int {
+	f.clients.mu.Lock()
+	defer f.clients.mu.Unlock()
+	return f.clients.active[client]
+}
+
+func responseHeaders(endOfStream bool, headers ...string) *extproc.RequestContext {
+	ctx := extproctest.NewContext(nil, headers...)
+	ctx.EndOfStream = endOfStream
+	return ctx
+}
+
+func TestSlotReleased(t *testing.T) {
+	for name, finish := range map[string]func(p *Processor){
+		"complete body": func(p *Processor) {
+			p.ProcessResponseHeaders(responseHeaders(false, ":status", "200", "content-length", "8"))
+			p.ProcessResponseBody(nil, []byte("data"), false)
+			p.ProcessResponseBody(nil, []byte("data"), true)
+		},
+		"error status": func(p *Processor) {
+			p.ProcessResponseHeaders(responseHeaders(false, ":status", "404"))
+		},
+		"headers only": func(p *Processor) {
+			p.ProcessResponseHeaders(responseHeaders(true, ":status", "200"))
+		},
+		"small response": func(p *Processor) {
+			p.ProcessResponseHeaders(responseHeaders(false, ":status", "200", "content-length", "10"))
+		},
+		"stream ended before the response": func(p *Processor) {
+			p.OnStreamEnd()
+		},
+		"stream ended mid-body": func(p *Processor) {
+			p.ProcessResponseHeaders(responseHeaders(false, ":status", "200"))
+			p.ProcessResponseBody(nil, []byte("data"), false)
+			p.OnStreamEnd()
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newFactory(t, Config{MaxConcurrent: 2, MinSize: 1024})
+			other, _ := start(t, f)
+			p, result := start(t, f)
+			extproctest.Check(t, result, extproctest.ExpectContinue())
+			if got := active(f); got != 2 {
+				t.Fatalf("active = %d after admission, want 2", got)
+			}
+
+			finish(p)
+			if got := active(f); got != 1 {
+				t.Errorf("active = %d, want 1", got)
+			}
+			// The server always ends the stream; the slot is not released
+			// twice, which would free the other download's.
+			p.OnStreamEnd()
+			if got := active(f); got != 1 {
+				t.Errorf("active = %d after stream end, want 1", got)
+			}
+			other.OnStreamEnd()
+			if got := active(f); got != 0 {
+				t.Errorf("active = %d after all downloads ended, want 0", got)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	f := newFactory(t, Config{MaxConcurrent: 1})
+	first, _ := start(t, f)
+	first.ProcessResponseHeaders(responseHeaders(false, ":status", "200"))
+
+	p, result := start(t, f)
+	extproctest.Check(t, result,
+		extproctest.ExpectDenied(http.StatusTooManyRequests),
+		extproctest.ExpectHeaderSet("retry-after", "1"),
+	)
+	// A rejected request holds no slot to release.
+	p.OnStreamEnd()
+	if got := active(f); got != 1 {
+		t.Errorf("active = %d after a rejected request ended, want 1", got)
+	}
+
+	first.ProcessResponseBody(nil, []byte("data"), true)
+	_, result = start(t, f)
+	extproctest.Check(t, result, extproctest.ExpectContinue())
+}
+
+func TestLogOnly(t *testing.T) {
+	f := newFactory(t, Config{MaxConcurrent: 1, MaxRanges: 2, DecisionMode: extproc.DecisionLogOnly})
+	start(t, f)
+
+	// Downloads over the limit are let through without a slot or pacing.
+	p, result := start(t, f)
+	extproctest.Check(t, result, extproctest.ExpectContinue())
+	if result.ModeOverride != nil || p.pacing.Load() {
+		t.Error("download let through over the limit is throttled")
+	}
+	p.OnStreamEnd()
+	if got := active(f); got != 1 {
+		t.Errorf("active = %d, want 1", got)
+	}
+
+	_, result = start(t, f, "range", "bytes=0-1,2-3,4-5")
+	extproctest.Check(t, result, extproctest.ExpectContinue())
+}
+
+func TestTooManyRanges(t *testing.T) {
+	f := newFactory(t, Config{MaxConcurrent: 1, MaxRanges: 2})
+	_, result := start(t, f, "range", "bytes=0-1,2-3,4-5")
+	extproctest.Check(t, result, extproctest.ExpectDenied(http.StatusRequestedRangeNotSatisfiable))
+	if got := active(f); got != 0 {
+		t.Errorf("active = %d after a rejected range request, want 0", got)
+	}
+	_, result = start(t, f, "range", "bytes=0-1,2-3")
+	extproctest.Check(t, result, extproctest.ExpectContinue())
+}
+
+func TestPacing(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		f := newFactory(t, Config{BytesPerSecond: 100, Burst: 100, MaxDelay: 5 * time.Second})
+		p, _ := start(t, f)
+		p.ProcessResponseHeaders(responseHeaders(false, ":status", "200"))
+
+		// The burst passes at once; the next 200 bytes take two seconds.
+		begin := time.Now()
+		p.ProcessResponseBody(nil, make([]byte, 100), false)
+		if waited := time.Since(begin); waited != 0 {
+			t.Errorf("burst held back %v", waited)
+		}
+		p.ProcessResponseBody(nil, make([]byte, 200), false)
+		if waited := time.Since(begin); waited != 2*time.Second {
+			t.Errorf("waited %v, want 2s", waited)
+		}
+		// A single chunk is held back at most MaxDelay.
+		begin = time.Now()
+		p.ProcessResponseBody(nil, make([]byte, 1000), false)
+		if waited := time.Since(begin); waited != 5*time.Second {
+			t.Errorf("waited %v, want MaxDelay", waited)
+		}
+
+		// Ending the stream stops a chunk's wait and frees the slot.
+		done := make(chan struct{})
+		go func() {
+			p.ProcessResponseBody(nil, make([]byte, 100), false)
+			close(done)
+		}()
+		synctest.Wait()
+		begin = time.Now()
+		p.OnStreamEnd()
+		<-done
+		if waited := time.Since(begin); waited != 0 {
+			t.Errorf("chunk held back %v after the stream ended", waited)
+		}
+		if got := active(f); got != 0 {
+			t.Errorf("active = %d, want 0", got)
+		}
+	})
+}
+
+func TestPacingClock(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		clk := clock.NewFake(time.Unix(1700000000, 0))
+		f := newFactory(t, Config{BytesPerSecond: 100, Burst: 100, MaxDelay: 5 * time.Second}, WithClock(clk))
+		p, _ := start(t, f)
+		p.ProcessResponseHeaders(responseHeaders(false, ":status", "200"))
+
+		// The bucket refills on the factory's clock, not the system's.
+		begin := time.Now()
+		p.ProcessResponseBody(nil, make([]byte, 100), false)
+		clk.Advance(time.Second)
+		p.ProcessResponseBody(nil, make([]byte, 100), false)
+		if waited := time.Since(begin); waited != 0 {
+			t.Errorf("waited %v after the clock refilled the bucket", waited)
+		}
+		p.ProcessResponseBody(nil, make([]byte, 100), false)
+		if waited := time.Since(begin); waited != time.Second {
+			t.Errorf("waited %v, want 1s", waited)
+		}
+	})
+}
+
+func TestSlotReleasedPerRequestOnReusedStream(t *testing.T) {
+	f, err := NewProcessorFactory(Config{Routes: []string{"/files/"}, MaxConcurrent: 1, CacheSize: 16}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := map[string]string{"source.address": "198.51.100.1:40000"}
+	download := func() []*envoy_service_proc_v3.ProcessingRequest {
+		return []*envoy_service_proc_v3.ProcessingRequest{
+			extproctest.RequestHeaders(attrs, ":method", "GET", ":path", "/files/a.iso"),
+			extproctest.ResponseHeaders(":status", "200", "content-length", "4"),
+			extproctest.ResponseBody("data", true),
+		}
+	}
+
+	// Two complete downloads on one stream each get the slot.
+	sent := extproctest.Run(t, f, append(download(), download()...)...)
+	for _, i := range []int{0, 3} {
+		if got := extproctest.ImmediateStatus(sent[i]); got != 0 {
+			t.Errorf("download %d: status %d, want admitted", i/3+1, got)
+		}
+	}
+	// A download abandoned mid-body frees its slot for the next request.
+	sent = extproctest.Run(t, f,
+		extproctest.RequestHeaders(attrs, ":method", "GET", ":path", "/files/a.iso"),
+		extproctest.ResponseHeaders(":status", "200", "content-length", "4"),
+		extproctest.ResponseBody("da", false),
+		extproctest.RequestHeaders(attrs, ":method", "GET", ":path", "/files/b.iso"),
+	)
+	if got := extproctest.ImmediateStatus(sent[3]); got != 0 {
+		t.Errorf("after an abandoned download: status %d, want admitted", got)
+	}
+	// No slot is left behind for a later stream.
+	sent = extproctest.Run(t, f, extproctest.RequestHeaders(attrs, ":method", "GET", ":path", "/files/c.iso"))
+	if got := extproctest.ImmediateStatus(sent[0]); got != 0 {
+		t.Errorf("later stream: status %d, want admitted", got)
+	}
+}
@@ -0,0 +1,147 @@
+package extproc
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/crashreport"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+var phaseTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "extproc_phase_timeouts_total",
+	Help: "Messages answered with the fallback result because the processor overran the phase timeout, by processor and phase.",
+}, []string{"processor", "phase"})
+
+func init() {
+	metrics.Registry.MustRegister(phaseTimeoutsTotal)
+}
+
+// TimeoutPolicy selects the fallback result of messages whose processor
+// overran the phase timeout.
+type TimeoutPolicy int
+
+const (
+	// TimeoutAuto is TimeoutDeny for processors that reject requests and
+	// TimeoutContinue for others. The Server cannot tell them apart and
+	// treats it as TimeoutDeny; callers that can resolve it first.
+	TimeoutAuto TimeoutPolicy = iota
+	// TimeoutContinue lets the message through unchanged.
+	TimeoutContinue
+	// TimeoutDeny answers with 504 Gateway Timeout.
+	TimeoutDeny
+)
+
+var timeoutPolicyNames = map[string]TimeoutPolicy{
+	"auto":     TimeoutAuto,
+	"continue": TimeoutContinue,
+	"deny":     TimeoutDeny,
+}
+
+// ParseTimeoutPolicy parses "auto", "continue" or "deny".
+func ParseTimeoutPolicy(name string) (TimeoutPolicy, error) {
+	policy, ok := timeoutPolicyNames[name]
+	if !ok {
+		return 0, oops.In("extproc").Code(errcode.InvalidConfig).With("policy", name).Errorf("unknown phase timeout policy %q", name)
+	}
+	return policy, nil
+}
+
+// timeoutDenyResult is the fallback of TimeoutDeny. It is shared and must
+// not be modified.
+var timeoutDenyResult = ImmediateResult(http.StatusGatewayTimeout, nil, []byte("processing timed out"))
+
+// WithPhaseTimeout bounds the time a processor may spend on a message.
+// Overrunning messages are answered right away with the fallback result of
+// policy, so a slow dependency cannot hold a request until Envoy's
+// message_timeout; 0 disables. The overrunning call is abandoned, not
+// interrupted.
+func WithPhaseTimeout(timeout time.Duration, policy TimeoutPolicy) ServerOption {
+	return func(s *Server) {
+		s.phaseTimeout = timeout
+		s.timeoutPolicy = policy
+	}
+}
+
+// processTimed processes p within the phase timeout, setting its response.
+// Once a message of a request overran, the rest of the request is answered
+// with the fallback too: the processor missed a message, and its abandoned
+// call may still be running. overran is reset when the next request starts.
+func (s *Server) processTimed(
+	processor Processor,
+	name string,
+	p *pending,
+	mem *MemoryAccount,
+	overran *atomic.Bool,
+	log zerolog.Logger,
+) {
+	if s.phaseTimeout <= 0 {
+		p.r = newResponse()
+		p.resp = s.processOne(processor, p.req, mem, p.request, p.r, log)
+		return
+	}
+	if overran.Load() {
+		p.r = newResponse()
+		p.resp = s.fallback(p.req, p.r)
+		return
+	}
+
+	r := newResponse()
+	done := make(chan *envoy_service_proc_v3.ProcessingResponse, 1)
+	go func() {
+		defer crashreport.Recover()
+		done <- s.processOne(processor, p.req, mem, p.request, r, log)
+	}()
+	timer := time.NewTimer(s.phaseTimeout)
+	defer timer.Stop()
+	select {
+	case resp := <-done:
+		p.r, p.resp = r, resp
+		return
+	case <-timer.C:
+	}
+
+	overran.Store(true)
+	phase := phaseName(p.req)
+	phaseTimeoutsTotal.WithLabelValues(name, phase).Inc()
+	log.Warn().
+		Str("phase", phase).
+		Dur("timeout", s.phaseTimeout).
+		Bool("deny", s.timeoutPolicy != TimeoutContinue).
+		Msg("processor overran the phase timeout, answering with the fallback result")
+	// The abandoned call still writes to r.
+	go func() {
+		<-done
+		r.release()
+	}()
+	p.r = newResponse()
+	p.resp = s.fallback(p.req, p.r)
+}
+
+// fallback builds the message answering req under the timeout policy.
+func (s *Server) fallback(req *envoy_service_proc_v3.ProcessingRequest, r *response) *envoy_service_proc_v3.ProcessingResponse {
+	result := timeoutDenyResult
+	if s.timeoutPolicy == TimeoutContinue {
+		result = continueResult
+	}
+	switch req.Request.(type) {
+	case *envoy_service_proc_v3.ProcessingRequest_RequestHeaders:
+		return r.headersResponse(result, true)
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseHeaders:
+		return r.headersResponse(result, false)
+	case *envoy_service_proc_v3.ProcessingRequest_RequestBody:
+		return r.bodyResponse(result, true)
+	case *envoy_service_proc_v3.ProcessingRequest_ResponseBody:
+		return r.bodyResponse(result, false)
+	case *envoy_service_proc_v3.ProcessingRequest_RequestTrailers:
+		return r.trailersResponse(result, true)
+	default:
+		return r.trailersResponse(result, false)
+	}
+}
@@ -0,0 +1,113 @@
+package extproc
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/rs/zerolog"
+)
+
+// blockedProcessor hangs on request headers until release is closed.
+type blockedProcessor struct {
+	BaseProcessor
+	release chan struct{}
+}
+
+func (p *blockedProcessor) ProcessRequestHeaders(*RequestContext) *ProcessingResult {
+	<-p.release
+	return ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{SetHeader("x-processed", "1")})
+}
+
+type blockedFactory struct{ release chan struct{} }
+
+func (f blockedFactory) NewProcessor() Processor { return &blockedProcessor{release: f.release} }
+
+func TestPhaseTimeout(t *testing.T) {
+	headers := benchRequests()["request_headers"]
+	body := benchRequests()["request_body"]
+	for _, policy := range []TimeoutPolicy{TimeoutContinue, TimeoutDeny} {
+		release := make(chan struct{})
+		stream := &fakeStream{requests: []*envoy_service_proc_v3.ProcessingRequest{headers, body}}
+		s := NewServer(blockedFactory{release: release}, zerolog.Nop(), WithPhaseTimeout(20*time.Millisecond, policy))
+		// Process returns while the processor is still blocked.
+		if err := s.Process(stream); err != nil {
+			t.Fatalf("policy %d: %v", policy, err)
+		}
+		close(release)
+		if len(stream.sent) != 2 {
+			t.Fatalf("policy %d: sent %d responses, want 2", policy, len(stream.sent))
+		}
+		first := stream.sent[0]
+		switch policy {
+		case TimeoutContinue:
+			if first.GetRequestHeaders() == nil || first.GetRequestHeaders().GetResponse().GetHeaderMutation() != nil {
+				t.Errorf("continue: first response = %v, want an unmodified continue", first)
+			}
+			if stream.sent[1].GetRequestBody() == nil {
+				t.Errorf("continue: second response = %v, want a body continue", stream.sent[1])
+			}
+		case TimeoutDeny:
+			if got := first.GetImmediateResponse().GetStatus().GetCode(); int(got) != http.StatusGatewayTimeout {
+				t.Errorf("deny: status = %d, want 504", got)
+			}
+		}
+	}
+}
+
+func TestPhaseTimeoutNotReached(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	stream := &fakeStream{requests: []*envoy_service_proc_v3.ProcessingRequest{benchRequests()["request_headers"]}}
+	s := NewServer(blockedFactory{release: release}, zerolog.Nop(), WithPhaseTimeout(time.Second, TimeoutDeny))
+	if err := s.Process(stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.sent) != 1 || stream.sent[0].GetRequestHeaders().GetResponse().GetHeaderMutation() == nil {
+		t.Errorf("responses = %v, want the processor's header mutation", stream.sent)
+	}
+}
+
+// TestPhaseTimeoutPerRequest checks that an overrun only degrades its own
+// request on a reused stream.
+func TestPhaseTimeoutPerRequest(t *testing.T) {
+	reqs := benchRequests()
+	release := make(chan struct{})
+	stream := &fakeStream{requests: []*envoy_service_proc_v3.ProcessingRequest{
+		reqs["request_headers"], reqs["response_headers"],
+		reqs["request_headers"], reqs["response_headers"],
+	}}
+	f := &slowFirstFactory{release: release}
+	s := NewServer(f, zerolog.Nop(), WithDispatch(DispatchSequential, 1), WithPhaseTimeout(20*time.Millisecond, TimeoutContinue))
+	if err := s.Process(stream); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if len(stream.sent) != 4 {
+		t.Fatalf("sent %d responses, want 4", len(stream.sent))
+	}
+	if stream.sent[0].GetRequestHeaders().GetResponse().GetHeaderMutation() != nil {
+		t.Errorf("first request: %v, want the fallback", stream.sent[0])
+	}
+	if stream.sent[2].GetRequestHeaders().GetResponse().GetHeaderMutation() == nil {
+		t.Errorf("second request: %v, want the processor's header mutation", stream.sent[2])
+	}
+}
+
+// slowFirstFactory creates a blocked processor for its first request only.
+type slowFirstFactory struct {
+	release chan struct{}
+	created int
+}
+
+func (f *slowFirstFactory) NewProcessor() Processor {
+	f.created++
+	if f.created == 1 {
+		return &blockedProcessor{release: f.release}
+	}
+	done := make(chan struct{})
+	close(done)
+	return &blockedProcessor{release: done}
+}
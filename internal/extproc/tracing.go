@@ -0,0 +1,121 @@
+package extproc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTracing records a span per processed message, named after its phase,
+// as a child of the trace context propagator extracts from the request
+// headers.
+func WithTracing(tracer trace.Tracer, propagator propagation.TextMapPropagator) ServerOption {
+	return func(s *Server) {
+		s.tracer = tracer
+		s.propagator = propagator
+	}
+}
+
+// traceParent returns the context spans of req's request are children of:
+// the trace context of its request headers, or parent for later phases.
+// A new request without request headers starts from the stream context.
+func (s *Server) traceParent(
+	stream, parent context.Context,
+	req *envoy_service_proc_v3.ProcessingRequest,
+	newRequest bool,
+) context.Context {
+	if s.tracer == nil {
+		return nil
+	}
+	if h := req.GetRequestHeaders(); h != nil {
+		return s.propagator.Extract(stream, headerMapCarrier{h.GetHeaders()})
+	}
+	if newRequest || parent == nil {
+		return stream
+	}
+	return parent
+}
+
+// traceMessage records the span of a message processor handled from start
+// for duration.
+func (s *Server) traceMessage(
+	processor string,
+	p *pending,
+	start time.Time,
+	duration time.Duration,
+) {
+	if s.tracer == nil {
+		return
+	}
+	phase := phaseName(p.req)
+	_, span := s.tracer.Start(p.trace, "ext_proc "+phase,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("extproc.processor", processor),
+			attribute.String("extproc.phase", phase),
+			attribute.Int("extproc.request", p.request),
+			attribute.Float64("extproc.processor.duration_seconds", p.r.processing.Seconds()),
+		),
+	)
+	if ir := p.resp.GetImmediateResponse(); ir != nil {
+		span.SetAttributes(
+			attribute.String("extproc.status", "immediate_response"),
+			attribute.Int("http.response.status_code", int(ir.GetStatus().GetCode())),
+		)
+		if ir.GetStatus().GetCode() >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+	} else if common := commonResponse(p.resp); common != nil {
+		span.SetAttributes(attribute.String("extproc.status", common.GetStatus().String()))
+	}
+	span.End(trace.WithTimestamp(start.Add(duration)))
+}
+
+// commonResponse returns the phase response of resp, nil for immediate
+// responses.
+func commonResponse(resp *envoy_service_proc_v3.ProcessingResponse) *envoy_service_proc_v3.CommonResponse {
+	switch v := resp.GetResponse().(type) {
+	case *envoy_service_proc_v3.ProcessingResponse_RequestHeaders:
+		return v.RequestHeaders.GetResponse()
+	case *envoy_service_proc_v3.ProcessingResponse_ResponseHeaders:
+		return v.ResponseHeaders.GetResponse()
+	case *envoy_service_proc_v3.ProcessingResponse_RequestBody:
+		return v.RequestBody.GetResponse()
+	case *envoy_service_proc_v3.ProcessingResponse_ResponseBody:
+		return v.ResponseBody.GetResponse()
+	default:
+		// Trailer responses carry no status.
+		return nil
+	}
+}
+
+// headerMapCarrier reads trace context from an ext_proc header map.
+type headerMapCarrier struct {
+	m *envoy_api_v3_core.HeaderMap
+}
+
+func (c headerMapCarrier) Get(key string) string {
+	return findHeader(c.m, strings.ToLower(key))
+}
+
+// Set is a no-op; trace context is only extracted.
+func (c headerMapCarrier) Set(string, string) {}
+
+func (c headerMapCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.m.GetHeaders()))
+	for _, h := range c.m.GetHeaders() {
+		keys = append(keys, h.GetKey())
+	}
+	return keys
+}
+
+// Ensure headerMapCarrier implements propagation.TextMapCarrier.
+var _ propagation.TextMapCarrier = headerMapCarrier{}
@@ -0,0 +1,113 @@
+package extproc
+
+import (
+	"testing"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// denyPostProcessor rejects POST requests at request headers.
+type denyPostProcessor struct{ BaseProcessor }
+
+func (denyPostProcessor) ProcessRequestHeaders(ctx *RequestContext) *ProcessingResult {
+	if ctx.Headers.Get(":method") == "POST" {
+		return ImmediateResult(403, nil, nil)
+	}
+	return ContinueResult()
+}
+
+type denyPostFactory struct{}
+
+func (denyPostFactory) NewProcessor() Processor { return denyPostProcessor{} }
+
+func headersRequest(kv ...string) *envoy_service_proc_v3.ProcessingRequest {
+	m := &envoy_api_v3_core.HeaderMap{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		m.Headers = append(m.Headers, &envoy_api_v3_core.HeaderValue{Key: kv[i], RawValue: []byte(kv[i+1])})
+	}
+	return &envoy_service_proc_v3.ProcessingRequest{Request: &envoy_service_proc_v3.ProcessingRequest_RequestHeaders{
+		RequestHeaders: &envoy_service_proc_v3.HttpHeaders{Headers: m},
+	}}
+}
+
+func TestTracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	stream := &fakeStream{requests: []*envoy_service_proc_v3.ProcessingRequest{
+		headersRequest(":method", "GET", "traceparent", "00-"+traceID+"-00f067aa0ba902b7-01"),
+		benchRequests()["request_body"],
+		// The next request on the stream carries no trace context.
+		headersRequest(":method", "POST"),
+	}}
+	s := NewServer(denyPostFactory{}, zerolog.Nop(),
+		WithDispatch(DispatchSequential, 1),
+		WithTracing(tp.Tracer("test"), propagation.TraceContext{}))
+	if err := s.Process(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("recorded %d spans, want 3", len(spans))
+	}
+	attrs := func(i int) map[attribute.Key]attribute.Value {
+		m := make(map[attribute.Key]attribute.Value)
+		for _, kv := range spans[i].Attributes() {
+			m[kv.Key] = kv.Value
+		}
+		return m
+	}
+	for i, want := range []struct {
+		name, status string
+		parent       bool
+	}{
+		{"ext_proc request_headers", "CONTINUE", true},
+		{"ext_proc request_body", "CONTINUE", true},
+		{"ext_proc request_headers", "immediate_response", false},
+	} {
+		span := spans[i]
+		if span.Name() != want.name {
+			t.Errorf("span %d name = %q, want %q", i, span.Name(), want.name)
+		}
+		if got := attrs(i)["extproc.status"].AsString(); got != want.status {
+			t.Errorf("span %d status = %q, want %q", i, got, want.status)
+		}
+		if got := attrs(i)["extproc.processor"].AsString(); got != "extproc.denyPostProcessor" {
+			t.Errorf("span %d processor = %q", i, got)
+		}
+		if _, ok := attrs(i)["extproc.processor.duration_seconds"]; !ok {
+			t.Errorf("span %d has no processor duration", i)
+		}
+		if parented := span.Parent().IsValid(); parented != want.parent {
+			t.Errorf("span %d has parent %v, want %v", i, parented, want.parent)
+		}
+		if want.parent && span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("span %d trace = %s, want %s", i, span.SpanContext().TraceID(), traceID)
+		}
+	}
+	if got := attrs(2)["http.response.status_code"].AsInt64(); got != 403 {
+		t.Errorf("status code = %d, want 403", got)
+	}
+}
+
+type namedProcessor struct{ BaseProcessor }
+
+func (namedProcessor) Name() string { return "named" }
+
+func TestProcessorName(t *testing.T) {
+	for processor, want := range map[Processor]string{
+		&denyPostProcessor{}: "extproc.denyPostProcessor",
+		namedProcessor{}:     "named",
+	} {
+		if got := processorName(processor); got != want {
+			t.Errorf("processorName(%T) = %q, want %q", processor, got, want)
+		}
+	}
+}
@@ -1,32 +1,10 @@
 package extproc
 
 import (
-	"net/netip"
-	"strings"
-
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
 	"github.com/samber/oops"
 )
 
-const (
-	HeaderEnvoyExternalAddr = "x-envoy-external-address"
-)
-
-func ParseIPFromAddress(addr string) (netip.Addr, error) {
-	ip, errParse := netip.ParseAddr(strings.Trim(addr, "[]"))
-	if errParse == nil {
-		return ip, nil
-	}
-	ap, errParseAddrPort := netip.ParseAddrPort(addr)
-	if errParseAddrPort == nil {
-		return ap.Addr(), nil
-	}
-	return netip.Addr{}, oops.
-		In("extproc").
-		Code("PARSE_IP_FROM_ADDRESS_FAILED").
-		With("addr", addr).
-		Join(errParse, errParseAddrPort)
-}
-
 func FirstNonEmpty[T comparable](values ...T) T {
 	var empty T
 	for _, v := range values {
@@ -46,5 +24,5 @@ func FirstNonEmptyFn[T comparable](factories ...func() (T, error)) (T, error) {
 			return v, nil
 		}
 	}
-	return empty, oops.New("no non-empty value found")
+	return empty, oops.Code(errcode.MissingAttribute).New("no non-empty value found")
 }
@@ -0,0 +1,368 @@
+package extproc
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/peer"
+)
+
+var (
+	streamGoroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "extproc_stream_goroutines",
+		Help: "Message handler goroutines running across all streams.",
+	})
+	streamsStale = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "extproc_streams_stale",
+		Help: "Open streams that received no message within the watchdog's stale threshold.",
+	})
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "extproc_queue_depth",
+		Help: "Items waiting in background queues, by queue.",
+	}, []string{"queue"})
+	leakWarningsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_leak_warnings_total",
+		Help: "Possible leaks reported by the watchdog, by kind (goroutines, streams, stale_stream or queue).",
+	}, []string{"kind"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(streamGoroutines, streamsStale, queueDepth, leakWarningsTotal)
+}
+
+var (
+	queuesMu sync.Mutex
+	queues   = map[string]func() int{}
+)
+
+// TrackQueue registers a background queue whose depth the watchdog samples.
+// Queues are usually created by commands before the server starts, so the
+// registry is process-wide.
+func TrackQueue(name string, depth func() int) {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	queues[name] = depth
+}
+
+// WatchdogConfig configures a Watchdog.
+type WatchdogConfig struct {
+	// Interval between samples.
+	Interval time.Duration
+	// StaleAfter is how long a stream may go without a message before it is
+	// reported.
+	StaleAfter time.Duration
+	// GrowthSamples is the number of consecutive growing samples of the
+	// goroutine count, stream count or a queue depth reported as a leak.
+	GrowthSamples int
+	// MaxGoroutines reports a leak whenever the process has more goroutines;
+	// 0 disables.
+	MaxGoroutines int
+}
+
+// Watchdog keeps a table of open streams and periodically checks stream,
+// goroutine and queue counts for unexpected growth, logging and counting
+// possible leaks. It serves the stream table as JSON for debugging.
+type Watchdog struct {
+	cfg    WatchdogConfig
+	log    zerolog.Logger
+	nextID atomic.Uint64
+
+	mu      sync.Mutex
+	streams map[uint64]*streamEntry
+	growth  map[string]*growthTracker
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWatchdog creates a Watchdog; Start begins sampling.
+func NewWatchdog(cfg WatchdogConfig, log zerolog.Logger) *Watchdog {
+	return &Watchdog{
+		cfg:     cfg,
+		log:     log.With().Str("component", "watchdog").Logger(),
+		streams: make(map[uint64]*streamEntry),
+		growth:  make(map[string]*growthTracker),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start samples every Interval until Close.
+func (w *Watchdog) Start() {
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(w.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case now := <-ticker.C:
+				w.check(now)
+			}
+		}
+	}()
+}
+
+// Close stops sampling.
+func (w *Watchdog) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+// streamEntry is a row of the stream table.
+type streamEntry struct {
+	id        uint64
+	started   time.Time
+	peer      string
+	authority string
+	processor string
+
+	messages    atomic.Int64
+	goroutines  atomic.Int64
+	request     atomic.Int64
+	lastMessage atomic.Int64
+	phase       atomic.Value
+	stale       bool // guarded by Watchdog.mu
+}
+
+// open adds a stream to the table. It returns nil for a nil Watchdog; a nil
+// entry ignores every update.
+func (w *Watchdog) open(ctx context.Context, processor Processor) *streamEntry {
+	if w == nil {
+		return nil
+	}
+	e := &streamEntry{
+		id:        w.nextID.Add(1),
+		started:   time.Now(),
+		authority: StreamInfoFromContext(ctx).Get(":authority"),
+		processor: processorName(processor),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		e.peer = p.Addr.String()
+	}
+	e.lastMessage.Store(e.started.UnixNano())
+	w.mu.Lock()
+	w.streams[e.id] = e
+	w.mu.Unlock()
+	return e
+}
+
+// close removes a stream from the table.
+func (w *Watchdog) close(e *streamEntry) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	delete(w.streams, e.id)
+	w.mu.Unlock()
+}
+
+func (e *streamEntry) received(req *envoy_service_proc_v3.ProcessingRequest, request int) {
+	if e == nil {
+		return
+	}
+	e.messages.Add(1)
+	e.request.Store(int64(request))
+	e.lastMessage.Store(time.Now().UnixNano())
+	e.phase.Store(phaseName(req))
+}
+
+func (e *streamEntry) goroutineStarted() {
+	if e != nil {
+		e.goroutines.Add(1)
+	}
+}
+
+func (e *streamEntry) goroutineDone() {
+	if e != nil {
+		e.goroutines.Add(-1)
+	}
+}
+
+// processorName returns the name processor is reported under in metrics,
+// logs, traces and the stream table, unwrapping the event splitter: the
+// name a Named processor gives, the package of a type called Processor, or
+// else the type.
+func processorName(processor Processor) string {
+	var v any = processor
+	if es, ok := processor.(*eventSplitter); ok {
+		v = es.EventProcessor
+	}
+	if n, ok := v.(Named); ok {
+		return n.Name()
+	}
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Name() == "Processor" && t.PkgPath() != "" {
+		return path.Base(t.PkgPath())
+	}
+	return strings.TrimLeft(fmt.Sprintf("%T", v), "*")
+}
+
+// growthTracker counts consecutive increases of a sampled value.
+type growthTracker struct {
+	last   int
+	rising int
+}
+
+// observe records v and reports whether it has now grown for n consecutive
+// samples; the count restarts after each report.
+func (g *growthTracker) observe(v, n int) bool {
+	if v > g.last {
+		g.rising++
+	} else {
+		g.rising = 0
+	}
+	g.last = v
+	if n > 0 && g.rising >= n {
+		g.rising = 0
+		return true
+	}
+	return false
+}
+
+func (w *Watchdog) check(now time.Time) {
+	goroutines := runtime.NumGoroutine()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var handlers int64
+	var stale int
+	for _, e := range w.streams {
+		handlers += e.goroutines.Load()
+		idle := now.Sub(time.Unix(0, e.lastMessage.Load()))
+		if w.cfg.StaleAfter <= 0 || idle < w.cfg.StaleAfter {
+			e.stale = false
+			continue
+		}
+		stale++
+		if !e.stale {
+			e.stale = true
+			leakWarningsTotal.WithLabelValues("stale_stream").Inc()
+			w.log.Warn().
+				Uint64("stream", e.id).
+				Str("peer", e.peer).
+				Str("processor", e.processor).
+				Dur("idle", idle).
+				Int64("goroutines", e.goroutines.Load()).
+				Int64("messages", e.messages.Load()).
+				Msg("stream received no message within the stale threshold")
+		}
+	}
+	streamGoroutines.Set(float64(handlers))
+	streamsStale.Set(float64(stale))
+
+	if w.cfg.MaxGoroutines > 0 && goroutines > w.cfg.MaxGoroutines {
+		leakWarningsTotal.WithLabelValues("goroutines").Inc()
+		w.log.Warn().
+			Int("goroutines", goroutines).
+			Int("max", w.cfg.MaxGoroutines).
+			Int("streams", len(w.streams)).
+			Msg("goroutine count above limit")
+	}
+	w.grew("goroutines", "goroutines", goroutines)
+	w.grew("streams", "streams", len(w.streams))
+
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	for name, depth := range queues {
+		d := depth()
+		queueDepth.WithLabelValues(name).Set(float64(d))
+		w.grew("queue:"+name, "queue", d)
+	}
+}
+
+// grew tracks a sampled value and reports sustained growth.
+func (w *Watchdog) grew(series, kind string, v int) {
+	g, ok := w.growth[series]
+	if !ok {
+		g = &growthTracker{last: v}
+		w.growth[series] = g
+		return
+	}
+	if g.observe(v, w.cfg.GrowthSamples) {
+		leakWarningsTotal.WithLabelValues(kind).Inc()
+		w.log.Warn().
+			Str("series", series).
+			Int("value", v).
+			Int("samples", w.cfg.GrowthSamples).
+			Dur("interval", w.cfg.Interval).
+			Msg("count keeps growing, possible leak")
+	}
+}
+
+// ServeHTTP writes the stream table and current counts as JSON, oldest
+// stream first.
+func (w *Watchdog) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	type stream struct {
+		ID         uint64    `json:"id"`
+		Started    time.Time `json:"started"`
+		Age        string    `json:"age"`
+		Idle       string    `json:"idle"`
+		Peer       string    `json:"peer,omitempty"`
+		Authority  string    `json:"authority,omitempty"`
+		Processor  string    `json:"processor"`
+		Request    int64     `json:"request"`
+		Phase      string    `json:"phase,omitempty"`
+		Messages   int64     `json:"messages"`
+		Goroutines int64     `json:"goroutines"`
+	}
+	out := struct {
+		Goroutines int            `json:"goroutines"`
+		Queues     map[string]int `json:"queues"`
+		Streams    []stream       `json:"streams"`
+	}{
+		Goroutines: runtime.NumGoroutine(),
+		Queues:     map[string]int{},
+		Streams:    []stream{},
+	}
+
+	now := time.Now()
+	w.mu.Lock()
+	for _, e := range w.streams {
+		phase, _ := e.phase.Load().(string)
+		out.Streams = append(out.Streams, stream{
+			ID:         e.id,
+			Started:    e.started,
+			Age:        now.Sub(e.started).Round(time.Millisecond).String(),
+			Idle:       now.Sub(time.Unix(0, e.lastMessage.Load())).Round(time.Millisecond).String(),
+			Peer:       e.peer,
+			Authority:  e.authority,
+			Processor:  e.processor,
+			Request:    e.request.Load(),
+			Phase:      phase,
+			Messages:   e.messages.Load(),
+			Goroutines: e.goroutines.Load(),
+		})
+	}
+	w.mu.Unlock()
+	slices.SortFunc(out.Streams, func(a, b stream) int { return cmp.Compare(a.ID, b.ID) })
+
+	queuesMu.Lock()
+	for name, depth := range queues {
+		out.Queues[name] = depth()
+	}
+	queuesMu.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(out)
+}
@@ -0,0 +1,48 @@
+package xmlguard
+
+import (
+	"bytes"
+	"encoding/xml"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/xmlguard"
+)
+
+// reject answers with status and reason, as a SOAP fault of the given
+// version or as plain text for other XML requests.
+func reject(status int, soap, reason string) *extproc.ProcessingResult {
+	var (
+		contentType string
+		body        []byte
+	)
+	switch soap {
+	case "1.1":
+		contentType = "text/xml; charset=utf-8"
+		body = fault(xmlguard.NamespaceSOAP11, "<faultcode>soap:Client</faultcode><faultstring>", reason, "</faultstring>")
+	case "1.2":
+		contentType = "application/soap+xml; charset=utf-8"
+		body = fault(xmlguard.NamespaceSOAP12,
+			`<soap:Code><soap:Value>soap:Sender</soap:Value></soap:Code><soap:Reason><soap:Text xml:lang="en">`,
+			reason, "</soap:Text></soap:Reason>")
+	default:
+		contentType = "text/plain; charset=utf-8"
+		body = []byte(reason + "\n")
+	}
+	return extproc.ImmediateResult(status, []*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader("content-type", contentType),
+	}, body)
+}
+
+// fault builds a SOAP envelope holding a Fault of prefix, the escaped
+// reason and suffix.
+func fault(namespace, prefix, reason, suffix string) []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<soap:Envelope xmlns:soap="` + namespace + `"><soap:Body><soap:Fault>`)
+	b.WriteString(prefix)
+	_ = xml.EscapeText(&b, []byte(reason))
+	b.WriteString(suffix)
+	b.WriteString("</soap:Fault></soap:Body></soap:Envelope>\n")
+	return b.Bytes()
+}
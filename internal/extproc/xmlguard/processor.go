@@ -0,0 +1,216 @@
+// Package xmlguard provides an ext_proc processor that rejects XML and SOAP
+// request bodies that are not well-formed, exceed size limits or declare
+// DTDs and entities, protecting legacy XML services from XXE and entity
+// expansion attacks.
+package xmlguard
+
+import (
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/xmlguard"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// Config holds XML guard settings.
+type Config struct {
+	// Routes are the path prefixes whose XML request bodies are checked.
+	Routes []string
+	// MaxBodyBytes rejects larger XML bodies with 413; 0 disables.
+	MaxBodyBytes int
+	// Validation holds the document limits and DTD handling.
+	Validation xmlguard.Options
+	// OperationHeader, if set, carries the SOAP operation upstream as
+	// "{namespace}local", e.g. for routing or rate limiting.
+	OperationHeader string
+	// DecisionMode selects whether rejected bodies are answered with a
+	// fault or let through.
+	DecisionMode extproc.DecisionMode
+}
+
+// ProcessorFactory creates XML guard processors.
+type ProcessorFactory struct {
+	cfg     Config
+	log     zerolog.Logger
+	decider extproc.Decider
+}
+
+// NewProcessorFactory creates a new XML guard ProcessorFactory.
+func NewProcessorFactory(cfg Config, log zerolog.Logger) *ProcessorFactory {
+	cfg.OperationHeader = strings.ToLower(cfg.OperationHeader)
+	log = log.With().Str("processor", "xmlguard").Logger()
+	return &ProcessorFactory{
+		cfg:     cfg,
+		log:     log,
+		decider: extproc.NewDecider("xmlguard", cfg.DecisionMode, log),
+	}
+}
+
+// NewProcessor creates a new XML guard processor for a single request.
+func (f *ProcessorFactory) NewProcessor() extproc.Processor {
+	return &Processor{factory: f}
+}
+
+// Processor checks a single request body.
+type Processor struct {
+	extproc.BaseProcessor
+	factory *ProcessorFactory
+
+	mu        sync.Mutex
+	matched   bool
+	soap      string
+	requestID string
+	body      []byte
+}
+
+// ProcessRequestHeaders buffers XML bodies of matching routes. Requests
+// with a SOAPAction header or a SOAP 1.2 media type must carry a SOAP
+// envelope.
+func (p *Processor) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	f := p.factory
+	result := &extproc.ProcessingResult{
+		Status:          extproc.ContinueResult().Status,
+		HeaderMutations: &extproc.HeaderMutations{},
+	}
+	if f.cfg.OperationHeader != "" {
+		// Only set from a checked envelope.
+		result.HeaderMutations.RemoveHeaders = []string{f.cfg.OperationHeader}
+	}
+	path, _, _ := strings.Cut(ctx.Headers.Get(":path"), "?")
+	mediaType, _, _ := mime.ParseMediaType(ctx.Headers.Get("content-type"))
+	if ctx.EndOfStream || !isXML(mediaType) || !f.matches(path) {
+		return result
+	}
+	soap := soapVersion(mediaType, ctx.Headers)
+	if encoding := ctx.Headers.Get("content-encoding"); encoding != "" && encoding != "identity" {
+		// Encoded bodies cannot be checked, so they must not get through.
+		return f.decider.Reject(ctx.GetRequestID(), "encoded_body",
+			reject(http.StatusUnsupportedMediaType, soap, "encoded XML bodies are not accepted"), result)
+	}
+	if length, err := strconv.Atoi(ctx.Headers.Get("content-length")); err == nil && f.cfg.MaxBodyBytes > 0 && length > f.cfg.MaxBodyBytes {
+		return f.decider.Reject(ctx.GetRequestID(), "body_too_large",
+			reject(http.StatusRequestEntityTooLarge, soap, "request body too large"), result)
+	}
+
+	p.mu.Lock()
+	p.matched = true
+	p.soap = soap
+	p.requestID = ctx.GetRequestID()
+	p.mu.Unlock()
+
+	result.ModeOverride = &envoy_extensions_ext_proc_v3.ProcessingMode{
+		RequestBodyMode:     envoy_extensions_ext_proc_v3.ProcessingMode_BUFFERED,
+		RequestTrailerMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseHeaderMode:  envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+		ResponseBodyMode:    envoy_extensions_ext_proc_v3.ProcessingMode_NONE,
+		ResponseTrailerMode: envoy_extensions_ext_proc_v3.ProcessingMode_SKIP,
+	}
+	return result
+}
+
+// ProcessRequestBody validates the buffered body.
+func (p *Processor) ProcessRequestBody(_ *extproc.RequestContext, body []byte, endOfStream bool) *extproc.ProcessingResult {
+	f := p.factory
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.matched {
+		return extproc.ContinueResult()
+	}
+
+	p.body = append(p.body, body...)
+	if f.cfg.MaxBodyBytes > 0 && len(p.body) > f.cfg.MaxBodyBytes {
+		p.matched = false
+		return f.decider.Reject(p.requestID, "body_too_large",
+			reject(http.StatusRequestEntityTooLarge, p.soap, "request body too large"), nil)
+	}
+	if !endOfStream {
+		return extproc.ContinueResult()
+	}
+	p.matched = false
+	data := p.body
+	p.body = nil
+
+	doc, err := xmlguard.Validate(data, f.cfg.Validation)
+	if err == nil && p.soap != "" && doc.SOAPVersion != p.soap {
+		err = oops.
+			In("xmlguard").
+			Code(errcode.InvalidXML).
+			With("soap_version", p.soap).
+			With("envelope_version", doc.SOAPVersion).
+			Errorf("body is not a SOAP %s envelope", p.soap)
+	}
+	if err != nil {
+		f.log.Warn().
+			Err(err).
+			Str("request_id", p.requestID).
+			Str("soap_version", p.soap).
+			Int("body_bytes", len(data)).
+			Msg("rejected XML request")
+		status, reason := http.StatusBadRequest, "invalid_xml"
+		if errcode.Is(err, errcode.LimitExceeded) {
+			status, reason = http.StatusRequestEntityTooLarge, "limit_exceeded"
+		}
+		return f.decider.Reject(p.requestID, reason,
+			reject(status, p.soap, "request body rejected: "+errcode.Classify(err).Description), nil)
+	}
+
+	if f.cfg.OperationHeader == "" || doc.Operation.Local == "" {
+		return extproc.ContinueResult()
+	}
+	return extproc.ContinueWithHeaders([]*envoy_api_v3_core.HeaderValueOption{
+		extproc.SetHeader(f.cfg.OperationHeader, operationName(doc.Operation)),
+	})
+}
+
+func (f *ProcessorFactory) matches(path string) bool {
+	for _, prefix := range f.cfg.Routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isXML(mediaType string) bool {
+	switch mediaType {
+	case "text/xml", "application/xml", "application/soap+xml":
+		return true
+	default:
+		return strings.HasSuffix(mediaType, "+xml")
+	}
+}
+
+// soapVersion returns the SOAP version the request claims: 1.2 for its
+// media type, 1.1 for a SOAPAction header, or empty for plain XML.
+func soapVersion(mediaType string, headers http.Header) string {
+	switch {
+	case mediaType == "application/soap+xml":
+		return "1.2"
+	case len(headers.Values("soapaction")) > 0:
+		return "1.1"
+	default:
+		return ""
+	}
+}
+
+func operationName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return "{" + name.Space + "}" + name.Local
+}
+
+// Ensure ProcessorFactory implements extproc.ProcessorFactory.
+var _ extproc.ProcessorFactory = (*ProcessorFactory)(nil)
+
+// Ensure Processor implements extproc.Processor.
+var _ extproc.Processor = (*Processor)(nil)
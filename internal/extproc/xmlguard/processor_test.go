@@ -0,0 +1,126 @@
+package xmlguard
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/internal/xmlguard"
+	"github.com/rs/zerolog"
+)
+
+const envelope12 = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><m:GetOrder xmlns:m="urn:orders"/></s:Body></s:Envelope>`
+
+func TestProcessRequestBody(t *testing.T) {
+	factory := NewProcessorFactory(Config{
+		Routes:          []string{"/soap"},
+		MaxBodyBytes:    256,
+		Validation:      xmlguard.Options{Limits: xmlguard.Limits{MaxDepth: 8}},
+		OperationHeader: "X-SOAP-Operation",
+	}, zerolog.Nop())
+
+	tests := []struct {
+		name    string
+		headers []string
+		body    string
+		expect  []extproctest.Expectation
+	}{
+		{
+			name:    "soap 1.2 operation",
+			headers: []string{"content-type", "application/soap+xml; charset=utf-8"},
+			body:    envelope12,
+			expect: []extproctest.Expectation{
+				extproctest.ExpectContinue(),
+				extproctest.ExpectHeaderSet("x-soap-operation", "{urn:orders}GetOrder"),
+			},
+		},
+		{
+			name:    "plain xml",
+			headers: []string{"content-type", "application/xml"},
+			body:    `<order id="1"/>`,
+			expect:  []extproctest.Expectation{extproctest.ExpectContinue()},
+		},
+		{
+			name:    "soapaction without envelope",
+			headers: []string{"content-type", "text/xml", "soapaction", `"urn:GetOrder"`},
+			body:    `<order id="1"/>`,
+			expect: []extproctest.Expectation{
+				extproctest.ExpectDenied(400),
+				extproctest.ExpectHeaderSet("content-type", "text/xml; charset=utf-8"),
+			},
+		},
+		{
+			name:    "soap version mismatch",
+			headers: []string{"content-type", "text/xml", "soapaction", `""`},
+			body:    envelope12,
+			expect:  []extproctest.Expectation{extproctest.ExpectDenied(400)},
+		},
+		{
+			name:    "entity declaration",
+			headers: []string{"content-type", "application/xml"},
+			body:    `<!DOCTYPE a [<!ENTITY x "y">]><a>&x;</a>`,
+			expect:  []extproctest.Expectation{extproctest.ExpectDenied(400)},
+		},
+		{
+			name:    "too deep",
+			headers: []string{"content-type", "application/xml"},
+			body:    strings.Repeat("<a>", 9) + strings.Repeat("</a>", 9),
+			expect:  []extproctest.Expectation{extproctest.ExpectDenied(413)},
+		},
+		{
+			name:    "too large",
+			headers: []string{"content-type", "application/xml"},
+			body:    "<a>" + strings.Repeat("x", 256) + "</a>",
+			expect:  []extproctest.Expectation{extproctest.ExpectDenied(413)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := factory.NewProcessor()
+			ctx := extproctest.NewContext(nil, append([]string{":method", "POST", ":path", "/soap/orders"}, tt.headers...)...)
+			ctx.EndOfStream = false
+			result := p.ProcessRequestHeaders(ctx)
+			extproctest.Check(t, result, extproctest.ExpectHeaderRemoved("x-soap-operation"))
+			if result.ModeOverride == nil {
+				t.Fatalf("request body not buffered: %s", extproctest.Describe(result))
+			}
+			extproctest.Check(t, p.ProcessRequestBody(ctx, []byte(tt.body), true), tt.expect...)
+		})
+	}
+}
+
+func TestSOAPFault(t *testing.T) {
+	result := reject(400, "1.1", "bad <input>")
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body><soap:Fault><faultcode>soap:Client</faultcode><faultstring>bad &lt;input&gt;</faultstring></soap:Fault></soap:Body></soap:Envelope>
+`
+	if got := string(result.ImmediateResponse.GetBody()); got != want {
+		t.Errorf("fault = %s, want %s", got, want)
+	}
+	if _, err := xmlguard.Validate(result.ImmediateResponse.GetBody(), xmlguard.Options{}); err != nil {
+		t.Errorf("fault is not valid: %v", err)
+	}
+}
+
+func TestProcessRequestHeaders(t *testing.T) {
+	factory := NewProcessorFactory(Config{Routes: []string{"/soap"}, MaxBodyBytes: 16}, zerolog.Nop())
+	for name, tt := range map[string]struct {
+		headers []string
+		expect  extproctest.Expectation
+	}{
+		"other route":    {[]string{":path", "/rest", "content-type", "application/xml"}, extproctest.ExpectContinue()},
+		"not xml":        {[]string{":path", "/soap", "content-type", "application/json"}, extproctest.ExpectContinue()},
+		"encoded":        {[]string{":path", "/soap", "content-type", "application/xml", "content-encoding", "gzip"}, extproctest.ExpectDenied(415)},
+		"length too big": {[]string{":path", "/soap", "content-type", "application/xml", "content-length", "17"}, extproctest.ExpectDenied(413)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := extproctest.NewContext(nil, tt.headers...)
+			ctx.EndOfStream = false
+			result := factory.NewProcessor().ProcessRequestHeaders(ctx)
+			extproctest.Check(t, result, tt.expect)
+			if result.ModeOverride != nil {
+				t.Error("request body buffered")
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+// Package featureflag lets processors gate behavior (enforce mode, sampling
+// rates, experiment buckets) on feature flags evaluated per request. The
+// Provider interface follows the OpenFeature provider contract, so an
+// OpenFeature SDK provider can be adapted to it; results are cached locally
+// by flag and evaluation context.
+package featureflag
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+var evaluationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "featureflag_evaluations_total",
+	Help: "Feature flag evaluations, by flag and reason (STATIC, TARGETING_MATCH, SPLIT, DEFAULT, DISABLED, CACHED or ERROR).",
+}, []string{"flag", "reason"})
+
+func init() {
+	metrics.Registry.MustRegister(evaluationsTotal)
+}
+
+// Reason explains how a value was resolved, using the OpenFeature reasons.
+type Reason string
+
+const (
+	ReasonStatic         Reason = "STATIC"
+	ReasonDefault        Reason = "DEFAULT"
+	ReasonTargetingMatch Reason = "TARGETING_MATCH"
+	ReasonSplit          Reason = "SPLIT"
+	ReasonDisabled       Reason = "DISABLED"
+	ReasonCached         Reason = "CACHED"
+	ReasonError          Reason = "ERROR"
+)
+
+// EvaluationContext describes the request a flag is evaluated for.
+type EvaluationContext struct {
+	// TargetingKey identifies the subject (user, session or request) and
+	// keeps percentage splits sticky for it.
+	TargetingKey string
+	// Attributes are matched by targeting rules, e.g. host, path and method.
+	Attributes map[string]string
+}
+
+// key identifies the context in the cache.
+func (ec EvaluationContext) key() string {
+	var b strings.Builder
+	b.WriteString(ec.TargetingKey)
+	keys := make([]string, 0, len(ec.Attributes))
+	for k := range ec.Attributes {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(ec.Attributes[k])
+	}
+	return b.String()
+}
+
+// Resolution is the result of evaluating a flag. On error, Value is the
+// default value passed to the provider.
+type Resolution[T any] struct {
+	Value   T
+	Variant string
+	Reason  Reason
+	Err     error
+}
+
+// Metadata describes a provider.
+type Metadata struct {
+	Name string
+}
+
+// Provider evaluates flags. Implementations must be safe for concurrent use
+// and return the default value with an error when a flag is missing or has
+// another type.
+type Provider interface {
+	Metadata() Metadata
+	BooleanEvaluation(ctx context.Context, flag string, defaultValue bool, ec EvaluationContext) Resolution[bool]
+	FloatEvaluation(ctx context.Context, flag string, defaultValue float64, ec EvaluationContext) Resolution[float64]
+	StringEvaluation(ctx context.Context, flag string, defaultValue string, ec EvaluationContext) Resolution[string]
+}
+
+// Config holds client settings.
+type Config struct {
+	// Provider is "file" or "ofrep"; other values disable flags.
+	Provider string
+	// File is the FlagSet file of the file provider, polled every
+	// PollInterval.
+	File         string
+	PollInterval time.Duration
+	// OFREPURL and OFREPToken locate the OFREP flag service.
+	OFREPURL   string
+	OFREPToken string
+
+	// TargetingHeader is the request header used as the targeting key.
+	TargetingHeader string
+	// Timeout bounds a single provider evaluation.
+	Timeout time.Duration
+	// CacheSize and CacheTTL bound the local result cache; a zero size
+	// disables it.
+	CacheSize int
+	CacheTTL  time.Duration
+}
+
+// Client evaluates flags through a Provider with local caching. A nil
+// *Client returns the default value of every flag, so processors can hold
+// one unconditionally.
+type Client struct {
+	cfg      Config
+	provider Provider
+	cache    *expirable.LRU[string, any]
+	log      zerolog.Logger
+}
+
+// New creates the Client of the configured provider. It returns a nil Client,
+// which serves default values, when no provider is configured.
+func New(cfg Config, log zerolog.Logger) (*Client, error) {
+	var provider Provider
+	var err error
+	switch cfg.Provider {
+	case "file":
+		provider, err = NewFileProvider(cfg.File, cfg.PollInterval, log)
+	case "ofrep":
+		provider, err = NewOFREPProvider(cfg.OFREPURL, cfg.OFREPToken)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(provider, cfg, log), nil
+}
+
+// NewClient creates a Client for provider.
+func NewClient(provider Provider, cfg Config, log zerolog.Logger) *Client {
+	c := &Client{
+		cfg:      cfg,
+		provider: provider,
+		log:      log.With().Str("component", "featureflag").Str("provider", provider.Metadata().Name).Logger(),
+	}
+	if cfg.CacheSize > 0 {
+		c.cache = expirable.NewLRU[string, any](cfg.CacheSize, nil, cfg.CacheTTL)
+	}
+	return c
+}
+
+// Close releases the provider.
+func (c *Client) Close() error {
+	if c == nil {
+		return nil
+	}
+	if closer, ok := c.provider.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Context builds the evaluation context of a request from its headers: the
+// targeting header's value as targeting key, and the host, path (without
+// query) and method attributes.
+func (c *Client) Context(headers http.Header) EvaluationContext {
+	path, _, _ := strings.Cut(headers.Get(":path"), "?")
+	ec := EvaluationContext{
+		Attributes: map[string]string{
+			"host":   strings.ToLower(headers.Get(":authority")),
+			"path":   path,
+			"method": headers.Get(":method"),
+		},
+	}
+	if c != nil && c.cfg.TargetingHeader != "" {
+		ec.TargetingKey = headers.Get(c.cfg.TargetingHeader)
+	}
+	return ec
+}
+
+// Bool evaluates a boolean flag, returning defaultValue on error.
+func (c *Client) Bool(ctx context.Context, flag string, defaultValue bool, ec EvaluationContext) bool {
+	if c == nil {
+		return defaultValue
+	}
+	return evaluate(ctx, c, "bool", flag, defaultValue, ec, c.provider.BooleanEvaluation)
+}
+
+// Float evaluates a number flag, returning defaultValue on error.
+func (c *Client) Float(ctx context.Context, flag string, defaultValue float64, ec EvaluationContext) float64 {
+	if c == nil {
+		return defaultValue
+	}
+	return evaluate(ctx, c, "float", flag, defaultValue, ec, c.provider.FloatEvaluation)
+}
+
+// String evaluates a string flag, e.g. an experiment bucket, returning
+// defaultValue on error.
+func (c *Client) String(ctx context.Context, flag string, defaultValue string, ec EvaluationContext) string {
+	if c == nil {
+		return defaultValue
+	}
+	return evaluate(ctx, c, "string", flag, defaultValue, ec, c.provider.StringEvaluation)
+}
+
+func evaluate[T any](
+	ctx context.Context,
+	c *Client,
+	kind, flag string,
+	defaultValue T,
+	ec EvaluationContext,
+	eval func(context.Context, string, T, EvaluationContext) Resolution[T],
+) T {
+	key := kind + "\x00" + flag + "\x00" + ec.key()
+	if c.cache != nil {
+		if v, ok := c.cache.Get(key); ok {
+			evaluationsTotal.WithLabelValues(flag, string(ReasonCached)).Inc()
+			return v.(T)
+		}
+	}
+	if c.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+		defer cancel()
+	}
+	res := eval(ctx, flag, defaultValue, ec)
+	if res.Err != nil {
+		evaluationsTotal.WithLabelValues(flag, string(ReasonError)).Inc()
+		c.log.Debug().Err(res.Err).Str("flag", flag).Msg("flag evaluation failed, using default")
+		return defaultValue
+	}
+	evaluationsTotal.WithLabelValues(flag, string(res.Reason)).Inc()
+	if c.cache != nil {
+		c.cache.Add(key, res.Value)
+	}
+	return res.Value
+}
@@ -0,0 +1,81 @@
+package featureflag
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// countingProvider serves flag "on" as true and fails every other flag,
+// counting evaluations.
+type countingProvider struct {
+	calls atomic.Int32
+}
+
+func (p *countingProvider) Metadata() Metadata { return Metadata{Name: "counting"} }
+
+func (p *countingProvider) BooleanEvaluation(_ context.Context, flag string, defaultValue bool, _ EvaluationContext) Resolution[bool] {
+	p.calls.Add(1)
+	if flag != "on" {
+		return Resolution[bool]{Value: defaultValue, Reason: ReasonError, Err: errors.New("unavailable")}
+	}
+	return Resolution[bool]{Value: true, Variant: "on", Reason: ReasonStatic}
+}
+
+func (p *countingProvider) FloatEvaluation(_ context.Context, _ string, defaultValue float64, _ EvaluationContext) Resolution[float64] {
+	return Resolution[float64]{Value: defaultValue, Reason: ReasonDefault}
+}
+
+func (p *countingProvider) StringEvaluation(_ context.Context, _ string, defaultValue string, _ EvaluationContext) Resolution[string] {
+	return Resolution[string]{Value: defaultValue, Reason: ReasonDefault}
+}
+
+func TestClientCache(t *testing.T) {
+	p := &countingProvider{}
+	c := NewClient(p, Config{CacheSize: 10, CacheTTL: 50 * time.Millisecond}, zerolog.Nop())
+	ctx := context.Background()
+	a := EvaluationContext{TargetingKey: "a"}
+
+	for range 3 {
+		if !c.Bool(ctx, "on", false, a) {
+			t.Fatal("flag evaluated false")
+		}
+	}
+	if got := p.calls.Load(); got != 1 {
+		t.Errorf("%d provider calls for a cached flag, want 1", got)
+	}
+	c.Bool(ctx, "on", false, EvaluationContext{TargetingKey: "b"})
+	if got := p.calls.Load(); got != 2 {
+		t.Errorf("%d provider calls, want another for a new context", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	c.Bool(ctx, "on", false, a)
+	if got := p.calls.Load(); got != 3 {
+		t.Errorf("%d provider calls, want another after the TTL", got)
+	}
+}
+
+func TestClientDefaultOnError(t *testing.T) {
+	p := &countingProvider{}
+	c := NewClient(p, Config{CacheSize: 10, CacheTTL: time.Minute}, zerolog.Nop())
+	ctx := context.Background()
+	for _, def := range []bool{true, false} {
+		if got := c.Bool(ctx, "down", def, EvaluationContext{}); got != def {
+			t.Errorf("failed evaluation = %v, want default %v", got, def)
+		}
+	}
+	// Failures are not cached.
+	if got := p.calls.Load(); got != 2 {
+		t.Errorf("%d provider calls, want 2", got)
+	}
+
+	var none *Client
+	if !none.Bool(ctx, "on", true, none.Context(http.Header{})) || none.Float(ctx, "f", 0.5, EvaluationContext{}) != 0.5 || none.String(ctx, "s", "x", EvaluationContext{}) != "x" {
+		t.Error("nil client did not serve defaults")
+	}
+}
@@ -0,0 +1,278 @@
+package featureflag
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+)
+
+// FlagSet is the file format of FileProvider:
+//
+//	flags:
+//	  fault.enabled:
+//	    variants: {on: true, off: false}
+//	    default: off
+//	    rules:
+//	      - when: {host: staging.example.com}
+//	        variant: on
+//	      - rollout: {on: 10, off: 90}
+//
+// Rules are tried in order; the first whose attributes all match selects its
+// variant, or splits its rollout weights by targeting key. Requests no rule
+// selects get the default variant.
+type FlagSet struct {
+	Flags map[string]Flag `yaml:"flags"`
+}
+
+// Flag is a flag definition.
+type Flag struct {
+	Variants map[string]any `yaml:"variants"`
+	Default  string         `yaml:"default"`
+	// Disabled flags evaluate to the caller's default value.
+	Disabled bool   `yaml:"disabled,omitempty"`
+	Rules    []Rule `yaml:"rules,omitempty"`
+}
+
+// Rule selects a variant for matching requests.
+type Rule struct {
+	// When maps evaluation context attributes ("targetingKey" for the
+	// targeting key) to their required values; empty matches every request.
+	When    map[string]string `yaml:"when,omitempty"`
+	Variant string            `yaml:"variant,omitempty"`
+	// Rollout maps variants to relative weights.
+	Rollout map[string]int `yaml:"rollout,omitempty"`
+}
+
+// ParseFlagSet parses and validates a flag file.
+func ParseFlagSet(data []byte) (*FlagSet, error) {
+	var set FlagSet
+	if err := yaml.Unmarshal(data, &set); err != nil {
+		return nil, oops.In("featureflag").Code(errcode.InvalidFlags).Wrapf(err, "failed to parse feature flags")
+	}
+	for name, f := range set.Flags {
+		errorf := oops.In("featureflag").Code(errcode.InvalidFlags).With("flag", name).Errorf
+		if _, ok := f.Variants[f.Default]; !ok {
+			return nil, errorf("flag %q: default variant %q is not defined", name, f.Default)
+		}
+		for i, r := range f.Rules {
+			if (r.Variant == "") == (len(r.Rollout) == 0) {
+				return nil, errorf("flag %q: rule %d must set exactly one of variant and rollout", name, i)
+			}
+			if _, ok := f.Variants[r.Variant]; r.Variant != "" && !ok {
+				return nil, errorf("flag %q: rule %d: variant %q is not defined", name, i, r.Variant)
+			}
+			total := 0
+			for v, w := range r.Rollout {
+				if _, ok := f.Variants[v]; !ok {
+					return nil, errorf("flag %q: rule %d: rollout variant %q is not defined", name, i, v)
+				}
+				if w < 0 {
+					return nil, errorf("flag %q: rule %d: rollout weight of %q is negative", name, i, v)
+				}
+				total += w
+			}
+			if len(r.Rollout) > 0 && total == 0 {
+				return nil, errorf("flag %q: rule %d: rollout weights sum to zero", name, i)
+			}
+		}
+	}
+	return &set, nil
+}
+
+// resolve returns the variant value of flag for ec.
+func (f *Flag) resolve(name string, ec EvaluationContext) (any, string, Reason) {
+	for _, r := range f.Rules {
+		if !r.matches(ec) {
+			continue
+		}
+		if r.Variant != "" {
+			return f.Variants[r.Variant], r.Variant, ReasonTargetingMatch
+		}
+		variant := r.split(name, ec.TargetingKey)
+		return f.Variants[variant], variant, ReasonSplit
+	}
+	return f.Variants[f.Default], f.Default, ReasonStatic
+}
+
+func (r *Rule) matches(ec EvaluationContext) bool {
+	for k, want := range r.When {
+		got := ec.Attributes[k]
+		if k == "targetingKey" {
+			got = ec.TargetingKey
+		}
+		if got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// split picks a rollout variant, stable for a targeting key and random
+// without one.
+func (r *Rule) split(flag, targetingKey string) string {
+	variants := make([]string, 0, len(r.Rollout))
+	total := 0
+	for v, w := range r.Rollout {
+		variants = append(variants, v)
+		total += w
+	}
+	slices.Sort(variants)
+	var bucket int
+	if targetingKey == "" {
+		bucket = rand.IntN(total)
+	} else {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(flag + "/" + targetingKey))
+		bucket = int(h.Sum32() % uint32(total))
+	}
+	for _, v := range variants {
+		if bucket < r.Rollout[v] {
+			return v
+		}
+		bucket -= r.Rollout[v]
+	}
+	return variants[len(variants)-1]
+}
+
+// FileProvider evaluates flags defined in a YAML file (see FlagSet), or a
+// ConfigMap/Secret reference, reloading it when it changes.
+type FileProvider struct {
+	path string
+	log  zerolog.Logger
+	set  atomic.Pointer[FlagSet]
+	stop context.CancelFunc
+}
+
+// NewFileProvider loads path and follows its changes, polling a file's
+// modification time every interval.
+func NewFileProvider(path string, interval time.Duration, log zerolog.Logger) (*FileProvider, error) {
+	p := &FileProvider{path: path, log: log.With().Str("component", "featureflag").Str("path", path).Logger()}
+	data, err := kube.ReadFile(context.Background(), path)
+	if err != nil {
+		return nil, oops.In("featureflag").Code(errcode.ReadConfigFailed).With("path", path).Wrapf(err, "failed to read feature flags")
+	}
+	if err := p.apply(data); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stop = cancel
+	if kube.IsRef(path) {
+		go kube.WatchFile(ctx, path, p.log, func(data []byte) { _ = p.apply(data) })
+	} else {
+		go p.poll(ctx, interval)
+	}
+	return p, nil
+}
+
+func (p *FileProvider) apply(data []byte) error {
+	set, err := ParseFlagSet(data)
+	if err != nil {
+		p.log.Error().Err(err).Msg("invalid feature flags, keeping previous")
+		return oops.With("path", p.path).Wrap(err)
+	}
+	p.set.Store(set)
+	p.log.Info().Int("flags", len(set.Flags)).Msg("feature flags loaded")
+	audit.Record("feature-flags", audit.File(p.path), data)
+	return nil
+}
+
+func (p *FileProvider) poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var modTime time.Time
+	if info, err := os.Stat(p.path); err == nil {
+		modTime = info.ModTime()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(p.path)
+		if err != nil {
+			p.log.Warn().Err(err).Msg("failed to stat feature flags")
+			continue
+		}
+		if !info.ModTime().After(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		data, err := os.ReadFile(p.path)
+		if err != nil {
+			p.log.Warn().Err(err).Msg("failed to read feature flags")
+			continue
+		}
+		_ = p.apply(data)
+	}
+}
+
+// Close stops following changes.
+func (p *FileProvider) Close() error {
+	p.stop()
+	return nil
+}
+
+// Metadata implements Provider.
+func (p *FileProvider) Metadata() Metadata {
+	return Metadata{Name: "file"}
+}
+
+// BooleanEvaluation implements Provider.
+func (p *FileProvider) BooleanEvaluation(_ context.Context, flag string, defaultValue bool, ec EvaluationContext) Resolution[bool] {
+	return resolveTyped(p.set.Load(), flag, defaultValue, ec, func(v any) (bool, bool) {
+		b, ok := v.(bool)
+		return b, ok
+	})
+}
+
+// FloatEvaluation implements Provider.
+func (p *FileProvider) FloatEvaluation(_ context.Context, flag string, defaultValue float64, ec EvaluationContext) Resolution[float64] {
+	return resolveTyped(p.set.Load(), flag, defaultValue, ec, func(v any) (float64, bool) {
+		switch n := v.(type) {
+		case int:
+			return float64(n), true
+		case float64:
+			return n, true
+		}
+		return 0, false
+	})
+}
+
+// StringEvaluation implements Provider.
+func (p *FileProvider) StringEvaluation(_ context.Context, flag string, defaultValue string, ec EvaluationContext) Resolution[string] {
+	return resolveTyped(p.set.Load(), flag, defaultValue, ec, func(v any) (string, bool) {
+		s, ok := v.(string)
+		return s, ok
+	})
+}
+
+func resolveTyped[T any](set *FlagSet, name string, defaultValue T, ec EvaluationContext, convert func(any) (T, bool)) Resolution[T] {
+	f, ok := set.Flags[name]
+	if !ok {
+		return Resolution[T]{Value: defaultValue, Reason: ReasonError, Err: oops.In("featureflag").Code(errcode.FlagNotFound).Errorf("flag %q not found", name)}
+	}
+	if f.Disabled {
+		return Resolution[T]{Value: defaultValue, Reason: ReasonDisabled}
+	}
+	raw, variant, reason := f.resolve(name, ec)
+	v, ok := convert(raw)
+	if !ok {
+		return Resolution[T]{Value: defaultValue, Reason: ReasonError, Err: oops.In("featureflag").Code(errcode.TypeMismatch).Errorf("flag %q variant %q has type %T", name, variant, raw)}
+	}
+	return Resolution[T]{Value: v, Variant: variant, Reason: reason}
+}
+
+// Ensure FileProvider implements Provider.
+var _ Provider = (*FileProvider)(nil)
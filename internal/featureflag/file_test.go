@@ -0,0 +1,133 @@
+package featureflag
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+)
+
+const testFlags = `
+flags:
+  fault.enabled:
+    variants: {on: true, off: false}
+    default: off
+    rules:
+      - when: {host: staging.example.com}
+        variant: on
+      - when: {targetingKey: tester}
+        variant: on
+  sample.rate:
+    variants: {low: 0.1, all: 1}
+    default: low
+    rules:
+      - rollout: {low: 50, all: 50}
+  bucket:
+    variants: {a: control, b: treatment}
+    default: a
+    disabled: true
+`
+
+func TestParseFlagSet(t *testing.T) {
+	for _, tt := range []struct {
+		name, data string
+	}{
+		{"not yaml", "flags: [\n"},
+		{"undefined default", "flags: {f: {variants: {on: true}, default: off}}"},
+		{"variant and rollout", "flags: {f: {variants: {on: true}, default: on, rules: [{variant: on, rollout: {on: 1}}]}}"},
+		{"neither variant nor rollout", "flags: {f: {variants: {on: true}, default: on, rules: [{when: {host: a}}]}}"},
+		{"undefined rule variant", "flags: {f: {variants: {on: true}, default: on, rules: [{variant: off}]}}"},
+		{"undefined rollout variant", "flags: {f: {variants: {on: true}, default: on, rules: [{rollout: {off: 1}}]}}"},
+		{"negative weight", "flags: {f: {variants: {on: true, off: false}, default: on, rules: [{rollout: {on: 2, off: -1}}]}}"},
+		{"zero weights", "flags: {f: {variants: {on: true}, default: on, rules: [{rollout: {on: 0}}]}}"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseFlagSet([]byte(tt.data)); !errcode.Is(err, errcode.InvalidFlags) {
+				t.Errorf("err = %v, want %s", err, errcode.InvalidFlags)
+			}
+		})
+	}
+	if _, err := ParseFlagSet([]byte(testFlags)); err != nil {
+		t.Errorf("valid flags rejected: %v", err)
+	}
+}
+
+func writeFlags(t *testing.T, path, data string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.yaml")
+	mtime := time.Now().Add(-time.Hour)
+	writeFlags(t, path, testFlags, mtime)
+	p, err := NewFileProvider(path, 5*time.Millisecond, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ctx := context.Background()
+	prod := EvaluationContext{Attributes: map[string]string{"host": "www.example.com"}}
+	staging := EvaluationContext{Attributes: map[string]string{"host": "staging.example.com"}}
+
+	if r := p.BooleanEvaluation(ctx, "fault.enabled", true, prod); r.Value || r.Variant != "off" || r.Reason != ReasonStatic || r.Err != nil {
+		t.Errorf("default variant = %+v", r)
+	}
+	if r := p.BooleanEvaluation(ctx, "fault.enabled", false, staging); !r.Value || r.Reason != ReasonTargetingMatch {
+		t.Errorf("attribute match = %+v", r)
+	}
+	if r := p.BooleanEvaluation(ctx, "fault.enabled", false, EvaluationContext{TargetingKey: "tester"}); !r.Value || r.Reason != ReasonTargetingMatch {
+		t.Errorf("targeting key match = %+v", r)
+	}
+
+	// Splits are sticky per targeting key and use both variants.
+	seen := map[float64]bool{}
+	for _, key := range []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7", "u8", "u9", "u10"} {
+		ec := EvaluationContext{TargetingKey: key}
+		r := p.FloatEvaluation(ctx, "sample.rate", -1, ec)
+		if r.Reason != ReasonSplit || r.Err != nil {
+			t.Fatalf("split = %+v", r)
+		}
+		if again := p.FloatEvaluation(ctx, "sample.rate", -1, ec); again.Value != r.Value {
+			t.Errorf("split for %s changed from %v to %v", key, r.Value, again.Value)
+		}
+		seen[r.Value] = true
+	}
+	if !seen[0.1] || !seen[1] {
+		t.Errorf("split over 10 keys only gave %v", seen)
+	}
+
+	if r := p.StringEvaluation(ctx, "bucket", "fallback", prod); r.Value != "fallback" || r.Reason != ReasonDisabled {
+		t.Errorf("disabled flag = %+v", r)
+	}
+	if r := p.BooleanEvaluation(ctx, "missing", true, prod); !r.Value || !errcode.Is(r.Err, errcode.FlagNotFound) {
+		t.Errorf("missing flag = %+v", r)
+	}
+	if r := p.StringEvaluation(ctx, "fault.enabled", "fallback", prod); r.Value != "fallback" || !errcode.Is(r.Err, errcode.TypeMismatch) {
+		t.Errorf("mistyped flag = %+v", r)
+	}
+
+	// Invalid changes keep the previous flags; valid ones replace them.
+	writeFlags(t, path, "flags: {fault.enabled: {variants: {on: true}, default: off}}", mtime.Add(time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if r := p.BooleanEvaluation(ctx, "fault.enabled", false, staging); !r.Value {
+		t.Errorf("invalid change applied: %+v", r)
+	}
+	writeFlags(t, path, "flags: {fault.enabled: {variants: {on: true}, default: on}}", mtime.Add(2*time.Minute))
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.BooleanEvaluation(ctx, "fault.enabled", false, prod).Value {
+		if time.Now().After(deadline) {
+			t.Fatal("valid change not applied")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,134 @@
+package featureflag
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/samber/oops"
+)
+
+// OFREPProvider evaluates flags remotely with the OpenFeature Remote
+// Evaluation Protocol (POST /ofrep/v1/evaluate/flags/{key}), served by
+// flagd, GO Feature Flag and other flag services.
+type OFREPProvider struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+// NewOFREPProvider creates a provider for the service at baseURL. A
+// non-empty token is sent as a bearer token.
+func NewOFREPProvider(baseURL, token string) (*OFREPProvider, error) {
+	u, err := url.ParseRequestURI(baseURL)
+	if err != nil {
+		return nil, oops.In("featureflag").Code(errcode.InvalidEndpoint).With("url", baseURL).Wrapf(err, "invalid OFREP URL")
+	}
+	return &OFREPProvider{
+		endpoint: strings.TrimSuffix(u.String(), "/") + "/ofrep/v1/evaluate/flags/",
+		token:    token,
+		client:   httpclient.New("ofrep", 0),
+	}, nil
+}
+
+type ofrepResponse struct {
+	Value        json.RawMessage `json:"value"`
+	Variant      string          `json:"variant"`
+	Reason       Reason          `json:"reason"`
+	ErrorCode    string          `json:"errorCode"`
+	ErrorDetails string          `json:"errorDetails"`
+}
+
+func (p *OFREPProvider) evaluate(ctx context.Context, flag string, ec EvaluationContext) (*ofrepResponse, error) {
+	evalCtx := make(map[string]any, len(ec.Attributes)+1)
+	for k, v := range ec.Attributes {
+		evalCtx[k] = v
+	}
+	if ec.TargetingKey != "" {
+		evalCtx["targetingKey"] = ec.TargetingKey
+	}
+	body, err := json.Marshal(map[string]any{"context": evalCtx})
+	if err != nil {
+		return nil, oops.In("featureflag").Code(errcode.EncodeFailed).Wrap(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+url.PathEscape(flag), bytes.NewReader(body))
+	if err != nil {
+		return nil, oops.In("featureflag").Code(errcode.RequestBuildFailed).Wrap(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, oops.In("featureflag").Code(errcode.ProviderNotReady).With("flag", flag).Wrapf(err, "OFREP request failed")
+	}
+	defer resp.Body.Close()
+	var out ofrepResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, oops.In("featureflag").Code(errcode.ParseError).With("flag", flag).Wrapf(err, "invalid OFREP response")
+	}
+	if resp.StatusCode != http.StatusOK || out.ErrorCode != "" {
+		code := errcode.FlagEvaluationFailed
+		switch out.ErrorCode {
+		case "FLAG_NOT_FOUND":
+			code = errcode.FlagNotFound
+		case "TYPE_MISMATCH":
+			code = errcode.TypeMismatch
+		case "PARSE_ERROR":
+			code = errcode.ParseError
+		}
+		return nil, oops.
+			In("featureflag").
+			Code(code).
+			With("flag", flag).
+			With("status", resp.StatusCode).
+			With("error_code", out.ErrorCode).
+			Errorf("OFREP evaluation failed: %s", out.ErrorDetails)
+	}
+	return &out, nil
+}
+
+func resolveRemote[T any](ctx context.Context, p *OFREPProvider, flag string, defaultValue T, ec EvaluationContext) Resolution[T] {
+	out, err := p.evaluate(ctx, flag, ec)
+	if err != nil {
+		return Resolution[T]{Value: defaultValue, Reason: ReasonError, Err: err}
+	}
+	var v T
+	if err := json.Unmarshal(out.Value, &v); err != nil {
+		return Resolution[T]{
+			Value:  defaultValue,
+			Reason: ReasonError,
+			Err:    oops.In("featureflag").Code(errcode.TypeMismatch).With("flag", flag).Wrapf(err, "unexpected flag value type"),
+		}
+	}
+	return Resolution[T]{Value: v, Variant: out.Variant, Reason: out.Reason}
+}
+
+// Metadata implements Provider.
+func (p *OFREPProvider) Metadata() Metadata {
+	return Metadata{Name: "ofrep"}
+}
+
+// BooleanEvaluation implements Provider.
+func (p *OFREPProvider) BooleanEvaluation(ctx context.Context, flag string, defaultValue bool, ec EvaluationContext) Resolution[bool] {
+	return resolveRemote(ctx, p, flag, defaultValue, ec)
+}
+
+// FloatEvaluation implements Provider.
+func (p *OFREPProvider) FloatEvaluation(ctx context.Context, flag string, defaultValue float64, ec EvaluationContext) Resolution[float64] {
+	return resolveRemote(ctx, p, flag, defaultValue, ec)
+}
+
+// StringEvaluation implements Provider.
+func (p *OFREPProvider) StringEvaluation(ctx context.Context, flag string, defaultValue string, ec EvaluationContext) Resolution[string] {
+	return resolveRemote(ctx, p, flag, defaultValue, ec)
+}
+
+// Ensure OFREPProvider implements Provider.
+var _ Provider = (*OFREPProvider)(nil)
@@ -0,0 +1,66 @@
+package featureflag
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+)
+
+func TestOFREPProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Context map[string]string `json:"context"`
+		}
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer s3cret" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/ofrep/v1/evaluate/flags/fault.enabled":
+			if body.Context["targetingKey"] == "tester" && body.Context["host"] == "staging.example.com" {
+				w.Write([]byte(`{"key":"fault.enabled","value":true,"variant":"on","reason":"TARGETING_MATCH"}`))
+				return
+			}
+			w.Write([]byte(`{"key":"fault.enabled","value":false,"variant":"off","reason":"STATIC"}`))
+		case "/ofrep/v1/evaluate/flags/sample.rate":
+			w.Write([]byte(`{"key":"sample.rate","value":0.25,"variant":"quarter","reason":"SPLIT"}`))
+		case "/ofrep/v1/evaluate/flags/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"key":"missing","errorCode":"FLAG_NOT_FOUND","errorDetails":"flag not found"}`))
+		case "/ofrep/v1/evaluate/flags/broken":
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	p, err := NewOFREPProvider(srv.URL+"/", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tester := EvaluationContext{TargetingKey: "tester", Attributes: map[string]string{"host": "staging.example.com"}}
+
+	if r := p.BooleanEvaluation(ctx, "fault.enabled", false, tester); !r.Value || r.Variant != "on" || r.Reason != ReasonTargetingMatch || r.Err != nil {
+		t.Errorf("targeted flag = %+v", r)
+	}
+	if r := p.BooleanEvaluation(ctx, "fault.enabled", true, EvaluationContext{}); r.Value || r.Reason != ReasonStatic {
+		t.Errorf("untargeted flag = %+v", r)
+	}
+	if r := p.FloatEvaluation(ctx, "sample.rate", 1, tester); r.Value != 0.25 || r.Reason != ReasonSplit {
+		t.Errorf("number flag = %+v", r)
+	}
+	if r := p.StringEvaluation(ctx, "sample.rate", "fallback", tester); r.Value != "fallback" || !errcode.Is(r.Err, errcode.TypeMismatch) {
+		t.Errorf("mistyped flag = %+v", r)
+	}
+	if r := p.BooleanEvaluation(ctx, "missing", true, tester); !r.Value || r.Reason != ReasonError || !errcode.Is(r.Err, errcode.FlagNotFound) {
+		t.Errorf("missing flag = %+v", r)
+	}
+	if r := p.BooleanEvaluation(ctx, "broken", true, tester); !r.Value || !errcode.Is(r.Err, errcode.FlagEvaluationFailed) {
+		t.Errorf("failing service = %+v", r)
+	}
+}
@@ -0,0 +1,245 @@
+// Package fieldcrypt encrypts single log values to a recipient's X25519
+// public key, so logs can be shared widely while the values stay readable
+// only to holders of the private key. Each value is sealed with AES-256-GCM
+// under a key agreed between an ephemeral key pair and the recipient (ECIES,
+// as in age), and written as a self-contained "enc1:" token.
+package fieldcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Prefix starts every token.
+const Prefix = "enc1:"
+
+const (
+	keyIDSize = 4
+	keySize   = 32
+	nonceSize = 12
+	// sessionValues is the number of values sealed under one ephemeral key,
+	// well below the 2^32 random nonces AES-GCM allows per key.
+	sessionValues = 1 << 24
+	info          = "envoy-ext-procs fieldcrypt v1"
+)
+
+var encoding = base64.RawURLEncoding
+
+// tokenPattern matches tokens within text such as log lines.
+var tokenPattern = regexp.MustCompile(regexp.QuoteMeta(Prefix) + `[A-Za-z0-9_-]+`)
+
+// Identity is a recipient's private key.
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateIdentity creates a new random Identity.
+func GenerateIdentity() (*Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, oops.In("fieldcrypt").Wrapf(err, "failed to generate key")
+	}
+	return &Identity{key: key}, nil
+}
+
+// ParseIdentity parses a private key written by Identity.String; blank
+// lines and "#" comments around it are ignored, so key files may carry the
+// public key as a comment.
+func ParseIdentity(s string) (*Identity, error) {
+	raw, err := decodeKey(s, "private")
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, oops.In("fieldcrypt").Code(errcode.InvalidConfig).Wrapf(err, "invalid private key")
+	}
+	return &Identity{key: key}, nil
+}
+
+// String returns the private key, base64 encoded.
+func (id *Identity) String() string {
+	return base64.StdEncoding.EncodeToString(id.key.Bytes())
+}
+
+// PublicKey returns the public key values are encrypted to.
+func (id *Identity) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(id.key.PublicKey().Bytes())
+}
+
+// decodeKey decodes the first line of s that is not blank or a comment.
+func decodeKey(s, kind string) ([]byte, error) {
+	var line string
+	for l := range strings.Lines(s) {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "#") {
+			line = l
+			break
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(raw) != keySize {
+		return nil, oops.
+			In("fieldcrypt").
+			Code(errcode.InvalidConfig).
+			Errorf("%s key must be %d base64-encoded bytes", kind, keySize)
+	}
+	return raw, nil
+}
+
+// keyID identifies the recipient a token was encrypted to.
+func keyID(public *ecdh.PublicKey) []byte {
+	sum := sha256.Sum256(public.Bytes())
+	return sum[:keyIDSize]
+}
+
+// deriveAEAD returns the cipher agreed between an ephemeral and a recipient
+// key from their shared secret.
+func deriveAEAD(secret []byte, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	salt := append(append([]byte(nil), ephemeral.Bytes()...), recipient.Bytes()...)
+	key, err := hkdf.Key(sha256.New, secret, salt, info, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// session is an ephemeral key agreed with the recipient.
+type session struct {
+	header []byte // key ID and ephemeral public key
+	aead   cipher.AEAD
+	sealed int
+}
+
+// Encryptor encrypts values to one recipient. It is safe for concurrent
+// use. One key agreement is reused for many values, so sealing a value
+// costs one AES-GCM operation.
+type Encryptor struct {
+	recipient *ecdh.PublicKey
+
+	mu      sync.Mutex
+	session *session
+}
+
+// NewEncryptor creates an Encryptor for a public key written by
+// Identity.PublicKey.
+func NewEncryptor(publicKey string) (*Encryptor, error) {
+	raw, err := decodeKey(publicKey, "public")
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, oops.In("fieldcrypt").Code(errcode.InvalidConfig).Wrapf(err, "invalid public key")
+	}
+	e := &Encryptor{recipient: recipient}
+	if _, err := e.current(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// current returns the session to seal the next value with, starting a new
+// one when the current one has sealed sessionValues values.
+func (e *Encryptor) current() (*session, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session != nil && e.session.sealed < sessionValues {
+		e.session.sealed++
+		return e.session, nil
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, oops.In("fieldcrypt").Wrapf(err, "failed to generate ephemeral key")
+	}
+	secret, err := ephemeral.ECDH(e.recipient)
+	if err != nil {
+		return nil, oops.In("fieldcrypt").Wrapf(err, "key agreement failed")
+	}
+	aead, err := deriveAEAD(secret, ephemeral.PublicKey(), e.recipient)
+	if err != nil {
+		return nil, oops.In("fieldcrypt").Wrapf(err, "failed to derive key")
+	}
+	e.session = &session{
+		header: append(keyID(e.recipient), ephemeral.PublicKey().Bytes()...),
+		aead:   aead,
+		sealed: 1,
+	}
+	return e.session, nil
+}
+
+// Encrypt returns value as a token. Encrypting the same value twice gives
+// different tokens.
+func (e *Encryptor) Encrypt(value string) (string, error) {
+	s, err := e.current()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, len(s.header), len(s.header)+nonceSize+len(value)+s.aead.Overhead())
+	copy(buf, s.header)
+	nonce := buf[len(buf) : len(buf)+nonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return "", oops.In("fieldcrypt").Wrapf(err, "failed to generate nonce")
+	}
+	buf = s.aead.Seal(buf[:len(buf)+nonceSize], nonce, []byte(value), nil)
+	return Prefix + encoding.EncodeToString(buf), nil
+}
+
+// Decrypt returns the value of a token encrypted to id.
+func (id *Identity) Decrypt(token string) (string, error) {
+	raw, err := encoding.DecodeString(strings.TrimPrefix(token, Prefix))
+	if err != nil || !strings.HasPrefix(token, Prefix) || len(raw) < keyIDSize+keySize+nonceSize {
+		return "", oops.In("fieldcrypt").Code(errcode.Malformed).Errorf("malformed token")
+	}
+	if !bytes.Equal(raw[:keyIDSize], keyID(id.key.PublicKey())) {
+		return "", oops.In("fieldcrypt").Code(errcode.BadSignature).Errorf("token was encrypted to another key")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(raw[keyIDSize : keyIDSize+keySize])
+	if err != nil {
+		return "", oops.In("fieldcrypt").Code(errcode.Malformed).Wrapf(err, "malformed token")
+	}
+	secret, err := id.key.ECDH(ephemeral)
+	if err != nil {
+		return "", oops.In("fieldcrypt").Code(errcode.Malformed).Wrapf(err, "malformed token")
+	}
+	aead, err := deriveAEAD(secret, ephemeral, id.key.PublicKey())
+	if err != nil {
+		return "", oops.In("fieldcrypt").Wrapf(err, "failed to derive key")
+	}
+	sealed := raw[keyIDSize+keySize:]
+	value, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", oops.In("fieldcrypt").Code(errcode.BadSignature).Wrapf(err, "token does not authenticate")
+	}
+	return string(value), nil
+}
+
+// DecryptAll replaces the tokens in text that are encrypted to id by their
+// values, leaving others as they are, and returns the number replaced.
+func (id *Identity) DecryptAll(text string) (string, int) {
+	n := 0
+	out := tokenPattern.ReplaceAllStringFunc(text, func(token string) string {
+		value, err := id.Decrypt(token)
+		if err != nil {
+			return token
+		}
+		n++
+		return value
+	})
+	return out, n
+}
@@ -0,0 +1,64 @@
+package fieldcrypt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Key files carry the public key as a comment.
+	parsed, err := ParseIdentity("# public key: " + id.PublicKey() + "\n" + id.String() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := NewEncryptor(id.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := enc.Encrypt("203.0.113.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := enc.Encrypt("203.0.113.7")
+	if a == b || !strings.HasPrefix(a, Prefix) {
+		t.Errorf("tokens %q and %q: want distinct %q tokens", a, b, Prefix)
+	}
+	if got, err := parsed.Decrypt(a); err != nil || got != "203.0.113.7" {
+		t.Errorf("Decrypt = %q, %v", got, err)
+	}
+
+	line := `{"client_ip":"` + a + `","user":"` + b + `","uri":"/"}`
+	got, n := parsed.DecryptAll(line)
+	if want := `{"client_ip":"203.0.113.7","user":"203.0.113.7","uri":"/"}`; got != want || n != 2 {
+		t.Errorf("DecryptAll = %q, %d; want %q, 2", got, n, want)
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	id, _ := GenerateIdentity()
+	other, _ := GenerateIdentity()
+	enc, _ := NewEncryptor(id.PublicKey())
+	token, _ := enc.Encrypt("alice")
+
+	if _, err := other.Decrypt(token); err == nil {
+		t.Error("decrypted a token encrypted to another key")
+	}
+	tampered := token[:len(token)-2] + "AA"
+	if tampered == token {
+		tampered = token[:len(token)-2] + "BB"
+	}
+	if _, err := id.Decrypt(tampered); err == nil {
+		t.Error("decrypted a tampered token")
+	}
+	if _, err := id.Decrypt(Prefix + "AAAA"); err == nil {
+		t.Error("decrypted a truncated token")
+	}
+	if _, err := NewEncryptor("not a key"); err == nil {
+		t.Error("accepted an invalid public key")
+	}
+}
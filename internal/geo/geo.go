@@ -0,0 +1,93 @@
+// Package geo resolves client addresses to countries and continents from a
+// MaxMind DB (mmdb) file, such as GeoLite2-Country or GeoIP2-City.
+package geo
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/samber/oops"
+)
+
+// Location is where an address is registered. Fields are upper-case ISO
+// 3166-1 alpha-2 country and two-letter continent codes, empty if unknown.
+type Location struct {
+	Country   string
+	Continent string
+}
+
+// record is the subset of the GeoIP2/GeoLite2 country and city schemas
+// that is decoded.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+}
+
+// DB is an open mmdb file.
+type DB struct {
+	reader *maxminddb.Reader
+}
+
+// Open opens the mmdb file at path.
+func Open(path string) (*DB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, oops.In("geo").Code(errcode.ReadConfigFailed).With("path", path).Wrapf(err, "failed to open mmdb file")
+	}
+	return &DB{reader: reader}, nil
+}
+
+// FromBytes reads an mmdb database held in memory.
+func FromBytes(data []byte) (*DB, error) {
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, oops.In("geo").Code(errcode.InvalidConfig).Wrapf(err, "invalid mmdb data")
+	}
+	return &DB{reader: reader}, nil
+}
+
+// Lookup returns the location of ip; ok is false if the database does not
+// know it. The country falls back to where the network is registered.
+func (d *DB) Lookup(ip netip.Addr) (loc Location, ok bool) {
+	var rec record
+	if err := d.reader.Lookup(net.IP(ip.Unmap().AsSlice()), &rec); err != nil {
+		return Location{}, false
+	}
+	loc.Country, _ = NormalizeCountry(rec.Country.ISOCode)
+	if loc.Country == "" {
+		loc.Country, _ = NormalizeCountry(rec.RegisteredCountry.ISOCode)
+	}
+	if c := strings.ToUpper(rec.Continent.Code); len(c) == 2 {
+		loc.Continent = c
+	}
+	return loc, loc.Country != "" || loc.Continent != ""
+}
+
+// Close releases the database.
+func (d *DB) Close() error {
+	return d.reader.Close()
+}
+
+// NormalizeCountry upper-cases a two-letter country code and reports
+// whether it names a country. CDN placeholders for unknown origins (XX,
+// ZZ) and codes with digits, such as Tor's T1, are rejected.
+func NormalizeCountry(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return "", false
+	}
+	if code == "XX" || code == "ZZ" {
+		return "", false
+	}
+	return code, true
+}
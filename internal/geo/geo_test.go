@@ -0,0 +1,139 @@
+package geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// mmdbValue encodes v in the MaxMind DB data format; only the types the
+// test records use are supported.
+func mmdbValue(buf *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case string:
+		buf.WriteByte(2<<5 | byte(len(v)))
+		buf.WriteString(v)
+	case uint16:
+		buf.WriteByte(5<<5 | 2)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case uint32:
+		buf.WriteByte(6<<5 | 4)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case uint64:
+		buf.WriteByte(0 | 8)
+		buf.WriteByte(9 - 7)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case []any:
+		buf.WriteByte(0 | byte(len(v)))
+		buf.WriteByte(11 - 7)
+		for _, e := range v {
+			mmdbValue(buf, e)
+		}
+	case map[string]any:
+		buf.WriteByte(7<<5 | byte(len(v)))
+		for k, e := range v {
+			mmdbValue(buf, k)
+			mmdbValue(buf, e)
+		}
+	default:
+		panic("unsupported mmdb value")
+	}
+}
+
+// buildMMDB builds an IPv4 database with 24-bit records mapping each prefix
+// to its record.
+func buildMMDB(t *testing.T, records map[netip.Prefix]map[string]any) []byte {
+	t.Helper()
+	type node struct{ children [2]int } // -1 empty, >= 0 node, < -1 data index
+	nodes := []node{{[2]int{-1, -1}}}
+	var data bytes.Buffer
+	for prefix, rec := range records {
+		offset := data.Len()
+		mmdbValue(&data, rec)
+		addr := prefix.Addr().As4()
+		n := 0
+		for bit := range prefix.Bits() {
+			b := int(addr[bit/8]>>(7-bit%8)) & 1
+			if bit == prefix.Bits()-1 {
+				nodes[n].children[b] = -2 - offset
+				break
+			}
+			if nodes[n].children[b] < 0 {
+				nodes = append(nodes, node{[2]int{-1, -1}})
+				nodes[n].children[b] = len(nodes) - 1
+			}
+			n = nodes[n].children[b]
+		}
+	}
+	count := len(nodes)
+	var out bytes.Buffer
+	for _, n := range nodes {
+		for _, c := range n.children {
+			v := count // no data
+			switch {
+			case c >= 0:
+				v = c
+			case c < -1:
+				v = count + 16 + (-2 - c)
+			}
+			out.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	mmdbValue(&out, map[string]any{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               "Test-Country",
+		"languages":                   []any{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(0),
+		"description":                 map[string]any{"en": "test"},
+	})
+	return out.Bytes()
+}
+
+func TestLookup(t *testing.T) {
+	db, err := FromBytes(buildMMDB(t, map[netip.Prefix]map[string]any{
+		netip.MustParsePrefix("81.2.69.0/24"): {
+			"country":   map[string]any{"iso_code": "gb"},
+			"continent": map[string]any{"code": "EU"},
+		},
+		netip.MustParsePrefix("1.128.0.0/11"): {
+			"registered_country": map[string]any{"iso_code": "AU"},
+			"continent":          map[string]any{"code": "OC"},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, tt := range []struct {
+		ip   string
+		want Location
+		ok   bool
+	}{
+		{"81.2.69.160", Location{Country: "GB", Continent: "EU"}, true},
+		{"::ffff:81.2.69.1", Location{Country: "GB", Continent: "EU"}, true},
+		{"1.130.0.1", Location{Country: "AU", Continent: "OC"}, true},
+		{"203.0.113.7", Location{}, false},
+	} {
+		got, ok := db.Lookup(netip.MustParseAddr(tt.ip))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Lookup(%s) = %+v, %v; want %+v, %v", tt.ip, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNormalizeCountry(t *testing.T) {
+	for in, want := range map[string]string{"us": "US", " De ": "DE", "XX": "", "T1": "", "USA": "", "": ""} {
+		if got, _ := NormalizeCountry(in); got != want {
+			t.Errorf("NormalizeCountry(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
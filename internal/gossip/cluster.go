@@ -0,0 +1,496 @@
+// Package gossip lets replicas share approximate state without an external
+// store. Each replica keeps its own contribution to every counter and the
+// latest value of every key, and periodically pushes what changed to a few
+// peers over UDP, which merge it and pass it on. Counters converge to the
+// cluster-wide total within a few gossip intervals, trading exactness for
+// zero external dependencies.
+package gossip
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+var (
+	membersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gossip_members",
+		Help: "Peers heard from recently, plus the seeds, excluding this replica.",
+	})
+	packetsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gossip_packets_total",
+		Help: "Gossip packets, by direction (sent or received) and result (ok, error, unauthenticated, replayed or malformed).",
+	}, []string{"direction", "result"})
+	keysGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gossip_keys",
+		Help: "Counters and values held by this replica.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(membersGauge, packetsTotal, keysGauge)
+}
+
+// version is the first byte of every packet.
+const version = 1
+
+// Config holds gossip settings.
+type Config struct {
+	// Bind is the UDP host:port to listen on; peers send to the same port.
+	Bind string
+	// Peers are seed host:port addresses. Names are re-resolved
+	// periodically, so a Kubernetes headless service lists every replica.
+	Peers []string
+	// Interval is how often changes are pushed; default 500ms.
+	Interval time.Duration
+	// Fanout is the number of peers changes are pushed to per interval;
+	// default 3.
+	Fanout int
+	// FullSyncEvery pushes the whole state every this many intervals, so
+	// new and restarted peers catch up; default 10.
+	FullSyncEvery int
+	// SecretKey authenticates packets with HMAC-SHA256. New refuses an
+	// empty key unless Insecure is set.
+	SecretKey []byte
+	// Insecure accepts packets from any sender when SecretKey is empty.
+	Insecure bool
+	// MaxSkew is how far a packet's timestamp may be from this replica's
+	// clock; older packets are dropped as replays. Default 30s.
+	MaxSkew time.Duration
+	// NodeName identifies this replica; default the host name.
+	NodeName string
+	// MaxPacketSize bounds packets; default 1400 bytes, below common MTUs.
+	MaxPacketSize int
+	// MaxKeys bounds the keys held; keys learned from peers beyond it are
+	// dropped. 0 is unbounded.
+	MaxKeys int
+	// Clock measures TTLs and intervals; nil is the system clock.
+	Clock clock.Clock
+}
+
+// Cluster is this replica's view of the shared state.
+type Cluster struct {
+	cfg   Config
+	log   zerolog.Logger
+	clock clock.Clock
+	conn  net.PacketConn
+
+	mu    sync.Mutex
+	state *state
+	// learned holds the addresses of peers heard from, by last contact.
+	learned map[string]time.Time
+	seeds   []string
+	// seen holds the MACs of authenticated packets received within MaxSkew,
+	// by expiry, to drop replays.
+	seen map[[sha256.Size]byte]time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New listens on cfg.Bind and starts gossiping until Close.
+func New(cfg Config, log zerolog.Logger) (*Cluster, error) {
+	if len(cfg.SecretKey) == 0 && !cfg.Insecure {
+		return nil, oops.
+			In("gossip").
+			Code(errcode.InvalidConfig).
+			New("gossip needs a secret key to authenticate peers; set one or explicitly allow unauthenticated gossip")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 500 * time.Millisecond
+	}
+	if cfg.Fanout <= 0 {
+		cfg.Fanout = 3
+	}
+	if cfg.FullSyncEvery <= 0 {
+		cfg.FullSyncEvery = 10
+	}
+	if cfg.MaxPacketSize <= 0 {
+		cfg.MaxPacketSize = 1400
+	}
+	if cfg.MaxSkew <= 0 {
+		cfg.MaxSkew = 30 * time.Second
+	}
+	if cfg.NodeName == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, oops.In("gossip").Code(errcode.InvalidConfig).Wrapf(err, "failed to get the host name for the node name")
+		}
+		cfg.NodeName = host
+	}
+	conn, err := net.ListenPacket("udp", cfg.Bind)
+	if err != nil {
+		return nil, oops.
+			In("gossip").
+			Code(errcode.ListenFailed).
+			With("bind", cfg.Bind).
+			Wrapf(err, "failed to listen for gossip")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Cluster{
+		cfg:     cfg,
+		log:     log.With().Str("component", "gossip").Str("node", cfg.NodeName).Logger(),
+		clock:   clock.Or(cfg.Clock),
+		conn:    conn,
+		state:   newState(cfg.NodeName, cfg.MaxKeys),
+		learned: make(map[string]time.Time),
+		seen:    make(map[[sha256.Size]byte]time.Time),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	c.resolveSeeds(ctx)
+	go c.receive()
+	go c.run(ctx)
+	c.log.Info().
+		Str("bind", conn.LocalAddr().String()).
+		Strs("peers", cfg.Peers).
+		Dur("interval", cfg.Interval).
+		Bool("authenticated", len(cfg.SecretKey) > 0).
+		Msg("gossip started")
+	return c, nil
+}
+
+// Addr returns the address the cluster listens on.
+func (c *Cluster) Addr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Close stops gossiping.
+func (c *Cluster) Close() error {
+	c.cancel()
+	err := c.conn.Close()
+	<-c.done
+	return oops.In("gossip").Wrap(err)
+}
+
+// Incr adds delta to this replica's contribution to the counter key, which
+// expires after ttl unless it already exists, and returns the cluster-wide
+// total known so far.
+func (c *Cluster) Incr(key string, delta int64, ttl time.Duration) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.incr(key, delta, ttl, c.clock.Now())
+}
+
+// Count returns the cluster-wide total of the counter key known so far.
+func (c *Cluster) Count(key string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.count(key, c.clock.Now())
+}
+
+// Set stores value under key for ttl; 0 keeps it until deleted. The latest
+// write of any replica wins.
+func (c *Cluster) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.write(key, value, false, ttl, c.clock.Now())
+}
+
+// Get returns the value stored under key.
+func (c *Cluster) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.get(key, c.clock.Now())
+}
+
+// Delete removes the value stored under key. Counters cannot be deleted;
+// they expire.
+func (c *Cluster) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Remember the deletion long enough to reach every peer.
+	c.state.write(key, nil, true, c.tombstoneTTL(), c.clock.Now())
+}
+
+// Expire changes the TTL of key: of its value, or else of this replica's
+// contribution to the counter.
+func (c *Cluster) Expire(key string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	if value, ok := c.state.get(key, now); ok {
+		c.state.write(key, value, false, ttl, now)
+		return
+	}
+	c.state.expireCounter(key, ttl, now)
+}
+
+func (c *Cluster) tombstoneTTL() time.Duration {
+	return max(time.Minute, time.Duration(4*c.cfg.FullSyncEvery)*c.cfg.Interval)
+}
+
+// Members returns the addresses of the seeds and the peers heard from
+// recently.
+func (c *Cluster) Members() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.membersLocked(c.clock.Now())
+}
+
+func (c *Cluster) membersLocked(now time.Time) []string {
+	seen := make(map[string]bool)
+	var members []string
+	for _, addr := range c.seeds {
+		if !seen[addr] {
+			seen[addr] = true
+			members = append(members, addr)
+		}
+	}
+	for addr, last := range c.learned {
+		if now.Sub(last) > c.tombstoneTTL() {
+			delete(c.learned, addr)
+			continue
+		}
+		if !seen[addr] {
+			seen[addr] = true
+			members = append(members, addr)
+		}
+	}
+	return members
+}
+
+func (c *Cluster) run(ctx context.Context) {
+	ticker := c.clock.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	var round int
+	last := c.clock.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		round++
+		now := c.clock.Now()
+		since := last
+		if round%c.cfg.FullSyncEvery == 0 {
+			since = time.Time{}
+			c.resolveSeeds(ctx)
+		}
+		last = now
+		c.push(since, now)
+	}
+}
+
+// resolveSeeds resolves the seed names to addresses.
+func (c *Cluster) resolveSeeds(ctx context.Context) {
+	var seeds []string
+	for _, peer := range c.cfg.Peers {
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			c.log.Warn().Err(err).Str("peer", peer).Msg("invalid gossip peer")
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			c.log.Debug().Err(err).Str("peer", peer).Msg("failed to resolve gossip peer")
+			continue
+		}
+		for _, ip := range ips {
+			seeds = append(seeds, net.JoinHostPort(ip.IP.String(), port))
+		}
+	}
+	c.mu.Lock()
+	c.seeds = seeds
+	c.mu.Unlock()
+}
+
+// push sends the entries changed since to Fanout random peers.
+func (c *Cluster) push(since, now time.Time) {
+	c.mu.Lock()
+	c.state.sweep(now)
+	for mac, expiry := range c.seen {
+		if now.After(expiry) {
+			delete(c.seen, mac)
+		}
+	}
+	keysGauge.Set(float64(c.state.keys()))
+	counters, regs := c.state.changes(since)
+	members := c.membersLocked(now)
+	c.mu.Unlock()
+	membersGauge.Set(float64(len(members)))
+	if len(members) == 0 || len(counters)+len(regs) == 0 {
+		return
+	}
+
+	packets := c.encode(counters, regs)
+	rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	for _, member := range members[:min(c.cfg.Fanout, len(members))] {
+		addr, err := net.ResolveUDPAddr("udp", member)
+		if err != nil {
+			continue
+		}
+		for _, packet := range packets {
+			result := "ok"
+			if _, err := c.conn.WriteTo(packet, addr); err != nil {
+				result = "error"
+				c.log.Debug().Err(err).Str("peer", member).Msg("failed to send gossip")
+			}
+			packetsTotal.WithLabelValues("sent", result).Inc()
+		}
+	}
+}
+
+// message is the payload of a packet.
+type message struct {
+	Node string `json:"n"`
+	// Time and Nonce make every packet unique, so replays can be told
+	// apart.
+	Time      int64           `json:"t"`
+	Nonce     uint64          `json:"i"`
+	Counters  []counterEntry  `json:"c,omitempty"`
+	Registers []registerEntry `json:"r,omitempty"`
+}
+
+// encode splits the entries into packets of at most MaxPacketSize bytes;
+// an entry too large for any packet is dropped.
+func (c *Cluster) encode(counters []counterEntry, regs []registerEntry) [][]byte {
+	// Time and Nonce take at most 20 digits each.
+	overhead := 1 + len(`{"n":"","t":,"i":,"c":[],"r":[]}`) + 40 + len(strconv.Quote(c.cfg.NodeName))
+	if len(c.cfg.SecretKey) > 0 {
+		overhead += sha256.Size
+	}
+	budget := c.cfg.MaxPacketSize - overhead
+
+	var packets [][]byte
+	msg := message{Node: c.cfg.NodeName}
+	size := 0
+	flush := func() {
+		if len(msg.Counters)+len(msg.Registers) > 0 {
+			packets = append(packets, c.seal(msg))
+		}
+		msg = message{Node: c.cfg.NodeName}
+		size = 0
+	}
+	add := func(entry any, append func()) {
+		data, _ := json.Marshal(entry)
+		if len(data)+1 > budget {
+			c.log.Warn().Int("size", len(data)).Msg("gossip entry larger than a packet, not sent")
+			return
+		}
+		if size+len(data)+1 > budget {
+			flush()
+		}
+		size += len(data) + 1
+		append()
+	}
+	for _, e := range counters {
+		add(e, func() { msg.Counters = append(msg.Counters, e) })
+	}
+	for _, r := range regs {
+		add(r, func() { msg.Registers = append(msg.Registers, r) })
+	}
+	flush()
+	return packets
+}
+
+// seal stamps and encodes msg into a packet, authenticated when a key is
+// set.
+func (c *Cluster) seal(msg message) []byte {
+	msg.Time = c.clock.Now().UnixNano()
+	msg.Nonce = rand.Uint64()
+	payload, _ := json.Marshal(msg)
+	packet := []byte{version}
+	if len(c.cfg.SecretKey) > 0 {
+		mac := hmac.New(sha256.New, c.cfg.SecretKey)
+		mac.Write(payload)
+		packet = mac.Sum(packet)
+	}
+	return append(packet, payload...)
+}
+
+// open authenticates and decodes a packet. Packets stamped outside MaxSkew
+// of now, or authenticated ones already received, are replays.
+func (c *Cluster) open(packet []byte) (message, string) {
+	var msg message
+	if len(packet) < 1 || packet[0] != version {
+		return msg, "malformed"
+	}
+	payload := packet[1:]
+	var sum [sha256.Size]byte
+	authenticated := len(c.cfg.SecretKey) > 0
+	if authenticated {
+		if len(payload) < sha256.Size {
+			return msg, "unauthenticated"
+		}
+		mac := hmac.New(sha256.New, c.cfg.SecretKey)
+		mac.Write(payload[sha256.Size:])
+		if !hmac.Equal(mac.Sum(nil), payload[:sha256.Size]) {
+			return msg, "unauthenticated"
+		}
+		copy(sum[:], payload)
+		payload = payload[sha256.Size:]
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Node == "" {
+		return msg, "malformed"
+	}
+
+	now := c.clock.Now()
+	if skew := now.Sub(time.Unix(0, msg.Time)); skew > c.cfg.MaxSkew || skew < -c.cfg.MaxSkew {
+		return msg, "replayed"
+	}
+	if authenticated {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.seen[sum]; ok {
+			return msg, "replayed"
+		}
+		// A packet stamped up to MaxSkew ahead stays acceptable for twice
+		// as long.
+		c.seen[sum] = now.Add(2 * c.cfg.MaxSkew)
+	}
+	return msg, "ok"
+}
+
+func (c *Cluster) receive() {
+	defer close(c.done)
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.log.Error().Err(err).Msg("gossip receive failed")
+			}
+			return
+		}
+		msg, result := c.open(buf[:n])
+		packetsTotal.WithLabelValues("received", result).Inc()
+		if result != "ok" {
+			c.log.Debug().Str("peer", addr.String()).Str("result", result).Msg("dropped gossip packet")
+			continue
+		}
+		if msg.Node == c.cfg.NodeName {
+			continue
+		}
+		c.merge(addr.String(), msg)
+	}
+}
+
+func (c *Cluster) merge(addr string, msg message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	c.learned[addr] = now
+	for _, e := range msg.Counters {
+		c.state.mergeCounter(e, now)
+	}
+	for _, r := range msg.Registers {
+		c.state.mergeRegister(r, now)
+	}
+}
@@ -0,0 +1,110 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/rs/zerolog"
+)
+
+func newCluster(t *testing.T, name, key string, peers ...string) *Cluster {
+	t.Helper()
+	c, err := New(Config{
+		Bind:      "127.0.0.1:0",
+		Peers:     peers,
+		Interval:  10 * time.Millisecond,
+		SecretKey: []byte(key),
+		Insecure:  key == "",
+		NodeName:  name,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// eventually polls cond for up to two seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: not converged", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClusterSync(t *testing.T) {
+	a := newCluster(t, "a", "secret")
+	// b only knows a; a learns b from its packets.
+	b := newCluster(t, "b", "secret", a.Addr().String())
+
+	a.Incr("hits", 2, time.Minute)
+	b.Incr("hits", 3, time.Minute)
+	eventually(t, "counter", func() bool {
+		na, _ := a.Count("hits")
+		nb, _ := b.Count("hits")
+		return na == 5 && nb == 5
+	})
+
+	a.Set("deny:192.0.2.1", []byte("1"), 0)
+	eventually(t, "set", func() bool {
+		_, ok := b.Get("deny:192.0.2.1")
+		return ok
+	})
+	b.Delete("deny:192.0.2.1")
+	eventually(t, "delete", func() bool {
+		_, ok := a.Get("deny:192.0.2.1")
+		return !ok
+	})
+}
+
+func TestClusterRejectsUnauthenticatedPackets(t *testing.T) {
+	a := newCluster(t, "a", "secret")
+	b := newCluster(t, "b", "other", a.Addr().String())
+	c := newCluster(t, "c", "secret", a.Addr().String())
+
+	b.Set("k", []byte("forged"), 0)
+	c.Set("ok", []byte("1"), 0)
+	eventually(t, "authenticated peer", func() bool {
+		_, ok := a.Get("ok")
+		return ok
+	})
+	if _, ok := a.Get("k"); ok {
+		t.Fatal("accepted a packet with the wrong key")
+	}
+}
+
+func TestClusterRequiresKey(t *testing.T) {
+	if _, err := New(Config{Bind: "127.0.0.1:0", NodeName: "a"}, zerolog.Nop()); err == nil {
+		t.Fatal("started without a key or Insecure")
+	}
+}
+
+func TestClusterRejectsReplays(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	c, err := New(Config{Bind: "127.0.0.1:0", SecretKey: []byte("secret"), NodeName: "a", Clock: clk}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	packet := c.seal(message{Node: "b", Registers: []registerEntry{{Key: "k"}}})
+	if _, result := c.open(packet); result != "ok" {
+		t.Fatalf("first packet: %s", result)
+	}
+	if _, result := c.open(packet); result != "replayed" {
+		t.Errorf("same packet again: %s, want replayed", result)
+	}
+	stale := c.seal(message{Node: "b"})
+	clk.Advance(time.Minute)
+	if _, result := c.open(stale); result != "replayed" {
+		t.Errorf("stale packet: %s, want replayed", result)
+	}
+	if _, result := c.open(c.seal(message{Node: "b"})); result != "ok" {
+		t.Errorf("fresh packet: %s", result)
+	}
+}
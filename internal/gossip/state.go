@@ -0,0 +1,245 @@
+package gossip
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"time"
+)
+
+// counterEntry is one node's contribution to a counter: the sums of its
+// positive and negative increments, which only grow, so merging keeps the
+// larger of each.
+type counterEntry struct {
+	Key     string `json:"k"`
+	Node    string `json:"o"`
+	Pos     int64  `json:"p,omitempty"`
+	Neg     int64  `json:"m,omitempty"`
+	Expires int64  `json:"e,omitempty"`
+	updated time.Time
+}
+
+// registerEntry is a value written by Set or removed by Delete; the latest
+// write wins, ties broken by node name.
+type registerEntry struct {
+	Key     string `json:"k"`
+	Value   []byte `json:"v,omitempty"`
+	Time    int64  `json:"t"`
+	Node    string `json:"o"`
+	Deleted bool   `json:"d,omitempty"`
+	Expires int64  `json:"e,omitempty"`
+	updated time.Time
+}
+
+func (r *registerEntry) newer(other *registerEntry) bool {
+	if r.Time != other.Time {
+		return r.Time > other.Time
+	}
+	return r.Node > other.Node
+}
+
+// expired reports whether expires, in Unix milliseconds, is before now;
+// zero never expires.
+func expired(expires int64, now time.Time) bool {
+	return expires != 0 && expires <= now.UnixMilli()
+}
+
+func expiry(now time.Time, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl).UnixMilli()
+}
+
+// state holds the replicated counters and registers. It is not safe for
+// concurrent use.
+type state struct {
+	node     string
+	maxKeys  int
+	counters map[string]map[string]*counterEntry
+	regs     map[string]*registerEntry
+}
+
+func newState(node string, maxKeys int) *state {
+	return &state{
+		node:     node,
+		maxKeys:  maxKeys,
+		counters: make(map[string]map[string]*counterEntry),
+		regs:     make(map[string]*registerEntry),
+	}
+}
+
+func (s *state) keys() int {
+	return len(s.counters) + len(s.regs)
+}
+
+// full reports whether a new key would exceed maxKeys.
+func (s *state) full() bool {
+	return s.maxKeys > 0 && s.keys() >= s.maxKeys
+}
+
+// incr adds delta to this node's contribution to key and returns the
+// cluster-wide total as known locally.
+func (s *state) incr(key string, delta int64, ttl time.Duration, now time.Time) int64 {
+	nodes := s.counters[key]
+	if nodes == nil {
+		nodes = make(map[string]*counterEntry)
+		s.counters[key] = nodes
+	}
+	own := nodes[s.node]
+	if own == nil || expired(own.Expires, now) {
+		own = &counterEntry{Key: key, Node: s.node, Expires: expiry(now, ttl)}
+		nodes[s.node] = own
+	}
+	if delta >= 0 {
+		own.Pos += delta
+	} else {
+		own.Neg -= delta
+	}
+	own.updated = now
+	return s.sum(key, now)
+}
+
+// sum returns the total of the live contributions to key.
+func (s *state) sum(key string, now time.Time) int64 {
+	var total int64
+	for _, e := range s.counters[key] {
+		if !expired(e.Expires, now) {
+			total += e.Pos - e.Neg
+		}
+	}
+	return total
+}
+
+// count returns the total of key and whether any node contributes to it.
+func (s *state) count(key string, now time.Time) (int64, bool) {
+	for _, e := range s.counters[key] {
+		if !expired(e.Expires, now) {
+			return s.sum(key, now), true
+		}
+	}
+	return 0, false
+}
+
+// expireCounter sets the TTL of this node's contribution to key.
+func (s *state) expireCounter(key string, ttl time.Duration, now time.Time) {
+	if own := s.counters[key][s.node]; own != nil && !expired(own.Expires, now) {
+		own.Expires = expiry(now, ttl)
+		own.updated = now
+	}
+}
+
+// write applies a local Set or Delete.
+func (s *state) write(key string, value []byte, deleted bool, ttl time.Duration, now time.Time) {
+	r := &registerEntry{
+		Key:     key,
+		Value:   value,
+		Time:    now.UnixNano(),
+		Node:    s.node,
+		Deleted: deleted,
+		Expires: expiry(now, ttl),
+		updated: now,
+	}
+	if old := s.regs[key]; old != nil && !r.newer(old) {
+		// The clock went backwards: order after the current value.
+		r.Time = old.Time + 1
+	}
+	s.regs[key] = r
+}
+
+// get returns the live value of key.
+func (s *state) get(key string, now time.Time) ([]byte, bool) {
+	r := s.regs[key]
+	if r == nil || r.Deleted || expired(r.Expires, now) {
+		return nil, false
+	}
+	return r.Value, true
+}
+
+// mergeCounter merges a contribution received from a peer, reporting
+// whether it changed the state.
+func (s *state) mergeCounter(e counterEntry, now time.Time) bool {
+	if e.Node == s.node || expired(e.Expires, now) {
+		return false
+	}
+	nodes := s.counters[e.Key]
+	if nodes == nil {
+		if s.full() {
+			return false
+		}
+		nodes = make(map[string]*counterEntry)
+		s.counters[e.Key] = nodes
+	}
+	cur := nodes[e.Node]
+	if cur == nil || expired(cur.Expires, now) {
+		e.updated = now
+		nodes[e.Node] = &e
+		return true
+	}
+	if e.Pos <= cur.Pos && e.Neg <= cur.Neg && e.Expires == cur.Expires {
+		return false
+	}
+	if e.Pos >= cur.Pos && e.Neg >= cur.Neg {
+		// The newer contribution carries the node's current TTL.
+		cur.Expires = e.Expires
+	}
+	cur.Pos, cur.Neg = max(cur.Pos, e.Pos), max(cur.Neg, e.Neg)
+	cur.updated = now
+	return true
+}
+
+// mergeRegister merges a register received from a peer, reporting whether
+// it changed the state.
+func (s *state) mergeRegister(r registerEntry, now time.Time) bool {
+	if expired(r.Expires, now) {
+		return false
+	}
+	cur := s.regs[r.Key]
+	if cur == nil && s.full() {
+		return false
+	}
+	if cur != nil && !r.newer(cur) {
+		return false
+	}
+	r.updated = now
+	s.regs[r.Key] = &r
+	return true
+}
+
+// sweep drops expired entries.
+func (s *state) sweep(now time.Time) {
+	for key, nodes := range s.counters {
+		maps.DeleteFunc(nodes, func(_ string, e *counterEntry) bool { return expired(e.Expires, now) })
+		if len(nodes) == 0 {
+			delete(s.counters, key)
+		}
+	}
+	maps.DeleteFunc(s.regs, func(_ string, r *registerEntry) bool { return expired(r.Expires, now) })
+}
+
+// changes returns the entries updated since, or all with a zero since,
+// sorted by key so packets are stable.
+func (s *state) changes(since time.Time) ([]counterEntry, []registerEntry) {
+	var counters []counterEntry
+	for _, nodes := range s.counters {
+		for _, e := range nodes {
+			if !e.updated.Before(since) {
+				counters = append(counters, *e)
+			}
+		}
+	}
+	var regs []registerEntry
+	for _, r := range s.regs {
+		if !r.updated.Before(since) {
+			regs = append(regs, *r)
+		}
+	}
+	slices.SortFunc(counters, func(a, b counterEntry) int {
+		if a.Key != b.Key {
+			return cmp.Compare(a.Key, b.Key)
+		}
+		return cmp.Compare(a.Node, b.Node)
+	})
+	slices.SortFunc(regs, func(a, b registerEntry) int { return cmp.Compare(a.Key, b.Key) })
+	return counters, regs
+}
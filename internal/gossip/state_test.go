@@ -0,0 +1,90 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+)
+
+// exchange merges every entry of from into to.
+func exchange(from, to *state, now time.Time) {
+	counters, regs := from.changes(time.Time{})
+	for _, e := range counters {
+		to.mergeCounter(e, now)
+	}
+	for _, r := range regs {
+		to.mergeRegister(r, now)
+	}
+}
+
+func TestCountersConverge(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, b := newState("a", 0), newState("b", 0)
+
+	a.incr("k", 3, time.Minute, now)
+	b.incr("k", 2, time.Minute, now)
+	b.incr("k", -1, time.Minute, now)
+	exchange(a, b, now)
+	exchange(b, a, now)
+	// Merging the same contributions again changes nothing.
+	exchange(a, b, now)
+	exchange(b, a, now)
+	for name, s := range map[string]*state{"a": a, "b": b} {
+		if got, ok := s.count("k", now); !ok || got != 4 {
+			t.Errorf("%s: count = %d, %v; want 4", name, got, ok)
+		}
+	}
+
+	// A stale contribution does not undo a newer one.
+	stale, _ := a.changes(time.Time{})
+	a.incr("k", 5, time.Minute, now)
+	exchange(a, b, now)
+	for _, e := range stale {
+		b.mergeCounter(e, now)
+	}
+	if got, _ := b.count("k", now); got != 9 {
+		t.Errorf("count after a stale merge = %d, want 9", got)
+	}
+
+	// Contributions expire with their TTL.
+	later := now.Add(time.Minute)
+	if _, ok := b.count("k", later); ok {
+		t.Error("expired counter still counted")
+	}
+	b.sweep(later)
+	if b.keys() != 0 {
+		t.Errorf("keys after sweep = %d, want 0", b.keys())
+	}
+}
+
+func TestRegistersLastWriteWins(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, b := newState("a", 0), newState("b", 0)
+
+	a.write("k", []byte("old"), false, 0, now)
+	b.write("k", []byte("new"), false, 0, now.Add(time.Second))
+	exchange(a, b, now)
+	exchange(b, a, now)
+	for name, s := range map[string]*state{"a": a, "b": b} {
+		if got, ok := s.get("k", now); !ok || string(got) != "new" {
+			t.Errorf("%s: get = %q, %v; want new", name, got, ok)
+		}
+	}
+
+	// Deletions replicate as tombstones.
+	a.write("k", nil, true, time.Minute, now.Add(2*time.Second))
+	exchange(a, b, now)
+	if _, ok := b.get("k", now); ok {
+		t.Error("deleted value still present")
+	}
+}
+
+func TestMaxKeysBoundsPeerKeys(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, b := newState("a", 0), newState("b", 1)
+	a.incr("x", 1, 0, now)
+	a.incr("y", 1, 0, now)
+	exchange(a, b, now)
+	if b.keys() != 1 {
+		t.Errorf("keys = %d, want 1", b.keys())
+	}
+}
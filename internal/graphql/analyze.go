@@ -0,0 +1,271 @@
+// Package graphql parses GraphQL query documents and measures the operation
+// a request executes: its depth, an estimate of its cost and whether it
+// queries the schema, so expensive or introspective queries can be refused
+// before they reach the server.
+package graphql
+
+import (
+	"encoding/json"
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+// MaxNesting bounds the bracket nesting of a document, checked before it is
+// parsed, so deeply nested input cannot exhaust the recursive parser.
+const MaxNesting = 256
+
+// DefaultListArguments are the arguments taken as the number of items a
+// list field returns.
+var DefaultListArguments = []string{"first", "last", "limit"}
+
+// Options control the analysis.
+type Options struct {
+	// ListArguments name the arguments whose integer value multiplies the
+	// cost of a field's selections; nil uses DefaultListArguments.
+	ListArguments []string
+}
+
+// Operation describes the operation a request executes.
+type Operation struct {
+	// Name is the operation name; empty for anonymous operations.
+	Name string
+	// Type is "query", "mutation" or "subscription".
+	Type string
+	// Depth is the deepest field nesting, with root fields at depth 1.
+	Depth int
+	// Complexity counts the fields selected, each list field's selections
+	// counted once per requested item.
+	Complexity int64
+	// Introspection reports whether __schema or __type is selected.
+	Introspection bool
+	// RootFields are the names of the top-level fields.
+	RootFields []string
+}
+
+// Analyze parses query and measures the operation named operationName, or
+// the only operation of the document if operationName is empty.
+// variables supply list argument values given as variables.
+func Analyze(query, operationName string, variables map[string]any, opts Options) (*Operation, error) {
+	if nesting(query) > MaxNesting {
+		return nil, oops.
+			In("graphql").
+			Code(errcode.LimitExceeded).
+			With("max_nesting", MaxNesting).
+			Errorf("document is nested too deeply")
+	}
+	doc, gqlErr := parser.ParseQuery(&ast.Source{Input: query})
+	if gqlErr != nil {
+		return nil, oops.
+			In("graphql").
+			Code(errcode.InvalidGraphQL).
+			Wrapf(gqlErr, "failed to parse document")
+	}
+
+	var def *ast.OperationDefinition
+	switch {
+	case operationName != "":
+		def = doc.Operations.ForName(operationName)
+	case len(doc.Operations) == 1:
+		def = doc.Operations[0]
+	default:
+		return nil, invalid("document has %d operations and no operation name", len(doc.Operations))
+	}
+	if def == nil {
+		return nil, invalid("document has no operation %q", operationName)
+	}
+
+	a := &analyzer{
+		doc:       doc,
+		variables: variables,
+		listArgs:  opts.ListArguments,
+		fragments: make(map[string]*measure),
+	}
+	if a.listArgs == nil {
+		a.listArgs = DefaultListArguments
+	}
+	m, err := a.selectionSet(def.SelectionSet)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &Operation{
+		Name:          def.Name,
+		Type:          string(def.Operation),
+		Depth:         m.depth,
+		Complexity:    m.cost,
+		Introspection: m.introspection,
+	}
+	for _, sel := range def.SelectionSet {
+		if field, ok := sel.(*ast.Field); ok {
+			op.RootFields = append(op.RootFields, field.Name)
+		}
+	}
+	return op, nil
+}
+
+// measure is the depth and cost of a selection set.
+type measure struct {
+	depth         int
+	cost          int64
+	introspection bool
+}
+
+type analyzer struct {
+	doc       *ast.QueryDocument
+	variables map[string]any
+	listArgs  []string
+	// fragments memoizes fragment measures; nil while a fragment is being
+	// measured, to detect cycles. Memoizing keeps fragments that spread
+	// others several times from costing exponential time.
+	fragments map[string]*measure
+}
+
+func (a *analyzer) selectionSet(set ast.SelectionSet) (measure, error) {
+	var total measure
+	for _, sel := range set {
+		var m measure
+		switch sel := sel.(type) {
+		case *ast.Field:
+			children, err := a.selectionSet(sel.SelectionSet)
+			if err != nil {
+				return measure{}, err
+			}
+			m = measure{
+				depth:         children.depth + 1,
+				cost:          addSat(1, mulSat(children.cost, a.listSize(sel))),
+				introspection: children.introspection || sel.Name == "__schema" || sel.Name == "__type",
+			}
+		case *ast.InlineFragment:
+			var err error
+			if m, err = a.selectionSet(sel.SelectionSet); err != nil {
+				return measure{}, err
+			}
+		case *ast.FragmentSpread:
+			var err error
+			if m, err = a.fragment(sel.Name); err != nil {
+				return measure{}, err
+			}
+		}
+		total.depth = max(total.depth, m.depth)
+		total.cost = addSat(total.cost, m.cost)
+		total.introspection = total.introspection || m.introspection
+	}
+	return total, nil
+}
+
+func (a *analyzer) fragment(name string) (measure, error) {
+	if m, ok := a.fragments[name]; ok {
+		if m == nil {
+			return measure{}, invalid("fragment %q spreads itself", name)
+		}
+		return *m, nil
+	}
+	def := a.doc.Fragments.ForName(name)
+	if def == nil {
+		return measure{}, invalid("fragment %q is not defined", name)
+	}
+	a.fragments[name] = nil
+	m, err := a.selectionSet(def.SelectionSet)
+	if err != nil {
+		return measure{}, err
+	}
+	a.fragments[name] = &m
+	return m, nil
+}
+
+// listSize returns the number of items a field asks for through its list
+// arguments, or 1.
+func (a *analyzer) listSize(field *ast.Field) int64 {
+	size := int64(1)
+	for _, arg := range field.Arguments {
+		if !slices.Contains(a.listArgs, arg.Name) || arg.Value == nil {
+			continue
+		}
+		var n int64
+		switch arg.Value.Kind {
+		case ast.IntValue:
+			n, _ = strconv.ParseInt(arg.Value.Raw, 10, 64)
+		case ast.Variable:
+			n = variableInt(a.variables[arg.Value.Raw])
+		}
+		size = max(size, n)
+	}
+	return size
+}
+
+// variableInt returns the integer value of a decoded JSON variable, or 0.
+func variableInt(v any) int64 {
+	switch v := v.(type) {
+	case json.Number:
+		n, _ := v.Int64()
+		return n
+	case float64:
+		if v >= math.MaxInt64 {
+			return math.MaxInt64
+		}
+		return int64(v)
+	}
+	return 0
+}
+
+// nesting returns the deepest bracket nesting of a document, skipping
+// strings and comments.
+func nesting(query string) int {
+	depth, deepest := 0, 0
+	for i := 0; i < len(query); i++ {
+		switch query[i] {
+		case '{', '[', '(':
+			depth++
+			deepest = max(deepest, depth)
+		case '}', ']', ')':
+			depth--
+		case '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case '"':
+			if len(query) >= i+3 && query[i:i+3] == `"""` {
+				for i += 3; i < len(query) && (len(query) < i+3 || query[i:i+3] != `"""`); i++ {
+					if query[i] == '\\' {
+						i++
+					}
+				}
+				i += 2
+				continue
+			}
+			for i++; i < len(query) && query[i] != '"' && query[i] != '\n'; i++ {
+				if query[i] == '\\' {
+					i++
+				}
+			}
+		}
+	}
+	return deepest
+}
+
+func addSat(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+func mulSat(a, b int64) int64 {
+	if a != 0 && b > math.MaxInt64/a {
+		return math.MaxInt64
+	}
+	return a * b
+}
+
+func invalid(format string, args ...any) error {
+	return oops.
+		In("graphql").
+		Code(errcode.InvalidGraphQL).
+		Errorf(format, args...)
+}
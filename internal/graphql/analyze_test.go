@@ -0,0 +1,126 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+)
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		variables map[string]any
+		want      Operation
+	}{
+		{
+			name:  "anonymous",
+			query: `{ me { id name } }`,
+			want:  Operation{Type: "query", Depth: 2, Complexity: 3, RootFields: []string{"me"}},
+		},
+		{
+			name:      "selected by name",
+			query:     `query A { a } mutation B { b { c } }`,
+			operation: "B",
+			want:      Operation{Name: "B", Type: "mutation", Depth: 2, Complexity: 2, RootFields: []string{"b"}},
+		},
+		{
+			name:  "list arguments",
+			query: `query Feed { posts(first: 10) { id author { name } } }`,
+			want:  Operation{Name: "Feed", Type: "query", Depth: 3, Complexity: 31, RootFields: []string{"posts"}},
+		},
+		{
+			name:      "list argument variable",
+			query:     `query Feed($n: Int) { posts(last: $n) { id } }`,
+			variables: map[string]any{"n": json.Number("50")},
+			want:      Operation{Name: "Feed", Type: "query", Depth: 2, Complexity: 51, RootFields: []string{"posts"}},
+		},
+		{
+			name: "fragments",
+			query: `query Q { a { ...F } b { ... on B { c { ...F } } } }
+				fragment F on T { x y { z } }`,
+			want: Operation{Name: "Q", Type: "query", Depth: 4, Complexity: 9, RootFields: []string{"a", "b"}},
+		},
+		{
+			name:  "introspection",
+			query: `{ __schema { types { name } } }`,
+			want:  Operation{Type: "query", Depth: 3, Complexity: 3, Introspection: true, RootFields: []string{"__schema"}},
+		},
+		{
+			name:  "typename is not introspection",
+			query: `{ me { __typename } }`,
+			want:  Operation{Type: "query", Depth: 2, Complexity: 2, RootFields: []string{"me"}},
+		},
+		{
+			name:  "braces in strings and comments",
+			query: "{ a(s: \"{{{{\", b: \"\"\"{{{\"\"\") # {{{{\n }",
+			want:  Operation{Type: "query", Depth: 1, Complexity: 1, RootFields: []string{"a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Analyze(tt.query, tt.operation, tt.variables, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.want.Name || got.Type != tt.want.Type || got.Depth != tt.want.Depth ||
+				got.Complexity != tt.want.Complexity || got.Introspection != tt.want.Introspection ||
+				!slices.Equal(got.RootFields, tt.want.RootFields) {
+				t.Errorf("Analyze() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnalyzeFragmentExplosion(t *testing.T) {
+	// Each fragment spreads the next twice: 2^40 fields once expanded.
+	var b strings.Builder
+	b.WriteString("{ ...F0 }\n")
+	for i := range 40 {
+		fmt.Fprintf(&b, "fragment F%d on T { ...F%d ...F%d }\n", i, i+1, i+1)
+	}
+	b.WriteString("fragment F40 on T { x }\n")
+	query := b.String()
+	op, err := Analyze(query, "", nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Complexity != 1<<40 {
+		t.Errorf("Complexity = %d, want %d", op.Complexity, int64(1)<<40)
+	}
+
+	op, err = Analyze(`{ a(first: 9223372036854775807) { b(first: 9223372036854775807) { c } } }`, "", nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Complexity != math.MaxInt64 {
+		t.Errorf("Complexity = %d, want saturation at %d", op.Complexity, int64(math.MaxInt64))
+	}
+}
+
+func TestAnalyzeErrors(t *testing.T) {
+	for name, tt := range map[string]struct {
+		query, operation string
+		code             errcode.Code
+	}{
+		"syntax":            {`{ a `, "", errcode.InvalidGraphQL},
+		"empty":             {``, "", errcode.InvalidGraphQL},
+		"ambiguous":         {`query A { a } query B { b }`, "", errcode.InvalidGraphQL},
+		"unknown operation": {`query A { a }`, "B", errcode.InvalidGraphQL},
+		"undefined":         {`{ ...F }`, "", errcode.InvalidGraphQL},
+		"cycle":             {`{ ...F } fragment F on T { a { ...G } } fragment G on T { ...F }`, "", errcode.InvalidGraphQL},
+		"nesting":           {strings.Repeat("{ a ", MaxNesting+1) + strings.Repeat("}", MaxNesting+1), "", errcode.LimitExceeded},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Analyze(tt.query, tt.operation, nil, Options{}); !errcode.Is(err, tt.code) {
+				t.Errorf("Analyze() error = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
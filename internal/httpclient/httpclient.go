@@ -0,0 +1,200 @@
+// Package httpclient builds the HTTP clients processors use to call external
+// services: JWKS and metadata fetches, token introspection, IP range
+// downloads, revocation checks and log shipping. Every client shares one
+// connection pool, proxy and TLS configuration, set once at startup with
+// Configure, and is instrumented per service.
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samber/oops"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "httpclient_requests_total",
+		Help: "Outbound HTTP request attempts, by service and status code ('error' for transport failures).",
+	}, []string{"service", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "httpclient_request_duration_seconds",
+		Help:    "Duration of outbound HTTP request attempts until the response headers, by service.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service"})
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "httpclient_retries_total",
+		Help: "Outbound HTTP requests retried, by service.",
+	}, []string{"service"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(requestsTotal, requestDuration, retriesTotal)
+}
+
+// Defaults are the process-wide settings of outbound clients.
+type Defaults struct {
+	// Proxy is the proxy URL of every request; empty uses HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY, and "direct" connects directly.
+	Proxy string
+	// CAFile holds PEM CAs trusted in addition to the system roots.
+	CAFile string
+	// MaxIdleConnsPerHost and IdleConnTimeout bound the shared pool.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// MaxRetries bounds retries of idempotent requests (GET and HEAD)
+	// failing with a transport error, 429 or 502-504; RetryBackoff is the
+	// initial delay between them, doubled each time.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// shared is the configured state clients are created from.
+type shared struct {
+	defaults  Defaults
+	transport *http.Transport
+}
+
+var current atomic.Pointer[shared]
+
+func init() {
+	s, _ := newShared(Defaults{MaxIdleConnsPerHost: 16, IdleConnTimeout: 90 * time.Second})
+	current.Store(s)
+}
+
+// Configure replaces the defaults of the clients created afterwards; call it
+// at startup, before creating any.
+func Configure(d Defaults) error {
+	s, err := newShared(d)
+	if err != nil {
+		return err
+	}
+	current.Store(s)
+	return nil
+}
+
+func newShared(d Defaults) (*shared, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = d.MaxIdleConnsPerHost
+	t.IdleConnTimeout = d.IdleConnTimeout
+	switch d.Proxy {
+	case "":
+		t.Proxy = http.ProxyFromEnvironment
+	case "direct":
+		t.Proxy = nil
+	default:
+		u, err := url.Parse(d.Proxy)
+		if err != nil || u.Host == "" {
+			return nil, oops.
+				In("httpclient").
+				Code(errcode.InvalidEndpoint).
+				With("proxy", d.Proxy).
+				Errorf("invalid proxy URL %q", d.Proxy)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if d.CAFile != "" {
+		pem, err := os.ReadFile(d.CAFile)
+		if err != nil {
+			return nil, oops.In("httpclient").Code(errcode.ReadCAFailed).With("ca_file", d.CAFile).Wrapf(err, "failed to read CA file")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, oops.In("httpclient").Code(errcode.AppendCertsFailed).With("ca_file", d.CAFile).Errorf("no certificates found in %s", d.CAFile)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &shared{defaults: d, transport: t}, nil
+}
+
+// New returns a client for the named service, e.g. "jwks", on the shared
+// pool. timeout bounds each request including its retries; 0 leaves it to
+// the request context.
+func New(service string, timeout time.Duration) *http.Client {
+	s := current.Load()
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &transport{
+			service:    service,
+			base:       s.transport,
+			maxRetries: s.defaults.MaxRetries,
+			backoff:    s.defaults.RetryBackoff,
+		},
+	}
+}
+
+// transport instruments and retries requests of one service.
+type transport struct {
+	service    string
+	base       http.RoundTripper
+	maxRetries int
+	backoff    time.Duration
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.Body == nil || req.Body == http.NoBody)
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := t.base.RoundTrip(req)
+		requestDuration.WithLabelValues(t.service).Observe(time.Since(start).Seconds())
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		requestsTotal.WithLabelValues(t.service, code).Inc()
+
+		if !retryable || attempt >= t.maxRetries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		retriesTotal.WithLabelValues(t.service).Inc()
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+// shouldRetry reports whether an attempt failed transiently: a transport
+// error while the request is still wanted, or a 429, 502, 503 or 504 answer.
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewDefaults builds Defaults from the CLI configuration block.
+func NewDefaults(cfg config.HTTPClientConfig) Defaults {
+	return Defaults{
+		Proxy:               cfg.Proxy,
+		CAFile:              cfg.CAFile,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+		MaxRetries:          cfg.MaxRetries,
+		RetryBackoff:        cfg.RetryBackoff,
+	}
+}
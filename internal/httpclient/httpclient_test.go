@@ -0,0 +1,67 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetries(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	if err := Configure(Defaults{MaxRetries: 2, RetryBackoff: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(Defaults{})
+	client := New("test-retries", time.Second)
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || attempts.Load() != 3 {
+		t.Errorf("GET: status %d after %d attempts, want 200 after 3", resp.StatusCode, attempts.Load())
+	}
+	if got := testutil.ToFloat64(retriesTotal.WithLabelValues("test-retries")); got != 2 {
+		t.Errorf("retries = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(requestsTotal.WithLabelValues("test-retries", "503")); got != 2 {
+		t.Errorf("503 attempts = %v, want 2", got)
+	}
+
+	// Requests with side effects are not retried.
+	attempts.Store(0)
+	resp, err = client.Post(srv.URL, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || attempts.Load() != 1 {
+		t.Errorf("POST: status %d after %d attempts, want 503 after 1", resp.StatusCode, attempts.Load())
+	}
+}
+
+func TestConfigureRejectsInvalidSettings(t *testing.T) {
+	for _, d := range []Defaults{
+		{Proxy: "proxy:3128"},
+		{CAFile: "/nonexistent/ca.pem"},
+	} {
+		if err := Configure(d); err == nil {
+			t.Errorf("Configure(%+v) succeeded", d)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package introspection validates opaque OAuth2 access tokens against an
+// RFC 7662 token introspection endpoint.
+package introspection
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"golang.org/x/sync/singleflight"
+)
+
+type Config struct {
+	Endpoint      string
+	ClientID      string
+	ClientSecret  string
+	TokenTypeHint string
+	CacheSize     int
+	CacheTTL      time.Duration
+	Timeout       time.Duration
+	// Clock checks cached tokens' expiry; nil is the system clock.
+	Clock clock.Clock
+}
+
+// Result is the subset of the RFC 7662 introspection response used for
+// authorization decisions.
+type Result struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// Scopes returns the space-delimited scope claim as a slice.
+func (r *Result) Scopes() []string {
+	return strings.Fields(r.Scope)
+}
+
+// expired reports whether the token's exp claim has passed.
+func (r *Result) expired(now time.Time) bool {
+	return r.ExpiresAt > 0 && now.Unix() >= r.ExpiresAt
+}
+
+type Introspector struct {
+	cfg    Config
+	client *http.Client
+	cache  *expirable.LRU[string, *Result]
+	clock  clock.Clock
+	sg     singleflight.Group
+	log    zerolog.Logger
+}
+
+func New(cfg Config, log zerolog.Logger) (*Introspector, error) {
+	if _, err := url.ParseRequestURI(cfg.Endpoint); err != nil {
+		return nil, oops.
+			In("introspection").
+			Code(errcode.InvalidEndpoint).
+			With("endpoint", cfg.Endpoint).
+			Wrapf(err, "invalid introspection endpoint")
+	}
+	if strings.TrimSpace(cfg.ClientID) == "" || strings.TrimSpace(cfg.ClientSecret) == "" {
+		return nil, oops.
+			In("introspection").
+			Code(errcode.MissingCredentials).
+			Errorf("missing client ID or client secret")
+	}
+
+	return &Introspector{
+		cfg:    cfg,
+		client: httpclient.New("introspection", cfg.Timeout),
+		cache:  expirable.NewLRU[string, *Result](cfg.CacheSize, nil, cfg.CacheTTL),
+		clock:  clock.Or(cfg.Clock),
+		log:    log.With().Str("component", "introspection").Logger(),
+	}, nil
+}
+
+// Introspect returns the introspection result for token. Results are cached
+// by token hash and never served past the token's own expiry.
+func (i *Introspector) Introspect(ctx context.Context, token string) (*Result, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	if cached, ok := i.cache.Get(key); ok && !cached.expired(i.clock.Now()) {
+		return cached, nil
+	}
+
+	val, err, _ := i.sg.Do(key, func() (any, error) {
+		if cached, ok := i.cache.Get(key); ok && !cached.expired(i.clock.Now()) {
+			return cached, nil
+		}
+		start := i.clock.Now()
+		result, err := i.introspect(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		i.log.Debug().
+			Dur("duration", i.clock.Since(start)).
+			Bool("active", result.Active).
+			Str("client_id", result.ClientID).
+			Msg("token introspected")
+		i.cache.Add(key, result)
+		return result, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*Result), nil
+}
+
+func (i *Introspector) introspect(ctx context.Context, token string) (*Result, error) {
+	form := url.Values{"token": {token}}
+	if i.cfg.TokenTypeHint != "" {
+		form.Set("token_type_hint", i.cfg.TokenTypeHint)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.cfg.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, oops.
+			In("introspection").
+			Code(errcode.RequestBuildFailed).
+			Wrapf(err, "failed to build introspection request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(i.cfg.ClientID), url.QueryEscape(i.cfg.ClientSecret))
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, oops.
+			In("introspection").
+			Code(errcode.APIRequestFailed).
+			With("endpoint", i.cfg.Endpoint).
+			Wrapf(err, "introspection request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, oops.
+			In("introspection").
+			Code(errcode.APIBadStatus).
+			With("endpoint", i.cfg.Endpoint).
+			With("status", resp.StatusCode).
+			With("body", string(body)).
+			Errorf("introspection endpoint returned status %d", resp.StatusCode)
+	}
+
+	var result Result
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, oops.
+			In("introspection").
+			Code(errcode.APIDecodeFailed).
+			With("endpoint", i.cfg.Endpoint).
+			Wrapf(err, "failed to decode introspection response")
+	}
+	return &result, nil
+}
@@ -0,0 +1,116 @@
+package introspection
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/rs/zerolog"
+)
+
+// newEndpoint serves introspection results by token, counting requests.
+func newEndpoint(t *testing.T, results map[string]Result) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if id, secret, _ := r.BasicAuth(); id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		result, ok := results[r.PostFormValue("token")]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func newIntrospector(t *testing.T, endpoint string, clk clock.Clock) *Introspector {
+	t.Helper()
+	i, err := New(Config{
+		Endpoint:     endpoint,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		CacheSize:    16,
+		CacheTTL:     time.Hour,
+		Timeout:      time.Second,
+		Clock:        clk,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestIntrospect(t *testing.T) {
+	srv, calls := newEndpoint(t, map[string]Result{
+		"active":   {Active: true, Subject: "alice", Scope: "read write"},
+		"inactive": {Active: false},
+	})
+	i := newIntrospector(t, srv.URL, nil)
+
+	result, err := i.Introspect(context.Background(), "active")
+	if err != nil || !result.Active || result.Subject != "alice" {
+		t.Fatalf("active token: %+v, %v", result, err)
+	}
+	if scopes := result.Scopes(); len(scopes) != 2 || scopes[1] != "write" {
+		t.Errorf("scopes = %q", scopes)
+	}
+	if result, err := i.Introspect(context.Background(), "inactive"); err != nil || result.Active {
+		t.Errorf("inactive token: %+v, %v", result, err)
+	}
+	// Both results are cached.
+	_, _ = i.Introspect(context.Background(), "active")
+	_, _ = i.Introspect(context.Background(), "inactive")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("endpoint called %d times, want 2", n)
+	}
+}
+
+func TestIntrospectCacheBoundedByExpiry(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	srv, calls := newEndpoint(t, map[string]Result{
+		"short": {Active: true, ExpiresAt: clk.Now().Add(time.Minute).Unix()},
+	})
+	i := newIntrospector(t, srv.URL, clk)
+
+	_, _ = i.Introspect(context.Background(), "short")
+	_, _ = i.Introspect(context.Background(), "short")
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("endpoint called %d times before exp, want 1", n)
+	}
+	// The cache TTL is an hour, but the token expired.
+	clk.Advance(2 * time.Minute)
+	_, _ = i.Introspect(context.Background(), "short")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("endpoint called %d times after exp, want 2", n)
+	}
+}
+
+func TestIntrospectEndpointFailure(t *testing.T) {
+	srv, calls := newEndpoint(t, nil)
+	i := newIntrospector(t, srv.URL, nil)
+	for range 2 {
+		if _, err := i.Introspect(context.Background(), "any"); err == nil {
+			t.Fatal("no error from a failing endpoint")
+		}
+	}
+	// Failures are not cached.
+	if n := calls.Load(); n != 2 {
+		t.Errorf("endpoint called %d times, want 2", n)
+	}
+
+	srv.Close()
+	if _, err := i.Introspect(context.Background(), "any"); err == nil {
+		t.Error("no error from an unreachable endpoint")
+	}
+}
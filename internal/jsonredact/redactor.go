@@ -0,0 +1,489 @@
+// Package jsonredact removes or masks JSON fields from a document as it
+// streams through, without buffering the whole document.
+package jsonredact
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Action is what happens to a value matched by a rule.
+type Action int
+
+const (
+	// ActionMask replaces the value with the mask.
+	ActionMask Action = iota + 1
+	// ActionRemove drops the object member entirely. Array elements cannot
+	// be removed without rewriting their siblings, so they are masked.
+	ActionRemove
+)
+
+// Rule applies Action to values whose path matches Path.
+type Rule struct {
+	Path   []string
+	Action Action
+}
+
+// ParsePath parses a dotted path such as "user.password", "items[*].ssn" or
+// "**.token". "*" matches any single key or array index, "**" matches any
+// number of levels. A leading "$" is ignored.
+func ParsePath(path string) ([]string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.ReplaceAll(path, "[", ".")
+	path = strings.ReplaceAll(path, "]", "")
+	segments := strings.Split(path, ".")
+	if path == "" || slices.Contains(segments, "") {
+		return nil, oops.
+			In("jsonredact").
+			Code(errcode.InvalidPath).
+			With("path", path).
+			Errorf("invalid JSON path %q", path)
+	}
+	return segments, nil
+}
+
+type state int
+
+const (
+	stValue state = iota
+	stArrayStart
+	stObjectKey
+	stKey
+	stColon
+	stString
+	stLiteral
+	stAfterValue
+	stEnd
+	stFailed
+)
+
+type frame struct {
+	object  bool
+	emitted bool
+	index   int
+	key     string
+}
+
+// Redactor is a streaming JSON rewriter. Feed it consecutive chunks of one
+// document with Write; it is not safe for concurrent use.
+type Redactor struct {
+	rules []Rule
+	mask  []byte
+
+	state state
+	stack []frame
+	out   []byte
+
+	// pending holds a comma-separated object member's leading whitespace
+	// and key until the key is known, so removed members leave no trace.
+	pending      []byte
+	pendingComma bool
+	key          []byte
+	escaped      bool
+	// literal holds the number, true, false or null being copied, to be
+	// validated once it ends.
+	literal []byte
+	// valueAction applies to the next value; removing drops the member's
+	// colon and value.
+	valueAction Action
+	removing    bool
+
+	skip skipper
+	err  error
+}
+
+// New creates a Redactor replacing masked values with mask, which is
+// encoded as a JSON string.
+func New(rules []Rule, mask string) *Redactor {
+	encoded, _ := json.Marshal(mask)
+	return &Redactor{rules: rules, mask: encoded}
+}
+
+// Err returns the syntax error that stopped redaction, if any. After an
+// error the remaining input is passed through unchanged.
+func (r *Redactor) Err() error {
+	return r.err
+}
+
+// Write consumes the next chunk and returns the rewritten bytes ready to be
+// sent. Bytes that cannot be decided yet are held until a later call.
+func (r *Redactor) Write(chunk []byte) []byte {
+	r.out = r.out[:0]
+	for i := 0; i < len(chunk); i++ {
+		if r.state == stFailed {
+			r.out = append(r.out, chunk[i:]...)
+			break
+		}
+		if !r.step(chunk[i]) {
+			i-- // reprocess the delimiter that ended a literal
+		}
+	}
+	return slices.Clone(r.out)
+}
+
+// Close flushes held bytes at the end of the document.
+func (r *Redactor) Close() []byte {
+	r.out = r.out[:0]
+	r.flushPending()
+	if r.state == stLiteral {
+		if !json.Valid(r.literal) {
+			r.fail(0)
+		} else {
+			r.valueDone()
+		}
+	}
+	if r.err == nil && r.state != stEnd {
+		r.err = oops.In("jsonredact").Code(errcode.UnexpectedEOF).New("unexpected end of JSON input")
+	}
+	return slices.Clone(r.out)
+}
+
+// step consumes c, reporting false if c must be processed again.
+func (r *Redactor) step(c byte) bool {
+	if r.skip.active {
+		done, consumed := r.skip.step(c)
+		if done {
+			r.valueDone()
+		}
+		return consumed
+	}
+
+	switch r.state {
+	case stValue:
+		if isSpace(c) {
+			r.emit(c)
+			return true
+		}
+		return r.beginValue(c)
+
+	case stArrayStart:
+		if isSpace(c) {
+			r.emit(c)
+			return true
+		}
+		if c == ']' {
+			r.closeContainer(c)
+			return true
+		}
+		r.state = stValue
+		return r.beginValue(c)
+
+	case stObjectKey:
+		switch {
+		case isSpace(c):
+			r.pending = append(r.pending, c)
+		case c == '"':
+			r.key = append(r.key[:0], c)
+			r.state = stKey
+		case c == '}' && !r.pendingComma:
+			r.out = append(r.out, r.pending...)
+			r.pending = r.pending[:0]
+			r.closeContainer(c)
+		default:
+			r.fail(c)
+		}
+		return true
+
+	case stKey:
+		r.key = append(r.key, c)
+		if r.escaped {
+			r.escaped = false
+		} else if c == '\\' {
+			r.escaped = true
+		} else if c == '"' {
+			r.endKey()
+		}
+		return true
+
+	case stColon:
+		if isSpace(c) {
+			if !r.removing {
+				r.emit(c)
+			}
+			return true
+		}
+		if c != ':' {
+			r.fail(c)
+			return true
+		}
+		if !r.removing {
+			r.emit(c)
+		}
+		r.state = stValue
+		return true
+
+	case stString:
+		r.emit(c)
+		if r.escaped {
+			r.escaped = false
+		} else if c == '\\' {
+			r.escaped = true
+		} else if c == '"' {
+			r.valueDone()
+		}
+		return true
+
+	case stLiteral:
+		if isSpace(c) || c == ',' || c == ']' || c == '}' {
+			if !json.Valid(r.literal) {
+				r.fail(c)
+				return true
+			}
+			r.valueDone()
+			return false
+		}
+		r.emit(c)
+		r.literal = append(r.literal, c)
+		return true
+
+	case stAfterValue:
+		top := &r.stack[len(r.stack)-1]
+		switch {
+		case isSpace(c):
+			r.emit(c)
+		case c == ',' && top.object:
+			r.pendingComma = true
+			r.state = stObjectKey
+		case c == ',':
+			r.emit(c)
+			top.index++
+			r.state = stValue
+		case c == '}' && top.object, c == ']' && !top.object:
+			r.closeContainer(c)
+		default:
+			r.fail(c)
+		}
+		return true
+
+	case stEnd:
+		if isSpace(c) {
+			r.emit(c)
+		} else {
+			r.fail(c)
+		}
+		return true
+	}
+	return true
+}
+
+func (r *Redactor) beginValue(c byte) bool {
+	action := r.valueAction
+	if n := len(r.stack); n > 0 && !r.stack[n-1].object {
+		if action = r.match(); action == ActionRemove {
+			action = ActionMask
+		}
+	}
+	r.valueAction = 0
+
+	if r.removing || action == ActionMask {
+		if !r.removing {
+			r.out = append(r.out, r.mask...)
+		}
+		if !r.skip.start(c) {
+			r.fail(c)
+		}
+		return true
+	}
+
+	switch {
+	case c == '{':
+		r.emit(c)
+		r.stack = append(r.stack, frame{object: true})
+		r.state = stObjectKey
+	case c == '[':
+		r.emit(c)
+		r.stack = append(r.stack, frame{})
+		r.state = stArrayStart
+	case c == '"':
+		r.emit(c)
+		r.state = stString
+	case c == '-' || (c >= '0' && c <= '9') || c == 't' || c == 'f' || c == 'n':
+		r.emit(c)
+		r.literal = append(r.literal[:0], c)
+		r.state = stLiteral
+	default:
+		r.fail(c)
+	}
+	return true
+}
+
+func (r *Redactor) endKey() {
+	var key string
+	if err := json.Unmarshal(r.key, &key); err != nil {
+		r.fail(0)
+		return
+	}
+	top := &r.stack[len(r.stack)-1]
+	top.key = key
+	action := r.match()
+
+	if action == ActionRemove {
+		r.removing = true
+	} else {
+		if r.pendingComma && top.emitted {
+			r.out = append(r.out, ',')
+		}
+		r.out = append(r.out, r.pending...)
+		r.out = append(r.out, r.key...)
+		top.emitted = true
+		r.valueAction = action
+	}
+	r.pending, r.key = r.pending[:0], r.key[:0]
+	r.pendingComma = false
+	r.state = stColon
+}
+
+func (r *Redactor) closeContainer(c byte) {
+	r.emit(c)
+	r.stack = r.stack[:len(r.stack)-1]
+	r.valueDone()
+}
+
+func (r *Redactor) valueDone() {
+	r.removing = false
+	if len(r.stack) == 0 {
+		r.state = stEnd
+		return
+	}
+	r.state = stAfterValue
+}
+
+func (r *Redactor) emit(c byte) {
+	r.out = append(r.out, c)
+}
+
+func (r *Redactor) fail(c byte) {
+	if r.err == nil {
+		r.err = oops.
+			In("jsonredact").
+			Code(errcode.SyntaxError).
+			With("char", string(c)).
+			New("invalid JSON input")
+	}
+	r.flushPending()
+	if c != 0 {
+		r.out = append(r.out, c)
+	}
+	r.skip = skipper{}
+	r.state = stFailed
+}
+
+// flushPending emits the held comma, whitespace and key of a member cut
+// short by an error or the end of input.
+func (r *Redactor) flushPending() {
+	if r.pendingComma && len(r.stack) > 0 && r.stack[len(r.stack)-1].emitted {
+		r.out = append(r.out, ',')
+	}
+	r.out = append(r.out, r.pending...)
+	r.out = append(r.out, r.key...)
+	r.pending, r.key = r.pending[:0], r.key[:0]
+	r.pendingComma = false
+}
+
+// match returns the strongest action of the rules matching the current path.
+func (r *Redactor) match() Action {
+	path := make([]string, len(r.stack))
+	for i, f := range r.stack {
+		if f.object {
+			path[i] = f.key
+		} else {
+			path[i] = strconv.Itoa(f.index)
+		}
+	}
+	var action Action
+	for _, rule := range r.rules {
+		if rule.Action > action && matchPath(rule.Path, path) {
+			action = rule.Action
+		}
+	}
+	return action
+}
+
+func matchPath(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchPath(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 || (pattern[0] != "*" && pattern[0] != path[0]) {
+		return false
+	}
+	return matchPath(pattern[1:], path[1:])
+}
+
+// skipper consumes one complete JSON value without emitting it.
+type skipper struct {
+	active   bool
+	depth    int
+	inString bool
+	escaped  bool
+	literal  bool
+}
+
+// start begins skipping the value starting with c, reporting false if c
+// cannot start a value.
+func (s *skipper) start(c byte) bool {
+	*s = skipper{active: true}
+	switch {
+	case c == '{' || c == '[':
+		s.depth = 1
+	case c == '"':
+		s.inString = true
+	case c == '-' || (c >= '0' && c <= '9') || c == 't' || c == 'f' || c == 'n':
+		s.literal = true
+	default:
+		*s = skipper{}
+		return false
+	}
+	return true
+}
+
+// step consumes c, reporting whether the value ended and whether c belonged
+// to it.
+func (s *skipper) step(c byte) (done, consumed bool) {
+	switch {
+	case s.inString:
+		if s.escaped {
+			s.escaped = false
+		} else if c == '\\' {
+			s.escaped = true
+		} else if c == '"' {
+			s.inString = false
+			if s.depth == 0 {
+				s.active = false
+				return true, true
+			}
+		}
+	case s.literal:
+		if isSpace(c) || c == ',' || c == ']' || c == '}' {
+			s.active = false
+			return true, false
+		}
+	case c == '"':
+		s.inString = true
+	case c == '{' || c == '[':
+		s.depth++
+	case c == '}' || c == ']':
+		s.depth--
+		if s.depth == 0 {
+			s.active = false
+			return true, true
+		}
+	}
+	return false, true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
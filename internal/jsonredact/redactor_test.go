@@ -0,0 +1,157 @@
+package jsonredact
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+)
+
+func rules(t *testing.T, paths map[string]Action) []Rule {
+	t.Helper()
+	var out []Rule
+	for p, action := range paths {
+		path, err := ParsePath(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, Rule{Path: path, Action: action})
+	}
+	return out
+}
+
+// redact runs doc through a Redactor in chunks split at the given offsets.
+func redact(rules []Rule, doc string, splits ...int) (string, error) {
+	r := New(rules, "***")
+	var out []byte
+	prev := 0
+	for _, at := range append(splits, len(doc)) {
+		out = append(out, r.Write([]byte(doc[prev:at]))...)
+		prev = at
+	}
+	out = append(out, r.Close()...)
+	return string(out), r.Err()
+}
+
+func TestRedactor(t *testing.T) {
+	for _, tt := range []struct {
+		name, doc, want string
+		paths           map[string]Action
+	}{
+		{
+			name:  "mask",
+			doc:   `{"user":{"name":"a","password":"p\"w"},"n":1}`,
+			want:  `{"user":{"name":"a","password":"***"},"n":1}`,
+			paths: map[string]Action{"user.password": ActionMask},
+		},
+		{
+			name:  "remove first, middle and last members",
+			doc:   `{"a":1, "b":{"x":[1,2]}, "c":"s", "d":null}`,
+			want:  `{ "c":"s"}`,
+			paths: map[string]Action{"a": ActionRemove, "b": ActionRemove, "d": ActionRemove},
+		},
+		{
+			name:  "array wildcard",
+			doc:   `{"items":[{"ssn":"1","id":1},{"ssn":"2","id":2}]}`,
+			want:  `{"items":[{"ssn":"***","id":1},{"ssn":"***","id":2}]}`,
+			paths: map[string]Action{"items[*].ssn": ActionMask},
+		},
+		{
+			name:  "array elements are masked, not removed",
+			doc:   `{"tags":["a","b"]}`,
+			want:  `{"tags":["***","***"]}`,
+			paths: map[string]Action{"tags.*": ActionRemove},
+		},
+		{
+			name:  "any depth",
+			doc:   `{"token":"t","a":{"b":[{"token":true}]},"tokens":1}`,
+			want:  `{"token":"***","a":{"b":[{"token":"***"}]},"tokens":1}`,
+			paths: map[string]Action{"**.token": ActionMask},
+		},
+		{
+			name:  "escaped keys and unicode",
+			doc:   `{"password":"x","ключ":"значение","k":"é\\"}`,
+			want:  `{"password":"***","ключ":"значение","k":"é\\"}`,
+			paths: map[string]Action{"password": ActionMask},
+		},
+		{
+			name:  "numbers and literals",
+			doc:   ` [ -1.5e3 , true , false , null , {"n":0} ] `,
+			want:  ` [ -1.5e3 , true , false , null , {"n":"***"} ] `,
+			paths: map[string]Action{"*.n": ActionMask},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := rules(t, tt.paths)
+			got, err := redact(rules, tt.doc)
+			if err != nil || got != tt.want {
+				t.Fatalf("redact = %s, %v; want %s", got, err, tt.want)
+			}
+			if !json.Valid([]byte(got)) {
+				t.Errorf("output is not valid JSON: %s", got)
+			}
+			// Chunk boundaries never change the output.
+			for at := 1; at < len(tt.doc); at++ {
+				if got, err := redact(rules, tt.doc, at); err != nil || got != tt.want {
+					t.Errorf("split at %d: %s, %v", at, got, err)
+				}
+			}
+			bytewise := make([]int, 0, len(tt.doc))
+			for at := 1; at < len(tt.doc); at++ {
+				bytewise = append(bytewise, at)
+			}
+			if got, err := redact(rules, tt.doc, bytewise...); err != nil || got != tt.want {
+				t.Errorf("byte by byte: %s, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestRedactorMalformed(t *testing.T) {
+	secret := map[string]Action{"password": ActionMask}
+	for _, tt := range []struct {
+		name, doc string
+		code      errcode.Code
+	}{
+		{"not json", `password=x`, errcode.SyntaxError},
+		{"bad literal", `{"a":tru,"password":"x"}`, errcode.SyntaxError},
+		{"missing colon", `{"password" "x"}`, errcode.SyntaxError},
+		{"missing key", `{"a":1, x}`, errcode.SyntaxError},
+		{"bad number", `[1.2.3]`, errcode.SyntaxError},
+		{"trailing data", `{"a":1} {"password":"x"}`, errcode.SyntaxError},
+		{"truncated", `{"a":1,"pass`, errcode.UnexpectedEOF},
+		{"unterminated string", `{"a":"x`, errcode.UnexpectedEOF},
+		{"truncated literal", `[tr`, errcode.SyntaxError},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := rules(t, secret)
+			for at := 0; at < len(tt.doc); at++ {
+				got, err := redact(rules, tt.doc, at)
+				if !errcode.Is(err, tt.code) {
+					t.Fatalf("split at %d: err = %v, want %s", at, err, tt.code)
+				}
+				// Input after the error passes through; nothing is lost.
+				if got != tt.doc {
+					t.Errorf("split at %d: output %s, want the input", at, got)
+				}
+			}
+		})
+	}
+
+	// Values redacted before the error stay redacted.
+	got, err := redact(rules(t, secret), `{"password":"x","a":[}`)
+	if !errcode.Is(err, errcode.SyntaxError) || got != `{"password":"***","a":[}` {
+		t.Errorf("redact = %s, %v", got, err)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	for _, bad := range []string{"", "$", "a..b", "a.", "[]"} {
+		if _, err := ParsePath(bad); !errcode.Is(err, errcode.InvalidPath) {
+			t.Errorf("ParsePath(%q) err = %v", bad, err)
+		}
+	}
+	if got, err := ParsePath("$.items[*].ssn"); err != nil || len(got) != 3 || got[1] != "*" {
+		t.Errorf("ParsePath = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,63 @@
+// Package jsonstrict decodes JSON objects by their exact keys. encoding/json
+// matches struct fields case-insensitively and keeps the last of repeated
+// keys, so a body such as {"model":"a","Model":"b"} reads differently to a
+// processor and to an upstream in another language; processors enforcing
+// policy on request bodies decode them with Object instead.
+package jsonstrict
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Object decodes data, a JSON object, into its members keyed exactly as
+// written. Keys repeated, or differing only in case, are an error.
+func Object(data []byte) (map[string]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, oops.In("jsonstrict").Code(errcode.InvalidJSON).Errorf("JSON body is not an object")
+	}
+	members := make(map[string]json.RawMessage)
+	folded := make(map[string]string)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, oops.In("jsonstrict").Code(errcode.InvalidJSON).Wrapf(err, "invalid JSON object")
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, oops.In("jsonstrict").Code(errcode.InvalidJSON).With("key", key).Wrapf(err, "invalid JSON object")
+		}
+		if prev, ok := folded[fold(key)]; ok {
+			return nil, oops.
+				In("jsonstrict").
+				Code(errcode.InvalidJSON).
+				With("key", key).
+				Errorf("JSON key %q repeats %q", key, prev)
+		}
+		folded[fold(key)] = key
+		members[key] = value
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, oops.In("jsonstrict").Code(errcode.InvalidJSON).Wrapf(err, "invalid JSON object")
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, oops.In("jsonstrict").Code(errcode.InvalidJSON).Errorf("data after the JSON object")
+	}
+	return members, nil
+}
+
+// fold returns the key encoding/json would match key as, folding case the
+// way it does, including the Kelvin sign and long s.
+func fold(key string) string {
+	return strings.Map(func(r rune) rune {
+		return unicode.ToLower(unicode.ToUpper(r))
+	}, key)
+}
@@ -0,0 +1,39 @@
+package jsonstrict
+
+import (
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+)
+
+func TestObject(t *testing.T) {
+	for body, valid := range map[string]bool{
+		`{"model":"a","messages":[{"role":"user"}]}`: true,
+		` {} `:                             true,
+		`{"model":"a","Model":"b"}`:        false,
+		`{"model":"a","model":"b"}`:        false,
+		"{\"kid\":1,\"\u212aid\":2}":       false, // Kelvin sign
+		"{\"stream\":1,\"\u017ftream\":2}": false, // long s
+		`{"a":{"b":1,"B":2}}`:              true,  // nested objects are decoded on their own
+		`[]`:                               false,
+		`{"model":"a"} {}`:                 false,
+		`{"model":}`:                       false,
+		`not json`:                         false,
+	} {
+		members, err := Object([]byte(body))
+		if valid != (err == nil) {
+			t.Errorf("Object(%s) = %v, %v", body, members, err)
+		}
+		if err != nil && !errcode.Is(err, errcode.InvalidJSON) {
+			t.Errorf("Object(%s): error %v is not INVALID_JSON", body, err)
+		}
+	}
+
+	members, err := Object([]byte(`{"model":"a","Max_Tokens":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := members["max_tokens"]; ok || string(members["model"]) != `"a"` {
+		t.Errorf("members %v are not keyed exactly", members)
+	}
+}
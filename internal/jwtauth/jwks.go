@@ -0,0 +1,129 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// JWK is a JSON Web Key (RFC 7517) of the types used to verify signatures.
+type JWK struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid,omitempty"`
+	Use     string `json:"use,omitempty"`
+	Alg     string `json:"alg,omitempty"`
+	// RSA.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP.
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// key is a parsed verification key.
+type key struct {
+	id  string
+	alg string
+	pub crypto.PublicKey
+}
+
+// publicKey parses the key material of k.
+func (k *JWK) publicKey() (crypto.PublicKey, error) {
+	errb := oops.In("jwtauth").Code(errcode.APIDecodeFailed).With("kid", k.KeyID).With("kty", k.KeyType)
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, errb.Wrapf(err, "invalid RSA modulus")
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errb.Errorf("invalid RSA exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, errb.With("bits", n.BitLen()).Errorf("RSA key shorter than 2048 bits")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errb.With("crv", k.Curve).Errorf("unsupported EC curve %q", k.Curve)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, errb.Wrapf(err, "invalid EC x coordinate")
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, errb.Wrapf(err, "invalid EC y coordinate")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		// Validate the point through the ECDH conversion, which rejects
+		// points off the curve.
+		if _, err := pub.ECDH(); err != nil {
+			return nil, errb.Wrapf(err, "invalid EC point")
+		}
+		return pub, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, errb.With("crv", k.Curve).Errorf("unsupported OKP curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errb.Errorf("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errb.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, oops.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// parseKeys returns the signature keys of set. Keys that cannot be parsed
+// are skipped and reported in skipped, so one unsupported key does not
+// take down the rest.
+func parseKeys(set *JWKS) (keys []key, skipped []error) {
+	for i := range set.Keys {
+		k := &set.Keys[i]
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			skipped = append(skipped, err)
+			continue
+		}
+		keys = append(keys, key{id: k.KeyID, alg: k.Alg, pub: pub})
+	}
+	return keys, skipped
+}
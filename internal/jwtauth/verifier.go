@@ -0,0 +1,333 @@
+// Package jwtauth verifies JWT bearer tokens against the keys published at a
+// JWKS URL.
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultAlgorithms are the asymmetric signature algorithms accepted by
+// default. HMAC algorithms are never accepted: a JWKS holds public keys.
+var DefaultAlgorithms = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+type Config struct {
+	JWKSURL string
+	// Issuer, if set, must equal the iss claim.
+	Issuer string
+	// Audiences, if set, must include one of the aud claim's values.
+	Audiences []string
+	// Algorithms are the accepted alg values; empty is DefaultAlgorithms.
+	Algorithms []string
+	// Leeway is the clock skew tolerated for exp, nbf and iat.
+	Leeway time.Duration
+	// RefreshInterval is how often the JWKS is fetched again.
+	RefreshInterval time.Duration
+	// MinRefreshInterval limits refreshes triggered by unknown key IDs.
+	MinRefreshInterval time.Duration
+	Timeout            time.Duration
+	// Clock checks token times; nil is the system clock.
+	Clock clock.Clock
+}
+
+// Claims are the claims of a verified token.
+type Claims map[string]any
+
+// Subject returns the sub claim.
+func (c Claims) Subject() string {
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+type Verifier struct {
+	cfg    Config
+	client *http.Client
+	clock  clock.Clock
+	parser *jwt.Parser
+	log    zerolog.Logger
+	sg     singleflight.Group
+
+	mu        sync.RWMutex
+	keys      []key
+	fetchedAt time.Time
+}
+
+// New creates a Verifier. The JWKS is fetched on first use and refreshed
+// every RefreshInterval, or sooner when a token names an unknown key.
+func New(cfg Config, log zerolog.Logger) (*Verifier, error) {
+	if _, err := url.ParseRequestURI(cfg.JWKSURL); err != nil {
+		return nil, oops.
+			In("jwtauth").
+			Code(errcode.InvalidEndpoint).
+			With("jwks_url", cfg.JWKSURL).
+			Wrapf(err, "invalid JWKS URL")
+	}
+	if len(cfg.Algorithms) == 0 {
+		cfg.Algorithms = DefaultAlgorithms
+	}
+	for _, alg := range cfg.Algorithms {
+		if !slices.Contains(DefaultAlgorithms, alg) {
+			return nil, oops.
+				In("jwtauth").
+				Code(errcode.InvalidConfig).
+				With("alg", alg).
+				Errorf("unsupported JWT algorithm %q", alg)
+		}
+	}
+	return &Verifier{
+		cfg:    cfg,
+		client: httpclient.New("jwks", cfg.Timeout),
+		clock:  clock.Or(cfg.Clock),
+		parser: jwt.NewParser(jwt.WithValidMethods(cfg.Algorithms), jwt.WithoutClaimsValidation()),
+		log:    log.With().Str("component", "jwtauth").Logger(),
+	}, nil
+}
+
+// Verify checks the signature and claims of token and returns its claims.
+func (v *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keyFor(ctx, kid, t.Method.Alg())
+	})
+	if err != nil {
+		var verr *jwt.ValidationError
+		if errors.As(err, &verr) && verr.Inner != nil {
+			if oerr, ok := oops.AsOops(verr.Inner); ok && oerr.Code() != nil {
+				// Key lookup failures keep their own code.
+				return nil, verr.Inner
+			}
+		}
+		code := errcode.Malformed
+		if verr != nil && verr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+			code = errcode.BadSignature
+		}
+		return nil, oops.In("jwtauth").Code(code).Wrapf(err, "invalid token")
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return Claims(claims), nil
+}
+
+// validate checks the time, issuer and audience claims.
+func (v *Verifier) validate(claims jwt.MapClaims) error {
+	now := v.clock.Now()
+	errb := oops.In("jwtauth")
+	exp, ok, err := numericDate(claims, "exp")
+	switch {
+	case err != nil:
+		return errb.Code(errcode.InvalidClaims).Wrap(err)
+	case !ok:
+		return errb.Code(errcode.InvalidClaims).Errorf("token has no exp claim")
+	case !now.Before(exp.Add(v.cfg.Leeway)):
+		return errb.Code(errcode.Expired).With("exp", exp).Errorf("token expired")
+	}
+	if nbf, ok, err := numericDate(claims, "nbf"); err != nil {
+		return errb.Code(errcode.InvalidClaims).Wrap(err)
+	} else if ok && now.Add(v.cfg.Leeway).Before(nbf) {
+		return errb.Code(errcode.InvalidClaims).With("nbf", nbf).Errorf("token not valid yet")
+	}
+	if iat, ok, err := numericDate(claims, "iat"); err != nil {
+		return errb.Code(errcode.InvalidClaims).Wrap(err)
+	} else if ok && now.Add(v.cfg.Leeway).Before(iat) {
+		return errb.Code(errcode.InvalidClaims).With("iat", iat).Errorf("token issued in the future")
+	}
+	if v.cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+			return errb.Code(errcode.InvalidClaims).With("iss", iss).Errorf("unexpected issuer %q", iss)
+		}
+	}
+	if len(v.cfg.Audiences) > 0 {
+		aud := audiences(claims["aud"])
+		if !slices.ContainsFunc(aud, func(a string) bool { return slices.Contains(v.cfg.Audiences, a) }) {
+			return errb.Code(errcode.InvalidClaims).With("aud", aud).Errorf("token is not intended for this audience")
+		}
+	}
+	return nil
+}
+
+// numericDate reads a NumericDate claim; ok is false if it is absent.
+func numericDate(claims jwt.MapClaims, name string) (t time.Time, ok bool, err error) {
+	raw, present := claims[name]
+	if !present {
+		return time.Time{}, false, nil
+	}
+	n, isNumber := raw.(float64)
+	if !isNumber {
+		return time.Time{}, false, oops.With("claim", name).Errorf("claim %q is not a number", name)
+	}
+	sec := int64(n)
+	return time.Unix(sec, int64((n-float64(sec))*float64(time.Second))), true, nil
+}
+
+// audiences returns the aud claim, a string or an array of strings.
+func audiences(raw any) []string {
+	switch aud := raw.(type) {
+	case string:
+		return []string{aud}
+	case []any:
+		out := make([]string, 0, len(aud))
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// keyFor returns the key for kid usable with alg, refreshing the JWKS when
+// it is stale or does not hold kid.
+func (v *Verifier) keyFor(ctx context.Context, kid, alg string) (any, error) {
+	v.mu.RLock()
+	keys, fetchedAt := v.keys, v.fetchedAt
+	v.mu.RUnlock()
+
+	now := v.clock.Now()
+	k, found := match(keys, kid, alg)
+	stale := fetchedAt.IsZero() || now.Sub(fetchedAt) >= v.cfg.RefreshInterval
+	if stale || (!found && now.Sub(fetchedAt) >= v.cfg.MinRefreshInterval) {
+		if err := v.refresh(ctx); err != nil {
+			if !found {
+				return nil, err
+			}
+			// Keep verifying with the keys already known.
+			v.log.Warn().Err(err).Msg("failed to refresh JWKS, using cached keys")
+		} else {
+			v.mu.RLock()
+			keys = v.keys
+			v.mu.RUnlock()
+			k, found = match(keys, kid, alg)
+		}
+	}
+	if !found {
+		return nil, oops.
+			In("jwtauth").
+			Code(errcode.KeyNotFound).
+			With("kid", kid).
+			With("alg", alg).
+			Errorf("no JWKS key for kid %q and alg %s", kid, alg)
+	}
+	return k.pub, nil
+}
+
+// match finds the key named kid whose type and declared alg fit alg. A
+// token without a kid matches keys without one.
+func match(keys []key, kid, alg string) (key, bool) {
+	for _, k := range keys {
+		if k.id == kid && (k.alg == "" || k.alg == alg) && usableWith(k.pub, alg) {
+			return k, true
+		}
+	}
+	return key{}, false
+}
+
+// usableWith reports whether pub is the key type alg signs with.
+func usableWith(pub crypto.PublicKey, alg string) bool {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		return strings.HasPrefix(alg, "ES")
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+// refresh fetches the JWKS; concurrent callers share one request.
+func (v *Verifier) refresh(ctx context.Context) error {
+	_, err, _ := v.sg.Do("jwks", func() (any, error) {
+		keys, err := v.fetch(ctx)
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		// A failed fetch is retried no sooner than MinRefreshInterval.
+		v.fetchedAt = v.clock.Now()
+		if err != nil {
+			if v.keys != nil {
+				v.fetchedAt = v.fetchedAt.Add(v.cfg.MinRefreshInterval - v.cfg.RefreshInterval)
+			}
+			return nil, err
+		}
+		v.keys = keys
+		v.log.Info().Int("keys", len(keys)).Str("jwks_url", v.cfg.JWKSURL).Msg("JWKS loaded")
+		return nil, nil
+	})
+	return err
+}
+
+func (v *Verifier) fetch(ctx context.Context) ([]key, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), v.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, oops.In("jwtauth").Code(errcode.RequestBuildFailed).Wrapf(err, "failed to build JWKS request")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, oops.
+			In("jwtauth").
+			Code(errcode.APIRequestFailed).
+			With("jwks_url", v.cfg.JWKSURL).
+			Wrapf(err, "JWKS request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, oops.
+			In("jwtauth").
+			Code(errcode.APIBadStatus).
+			With("jwks_url", v.cfg.JWKSURL).
+			With("status", resp.StatusCode).
+			Errorf("JWKS endpoint returned status %d", resp.StatusCode)
+	}
+
+	var set JWKS
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, oops.
+			In("jwtauth").
+			Code(errcode.APIDecodeFailed).
+			With("jwks_url", v.cfg.JWKSURL).
+			Wrapf(err, "failed to decode JWKS")
+	}
+	keys, skipped := parseKeys(&set)
+	for _, err := range skipped {
+		v.log.Warn().Err(err).Msg("skipping unusable JWKS key")
+	}
+	if len(keys) == 0 {
+		return nil, oops.
+			In("jwtauth").
+			Code(errcode.APIDecodeFailed).
+			With("jwks_url", v.cfg.JWKSURL).
+			Errorf("JWKS holds no usable signature keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,211 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+)
+
+type testIssuer struct {
+	ec      *ecdsa.PrivateKey
+	ed      ed25519.PrivateKey
+	set     atomic.Pointer[JWKS]
+	fetches atomic.Int32
+	server  *httptest.Server
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{ec: ec, ed: ed}
+	b64 := base64.RawURLEncoding.EncodeToString
+	iss.set.Store(&JWKS{Keys: []JWK{
+		{KeyType: "EC", KeyID: "ec", Use: "sig", Curve: "P-256", X: b64(ec.X.FillBytes(make([]byte, 32))), Y: b64(ec.Y.FillBytes(make([]byte, 32)))},
+		{KeyType: "OKP", KeyID: "ed", Curve: "Ed25519", X: b64(ed.Public().(ed25519.PublicKey))},
+		{KeyType: "oct", KeyID: "hmac"},
+	}})
+	iss.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iss.fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(iss.set.Load())
+	}))
+	t.Cleanup(iss.server.Close)
+	return iss
+}
+
+func (iss *testIssuer) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	var tok *jwt.Token
+	var key any
+	switch kid {
+	case "ed":
+		tok, key = jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims), iss.ed
+	default:
+		tok, key = jwt.NewWithClaims(jwt.SigningMethodES256, claims), iss.ec
+	}
+	tok.Header["kid"] = kid
+	s, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVerify(t *testing.T) {
+	iss := newTestIssuer(t)
+	now := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(now)
+	v, err := New(Config{
+		JWKSURL:            iss.server.URL,
+		Issuer:             "https://issuer.example",
+		Audiences:          []string{"api"},
+		Leeway:             time.Minute,
+		RefreshInterval:    time.Hour,
+		MinRefreshInterval: time.Minute,
+		Timeout:            time.Second,
+		Clock:              clk,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "https://issuer.example",
+			"aud": []string{"other", "api"},
+			"sub": "alice",
+			"exp": now.Add(time.Hour).Unix(),
+			"iat": now.Unix(),
+		}
+	}
+	with := func(k string, v any) jwt.MapClaims {
+		c := valid()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, kid := range []string{"ec", "ed"} {
+		claims, err := v.Verify(context.Background(), iss.sign(t, kid, valid()))
+		if err != nil {
+			t.Fatalf("%s: %v", kid, err)
+		}
+		if claims.Subject() != "alice" {
+			t.Errorf("%s: subject = %q", kid, claims.Subject())
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		code  errcode.Code
+	}{
+		{"garbage", "not.a.token", errcode.Malformed},
+		{"hmac", func() string {
+			s, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, valid()).SignedString([]byte("secret"))
+			return s
+		}(), errcode.BadSignature},
+		{"wrong key", func() string {
+			s := iss.sign(t, "ec", valid())
+			other := newTestIssuer(t).sign(t, "ec", valid())
+			return s[:strings.LastIndex(s, ".")] + other[strings.LastIndex(other, "."):]
+		}(), errcode.BadSignature},
+		{"expired", iss.sign(t, "ec", with("exp", now.Add(-2*time.Minute).Unix())), errcode.Expired},
+		{"expired within leeway", iss.sign(t, "ec", with("exp", now.Add(-30*time.Second).Unix())), ""},
+		{"no exp", iss.sign(t, "ec", with("exp", nil)), errcode.InvalidClaims},
+		{"not yet valid", iss.sign(t, "ec", with("nbf", now.Add(5*time.Minute).Unix())), errcode.InvalidClaims},
+		{"wrong issuer", iss.sign(t, "ec", with("iss", "https://evil.example")), errcode.InvalidClaims},
+		{"wrong audience", iss.sign(t, "ec", with("aud", "other")), errcode.InvalidClaims},
+		{"unknown kid", iss.sign(t, "nope", valid()), errcode.KeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.Verify(context.Background(), tt.token)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errcode.Is(err, tt.code) {
+				t.Fatalf("error = %v, want code %s", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestVerifyRefresh(t *testing.T) {
+	iss := newTestIssuer(t)
+	now := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(now)
+	v, err := New(Config{
+		JWKSURL:            iss.server.URL,
+		RefreshInterval:    time.Hour,
+		MinRefreshInterval: time.Minute,
+		Timeout:            time.Second,
+		Clock:              clk,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{"exp": now.Add(24 * time.Hour).Unix()}
+	token := iss.sign(t, "ec", claims)
+
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+	if n := iss.fetches.Load(); n != 1 {
+		t.Fatalf("fetches = %d, want 1 (cached)", n)
+	}
+
+	// A rotated key is picked up once MinRefreshInterval has passed.
+	set := *iss.set.Load()
+	set.Keys = append([]JWK(nil), set.Keys...)
+	set.Keys[0].KeyID = "ec-2"
+	iss.set.Store(&set)
+	rotated := iss.sign(t, "ec-2", claims)
+	if _, err := v.Verify(context.Background(), rotated); !errcode.Is(err, errcode.KeyNotFound) {
+		t.Fatalf("error = %v, want KeyNotFound before MinRefreshInterval", err)
+	}
+	clk.Advance(time.Minute)
+	if _, err := v.Verify(context.Background(), rotated); err != nil {
+		t.Fatal(err)
+	}
+	if n := iss.fetches.Load(); n != 2 {
+		t.Fatalf("fetches = %d, want 2", n)
+	}
+
+	clk.Advance(time.Hour)
+	if _, err := v.Verify(context.Background(), rotated); err != nil {
+		t.Fatal(err)
+	}
+	if n := iss.fetches.Load(); n != 3 {
+		t.Fatalf("fetches = %d, want 3 after RefreshInterval", n)
+	}
+}
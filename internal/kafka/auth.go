@@ -0,0 +1,92 @@
+package kafka
+
+import (
+	"crypto/tls"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/tlsutil"
+	"github.com/samber/oops"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// TLSConfig holds the TLS settings of broker connections.
+type TLSConfig struct {
+	Enabled bool
+	// CAFile verifies the brokers; empty uses the system roots.
+	CAFile string
+	// CertFile and KeyFile are a client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name verified in broker certificates.
+	ServerName string
+	// InsecureSkipVerify disables broker verification. Testing only.
+	InsecureSkipVerify bool
+}
+
+// load builds the client tls.Config.
+func (c TLSConfig) load() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pool, err := tlsutil.LoadCA(c.CAFile)
+		if err != nil {
+			return nil, oops.In("kafka").Wrap(err)
+		}
+		config.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, oops.
+				In("kafka").
+				Code(errcode.LoadKeypairFailed).
+				With("cert_file", c.CertFile).
+				With("key_file", c.KeyFile).
+				Wrapf(err, "failed to load client key pair")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// SASLMechanism is how the producer authenticates to the brokers.
+type SASLMechanism string
+
+const (
+	SASLNone        SASLMechanism = "none"
+	SASLPlain       SASLMechanism = "plain"
+	SASLScramSHA256 SASLMechanism = "scram-sha-256"
+	SASLScramSHA512 SASLMechanism = "scram-sha-512"
+)
+
+// SASLConfig holds the SASL credentials of the producer. PLAIN sends the
+// password as is, so use it over TLS.
+type SASLConfig struct {
+	// Mechanism is empty or SASLNone to disable SASL.
+	Mechanism SASLMechanism
+	Username  string
+	Password  string
+}
+
+// mechanism returns the franz-go mechanism of c.
+func (c SASLConfig) mechanism() (sasl.Mechanism, error) {
+	switch c.Mechanism {
+	case SASLPlain:
+		return plain.Auth{User: c.Username, Pass: c.Password}.AsMechanism(), nil
+	case SASLScramSHA256:
+		return scram.Auth{User: c.Username, Pass: c.Password}.AsSha256Mechanism(), nil
+	case SASLScramSHA512:
+		return scram.Auth{User: c.Username, Pass: c.Password}.AsSha512Mechanism(), nil
+	default:
+		return nil, oops.
+			In("kafka").
+			Code(errcode.InvalidConfig).
+			With("mechanism", c.Mechanism).
+			Errorf("unknown Kafka SASL mechanism %q, want plain, scram-sha-256 or scram-sha-512", c.Mechanism)
+	}
+}
@@ -0,0 +1,392 @@
+// Package kafka produces log lines to a Kafka topic in batches, buffering
+// them in a bounded queue that drops lines while the brokers are
+// unreachable rather than blocking the writer. Batches are produced with
+// franz-go, over plaintext or TLS connections, optionally authenticated with
+// SASL.
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/logsink"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+var (
+	entriesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kafka_entries_sent_total",
+		Help: "Log lines produced to Kafka.",
+	})
+	entriesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_entries_dropped_total",
+		Help: "Log lines not delivered to Kafka, by reason (queue_full, memory_budget, rejected or retries_exhausted).",
+	}, []string{"reason"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(entriesSent, entriesDropped)
+}
+
+// Acks is the acknowledgement a produce request waits for.
+type Acks int16
+
+const (
+	// AcksNone does not wait: the broker sends no response.
+	AcksNone Acks = 0
+	// AcksLeader waits for the partition leader to write the batch.
+	AcksLeader Acks = 1
+	// AcksAll waits for all in-sync replicas.
+	AcksAll Acks = -1
+)
+
+// ParseAcks parses "0", "1" or "all".
+func ParseAcks(s string) (Acks, error) {
+	switch s {
+	case "0":
+		return AcksNone, nil
+	case "1":
+		return AcksLeader, nil
+	case "all", "-1":
+		return AcksAll, nil
+	default:
+		return 0, oops.
+			In("kafka").
+			Code(errcode.InvalidConfig).
+			With("acks", s).
+			Errorf("invalid Kafka acks %q, want 0, 1 or all", s)
+	}
+}
+
+// kgoAcks returns the franz-go acks of a.
+func (a Acks) kgoAcks() kgo.Acks {
+	switch a {
+	case AcksNone:
+		return kgo.NoAck()
+	case AcksLeader:
+		return kgo.LeaderAck()
+	default:
+		return kgo.AllISRAcks()
+	}
+}
+
+// Config holds Kafka producer settings.
+type Config struct {
+	// Brokers are host:port bootstrap addresses; the partition leaders are
+	// discovered from them.
+	Brokers []string
+	Topic   string
+	// ClientID identifies the producer in broker logs and quotas.
+	ClientID string
+	Acks     Acks
+	// Compression, none, gzip or zstd, encodes record batches.
+	Compression logsink.Compression
+	// TLS secures the broker connections.
+	TLS TLSConfig
+	// SASL authenticates to the brokers.
+	SASL SASLConfig
+	// BatchEntries and BatchInterval bound how many lines a record batch
+	// carries and how long a line waits for one.
+	BatchEntries  int
+	BatchInterval time.Duration
+	// QueueSize bounds the lines waiting to be produced; further lines are
+	// dropped.
+	QueueSize int
+	// MaxRetries bounds the produce attempts of a line after the first one;
+	// RetryBackoff is the initial delay between them, doubled each time up
+	// to MaxBackoff.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	// Timeout bounds connecting to a broker and each produce request, and
+	// how long Close waits for a batch still being produced.
+	Timeout time.Duration
+	// Memory, if set, accounts queued lines until they are produced or
+	// dropped; lines it refuses are dropped.
+	Memory logsink.Reserver
+}
+
+// line is a queued log line with its timestamp.
+type line struct {
+	at   time.Time
+	text string
+}
+
+// Sink is an io.WriteCloser producing each Write, one log line, to Kafka.
+// The client spreads batches across the topic's partitions.
+type Sink struct {
+	cfg    Config
+	log    zerolog.Logger
+	client *kgo.Client
+
+	// ctx is canceled when Close gives up on the batch being produced.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	queue chan line
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// New creates a Sink and starts producing in the background until Close.
+func New(cfg Config, log zerolog.Logger) (*Sink, error) {
+	if len(cfg.Brokers) == 0 || cfg.Topic == "" {
+		return nil, oops.
+			In("kafka").
+			Code(errcode.InvalidConfig).
+			Errorf("Kafka needs at least one broker and a topic")
+	}
+	for _, broker := range cfg.Brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			return nil, oops.
+				In("kafka").
+				Code(errcode.InvalidEndpoint).
+				With("broker", broker).
+				Wrapf(err, "invalid Kafka broker address %q", broker)
+		}
+	}
+	codec, ok := codecs[cfg.Compression]
+	if !ok {
+		return nil, oops.
+			In("kafka").
+			Code(errcode.InvalidCompression).
+			With("compression", cfg.Compression).
+			Errorf("Kafka record batches can only be gzip or zstd compressed, not %q", cfg.Compression)
+	}
+	cfg.BatchEntries = max(cfg.BatchEntries, 1)
+	if cfg.BatchInterval <= 0 {
+		cfg.BatchInterval = time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	cfg.MaxBackoff = max(cfg.MaxBackoff, cfg.RetryBackoff)
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.DefaultProduceTopic(cfg.Topic),
+		kgo.RequiredAcks(cfg.Acks.kgoAcks()),
+		// Idempotence needs acks from all replicas; log lines may be
+		// duplicated by retries anyway.
+		kgo.DisableIdempotentWrite(),
+		kgo.ProducerBatchCompression(codec),
+		// The sink batches lines itself.
+		kgo.ProducerLinger(0),
+		kgo.MaxBufferedRecords(max(cfg.BatchEntries, 10000)),
+		kgo.RecordRetries(cfg.MaxRetries + 1),
+		kgo.RetryBackoffFn(func(tries int) time.Duration {
+			backoff := cfg.RetryBackoff
+			for range min(tries-1, 32) {
+				backoff = min(backoff*2, cfg.MaxBackoff)
+			}
+			return backoff
+		}),
+		// Moved partition leaders are looked up again after RetryBackoff
+		// rather than franz-go's default of 5s.
+		kgo.MetadataMinAge(max(cfg.RetryBackoff, 10*time.Millisecond)),
+		kgo.DialTimeout(cfg.Timeout),
+		kgo.ProduceRequestTimeout(cfg.Timeout),
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+	}
+	if cfg.TLS.Enabled {
+		tlsConfig, err := cfg.TLS.load()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+	if cfg.SASL.Mechanism != SASLNone && cfg.SASL.Mechanism != "" {
+		mechanism, err := cfg.SASL.mechanism()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, oops.
+			In("kafka").
+			Code(errcode.InvalidConfig).
+			Wrapf(err, "failed to create Kafka client")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Sink{
+		cfg:    cfg,
+		log:    log.With().Str("component", "kafka").Str("topic", cfg.Topic).Logger(),
+		client: client,
+		ctx:    ctx,
+		cancel: cancel,
+		queue:  make(chan line, max(cfg.QueueSize, cfg.BatchEntries)),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// codecs are the franz-go codecs of the supported compressions.
+var codecs = map[logsink.Compression]kgo.CompressionCodec{
+	"":                      kgo.NoCompression(),
+	logsink.CompressionNone: kgo.NoCompression(),
+	logsink.CompressionGzip: kgo.GzipCompression(),
+	logsink.CompressionZstd: kgo.ZstdCompression(),
+}
+
+// Write queues p, a log line. It never blocks: with a full queue or memory
+// budget the line is dropped and counted.
+func (s *Sink) Write(p []byte) (int, error) {
+	text := string(bytes.TrimRight(p, "\n"))
+	if s.cfg.Memory != nil && !s.cfg.Memory.Reserve(int64(len(text))) {
+		entriesDropped.WithLabelValues("memory_budget").Inc()
+		return len(p), nil
+	}
+	select {
+	case s.queue <- line{at: time.Now(), text: text}:
+	default:
+		s.release([]line{{text: text}})
+		entriesDropped.WithLabelValues("queue_full").Inc()
+	}
+	return len(p), nil
+}
+
+// release returns the memory of lines that left the queue.
+func (s *Sink) release(lines []line) {
+	if s.cfg.Memory == nil {
+		return
+	}
+	var n int64
+	for _, l := range lines {
+		n += int64(len(l.text))
+	}
+	s.cfg.Memory.Release(n)
+}
+
+// Depth returns the number of lines waiting in the queue.
+func (s *Sink) Depth() int {
+	return len(s.queue)
+}
+
+// Close produces the queued lines, giving each batch up to Timeout, and
+// closes the client.
+func (s *Sink) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		// A batch being retried gets Timeout to go through.
+		select {
+		case <-s.done:
+		case <-time.After(s.cfg.Timeout):
+			s.cancel()
+			<-s.done
+		}
+		s.cancel()
+		s.client.Close()
+	})
+	<-s.done
+	return nil
+}
+
+// run collects batches and produces them.
+func (s *Sink) run() {
+	defer close(s.done)
+	batch := make([]line, 0, s.cfg.BatchEntries)
+	ticker := time.NewTicker(s.cfg.BatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case l := <-s.queue:
+			batch = append(batch, l)
+			if len(batch) < s.cfg.BatchEntries {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-s.stop:
+			s.drain(batch)
+			return
+		}
+		s.push(s.ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+// drain produces batch and the queued lines, giving each batch Timeout.
+func (s *Sink) drain(batch []line) {
+	push := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+		defer cancel()
+		s.push(ctx, batch)
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case l := <-s.queue:
+			if batch = append(batch, l); len(batch) == s.cfg.BatchEntries {
+				push()
+			}
+		default:
+			if len(batch) > 0 {
+				push()
+			}
+			return
+		}
+	}
+}
+
+// push produces batch; the client retries failed attempts until
+// MaxRetries or ctx is done. Undelivered lines are dropped and counted.
+func (s *Sink) push(ctx context.Context, batch []line) {
+	defer s.release(batch)
+	records := make([]*kgo.Record, len(batch))
+	for i, l := range batch {
+		records[i] = &kgo.Record{Value: []byte(l.text), Timestamp: l.at}
+	}
+	var (
+		sent  int
+		first error
+	)
+	for _, result := range s.client.ProduceSync(ctx, records...) {
+		if result.Err == nil {
+			sent++
+			continue
+		}
+		entriesDropped.WithLabelValues(dropReason(result.Err)).Inc()
+		if first == nil {
+			first = result.Err
+		}
+	}
+	entriesSent.Add(float64(sent))
+	if first != nil {
+		s.log.Error().Err(first).Int("entries", len(batch)-sent).Msg("failed to produce log lines to Kafka, dropping them")
+	}
+}
+
+// dropReason returns the entriesDropped reason of a record that failed
+// with err: rejected if Kafka refused it for good, retries_exhausted
+// otherwise.
+func dropReason(err error) string {
+	var kafkaErr *kerr.Error
+	if errors.As(err, &kafkaErr) && !kafkaErr.Retriable {
+		return "rejected"
+	}
+	return "retries_exhausted"
+}
+
+// Ensure Sink implements io.WriteCloser.
+var _ io.WriteCloser = (*Sink)(nil)
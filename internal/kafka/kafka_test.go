@@ -0,0 +1,413 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/logsink"
+	"github.com/rs/zerolog"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// broker is a single-node fake Kafka cluster leading partitions 0 and 1 of
+// one topic. The first produce request is answered with
+// NOT_LEADER_OR_FOLLOWER. With a username set, connections must
+// authenticate with SASL PLAIN first.
+type broker struct {
+	t     *testing.T
+	ln    net.Listener
+	topic string
+
+	username, password string
+
+	mu       sync.Mutex
+	produces int
+	metadata int
+	logins   int
+	values   []string
+}
+
+// versions are the API versions the broker advertises; all but
+// ApiVersions and SASLAuthenticate v2 use non-flexible headers.
+var versions = map[int16]int16{
+	0:  7, // Produce
+	3:  7, // Metadata
+	17: 1, // SASLHandshake
+	18: 3, // ApiVersions
+	36: 1, // SASLAuthenticate
+}
+
+func newBroker(t *testing.T, topic, username, password string) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{t: t, ln: ln, topic: topic, username: username, password: password}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return b
+}
+
+func (b *broker) serve(c net.Conn) {
+	defer c.Close()
+	authenticated := b.username == ""
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		key := int16(binary.BigEndian.Uint16(buf))
+		version := int16(binary.BigEndian.Uint16(buf[2:]))
+		id := binary.BigEndian.Uint32(buf[4:])
+		clientID := int16(binary.BigEndian.Uint16(buf[8:]))
+		body := buf[10+max(clientID, 0):]
+
+		req := kmsg.RequestForKey(key)
+		if req == nil || version > versions[key] {
+			b.t.Errorf("unexpected API key %d version %d", key, version)
+			return
+		}
+		req.SetVersion(version)
+		if req.IsFlexible() {
+			body = body[1:] // no tagged header fields
+		}
+		if err := req.ReadFrom(body); err != nil {
+			b.t.Errorf("API key %d: %v", key, err)
+			return
+		}
+		if !authenticated && key != 17 && key != 18 && key != 36 {
+			b.t.Errorf("API key %d before authenticating", key)
+			return
+		}
+
+		var resp kmsg.Response
+		switch req := req.(type) {
+		case *kmsg.ApiVersionsRequest:
+			resp = b.answerApiVersions()
+		case *kmsg.SASLHandshakeRequest:
+			resp = b.answerHandshake(req)
+		case *kmsg.SASLAuthenticateRequest:
+			var ok bool
+			resp, ok = b.answerAuthenticate(req)
+			authenticated = authenticated || ok
+		case *kmsg.MetadataRequest:
+			resp = b.answerMetadata()
+		case *kmsg.ProduceRequest:
+			resp = b.answerProduce(req)
+		}
+		resp.SetVersion(version)
+
+		out := binary.BigEndian.AppendUint32(make([]byte, 4), id)
+		// ApiVersions responses keep the v0 header for older clients.
+		if resp.IsFlexible() && key != 18 {
+			out = append(out, 0)
+		}
+		out = resp.AppendTo(out)
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := c.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (b *broker) answerApiVersions() kmsg.Response {
+	resp := kmsg.NewPtrApiVersionsResponse()
+	for key, version := range versions {
+		resp.ApiKeys = append(resp.ApiKeys, kmsg.ApiVersionsResponseApiKey{ApiKey: key, MaxVersion: version})
+	}
+	return resp
+}
+
+func (b *broker) answerHandshake(req *kmsg.SASLHandshakeRequest) kmsg.Response {
+	resp := kmsg.NewPtrSASLHandshakeResponse()
+	resp.SupportedMechanisms = []string{"PLAIN"}
+	if req.Mechanism != "PLAIN" {
+		resp.ErrorCode = 33 // UNSUPPORTED_SASL_MECHANISM
+	}
+	return resp
+}
+
+func (b *broker) answerAuthenticate(req *kmsg.SASLAuthenticateRequest) (kmsg.Response, bool) {
+	resp := kmsg.NewPtrSASLAuthenticateResponse()
+	if string(req.SASLAuthBytes) != "\x00"+b.username+"\x00"+b.password {
+		resp.ErrorCode = 58 // SASL_AUTHENTICATION_FAILED
+		return resp, false
+	}
+	b.mu.Lock()
+	b.logins++
+	b.mu.Unlock()
+	return resp, true
+}
+
+func (b *broker) answerMetadata() kmsg.Response {
+	b.mu.Lock()
+	b.metadata++
+	b.mu.Unlock()
+	host, port, _ := net.SplitHostPort(b.ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	resp := kmsg.NewPtrMetadataResponse()
+	resp.ControllerID = 1
+	resp.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 1, Host: host, Port: int32(p)}}
+	topic := kmsg.NewMetadataResponseTopic()
+	topic.Topic = &b.topic
+	for partition := range int32(2) {
+		topic.Partitions = append(topic.Partitions, kmsg.MetadataResponseTopicPartition{
+			Partition: partition,
+			Leader:    1,
+			Replicas:  []int32{1},
+			ISR:       []int32{1},
+		})
+	}
+	resp.Topics = []kmsg.MetadataResponseTopic{topic}
+	return resp
+}
+
+func (b *broker) answerProduce(req *kmsg.ProduceRequest) kmsg.Response {
+	if req.Acks != int16(AcksAll) {
+		b.t.Errorf("acks = %d", req.Acks)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.produces++
+
+	resp := kmsg.NewPtrProduceResponse()
+	for _, topic := range req.Topics {
+		if topic.Topic != b.topic {
+			b.t.Errorf("produce to %q", topic.Topic)
+		}
+		rt := kmsg.ProduceResponseTopic{Topic: topic.Topic}
+		for _, partition := range topic.Partitions {
+			rp := kmsg.ProduceResponseTopicPartition{Partition: partition.Partition, LogAppendTime: -1}
+			if b.produces == 1 {
+				rp.ErrorCode = 6 // NOT_LEADER_OR_FOLLOWER
+			} else {
+				b.values = append(b.values, b.decodeBatch(partition.Records)...)
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		resp.Topics = append(resp.Topics, rt)
+	}
+	return resp
+}
+
+func (b *broker) decodeBatch(records []byte) []string {
+	var batch kmsg.RecordBatch
+	if err := batch.ReadFrom(records); err != nil {
+		b.t.Error(err)
+		return nil
+	}
+	if batch.Magic != 2 {
+		b.t.Errorf("magic = %d", batch.Magic)
+	}
+	raw := batch.Records
+	// Batches that gzip would not shrink are sent uncompressed.
+	switch codec := batch.Attributes & 7; codec {
+	case 0:
+	case 1:
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			b.t.Error(err)
+			return nil
+		}
+		if raw, err = io.ReadAll(zr); err != nil {
+			b.t.Error(err)
+			return nil
+		}
+	default:
+		b.t.Errorf("codec = %d, want gzip", codec)
+		return nil
+	}
+	var values []string
+	for range batch.NumRecords {
+		n, k := binary.Varint(raw)
+		var record kmsg.Record
+		if err := record.ReadFrom(raw[:k+int(n)]); err != nil {
+			b.t.Error(err)
+			return values
+		}
+		values = append(values, string(record.Value))
+		raw = raw[k+int(n):]
+	}
+	return values
+}
+
+// produced waits until the broker stored n lines.
+func (b *broker) produced(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		got := len(b.values)
+		b.mu.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d lines produced", got, n)
+		}
+	}
+}
+
+func testConfig(b *broker) Config {
+	return Config{
+		Brokers:       []string{b.ln.Addr().String()},
+		Topic:         b.topic,
+		ClientID:      "test",
+		Acks:          AcksAll,
+		Compression:   logsink.CompressionGzip,
+		BatchEntries:  2,
+		BatchInterval: time.Hour,
+		QueueSize:     10,
+		MaxRetries:    3,
+		RetryBackoff:  time.Millisecond,
+		Timeout:       time.Second,
+	}
+}
+
+func write(t *testing.T, sink *Sink, lines ...string) {
+	t.Helper()
+	for _, l := range lines {
+		if _, err := sink.Write([]byte(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSinkProducesBatches(t *testing.T) {
+	b := newBroker(t, "access-logs", "", "")
+	sink, err := New(testConfig(b), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The full batch is produced, and retried, in the background.
+	write(t, sink, "first\n", "second\n")
+	b.produced(t, 2)
+	// The partial batch is flushed on Close.
+	write(t, sink, "third\n")
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Lines of a batch may be spread across partitions.
+	slices.Sort(b.values[:2])
+	if want := []string{"first", "second", "third"}; !slices.Equal(b.values, want) {
+		t.Errorf("produced %q, want %q", b.values, want)
+	}
+	if b.metadata < 2 {
+		t.Errorf("%d metadata requests, want a refresh after NOT_LEADER_OR_FOLLOWER", b.metadata)
+	}
+}
+
+func TestSinkSASLPlain(t *testing.T) {
+	b := newBroker(t, "access-logs", "envoy", "secret")
+	cfg := testConfig(b)
+	cfg.SASL = SASLConfig{Mechanism: SASLPlain, Username: "envoy", Password: "secret"}
+	sink, err := New(cfg, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, sink, "first\n", "second\n")
+	b.produced(t, 2)
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.logins == 0 {
+		t.Error("producer never authenticated")
+	}
+}
+
+// budget is a logsink.Reserver of limit bytes.
+type budget struct {
+	mu          sync.Mutex
+	limit, held int64
+}
+
+func (b *budget) Reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.held+n > b.limit {
+		return false
+	}
+	b.held += n
+	return true
+}
+
+func (b *budget) Release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.held -= n
+}
+
+func (b *budget) Held() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.held
+}
+
+func TestSinkMemory(t *testing.T) {
+	b := newBroker(t, "access-logs", "", "")
+	mem := &budget{limit: 10}
+	cfg := testConfig(b)
+	cfg.BatchEntries = 10
+	cfg.Memory = mem
+	sink, err := New(cfg, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, sink, "0123456789\n", "refused\n")
+	if held := mem.Held(); held != 10 {
+		t.Errorf("queue holds %d bytes, want 10", held)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if want := []string{"0123456789"}; !slices.Equal(b.values, want) {
+		t.Errorf("produced %q, want only the line within the budget", b.values)
+	}
+	if held := mem.Held(); held != 0 {
+		t.Errorf("%d bytes still held after the push", held)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{Topic: "logs"},
+		{Brokers: []string{"kafka"}, Topic: "logs"},
+		{Brokers: []string{"kafka:9092"}},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", Compression: "brotli"},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", SASL: SASLConfig{Mechanism: "gssapi"}},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", TLS: TLSConfig{Enabled: true, CAFile: "/nonexistent/ca.pem"}},
+	} {
+		if _, err := New(cfg, zerolog.Nop()); err == nil {
+			t.Errorf("New(%+v) succeeded", cfg)
+		}
+	}
+}
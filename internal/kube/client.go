@@ -0,0 +1,169 @@
+// Package kube is a minimal Kubernetes API client for processors running in
+// a pod: it authenticates with the mounted service account and speaks plain
+// JSON over HTTPS, without the client-go dependency tree.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/tlsutil"
+	"github.com/samber/oops"
+)
+
+// serviceAccountDir holds the in-cluster credentials mounted into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+var (
+	// ErrNotFound is returned for 404 responses.
+	ErrNotFound = errors.New("kube: not found")
+	// ErrConflict is returned for 409 responses, e.g. a stale resourceVersion.
+	ErrConflict = errors.New("kube: conflict")
+)
+
+// Client calls the API server of the cluster the process runs in.
+type Client struct {
+	baseURL   string
+	tokenFile string
+	timeout   time.Duration
+	client    *http.Client
+}
+
+// NewInCluster creates a Client from the pod's service account. timeout
+// bounds each request except watches.
+func NewInCluster(timeout time.Duration) (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, oops.
+			In("kube").
+			Code(errcode.NotInCluster).
+			Errorf("not running in a Kubernetes pod (KUBERNETES_SERVICE_HOST is unset)")
+	}
+	roots, err := tlsutil.LoadCA(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, oops.In("kube").Wrap(err)
+	}
+	return &Client{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountDir + "/token",
+		timeout:   timeout,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: roots},
+			},
+		},
+	}, nil
+}
+
+// Namespace returns the namespace of the running pod, or "" outside one.
+func Namespace() string {
+	ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(ns))
+}
+
+// Do sends in (if not nil) as JSON to path and decodes the response into out
+// (if not nil).
+func (c *Client) Do(ctx context.Context, method, path string, in, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	resp, err := c.send(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return oops.In("kube").Code(errcode.InvalidResponse).Wrap(err)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return oops.
+			In("kube").
+			Code(errcode.InvalidResponse).
+			With("path", path).
+			Wrapf(err, "failed to decode kubernetes api response")
+	}
+	return nil
+}
+
+// stream sends a GET whose response body is read until ctx is done or the
+// server closes it. The caller closes the body.
+func (c *Client) stream(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// send performs the request and maps error statuses. On success the caller
+// closes the body.
+func (c *Client) send(ctx context.Context, method, path string, in any) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, oops.In("kube").Code(errcode.EncodeFailed).Wrap(err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, oops.In("kube").Code(errcode.RequestBuildFailed).Wrap(err)
+	}
+	// Projected service account tokens are rotated, so read it every time.
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, oops.In("kube").Code(errcode.TokenReadFailed).Wrapf(err, "failed to read service account token")
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, oops.
+			In("kube").
+			Code(errcode.APIRequestFailed).
+			With("method", method).
+			With("path", path).
+			Wrapf(err, "kubernetes api request failed")
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	case http.StatusConflict:
+		return nil, ErrConflict
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return nil, oops.
+		In("kube").
+		Code(errcode.KubernetesAPIError).
+		With("method", method).
+		With("path", path).
+		With("status", resp.StatusCode).
+		With("body", string(data)).
+		Errorf("kubernetes api returned %s", resp.Status)
+}
@@ -0,0 +1,127 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// itemKey is the identity of a listed object.
+type itemKey struct {
+	Metadata struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"metadata"`
+}
+
+func (k itemKey) String() string {
+	return k.Metadata.Namespace + "/" + k.Metadata.Name
+}
+
+type list struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []json.RawMessage `json:"items"`
+}
+
+// WatchList lists the collection at path (e.g.
+// "/apis/example.com/v1/namespaces/default/widgets") and keeps the set of
+// objects up to date from a watch, calling onChange with every object after
+// the initial list and after each change, until ctx is done. onChange runs
+// on the caller's goroutine and must not retain items across calls.
+func (c *Client) WatchList(ctx context.Context, path string, log zerolog.Logger, onChange func(items []json.RawMessage)) {
+	log = log.With().Str("component", "kube_watch").Str("path", path).Logger()
+	backoff := time.Second
+	for ctx.Err() == nil {
+		objects := make(map[string]json.RawMessage)
+		var l list
+		err := c.Do(ctx, http.MethodGet, path, nil, &l)
+		if err == nil {
+			for _, item := range l.Items {
+				var key itemKey
+				if json.Unmarshal(item, &key) == nil {
+					objects[key.String()] = item
+				}
+			}
+			onChange(values(objects))
+			err = c.watchList(ctx, path, l.Metadata.ResourceVersion, objects, onChange)
+		}
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn().Err(err).Dur("backoff", backoff).Msg("watch failed, retrying")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (c *Client) watchList(
+	ctx context.Context,
+	path, version string,
+	objects map[string]json.RawMessage,
+	onChange func([]json.RawMessage),
+) error {
+	query := url.Values{
+		"watch":           {"true"},
+		"resourceVersion": {version},
+		"timeoutSeconds":  {"300"},
+	}
+	body, err := c.stream(ctx, path+"?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	for {
+		var ev watchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// The server closes watches after timeoutSeconds; re-list.
+			return nil
+		}
+		var key itemKey
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			if err := json.Unmarshal(ev.Object, &key); err != nil {
+				return oops.In("kube").Code(errcode.InvalidResponse).Wrapf(err, "failed to decode watch event")
+			}
+			objects[key.String()] = ev.Object
+		case "DELETED":
+			if err := json.Unmarshal(ev.Object, &key); err != nil {
+				return oops.In("kube").Code(errcode.InvalidResponse).Wrapf(err, "failed to decode watch event")
+			}
+			delete(objects, key.String())
+		case "ERROR":
+			// Typically 410 Gone for an expired resourceVersion; re-list.
+			return oops.In("kube").Code(errcode.WatchError).With("status", string(ev.Object)).Errorf("watch returned an error event")
+		default:
+			continue
+		}
+		onChange(values(objects))
+	}
+}
+
+func values(objects map[string]json.RawMessage) []json.RawMessage {
+	items := make([]json.RawMessage, 0, len(objects))
+	for _, item := range objects {
+		items = append(items, item)
+	}
+	return items
+}
@@ -0,0 +1,266 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// Kind is a resource kind that can hold a file.
+type Kind string
+
+const (
+	KindConfigMap Kind = "configmap"
+	KindSecret    Kind = "secret"
+)
+
+// Ref points at one key of a ConfigMap or Secret, written as
+// "configmap://[namespace/]name/key" or "secret://[namespace/]name/key".
+type Ref struct {
+	Kind      Kind
+	Namespace string
+	Name      string
+	Key       string
+}
+
+// ParseRef parses s as a ConfigMap or Secret reference. ok is false for
+// anything else, e.g. a file path. A missing namespace is the pod's.
+func ParseRef(s string) (ref Ref, ok bool, err error) {
+	kind, rest, found := strings.Cut(s, "://")
+	if !found || (Kind(kind) != KindConfigMap && Kind(kind) != KindSecret) {
+		return Ref{}, false, nil
+	}
+	ref.Kind = Kind(kind)
+	parts := strings.Split(rest, "/")
+	switch len(parts) {
+	case 2:
+		ref.Namespace, ref.Name, ref.Key = Namespace(), parts[0], parts[1]
+	case 3:
+		ref.Namespace, ref.Name, ref.Key = parts[0], parts[1], parts[2]
+	}
+	if ref.Namespace == "" || ref.Name == "" || ref.Key == "" {
+		return Ref{}, true, oops.
+			In("kube").
+			Code(errcode.InvalidRef).
+			With("ref", s).
+			Errorf("invalid %s reference %q, want %s://[namespace/]name/key", kind, s, kind)
+	}
+	return ref, true, nil
+}
+
+func (r Ref) String() string {
+	return string(r.Kind) + "://" + r.Namespace + "/" + r.Name + "/" + r.Key
+}
+
+func (r Ref) collection() string {
+	return "/api/v1/namespaces/" + url.PathEscape(r.Namespace) + "/" + string(r.Kind) + "s"
+}
+
+// object is the subset of a ConfigMap or Secret holding its data. Secret
+// data and ConfigMap binaryData are base64, which []byte decodes.
+type object struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data       map[string]json.RawMessage `json:"data"`
+	BinaryData map[string][]byte          `json:"binaryData"`
+	// Kind-specific decoding happens in value.
+	kind Kind
+}
+
+// value returns the contents of key.
+func (o *object) value(key string) ([]byte, bool) {
+	if raw, ok := o.Data[key]; ok {
+		if o.kind == KindSecret {
+			var b []byte
+			if json.Unmarshal(raw, &b) == nil {
+				return b, true
+			}
+			return nil, false
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return []byte(s), true
+		}
+		return nil, false
+	}
+	b, ok := o.BinaryData[key]
+	return b, ok
+}
+
+// Get returns the current contents of ref.
+func (c *Client) Get(ctx context.Context, ref Ref) ([]byte, error) {
+	data, _, err := c.get(ctx, ref)
+	return data, err
+}
+
+func (c *Client) get(ctx context.Context, ref Ref) ([]byte, string, error) {
+	obj := object{kind: ref.Kind}
+	err := c.Do(ctx, http.MethodGet, ref.collection()+"/"+url.PathEscape(ref.Name), nil, &obj)
+	if errors.Is(err, ErrNotFound) {
+		return nil, "", oops.In("kube").Code(errcode.NotFound).With("ref", ref.String()).Wrapf(err, "%s %s/%s not found", ref.Kind, ref.Namespace, ref.Name)
+	}
+	if err != nil {
+		return nil, "", oops.With("ref", ref.String()).Wrap(err)
+	}
+	data, ok := obj.value(ref.Key)
+	if !ok {
+		return nil, obj.Metadata.ResourceVersion, oops.
+			In("kube").
+			Code(errcode.KeyNotFound).
+			With("ref", ref.String()).
+			Errorf("%s %s/%s has no key %q", ref.Kind, ref.Namespace, ref.Name, ref.Key)
+	}
+	return data, obj.Metadata.ResourceVersion, nil
+}
+
+// watchEvent is one line of a watch stream.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Watch calls onChange with the contents of ref whenever they differ from
+// current, until ctx is done. A nil current takes the first read as the
+// baseline. Dropped watches are re-established, re-reading the object first
+// so no change is missed.
+func (c *Client) Watch(ctx context.Context, ref Ref, current []byte, log zerolog.Logger, onChange func([]byte)) {
+	log = log.With().Str("component", "kube_watch").Stringer("ref", ref).Logger()
+	backoff := time.Second
+	for ctx.Err() == nil {
+		data, version, err := c.get(ctx, ref)
+		if err == nil && current == nil {
+			current = data
+		}
+		if err == nil && !bytes.Equal(data, current) {
+			current = data
+			onChange(data)
+		}
+		if err == nil {
+			err = c.watch(ctx, ref, version, func(data []byte) {
+				if !bytes.Equal(data, current) {
+					current = data
+					onChange(data)
+				}
+			})
+		}
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn().Err(err).Dur("backoff", backoff).Msg("watch failed, retrying")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// watch follows one watch stream from version until the server ends it.
+func (c *Client) watch(ctx context.Context, ref Ref, version string, onData func([]byte)) error {
+	query := url.Values{
+		"watch":           {"true"},
+		"fieldSelector":   {"metadata.name=" + ref.Name},
+		"resourceVersion": {version},
+		"timeoutSeconds":  {"300"},
+	}
+	body, err := c.stream(ctx, ref.collection()+"?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	for {
+		var ev watchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// The server closes watches after timeoutSeconds; start over.
+			return nil
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			obj := object{kind: ref.Kind}
+			if err := json.Unmarshal(ev.Object, &obj); err != nil {
+				return oops.In("kube").Code(errcode.InvalidResponse).Wrapf(err, "failed to decode watch event")
+			}
+			if data, ok := obj.value(ref.Key); ok {
+				onData(data)
+			}
+		case "ERROR":
+			// Typically 410 Gone for an expired resourceVersion; re-list.
+			return oops.In("kube").Code(errcode.WatchError).With("status", string(ev.Object)).Errorf("watch returned an error event")
+		}
+	}
+}
+
+var (
+	clientOnce sync.Once
+	client     *Client
+	clientErr  error
+)
+
+// defaultClient is the shared in-cluster client used by ReadFile and
+// WatchFile.
+func defaultClient() (*Client, error) {
+	clientOnce.Do(func() {
+		client, clientErr = NewInCluster(10 * time.Second)
+	})
+	return client, clientErr
+}
+
+// ReadFile reads path, which is either a file or a ConfigMap/Secret
+// reference.
+func ReadFile(ctx context.Context, path string) ([]byte, error) {
+	ref, ok, err := ParseRef(path)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return os.ReadFile(path)
+	}
+	c, err := defaultClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.Get(ctx, ref)
+}
+
+// IsRef reports whether path is a ConfigMap/Secret reference.
+func IsRef(path string) bool {
+	_, ok, _ := ParseRef(path)
+	return ok
+}
+
+// WatchFile calls onChange whenever the ConfigMap/Secret reference path
+// changes after the first read, until ctx is done. It returns immediately for
+// file paths, which callers watch themselves.
+func WatchFile(ctx context.Context, path string, log zerolog.Logger, onChange func([]byte)) {
+	ref, ok, err := ParseRef(path)
+	if !ok || err != nil {
+		return
+	}
+	c, err := defaultClient()
+	if err != nil {
+		log.Error().Err(err).Str("ref", path).Msg("cannot watch kubernetes reference")
+		return
+	}
+	c.Watch(ctx, ref, nil, log, onChange)
+}
@@ -0,0 +1,75 @@
+package kvstore
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/gossip"
+)
+
+// Gossip is a Store whose replicas exchange their state over UDP instead of
+// sharing a server. Counters are approximate: each replica sees the others'
+// increments a few gossip intervals late. Values are last-write-wins.
+type Gossip struct {
+	cluster *gossip.Cluster
+}
+
+func newGossip(cfg Config) (*Gossip, error) {
+	gcfg := cfg.Gossip
+	if gcfg.MaxKeys == 0 {
+		gcfg.MaxKeys = cfg.MaxKeys
+	}
+	if gcfg.Clock == nil {
+		gcfg.Clock = cfg.Clock
+	}
+	cluster, err := gossip.New(gcfg, cfg.Log)
+	if err != nil {
+		return nil, err
+	}
+	return &Gossip{cluster: cluster}, nil
+}
+
+// Get implements Store. A counter reads as its cluster-wide total.
+func (g *Gossip) Get(_ context.Context, key string) ([]byte, error) {
+	if value, ok := g.cluster.Get(key); ok {
+		return value, nil
+	}
+	if total, ok := g.cluster.Count(key); ok {
+		return []byte(strconv.FormatInt(total, 10)), nil
+	}
+	return nil, ErrNotFound
+}
+
+// Set implements Store.
+func (g *Gossip) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	g.cluster.Set(key, value, ttl)
+	return nil
+}
+
+// Incr implements Store. The result includes the increments of other
+// replicas received so far.
+func (g *Gossip) Incr(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	return g.cluster.Incr(key, delta, ttl), nil
+}
+
+// Expire implements Store. For counters only this replica's share of the
+// total gets the new TTL.
+func (g *Gossip) Expire(_ context.Context, key string, ttl time.Duration) error {
+	g.cluster.Expire(key, ttl)
+	return nil
+}
+
+// Delete implements Store. Counters cannot be deleted; they expire.
+func (g *Gossip) Delete(_ context.Context, key string) error {
+	g.cluster.Delete(key)
+	return nil
+}
+
+// Close implements Store.
+func (g *Gossip) Close() error {
+	return g.cluster.Close()
+}
+
+// Ensure Gossip implements Store.
+var _ Store = (*Gossip)(nil)
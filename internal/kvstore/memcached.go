@@ -0,0 +1,127 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Memcached is a Store backed by memcached servers, sharded by key. TTLs are
+// rounded up to whole seconds.
+type Memcached struct {
+	client *memcache.Client
+}
+
+func newMemcached(cfg Config) (*Memcached, error) {
+	if len(cfg.Addrs) == 0 {
+		return nil, oops.
+			In("kvstore").
+			Code(errcode.InvalidConfig).
+			Errorf("memcached driver needs at least one address")
+	}
+	client := memcache.New(cfg.Addrs...)
+	if cfg.Timeout > 0 {
+		client.Timeout = cfg.Timeout
+	}
+	return &Memcached{client: client}, nil
+}
+
+// seconds converts a TTL to memcached expiration seconds.
+func seconds(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	return int32((ttl + time.Second - 1) / time.Second)
+}
+
+// Get implements Store.
+func (m *Memcached) Get(_ context.Context, key string) ([]byte, error) {
+	item, err := m.client.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, memcachedError(err, "get", key)
+	}
+	return item.Value, nil
+}
+
+// Set implements Store.
+func (m *Memcached) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	return memcachedError(m.client.Set(&memcache.Item{Key: key, Value: value, Expiration: seconds(ttl)}), "set", key)
+}
+
+// Incr implements Store. memcached counters are unsigned, so values never
+// drop below zero.
+func (m *Memcached) Incr(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	for range 2 {
+		n, err := m.step(key, delta)
+		if err == nil {
+			return int64(n), nil
+		}
+		if !errors.Is(err, memcache.ErrCacheMiss) {
+			return 0, memcachedError(err, "incr", key)
+		}
+		// Create the counter; if another client won the race, retry the
+		// increment.
+		err = m.client.Add(&memcache.Item{Key: key, Value: []byte(strconv.FormatInt(max(delta, 0), 10)), Expiration: seconds(ttl)})
+		if err == nil {
+			return max(delta, 0), nil
+		}
+		if !errors.Is(err, memcache.ErrNotStored) {
+			return 0, memcachedError(err, "incr", key)
+		}
+	}
+	return 0, memcachedError(memcache.ErrNotStored, "incr", key)
+}
+
+func (m *Memcached) step(key string, delta int64) (uint64, error) {
+	if delta < 0 {
+		return m.client.Decrement(key, uint64(-delta))
+	}
+	return m.client.Increment(key, uint64(delta))
+}
+
+// Expire implements Store.
+func (m *Memcached) Expire(_ context.Context, key string, ttl time.Duration) error {
+	err := m.client.Touch(key, seconds(ttl))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	return memcachedError(err, "expire", key)
+}
+
+// Delete implements Store.
+func (m *Memcached) Delete(_ context.Context, key string) error {
+	err := m.client.Delete(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	return memcachedError(err, "delete", key)
+}
+
+// Close implements Store.
+func (m *Memcached) Close() error {
+	return oops.In("kvstore").Code(errcode.StoreFailed).Wrap(m.client.Close())
+}
+
+func memcachedError(err error, op, key string) error {
+	if err == nil {
+		return nil
+	}
+	return oops.
+		In("kvstore").
+		Code(errcode.StoreFailed).
+		With("driver", DriverMemcached).
+		With("op", op).
+		With("key", key).
+		Wrapf(err, "memcached %s failed", op)
+}
+
+// Ensure Memcached implements Store.
+var _ Store = (*Memcached)(nil)
@@ -0,0 +1,201 @@
+package kvstore
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// sweepInterval is how often expired keys are removed from a Memory store.
+const sweepInterval = time.Minute
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// Memory is a process-local Store. When MaxKeys is reached, expired keys are
+// swept and, if still full, an arbitrary key is evicted.
+type Memory struct {
+	maxKeys int
+	clock   clock.Clock
+
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// MemoryOption configures a Memory store.
+type MemoryOption func(*Memory)
+
+// WithClock sets the clock TTLs are measured on.
+func WithClock(c clock.Clock) MemoryOption {
+	return func(m *Memory) {
+		m.clock = clock.Or(c)
+	}
+}
+
+// NewMemory creates a Memory store holding up to maxKeys keys (0 is
+// unbounded).
+func NewMemory(maxKeys int, opts ...MemoryOption) *Memory {
+	m := &Memory{
+		maxKeys: maxKeys,
+		clock:   clock.Real,
+		entries: make(map[string]*memoryEntry),
+		stop:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	go m.sweepLoop()
+	return m
+}
+
+func (m *Memory) sweepLoop() {
+	ticker := m.clock.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			m.mu.Lock()
+			m.sweep(m.clock.Now())
+			m.mu.Unlock()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// sweep removes expired keys. The caller holds m.mu.
+func (m *Memory) sweep(now time.Time) {
+	for key, e := range m.entries {
+		if e.expired(now) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// get returns the live entry of key. The caller holds m.mu.
+func (m *Memory) get(key string, now time.Time) *memoryEntry {
+	e, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if e.expired(now) {
+		delete(m.entries, key)
+		return nil
+	}
+	return e
+}
+
+// put stores a new entry, making room if needed. The caller holds m.mu.
+func (m *Memory) put(key string, e *memoryEntry, now time.Time) {
+	if _, ok := m.entries[key]; !ok && m.maxKeys > 0 && len(m.entries) >= m.maxKeys {
+		m.sweep(now)
+		for victim := range m.entries {
+			if len(m.entries) < m.maxKeys {
+				break
+			}
+			delete(m.entries, victim)
+		}
+	}
+	m.entries[key] = e
+}
+
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// Get implements Store.
+func (m *Memory) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.get(key, m.clock.Now())
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+// Set implements Store.
+func (m *Memory) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	now := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(key, &memoryEntry{value: append([]byte(nil), value...), expires: expiry(now, ttl)}, now)
+	return nil
+}
+
+// Incr implements Store.
+func (m *Memory) Incr(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	now := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.get(key, now)
+	if e == nil {
+		e = &memoryEntry{expires: expiry(now, ttl)}
+		m.put(key, e, now)
+	}
+	var n int64
+	if len(e.value) > 0 {
+		var err error
+		if n, err = strconv.ParseInt(string(e.value), 10, 64); err != nil {
+			return 0, oops.
+				In("kvstore").
+				Code(errcode.NotAnInteger).
+				With("key", key).
+				Wrapf(err, "value is not an integer")
+		}
+	}
+	n += delta
+	e.value = strconv.AppendInt(e.value[:0], n, 10)
+	return n, nil
+}
+
+// Expire implements Store.
+func (m *Memory) Expire(_ context.Context, key string, ttl time.Duration) error {
+	now := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.get(key, now); e != nil {
+		e.expires = expiry(now, ttl)
+	}
+	return nil
+}
+
+// Delete implements Store.
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// Len returns the number of keys held, including expired ones not yet swept.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// Close stops the background sweeper.
+func (m *Memory) Close() error {
+	m.once.Do(func() { close(m.stop) })
+	return nil
+}
+
+// Ensure Memory implements Store.
+var _ Store = (*Memory)(nil)
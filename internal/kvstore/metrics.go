@@ -0,0 +1,105 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	operationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kvstore_operations_total",
+		Help: "Key-value store operations, by driver, operation and result (ok, miss or error).",
+	}, []string{"driver", "op", "result"})
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kvstore_operation_duration_seconds",
+		Help:    "Key-value store operation latency, by driver and operation.",
+		Buckets: []float64{.00005, .0001, .0005, .001, .005, .01, .05, .1, .5},
+	}, []string{"driver", "op"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(operationsTotal, operationDuration)
+}
+
+// instrumented prefixes keys and records metrics around a driver.
+type instrumented struct {
+	driver  string
+	prefix  string
+	backend Store
+}
+
+func (s *instrumented) observe(op string, start time.Time, err error) {
+	operationDuration.WithLabelValues(s.driver, op).Observe(time.Since(start).Seconds())
+	result := "ok"
+	switch {
+	case errors.Is(err, ErrNotFound):
+		result = "miss"
+	case err != nil:
+		result = "error"
+	}
+	operationsTotal.WithLabelValues(s.driver, op, result).Inc()
+}
+
+func (s *instrumented) Get(ctx context.Context, key string) ([]byte, error) {
+	start := time.Now()
+	value, err := s.backend.Get(ctx, s.prefix+key)
+	s.observe("get", start, err)
+	return value, err
+}
+
+func (s *instrumented) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	start := time.Now()
+	err := s.backend.Set(ctx, s.prefix+key, value, ttl)
+	s.observe("set", start, err)
+	return err
+}
+
+func (s *instrumented) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	start := time.Now()
+	n, err := s.backend.Incr(ctx, s.prefix+key, delta, ttl)
+	s.observe("incr", start, err)
+	return n, err
+}
+
+func (s *instrumented) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	start := time.Now()
+	err := s.backend.Expire(ctx, s.prefix+key, ttl)
+	s.observe("expire", start, err)
+	return err
+}
+
+func (s *instrumented) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.backend.Delete(ctx, s.prefix+key)
+	s.observe("delete", start, err)
+	return err
+}
+
+func (s *instrumented) Eval(ctx context.Context, script *Script, keys []string, args ...any) (any, error) {
+	scripter, ok := s.backend.(Scripter)
+	if !ok {
+		return nil, ErrScriptsUnsupported
+	}
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.prefix + key
+	}
+	start := time.Now()
+	result, err := scripter.Eval(ctx, script, prefixed, args...)
+	s.observe("eval", start, err)
+	return result, err
+}
+
+func (s *instrumented) Close() error {
+	return s.backend.Close()
+}
+
+// Ensure instrumented implements Store and Scripter.
+var (
+	_ Store    = (*instrumented)(nil)
+	_ Scripter = (*instrumented)(nil)
+)
@@ -0,0 +1,163 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/redis/go-redis/v9"
+	"github.com/samber/oops"
+)
+
+// incrScript increments a key and sets its TTL only when the increment
+// created it, atomically.
+var incrScript = redis.NewScript(`
+local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if n == tonumber(ARGV[1]) and tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return n
+`)
+
+// Redis is a Store backed by a Redis server.
+type Redis struct {
+	client redis.UniversalClient
+}
+
+func newRedis(cfg Config) (*Redis, error) {
+	if len(cfg.Addrs) == 0 {
+		return nil, oops.
+			In("kvstore").
+			Code(errcode.InvalidConfig).
+			Errorf("redis driver needs at least one address")
+	}
+	rc := cfg.Redis
+	opts := &redis.UniversalOptions{
+		Addrs:            cfg.Addrs,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		DB:               cfg.DB,
+		SentinelUsername: rc.SentinelUsername,
+		SentinelPassword: rc.SentinelPassword,
+		DialTimeout:      cfg.Timeout,
+		ReadTimeout:      cfg.Timeout,
+		WriteTimeout:     cfg.Timeout,
+		PoolSize:         rc.PoolSize,
+		MinIdleConns:     rc.MinIdleConns,
+		MaxIdleConns:     rc.MaxIdleConns,
+		ConnMaxIdleTime:  rc.ConnMaxIdleTime,
+		ConnMaxLifetime:  rc.ConnMaxLifetime,
+		PoolTimeout:      rc.PoolTimeout,
+		MaxRetries:       rc.MaxRetries,
+	}
+	switch rc.Topology {
+	case RedisStandalone, "":
+		if len(cfg.Addrs) > 1 {
+			return nil, oops.
+				In("kvstore").
+				Code(errcode.InvalidConfig).
+				With("addrs", cfg.Addrs).
+				Errorf("standalone redis takes one address; use the sentinel or cluster topology for more")
+		}
+	case RedisSentinel:
+		if rc.MasterName == "" {
+			return nil, oops.
+				In("kvstore").
+				Code(errcode.InvalidConfig).
+				Errorf("redis sentinel needs a master name")
+		}
+		opts.MasterName = rc.MasterName
+		opts.ReadOnly = rc.ReplicaReads
+	case RedisCluster:
+		if cfg.DB != 0 {
+			return nil, oops.
+				In("kvstore").
+				Code(errcode.InvalidConfig).
+				With("db", cfg.DB).
+				Errorf("redis cluster only supports database 0")
+		}
+		opts.IsClusterMode = true
+		opts.ReadOnly = rc.ReplicaReads
+	default:
+		return nil, oops.
+			In("kvstore").
+			Code(errcode.InvalidConfig).
+			With("topology", rc.Topology).
+			Errorf("unknown redis topology %q", rc.Topology)
+	}
+	if rc.TLS.Enabled {
+		tlsConfig, err := rc.TLS.load()
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	return &Redis{client: redis.NewUniversalClient(opts)}, nil
+}
+
+// Get implements Store.
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := r.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	return value, redisError(err, "get", key)
+}
+
+// Set implements Store.
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return redisError(r.client.Set(ctx, key, value, ttl).Err(), "set", key)
+}
+
+// Incr implements Store.
+func (r *Redis) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	n, err := incrScript.Run(ctx, r.client, []string{key}, delta, ttl.Milliseconds()).Int64()
+	return n, redisError(err, "incr", key)
+}
+
+// Expire implements Store.
+func (r *Redis) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return redisError(r.client.Persist(ctx, key).Err(), "expire", key)
+	}
+	return redisError(r.client.PExpire(ctx, key, ttl).Err(), "expire", key)
+}
+
+// Delete implements Store.
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	return redisError(r.client.Del(ctx, key).Err(), "delete", key)
+}
+
+// Eval implements Scripter.
+func (r *Redis) Eval(ctx context.Context, script *Script, keys []string, args ...any) (any, error) {
+	result, err := script.script.Run(ctx, r.client, keys, args...).Result()
+	if len(keys) > 0 {
+		return result, redisError(err, "eval", keys[0])
+	}
+	return result, redisError(err, "eval", "")
+}
+
+// Close implements Store.
+func (r *Redis) Close() error {
+	return oops.In("kvstore").Code(errcode.StoreFailed).Wrap(r.client.Close())
+}
+
+func redisError(err error, op, key string) error {
+	if err == nil {
+		return nil
+	}
+	return oops.
+		In("kvstore").
+		Code(errcode.StoreFailed).
+		With("driver", DriverRedis).
+		With("op", op).
+		With("key", key).
+		Wrapf(err, "redis %s failed", op)
+}
+
+// Ensure Redis implements Store and Scripter.
+var (
+	_ Store    = (*Redis)(nil)
+	_ Scripter = (*Redis)(nil)
+)
@@ -0,0 +1,43 @@
+package kvstore
+
+import (
+	"context"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/redis/go-redis/v9"
+	"github.com/samber/oops"
+)
+
+// Script is a Lua script run atomically by stores supporting scripts.
+type Script struct {
+	script *redis.Script
+}
+
+// NewScript creates a Script from Lua source.
+func NewScript(src string) *Script {
+	return &Script{script: redis.NewScript(src)}
+}
+
+// Scripter is implemented by stores that run Scripts. Stores returned by
+// Open implement it, but return ErrScriptsUnsupported unless their driver
+// does.
+type Scripter interface {
+	// Eval runs script with keys, namespaced like other keys, and args, and
+	// returns its result: integers as int64, strings, and arrays as []any.
+	Eval(ctx context.Context, script *Script, keys []string, args ...any) (any, error)
+}
+
+// ErrScriptsUnsupported is returned by Eval on drivers without scripts.
+var ErrScriptsUnsupported = oops.
+	In("kvstore").
+	Code(errcode.InvalidDriver).
+	Errorf("kvstore driver does not support scripts")
+
+// SupportsScripts reports whether store runs Scripts.
+func SupportsScripts(store Store) bool {
+	if s, ok := store.(*instrumented); ok {
+		store = s.backend
+	}
+	_, ok := store.(Scripter)
+	return ok
+}
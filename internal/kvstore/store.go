@@ -0,0 +1,204 @@
+// Package kvstore is a small key-value store API shared by processors that
+// keep state across requests or replicas, with in-memory, Redis, memcached
+// and gossip drivers.
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/gossip"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// ErrNotFound is returned by Get for missing or expired keys.
+var ErrNotFound = errors.New("kvstore: key not found")
+
+// Store is a key-value store. A zero TTL means the key never expires.
+type Store interface {
+	// Get returns the value of key, or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value under key.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Incr adds delta to the integer under key and returns the new value.
+	// A missing key starts at 0 and gets ttl; existing keys keep theirs.
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// Expire sets the TTL of an existing key; missing keys are ignored.
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	// Delete removes key; missing keys are ignored.
+	Delete(ctx context.Context, key string) error
+	// Close releases connections.
+	Close() error
+}
+
+// Driver selects the Store implementation.
+type Driver string
+
+const (
+	DriverMemory    Driver = "memory"
+	DriverRedis     Driver = "redis"
+	DriverMemcached Driver = "memcached"
+	DriverGossip    Driver = "gossip"
+)
+
+// Config holds store settings.
+type Config struct {
+	Driver Driver
+	// Addrs are host:port server addresses for redis and memcached. For
+	// Redis Sentinel they are the sentinels; for Redis Cluster, seed nodes.
+	Addrs []string
+	// Username and Password authenticate to Redis (ACL users when Username
+	// is set).
+	Username string
+	Password string
+	// DB is the Redis database number; Cluster only has database 0.
+	DB int
+	// Redis selects the topology, TLS and pooling of the redis driver.
+	Redis RedisConfig
+	// Prefix namespaces every key, so stores can share a server. With
+	// Redis Cluster, a "{tag}" prefix keeps all keys in one slot.
+	Prefix string
+	// Timeout bounds dialing and each operation.
+	Timeout time.Duration
+	// Gossip selects the peers and transport of the gossip driver.
+	Gossip gossip.Config
+	// MaxKeys bounds the memory and gossip drivers; 0 is unbounded.
+	MaxKeys int
+	// Clock measures TTLs of the memory and gossip drivers; nil is the
+	// system clock.
+	Clock clock.Clock
+	// Log receives the gossip driver's events.
+	Log zerolog.Logger
+}
+
+// RedisTopology is how Redis servers are deployed.
+type RedisTopology string
+
+const (
+	RedisStandalone RedisTopology = "standalone"
+	RedisSentinel   RedisTopology = "sentinel"
+	RedisCluster    RedisTopology = "cluster"
+)
+
+// RedisConfig holds Redis-specific settings.
+type RedisConfig struct {
+	Topology RedisTopology
+	// MasterName is the Sentinel master set name.
+	MasterName string
+	// SentinelUsername and SentinelPassword authenticate to the sentinels.
+	SentinelUsername string
+	SentinelPassword string
+	// ReplicaReads routes read-only commands to replicas (Sentinel and
+	// Cluster).
+	ReplicaReads bool
+
+	TLS TLSConfig
+
+	// PoolSize is the maximum number of connections per node; 0 uses
+	// 10 per CPU.
+	PoolSize        int
+	MinIdleConns    int
+	MaxIdleConns    int
+	ConnMaxIdleTime time.Duration
+	ConnMaxLifetime time.Duration
+	// PoolTimeout is how long to wait for a free connection; 0 uses
+	// Timeout plus one second.
+	PoolTimeout time.Duration
+	// MaxRetries is the number of retries of failed commands; -1 disables
+	// them.
+	MaxRetries int
+}
+
+// TLSConfig holds client TLS settings.
+type TLSConfig struct {
+	Enabled bool
+	// CAFile verifies the server; empty uses the system roots.
+	CAFile string
+	// CertFile and KeyFile are a client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name verified in the server certificate.
+	ServerName string
+	// InsecureSkipVerify disables server verification. Testing only.
+	InsecureSkipVerify bool
+}
+
+// NewConfig builds a Config from the CLI configuration block.
+func NewConfig(cfg config.KVStoreConfig, log zerolog.Logger) Config {
+	return Config{
+		Driver:   Driver(cfg.Driver),
+		Addrs:    cfg.Addrs,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+		Redis: RedisConfig{
+			Topology:         RedisTopology(cfg.Topology),
+			MasterName:       cfg.MasterName,
+			SentinelUsername: cfg.SentinelUsername,
+			SentinelPassword: cfg.SentinelPassword,
+			ReplicaReads:     cfg.ReplicaReads,
+			TLS: TLSConfig{
+				Enabled:            cfg.TLS,
+				CAFile:             cfg.TLSCAFile,
+				CertFile:           cfg.TLSCertFile,
+				KeyFile:            cfg.TLSKeyFile,
+				ServerName:         cfg.TLSServerName,
+				InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+			},
+			PoolSize:        cfg.PoolSize,
+			MinIdleConns:    cfg.MinIdleConns,
+			MaxIdleConns:    cfg.MaxIdleConns,
+			PoolTimeout:     cfg.PoolTimeout,
+			ConnMaxIdleTime: cfg.ConnMaxIdleTime,
+			ConnMaxLifetime: cfg.ConnMaxLifetime,
+			MaxRetries:      cfg.MaxRetries,
+		},
+		Gossip: gossip.Config{
+			Bind:      cfg.GossipBind,
+			Peers:     cfg.GossipPeers,
+			Interval:  cfg.GossipInterval,
+			Fanout:    cfg.GossipFanout,
+			SecretKey: []byte(cfg.GossipSecretKey),
+			Insecure:  cfg.GossipInsecure,
+			NodeName:  cfg.GossipNodeName,
+		},
+		Prefix:  cfg.Prefix,
+		Timeout: cfg.Timeout,
+		MaxKeys: cfg.GossipMaxKeys,
+		Log:     log,
+	}
+}
+
+// Open creates the store selected by cfg.Driver.
+func Open(cfg Config) (Store, error) {
+	var (
+		backend Store
+		err     error
+	)
+	switch cfg.Driver {
+	case DriverMemory, "":
+		cfg.Driver = DriverMemory
+		backend = NewMemory(cfg.MaxKeys, WithClock(cfg.Clock))
+	case DriverRedis:
+		backend, err = newRedis(cfg)
+	case DriverMemcached:
+		backend, err = newMemcached(cfg)
+	case DriverGossip:
+		backend, err = newGossip(cfg)
+	default:
+		return nil, oops.
+			In("kvstore").
+			Code(errcode.InvalidDriver).
+			With("driver", cfg.Driver).
+			Errorf("unknown kvstore driver %q", cfg.Driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumented{driver: string(cfg.Driver), prefix: cfg.Prefix, backend: backend}, nil
+}
@@ -0,0 +1,38 @@
+package kvstore
+
+import (
+	"crypto/tls"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/tlsutil"
+	"github.com/samber/oops"
+)
+
+// load builds the client tls.Config.
+func (c TLSConfig) load() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pool, err := tlsutil.LoadCA(c.CAFile)
+		if err != nil {
+			return nil, oops.In("kvstore").Wrap(err)
+		}
+		config.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, oops.
+				In("kvstore").
+				Code(errcode.LoadKeypairFailed).
+				With("cert_file", c.CertFile).
+				With("key_file", c.KeyFile).
+				Wrapf(err, "failed to load client key pair")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
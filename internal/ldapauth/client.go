@@ -0,0 +1,249 @@
+// Package ldapauth resolves user group memberships from LDAP or Active
+// Directory using a pool of bound connections and a result cache.
+package ldapauth
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"golang.org/x/sync/singleflight"
+)
+
+// matchingRuleInChain is the Active Directory LDAP_MATCHING_RULE_IN_CHAIN
+// OID, used to resolve nested group membership in a single query.
+const matchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+type Config struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	StartTLS     bool
+	BaseDN       string
+	// UserFilter is a filter template with a single %s for the escaped user.
+	UserFilter     string
+	GroupAttribute string
+	NestedGroups   bool
+	PoolSize       int
+	CacheSize      int
+	CacheTTL       time.Duration
+	Timeout        time.Duration
+}
+
+type Client struct {
+	cfg   Config
+	pool  chan *ldap.Conn
+	cache *expirable.LRU[string, []string]
+	sg    singleflight.Group
+	log   zerolog.Logger
+}
+
+func New(cfg Config, log zerolog.Logger) (*Client, error) {
+	if cfg.URL == "" || cfg.BaseDN == "" {
+		return nil, oops.
+			In("ldapauth").
+			Code(errcode.InvalidConfig).
+			Errorf("LDAP URL and base DN are required")
+	}
+	if strings.Count(cfg.UserFilter, "%s") != 1 {
+		return nil, oops.
+			In("ldapauth").
+			Code(errcode.InvalidConfig).
+			With("user_filter", cfg.UserFilter).
+			Errorf("user filter must contain exactly one %%s")
+	}
+	return &Client{
+		cfg:   cfg,
+		pool:  make(chan *ldap.Conn, max(cfg.PoolSize, 1)),
+		cache: expirable.NewLRU[string, []string](cfg.CacheSize, nil, cfg.CacheTTL),
+		log:   log.With().Str("component", "ldapauth").Logger(),
+	}, nil
+}
+
+// Groups returns the DNs of the groups user is a member of.
+func (c *Client) Groups(user string) ([]string, error) {
+	key := strings.ToLower(user)
+	if cached, ok := c.cache.Get(key); ok {
+		return cached, nil
+	}
+
+	val, err, _ := c.sg.Do(key, func() (any, error) {
+		if cached, ok := c.cache.Get(key); ok {
+			return cached, nil
+		}
+		start := time.Now()
+		groups, err := c.lookup(user)
+		if err != nil {
+			return nil, err
+		}
+		c.log.Debug().
+			Dur("duration", time.Since(start)).
+			Str("user", user).
+			Int("groups", len(groups)).
+			Msg("group membership resolved")
+		c.cache.Add(key, groups)
+		return groups, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]string), nil
+}
+
+func (c *Client) lookup(user string) ([]string, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := c.search(conn, user)
+	if err != nil {
+		// The connection may be broken; drop it rather than returning it to the pool.
+		conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return groups, nil
+}
+
+func (c *Client) search(conn *ldap.Conn, user string) ([]string, error) {
+	userReq := ldap.NewSearchRequest(
+		c.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(c.cfg.Timeout.Seconds()), false,
+		c.userFilter(user),
+		[]string{"dn", c.cfg.GroupAttribute},
+		nil,
+	)
+	res, err := conn.Search(userReq)
+	if err != nil {
+		return nil, oops.
+			In("ldapauth").
+			Code(errcode.SearchFailed).
+			With("user", user).
+			Wrapf(err, "failed to search user")
+	}
+	switch len(res.Entries) {
+	case 0:
+		return []string{}, nil
+	case 1:
+	default:
+		return nil, oops.
+			In("ldapauth").
+			Code(errcode.AmbiguousUser).
+			With("user", user).
+			Errorf("user filter matched %d entries", len(res.Entries))
+	}
+	entry := res.Entries[0]
+
+	if !c.cfg.NestedGroups {
+		return entry.GetAttributeValues(c.cfg.GroupAttribute), nil
+	}
+
+	groupReq := ldap.NewSearchRequest(
+		c.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(c.cfg.Timeout.Seconds()), false,
+		fmt.Sprintf("(member:%s:=%s)", matchingRuleInChain, ldap.EscapeFilter(entry.DN)),
+		[]string{"dn"},
+		nil,
+	)
+	groupRes, err := conn.Search(groupReq)
+	if err != nil {
+		return nil, oops.
+			In("ldapauth").
+			Code(errcode.SearchFailed).
+			With("user_dn", entry.DN).
+			Wrapf(err, "failed to search nested groups")
+	}
+	groups := make([]string, 0, len(groupRes.Entries))
+	for _, g := range groupRes.Entries {
+		groups = append(groups, g.DN)
+	}
+	return groups, nil
+}
+
+// userFilter returns the user search filter for user, escaped so it
+// cannot change the filter's structure.
+func (c *Client) userFilter(user string) string {
+	return fmt.Sprintf(c.cfg.UserFilter, ldap.EscapeFilter(user))
+}
+
+// get takes a pooled connection or dials and binds a new one.
+func (c *Client) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-c.pool:
+			if conn.IsClosing() {
+				continue
+			}
+			return conn, nil
+		default:
+			return c.dial()
+		}
+	}
+}
+
+// put returns a healthy connection to the pool, closing it if the pool is full.
+func (c *Client) put(conn *ldap.Conn) {
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (c *Client) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(c.cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: c.cfg.Timeout}))
+	if err != nil {
+		return nil, oops.
+			In("ldapauth").
+			Code(errcode.DialFailed).
+			With("url", c.cfg.URL).
+			Wrapf(err, "failed to connect to LDAP server")
+	}
+	conn.SetTimeout(c.cfg.Timeout)
+
+	if c.cfg.StartTLS {
+		var host string
+		if u, err := url.Parse(c.cfg.URL); err == nil {
+			host = u.Hostname()
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			conn.Close()
+			return nil, oops.
+				In("ldapauth").
+				Code(errcode.StartTLSFailed).
+				With("url", c.cfg.URL).
+				Wrapf(err, "failed to start TLS")
+		}
+	}
+
+	if c.cfg.BindDN != "" {
+		if err := conn.Bind(c.cfg.BindDN, c.cfg.BindPassword); err != nil {
+			conn.Close()
+			return nil, oops.
+				In("ldapauth").
+				Code(errcode.BindFailed).
+				With("bind_dn", c.cfg.BindDN).
+				Wrapf(err, "failed to bind")
+		}
+	}
+	return conn, nil
+}
+
+// Close closes all pooled connections.
+func (c *Client) Close() error {
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
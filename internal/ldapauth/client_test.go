@@ -0,0 +1,76 @@
+package ldapauth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+)
+
+func newClient(t *testing.T, url string) *Client {
+	t.Helper()
+	c, err := New(Config{
+		URL:        url,
+		BaseDN:     "dc=corp,dc=example",
+		UserFilter: "(&(objectClass=user)(sAMAccountName=%s))",
+		PoolSize:   2,
+		CacheSize:  16,
+		CacheTTL:   time.Minute,
+		Timeout:    time.Second,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestUserFilterEscaping(t *testing.T) {
+	c := newClient(t, "ldap://127.0.0.1:1")
+	for user, want := range map[string]string{
+		"alice":        `(&(objectClass=user)(sAMAccountName=alice))`,
+		"*":            `(&(objectClass=user)(sAMAccountName=\2a))`,
+		"a)(uid=*":     `(&(objectClass=user)(sAMAccountName=a\29\28uid=\2a))`,
+		`x\00`:         `(&(objectClass=user)(sAMAccountName=x\5c00))`,
+		"admin)(|(a=b": `(&(objectClass=user)(sAMAccountName=admin\29\28|\28a=b))`,
+	} {
+		if got := c.userFilter(user); got != want {
+			t.Errorf("userFilter(%q) = %s, want %s", user, got, want)
+		}
+	}
+}
+
+func TestNewValidatesFilter(t *testing.T) {
+	for _, filter := range []string{"(uid=alice)", "(|(uid=%s)(mail=%s))"} {
+		if _, err := New(Config{URL: "ldap://ldap", BaseDN: "dc=example", UserFilter: filter}, zerolog.Nop()); err == nil {
+			t.Errorf("accepted filter %q", filter)
+		}
+	}
+}
+
+// TestGroupsServerDown checks that lookups fail rather than resolve to no
+// groups when no connection can be made, and that failures are not cached.
+func TestGroupsServerDown(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	c := newClient(t, "ldap://"+addr)
+	for range 2 {
+		groups, err := c.Groups("alice")
+		if err == nil {
+			t.Fatalf("Groups = %q, want an error", groups)
+		}
+		if !errcode.Is(err, errcode.DialFailed) {
+			t.Errorf("error = %v, want %s", err, errcode.DialFailed)
+		}
+	}
+	if c.cache.Len() != 0 {
+		t.Error("cached a failed lookup")
+	}
+}
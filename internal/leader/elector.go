@@ -0,0 +1,286 @@
+// Package leader elects one replica to run singleton background work, using
+// a Kubernetes coordination.k8s.io/v1 Lease as the lock.
+package leader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+var leading = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "leader_election_leading",
+	Help: "Whether this replica holds the leader election lease (1) or not (0).",
+}, []string{"lease"})
+
+func init() {
+	metrics.Registry.MustRegister(leading)
+}
+
+// Config holds leader election settings.
+type Config struct {
+	// Namespace of the Lease; empty uses the pod's namespace.
+	Namespace string
+	// Name of the Lease shared by all replicas.
+	Name string
+	// Identity of this replica; empty uses the hostname (the pod name).
+	Identity string
+	// LeaseDuration is how long followers wait after the last renewal
+	// before taking over.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps retrying renewal before
+	// giving up leadership. It must be shorter than LeaseDuration.
+	RenewDeadline time.Duration
+	// RetryPeriod is the interval between acquire and renew attempts.
+	RetryPeriod time.Duration
+	// Clock judges lease expiry and paces attempts; nil is the system
+	// clock.
+	Clock clock.Clock
+}
+
+// Elector campaigns for a Lease and runs a callback while holding it.
+type Elector struct {
+	cfg    Config
+	client leases
+	clock  clock.Clock
+	log    zerolog.Logger
+	gauge  prometheus.Gauge
+
+	isLeader atomic.Bool
+
+	// Observed lease state, used to judge expiry by the local clock rather
+	// than the holder's timestamps.
+	mu         sync.Mutex
+	observed   string
+	observedAt time.Time
+}
+
+// New creates an Elector. It fails outside a Kubernetes pod.
+func New(cfg Config, log zerolog.Logger) (*Elector, error) {
+	if cfg.Namespace == "" {
+		cfg.Namespace = kube.Namespace()
+	}
+	if cfg.Identity == "" {
+		cfg.Identity, _ = os.Hostname()
+	}
+	switch {
+	case cfg.Name == "" || cfg.Namespace == "" || cfg.Identity == "":
+		return nil, oops.
+			In("leader").
+			Code(errcode.InvalidConfig).
+			With("name", cfg.Name).
+			With("namespace", cfg.Namespace).
+			With("identity", cfg.Identity).
+			Errorf("leader election needs a lease name, namespace and identity")
+	case cfg.RetryPeriod <= 0 || cfg.RenewDeadline <= cfg.RetryPeriod || cfg.LeaseDuration <= cfg.RenewDeadline:
+		return nil, oops.
+			In("leader").
+			Code(errcode.InvalidConfig).
+			With("lease_duration", cfg.LeaseDuration).
+			With("renew_deadline", cfg.RenewDeadline).
+			With("retry_period", cfg.RetryPeriod).
+			Errorf("leader election needs lease duration > renew deadline > retry period > 0")
+	}
+	client, err := newLeaseClient(cfg.Namespace, cfg.RetryPeriod)
+	if err != nil {
+		return nil, err
+	}
+	return newElector(cfg, client, log), nil
+}
+
+// newElector creates an Elector campaigning through client.
+func newElector(cfg Config, client leases, log zerolog.Logger) *Elector {
+	gauge := leading.WithLabelValues(cfg.Namespace + "/" + cfg.Name)
+	gauge.Set(0)
+	return &Elector{
+		cfg:    cfg,
+		client: client,
+		clock:  clock.Or(cfg.Clock),
+		log: log.With().
+			Str("component", "leader").
+			Str("lease", cfg.Namespace+"/"+cfg.Name).
+			Str("identity", cfg.Identity).
+			Logger(),
+		gauge: gauge,
+	}
+}
+
+// IsLeader reports whether this replica currently holds the lease.
+func (e *Elector) IsLeader() bool {
+	return e.isLeader.Load()
+}
+
+// Run campaigns until ctx is done. Each time leadership is acquired, lead
+// runs with a context canceled when it is lost; Run waits for lead to
+// return before campaigning again. On exit the lease is released so another
+// replica can take over without waiting for it to expire.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	for {
+		if !e.acquire(ctx) {
+			return
+		}
+		e.isLeader.Store(true)
+		e.gauge.Set(1)
+		e.log.Info().Msg("acquired leadership")
+
+		leaderCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			lead(leaderCtx)
+		}()
+		e.renew(ctx)
+		e.isLeader.Store(false)
+		e.gauge.Set(0)
+		cancel()
+		<-done
+
+		if ctx.Err() != nil {
+			e.release()
+			return
+		}
+		e.log.Warn().Msg("lost leadership")
+	}
+}
+
+// acquire retries until the lease is held or ctx is done.
+func (e *Elector) acquire(ctx context.Context) bool {
+	ticker := e.clock.NewTicker(e.cfg.RetryPeriod)
+	defer ticker.Stop()
+	for {
+		if e.tryAcquireOrRenew(ctx) {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C():
+		}
+	}
+}
+
+// renew keeps the lease until a renewal has not succeeded for RenewDeadline
+// or ctx is done.
+func (e *Elector) renew(ctx context.Context) {
+	ticker := e.clock.NewTicker(e.cfg.RetryPeriod)
+	defer ticker.Stop()
+	last := e.clock.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		if e.tryAcquireOrRenew(ctx) {
+			last = e.clock.Now()
+		} else if e.clock.Since(last) > e.cfg.RenewDeadline {
+			return
+		}
+	}
+}
+
+func (e *Elector) tryAcquireOrRenew(ctx context.Context) bool {
+	now := e.clock.Now()
+	stamp := now.UTC().Format(microTime)
+	seconds := int32(e.cfg.LeaseDuration / time.Second)
+	identity := e.cfg.Identity
+
+	current, err := e.client.get(ctx, e.cfg.Name)
+	if errors.Is(err, kube.ErrNotFound) {
+		var transitions int32
+		created, err := e.client.create(ctx, &lease{
+			Metadata: leaseMetadata{Name: e.cfg.Name, Namespace: e.cfg.Namespace},
+			Spec: leaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &stamp,
+				RenewTime:            &stamp,
+				LeaseTransitions:     &transitions,
+			},
+		})
+		if err != nil {
+			e.log.Debug().Err(err).Msg("failed to create lease")
+			return false
+		}
+		e.observe(created, now)
+		return true
+	}
+	if err != nil {
+		e.log.Debug().Err(err).Msg("failed to get lease")
+		return false
+	}
+
+	e.observe(current, now)
+	holder := current.holder()
+	if holder != "" && holder != identity && !e.expired(current, now) {
+		return false
+	}
+
+	next := *current
+	next.Spec.HolderIdentity = &identity
+	next.Spec.LeaseDurationSeconds = &seconds
+	next.Spec.RenewTime = &stamp
+	if holder != identity {
+		transitions := current.transitions() + 1
+		next.Spec.AcquireTime = &stamp
+		next.Spec.LeaseTransitions = &transitions
+	}
+	updated, err := e.client.update(ctx, &next)
+	if err != nil {
+		e.log.Debug().Err(err).Msg("failed to update lease")
+		return false
+	}
+	e.observe(updated, now)
+	return true
+}
+
+// observe records when the lease last changed, as seen locally.
+func (e *Elector) observe(l *lease, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if l.Metadata.ResourceVersion != e.observed {
+		e.observed = l.Metadata.ResourceVersion
+		e.observedAt = now
+	}
+}
+
+func (e *Elector) expired(l *lease, now time.Time) bool {
+	duration := e.cfg.LeaseDuration
+	if l.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return now.After(e.observedAt.Add(duration))
+}
+
+// release hands the lease back if this replica still holds it.
+func (e *Elector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.RetryPeriod)
+	defer cancel()
+	current, err := e.client.get(ctx, e.cfg.Name)
+	if err != nil || current.holder() != e.cfg.Identity {
+		return
+	}
+	empty, seconds := "", int32(1)
+	stamp := e.clock.Now().UTC().Format(microTime)
+	current.Spec.HolderIdentity = &empty
+	current.Spec.LeaseDurationSeconds = &seconds
+	current.Spec.RenewTime = &stamp
+	if _, err := e.client.update(ctx, current); err != nil {
+		e.log.Warn().Err(err).Msg("failed to release lease")
+		return
+	}
+	e.log.Info().Msg("released leadership")
+}
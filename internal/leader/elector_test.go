@@ -0,0 +1,240 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/rs/zerolog"
+)
+
+// fakeLeases is an in-memory API server for one Lease, checking
+// resourceVersion like the real one.
+type fakeLeases struct {
+	mu      sync.Mutex
+	lease   *lease
+	version int
+	// down fails every call.
+	down bool
+	// beforeUpdate, if set, runs once at the start of the next update, as
+	// a concurrent writer would.
+	beforeUpdate func()
+}
+
+var errDown = errors.New("api server down")
+
+func (f *fakeLeases) get(_ context.Context, _ string) (*lease, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.down:
+		return nil, errDown
+	case f.lease == nil:
+		return nil, kube.ErrNotFound
+	}
+	return f.copy(), nil
+}
+
+func (f *fakeLeases) create(_ context.Context, l *lease) (*lease, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.down:
+		return nil, errDown
+	case f.lease != nil:
+		return nil, kube.ErrConflict
+	}
+	f.store(l)
+	return f.copy(), nil
+}
+
+func (f *fakeLeases) update(_ context.Context, l *lease) (*lease, error) {
+	if hook := f.beforeUpdate; hook != nil {
+		f.beforeUpdate = nil
+		hook()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.down:
+		return nil, errDown
+	case f.lease == nil:
+		return nil, kube.ErrNotFound
+	case l.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion:
+		return nil, kube.ErrConflict
+	}
+	f.store(l)
+	return f.copy(), nil
+}
+
+// set stores a lease held by holder, as another replica would.
+func (f *fakeLeases) set(holder string, seconds int32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.store(&lease{Spec: leaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &seconds}})
+}
+
+func (f *fakeLeases) store(l *lease) {
+	f.version++
+	stored := *l
+	stored.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.lease = &stored
+}
+
+func (f *fakeLeases) copy() *lease {
+	l := *f.lease
+	return &l
+}
+
+func (f *fakeLeases) holder() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lease == nil {
+		return ""
+	}
+	return f.lease.holder()
+}
+
+func newTestElector(identity string, client leases, c clock.Clock) *Elector {
+	return newElector(Config{
+		Namespace:     "default",
+		Name:          "test",
+		Identity:      identity,
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+		Clock:         c,
+	}, client, zerolog.Nop())
+}
+
+func TestTakeoverAfterLeaseDuration(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	client := &fakeLeases{}
+	client.set("other", 15)
+	e := newTestElector("me", client, c)
+
+	if e.tryAcquireOrRenew(ctx) {
+		t.Fatal("took over a lease just observed")
+	}
+	c.Advance(14 * time.Second)
+	if e.tryAcquireOrRenew(ctx) {
+		t.Fatal("took over before the lease duration passed")
+	}
+	// A renewal by the holder restarts the wait, whatever its timestamps.
+	client.set("other", 15)
+	c.Advance(2 * time.Second)
+	if e.tryAcquireOrRenew(ctx) {
+		t.Fatal("took over a lease renewed 2s ago")
+	}
+	c.Advance(14 * time.Second)
+	if e.tryAcquireOrRenew(ctx) {
+		t.Fatal("took over before the lease duration passed since the renewal")
+	}
+	c.Advance(2 * time.Second)
+	if !e.tryAcquireOrRenew(ctx) {
+		t.Fatal("did not take over an expired lease")
+	}
+	if got := client.holder(); got != "me" {
+		t.Errorf("holder %q, want me", got)
+	}
+	if got := client.lease.transitions(); got != 1 {
+		t.Errorf("transitions %d, want 1", got)
+	}
+}
+
+func TestConcurrentTakeoverConflicts(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	client := &fakeLeases{}
+	client.set("old", 15)
+	e := newTestElector("me", client, c)
+	e.tryAcquireOrRenew(ctx)
+	c.Advance(16 * time.Second)
+
+	// Another replica takes over between our read and our write.
+	client.beforeUpdate = func() { client.set("rival", 15) }
+	if e.tryAcquireOrRenew(ctx) {
+		t.Fatal("acquired a lease updated concurrently")
+	}
+	if got := client.holder(); got != "rival" {
+		t.Errorf("holder %q, want rival", got)
+	}
+	if e.tryAcquireOrRenew(ctx) {
+		t.Error("took over the rival's fresh lease")
+	}
+}
+
+func TestRenewGivesUpAfterDeadline(t *testing.T) {
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	client := &fakeLeases{}
+	e := newTestElector("me", client, c)
+	if !e.tryAcquireOrRenew(context.Background()) {
+		t.Fatal("did not create the lease")
+	}
+
+	start := c.Now()
+	client.mu.Lock()
+	client.down = true
+	client.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.renew(context.Background())
+	}()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-done:
+			if elapsed := c.Since(start); elapsed <= 10*time.Second {
+				t.Errorf("gave up after %v, before the renew deadline", elapsed)
+			}
+			return
+		case <-timeout:
+			t.Fatal("renew kept leading past the renew deadline")
+		case <-time.After(time.Millisecond):
+			c.Advance(time.Second)
+		}
+	}
+}
+
+func TestRunReleasesOnShutdown(t *testing.T) {
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	client := &fakeLeases{}
+	e := newTestElector("me", client, c)
+	ctx, cancel := context.WithCancel(context.Background())
+	leading := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(ctx, func(ctx context.Context) {
+			close(leading)
+			<-ctx.Done()
+		})
+	}()
+
+	select {
+	case <-leading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not acquire a free lease")
+	}
+	if !e.IsLeader() || client.holder() != "me" {
+		t.Fatalf("leader %v, holder %q", e.IsLeader(), client.holder())
+	}
+	cancel()
+	<-done
+	if e.IsLeader() {
+		t.Error("still leader after shutdown")
+	}
+	if got := client.holder(); got != "" {
+		t.Errorf("holder %q after shutdown, want the lease released", got)
+	}
+	if got := *client.lease.Spec.LeaseDurationSeconds; got != 1 {
+		t.Errorf("released lease duration %ds, want 1s", got)
+	}
+}
@@ -0,0 +1,103 @@
+package leader
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/samber/oops"
+)
+
+// microTime is the Kubernetes MicroTime wire format.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// lease is the subset of a coordination.k8s.io/v1 Lease that election uses.
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int32  `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+	LeaseTransitions     *int32  `json:"leaseTransitions,omitempty"`
+}
+
+func (l *lease) holder() string {
+	if l.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *l.Spec.HolderIdentity
+}
+
+func (l *lease) transitions() int32 {
+	if l.Spec.LeaseTransitions == nil {
+		return 0
+	}
+	return *l.Spec.LeaseTransitions
+}
+
+// leases reads and writes Leases in one namespace.
+type leases interface {
+	get(ctx context.Context, name string) (*lease, error)
+	create(ctx context.Context, l *lease) (*lease, error)
+	// update replaces the lease, failing with kube.ErrConflict if it
+	// changed since l was read.
+	update(ctx context.Context, l *lease) (*lease, error)
+}
+
+// leaseClient is the leases of the Kubernetes API server.
+type leaseClient struct {
+	client *kube.Client
+	path   string
+}
+
+func newLeaseClient(namespace string, timeout time.Duration) (*leaseClient, error) {
+	client, err := kube.NewInCluster(timeout)
+	if err != nil {
+		return nil, oops.In("leader").Wrap(err)
+	}
+	return &leaseClient{
+		client: client,
+		path:   "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(namespace) + "/leases",
+	}, nil
+}
+
+func (c *leaseClient) get(ctx context.Context, name string) (*lease, error) {
+	return c.do(ctx, http.MethodGet, c.path+"/"+url.PathEscape(name), nil)
+}
+
+func (c *leaseClient) create(ctx context.Context, l *lease) (*lease, error) {
+	return c.do(ctx, http.MethodPost, c.path, l)
+}
+
+// update replaces the lease, failing with kube.ErrConflict if it changed
+// since l was read.
+func (c *leaseClient) update(ctx context.Context, l *lease) (*lease, error) {
+	return c.do(ctx, http.MethodPut, c.path+"/"+url.PathEscape(l.Metadata.Name), l)
+}
+
+func (c *leaseClient) do(ctx context.Context, method, path string, in *lease) (*lease, error) {
+	var body any
+	if in != nil {
+		in.APIVersion, in.Kind = "coordination.k8s.io/v1", "Lease"
+		body = in
+	}
+	var out lease
+	if err := c.client.Do(ctx, method, path, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
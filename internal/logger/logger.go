@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/crashreport"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
 	"github.com/rs/zerolog"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -14,6 +16,12 @@ import (
 func New(cfg config.LogConfig) zerolog.Logger {
 	zerolog.TimeFieldFormat = time.RFC3339Nano
 	zerolog.SetGlobalLevel(cfg.Level)
+	// Every logged error is classified by its catalog code, feeding
+	// errors_total and /admin/errors; the logged value is unchanged.
+	zerolog.ErrorMarshalFunc = func(err error) any {
+		errcode.Observe(err)
+		return err
+	}
 
 	var writer io.Writer
 	switch cfg.Output {
@@ -47,5 +55,14 @@ func New(cfg config.LogConfig) zerolog.Logger {
 		writer = zerolog.ConsoleWriter{Out: writer, TimeFormat: time.RFC3339}
 	}
 
-	return zerolog.New(writer).With().Timestamp().Caller().Logger()
+	reporter, err := crashreport.Init(cfg.Sentry)
+	if reporter != nil {
+		writer = zerolog.MultiLevelWriter(writer, reporter)
+	}
+
+	log := zerolog.New(writer).With().Timestamp().Caller().Logger()
+	if err != nil {
+		log.Error().Err(err).Msg("crash reporting disabled")
+	}
+	return log
 }
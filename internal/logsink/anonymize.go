@@ -0,0 +1,157 @@
+package logsink
+
+import (
+	"io"
+	"net/netip"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Anonymizer truncates the IP addresses in entries to a network prefix,
+// e.g. 203.0.113.7 to 203.0.113.0 with the default /24, for outputs that
+// must not hold full client addresses. Addresses are found in the encoded
+// entry, so every format and field is covered, headers such as
+// X-Forwarded-For included.
+type Anonymizer struct {
+	// IPv4Prefix is the number of leading IPv4 bits kept.
+	IPv4Prefix int
+	// IPv6Prefix is the number of leading IPv6 bits kept.
+	IPv6Prefix int
+}
+
+// DefaultAnonymizer zeroes the last octet of IPv4 and the last 80 bits of
+// IPv6 addresses.
+var DefaultAnonymizer = Anonymizer{IPv4Prefix: 24, IPv6Prefix: 48}
+
+// Validate checks that the prefixes fit their address families.
+func (a Anonymizer) Validate() error {
+	if a.IPv4Prefix < 0 || a.IPv4Prefix > 32 || a.IPv6Prefix < 0 || a.IPv6Prefix > 128 {
+		return oops.
+			In("logsink").
+			Code(errcode.InvalidConfig).
+			With("ipv4_prefix", a.IPv4Prefix).
+			With("ipv6_prefix", a.IPv6Prefix).
+			Errorf("anonymization prefixes must be within 0-32 (IPv4) and 0-128 (IPv6)")
+	}
+	return nil
+}
+
+// isAddrByte reports whether c can be part of an IP address literal.
+func isAddrByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' || c == '.' || c == ':'
+}
+
+// isWordByte reports whether c continues a word an address literal cannot
+// be embedded in.
+func isWordByte(c byte) bool {
+	return c >= 'g' && c <= 'z' || c >= 'G' && c <= 'Z' || c == '_'
+}
+
+// addrShaped reports whether token, a run of address bytes, has the
+// separators of an address: three dots for IPv4, optionally with a port,
+// and "::" or seven colons (six before an embedded IPv4) for IPv6. It spares
+// parsing, and allocating, for the numbers, hex IDs, versions and times
+// entries are mostly made of.
+func addrShaped(token []byte) bool {
+	dots, colons, compressed := 0, 0, false
+	for i, c := range token {
+		switch c {
+		case '.':
+			dots++
+		case ':':
+			colons++
+			compressed = compressed || i > 0 && token[i-1] == ':'
+		}
+	}
+	return dots == 3 && colons <= 1 || compressed || colons == 7 || colons == 6 && dots == 3
+}
+
+// Anonymize returns entry with its IP addresses truncated. Entries without
+// addresses are returned as they are.
+func (a Anonymizer) Anonymize(entry []byte) []byte {
+	var out []byte
+	last := 0
+	for i := 0; i < len(entry); {
+		if !isAddrByte(entry[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(entry) && isAddrByte(entry[j]) {
+			j++
+		}
+		start, end := i, j
+		i = j
+		if start > 0 && isWordByte(entry[start-1]) || end < len(entry) && isWordByte(entry[end]) {
+			continue
+		}
+		// Sentence punctuation is not part of the address.
+		for end > start && (entry[end-1] == '.' || entry[end-1] == ':') {
+			end--
+		}
+		if !addrShaped(entry[start:end]) {
+			continue
+		}
+		masked, ok := a.mask(string(entry[start:end]))
+		if !ok {
+			continue
+		}
+		out = append(out, entry[last:start]...)
+		out = append(out, masked...)
+		last = end
+	}
+	if out == nil {
+		return entry
+	}
+	return append(out, entry[last:]...)
+}
+
+// mask returns the truncated form of an address, or of an IPv4 address
+// with a port, and whether s is one.
+func (a Anonymizer) mask(s string) (string, bool) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return a.maskAddr(addr).String(), true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return netip.AddrPortFrom(a.maskAddr(ap.Addr()), ap.Port()).String(), true
+	}
+	return "", false
+}
+
+func (a Anonymizer) maskAddr(addr netip.Addr) netip.Addr {
+	bits := a.IPv6Prefix
+	switch {
+	case addr.Is4():
+		bits = a.IPv4Prefix
+	case addr.Is4In6():
+		bits = 96 + a.IPv4Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr
+	}
+	return prefix.Addr()
+}
+
+// Anonymize returns a writer that truncates the IP addresses of every
+// entry written to w. Each write must hold whole entries.
+func Anonymize(w io.WriteCloser, a Anonymizer) io.WriteCloser {
+	return &anonymizing{w: w, a: a}
+}
+
+type anonymizing struct {
+	w io.WriteCloser
+	a Anonymizer
+}
+
+func (an *anonymizing) Write(p []byte) (int, error) {
+	if _, err := an.w.Write(an.a.Anonymize(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (an *anonymizing) Close() error {
+	return an.w.Close()
+}
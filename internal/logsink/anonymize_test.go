@@ -0,0 +1,45 @@
+package logsink
+
+import "testing"
+
+func TestAnonymize(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{
+			`{"remote_ip":"192.0.2.10","client_ip":"203.0.113.7","headers":{"X-Forwarded-For":["203.0.113.7, 10.0.0.1"]}}`,
+			`{"remote_ip":"192.0.2.0","client_ip":"203.0.113.0","headers":{"X-Forwarded-For":["203.0.113.0, 10.0.0.0"]}}`,
+		},
+		{
+			`{"client_ip":"2001:db8:1234:5678::1","peer":"[2001:db8:1:2::3]:443","mapped":"::ffff:198.51.100.9"}`,
+			`{"client_ip":"2001:db8:1234::","peer":"[2001:db8:1::]:443","mapped":"::ffff:198.51.100.0"}`,
+		},
+		{
+			`10.1.2.3:40000 - - [14/Mar/2025:07:09:26 +0000] "GET / HTTP/1.1" 200 512`,
+			`10.1.2.0:40000 - - [14/Mar/2025:07:09:26 +0000] "GET / HTTP/1.1" 200 512`,
+		},
+		// Versions, times, hex IDs and words are not addresses.
+		{
+			`{"ua":"curl/8.5.0","t":"2025-03-14T07:09:26.123Z","id":"dead:beef","host":"cafe.example.com","d":0.013}`,
+			`{"ua":"curl/8.5.0","t":"2025-03-14T07:09:26.123Z","id":"dead:beef","host":"cafe.example.com","d":0.013}`,
+		},
+		{`denied 198.51.100.77.`, `denied 198.51.100.0.`},
+		{`from 2001:db8:1:2:3:4:5:6 and 0:0:0:0:0:ffff:192.0.2.1`, `from 2001:db8:1:: and ::ffff:192.0.2.0`},
+	} {
+		if got := string(DefaultAnonymizer.Anonymize([]byte(tt.in))); got != tt.want {
+			t.Errorf("Anonymize(%s)\ngot  %s\nwant %s", tt.in, got, tt.want)
+		}
+	}
+
+	if (Anonymizer{IPv4Prefix: 33}).Validate() == nil {
+		t.Error("accepted a /33 IPv4 prefix")
+	}
+}
+
+func TestAnonymizeSkipsNonAddresses(t *testing.T) {
+	entry := []byte(`{"ts":1741936166.123,"status":200,"size":5120,"id":"8c4f1a7e4b1d","ver":"1.2.3","t":"07:09:26","log":"[14/Mar/2025:07:09:26 +0000]"}`)
+	allocs := testing.AllocsPerRun(100, func() {
+		DefaultAnonymizer.Anonymize(entry)
+	})
+	if allocs > 0 {
+		t.Errorf("%v allocations anonymizing an entry without addresses", allocs)
+	}
+}
@@ -0,0 +1,88 @@
+package logsink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Compression is a log compression codec.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// Extension returns the file name suffix of the codec.
+func (c Compression) Extension() string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// ContentEncoding returns the HTTP Content-Encoding of the codec, for
+// network sinks sending compressed batches.
+func (c Compression) ContentEncoding() string {
+	switch c {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// encoder is a streaming compressor that can be flushed mid-stream.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newEncoder wraps w in the codec's streaming compressor.
+func newEncoder(c Compression, w io.Writer) (encoder, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		return enc, oops.In("logsink").Code(errcode.InvalidCompression).Wrap(err)
+	default:
+		return nil, oops.
+			In("logsink").
+			Code(errcode.InvalidCompression).
+			With("compression", c).
+			Errorf("unknown compression %q", c)
+	}
+}
+
+// CompressBatch compresses a complete batch of log lines, for network sinks
+// that ship one request body per batch.
+func CompressBatch(c Compression, batch []byte) ([]byte, error) {
+	if c == CompressionNone || c == "" {
+		return batch, nil
+	}
+	var buf bytes.Buffer
+	enc, err := newEncoder(c, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := enc.Write(batch); err != nil {
+		return nil, oops.In("logsink").Code(errcode.WriteFailed).Wrapf(err, "failed to compress batch")
+	}
+	if err := enc.Close(); err != nil {
+		return nil, oops.In("logsink").Code(errcode.WriteFailed).Wrapf(err, "failed to compress batch")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,472 @@
+// Package logsink opens the outputs access logs are written to, optionally
+// compressing them on the fly.
+package logsink
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Config holds log output settings.
+type Config struct {
+	// Output is "stdout", "stderr", "none" or a file path. With hourly or daily
+	// rotation the path may hold strftime directives, e.g.
+	// "access-%Y%m%d%H.log".
+	Output      string
+	Compression Compression
+	// Rotation selects size-based or hourly/daily rotation.
+	Rotation Rotation
+	// LocalTime names and rotates time-based files in local time instead of
+	// UTC.
+	LocalTime bool
+	// MaxSize is the size in MB after which a file is rotated; 0 disables
+	// size-based rotation.
+	MaxSize int
+	// MaxAge is the number of days rotated files are kept; 0 keeps all.
+	MaxAge int
+	// MaxBackups is the number of rotated files kept; 0 keeps all.
+	MaxBackups int
+	// FlushInterval bounds how long compressed output stays buffered.
+	FlushInterval time.Duration
+	// BatchEntries coalesces file writes: entries are buffered and written
+	// with one syscall once this many are pending, or after BatchInterval.
+	// 0 writes every entry immediately.
+	BatchEntries int
+	// BatchInterval bounds how long a batched entry stays buffered.
+	BatchInterval time.Duration
+	// Memory, if set, accounts batched entries. An entry it refuses is
+	// written right away with the pending batch.
+	Memory Reserver
+	// Sync selects when files are fsynced.
+	Sync SyncPolicy
+	// AnonymizeIPs truncates the IP addresses of entries as Anonymizer
+	// says before they are written.
+	AnonymizeIPs bool
+	Anonymizer   Anonymizer
+	// OnRotate, if set, is called with the path of every file that was
+	// completed by rotation. It runs on the writing goroutine and must not
+	// block.
+	OnRotate func(path string)
+}
+
+// Reserver accounts bytes held in memory against a budget shared with
+// other buffers, e.g. an extproc.MemoryAccount.
+type Reserver interface {
+	// Reserve accounts n bytes, reporting false, and accounting nothing,
+	// if the budget is exhausted.
+	Reserve(n int64) bool
+	// Release returns n reserved bytes.
+	Release(n int64)
+}
+
+// SyncPolicy is when file output is fsynced.
+type SyncPolicy string
+
+const (
+	// SyncNone leaves flushing to disk to the kernel.
+	SyncNone SyncPolicy = "none"
+	// SyncBatch fsyncs after every batch or unbatched entry written.
+	SyncBatch SyncPolicy = "batch"
+)
+
+// maxBatchBytes writes a batch early so memory stays bounded when entries
+// are large.
+const maxBatchBytes = 1 << 20
+
+// Open returns a writer for cfg.Output. Closing it finishes any compressed
+// stream; standard streams themselves are left open.
+func Open(cfg Config) (io.WriteCloser, error) {
+	if !cfg.AnonymizeIPs {
+		return open(cfg)
+	}
+	if err := cfg.Anonymizer.Validate(); err != nil {
+		return nil, err
+	}
+	w, err := open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return Anonymize(w, cfg.Anonymizer), nil
+}
+
+func open(cfg Config) (io.WriteCloser, error) {
+	var w io.Writer
+	switch cfg.Output {
+	case "stdout", "":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	case "none":
+		return nopCloser{io.Discard}, nil
+	default:
+		if cfg.Rotation == RotateHourly || cfg.Rotation == RotateDaily {
+			return openTimedFile(cfg)
+		}
+		return openSizedFile(cfg)
+	}
+
+	if cfg.Compression == CompressionNone || cfg.Compression == "" {
+		return nopCloser{w}, nil
+	}
+	enc, err := newEncoder(cfg.Compression, w)
+	if err != nil {
+		return nil, err
+	}
+	return newFlusher(&stream{enc: enc}, Config{FlushInterval: cfg.FlushInterval}), nil
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// Tee returns a writer duplicating every write to each of outputs, e.g. a
+// file and a network sink. Writes and Close reach every output and return
+// the first error.
+func Tee(outputs ...io.WriteCloser) io.WriteCloser {
+	return tee(outputs)
+}
+
+type tee []io.WriteCloser
+
+func (t tee) Write(p []byte) (int, error) {
+	var first error
+	for _, w := range t {
+		if _, err := w.Write(p); err != nil && first == nil {
+			first = err
+		}
+	}
+	return len(p), first
+}
+
+func (t tee) Close() error {
+	var first error
+	for _, w := range t {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// stream is a compressed standard stream.
+type stream struct {
+	enc encoder
+}
+
+func (s *stream) write(p []byte) (int, error) { return s.enc.Write(p) }
+func (s *stream) flush() error                { return s.enc.Flush() }
+func (s *stream) close() error                { return s.enc.Close() }
+func (s *stream) sync() error                 { return nil }
+
+// sizedFile writes to a file, optionally compressed, rotating it by size.
+// Compressed files are complete gzip members or zstd frame sequences, so
+// appending to an existing file after a restart keeps it readable.
+type sizedFile struct {
+	cfg  Config
+	path string
+
+	file *os.File
+	enc  encoder
+	size int64
+}
+
+// sizedPath returns the active file of size-based rotation.
+func sizedPath(cfg Config) string {
+	path := cfg.Output
+	if ext := cfg.Compression.Extension(); !strings.HasSuffix(path, ext) {
+		path += ext
+	}
+	return path
+}
+
+func openSizedFile(cfg Config) (io.WriteCloser, error) {
+	f := &sizedFile{cfg: cfg, path: sizedPath(cfg)}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return newFlusher(f, cfg), nil
+}
+
+func (f *sizedFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return oops.In("logsink").Code(errcode.WriteFailed).With("output", f.path).Wrapf(err, "failed to open log output")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return oops.In("logsink").Code(errcode.WriteFailed).With("output", f.path).Wrap(err)
+	}
+	f.file, f.enc, f.size = file, nil, info.Size()
+	if f.cfg.Compression != CompressionNone && f.cfg.Compression != "" {
+		if f.enc, err = newEncoder(f.cfg.Compression, (*countingFile)(f)); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *sizedFile) write(p []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	if f.enc != nil {
+		n, err = f.enc.Write(p)
+	} else {
+		n, err = (*countingFile)(f).Write(p)
+	}
+	if err != nil || f.cfg.MaxSize <= 0 || f.size < int64(f.cfg.MaxSize)<<20 {
+		return n, err
+	}
+	return n, f.rotate()
+}
+
+func (f *sizedFile) flush() error {
+	if f.enc != nil {
+		return f.enc.Flush()
+	}
+	return nil
+}
+
+func (f *sizedFile) sync() error {
+	return oops.In("logsink").Code(errcode.WriteFailed).With("output", f.path).Wrap(f.file.Sync())
+}
+
+func (f *sizedFile) close() error {
+	var err error
+	if f.enc != nil {
+		err = f.enc.Close()
+	}
+	return oops.In("logsink").Code(errcode.WriteFailed).Wrap(oops.Join(err, f.file.Close()))
+}
+
+// rotate finishes the current file, renames it with a timestamp and starts
+// a new one.
+func (f *sizedFile) rotate() error {
+	if err := f.close(); err != nil {
+		return err
+	}
+	ext := f.cfg.Compression.Extension()
+	rotated := strings.TrimSuffix(f.path, ext) + "." + time.Now().UTC().Format("20060102T150405.000") + ext
+	if err := os.Rename(f.path, rotated); err != nil {
+		return oops.In("logsink").Code(errcode.WriteFailed).With("output", f.path).Wrapf(err, "failed to rotate log output")
+	}
+	if f.cfg.OnRotate != nil {
+		f.cfg.OnRotate(rotated)
+	}
+	prune(f.cfg, sizedPattern(f.cfg), f.path)
+	return f.open()
+}
+
+// sizedPattern globs the rotated files of size-based rotation.
+func sizedPattern(cfg Config) string {
+	ext := cfg.Compression.Extension()
+	return strings.TrimSuffix(sizedPath(cfg), ext) + ".*" + ext
+}
+
+// prune removes files matching pattern, other than active, beyond
+// MaxBackups or older than MaxAge. Names must sort chronologically.
+func prune(cfg Config, pattern, active string) {
+	if cfg.MaxBackups <= 0 && cfg.MaxAge <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return
+	}
+	slices.Sort(matches)
+	slices.Reverse(matches)
+	cutoff := time.Now().AddDate(0, 0, -cfg.MaxAge)
+	kept := 0
+	for _, name := range matches {
+		if name == active {
+			continue
+		}
+		kept++
+		remove := cfg.MaxBackups > 0 && kept > cfg.MaxBackups
+		if !remove && cfg.MaxAge > 0 {
+			info, err := os.Stat(name)
+			remove = err == nil && info.ModTime().Before(cutoff)
+		}
+		if remove {
+			_ = os.Remove(name)
+		}
+	}
+}
+
+// Completed lists the rotated files of cfg currently on disk, oldest first,
+// excluding the file being written. Uploaders use it to pick up files
+// rotated before a restart.
+func Completed(cfg Config) ([]string, error) {
+	var pattern, active string
+	switch cfg.Output {
+	case "stdout", "stderr", "":
+		return nil, nil
+	}
+	if cfg.Rotation == RotateHourly || cfg.Rotation == RotateDaily {
+		t := newTimedFile(cfg)
+		pattern, active = Strftime(t.template, time.Time{}, "*"), Strftime(t.template, t.periodStart(time.Now()))
+	} else {
+		pattern, active = sizedPattern(cfg), sizedPath(cfg)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, oops.In("logsink").Code(errcode.InvalidConfig).With("pattern", pattern).Wrap(err)
+	}
+	slices.Sort(matches)
+	return slices.DeleteFunc(matches, func(name string) bool { return name == active }), nil
+}
+
+// countingFile writes to the current file, tracking its size.
+type countingFile sizedFile
+
+func (c *countingFile) Write(p []byte) (int, error) {
+	n, err := c.file.Write(p)
+	c.size += int64(n)
+	return n, err
+}
+
+// target is a file or stream output driven by flusher.
+type target interface {
+	write(p []byte) (int, error)
+	flush() error
+	sync() error
+	close() error
+}
+
+// flusher serializes writes to a target, optionally coalescing them into
+// batches, and flushes it periodically so entries reach the output within
+// FlushInterval.
+type flusher struct {
+	mu     sync.Mutex
+	target target
+	cfg    Config
+	// batch holds pending entries while batching; reserved is the part
+	// of it accounted to cfg.Memory.
+	batch    []byte
+	pending  int
+	reserved int64
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newFlusher(t target, cfg Config) *flusher {
+	f := &flusher{target: t, cfg: cfg, stop: make(chan struct{}), done: make(chan struct{})}
+	if cfg.BatchEntries <= 0 {
+		cfg.BatchInterval = 0
+	}
+	if cfg.FlushInterval <= 0 && cfg.BatchInterval <= 0 {
+		close(f.done)
+		return f
+	}
+	go func() {
+		defer close(f.done)
+		flushTick := tick(cfg.FlushInterval)
+		defer flushTick.Stop()
+		batchTick := tick(cfg.BatchInterval)
+		defer batchTick.Stop()
+		for {
+			select {
+			case <-flushTick.C:
+				f.mu.Lock()
+				_ = f.writeBatch()
+				_ = f.target.flush()
+				f.mu.Unlock()
+			case <-batchTick.C:
+				f.mu.Lock()
+				_ = f.writeBatch()
+				f.mu.Unlock()
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+	return f
+}
+
+// tick returns a ticker firing every d, or one that never fires for d <= 0.
+func tick(d time.Duration) *time.Ticker {
+	if d <= 0 {
+		return &time.Ticker{}
+	}
+	return time.NewTicker(d)
+}
+
+func (f *flusher) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfg.BatchEntries <= 0 {
+		n, err := f.target.write(p)
+		if err == nil && f.cfg.Sync == SyncBatch {
+			err = f.target.sync()
+		}
+		return n, err
+	}
+	// The caller may reuse p, so the batch keeps a copy.
+	f.batch = append(f.batch, p...)
+	f.pending++
+	// An entry the memory budget refuses is written right away with the
+	// batch rather than held.
+	if !f.reserve(len(p)) || f.pending >= f.cfg.BatchEntries || len(f.batch) >= maxBatchBytes {
+		if err := f.writeBatch(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// reserve accounts n batched bytes to cfg.Memory, reporting false if it
+// refuses them.
+func (f *flusher) reserve(n int) bool {
+	if f.cfg.Memory == nil {
+		return true
+	}
+	if !f.cfg.Memory.Reserve(int64(n)) {
+		return false
+	}
+	f.reserved += int64(n)
+	return true
+}
+
+// writeBatch writes pending entries with a single write. Entries of a
+// failed batch are dropped.
+func (f *flusher) writeBatch() error {
+	if f.pending == 0 {
+		return nil
+	}
+	_, err := f.target.write(f.batch)
+	if err == nil && f.cfg.Sync == SyncBatch {
+		err = f.target.sync()
+	}
+	f.pending = 0
+	if f.reserved > 0 {
+		f.cfg.Memory.Release(f.reserved)
+		f.reserved = 0
+	}
+	if cap(f.batch) > maxBatchBytes {
+		f.batch = nil
+	} else {
+		f.batch = f.batch[:0]
+	}
+	return err
+}
+
+// Close stops periodic flushing, writes pending entries and finishes the
+// compressed stream.
+func (f *flusher) Close() error {
+	close(f.stop)
+	<-f.done
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return oops.Join(f.writeBatch(), f.target.close())
+}
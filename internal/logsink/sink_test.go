@@ -0,0 +1,67 @@
+package logsink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// budget is a Reserver of limit bytes.
+type budget struct{ limit, held int64 }
+
+func (b *budget) Reserve(n int64) bool {
+	if b.held+n > b.limit {
+		return false
+	}
+	b.held += n
+	return true
+}
+
+func (b *budget) Release(n int64) { b.held -= n }
+
+func TestBatchMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	mem := &budget{limit: 12}
+	w, err := Open(Config{
+		Output:        path,
+		BatchEntries:  10,
+		BatchInterval: time.Hour,
+		Memory:        mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := func() string {
+		t.Helper()
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	write := func(entry string) {
+		t.Helper()
+		if _, err := w.Write([]byte(entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("first\n")
+	if got := written(); got != "" || mem.held != 6 {
+		t.Fatalf("within the budget: wrote %q, held %d; want the entry held", got, mem.held)
+	}
+	// An entry over the budget is written right away, with the batch.
+	write("second\n")
+	if got := written(); got != "first\nsecond\n" || mem.held != 0 {
+		t.Errorf("over the budget: wrote %q, held %d; want both entries written", got, mem.held)
+	}
+	write("third\n")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := written(); got != "first\nsecond\nthird\n" || mem.held != 0 {
+		t.Errorf("after close: wrote %q, held %d", got, mem.held)
+	}
+}
@@ -0,0 +1,185 @@
+package logsink
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Rotation is how output files are rotated.
+type Rotation string
+
+const (
+	RotateSize   Rotation = "size"
+	RotateHourly Rotation = "hourly"
+	RotateDaily  Rotation = "daily"
+)
+
+// defaultTemplates are appended to file names without strftime directives.
+var defaultTemplates = map[Rotation]string{
+	RotateHourly: "-%Y%m%d%H",
+	RotateDaily:  "-%Y%m%d",
+}
+
+// timedFile writes to a file named by a strftime-style template and starts a
+// new one at every hour or day boundary.
+type timedFile struct {
+	cfg      Config
+	template string
+	loc      *time.Location
+
+	file   *os.File
+	enc    encoder
+	period time.Time
+}
+
+func newTimedFile(cfg Config) *timedFile {
+	template := cfg.Output
+	if !strings.Contains(template, "%") {
+		ext := filepath.Ext(template)
+		template = strings.TrimSuffix(template, ext) + defaultTemplates[cfg.Rotation] + ext
+	}
+	template += cfg.Compression.Extension()
+	loc := time.UTC
+	if cfg.LocalTime {
+		loc = time.Local
+	}
+	return &timedFile{cfg: cfg, template: template, loc: loc}
+}
+
+func openTimedFile(cfg Config) (io.WriteCloser, error) {
+	f := newTimedFile(cfg)
+	if err := f.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return newFlusher(f, cfg), nil
+}
+
+// periodStart truncates t to the start of its hour or day.
+func (f *timedFile) periodStart(t time.Time) time.Time {
+	t = t.In(f.loc)
+	hour := t.Hour()
+	if f.cfg.Rotation == RotateDaily {
+		hour = 0
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), hour, 0, 0, 0, f.loc)
+}
+
+func (f *timedFile) open(now time.Time) error {
+	f.period = f.periodStart(now)
+	name := Strftime(f.template, f.period)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return oops.In("logsink").Code(errcode.WriteFailed).With("output", name).Wrapf(err, "failed to create log directory")
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return oops.In("logsink").Code(errcode.WriteFailed).With("output", name).Wrapf(err, "failed to open log output")
+	}
+	f.file, f.enc = file, nil
+	if f.cfg.Compression != CompressionNone && f.cfg.Compression != "" {
+		if f.enc, err = newEncoder(f.cfg.Compression, file); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	prune(f.cfg, Strftime(f.template, time.Time{}, "*"), name)
+	return nil
+}
+
+func (f *timedFile) write(p []byte) (int, error) {
+	if now := time.Now(); !f.periodStart(now).Equal(f.period) {
+		completed := f.file.Name()
+		if err := f.close(); err != nil {
+			return 0, err
+		}
+		if f.cfg.OnRotate != nil {
+			f.cfg.OnRotate(completed)
+		}
+		if err := f.open(now); err != nil {
+			return 0, err
+		}
+	}
+	if f.enc != nil {
+		return f.enc.Write(p)
+	}
+	return f.file.Write(p)
+}
+
+func (f *timedFile) flush() error {
+	if f.enc != nil {
+		return f.enc.Flush()
+	}
+	return nil
+}
+
+func (f *timedFile) sync() error {
+	return oops.In("logsink").Code(errcode.WriteFailed).With("output", f.file.Name()).Wrap(f.file.Sync())
+}
+
+func (f *timedFile) close() error {
+	var err error
+	if f.enc != nil {
+		err = f.enc.Close()
+	}
+	return oops.In("logsink").Code(errcode.WriteFailed).Wrap(oops.Join(err, f.file.Close()))
+}
+
+// Strftime formats t using the directives %Y %y %m %d %j %H %M %S and %%.
+// If wildcard is given, every directive is replaced with it instead, which
+// turns a template into a glob pattern.
+func Strftime(template string, t time.Time, wildcard ...string) string {
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '%' || i+1 == len(template) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		d := template[i]
+		if d == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		if len(wildcard) > 0 {
+			b.WriteString(wildcard[0])
+			continue
+		}
+		switch d {
+		case 'Y':
+			b.WriteString(strconv.Itoa(t.Year()))
+		case 'y':
+			b.WriteString(pad(t.Year()%100, 2))
+		case 'm':
+			b.WriteString(pad(int(t.Month()), 2))
+		case 'd':
+			b.WriteString(pad(t.Day(), 2))
+		case 'j':
+			b.WriteString(pad(t.YearDay(), 3))
+		case 'H':
+			b.WriteString(pad(t.Hour(), 2))
+		case 'M':
+			b.WriteString(pad(t.Minute(), 2))
+		case 'S':
+			b.WriteString(pad(t.Second(), 2))
+		default:
+			b.WriteByte('%')
+			b.WriteByte(d)
+		}
+	}
+	return b.String()
+}
+
+func pad(n, width int) string {
+	s := strconv.Itoa(n)
+	for len(s) < width {
+		s = "0" + s
+	}
+	return s
+}
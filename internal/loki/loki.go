@@ -0,0 +1,327 @@
+// Package loki ships log lines to a Grafana Loki push endpoint in batches,
+// buffering them in a bounded queue that drops lines while Loki is
+// unreachable rather than blocking the writer.
+package loki
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/logsink"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+var (
+	entriesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_entries_sent_total",
+		Help: "Log lines pushed to Loki.",
+	})
+	entriesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "loki_entries_dropped_total",
+		Help: "Log lines not delivered to Loki, by reason (queue_full, memory_budget, rejected or retries_exhausted).",
+	}, []string{"reason"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(entriesSent, entriesDropped)
+}
+
+// pushPath is the Loki push API, appended to a URL without a path.
+const pushPath = "/loki/api/v1/push"
+
+// Config holds Loki push settings.
+type Config struct {
+	// URL is the Loki base URL or its full push URL.
+	URL string
+	// Labels are the stream labels of every line. Values may hold
+	// {hostname}.
+	Labels map[string]string
+	// TenantID, if set, is sent as X-Scope-OrgID for multi-tenant Loki.
+	TenantID string
+	// Username and Password, if set, authenticate with HTTP basic auth.
+	Username string
+	Password string
+	// BatchEntries and BatchInterval bound how many lines a push carries
+	// and how long a line waits for one.
+	BatchEntries  int
+	BatchInterval time.Duration
+	// QueueSize bounds the lines waiting to be pushed; further lines are
+	// dropped.
+	QueueSize int
+	// MaxRetries bounds push attempts after the first one; RetryBackoff is
+	// the initial delay between them, doubled each time up to MaxBackoff.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	// Timeout bounds a single push request.
+	Timeout time.Duration
+	// Compression, gzip or none, encodes push request bodies.
+	Compression logsink.Compression
+	// Memory, if set, accounts queued lines until they are pushed or
+	// dropped; lines it refuses are dropped.
+	Memory logsink.Reserver
+}
+
+// line is a queued log line with its timestamp.
+type line struct {
+	at   time.Time
+	text string
+}
+
+// Sink is an io.WriteCloser pushing each Write, one log line, to Loki.
+type Sink struct {
+	cfg    Config
+	url    string
+	labels map[string]string
+	client *http.Client
+	log    zerolog.Logger
+
+	queue chan line
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// New creates a Sink and starts pushing in the background until Close.
+func New(cfg Config, log zerolog.Logger) (*Sink, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, oops.
+			In("loki").
+			Code(errcode.InvalidEndpoint).
+			With("url", cfg.URL).
+			Errorf("invalid Loki URL %q", cfg.URL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = pushPath
+	}
+	switch cfg.Compression {
+	case "", logsink.CompressionNone, logsink.CompressionGzip:
+	default:
+		return nil, oops.
+			In("loki").
+			Code(errcode.InvalidCompression).
+			With("compression", cfg.Compression).
+			Errorf("Loki push bodies can only be gzip compressed, not %q", cfg.Compression)
+	}
+	hostname, _ := os.Hostname()
+	labels := make(map[string]string, len(cfg.Labels))
+	for name, value := range cfg.Labels {
+		labels[name] = strings.ReplaceAll(value, "{hostname}", hostname)
+	}
+	cfg.BatchEntries = max(cfg.BatchEntries, 1)
+	if cfg.BatchInterval <= 0 {
+		cfg.BatchInterval = time.Second
+	}
+	cfg.MaxBackoff = max(cfg.MaxBackoff, cfg.RetryBackoff)
+	s := &Sink{
+		cfg:    cfg,
+		url:    u.String(),
+		labels: labels,
+		client: httpclient.New("loki", cfg.Timeout),
+		log:    log.With().Str("component", "loki").Str("url", u.Redacted()).Logger(),
+		queue:  make(chan line, max(cfg.QueueSize, cfg.BatchEntries)),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Write queues p, a log line. It never blocks: with a full queue or memory
+// budget the line is dropped and counted.
+func (s *Sink) Write(p []byte) (int, error) {
+	text := string(bytes.TrimRight(p, "\n"))
+	if s.cfg.Memory != nil && !s.cfg.Memory.Reserve(int64(len(text))) {
+		entriesDropped.WithLabelValues("memory_budget").Inc()
+		return len(p), nil
+	}
+	select {
+	case s.queue <- line{at: time.Now(), text: text}:
+	default:
+		s.release([]line{{text: text}})
+		entriesDropped.WithLabelValues("queue_full").Inc()
+	}
+	return len(p), nil
+}
+
+// release returns the memory of lines that left the queue.
+func (s *Sink) release(lines []line) {
+	if s.cfg.Memory == nil {
+		return
+	}
+	var n int64
+	for _, l := range lines {
+		n += int64(len(l.text))
+	}
+	s.cfg.Memory.Release(n)
+}
+
+// Depth returns the number of lines waiting in the queue.
+func (s *Sink) Depth() int {
+	return len(s.queue)
+}
+
+// Close pushes the queued lines, with a single attempt, and stops.
+func (s *Sink) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+	return nil
+}
+
+// run collects batches and pushes them.
+func (s *Sink) run() {
+	defer close(s.done)
+	batch := make([]line, 0, s.cfg.BatchEntries)
+	ticker := time.NewTicker(s.cfg.BatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case l := <-s.queue:
+			batch = append(batch, l)
+			if len(batch) < s.cfg.BatchEntries {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-s.stop:
+			s.drain(batch)
+			return
+		}
+		s.push(batch, true)
+		batch = batch[:0]
+	}
+}
+
+// drain pushes batch and the queued lines with single attempts.
+func (s *Sink) drain(batch []line) {
+	for {
+		select {
+		case l := <-s.queue:
+			if batch = append(batch, l); len(batch) == s.cfg.BatchEntries {
+				s.push(batch, false)
+				batch = batch[:0]
+			}
+		default:
+			if len(batch) > 0 {
+				s.push(batch, false)
+			}
+			return
+		}
+	}
+}
+
+// push sends batch, retrying failed attempts with backoff if retry is set
+// and the sink is not stopping. Undelivered lines are dropped and counted.
+func (s *Sink) push(batch []line, retry bool) {
+	defer s.release(batch)
+	body, err := s.encode(batch)
+	if err != nil {
+		s.log.Error().Err(err).Int("entries", len(batch)).Msg("failed to encode Loki push")
+		entriesDropped.WithLabelValues("rejected").Add(float64(len(batch)))
+		return
+	}
+	backoff := s.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retryable, err := s.send(body)
+		if err == nil {
+			entriesSent.Add(float64(len(batch)))
+			return
+		}
+		if !retryable {
+			s.log.Error().Err(err).Int("entries", len(batch)).Msg("Loki rejected log lines, dropping them")
+			entriesDropped.WithLabelValues("rejected").Add(float64(len(batch)))
+			return
+		}
+		if !retry || attempt >= s.cfg.MaxRetries {
+			s.log.Error().Err(err).Int("entries", len(batch)).Msg("giving up pushing log lines to Loki")
+			entriesDropped.WithLabelValues("retries_exhausted").Add(float64(len(batch)))
+			return
+		}
+		s.log.Warn().Err(err).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("Loki push failed, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+			retry = false
+		}
+		backoff = min(backoff*2, s.cfg.MaxBackoff)
+	}
+}
+
+// pushRequest is the JSON body of the push API.
+type pushRequest struct {
+	Streams []pushStream `json:"streams"`
+}
+
+type pushStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (s *Sink) encode(batch []line) ([]byte, error) {
+	stream := pushStream{Stream: s.labels, Values: make([][2]string, len(batch))}
+	for i, l := range batch {
+		stream.Values[i] = [2]string{strconv.FormatInt(l.at.UnixNano(), 10), l.text}
+	}
+	body, err := json.Marshal(pushRequest{Streams: []pushStream{stream}})
+	if err != nil {
+		return nil, oops.In("loki").Code(errcode.WriteFailed).Wrapf(err, "failed to encode push request")
+	}
+	return logsink.CompressBatch(s.cfg.Compression, body)
+}
+
+// send posts body once. Failures are retryable unless Loki rejected the
+// lines themselves with a 4xx status other than 429.
+func (s *Sink) send(body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, oops.In("loki").Code(errcode.InvalidEndpoint).Wrap(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if encoding := s.cfg.Compression.ContentEncoding(); encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if s.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.cfg.TenantID)
+	}
+	if s.cfg.Username != "" || s.cfg.Password != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, oops.In("loki").Code(errcode.APIRequestFailed).Wrapf(err, "Loki push failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, oops.
+		In("loki").
+		Code(errcode.APIRequestFailed).
+		With("status", resp.StatusCode).
+		Errorf("Loki push answered %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+// Ensure Sink implements io.WriteCloser.
+var _ io.WriteCloser = (*Sink)(nil)
@@ -0,0 +1,194 @@
+package loki
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/logsink"
+	"github.com/rs/zerolog"
+)
+
+func TestSinkPushesBatches(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+		lines    []string
+		labels   map[string]string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "ingester unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != pushPath || r.Header.Get("X-Scope-OrgID") != "team-a" || r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("push to %s with tenant %q, encoding %q", r.URL.Path, r.Header.Get("X-Scope-OrgID"), r.Header.Get("Content-Encoding"))
+		}
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req pushRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		for _, stream := range req.Streams {
+			labels = stream.Stream
+			for _, v := range stream.Values {
+				lines = append(lines, v[1])
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := New(Config{
+		URL:           server.URL,
+		Labels:        map[string]string{"service": "accesslog", "env": "test"},
+		TenantID:      "team-a",
+		BatchEntries:  2,
+		BatchInterval: time.Hour,
+		QueueSize:     10,
+		MaxRetries:    3,
+		RetryBackoff:  time.Millisecond,
+		Timeout:       time.Second,
+		Compression:   logsink.CompressionGzip,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(l string) {
+		if _, err := sink.Write([]byte(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("first\n")
+	write("second\n")
+	// The full batch is pushed, and retried, in the background.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(lines)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("batch not pushed")
+		}
+	}
+	// The partial batch is pushed on Close.
+	write("third\n")
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"first", "second", "third"}; len(lines) != len(want) || lines[0] != want[0] || lines[1] != want[1] || lines[2] != want[2] {
+		t.Errorf("pushed %q, want %q", lines, want)
+	}
+	if labels["service"] != "accesslog" || labels["env"] != "test" {
+		t.Errorf("labels = %v", labels)
+	}
+	if attempts != 3 {
+		t.Errorf("%d push attempts, want 3 (one retried)", attempts)
+	}
+}
+
+// budget is a logsink.Reserver of limit bytes.
+type budget struct {
+	mu          sync.Mutex
+	limit, held int64
+}
+
+func (b *budget) Reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.held+n > b.limit {
+		return false
+	}
+	b.held += n
+	return true
+}
+
+func (b *budget) Release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.held -= n
+}
+
+func (b *budget) Held() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.held
+}
+
+func TestSinkMemory(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req pushRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, stream := range req.Streams {
+			for _, v := range stream.Values {
+				lines = append(lines, v[1])
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	mem := &budget{limit: 10}
+	sink, err := New(Config{
+		URL:           server.URL,
+		BatchEntries:  10,
+		BatchInterval: time.Hour,
+		QueueSize:     10,
+		Timeout:       time.Second,
+		Memory:        mem,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{"0123456789\n", "refused\n"} {
+		if _, err := sink.Write([]byte(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if held := mem.Held(); held != 10 {
+		t.Errorf("queue holds %d bytes, want 10", held)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) != 1 || lines[0] != "0123456789" {
+		t.Errorf("pushed %q, want only the line within the budget", lines)
+	}
+	if held := mem.Held(); held != 0 {
+		t.Errorf("%d bytes still held after the push", held)
+	}
+}
+
+func TestNewRejectsInvalidURL(t *testing.T) {
+	for _, u := range []string{"", "loki:3100", "ftp://loki"} {
+		if _, err := New(Config{URL: u}, zerolog.Nop()); err == nil {
+			t.Errorf("New(%q) succeeded", u)
+		}
+	}
+}
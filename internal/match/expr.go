@@ -0,0 +1,71 @@
+package match
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("host", cel.StringType),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("method", cel.StringType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("ip", cel.StringType),
+	)
+})
+
+// program is a compiled CEL expression.
+type program struct {
+	prg cel.Program
+}
+
+func compileExpr(expr string) (*program, error) {
+	env, err := celEnv()
+	if err != nil {
+		return nil, oops.In("match").Code(errcode.InvalidMatch).Wrap(err)
+	}
+	ast, issues := env.Compile(expr)
+	if issues.Err() != nil {
+		return nil, oops.In("match").Code(errcode.InvalidMatch).With("expr", expr).Wrapf(issues.Err(), "invalid expr")
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, oops.In("match").Code(errcode.InvalidMatch).With("expr", expr).Errorf("expr must evaluate to a bool, not %s", ast.OutputType())
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, oops.In("match").Code(errcode.InvalidMatch).With("expr", expr).Wrap(err)
+	}
+	return &program{prg: prg}, nil
+}
+
+// eval runs the expression; evaluation errors, such as a missing header
+// key, do not match.
+func (p *program) eval(req Request) bool {
+	headers := make(map[string]string, len(req.Headers))
+	for name, values := range req.Headers {
+		if len(values) > 0 {
+			headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	var ip string
+	if req.IP.IsValid() {
+		ip = req.IP.Unmap().String()
+	}
+	out, _, err := p.prg.Eval(map[string]any{
+		"host":    req.Host,
+		"path":    req.Path,
+		"method":  req.Method,
+		"headers": headers,
+		"ip":      ip,
+	})
+	if err != nil {
+		return false
+	}
+	matched, _ := out.Value().(bool)
+	return matched
+}
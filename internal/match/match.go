@@ -0,0 +1,232 @@
+// Package match implements the request matching syntax shared by processor
+// configuration files: host globs, path prefixes and regular expressions,
+// methods, header predicates, client IP ranges and, for anything else, a CEL
+// expression.
+//
+//	match:
+//	  hosts: ["*.example.com"]
+//	  paths: ["/api/"]
+//	  path_regex: "^/api/v[0-9]+/admin"
+//	  methods: [POST, PUT]
+//	  headers:
+//	    - {name: x-env, value: prod}
+//	    - {name: x-debug, present: false}
+//	  ips: [10.0.0.0/8, 2001:db8::/32]
+//	  expr: 'headers["x-tier"] == "gold" || ip.startsWith("192.168.")'
+//
+// Every condition that is set must hold; a list matches if any entry does.
+// An empty Spec matches every request.
+package match
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Request is the view of a request that matchers inspect.
+type Request struct {
+	// Host is lowercase and without port.
+	Host string
+	// Path excludes the query string.
+	Path    string
+	Method  string
+	Headers http.Header
+	// IP is the client address; the zero Addr matches no IP range.
+	IP netip.Addr
+}
+
+// NewRequest builds a Request from ext_proc request headers, which carry the
+// :authority, :path and :method pseudo-headers, and the client address.
+func NewRequest(headers http.Header, ip netip.Addr) Request {
+	p, _, _ := strings.Cut(headers.Get(":path"), "?")
+	return Request{
+		Host:    NormalizeHost(headers.Get(":authority")),
+		Path:    p,
+		Method:  headers.Get(":method"),
+		Headers: headers,
+		IP:      ip,
+	}
+}
+
+// NormalizeHost lowercases host and strips its port.
+func NormalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// Spec is the configuration syntax of a Matcher.
+type Spec struct {
+	// Hosts are globs (path.Match syntax), e.g. "*.example.com".
+	Hosts []string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	// Paths are path prefixes.
+	Paths []string `yaml:"paths,omitempty" json:"paths,omitempty"`
+	// PathRegex is a regular expression the path must match.
+	PathRegex string   `yaml:"path_regex,omitempty" json:"path_regex,omitempty"`
+	Methods   []string `yaml:"methods,omitempty" json:"methods,omitempty"`
+	// Headers must all hold.
+	Headers []HeaderSpec `yaml:"headers,omitempty" json:"headers,omitempty"`
+	// IPs are client addresses or CIDR ranges.
+	IPs []string `yaml:"ips,omitempty" json:"ips,omitempty"`
+	// Expr is a CEL expression over host, path, method, headers (first
+	// values, lowercase names) and ip, which must evaluate to a bool.
+	Expr string `yaml:"expr,omitempty" json:"expr,omitempty"`
+}
+
+// HeaderSpec is a predicate on a request header. With only Name set, the
+// header must be present.
+type HeaderSpec struct {
+	Name string `yaml:"name" json:"name"`
+	// Value is the exact value required.
+	Value string `yaml:"value,omitempty" json:"value,omitempty"`
+	// Regex is a regular expression the value must match.
+	Regex string `yaml:"regex,omitempty" json:"regex,omitempty"`
+	// Present, when false, requires the header to be absent.
+	Present *bool `yaml:"present,omitempty" json:"present,omitempty"`
+}
+
+// Matcher is a compiled Spec. A nil Matcher matches every request.
+type Matcher struct {
+	hosts     []string
+	paths     []string
+	pathRegex *regexp.Regexp
+	methods   []string
+	headers   []header
+	prefixes  []netip.Prefix
+	expr      *program
+}
+
+type header struct {
+	name    string
+	value   string
+	regex   *regexp.Regexp
+	present bool
+}
+
+// Compile validates spec and compiles it.
+func Compile(spec Spec) (*Matcher, error) {
+	m := &Matcher{paths: spec.Paths}
+	for _, h := range spec.Hosts {
+		h = strings.ToLower(h)
+		if _, err := path.Match(h, ""); err != nil {
+			return nil, oops.In("match").Code(errcode.InvalidMatch).With("host", h).Wrapf(err, "invalid host pattern %q", h)
+		}
+		m.hosts = append(m.hosts, h)
+	}
+	if spec.PathRegex != "" {
+		re, err := regexp.Compile(spec.PathRegex)
+		if err != nil {
+			return nil, oops.In("match").Code(errcode.InvalidMatch).Wrapf(err, "invalid path_regex")
+		}
+		m.pathRegex = re
+	}
+	for _, method := range spec.Methods {
+		m.methods = append(m.methods, strings.ToUpper(method))
+	}
+	for _, h := range spec.Headers {
+		if h.Name == "" {
+			return nil, oops.In("match").Code(errcode.InvalidMatch).Errorf("header predicate needs a name")
+		}
+		compiled := header{name: h.Name, value: h.Value, present: h.Present == nil || *h.Present}
+		if !compiled.present && (h.Value != "" || h.Regex != "") {
+			return nil, oops.In("match").Code(errcode.InvalidMatch).With("header", h.Name).Errorf("header %q: present: false excludes value and regex", h.Name)
+		}
+		if h.Regex != "" {
+			re, err := regexp.Compile(h.Regex)
+			if err != nil {
+				return nil, oops.In("match").Code(errcode.InvalidMatch).With("header", h.Name).Wrapf(err, "invalid regex of header %q", h.Name)
+			}
+			compiled.regex = re
+		}
+		m.headers = append(m.headers, compiled)
+	}
+	for _, s := range spec.IPs {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		m.prefixes = append(m.prefixes, prefix)
+	}
+	if spec.Expr != "" {
+		prg, err := compileExpr(spec.Expr)
+		if err != nil {
+			return nil, err
+		}
+		m.expr = prg
+	}
+	return m, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, oops.In("match").Code(errcode.InvalidMatch).Wrapf(err, "invalid IP range %q", s)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, oops.In("match").Code(errcode.InvalidMatch).Wrapf(err, "invalid IP address %q", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Match reports whether req satisfies every condition.
+func (m *Matcher) Match(req Request) bool {
+	if m == nil {
+		return true
+	}
+	if len(m.hosts) > 0 && !slices.ContainsFunc(m.hosts, func(pattern string) bool {
+		matched, _ := path.Match(pattern, req.Host)
+		return matched
+	}) {
+		return false
+	}
+	if len(m.paths) > 0 && !slices.ContainsFunc(m.paths, func(prefix string) bool { return strings.HasPrefix(req.Path, prefix) }) {
+		return false
+	}
+	if m.pathRegex != nil && !m.pathRegex.MatchString(req.Path) {
+		return false
+	}
+	if len(m.methods) > 0 && !slices.Contains(m.methods, req.Method) {
+		return false
+	}
+	for _, h := range m.headers {
+		if !h.match(req.Headers) {
+			return false
+		}
+	}
+	if len(m.prefixes) > 0 {
+		ip := req.IP.Unmap()
+		if !slices.ContainsFunc(m.prefixes, func(p netip.Prefix) bool { return p.Contains(ip) }) {
+			return false
+		}
+	}
+	return m.expr == nil || m.expr.eval(req)
+}
+
+func (h *header) match(headers http.Header) bool {
+	values := headers.Values(h.name)
+	if !h.present {
+		return len(values) == 0
+	}
+	if len(values) == 0 {
+		return false
+	}
+	if h.value == "" && h.regex == nil {
+		return true
+	}
+	return slices.ContainsFunc(values, func(v string) bool {
+		return (h.value == "" || v == h.value) && (h.regex == nil || h.regex.MatchString(v))
+	})
+}
@@ -0,0 +1,80 @@
+package match
+
+import (
+	"path"
+	"strings"
+)
+
+// NormalizePath returns the path of target, a :path header, in the form
+// policy compares against: without query or fragment, with percent-encoded
+// unreserved characters decoded and with repeated slashes and dot segments
+// resolved. A trailing slash is kept. Without it, /%61dmin, //admin and
+// /public/../admin would each escape a rule written for /admin.
+func NormalizePath(target string) string {
+	p, _, _ := strings.Cut(target, "?")
+	p, _, _ = strings.Cut(p, "#")
+	p = decodeUnreserved(p)
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// PathPrefix reports whether path is prefix or below it, matching whole
+// segments: /admin covers /admin and /admin/users but not /administrators.
+// A prefix ending in "/" matches only below it.
+func PathPrefix(path, prefix string) bool {
+	if !strings.HasSuffix(prefix, "/") {
+		if path == prefix {
+			return true
+		}
+		prefix += "/"
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+// decodeUnreserved decodes the percent-encoded unreserved characters of p
+// (RFC 3986, section 2.3), which mean the same encoded or not. Other escapes,
+// such as %2F, are kept.
+func decodeUnreserved(p string) string {
+	if !strings.Contains(p, "%") {
+		return p
+	}
+	var b strings.Builder
+	b.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		if p[i] == '%' && i+2 < len(p) {
+			if c, ok := unhex(p[i+1], p[i+2]); ok && unreserved(c) {
+				b.WriteByte(c)
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+func unhex(hi, lo byte) (byte, bool) {
+	h, ok1 := hexValue(hi)
+	l, ok2 := hexValue(lo)
+	return h<<4 | l, ok1 && ok2
+}
+
+func hexValue(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
@@ -0,0 +1,221 @@
+// Package pathtemplate normalizes request paths into route templates such as
+// /users/{id}, keeping metric label and log field cardinality bounded.
+package pathtemplate
+
+import (
+	"cmp"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+)
+
+// Overflow is returned for new templates once MaxTemplates is reached.
+const Overflow = "{other}"
+
+var (
+	uuidSegment = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment  = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	numSegment  = regexp.MustCompile(`^\d+$`)
+	tokenDigit  = regexp.MustCompile(`\d`)
+)
+
+// Config holds path templating settings.
+type Config struct {
+	// Patterns are route templates like "/users/{id}/orders/{order}"; each
+	// "{name}" matches one non-empty segment.
+	Patterns []string
+	// OpenAPIFile, if set, adds every path of an OpenAPI (JSON or YAML)
+	// document as a pattern.
+	OpenAPIFile string
+	// Heuristics replaces numeric, UUID, long hex and token-like segments of
+	// unmatched paths with "{id}".
+	Heuristics bool
+	// MaxTemplates caps distinct templates; later ones become Overflow.
+	// Zero disables the cap.
+	MaxTemplates int
+}
+
+type pattern struct {
+	template string
+	segments []string
+	literals int
+}
+
+// Templater maps request paths to templates. It is safe for concurrent use.
+type Templater struct {
+	patterns   []pattern
+	heuristics bool
+	max        int
+
+	mu   sync.RWMutex
+	seen map[string]struct{}
+}
+
+// New creates a Templater from cfg.
+func New(cfg Config) (*Templater, error) {
+	patterns := slices.Clone(cfg.Patterns)
+	if cfg.OpenAPIFile != "" {
+		paths, err := LoadOpenAPIPaths(cfg.OpenAPIFile)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, paths...)
+	}
+
+	t := &Templater{
+		heuristics: cfg.Heuristics,
+		max:        cfg.MaxTemplates,
+		seen:       make(map[string]struct{}),
+	}
+	for _, p := range patterns {
+		if !strings.HasPrefix(p, "/") {
+			return nil, oops.
+				In("pathtemplate").
+				Code(errcode.InvalidPattern).
+				With("pattern", p).
+				Errorf("path pattern must start with '/'")
+		}
+		segments := split(p)
+		literals := 0
+		for _, s := range segments {
+			if !isParam(s) {
+				literals++
+			}
+		}
+		t.patterns = append(t.patterns, pattern{template: p, segments: segments, literals: literals})
+	}
+	// Prefer the most specific pattern, i.e. the one with most literals.
+	slices.SortStableFunc(t.patterns, func(a, b pattern) int {
+		return cmp.Compare(b.literals, a.literals)
+	})
+	return t, nil
+}
+
+// LoadOpenAPIPaths returns the keys of the "paths" object of an OpenAPI
+// document.
+func LoadOpenAPIPaths(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, oops.
+			In("pathtemplate").
+			Code(errcode.ReadOpenAPIFailed).
+			With("path", file).
+			Wrapf(err, "failed to read OpenAPI document")
+	}
+	var doc struct {
+		Paths map[string]any `yaml:"paths"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, oops.
+			In("pathtemplate").
+			Code(errcode.ParseOpenAPIFailed).
+			With("path", file).
+			Wrapf(err, "failed to parse OpenAPI document")
+	}
+	paths := make([]string, 0, len(doc.Paths))
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	return paths, nil
+}
+
+// Template returns the template for path, ignoring any query string.
+func (t *Templater) Template(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	if path == "" {
+		path = "/"
+	}
+	segments := split(path)
+
+	template := ""
+	for _, p := range t.patterns {
+		if matches(p.segments, segments) {
+			template = p.template
+			break
+		}
+	}
+	if template == "" {
+		if t.heuristics {
+			for i, s := range segments {
+				if looksLikeID(s) {
+					segments[i] = "{id}"
+				}
+			}
+			template = "/" + strings.Join(segments, "/")
+		} else {
+			template = path
+		}
+	}
+	return t.admit(template)
+}
+
+// admit enforces the template cap.
+func (t *Templater) admit(template string) string {
+	if t.max <= 0 {
+		return template
+	}
+	t.mu.RLock()
+	_, ok := t.seen[template]
+	full := len(t.seen) >= t.max
+	t.mu.RUnlock()
+	if ok {
+		return template
+	}
+	if full {
+		return Overflow
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.seen) >= t.max {
+		return Overflow
+	}
+	t.seen[template] = struct{}{}
+	return template
+}
+
+func matches(pattern, segments []string) bool {
+	if len(pattern) != len(segments) {
+		return false
+	}
+	for i, p := range pattern {
+		if isParam(p) {
+			if segments[i] == "" {
+				return false
+			}
+		} else if p != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func looksLikeID(s string) bool {
+	return numSegment.MatchString(s) ||
+		uuidSegment.MatchString(s) ||
+		hexSegment.MatchString(s) ||
+		(len(s) >= 24 && tokenDigit.MatchString(s)) ||
+		isAddr(s)
+}
+
+// isAddr reports whether s is an IP address, which must not end up in a
+// metric label.
+func isAddr(s string) bool {
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+func isParam(s string) bool {
+	return strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}")
+}
+
+func split(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
@@ -0,0 +1,232 @@
+// Package policy reconciles ExtProcPolicy custom resources into a running
+// extproc.Mux, so per-route processor settings can be managed declaratively
+// in Kubernetes.
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// Group, Version and Resource identify the ExtProcPolicy API.
+const (
+	Group    = "envoy-ext-procs.mnixry.io"
+	Version  = "v1alpha1"
+	Resource = "extprocpolicies"
+)
+
+var (
+	policyRoutes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "policy_controller_routes",
+		Help: "Routes currently configured from ExtProcPolicy resources.",
+	})
+	policyErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "policy_controller_rejected_total",
+		Help: "ExtProcPolicy resources rejected during reconciliation, by reason (invalid or conflict).",
+	}, []string{"reason"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(policyRoutes, policyErrors)
+}
+
+// Policy is an ExtProcPolicy resource.
+type Policy struct {
+	Metadata struct {
+		Namespace         string    `json:"namespace"`
+		Name              string    `json:"name"`
+		Generation        int64     `json:"generation"`
+		CreationTimestamp time.Time `json:"creationTimestamp"`
+	} `json:"metadata"`
+	Spec Spec `json:"spec"`
+}
+
+// Spec is the desired configuration of a policy.
+type Spec struct {
+	// Processor is the processor the policy targets, e.g. "accesslog"; other
+	// processors ignore it.
+	Processor string `json:"processor"`
+	// Routes are the --grpc-route-key values (by default the :authority of
+	// the ext_proc stream) the settings apply to.
+	Routes []string `json:"routes"`
+	// Settings are processor specific.
+	Settings json.RawMessage `json:"settings,omitempty"`
+}
+
+func (p *Policy) key() string {
+	return p.Metadata.Namespace + "/" + p.Metadata.Name
+}
+
+// Builder creates the factory for a policy's settings.
+type Builder func(settings json.RawMessage) (extproc.ProcessorFactory, error)
+
+// Config holds controller settings.
+type Config struct {
+	// Processor selects the policies to apply.
+	Processor string
+	// Namespace restricts watched policies; empty watches all namespaces.
+	Namespace string
+}
+
+// applied is a route currently served by a policy.
+type applied struct {
+	policy     string
+	generation int64
+	factory    extproc.ProcessorFactory
+	settings   json.RawMessage
+}
+
+// Controller watches ExtProcPolicy resources and registers their routes on a
+// Mux. Routes registered on the Mux by other means are restored when the
+// policy overriding them goes away.
+type Controller struct {
+	cfg    Config
+	client *kube.Client
+	mux    *extproc.Mux
+	build  Builder
+	log    zerolog.Logger
+
+	// Only touched by the watch goroutine.
+	routes   map[string]applied
+	previous map[string]extproc.ProcessorFactory
+}
+
+// New creates a Controller from the pod's service account.
+func New(cfg Config, mux *extproc.Mux, build Builder, log zerolog.Logger) (*Controller, error) {
+	client, err := kube.NewInCluster(10 * time.Second)
+	if err != nil {
+		return nil, oops.In("policy").Wrap(err)
+	}
+	return &Controller{
+		cfg:      cfg,
+		client:   client,
+		mux:      mux,
+		build:    build,
+		log:      log.With().Str("component", "policy_controller").Str("processor", cfg.Processor).Logger(),
+		routes:   make(map[string]applied),
+		previous: make(map[string]extproc.ProcessorFactory),
+	}, nil
+}
+
+// Run reconciles until ctx is done.
+func (c *Controller) Run(ctx context.Context) {
+	path := "/apis/" + Group + "/" + Version + "/" + Resource
+	if c.cfg.Namespace != "" {
+		path = "/apis/" + Group + "/" + Version + "/namespaces/" + url.PathEscape(c.cfg.Namespace) + "/" + Resource
+	}
+	c.client.WatchList(ctx, path, c.log, c.reconcile)
+}
+
+// reconcile brings the Mux in line with items. When several policies claim
+// a route, the oldest wins.
+func (c *Controller) reconcile(items []json.RawMessage) {
+	policies := make([]*Policy, 0, len(items))
+	for _, item := range items {
+		var p Policy
+		if err := json.Unmarshal(item, &p); err != nil {
+			policyErrors.WithLabelValues("invalid").Inc()
+			c.log.Error().Err(err).Msg("failed to decode ExtProcPolicy")
+			continue
+		}
+		if p.Spec.Processor == c.cfg.Processor {
+			policies = append(policies, &p)
+		}
+	}
+	slices.SortFunc(policies, func(a, b *Policy) int {
+		if n := a.Metadata.CreationTimestamp.Compare(b.Metadata.CreationTimestamp); n != 0 {
+			return n
+		}
+		return strings.Compare(a.key(), b.key())
+	})
+
+	desired := make(map[string]applied)
+	for _, p := range policies {
+		want, ok := c.factory(p)
+		if !ok {
+			continue
+		}
+		for _, route := range p.Spec.Routes {
+			route = strings.ToLower(route)
+			if owner, taken := desired[route]; taken {
+				policyErrors.WithLabelValues("conflict").Inc()
+				c.log.Warn().
+					Str("policy", p.key()).
+					Str("route", route).
+					Str("owner", owner.policy).
+					Msg("route already claimed by an older ExtProcPolicy, ignoring")
+				continue
+			}
+			desired[route] = want
+		}
+	}
+
+	for route, want := range desired {
+		have, ok := c.routes[route]
+		if ok && have.policy == want.policy && have.generation == want.generation {
+			continue
+		}
+		if !ok {
+			if factory, exists := c.mux.Route(route); exists {
+				c.previous[route] = factory
+			}
+		}
+		c.mux.Handle(route, want.factory)
+		c.routes[route] = want
+		audit.Record("policy-route:"+route, audit.Trigger{Source: "kubernetes", Actor: want.policy, Version: strconv.FormatInt(want.generation, 10)}, []byte(want.settings))
+		c.log.Info().Str("route", route).Str("policy", want.policy).Int64("generation", want.generation).Msg("policy route applied")
+	}
+	for route, have := range c.routes {
+		if _, ok := desired[route]; ok {
+			continue
+		}
+		if factory, ok := c.previous[route]; ok {
+			c.mux.Handle(route, factory)
+			delete(c.previous, route)
+		} else {
+			c.mux.Remove(route)
+		}
+		delete(c.routes, route)
+		c.log.Info().Str("route", route).Str("policy", have.policy).Msg("policy route removed")
+		audit.Record("policy-route:"+route, audit.Trigger{Source: "kubernetes", Actor: have.policy}, []byte(nil))
+	}
+	policyRoutes.Set(float64(len(c.routes)))
+}
+
+// factory returns the factory for p with the generation and settings it
+// was built from, reusing the applied one when the policy is unchanged.
+// Invalid updates keep the previous generation, if any.
+func (c *Controller) factory(p *Policy) (applied, bool) {
+	var previous *applied
+	for _, a := range c.routes {
+		if a.policy != p.key() {
+			continue
+		}
+		if a.generation == p.Metadata.Generation {
+			return a, true
+		}
+		previous = &a
+	}
+	factory, err := c.build(p.Spec.Settings)
+	if err != nil {
+		policyErrors.WithLabelValues("invalid").Inc()
+		c.log.Error().Err(err).Str("policy", p.key()).Int64("generation", p.Metadata.Generation).Msg("invalid ExtProcPolicy settings")
+		if previous == nil {
+			return applied{}, false
+		}
+		return *previous, true
+	}
+	return applied{policy: p.key(), generation: p.Metadata.Generation, factory: factory, settings: p.Spec.Settings}, true
+}
@@ -0,0 +1,125 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+)
+
+// settingsFactory is a factory remembering the settings it was built from.
+type settingsFactory struct {
+	extproc.ProcessorFactory
+	settings string
+}
+
+func build(settings json.RawMessage) (extproc.ProcessorFactory, error) {
+	var s struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(settings, &s); err != nil || s.Name == "" {
+		return nil, fmt.Errorf("invalid settings %s", settings)
+	}
+	return &settingsFactory{settings: s.Name}, nil
+}
+
+func policy(name string, generation int64, created, processor, settings string, routes ...string) json.RawMessage {
+	routesJSON, _ := json.Marshal(routes)
+	return json.RawMessage(fmt.Sprintf(`{
+		"metadata": {"namespace": "default", "name": %q, "generation": %d, "creationTimestamp": %q},
+		"spec": {"processor": %q, "routes": %s, "settings": %s}
+	}`, name, generation, created, processor, routesJSON, settings))
+}
+
+func newTestController(t *testing.T) (*Controller, *extproc.Mux) {
+	t.Helper()
+	mux, err := extproc.NewMux("", &settingsFactory{settings: "fallback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle("static.example.com", &settingsFactory{settings: "static"})
+	return &Controller{
+		cfg:      Config{Processor: "accesslog"},
+		mux:      mux,
+		build:    build,
+		log:      zerolog.Nop(),
+		routes:   make(map[string]applied),
+		previous: make(map[string]extproc.ProcessorFactory),
+	}, mux
+}
+
+// served returns the settings of the factory routed for route, or "" if
+// none is registered.
+func served(mux *extproc.Mux, route string) string {
+	f, ok := mux.Route(route)
+	if !ok {
+		return ""
+	}
+	return f.(*settingsFactory).settings
+}
+
+func TestReconcile(t *testing.T) {
+	c, mux := newTestController(t)
+	const t1, t2 = "2024-01-01T00:00:00Z", "2024-02-01T00:00:00Z"
+
+	// Add: routes are registered, lowercased; other processors' policies
+	// and invalid settings are ignored.
+	c.reconcile([]json.RawMessage{
+		policy("a", 1, t1, "accesslog", `{"name":"a1"}`, "API.example.com", "static.example.com"),
+		policy("other", 1, t1, "ratelimit", `{"name":"x"}`, "other.example.com"),
+		policy("broken", 1, t1, "accesslog", `{}`, "broken.example.com"),
+		json.RawMessage(`not json`),
+	})
+	for route, want := range map[string]string{
+		"api.example.com":    "a1",
+		"static.example.com": "a1",
+		"other.example.com":  "",
+		"broken.example.com": "",
+	} {
+		if got := served(mux, route); got != want {
+			t.Errorf("after add, %s served by %q, want %q", route, got, want)
+		}
+	}
+
+	// Update: a new generation replaces the factory; an invalid one keeps
+	// the previous generation. A newer policy cannot take an older one's
+	// route.
+	c.reconcile([]json.RawMessage{
+		policy("a", 2, t1, "accesslog", `{"name":"a2"}`, "api.example.com", "static.example.com"),
+		policy("b", 1, t2, "accesslog", `{"name":"b1"}`, "api.example.com", "b.example.com"),
+	})
+	for route, want := range map[string]string{"api.example.com": "a2", "static.example.com": "a2", "b.example.com": "b1"} {
+		if got := served(mux, route); got != want {
+			t.Errorf("after update, %s served by %q, want %q", route, got, want)
+		}
+	}
+	c.reconcile([]json.RawMessage{
+		policy("a", 3, t1, "accesslog", `{}`, "api.example.com", "static.example.com"),
+		policy("b", 1, t2, "accesslog", `{"name":"b1"}`, "api.example.com", "b.example.com"),
+	})
+	if got := served(mux, "api.example.com"); got != "a2" {
+		t.Errorf("after invalid update, api.example.com served by %q, want a2", got)
+	}
+
+	// Delete: routes of removed policies are unregistered, and routes they
+	// overrode are restored.
+	c.reconcile([]json.RawMessage{
+		policy("b", 1, t2, "accesslog", `{"name":"b1"}`, "api.example.com", "b.example.com"),
+	})
+	for route, want := range map[string]string{"api.example.com": "b1", "static.example.com": "static", "b.example.com": "b1"} {
+		if got := served(mux, route); got != want {
+			t.Errorf("after delete, %s served by %q, want %q", route, got, want)
+		}
+	}
+	c.reconcile(nil)
+	for route, want := range map[string]string{"api.example.com": "", "static.example.com": "static", "b.example.com": ""} {
+		if got := served(mux, route); got != want {
+			t.Errorf("after deleting all, %s served by %q, want %q", route, got, want)
+		}
+	}
+	if len(c.routes) != 0 || len(c.previous) != 0 {
+		t.Errorf("state left after deleting all: routes %v, previous %v", c.routes, c.previous)
+	}
+}
@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/kvstore"
+	"github.com/samber/oops"
+)
+
+// gcraScript applies the generic cell rate algorithm to the theoretical
+// arrival time (TAT) kept under KEYS[1], in microseconds of the server's
+// clock, so replicas with skewed clocks agree. ARGV holds the emission
+// interval, the period of the limit and the hits. It returns whether the
+// hits were allowed, the TAT after the call and the TAT the hits needed,
+// both relative to now.
+var gcraScript = kvstore.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local emission = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local hits = tonumber(ARGV[3])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local wanted = tat + emission * hits
+local allowed = 0
+if wanted - now <= period then
+	allowed = 1
+	tat = wanted
+	redis.call('SET', KEYS[1], string.format('%d', tat), 'PX', math.max(1, math.ceil((tat - now) / 1000)))
+end
+return {allowed, tat - now, wanted - now}
+`)
+
+// GCRALimiter is a Limiter keeping one timestamp per key in a store that
+// runs scripts, such as Redis, applying the generic cell rate algorithm
+// atomically on the server. It enforces the same limit as a token bucket,
+// exactly, across every replica sharing the store.
+type GCRALimiter struct {
+	store kvstore.Scripter
+}
+
+// NewGCRALimiter creates a GCRALimiter on store, which must support
+// scripts.
+func NewGCRALimiter(store kvstore.Store) (*GCRALimiter, error) {
+	if !kvstore.SupportsScripts(store) {
+		return nil, oops.
+			In("ratelimit").
+			Code(errcode.InvalidDriver).
+			Errorf("the GCRA limiter needs a store supporting scripts, such as redis")
+	}
+	return &GCRALimiter{store: store.(kvstore.Scripter)}, nil
+}
+
+// Allow implements Limiter. Denied hits are not counted.
+func (l *GCRALimiter) Allow(ctx context.Context, key string, limit Limit, hits uint32) (Decision, error) {
+	period := limit.Per.Microseconds()
+	emission := max(1, period/int64(limit.Requests))
+	result, err := l.store.Eval(ctx, gcraScript, []string{key}, emission, period, hits)
+	if err != nil {
+		return Decision{}, oops.In("ratelimit").Wrap(err)
+	}
+	values, ok := result.([]any)
+	if !ok || len(values) != 3 {
+		return Decision{}, unexpectedResult(key, result)
+	}
+	var ints [3]int64
+	for i, v := range values {
+		if ints[i], ok = v.(int64); !ok {
+			return Decision{}, unexpectedResult(key, result)
+		}
+	}
+	allowed, tat, wanted := ints[0] == 1, ints[1], ints[2]
+
+	decision := Decision{
+		Allowed:    allowed,
+		Limit:      limit,
+		Remaining:  uint32(max(0, (period-tat)/emission)),
+		ResetAfter: time.Duration(tat) * time.Microsecond,
+	}
+	if !allowed {
+		decision.RetryAfter = time.Duration(wanted-period) * time.Microsecond
+	}
+	return decision, nil
+}
+
+func unexpectedResult(key string, result any) error {
+	return oops.
+		In("ratelimit").
+		Code(errcode.UnexpectedResponse).
+		With("key", key).
+		Errorf("unexpected GCRA script result %v", result)
+}
+
+// Ensure GCRALimiter implements Limiter.
+var _ Limiter = (*GCRALimiter)(nil)
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mnixry/envoy-ext-procs/internal/kvstore"
+)
+
+func TestGCRALimiter(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.SetTime(time.Unix(1700000000, 0))
+	store, err := kvstore.Open(kvstore.Config{Driver: kvstore.DriverRedis, Addrs: []string{server.Addr()}, Prefix: "rl:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	limiter, err := NewGCRALimiter(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replicas sharing the store share the limit.
+	other, _ := NewGCRALimiter(store)
+	ctx := context.Background()
+	limit := Limit{Requests: 3, Per: time.Minute}
+
+	d, err := limiter.Allow(ctx, "client", limit, 1)
+	if err != nil || !d.Allowed || d.Remaining != 2 || d.ResetAfter != 20*time.Second {
+		t.Fatalf("first hit = %+v, %v", d, err)
+	}
+	for _, l := range []*GCRALimiter{other, limiter} {
+		if d, err := l.Allow(ctx, "client", limit, 1); err != nil || !d.Allowed {
+			t.Fatalf("hit within limit = %+v, %v", d, err)
+		}
+	}
+	d, err = other.Allow(ctx, "client", limit, 1)
+	if err != nil || d.Allowed || d.Remaining != 0 || d.RetryAfter != 20*time.Second || d.ResetAfter != time.Minute {
+		t.Fatalf("hit over limit = %+v, %v", d, err)
+	}
+	if !server.Exists("rl:client") {
+		t.Errorf("keys not prefixed: %v", server.Keys())
+	}
+
+	server.SetTime(time.Unix(1700000020, 0))
+	if d, err := limiter.Allow(ctx, "client", limit, 1); err != nil || !d.Allowed || d.Remaining != 0 {
+		t.Errorf("hit after one emission interval = %+v, %v", d, err)
+	}
+	if d, err := limiter.Allow(ctx, "other", limit, 3); err != nil || !d.Allowed {
+		t.Errorf("burst of a new key = %+v, %v", d, err)
+	}
+}
+
+func TestGCRALimiterNeedsScripts(t *testing.T) {
+	store, err := kvstore.Open(kvstore.Config{Driver: kvstore.DriverMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := NewGCRALimiter(store); err == nil {
+		t.Error("NewGCRALimiter accepted the memory store")
+	}
+}
+
+func TestNewSharedLimiter(t *testing.T) {
+	server := miniredis.RunT(t)
+	redis, err := kvstore.Open(kvstore.Config{Driver: kvstore.DriverRedis, Addrs: []string{server.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redis.Close()
+	if _, ok := NewSharedLimiter(redis).(*GCRALimiter); !ok {
+		t.Error("redis store not limited by GCRA")
+	}
+	memory, err := kvstore.Open(kvstore.Config{Driver: kvstore.DriverMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memory.Close()
+	if _, ok := NewSharedLimiter(memory).(*StoreLimiter); !ok {
+		t.Error("memory store not limited by counters")
+	}
+}
@@ -0,0 +1,154 @@
+// Package ratelimit provides token bucket rate limiting shared by the Envoy
+// RateLimitService server and the rate limit processor.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Limit is a token bucket of Requests tokens refilled evenly over Per.
+type Limit struct {
+	Requests uint32
+	Per      time.Duration
+}
+
+// rate returns the refill rate in tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// ParseLimit parses a limit written as "requests/unit", where the unit is
+// second, minute, hour or day, or a duration such as "30s".
+func ParseLimit(s string) (Limit, error) {
+	requests, per, ok := strings.Cut(s, "/")
+	n, err := strconv.ParseUint(strings.TrimSpace(requests), 10, 32)
+	if !ok || err != nil || n == 0 {
+		return Limit{}, invalidLimit(s)
+	}
+	per = strings.TrimSpace(per)
+	d := Unit(per).Duration()
+	if d == 0 {
+		if d, err = time.ParseDuration(per); err != nil || d <= 0 {
+			return Limit{}, invalidLimit(s)
+		}
+	}
+	return Limit{Requests: uint32(n), Per: d}, nil
+}
+
+func invalidLimit(s string) error {
+	return oops.
+		In("ratelimit").
+		Code(errcode.InvalidLimit).
+		With("limit", s).
+		Errorf("invalid rate limit %q, want 'requests/unit'", s)
+}
+
+// Decision is the outcome of consuming tokens from a bucket.
+type Decision struct {
+	Allowed   bool
+	Limit     Limit
+	Remaining uint32
+	// RetryAfter is how long until the request would be allowed; zero when allowed.
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again.
+	ResetAfter time.Duration
+}
+
+// Limiter consumes hits tokens from the bucket identified by key.
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit, hits uint32) (Decision, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// LimiterOption configures a MemoryLimiter or StoreLimiter.
+type LimiterOption func(*limiterOptions)
+
+type limiterOptions struct {
+	clock clock.Clock
+}
+
+// WithClock sets the clock buckets and windows are measured on.
+func WithClock(c clock.Clock) LimiterOption {
+	return func(o *limiterOptions) {
+		o.clock = clock.Or(c)
+	}
+}
+
+func newLimiterOptions(opts []LimiterOption) limiterOptions {
+	o := limiterOptions{clock: clock.Real}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// MemoryLimiter is a process-local Limiter holding buckets in an LRU cache,
+// so idle keys are evicted once size buckets are tracked.
+type MemoryLimiter struct {
+	clock   clock.Clock
+	mu      sync.Mutex
+	buckets *lru.Cache[string, *bucket]
+}
+
+// NewMemoryLimiter creates a MemoryLimiter tracking up to size buckets.
+func NewMemoryLimiter(size int, opts ...LimiterOption) (*MemoryLimiter, error) {
+	buckets, err := lru.New[string, *bucket](size)
+	if err != nil {
+		return nil, oops.
+			In("ratelimit").
+			Code(errcode.CacheInitFailed).
+			With("size", size).
+			Wrapf(err, "failed to create bucket cache")
+	}
+	return &MemoryLimiter{clock: newLimiterOptions(opts).clock, buckets: buckets}, nil
+}
+
+// Allow implements Limiter.
+func (l *MemoryLimiter) Allow(_ context.Context, key string, limit Limit, hits uint32) (Decision, error) {
+	now := l.clock.Now()
+	capacity := float64(limit.Requests)
+	rate := limit.rate()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets.Get(key)
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets.Add(key, b)
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	decision := Decision{Limit: limit}
+	if b.tokens >= float64(hits) {
+		b.tokens -= float64(hits)
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = secondsToDuration((float64(hits) - b.tokens) / rate)
+	}
+	decision.Remaining = uint32(math.Floor(b.tokens))
+	decision.ResetAfter = secondsToDuration((capacity - b.tokens) / rate)
+	return decision, nil
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
+
+// Ensure MemoryLimiter implements Limiter.
+var _ Limiter = (*MemoryLimiter)(nil)
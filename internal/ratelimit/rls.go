@@ -0,0 +1,171 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_ratelimit_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RLSServer implements the Envoy RateLimitService gRPC API on top of Rules
+// and a Limiter, for deployments that prefer Envoy's native ratelimit filter.
+type RLSServer struct {
+	envoy_service_ratelimit_v3.UnimplementedRateLimitServiceServer
+
+	rules           atomic.Pointer[Rules]
+	limiter         Limiter
+	responseHeaders bool
+	decisionMode    extproc.DecisionMode
+	decider         extproc.Decider
+	log             zerolog.Logger
+}
+
+// RLSOption configures optional RLSServer behavior.
+type RLSOption func(*RLSServer)
+
+// WithResponseHeaders adds x-ratelimit-limit/remaining/reset headers for the
+// most restrictive matched descriptor to every response.
+func WithResponseHeaders(enabled bool) RLSOption {
+	return func(s *RLSServer) {
+		s.responseHeaders = enabled
+	}
+}
+
+// WithDecisionMode selects whether requests over a limit are rejected. When
+// they are not, the response is OK, adding the x-extproc-would-block header
+// to the request in header-tag-only mode.
+func WithDecisionMode(mode extproc.DecisionMode) RLSOption {
+	return func(s *RLSServer) {
+		s.decisionMode = mode
+	}
+}
+
+// NewRLSServer creates a RateLimitService server.
+func NewRLSServer(rules *Rules, limiter Limiter, log zerolog.Logger, opts ...RLSOption) *RLSServer {
+	s := &RLSServer{
+		limiter: limiter,
+		log:     log.With().Str("component", "rls").Logger(),
+	}
+	s.rules.Store(rules)
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.decider = extproc.NewDecider("ratelimit-service", s.decisionMode, s.log)
+	return s
+}
+
+// SetRules replaces the rules; requests already being evaluated finish with
+// the previous ones.
+func (s *RLSServer) SetRules(rules *Rules) {
+	s.rules.Store(rules)
+}
+
+// ShouldRateLimit implements the RateLimitService RPC.
+func (s *RLSServer) ShouldRateLimit(
+	ctx context.Context,
+	req *envoy_service_ratelimit_v3.RateLimitRequest,
+) (*envoy_service_ratelimit_v3.RateLimitResponse, error) {
+	rules := s.rules.Load()
+	if req.GetDomain() != rules.Domain {
+		return nil, status.Errorf(codes.NotFound, "unknown rate limit domain %q", req.GetDomain())
+	}
+
+	hits := max(req.GetHitsAddend(), 1)
+	resp := &envoy_service_ratelimit_v3.RateLimitResponse{
+		OverallCode: envoy_service_ratelimit_v3.RateLimitResponse_OK,
+		Statuses:    make([]*envoy_service_ratelimit_v3.RateLimitResponse_DescriptorStatus, 0, len(req.GetDescriptors())),
+	}
+
+	var tightest *Decision
+	for _, descriptor := range req.GetDescriptors() {
+		entries := make([]Entry, 0, len(descriptor.GetEntries()))
+		for _, e := range descriptor.GetEntries() {
+			entries = append(entries, Entry{Key: e.GetKey(), Value: e.GetValue()})
+		}
+
+		match, ok := rules.Match(entries)
+		if !ok {
+			resp.Statuses = append(resp.Statuses, &envoy_service_ratelimit_v3.RateLimitResponse_DescriptorStatus{
+				Code: envoy_service_ratelimit_v3.RateLimitResponse_OK,
+			})
+			continue
+		}
+
+		decision, err := s.limiter.Allow(ctx, match.Key, match.Rule.Limit(), hits)
+		if err != nil {
+			s.log.Error().Err(err).Str("key", match.Key).Msg("rate limit backend failed")
+			return nil, status.Errorf(codes.Unavailable, "rate limit backend failed: %v", err)
+		}
+
+		code := envoy_service_ratelimit_v3.RateLimitResponse_OK
+		if !decision.Allowed {
+			code = envoy_service_ratelimit_v3.RateLimitResponse_OVER_LIMIT
+			resp.OverallCode = code
+		}
+		resp.Statuses = append(resp.Statuses, &envoy_service_ratelimit_v3.RateLimitResponse_DescriptorStatus{
+			Code: code,
+			CurrentLimit: &envoy_service_ratelimit_v3.RateLimitResponse_RateLimit{
+				Name:            match.Rule.Name,
+				RequestsPerUnit: match.Rule.RequestsPerUnit,
+				Unit:            protoUnit(match.Rule.Unit),
+			},
+			LimitRemaining:     decision.Remaining,
+			DurationUntilReset: durationpb.New(decision.ResetAfter),
+		})
+
+		if tightest == nil || decision.Remaining < tightest.Remaining || !decision.Allowed {
+			tightest = &decision
+		}
+		s.log.Debug().
+			Str("key", match.Key).
+			Bool("allowed", decision.Allowed).
+			Uint32("remaining", decision.Remaining).
+			Msg("descriptor evaluated")
+	}
+
+	if resp.OverallCode == envoy_service_ratelimit_v3.RateLimitResponse_OVER_LIMIT && !s.decider.Enforcing("over_limit") {
+		resp.OverallCode = envoy_service_ratelimit_v3.RateLimitResponse_OK
+		if s.decider.Mode() == extproc.DecisionHeaderTag {
+			resp.RequestHeadersToAdd = append(resp.RequestHeadersToAdd, s.decider.Tag("over_limit").GetHeader())
+		}
+	}
+	if s.responseHeaders && tightest != nil {
+		resp.ResponseHeadersToAdd = RateLimitHeaders(*tightest)
+	}
+	return resp, nil
+}
+
+// RateLimitHeaders renders the x-ratelimit-* headers for a decision.
+func RateLimitHeaders(d Decision) []*envoy_api_v3_core.HeaderValue {
+	return []*envoy_api_v3_core.HeaderValue{
+		{Key: "x-ratelimit-limit", Value: strconv.FormatUint(uint64(d.Limit.Requests), 10)},
+		{Key: "x-ratelimit-remaining", Value: strconv.FormatUint(uint64(d.Remaining), 10)},
+		{Key: "x-ratelimit-reset", Value: strconv.FormatInt(int64(math.Ceil(d.ResetAfter.Seconds())), 10)},
+	}
+}
+
+func protoUnit(u Unit) envoy_service_ratelimit_v3.RateLimitResponse_RateLimit_Unit {
+	switch Unit(strings.ToLower(string(u))) {
+	case UnitSecond:
+		return envoy_service_ratelimit_v3.RateLimitResponse_RateLimit_SECOND
+	case UnitMinute:
+		return envoy_service_ratelimit_v3.RateLimitResponse_RateLimit_MINUTE
+	case UnitHour:
+		return envoy_service_ratelimit_v3.RateLimitResponse_RateLimit_HOUR
+	case UnitDay:
+		return envoy_service_ratelimit_v3.RateLimitResponse_RateLimit_DAY
+	}
+	return envoy_service_ratelimit_v3.RateLimitResponse_RateLimit_UNKNOWN
+}
+
+// Ensure RLSServer implements the RateLimitService server interface.
+var _ envoy_service_ratelimit_v3.RateLimitServiceServer = (*RLSServer)(nil)
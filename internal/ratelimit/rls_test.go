@@ -0,0 +1,138 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	envoy_extensions_common_ratelimit_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	envoy_service_ratelimit_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestRLS(t *testing.T, opts ...RLSOption) *RLSServer {
+	t.Helper()
+	rules, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := NewMemoryLimiter(100, WithClock(clock.NewFake(time.Unix(1700000000, 0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRLSServer(rules, limiter, zerolog.Nop(), opts...)
+}
+
+func rateLimitRequest(domain string, descriptors ...[]string) *envoy_service_ratelimit_v3.RateLimitRequest {
+	req := &envoy_service_ratelimit_v3.RateLimitRequest{Domain: domain}
+	for _, kv := range descriptors {
+		d := &envoy_extensions_common_ratelimit_v3.RateLimitDescriptor{}
+		for i := 0; i+1 < len(kv); i += 2 {
+			d.Entries = append(d.Entries, &envoy_extensions_common_ratelimit_v3.RateLimitDescriptor_Entry{Key: kv[i], Value: kv[i+1]})
+		}
+		req.Descriptors = append(req.Descriptors, d)
+	}
+	return req
+}
+
+func headerValues(resp *envoy_service_ratelimit_v3.RateLimitResponse) map[string]string {
+	headers := map[string]string{}
+	for _, h := range resp.GetResponseHeadersToAdd() {
+		headers[h.GetKey()] = h.GetValue()
+	}
+	return headers
+}
+
+func TestShouldRateLimitDomain(t *testing.T) {
+	s := newTestRLS(t)
+	_, err := s.ShouldRateLimit(context.Background(), rateLimitRequest("other", []string{"path", "/login"}))
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("unknown domain: err = %v, want NotFound", err)
+	}
+}
+
+func TestShouldRateLimit(t *testing.T) {
+	s := newTestRLS(t, WithResponseHeaders(true))
+	ctx := context.Background()
+	login := rateLimitRequest("edge", []string{"path", "/login"}, []string{"user", "alice"}, []string{"path", "/orders"})
+
+	for i := range 5 {
+		resp, err := s.ShouldRateLimit(ctx, login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetOverallCode() != envoy_service_ratelimit_v3.RateLimitResponse_OK {
+			t.Fatalf("request %d: %v", i+1, resp.GetOverallCode())
+		}
+		statuses := resp.GetStatuses()
+		if len(statuses) != 3 || statuses[0].GetCurrentLimit().GetName() != "login" || statuses[1].GetCurrentLimit() != nil ||
+			statuses[2].GetCurrentLimit().GetRequestsPerUnit() != 100 {
+			t.Fatalf("request %d: statuses %v", i+1, statuses)
+		}
+		// Headers describe the descriptor closest to its limit.
+		if got := headerValues(resp); got["x-ratelimit-limit"] != "5" || got["x-ratelimit-remaining"] != strconv.Itoa(4-i) {
+			t.Errorf("request %d: headers %v", i+1, got)
+		}
+	}
+
+	resp, err := s.ShouldRateLimit(ctx, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetOverallCode() != envoy_service_ratelimit_v3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("over limit: %v", resp.GetOverallCode())
+	}
+	if got := resp.GetStatuses()[0]; got.GetCode() != envoy_service_ratelimit_v3.RateLimitResponse_OVER_LIMIT || got.GetLimitRemaining() != 0 {
+		t.Errorf("login status %v", got)
+	}
+	if got := resp.GetStatuses()[2].GetCode(); got != envoy_service_ratelimit_v3.RateLimitResponse_OK {
+		t.Errorf("orders status %v", got)
+	}
+	if got := headerValues(resp); got["x-ratelimit-limit"] != "5" || got["x-ratelimit-remaining"] != "0" || got["x-ratelimit-reset"] != "60" {
+		t.Errorf("over limit headers %v", got)
+	}
+}
+
+func TestShouldRateLimitDecisionModes(t *testing.T) {
+	for _, tt := range []struct {
+		mode extproc.DecisionMode
+		code envoy_service_ratelimit_v3.RateLimitResponse_Code
+		tag  bool
+	}{
+		{extproc.DecisionEnforce, envoy_service_ratelimit_v3.RateLimitResponse_OVER_LIMIT, false},
+		{extproc.DecisionHeaderTag, envoy_service_ratelimit_v3.RateLimitResponse_OK, true},
+		{extproc.DecisionLogOnly, envoy_service_ratelimit_v3.RateLimitResponse_OK, false},
+	} {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			s := newTestRLS(t, WithDecisionMode(tt.mode))
+			req := rateLimitRequest("edge", []string{"path", "/login"})
+			req.HitsAddend = 6
+			resp, err := s.ShouldRateLimit(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.GetOverallCode() != tt.code {
+				t.Errorf("overall code %v, want %v", resp.GetOverallCode(), tt.code)
+			}
+			// Descriptor statuses report the limit whatever the mode.
+			if got := resp.GetStatuses()[0].GetCode(); got != envoy_service_ratelimit_v3.RateLimitResponse_OVER_LIMIT {
+				t.Errorf("descriptor code %v", got)
+			}
+			tagged := false
+			for _, h := range resp.GetRequestHeadersToAdd() {
+				tagged = tagged || h.GetKey() == extproc.HeaderWouldBlock
+			}
+			if tagged != tt.tag {
+				t.Errorf("would-block tag %v, want %v", tagged, tt.tag)
+			}
+			if len(resp.GetResponseHeadersToAdd()) != 0 {
+				t.Errorf("response headers without WithResponseHeaders: %v", resp.GetResponseHeadersToAdd())
+			}
+		})
+	}
+}
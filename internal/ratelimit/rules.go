@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+)
+
+// Unit is the period a rate limit's requests_per_unit applies to.
+type Unit string
+
+const (
+	UnitSecond Unit = "second"
+	UnitMinute Unit = "minute"
+	UnitHour   Unit = "hour"
+	UnitDay    Unit = "day"
+)
+
+// Duration returns the length of the unit, or zero if it is unknown.
+func (u Unit) Duration() time.Duration {
+	switch Unit(strings.ToLower(string(u))) {
+	case UnitSecond:
+		return time.Second
+	case UnitMinute:
+		return time.Minute
+	case UnitHour:
+		return time.Hour
+	case UnitDay:
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// Rules is a descriptor tree in the same shape as the envoyproxy/ratelimit
+// service configuration, so existing rule files can be reused.
+type Rules struct {
+	Domain      string           `yaml:"domain"`
+	Descriptors []DescriptorRule `yaml:"descriptors"`
+}
+
+// DescriptorRule matches one descriptor entry by key and optional value.
+type DescriptorRule struct {
+	Key         string           `yaml:"key"`
+	Value       string           `yaml:"value,omitempty"`
+	RateLimit   *RateLimitRule   `yaml:"rate_limit,omitempty"`
+	Descriptors []DescriptorRule `yaml:"descriptors,omitempty"`
+}
+
+// RateLimitRule is the limit applied to a matched descriptor.
+type RateLimitRule struct {
+	Name            string `yaml:"name,omitempty"`
+	Unit            Unit   `yaml:"unit"`
+	RequestsPerUnit uint32 `yaml:"requests_per_unit"`
+}
+
+// Limit converts the rule to a token bucket Limit.
+func (r *RateLimitRule) Limit() Limit {
+	return Limit{Requests: r.RequestsPerUnit, Per: r.Unit.Duration()}
+}
+
+// Entry is a single descriptor key/value pair.
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Match is a descriptor resolved to a limit.
+type Match struct {
+	// Key identifies the bucket: the domain plus every entry of the descriptor.
+	Key  string
+	Rule *RateLimitRule
+}
+
+// LoadRules reads and validates a YAML rules file or ConfigMap/Secret
+// reference (see kube.ParseRef).
+func LoadRules(path string) (*Rules, error) {
+	data, err := kube.ReadFile(context.Background(), path)
+	if err != nil {
+		return nil, oops.
+			In("ratelimit").
+			Code(errcode.ReadRulesFailed).
+			With("path", path).
+			Wrapf(err, "failed to read rate limit rules")
+	}
+	return ParseRules(data)
+}
+
+// ParseRules parses and validates YAML rules.
+func ParseRules(data []byte) (*Rules, error) {
+	var rules Rules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, oops.
+			In("ratelimit").
+			Code(errcode.ParseRulesFailed).
+			Wrapf(err, "failed to parse rate limit rules")
+	}
+	if err := validateDescriptors(rules.Descriptors, ""); err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+func validateDescriptors(descriptors []DescriptorRule, parent string) error {
+	for _, d := range descriptors {
+		path := parent + "/" + d.Key
+		if d.Value != "" {
+			path += "=" + d.Value
+		}
+		if d.Key == "" {
+			return oops.
+				In("ratelimit").
+				Code(errcode.InvalidRules).
+				With("path", path).
+				Errorf("descriptor key must not be empty")
+		}
+		if rl := d.RateLimit; rl != nil {
+			if rl.Unit.Duration() == 0 || rl.RequestsPerUnit == 0 {
+				return oops.
+					In("ratelimit").
+					Code(errcode.InvalidRules).
+					With("path", path).
+					With("unit", rl.Unit).
+					Errorf("rate_limit needs a unit of second/minute/hour/day and positive requests_per_unit")
+			}
+		}
+		if err := validateDescriptors(d.Descriptors, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match walks the descriptor tree entry by entry, preferring a rule with a
+// matching value over a key-only rule, and returns the rate limit of the node
+// reached by the last entry.
+func (r *Rules) Match(entries []Entry) (Match, bool) {
+	if len(entries) == 0 {
+		return Match{}, false
+	}
+
+	nodes := r.Descriptors
+	var node *DescriptorRule
+	for _, entry := range entries {
+		node = findDescriptor(nodes, entry)
+		if node == nil {
+			return Match{}, false
+		}
+		nodes = node.Descriptors
+	}
+	if node.RateLimit == nil {
+		return Match{}, false
+	}
+
+	var key strings.Builder
+	key.WriteString(r.Domain)
+	for _, entry := range entries {
+		key.WriteString("|")
+		key.WriteString(entry.Key)
+		key.WriteString("=")
+		key.WriteString(entry.Value)
+	}
+	return Match{Key: key.String(), Rule: node.RateLimit}, true
+}
+
+func findDescriptor(nodes []DescriptorRule, entry Entry) *DescriptorRule {
+	var keyOnly *DescriptorRule
+	for i := range nodes {
+		n := &nodes[i]
+		if n.Key != entry.Key {
+			continue
+		}
+		if n.Value == entry.Value {
+			return n
+		}
+		if n.Value == "" && keyOnly == nil {
+			keyOnly = n
+		}
+	}
+	return keyOnly
+}
@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+)
+
+const testRules = `
+domain: edge
+descriptors:
+  - key: remote_address
+    rate_limit: {unit: second, requests_per_unit: 10}
+  - key: path
+    value: /login
+    rate_limit: {name: login, unit: minute, requests_per_unit: 5}
+  - key: path
+    rate_limit: {unit: minute, requests_per_unit: 100}
+  - key: tenant
+    descriptors:
+      - key: plan
+        value: free
+        rate_limit: {unit: hour, requests_per_unit: 1000}
+`
+
+func TestParseRules(t *testing.T) {
+	for _, tt := range []struct {
+		name, data string
+		code       errcode.Code
+	}{
+		{"not yaml", "domain: [\n", errcode.ParseRulesFailed},
+		{"empty key", "descriptors: [{value: a}]", errcode.InvalidRules},
+		{"unknown unit", "descriptors: [{key: a, rate_limit: {unit: week, requests_per_unit: 1}}]", errcode.InvalidRules},
+		{"zero requests", "descriptors: [{key: a, rate_limit: {unit: second, requests_per_unit: 0}}]", errcode.InvalidRules},
+		{"nested", "descriptors: [{key: a, descriptors: [{key: b, rate_limit: {unit: day}}]}]", errcode.InvalidRules},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseRules([]byte(tt.data)); !errcode.Is(err, tt.code) {
+				t.Errorf("err = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestRulesMatch(t *testing.T) {
+	rules, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		entries []Entry
+		key     string
+		limit   Limit
+	}{
+		{"key only", []Entry{{"remote_address", "192.0.2.1"}}, "edge|remote_address=192.0.2.1", Limit{10, time.Second}},
+		{"value preferred", []Entry{{"path", "/login"}}, "edge|path=/login", Limit{5, time.Minute}},
+		{"key fallback", []Entry{{"path", "/orders"}}, "edge|path=/orders", Limit{100, time.Minute}},
+		{"nested", []Entry{{"tenant", "acme"}, {"plan", "free"}}, "edge|tenant=acme|plan=free", Limit{1000, time.Hour}},
+		{"nested value mismatch", []Entry{{"tenant", "acme"}, {"plan", "pro"}}, "", Limit{}},
+		{"node without limit", []Entry{{"tenant", "acme"}}, "", Limit{}},
+		{"entries past the tree", []Entry{{"remote_address", "192.0.2.1"}, {"path", "/"}}, "", Limit{}},
+		{"unknown key", []Entry{{"user", "alice"}}, "", Limit{}},
+		{"no entries", nil, "", Limit{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, ok := rules.Match(tt.entries)
+			if ok != (tt.key != "") {
+				t.Fatalf("matched %v, want %v", ok, tt.key != "")
+			}
+			if ok && (m.Key != tt.key || m.Rule.Limit() != tt.limit) {
+				t.Errorf("match %q with %+v, want %q with %+v", m.Key, m.Rule.Limit(), tt.key, tt.limit)
+			}
+		})
+	}
+}
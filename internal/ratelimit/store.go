@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/kvstore"
+	"github.com/samber/oops"
+)
+
+// StoreLimiter is a Limiter sharing counters through a kvstore.Store, so
+// replicas enforce one limit. It approximates a sliding window from the
+// counts of the current and previous fixed windows of length Limit.Per.
+type StoreLimiter struct {
+	store kvstore.Store
+	clock clock.Clock
+}
+
+// NewStoreLimiter creates a StoreLimiter keeping counters in store.
+func NewStoreLimiter(store kvstore.Store, opts ...LimiterOption) *StoreLimiter {
+	return &StoreLimiter{store: store, clock: newLimiterOptions(opts).clock}
+}
+
+// NewSharedLimiter creates the Limiter replicas sharing store enforce one
+// limit with: a GCRALimiter, exact, if store runs scripts, as Redis does, or
+// else a StoreLimiter approximating a sliding window from counters.
+func NewSharedLimiter(store kvstore.Store, opts ...LimiterOption) Limiter {
+	if gcra, err := NewGCRALimiter(store); err == nil {
+		return gcra
+	}
+	return NewStoreLimiter(store, opts...)
+}
+
+// Allow implements Limiter. Denied hits are not counted.
+func (l *StoreLimiter) Allow(ctx context.Context, key string, limit Limit, hits uint32) (Decision, error) {
+	now := l.clock.Now()
+	window := limit.Per
+	index := now.UnixNano() / int64(window)
+	elapsed := time.Duration(now.UnixNano() - index*int64(window))
+	weight := 1 - float64(elapsed)/float64(window)
+
+	prev, err := l.count(ctx, key+":"+strconv.FormatInt(index-1, 10))
+	if err != nil {
+		return Decision{}, err
+	}
+	currentKey := key + ":" + strconv.FormatInt(index, 10)
+	// Counters live for two windows so the next window can weigh them.
+	current, err := l.store.Incr(ctx, currentKey, int64(hits), 2*window)
+	if err != nil {
+		return Decision{}, oops.In("ratelimit").Wrap(err)
+	}
+
+	capacity := float64(limit.Requests)
+	estimate := float64(prev)*weight + float64(current)
+	decision := Decision{Limit: limit, ResetAfter: window - elapsed}
+	if estimate <= capacity {
+		decision.Allowed = true
+	} else {
+		if _, err := l.store.Incr(ctx, currentKey, -int64(hits), 2*window); err != nil {
+			return Decision{}, oops.In("ratelimit").Wrap(err)
+		}
+		current -= int64(hits)
+		estimate = float64(prev)*weight + float64(current)
+		decision.RetryAfter = retryAfter(float64(prev), float64(current), float64(hits), capacity, weight, window)
+	}
+	decision.Remaining = uint32(max(0, math.Floor(capacity-estimate)))
+	return decision, nil
+}
+
+// count returns the counter at key, 0 if missing.
+func (l *StoreLimiter) count(ctx context.Context, key string) (int64, error) {
+	raw, err := l.store.Get(ctx, key)
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, oops.In("ratelimit").Wrap(err)
+	}
+	n, err := strconv.ParseInt(string(raw), 10, 64)
+	return n, oops.In("ratelimit").Code(errcode.NotAnInteger).With("key", key).Wrap(err)
+}
+
+// retryAfter estimates when prev's decaying weight leaves room for hits,
+// falling back to the start of the next window.
+func retryAfter(prev, current, hits, capacity, weight float64, window time.Duration) time.Duration {
+	untilNext := time.Duration(weight * float64(window))
+	room := capacity - current - hits
+	if prev <= 0 || room < 0 {
+		return untilNext
+	}
+	// Solve prev*w' <= room for the weight w' at which hits fit.
+	wait := time.Duration((weight - room/prev) * float64(window))
+	return min(max(wait, 0), untilNext)
+}
+
+// Ensure StoreLimiter implements Limiter.
+var _ Limiter = (*StoreLimiter)(nil)
@@ -0,0 +1,78 @@
+package recording
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// extprocEncoder writes each exchange as the ext_proc messages Envoy would
+// send for it: request headers, request body, response headers and response
+// body, each prefixed with its varint length. Every exchange starts with a
+// request headers message.
+type extprocEncoder struct{}
+
+func (extprocEncoder) extension() string { return ".binpb" }
+
+func (extprocEncoder) header() []byte { return nil }
+
+func (extprocEncoder) footer() []byte { return nil }
+
+func (extprocEncoder) encode(ex *Exchange, _ bool) ([]byte, error) {
+	msgs := []*envoy_service_proc_v3.ProcessingRequest{{
+		Request: &envoy_service_proc_v3.ProcessingRequest_RequestHeaders{
+			RequestHeaders: httpHeaders(ex.RequestHeaders, len(ex.RequestBody) == 0),
+		},
+	}}
+	if len(ex.RequestBody) > 0 {
+		msgs = append(msgs, &envoy_service_proc_v3.ProcessingRequest{
+			Request: &envoy_service_proc_v3.ProcessingRequest_RequestBody{
+				RequestBody: &envoy_service_proc_v3.HttpBody{Body: ex.RequestBody, EndOfStream: true},
+			},
+		})
+	}
+	if ex.ResponseHeaders != nil {
+		msgs = append(msgs, &envoy_service_proc_v3.ProcessingRequest{
+			Request: &envoy_service_proc_v3.ProcessingRequest_ResponseHeaders{
+				ResponseHeaders: httpHeaders(ex.ResponseHeaders, len(ex.ResponseBody) == 0),
+			},
+		})
+		if len(ex.ResponseBody) > 0 {
+			msgs = append(msgs, &envoy_service_proc_v3.ProcessingRequest{
+				Request: &envoy_service_proc_v3.ProcessingRequest_ResponseBody{
+					ResponseBody: &envoy_service_proc_v3.HttpBody{Body: ex.ResponseBody, EndOfStream: true},
+				},
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		if _, err := protodelim.MarshalTo(&buf, msg); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func httpHeaders(h http.Header, endOfStream bool) *envoy_service_proc_v3.HttpHeaders {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	// Pseudo-headers sort first, as Envoy sends them.
+	slices.Sort(names)
+
+	headers := &envoy_api_v3_core.HeaderMap{}
+	for _, name := range names {
+		for _, v := range h[name] {
+			headers.Headers = append(headers.Headers, &envoy_api_v3_core.HeaderValue{Key: strings.ToLower(name), RawValue: []byte(v)})
+		}
+	}
+	return &envoy_service_proc_v3.HttpHeaders{Headers: headers, EndOfStream: endOfStream}
+}
@@ -0,0 +1,184 @@
+package recording
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// harEncoder writes one HAR document per file. Entries are appended to the
+// log's entries array, which is closed when the file is rotated.
+type harEncoder struct{}
+
+func (harEncoder) extension() string { return ".har" }
+
+func (harEncoder) header() []byte {
+	return []byte(`{"log":{"version":"1.2","creator":{"name":"envoy-ext-procs","version":"1"},"entries":[` + "\n")
+}
+
+func (harEncoder) footer() []byte { return []byte("\n]}}\n") }
+
+func (harEncoder) encode(ex *Exchange, first bool) ([]byte, error) {
+	data, err := json.Marshal(newHAREntry(ex))
+	if err != nil || first {
+		return data, err
+	}
+	return append([]byte(",\n"), data...), nil
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harContent    `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func newHAREntry(ex *Exchange) *harEntry {
+	req := ex.RequestHeaders
+	ms := float64(ex.Duration) / float64(time.Millisecond)
+	entry := &harEntry{
+		StartedDateTime: ex.Started.UTC().Format(time.RFC3339Nano),
+		Time:            ms,
+		Request: harRequest{
+			Method:      req.Get(":method"),
+			URL:         requestURL(req),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req),
+			QueryString: queryString(req.Get(":path")),
+			HeadersSize: -1,
+			BodySize:    len(ex.RequestBody),
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(ex.ResponseHeaders),
+			HTTPVersion: "HTTP/1.1",
+			HeadersSize: -1,
+			BodySize:    len(ex.ResponseBody),
+		},
+		Timings: harTimings{Send: 0, Wait: ms, Receive: 0},
+	}
+	if len(ex.RequestBody) > 0 {
+		content := newContent(req.Get("content-type"), ex.RequestBody)
+		entry.Request.PostData = &content
+	}
+
+	var notes []string
+	if ex.ResponseHeaders == nil {
+		notes = append(notes, "no response")
+	} else {
+		status, _ := strconv.Atoi(ex.ResponseHeaders.Get(":status"))
+		entry.Response.Status = status
+		entry.Response.StatusText = http.StatusText(status)
+		entry.Response.RedirectURL = ex.ResponseHeaders.Get("location")
+	}
+	entry.Response.Content = newContent(ex.ResponseHeaders.Get("content-type"), ex.ResponseBody)
+	if ex.RequestTruncated {
+		notes = append(notes, "request body truncated")
+	}
+	if ex.ResponseTruncated {
+		notes = append(notes, "response body truncated")
+	}
+	entry.Comment = strings.Join(notes, "; ")
+	return entry
+}
+
+func requestURL(h http.Header) string {
+	scheme := h.Get(":scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + h.Get(":authority") + h.Get(":path")
+}
+
+// harHeaders lists regular headers sorted by name; pseudo-headers are
+// represented by the request line and status instead.
+func harHeaders(h http.Header) []harNameValue {
+	out := []harNameValue{}
+	for name, values := range h {
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		for _, v := range values {
+			out = append(out, harNameValue{Name: strings.ToLower(name), Value: v})
+		}
+	}
+	slices.SortStableFunc(out, func(a, b harNameValue) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+func queryString(path string) []harNameValue {
+	out := []harNameValue{}
+	_, rawQuery, _ := strings.Cut(path, "?")
+	query, _ := url.ParseQuery(rawQuery)
+	for name, values := range query {
+		for _, v := range values {
+			out = append(out, harNameValue{Name: name, Value: v})
+		}
+	}
+	slices.SortStableFunc(out, func(a, b harNameValue) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+// newContent stores text bodies verbatim and binary bodies base64-encoded.
+func newContent(mimeType string, body []byte) harContent {
+	c := harContent{Size: len(body), MimeType: mimeType}
+	if utf8.Valid(body) {
+		c.Text = string(body)
+	} else {
+		c.Text = base64.StdEncoding.EncodeToString(body)
+		c.Encoding = "base64"
+	}
+	return c
+}
@@ -0,0 +1,181 @@
+// Package recording writes captured HTTP exchanges to size-rotated files,
+// either as HAR documents or as length-delimited ext_proc messages that can
+// be streamed back into a processor.
+package recording
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// Format is a capture file format.
+type Format string
+
+const (
+	// FormatHAR writes HTTP Archive 1.2 documents.
+	FormatHAR Format = "har"
+	// FormatExtProc writes varint length-delimited ext_proc
+	// ProcessingRequest messages, one exchange after another.
+	FormatExtProc Format = "extproc"
+)
+
+// Exchange is a captured request/response pair.
+type Exchange struct {
+	Started  time.Time
+	Duration time.Duration
+
+	RequestHeaders   http.Header
+	RequestBody      []byte
+	RequestTruncated bool
+
+	// ResponseHeaders is nil when the exchange ended before a response.
+	ResponseHeaders   http.Header
+	ResponseBody      []byte
+	ResponseTruncated bool
+}
+
+// encoder serializes exchanges into one capture file.
+type encoder interface {
+	extension() string
+	header() []byte
+	encode(ex *Exchange, first bool) ([]byte, error)
+	footer() []byte
+}
+
+// WriterConfig holds capture file settings.
+type WriterConfig struct {
+	Dir    string
+	Format Format
+	// MaxSize is the size in bytes after which a new file is started.
+	MaxSize int64
+	// MaxFiles is the number of capture files kept; 0 keeps all.
+	MaxFiles int
+}
+
+// Writer appends exchanges to the current capture file, rotating by size.
+// It is safe for concurrent use.
+type Writer struct {
+	cfg WriterConfig
+	enc encoder
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	entries int
+}
+
+// NewWriter creates a Writer, creating the capture directory if needed.
+func NewWriter(cfg WriterConfig) (*Writer, error) {
+	var enc encoder
+	switch cfg.Format {
+	case FormatHAR:
+		enc = harEncoder{}
+	case FormatExtProc:
+		enc = extprocEncoder{}
+	default:
+		return nil, oops.
+			In("recording").
+			Code(errcode.InvalidFormat).
+			With("format", cfg.Format).
+			Errorf("unknown capture format %q", cfg.Format)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, oops.
+			In("recording").
+			Code(errcode.WriteFailed).
+			With("dir", cfg.Dir).
+			Wrapf(err, "failed to create capture directory")
+	}
+	return &Writer{cfg: cfg, enc: enc}, nil
+}
+
+// Write appends ex to the current capture file.
+func (w *Writer) Write(ex *Exchange) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file != nil && w.cfg.MaxSize > 0 && w.size >= w.cfg.MaxSize {
+		if err := w.closeFile(); err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		if err := w.openFile(); err != nil {
+			return err
+		}
+	}
+
+	data, err := w.enc.encode(ex, w.entries == 0)
+	if err != nil {
+		return oops.In("recording").Code(errcode.EncodeFailed).Wrapf(err, "failed to encode exchange")
+	}
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	w.entries++
+	return oops.In("recording").Code(errcode.WriteFailed).With("file", w.file.Name()).Wrap(err)
+}
+
+// Close finishes the current capture file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeFile()
+}
+
+func (w *Writer) openFile() error {
+	name := filepath.Join(w.cfg.Dir, "capture-"+time.Now().UTC().Format("20060102T150405.000000000")+w.enc.extension())
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return oops.In("recording").Code(errcode.WriteFailed).With("file", name).Wrapf(err, "failed to create capture file")
+	}
+	n, err := file.Write(w.enc.header())
+	if err != nil {
+		_ = file.Close()
+		return oops.In("recording").Code(errcode.WriteFailed).With("file", name).Wrapf(err, "failed to write capture header")
+	}
+	w.file, w.size, w.entries = file, int64(n), 0
+	w.prune()
+	return nil
+}
+
+func (w *Writer) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	_, err := w.file.Write(w.enc.footer())
+	err = oops.Join(err, w.file.Close())
+	name := w.file.Name()
+	w.file = nil
+	return oops.In("recording").Code(errcode.WriteFailed).With("file", name).Wrap(err)
+}
+
+// prune removes the oldest capture files beyond MaxFiles. File names sort
+// chronologically.
+func (w *Writer) prune() {
+	if w.cfg.MaxFiles <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(w.cfg.Dir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "capture-") && strings.HasSuffix(e.Name(), w.enc.extension()) {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	for len(names) > w.cfg.MaxFiles {
+		_ = os.Remove(filepath.Join(w.cfg.Dir, names[0]))
+		names = names[1:]
+	}
+}
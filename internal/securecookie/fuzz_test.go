@@ -0,0 +1,44 @@
+package securecookie
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func FuzzDecode(f *testing.F) {
+	c, err := New(bytes.Repeat([]byte("k"), MinKeyLength))
+	if err != nil {
+		f.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	f.Add("session", c.Encode("session", []byte("user=alice"), now.Add(time.Hour)))
+	f.Add("session", c.Encode("other", []byte("user=alice"), now.Add(time.Hour)))
+	f.Add("session", c.Encode("session", nil, now.Add(-time.Hour)))
+	f.Add("session", "")
+	f.Add("session", ".")
+	f.Add("session", "AAAAAAAAAAA.AAAA")
+	f.Fuzz(func(t *testing.T, name, encoded string) {
+		value, err := c.Decode(name, encoded, now)
+		if err != nil {
+			if value != nil {
+				t.Fatalf("Decode(%q, %q) returned a value with error %v", name, encoded, err)
+			}
+			return
+		}
+		// Anything that verifies must be what Encode produces for it.
+		enc, _, _ := strings.Cut(encoded, ".")
+		payload, err := base64.RawURLEncoding.DecodeString(enc)
+		if err != nil {
+			t.Fatalf("Decode(%q, %q) accepted an undecodable payload", name, encoded)
+		}
+		expires := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+		reencoded := c.Encode(name, value, expires)
+		if reencoded != encoded {
+			t.Fatalf("Decode(%q, %q) accepted a value Encode does not produce (%q)", name, encoded, reencoded)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+// Package securecookie encodes tamper-proof, expiring cookie values using
+// HMAC-SHA256. Values are authenticated, not encrypted.
+package securecookie
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// MinKeyLength is the minimum accepted signing key length in bytes.
+const MinKeyLength = 32
+
+// Codec signs and verifies cookie values.
+type Codec struct {
+	key []byte
+}
+
+// New creates a Codec with the given signing key.
+func New(key []byte) (*Codec, error) {
+	if len(key) < MinKeyLength {
+		return nil, oops.
+			In("securecookie").
+			Code(errcode.KeyTooShort).
+			With("length", len(key)).
+			Errorf("cookie signing key must be at least %d bytes", MinKeyLength)
+	}
+	return &Codec{key: key}, nil
+}
+
+// Encode returns a signed representation of value for the cookie name that
+// stops verifying after expires.
+func (c *Codec) Encode(name string, value []byte, expires time.Time) string {
+	payload := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	payload = append(payload, value...)
+	enc := base64.RawURLEncoding.EncodeToString(payload)
+	return enc + "." + base64.RawURLEncoding.EncodeToString(c.sign(name, enc))
+}
+
+// Decode verifies encoded for the cookie name and returns its value.
+func (c *Codec) Decode(name, encoded string, now time.Time) ([]byte, error) {
+	enc, sig, ok := strings.Cut(encoded, ".")
+	if !ok {
+		return nil, oops.In("securecookie").Code(errcode.Malformed).Errorf("malformed cookie value")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, c.sign(name, enc)) {
+		return nil, oops.In("securecookie").Code(errcode.BadSignature).Errorf("invalid cookie signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(payload) < 8 {
+		return nil, oops.In("securecookie").Code(errcode.Malformed).Errorf("malformed cookie payload")
+	}
+	if expires := int64(binary.BigEndian.Uint64(payload)); now.Unix() >= expires {
+		return nil, oops.In("securecookie").Code(errcode.Expired).With("expires", time.Unix(expires, 0)).Errorf("cookie expired")
+	}
+	return payload[8:], nil
+}
+
+func (c *Codec) sign(name, enc string) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(enc))
+	return h.Sum(nil)
+}
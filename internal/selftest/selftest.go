@@ -0,0 +1,239 @@
+// Package selftest runs synthetic ext_proc exchanges against a processor
+// in-process over a real gRPC stream, for use as a deep health probe or a
+// release gate.
+package selftest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const bufSize = 1 << 20
+
+// Request is an alias for the ext_proc request message.
+type Request = envoy_service_proc_v3.ProcessingRequest
+
+// Response is an alias for the ext_proc response message.
+type Response = envoy_service_proc_v3.ProcessingResponse
+
+// Case is a single synthetic exchange. Requests are sent one at a time on a
+// fresh stream and Expect receives the responses in the same order.
+type Case struct {
+	Name     string
+	Requests []*Request
+	Expect   func(responses []*Response) error
+}
+
+// Run executes cases against factory and writes a PASS/FAIL report to out.
+// It returns an error if any case fails.
+func Run(ctx context.Context, factory extproc.ProcessorFactory, cases []Case, out io.Writer, log zerolog.Logger) error {
+	lis := bufconn.Listen(bufSize)
+	gs := grpc.NewServer()
+	envoy_service_proc_v3.RegisterExternalProcessorServer(gs, extproc.NewServer(factory, log))
+	go func() {
+		_ = gs.Serve(lis)
+	}()
+	defer gs.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///selftest",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		return oops.In("selftest").Code(errcode.DialFailed).Wrapf(err, "failed to dial in-process server")
+	}
+	defer conn.Close()
+	client := envoy_service_proc_v3.NewExternalProcessorClient(conn)
+
+	var failed []string
+	for _, c := range cases {
+		responses, err := runCase(ctx, client, c)
+		if err == nil && c.Expect != nil {
+			err = c.Expect(responses)
+		}
+		if err != nil {
+			failed = append(failed, c.Name)
+			fmt.Fprintf(out, "FAIL %s: %v\n", c.Name, err)
+		} else {
+			fmt.Fprintf(out, "PASS %s\n", c.Name)
+		}
+		for i, resp := range responses {
+			fmt.Fprintf(out, "  [%d] %s\n", i, DescribeResponse(resp))
+		}
+	}
+
+	if len(failed) > 0 {
+		return oops.
+			In("selftest").
+			Code(errcode.SelftestFailed).
+			With("failed", failed).
+			Errorf("%d of %d self-test cases failed", len(failed), len(cases))
+	}
+	return nil
+}
+
+func runCase(
+	ctx context.Context,
+	client envoy_service_proc_v3.ExternalProcessorClient,
+	c Case,
+) ([]*Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.Process(ctx)
+	if err != nil {
+		return nil, oops.Code(errcode.StreamFailed).Wrapf(err, "failed to open stream")
+	}
+	responses := make([]*Response, 0, len(c.Requests))
+	for _, req := range c.Requests {
+		if err := stream.Send(req); err != nil {
+			return responses, oops.Code(errcode.StreamFailed).Wrapf(err, "failed to send request")
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return responses, oops.Code(errcode.StreamFailed).Wrapf(err, "failed to receive response")
+		}
+		responses = append(responses, resp)
+	}
+	_ = stream.CloseSend()
+	return responses, nil
+}
+
+// RequestHeaders builds a request headers message with the given ext_proc
+// attributes and header key/value pairs.
+func RequestHeaders(attrs map[string]string, headers ...string) *Request {
+	return &envoy_service_proc_v3.ProcessingRequest{
+		Request: &envoy_service_proc_v3.ProcessingRequest_RequestHeaders{
+			RequestHeaders: httpHeaders(headers),
+		},
+		Attributes: attributes(attrs),
+	}
+}
+
+// ResponseHeaders builds a response headers message with the given ext_proc
+// attributes and header key/value pairs.
+func ResponseHeaders(attrs map[string]string, headers ...string) *Request {
+	return &envoy_service_proc_v3.ProcessingRequest{
+		Request: &envoy_service_proc_v3.ProcessingRequest_ResponseHeaders{
+			ResponseHeaders: httpHeaders(headers),
+		},
+		Attributes: attributes(attrs),
+	}
+}
+
+func httpHeaders(kv []string) *envoy_service_proc_v3.HttpHeaders {
+	headers := make([]*envoy_api_v3_core.HeaderValue, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		headers = append(headers, &envoy_api_v3_core.HeaderValue{
+			Key:      kv[i],
+			RawValue: []byte(kv[i+1]),
+		})
+	}
+	return &envoy_service_proc_v3.HttpHeaders{
+		Headers: &envoy_api_v3_core.HeaderMap{Headers: headers},
+	}
+}
+
+func attributes(attrs map[string]string) map[string]*structpb.Struct {
+	if len(attrs) == 0 {
+		return nil
+	}
+	fields := make(map[string]*structpb.Value, len(attrs))
+	for k, v := range attrs {
+		fields[k] = structpb.NewStringValue(v)
+	}
+	return map[string]*structpb.Struct{
+		extproc.EnvoyAttributesKey: {Fields: fields},
+	}
+}
+
+// commonResponse returns the CommonResponse of a headers/body response.
+func commonResponse(resp *envoy_service_proc_v3.ProcessingResponse) *envoy_service_proc_v3.CommonResponse {
+	switch v := resp.GetResponse().(type) {
+	case *envoy_service_proc_v3.ProcessingResponse_RequestHeaders:
+		return v.RequestHeaders.GetResponse()
+	case *envoy_service_proc_v3.ProcessingResponse_ResponseHeaders:
+		return v.ResponseHeaders.GetResponse()
+	case *envoy_service_proc_v3.ProcessingResponse_RequestBody:
+		return v.RequestBody.GetResponse()
+	case *envoy_service_proc_v3.ProcessingResponse_ResponseBody:
+		return v.ResponseBody.GetResponse()
+	}
+	return nil
+}
+
+// SetHeaders returns the header mutations of a response as a map.
+func SetHeaders(resp *envoy_service_proc_v3.ProcessingResponse) map[string]string {
+	out := make(map[string]string)
+	for _, opt := range commonResponse(resp).GetHeaderMutation().GetSetHeaders() {
+		out[opt.GetHeader().GetKey()] = headerValue(opt.GetHeader())
+	}
+	return out
+}
+
+// ExpectHeaders returns an Expect function asserting that the response at
+// index set each of want's headers to the given value.
+func ExpectHeaders(index int, want map[string]string) func([]*Response) error {
+	return func(responses []*Response) error {
+		if index >= len(responses) {
+			return oops.Code(errcode.SelftestFailed).Errorf("missing response %d", index)
+		}
+		if responses[index].GetImmediateResponse() != nil {
+			return oops.Code(errcode.SelftestFailed).Errorf("response %d: unexpected immediate response", index)
+		}
+		got := SetHeaders(responses[index])
+		for key, value := range want {
+			if got[key] != value {
+				return oops.Code(errcode.SelftestFailed).Errorf("response %d: header %q = %q, want %q", index, key, got[key], value)
+			}
+		}
+		return nil
+	}
+}
+
+// DescribeResponse renders the decision and mutations of a response on one line.
+func DescribeResponse(resp *envoy_service_proc_v3.ProcessingResponse) string {
+	if ir := resp.GetImmediateResponse(); ir != nil {
+		return fmt.Sprintf("immediate_response status=%d", ir.GetStatus().GetCode())
+	}
+	common := commonResponse(resp)
+	parts := []string{fmt.Sprintf("status=%s", common.GetStatus())}
+
+	set := SetHeaders(resp)
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("set %s=%q", key, set[key]))
+	}
+	for _, key := range common.GetHeaderMutation().GetRemoveHeaders() {
+		parts = append(parts, fmt.Sprintf("remove %s", key))
+	}
+	return strings.Join(parts, " ")
+}
+
+func headerValue(hdr *envoy_api_v3_core.HeaderValue) string {
+	if raw := hdr.GetRawValue(); len(raw) > 0 {
+		return string(raw)
+	}
+	return hdr.GetValue()
+}
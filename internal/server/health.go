@@ -3,13 +3,19 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
 	"github.com/mnixry/envoy-ext-procs/internal/tlsutil"
 	"github.com/rs/zerolog"
+	"github.com/samber/oops"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
@@ -32,28 +38,105 @@ func (s *HealthServer) Watch(req *grpc_health_v1.HealthCheckRequest, srv grpc_he
 	})
 }
 
+// healthStatus is the /healthz response body.
+type healthStatus struct {
+	Status      string             `json:"status"`
+	Certificate *certificateStatus `json:"certificate,omitempty"`
+}
+
+// certificateStatus describes the served gRPC certificate.
+type certificateStatus struct {
+	NotAfter         time.Time `json:"not_after"`
+	ExpiresInSeconds int64     `json:"expires_in_seconds"`
+	Expired          bool      `json:"expired"`
+}
+
+// HealthDial configures how the health check verifies the local gRPC
+// server: against the CA pool if set, and against SPKIPins if set.
+// Without either, the server must present the certificate Cert serves.
+// Insecure dials a plaintext server. ClientCert, if set, provides the
+// certificate presented to a server verifying clients.
+type HealthDial struct {
+	Insecure   bool
+	ClientCert func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	CA         *tlsutil.CAWatcher
+	ServerName string
+	SPKIPins   []tlsutil.SPKIPin
+	Cert       *tlsutil.CertWatcher
+}
+
+// tlsConfig builds the dial's TLS configuration with the current CA pool,
+// so rotations are picked up.
+func (d HealthDial) tlsConfig() *tls.Config {
+	cfg := &tls.Config{ServerName: d.ServerName, GetClientCertificate: d.ClientCert}
+	if d.CA != nil {
+		cfg.RootCAs = d.CA.Pool()
+	}
+
+	var verify func([][]byte, [][]*x509.Certificate) error
+	switch {
+	case len(d.SPKIPins) > 0:
+		verify = tlsutil.VerifySPKIPins(d.SPKIPins)
+	case cfg.RootCAs == nil && d.Cert != nil:
+		verify = d.Cert.VerifyServed(d.ServerName)
+	case cfg.RootCAs == nil:
+		verify = func([][]byte, [][]*x509.Certificate) error {
+			return oops.In("server").Code(errcode.PinMismatch).Errorf("no CA bundle, SPKI pin or served certificate to verify the health check peer")
+		}
+	}
+	if cfg.RootCAs == nil {
+		// The chain is not verified by a CA, only by verify.
+		cfg.InsecureSkipVerify = true
+	}
+	cfg.VerifyPeerCertificate = verify
+	return cfg
+}
+
+// credentials returns the dial's transport credentials.
+func (d HealthDial) credentials() credentials.TransportCredentials {
+	if d.Insecure {
+		return insecure.NewCredentials()
+	}
+	return credentials.NewTLS(d.tlsConfig())
+}
+
 // HealthCheckHandler performs a health check by connecting to the local gRPC server
-// and using the standard gRPC Health Checking Protocol.
-func HealthCheckHandler(w http.ResponseWriter, r *http.Request, log zerolog.Logger, caFile string, grpcPort int, dialServerName string) {
-	tlsConfig := &tls.Config{
-		ServerName: dialServerName,
+// and using the standard gRPC Health Checking Protocol. The response body
+// reports the result and, if dial.Cert is set, the certificate's expiry.
+func HealthCheckHandler(w http.ResponseWriter, r *http.Request, log zerolog.Logger, grpcPort int, dial HealthDial) {
+	status := healthStatus{Status: grpc_health_v1.HealthCheckResponse_NOT_SERVING.String()}
+	if cert := dial.Cert; cert != nil {
+		expiresIn := cert.ExpiresIn()
+		status.Certificate = &certificateStatus{
+			NotAfter:         cert.NotAfter(),
+			ExpiresInSeconds: int64(expiresIn.Seconds()),
+			Expired:          expiresIn <= 0,
+		}
+	}
+	if grpcHealthy(log, grpcPort, dial.credentials()) {
+		status.Status = grpc_health_v1.HealthCheckResponse_SERVING.String()
 	}
-	if certPool, err := tlsutil.LoadCA(caFile); err == nil {
-		tlsConfig.RootCAs = certPool
-	} else {
-		log.Warn().Err(err).Msg("certificate verification disabled")
-		tlsConfig.InsecureSkipVerify = true
+
+	code := http.StatusOK
+	if status.Status != grpc_health_v1.HealthCheckResponse_SERVING.String() {
+		code = http.StatusServiceUnavailable
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
 
+// grpcHealthy checks the local gRPC server with the gRPC Health Checking
+// Protocol.
+func grpcHealthy(log zerolog.Logger, grpcPort int, creds credentials.TransportCredentials) bool {
 	opts := []grpc.DialOption{
-		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithTransportCredentials(creds),
 	}
 
 	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", grpcPort), opts...)
 	if err != nil {
 		log.Warn().Err(err).Msg("health check failed")
-		w.WriteHeader(http.StatusServiceUnavailable)
-		return
+		return false
 	}
 	defer conn.Close()
 
@@ -61,14 +144,7 @@ func HealthCheckHandler(w http.ResponseWriter, r *http.Request, log zerolog.Logg
 	resp, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
 	if err != nil {
 		log.Warn().Err(err).Msg("health check failed")
-		w.WriteHeader(http.StatusServiceUnavailable)
-		return
+		return false
 	}
-
-	if resp.GetStatus() == grpc_health_v1.HealthCheckResponse_SERVING {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	w.WriteHeader(http.StatusServiceUnavailable)
+	return resp.GetStatus() == grpc_health_v1.HealthCheckResponse_SERVING
 }
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/tlsutil"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// newHTTPServer creates an http.Server for the health/admin listener with the
+// configured timeouts and header limits applied.
+func newHTTPServer(port int, cfg HTTPConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// serveHTTP runs the health/admin listener, over HTTPS when a certificate
+// directory is configured, watching the certificate with opts. It blocks
+// until the server exits.
+func serveHTTP(port int, cfg HTTPConfig, handler http.Handler, log zerolog.Logger, opts ...tlsutil.CertWatcherOption) error {
+	srv := newHTTPServer(port, cfg, handler)
+
+	if cfg.ClientCAFile != "" && cfg.CertPath == "" {
+		return oops.
+			Code(errcode.InvalidConfig).
+			Errorf("--admin-client-ca-file needs --health-cert-path to serve HTTPS")
+	}
+
+	var err error
+	if cfg.CertPath != "" {
+		certWatcher, werr := tlsutil.NewCertWatcher(cfg.CertPath, log, opts...)
+		if werr != nil {
+			return oops.Wrapf(werr, "failed to create certificate watcher for %s", cfg.CertPath)
+		}
+		defer certWatcher.Close()
+
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certWatcher.GetCertificate,
+		}
+		if cfg.ClientCAFile != "" {
+			clientCA, cerr := tlsutil.NewCAWatcher(cfg.ClientCAFile, log)
+			if cerr != nil {
+				return oops.Wrapf(cerr, "failed to load admin client CA bundle")
+			}
+			// Probes and scrapers connect without a certificate.
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			srv.TLSConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				config := srv.TLSConfig.Clone()
+				config.GetConfigForClient = nil
+				config.NextProtos = []string{"h2", "http/1.1"}
+				config.ClientCAs = clientCA.Pool()
+				return config, nil
+			}
+		}
+		log.Info().Int("port", port).Bool("tls", true).Bool("client_certs", cfg.ClientCAFile != "").Msg("health check server listening")
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Info().Int("port", port).Bool("tls", false).Msg("health check server listening")
+		err = srv.ListenAndServe()
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return oops.Code(errcode.ListenFailed).Wrapf(err, "failed to serve health check on port %d", port)
+	}
+	return nil
+}
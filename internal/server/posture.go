@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mnixry/envoy-ext-procs/internal/adminauth"
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/rs/zerolog"
+)
+
+// PostureSetting is a security-relevant processor setting, added by commands
+// to the posture summary.
+type PostureSetting struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Permissive marks values that let through requests the policy would
+	// reject or weaken a check, such as fail-open or log-only.
+	Permissive bool `json:"permissive,omitempty"`
+}
+
+// DecisionSetting returns the posture setting of a blocking processor's
+// decision mode, permissive unless it enforces.
+func DecisionSetting(mode extproc.DecisionMode) PostureSetting {
+	if mode == "" {
+		mode = extproc.DecisionEnforce
+	}
+	return PostureSetting{Name: "decision_mode", Value: string(mode), Permissive: mode != extproc.DecisionEnforce}
+}
+
+// timeoutPolicy resolves TimeoutAuto: processors enforcing their
+// rejections fail closed, others let overrunning messages through.
+func (cfg Config) timeoutPolicy() extproc.TimeoutPolicy {
+	switch {
+	case cfg.TimeoutPolicy != extproc.TimeoutAuto:
+		return cfg.TimeoutPolicy
+	case cfg.blocking():
+		return extproc.TimeoutDeny
+	default:
+		return extproc.TimeoutContinue
+	}
+}
+
+// blocking reports whether the processor enforces its rejections.
+func (cfg Config) blocking() bool {
+	for _, s := range cfg.Posture {
+		if s.Name == "decision_mode" && !s.Permissive {
+			return true
+		}
+	}
+	return false
+}
+
+// Posture summarizes the effective security-relevant configuration, logged
+// at startup and served at /admin/posture so misconfigurations stand out.
+type Posture struct {
+	GRPCTLS bool `json:"grpc_tls"`
+	// ClientAuth is require, optional or off.
+	ClientAuth      string `json:"client_auth"`
+	ClientAllowlist bool   `json:"client_allowlist"`
+	// Revocation is off, soft-fail or hard-fail.
+	Revocation string `json:"revocation"`
+	// ExpiredCerts is serve or reject.
+	ExpiredCerts string `json:"expired_certs"`
+	AdminTLS     bool   `json:"admin_tls"`
+	// AdminAuth is how state-changing admin requests authenticate: token,
+	// client-cert, token+client-cert or loopback-only.
+	AdminAuth           string `json:"admin_auth"`
+	RecentMessageBodies bool   `json:"recent_message_bodies"`
+	TracingTLS          bool   `json:"tracing_tls"`
+	// PhaseTimeout is off, continue or deny.
+	PhaseTimeout string           `json:"phase_timeout"`
+	Settings     []PostureSetting `json:"settings,omitempty"`
+	Warnings     []string         `json:"warnings,omitempty"`
+}
+
+// NewPosture builds the posture summary of cfg, with a warning for every
+// risky setting or combination.
+func NewPosture(cfg Config) Posture {
+	p := Posture{
+		GRPCTLS:             !cfg.Insecure,
+		ClientAuth:          "off",
+		ClientAllowlist:     len(cfg.ClientAllowedSANs) > 0 || len(cfg.ClientAllowedSPIFFEIDs) > 0,
+		Revocation:          "off",
+		ExpiredCerts:        "serve",
+		PhaseTimeout:        "off",
+		AdminTLS:            cfg.HTTP.CertPath != "",
+		AdminAuth:           adminAuth(cfg.Admin.Auth),
+		RecentMessageBodies: cfg.Admin.RecentMessages > 0 && cfg.Admin.RecentIncludeBody,
+		TracingTLS:          cfg.Metrics.Tracing.Endpoint != "" && !cfg.Metrics.Tracing.Insecure,
+		Settings:            cfg.Posture,
+	}
+	if p.GRPCTLS {
+		switch {
+		case cfg.ClientCAFile == "":
+		case cfg.ClientAuthOptional:
+			p.ClientAuth = "optional"
+		default:
+			p.ClientAuth = "require"
+		}
+		if cfg.Revocation.Enabled() {
+			p.Revocation = "hard-fail"
+			if cfg.Revocation.SoftFail {
+				p.Revocation = "soft-fail"
+			}
+		}
+		if cfg.CertExpiry.RejectExpired {
+			p.ExpiredCerts = "reject"
+		}
+	}
+
+	if cfg.PhaseTimeout > 0 {
+		p.PhaseTimeout = "continue"
+		if cfg.timeoutPolicy() == extproc.TimeoutDeny {
+			p.PhaseTimeout = "deny"
+		}
+	}
+
+	if !p.GRPCTLS {
+		p.Warnings = append(p.Warnings, "gRPC is served without TLS")
+	} else if p.ClientAuth == "optional" {
+		p.Warnings = append(p.Warnings, "gRPC client certificates are optional")
+	}
+	if p.PhaseTimeout == "continue" && cfg.blocking() {
+		p.Warnings = append(p.Warnings, "requests the processor rejects are let through when it overruns the phase timeout")
+	}
+	if p.RecentMessageBodies && !p.AdminTLS {
+		p.Warnings = append(p.Warnings, "recorded message bodies are served over plaintext HTTP")
+	}
+	if cfg.Admin.Auth.Token != "" && !p.AdminTLS {
+		p.Warnings = append(p.Warnings, "the admin token is sent over plaintext HTTP")
+	}
+	if cfg.Metrics.Tracing.Endpoint != "" && !p.TracingTLS {
+		p.Warnings = append(p.Warnings, "traces are exported without TLS")
+	}
+	for _, s := range p.Settings {
+		if !s.Permissive {
+			continue
+		}
+		if p.ClientAuth != "require" {
+			p.Warnings = append(p.Warnings, s.Name+"="+s.Value+" is permissive and gRPC clients are not authenticated")
+		} else {
+			p.Warnings = append(p.Warnings, s.Name+"="+s.Value+" is permissive")
+		}
+	}
+	return p
+}
+
+// adminAuth returns the Posture.AdminAuth of cfg.
+func adminAuth(cfg adminauth.Config) string {
+	switch {
+	case cfg.Token != "" && cfg.ClientCerts:
+		return "token+client-cert"
+	case cfg.Token != "":
+		return "token"
+	case cfg.ClientCerts:
+		return "client-cert"
+	default:
+		return "loopback-only"
+	}
+}
+
+// Log logs the posture once, and each warning on its own.
+func (p Posture) Log(log zerolog.Logger) {
+	settings := zerolog.Dict()
+	for _, s := range p.Settings {
+		settings = settings.Str(s.Name, s.Value)
+	}
+	log.Info().
+		Bool("grpc_tls", p.GRPCTLS).
+		Str("client_auth", p.ClientAuth).
+		Bool("client_allowlist", p.ClientAllowlist).
+		Str("revocation", p.Revocation).
+		Str("expired_certs", p.ExpiredCerts).
+		Str("phase_timeout", p.PhaseTimeout).
+		Bool("admin_tls", p.AdminTLS).
+		Str("admin_auth", p.AdminAuth).
+		Bool("recent_message_bodies", p.RecentMessageBodies).
+		Bool("tracing_tls", p.TracingTLS).
+		Dict("settings", settings).
+		Int("warnings", len(p.Warnings)).
+		Msg("security posture")
+	for _, w := range p.Warnings {
+		log.Warn().Str("warning", w).Msg("security posture warning")
+	}
+}
+
+// ServeHTTP serves the posture as JSON.
+func (p Posture) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// Ensure Posture implements http.Handler.
+var _ http.Handler = Posture{}
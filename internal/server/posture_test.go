@@ -0,0 +1,61 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+)
+
+func TestNewPosture(t *testing.T) {
+	logOnly := DecisionSetting(extproc.DecisionLogOnly)
+
+	p := NewPosture(Config{Insecure: true, Posture: []PostureSetting{logOnly}})
+	if p.GRPCTLS || p.ClientAuth != "off" {
+		t.Errorf("insecure posture = %+v", p)
+	}
+	want := []string{
+		"gRPC is served without TLS",
+		"decision_mode=log-only is permissive and gRPC clients are not authenticated",
+	}
+	if !slices.Equal(p.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", p.Warnings, want)
+	}
+
+	p = NewPosture(Config{
+		CertPath:     "/certs",
+		ClientCAFile: "/certs/ca.crt",
+		Posture:      []PostureSetting{DecisionSetting("")},
+	})
+	if !p.GRPCTLS || p.ClientAuth != "require" || len(p.Warnings) != 0 {
+		t.Errorf("mTLS posture = %+v", p)
+	}
+}
+
+func TestPhaseTimeoutPolicy(t *testing.T) {
+	blocking := []PostureSetting{DecisionSetting("")}
+	for _, tt := range []struct {
+		policy  extproc.TimeoutPolicy
+		posture []PostureSetting
+		want    string
+		warns   bool
+	}{
+		{extproc.TimeoutAuto, nil, "continue", false},
+		{extproc.TimeoutAuto, blocking, "deny", false},
+		{extproc.TimeoutAuto, []PostureSetting{DecisionSetting(extproc.DecisionLogOnly)}, "continue", false},
+		{extproc.TimeoutContinue, blocking, "continue", true},
+	} {
+		p := NewPosture(Config{
+			CertPath:      "/certs",
+			ClientCAFile:  "/certs/ca.crt",
+			PhaseTimeout:  time.Second,
+			TimeoutPolicy: tt.policy,
+			Posture:       tt.posture,
+		})
+		warns := slices.Contains(p.Warnings, "requests the processor rejects are let through when it overruns the phase timeout")
+		if p.PhaseTimeout != tt.want || warns != tt.warns {
+			t.Errorf("policy %d with %v: phase timeout %q, warnings %q", tt.policy, tt.posture, p.PhaseTimeout, p.Warnings)
+		}
+	}
+}
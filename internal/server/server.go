@@ -2,13 +2,26 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
+	"time"
 
 	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/adminauth"
+	"github.com/mnixry/envoy-ext-procs/internal/audit"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
 	"github.com/mnixry/envoy-ext-procs/internal/extproc"
+	"github.com/mnixry/envoy-ext-procs/internal/kube"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/mnixry/envoy-ext-procs/internal/pathtemplate"
 	"github.com/mnixry/envoy-ext-procs/internal/tlsutil"
+	"github.com/mnixry/envoy-ext-procs/internal/tracing"
 	"github.com/rs/zerolog"
 	"github.com/samber/oops"
 	"google.golang.org/grpc"
@@ -17,45 +30,402 @@ import (
 
 // Config holds the common server configuration.
 type Config struct {
-	GRPCPort       int
-	CertPath       string
-	CAFile         string
+	GRPCPort int
+	CertPath string
+	// Insecure serves gRPC in plaintext and ignores CertPath and the TLS
+	// settings of the gRPC listener.
+	Insecure bool
+	CAFile   string
+	// CertExpiry controls expiry warnings and handling of the gRPC and
+	// HTTPS certificates.
+	CertExpiry tlsutil.ExpiryConfig
+	// CertWatch watches the gRPC and HTTPS certificate directories for
+	// changes instead of checking the files on every handshake.
+	CertWatch bool
+	// KeyPassphrase decrypts the gRPC and HTTPS keys; nil if they are not
+	// encrypted.
+	KeyPassphrase tlsutil.PassphraseFunc
+	// OCSPStaple staples OCSP responses to the gRPC and HTTPS certificates.
+	OCSPStaple bool
+	// ClientCAFile, if set, makes the gRPC listener verify client
+	// certificates against it; ClientAuthOptional still admits clients
+	// without one. ClientAllowedSANs and ClientAllowedSPIFFEIDs restrict
+	// the verified certificates admitted.
+	ClientCAFile           string
+	ClientAuthOptional     bool
+	ClientAllowedSANs      []string
+	ClientAllowedSPIFFEIDs []string
+	// Revocation checks client certificates of the gRPC listener.
+	Revocation tlsutil.RevocationConfig
+	// MemoryBudget bounds body bytes buffered across streams, and whatever
+	// the command accounts against it such as log queues; nil disables.
+	MemoryBudget *extproc.MemoryBudget
+	// Dispatch and DispatchQueue control how messages of a stream are
+	// handled and answered.
+	Dispatch      extproc.DispatchMode
+	DispatchQueue int
+	// PhaseTimeout bounds the time the processor spends on a message;
+	// overrunning messages get the TimeoutPolicy fallback, with TimeoutAuto
+	// resolved from Posture. 0 disables.
+	PhaseTimeout   time.Duration
+	TimeoutPolicy  extproc.TimeoutPolicy
 	HealthPort     int
 	DialServerName string
+	// DialSPKIPins are SPKI pins the health check requires of the gRPC
+	// server's chain.
+	DialSPKIPins []string
+	// DialCertPath holds the client certificate the health check presents
+	// under mTLS; empty presents the served certificate.
+	DialCertPath string
+	HTTP         HTTPConfig
+	Admin        AdminConfig
+	Metrics      MetricsConfig
+	// Posture holds security-relevant processor settings, added by commands
+	// to the posture summary.
+	Posture []PostureSetting
 }
 
-// Run starts the gRPC server and health check HTTP server.
+// MetricsConfig holds Prometheus metrics and tracing settings.
+type MetricsConfig struct {
+	Enabled      bool
+	PathTemplate pathtemplate.Config
+	// Tracing exports a span per processed message; an empty Endpoint
+	// disables it.
+	Tracing tracing.Config
+}
+
+// AdminConfig holds settings for the admin API on the health listener.
+type AdminConfig struct {
+	RecentMessages    int
+	RecentRedact      []string
+	RecentIncludeBody bool
+	// Watchdog checks for stream and goroutine leaks; a zero Interval
+	// disables it.
+	Watchdog extproc.WatchdogConfig
+	// Handlers are extra admin endpoints keyed by ServeMux pattern, added by
+	// commands for processor-specific introspection.
+	Handlers map[string]http.Handler
+	// Changes configures the runtime configuration change history.
+	Changes audit.Config
+	// Auth guards the admin requests changing runtime state.
+	Auth adminauth.Config
+}
+
+// HTTPConfig holds hardening settings for the health/admin HTTP listener.
+type HTTPConfig struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// CertPath, if set, serves the listener over HTTPS using server.crt and
+	// server.key from that directory.
+	CertPath string
+	// ClientCAFile, with CertPath, verifies client certificates presented to
+	// the listener; they are optional, as probes do not have one.
+	ClientCAFile string
+}
+
+// NewConfig builds a Config from the shared CLI configuration blocks.
+func NewConfig(grpcCfg config.GRPCConfig, healthCfg config.HealthConfig, adminCfg config.AdminConfig, metricsCfg config.MetricsConfig) Config {
+	// The flag is an enum, so the mode always parses.
+	dispatch, _ := extproc.ParseDispatchMode(grpcCfg.Dispatch)
+	timeoutPolicy, _ := extproc.ParseTimeoutPolicy(grpcCfg.PhaseTimeoutPolicy)
+	return Config{
+		GRPCPort: grpcCfg.Port,
+		CertPath: grpcCfg.CertPath,
+		Insecure: grpcCfg.Insecure,
+		CAFile:   grpcCfg.CAFile,
+		CertExpiry: tlsutil.ExpiryConfig{
+			WarnBefore:    grpcCfg.CertExpiryWarn,
+			CheckInterval: grpcCfg.CertExpiryCheck,
+			RejectExpired: grpcCfg.CertExpired == "reject",
+		},
+		CertWatch:              grpcCfg.CertWatch,
+		KeyPassphrase:          keyPassphrase(grpcCfg.KeyPassphrase, grpcCfg.KeyPassphraseFile),
+		OCSPStaple:             grpcCfg.OCSPStaple,
+		ClientCAFile:           grpcCfg.ClientCAFile,
+		ClientAuthOptional:     grpcCfg.ClientAuth == "optional",
+		ClientAllowedSANs:      grpcCfg.ClientAllowedSANs,
+		ClientAllowedSPIFFEIDs: grpcCfg.ClientAllowedSPIFFEIDs,
+		Revocation: tlsutil.RevocationConfig{
+			CRLFiles:  grpcCfg.ClientCRLFiles,
+			FetchCRLs: grpcCfg.ClientCRLFetch,
+			OCSP:      grpcCfg.ClientOCSP,
+			SoftFail:  grpcCfg.ClientRevocationFail == "soft",
+			Timeout:   grpcCfg.RevocationTimeout,
+			CacheTTL:  grpcCfg.RevocationCacheTTL,
+		},
+		MemoryBudget:   memoryBudget(grpcCfg.MemoryBudget),
+		Dispatch:       dispatch,
+		DispatchQueue:  grpcCfg.DispatchQueue,
+		PhaseTimeout:   grpcCfg.PhaseTimeout,
+		TimeoutPolicy:  timeoutPolicy,
+		HealthPort:     healthCfg.Port,
+		DialServerName: healthCfg.DialServerName,
+		DialSPKIPins:   healthCfg.DialSPKIPins,
+		DialCertPath:   healthCfg.DialCertPath,
+		HTTP: HTTPConfig{
+			ReadTimeout:       healthCfg.ReadTimeout,
+			ReadHeaderTimeout: healthCfg.ReadHeaderTimeout,
+			WriteTimeout:      healthCfg.WriteTimeout,
+			IdleTimeout:       healthCfg.IdleTimeout,
+			MaxHeaderBytes:    healthCfg.MaxHeaderBytes,
+			CertPath:          healthCfg.CertPath,
+			ClientCAFile:      adminCfg.ClientCAFile,
+		},
+		Admin: AdminConfig{
+			RecentMessages:    adminCfg.RecentMessages,
+			RecentRedact:      adminCfg.RecentRedact,
+			RecentIncludeBody: adminCfg.RecentIncludeBody,
+			Watchdog: extproc.WatchdogConfig{
+				Interval:      adminCfg.WatchdogInterval,
+				StaleAfter:    adminCfg.WatchdogStaleAfter,
+				GrowthSamples: adminCfg.WatchdogGrowthSamples,
+				MaxGoroutines: adminCfg.WatchdogMaxGoroutines,
+			},
+			Changes: audit.Config{
+				HistorySize: adminCfg.ChangeHistory,
+				RedactKeys:  adminCfg.ChangeRedactKeys,
+			},
+			Auth: adminauth.Config{
+				Token:       adminCfg.Token,
+				ClientCerts: adminCfg.ClientCAFile != "",
+			},
+		},
+		Metrics: MetricsConfig{
+			Enabled: metricsCfg.Enabled,
+			PathTemplate: pathtemplate.Config{
+				Patterns:     metricsCfg.PathPatterns,
+				OpenAPIFile:  metricsCfg.OpenAPIFile,
+				Heuristics:   metricsCfg.Heuristics,
+				MaxTemplates: metricsCfg.MaxPaths,
+			},
+			Tracing: tracing.Config{
+				Endpoint:    metricsCfg.Tracing.Endpoint,
+				Protocol:    metricsCfg.Tracing.Protocol,
+				Insecure:    metricsCfg.Tracing.Insecure,
+				Headers:     metricsCfg.Tracing.Headers,
+				ServiceName: metricsCfg.Tracing.ServiceName,
+				SampleRatio: metricsCfg.Tracing.SampleRatio,
+				Propagators: metricsCfg.Tracing.Propagators,
+				Timeout:     metricsCfg.Tracing.Timeout,
+			},
+		},
+	}
+}
+
+// memoryBudget returns a budget of mb megabytes, or nil for 0.
+func memoryBudget(mb int) *extproc.MemoryBudget {
+	if mb <= 0 {
+		return nil
+	}
+	return extproc.NewMemoryBudget(int64(mb) << 20)
+}
+
+// keyPassphrase returns the passphrase given directly or read from file, a
+// path or Secret reference; nil if neither is set.
+func keyPassphrase(value, file string) tlsutil.PassphraseFunc {
+	switch {
+	case file != "":
+		return func() ([]byte, error) {
+			data, err := kube.ReadFile(context.Background(), file)
+			if err != nil {
+				return nil, oops.With("passphrase_file", file).Wrapf(err, "failed to read key passphrase")
+			}
+			return bytes.TrimRight(data, "\r\n"), nil
+		}
+	case value != "":
+		return func() ([]byte, error) { return []byte(value), nil }
+	default:
+		return nil
+	}
+}
+
+// RegisterFunc registers gRPC services and admin HTTP handlers before the
+// servers start.
+type RegisterFunc func(gs *grpc.Server, mux *http.ServeMux)
+
+// Run starts the ext_proc gRPC server and health check HTTP server.
 // This function blocks until the health check server exits.
 func Run(cfg Config, factory extproc.ProcessorFactory, log zerolog.Logger) error {
+	serverOpts := []extproc.ServerOption{
+		extproc.WithDispatch(cfg.Dispatch, cfg.DispatchQueue),
+		extproc.WithPhaseTimeout(cfg.PhaseTimeout, cfg.timeoutPolicy()),
+	}
+	if cfg.Metrics.Enabled {
+		paths, err := pathtemplate.New(cfg.Metrics.PathTemplate)
+		if err != nil {
+			return oops.Wrapf(err, "failed to create path templater")
+		}
+		serverOpts = append(serverOpts, extproc.WithRequestMetrics(paths))
+	}
+	if cfg.Metrics.Tracing.Endpoint != "" {
+		provider, err := tracing.New(context.Background(), cfg.Metrics.Tracing)
+		if err != nil {
+			return oops.Wrapf(err, "failed to set up tracing")
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Metrics.Tracing.Timeout)
+			defer cancel()
+			if err := provider.Shutdown(ctx); err != nil {
+				log.Warn().Err(err).Msg("failed to flush spans")
+			}
+		}()
+		serverOpts = append(serverOpts, extproc.WithTracing(provider.Tracer(), provider.Propagator()))
+		log.Info().
+			Str("endpoint", cfg.Metrics.Tracing.Endpoint).
+			Str("protocol", cfg.Metrics.Tracing.Protocol).
+			Float64("sample_ratio", cfg.Metrics.Tracing.SampleRatio).
+			Msg("tracing enabled")
+	}
+	if cfg.MemoryBudget != nil {
+		serverOpts = append(serverOpts, extproc.WithMemoryBudget(cfg.MemoryBudget))
+	}
+	var watchdog *extproc.Watchdog
+	if cfg.Admin.Watchdog.Interval > 0 {
+		watchdog = extproc.NewWatchdog(cfg.Admin.Watchdog, log)
+		watchdog.Start()
+		defer watchdog.Close()
+		serverOpts = append(serverOpts, extproc.WithWatchdog(watchdog))
+	}
+
+	return Serve(cfg, log, func(gs *grpc.Server, mux *http.ServeMux) {
+		if cfg.Admin.RecentMessages > 0 {
+			recorder := extproc.NewMessageRecorder(cfg.Admin.RecentMessages, cfg.Admin.RecentRedact, cfg.Admin.RecentIncludeBody)
+			serverOpts = append(serverOpts, extproc.WithMessageRecorder(recorder))
+			mux.Handle("GET /admin/messages", recorder)
+			log.Info().Int("size", cfg.Admin.RecentMessages).Msg("recent message recorder enabled")
+		}
+		if watchdog != nil {
+			mux.Handle("GET /admin/streams", watchdog)
+		}
+		for pattern, handler := range cfg.Admin.Handlers {
+			mux.Handle(pattern, handler)
+		}
+
+		envoy_service_proc_v3.RegisterExternalProcessorServer(gs, extproc.NewServer(factory, log, serverOpts...))
+	})
+}
+
+// Serve starts a TLS gRPC server, or a plaintext one if cfg.Insecure, with
+// the services added by register, plus the gRPC health service, and the
+// health check HTTP server.
+// This function blocks until the health check server exits.
+func Serve(cfg Config, log zerolog.Logger, register RegisterFunc) error {
+	pins, err := tlsutil.ParseSPKIPins(cfg.DialSPKIPins)
+	if err != nil {
+		return oops.Wrapf(err, "invalid health check SPKI pins")
+	}
+	posture := NewPosture(cfg)
+	posture.Log(log)
+	audit.Configure(cfg.Admin.Changes, log)
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.GRPCPort))
 	if err != nil {
-		return oops.Wrapf(err, "failed to listen on port %d", cfg.GRPCPort)
+		return oops.Code(errcode.ListenFailed).Wrapf(err, "failed to listen on port %d", cfg.GRPCPort)
 	}
 
-	certWatcher, err := tlsutil.NewCertWatcher(cfg.CertPath, log)
-	if err != nil {
-		return oops.Wrapf(err, "failed to create certificate watcher for %s", cfg.CertPath)
+	watcherOpts := []tlsutil.CertWatcherOption{tlsutil.WithExpiry(cfg.CertExpiry)}
+	if cfg.CertWatch {
+		watcherOpts = append(watcherOpts, tlsutil.WithFileWatch())
+	}
+	if cfg.KeyPassphrase != nil {
+		watcherOpts = append(watcherOpts, tlsutil.WithPassphrase(cfg.KeyPassphrase))
+	}
+	if cfg.OCSPStaple {
+		watcherOpts = append(watcherOpts, tlsutil.WithOCSPStapling(tlsutil.OCSPConfig{Timeout: cfg.Revocation.Timeout}))
 	}
-	defer certWatcher.Close()
 
-	server := extproc.NewServer(factory, log)
-	gs := grpc.NewServer(grpc.Creds(certWatcher.TransportCredentials()))
-	envoy_service_proc_v3.RegisterExternalProcessorServer(gs, server)
+	var certWatcher *tlsutil.CertWatcher
+	var clientCert func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	var gs *grpc.Server
+	if cfg.Insecure {
+		log.Warn().
+			Int("port", cfg.GRPCPort).
+			Msg("!!! gRPC server is running WITHOUT TLS: ext_proc traffic is unencrypted and clients are not authenticated; use --grpc-insecure only in development or behind a sidecar terminating mTLS !!!")
+		gs = grpc.NewServer()
+	} else {
+		grpcOpts := watcherOpts
+		if cfg.Revocation.Enabled() {
+			checker, err := tlsutil.NewRevocationChecker(cfg.Revocation, log)
+			if err != nil {
+				return oops.Wrapf(err, "failed to create revocation checker")
+			}
+			grpcOpts = append(slices.Clip(grpcOpts), tlsutil.WithRevocationChecker(checker))
+		}
+		if cfg.ClientCAFile != "" {
+			clientCA, err := tlsutil.NewCAWatcher(cfg.ClientCAFile, log)
+			if err != nil {
+				return oops.Wrapf(err, "failed to load client CA bundle")
+			}
+			grpcOpts = append(slices.Clip(grpcOpts), tlsutil.WithClientAuth(tlsutil.ClientAuthConfig{
+				CA:               clientCA,
+				Optional:         cfg.ClientAuthOptional,
+				AllowedSANs:      cfg.ClientAllowedSANs,
+				AllowedSPIFFEIDs: cfg.ClientAllowedSPIFFEIDs,
+			}))
+			log.Info().
+				Str("client_ca_file", cfg.ClientCAFile).
+				Bool("optional", cfg.ClientAuthOptional).
+				Strs("allowed_sans", cfg.ClientAllowedSANs).
+				Strs("allowed_spiffe_ids", cfg.ClientAllowedSPIFFEIDs).
+				Msg("gRPC client certificate verification enabled")
+		}
+
+		certWatcher, err = tlsutil.NewCertWatcher(cfg.CertPath, log, grpcOpts...)
+		if err != nil {
+			return oops.Wrapf(err, "failed to create certificate watcher for %s", cfg.CertPath)
+		}
+		defer certWatcher.Close()
+		gs = grpc.NewServer(grpc.Creds(certWatcher.TransportCredentials()))
+
+		if cfg.ClientCAFile != "" {
+			// The health check is a client too.
+			clientCert = certWatcher.GetClientCertificate
+			if cfg.DialCertPath != "" {
+				dialCert, err := tlsutil.NewCertWatcher(cfg.DialCertPath, log, watcherOpts...)
+				if err != nil {
+					return oops.Wrapf(err, "failed to create certificate watcher for %s", cfg.DialCertPath)
+				}
+				defer dialCert.Close()
+				clientCert = dialCert.GetClientCertificate
+			}
+		}
+	}
+
+	mux := http.NewServeMux()
+	register(gs, mux)
 	grpc_health_v1.RegisterHealthServer(gs, &HealthServer{})
 
-	log.Info().Int("port", cfg.GRPCPort).Msg("gRPC server listening")
+	log.Info().Int("port", cfg.GRPCPort).Bool("tls", !cfg.Insecure).Msg("gRPC server listening")
 	go func() {
 		if err := gs.Serve(lis); err != nil {
 			log.Fatal().Err(err).Msg("failed to serve gRPC")
 		}
 	}()
 
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		HealthCheckHandler(w, r, log, cfg.CAFile, cfg.GRPCPort, cfg.DialServerName)
-	})
-	log.Info().Int("port", cfg.HealthPort).Msg("health check server listening")
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.HealthPort), nil); err != nil {
-		return oops.Wrapf(err, "failed to serve health check on port %d", cfg.HealthPort)
+	if cfg.Metrics.Enabled {
+		mux.Handle("GET /metrics", metrics.Handler())
+	}
+	mux.Handle("GET /admin/errors", errcode.Handler())
+	mux.Handle("GET /admin/posture", posture)
+	mux.Handle("GET /admin/changes", audit.Handler())
+	var ca *tlsutil.CAWatcher
+	if cfg.CAFile != "" {
+		if ca, err = tlsutil.NewCAWatcher(cfg.CAFile, log); err != nil {
+			log.Warn().Err(err).Msg("CA bundle unusable, verifying the health check peer against the served certificate")
+		}
 	}
-	return nil
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		HealthCheckHandler(w, r, log, cfg.GRPCPort, HealthDial{
+			Insecure:   cfg.Insecure,
+			ClientCert: clientCert,
+			CA:         ca,
+			ServerName: cfg.DialServerName,
+			SPKIPins:   pins,
+			Cert:       certWatcher,
+		})
+	})
+
+	return serveHTTP(cfg.HealthPort, cfg.HTTP, adminauth.Require(cfg.Admin.Auth, mux), log, watcherOpts...)
 }
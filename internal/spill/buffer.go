@@ -0,0 +1,178 @@
+// Package spill provides a body buffer that keeps small bodies in memory and
+// moves large ones to an unlinked temporary file, so processors that must
+// see a whole body (upload scanning, signing) do not hold hundreds of
+// megabytes per stream.
+package spill
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// ErrTooLarge is returned when a write would exceed the buffer's MaxSize or
+// the shared disk budget. Processors typically answer it with 413.
+var ErrTooLarge = errors.New("spill: body exceeds buffer limit")
+
+// Config holds buffer limits.
+type Config struct {
+	// MemoryLimit is the size kept in memory before spilling to disk.
+	MemoryLimit int64
+	// MaxSize bounds the total body size; 0 means unlimited.
+	MaxSize int64
+	// Dir is where temporary files are created; empty uses os.TempDir.
+	Dir string
+	// Budget, if set, bounds the disk space used by all buffers sharing it.
+	Budget *Budget
+}
+
+// Budget is a disk space limit shared by several buffers.
+type Budget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewBudget creates a Budget of limit bytes.
+func NewBudget(limit int64) *Budget {
+	return &Budget{limit: limit}
+}
+
+// Used returns the bytes currently held on disk.
+func (b *Budget) Used() int64 {
+	return b.used.Load()
+}
+
+func (b *Budget) reserve(n int64) bool {
+	if b.used.Add(n) > b.limit {
+		b.used.Add(-n)
+		return false
+	}
+	return true
+}
+
+func (b *Budget) release(n int64) {
+	b.used.Add(-n)
+}
+
+// Buffer accumulates a body. It is not safe for concurrent use; callers
+// serialize access like the rest of their per-stream state.
+type Buffer struct {
+	cfg  Config
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+// New creates an empty Buffer.
+func New(cfg Config) *Buffer {
+	return &Buffer{cfg: cfg}
+}
+
+// Write appends p, spilling to disk once MemoryLimit is exceeded. Nothing is
+// written if the limits would be exceeded.
+func (b *Buffer) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if b.cfg.MaxSize > 0 && b.size+n > b.cfg.MaxSize {
+		return 0, ErrTooLarge
+	}
+	if b.file == nil && b.size+n <= b.cfg.MemoryLimit {
+		b.mem = append(b.mem, p...)
+		b.size += n
+		return len(p), nil
+	}
+
+	if b.file == nil {
+		if err := b.spill(n); err != nil {
+			return 0, err
+		}
+	} else if b.cfg.Budget != nil && !b.cfg.Budget.reserve(n) {
+		return 0, ErrTooLarge
+	}
+	written, err := b.file.Write(p)
+	b.size += int64(written)
+	if err != nil {
+		// Only the bytes on disk stay reserved.
+		b.releaseBudget(n - int64(written))
+		return written, oops.In("spill").Code(errcode.WriteFailed).Wrapf(err, "failed to write spill file")
+	}
+	return written, nil
+}
+
+// spill moves the in-memory bytes to a new temporary file, reserving room
+// for them and the next n bytes.
+func (b *Buffer) spill(n int64) error {
+	if b.cfg.Budget != nil && !b.cfg.Budget.reserve(b.size+n) {
+		return ErrTooLarge
+	}
+	file, err := os.CreateTemp(b.cfg.Dir, "extproc-spill-*")
+	if err != nil {
+		b.releaseBudget(b.size + n)
+		return oops.In("spill").Code(errcode.WriteFailed).With("dir", b.cfg.Dir).Wrapf(err, "failed to create spill file")
+	}
+	// The file is unlinked right away so it disappears when closed, even if
+	// the process crashes.
+	_ = os.Remove(file.Name())
+	if _, err := file.Write(b.mem); err != nil {
+		_ = file.Close()
+		b.releaseBudget(b.size + n)
+		return oops.In("spill").Code(errcode.WriteFailed).Wrapf(err, "failed to write spill file")
+	}
+	b.file, b.mem = file, nil
+	return nil
+}
+
+// Len returns the number of bytes buffered.
+func (b *Buffer) Len() int64 {
+	return b.size
+}
+
+// Spilled reports whether the body has moved to disk.
+func (b *Buffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Reader returns a reader over the buffered body. It stays valid until the
+// next Write or Close.
+func (b *Buffer) Reader() *io.SectionReader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return io.NewSectionReader(bytes.NewReader(b.mem), 0, b.size)
+}
+
+// Bytes returns the whole body, reading it back from disk if spilled.
+func (b *Buffer) Bytes() ([]byte, error) {
+	if b.file == nil {
+		return b.mem, nil
+	}
+	out := make([]byte, b.size)
+	if _, err := b.file.ReadAt(out, 0); err != nil && err != io.EOF {
+		return nil, oops.In("spill").Code(errcode.ReadFailed).Wrapf(err, "failed to read spill file")
+	}
+	return out, nil
+}
+
+// Close releases the memory, temporary file and disk budget. It is safe to
+// call more than once, typically from StreamEndHandler.OnStreamEnd.
+func (b *Buffer) Close() error {
+	b.mem = nil
+	if b.file == nil {
+		b.size = 0
+		return nil
+	}
+	err := b.file.Close()
+	b.releaseBudget(b.size)
+	b.file, b.size = nil, 0
+	return oops.In("spill").Code(errcode.WriteFailed).Wrap(err)
+}
+
+func (b *Buffer) releaseBudget(n int64) {
+	if b.cfg.Budget != nil {
+		b.cfg.Budget.release(n)
+	}
+}
@@ -0,0 +1,143 @@
+package spill
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+)
+
+func write(t *testing.T, b *Buffer, s string) {
+	t.Helper()
+	if n, err := b.Write([]byte(s)); err != nil || n != len(s) {
+		t.Fatalf("Write(%q) = %d, %v", s, n, err)
+	}
+}
+
+func contents(t *testing.T, b *Buffer) string {
+	t.Helper()
+	data, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(b.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, read) {
+		t.Errorf("Bytes = %q, Reader read %q", data, read)
+	}
+	return string(data)
+}
+
+func TestSpillThreshold(t *testing.T) {
+	dir := t.TempDir()
+	budget := NewBudget(1 << 10)
+	b := New(Config{MemoryLimit: 8, Dir: dir, Budget: budget})
+
+	write(t, b, "01234")
+	write(t, b, "567")
+	if b.Spilled() || budget.Used() != 0 {
+		t.Fatalf("spilled at the memory limit (disk used %d)", budget.Used())
+	}
+	write(t, b, "89")
+	if !b.Spilled() {
+		t.Fatal("not spilled over the memory limit")
+	}
+	write(t, b, "ab")
+	if got := contents(t, b); got != "0123456789ab" {
+		t.Errorf("body = %q", got)
+	}
+	if b.Len() != 12 || budget.Used() != 12 {
+		t.Errorf("Len = %d, disk used %d, want 12", b.Len(), budget.Used())
+	}
+	// The temporary file is unlinked as soon as it is created.
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("spill directory holds %d entries", len(entries))
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	b := New(Config{MemoryLimit: 4, MaxSize: 6, Dir: t.TempDir()})
+	write(t, b, "0123")
+	if _, err := b.Write([]byte("456")); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Write over MaxSize = %v, want ErrTooLarge", err)
+	}
+	// A refused write leaves the buffer as it was.
+	write(t, b, "45")
+	if got := contents(t, b); got != "012345" {
+		t.Errorf("body = %q", got)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	dir := t.TempDir()
+	budget := NewBudget(10)
+	a := New(Config{MemoryLimit: 2, Dir: dir, Budget: budget})
+	b := New(Config{MemoryLimit: 2, Dir: dir, Budget: budget})
+
+	write(t, a, "0123456")
+	if _, err := b.Write([]byte("0123")); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Write over the shared budget = %v, want ErrTooLarge", err)
+	}
+	if b.Spilled() || budget.Used() != 7 {
+		t.Errorf("refused spill: spilled %t, disk used %d", b.Spilled(), budget.Used())
+	}
+	write(t, b, "012")
+	if _, err := a.Write([]byte("x")); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Write to a spilled buffer over the budget = %v, want ErrTooLarge", err)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if budget.Used() != 3 {
+		t.Errorf("disk used %d after Close, want 3", budget.Used())
+	}
+	// Close is idempotent and leaves an empty buffer.
+	if err := a.Close(); err != nil || a.Len() != 0 || a.Spilled() {
+		t.Errorf("second Close = %v, Len %d, spilled %t", err, a.Len(), a.Spilled())
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if budget.Used() != 0 {
+		t.Errorf("disk used %d after closing every buffer", budget.Used())
+	}
+}
+
+func TestFailedWriteReleasesBudget(t *testing.T) {
+	budget := NewBudget(1 << 10)
+	b := New(Config{MemoryLimit: 2, Dir: t.TempDir(), Budget: budget})
+	write(t, b, "0123")
+
+	// Writes to a closed file fail without writing anything.
+	_ = b.file.Close()
+	if _, err := b.Write([]byte("4567")); !errcode.Is(err, errcode.WriteFailed) {
+		t.Fatalf("Write = %v, want %s", err, errcode.WriteFailed)
+	}
+	if budget.Used() != 4 || b.Len() != 4 {
+		t.Errorf("disk used %d, Len %d after a failed write, want 4", budget.Used(), b.Len())
+	}
+	_ = b.Close()
+	if budget.Used() != 0 {
+		t.Errorf("disk used %d after Close, want 0", budget.Used())
+	}
+}
+
+func TestMemoryOnly(t *testing.T) {
+	b := New(Config{MemoryLimit: 1 << 10})
+	write(t, b, "body")
+	if b.Spilled() {
+		t.Error("spilled under the memory limit")
+	}
+	if got := contents(t, b); got != "body" {
+		t.Errorf("body = %q", got)
+	}
+	if err := b.Close(); err != nil || b.Len() != 0 {
+		t.Errorf("Close = %v, Len %d", err, b.Len())
+	}
+}
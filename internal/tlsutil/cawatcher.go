@@ -0,0 +1,114 @@
+package tlsutil
+
+import (
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+)
+
+// CAWatcher holds a CA pool loaded with LoadCA and reloads it when the file,
+// or a file of the directory, is modified. A pool that fails to reload is
+// kept.
+type CAWatcher struct {
+	path string
+	log  zerolog.Logger
+
+	mu      sync.RWMutex
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// NewCAWatcher loads the CA file or directory at path.
+func NewCAWatcher(path string, log zerolog.Logger) (*CAWatcher, error) {
+	w := &CAWatcher{path: path, log: log.With().Str("component", "ca_watcher").Logger()}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// latestModTime returns the most recent mtime of path and, for a directory,
+// of its CA files, so files added, removed or replaced are noticed.
+func (w *CAWatcher) latestModTime() (time.Time, error) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := info.ModTime()
+	if !info.IsDir() {
+		return latest, nil
+	}
+	files, err := caFiles(w.path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (w *CAWatcher) reload() error {
+	modTime, err := w.latestModTime()
+	if err != nil {
+		return oops.In("tlsutil").Code(errcode.StatFailed).With("ca_file", w.path).Wrapf(err, "failed to stat CA files")
+	}
+	pool, err := LoadCA(w.path)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.pool, w.modTime = pool, modTime
+	w.mu.Unlock()
+	w.log.Info().Str("ca_file", w.path).Time("mod_time", modTime).Msg("CA certificates loaded")
+	return nil
+}
+
+// Pool returns the current CA pool, reloading it first if it changed.
+func (w *CAWatcher) Pool() *x509.CertPool {
+	modTime, err := w.latestModTime()
+	if err != nil {
+		w.log.Warn().Err(err).Str("ca_file", w.path).Msg("failed to stat CA files")
+	}
+	w.mu.RLock()
+	pool, changed := w.pool, err == nil && modTime.After(w.modTime)
+	w.mu.RUnlock()
+	if !changed {
+		return pool
+	}
+	if err := w.reload(); err != nil {
+		w.log.Error().Err(err).Msg("failed to reload CA certificates, keeping previous")
+		// Not retried until the files change again.
+		w.mu.Lock()
+		w.modTime = modTime
+		w.mu.Unlock()
+		return pool
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.pool
+}
+
+// Verify verifies a peer's chain, leaf first, against the current pool for
+// usage and returns the verified chains.
+func (w *CAWatcher) Verify(certs []*x509.Certificate, usage x509.ExtKeyUsage) ([][]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, oops.In("tlsutil").Code(errcode.ParseCertFailed).Errorf("no peer certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	return certs[0].Verify(x509.VerifyOptions{
+		Roots:         w.Pool(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+}
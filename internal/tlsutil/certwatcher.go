@@ -1,97 +1,276 @@
 package tlsutil
 
 import (
+	"cmp"
 	"crypto/tls"
+	"crypto/x509"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"github.com/samber/oops"
 	"google.golang.org/grpc/credentials"
 )
 
+var certExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tls_certificate_expiry_timestamp_seconds",
+	Help: "NotAfter of the served certificate as a Unix timestamp, by certificate file.",
+}, []string{"cert_file"})
+
+func init() {
+	metrics.Registry.MustRegister(certExpiry)
+}
+
+// ExpiryConfig controls how a CertWatcher handles certificate expiry.
+type ExpiryConfig struct {
+	// WarnBefore are lead times before NotAfter at which a warning is
+	// logged, once each per certificate.
+	WarnBefore []time.Duration
+	// CheckInterval is how often expiry is checked and the files are
+	// polled for rotation; zero disables the background check.
+	CheckInterval time.Duration
+	// RejectExpired fails handshakes once the certificate has expired.
+	// Otherwise the last loaded certificate keeps being served and an
+	// error is logged on every check.
+	RejectExpired bool
+}
+
+// CertWatcherOption configures a CertWatcher.
+type CertWatcherOption func(*CertWatcher)
+
+// WithExpiry enables expiry monitoring.
+func WithExpiry(cfg ExpiryConfig) CertWatcherOption {
+	return func(cw *CertWatcher) {
+		cw.expiry = cfg
+		// Leads are checked from the longest down.
+		cw.expiry.WarnBefore = slices.Clone(cfg.WarnBefore)
+		slices.SortFunc(cw.expiry.WarnBefore, func(a, b time.Duration) int { return cmp.Compare(b, a) })
+	}
+}
+
+// WithRevocationChecker checks verified client certificate chains with
+// checker. It has no effect unless client certificates are requested.
+func WithRevocationChecker(checker *RevocationChecker) CertWatcherOption {
+	return func(cw *CertWatcher) {
+		cw.checker = checker
+	}
+}
+
+// WithClock sets the clock expiry is measured on.
+func WithClock(c clock.Clock) CertWatcherOption {
+	return func(cw *CertWatcher) {
+		cw.clock = clock.Or(c)
+	}
+}
+
 // CertWatcher watches TLS certificate files and reloads them when modified.
-// It checks file mtime on each GetCertificate call—simple and reliable.
+// It checks the files on each GetCertificate call—simple and reliable—or,
+// with WithFileWatch, when the directory reports a change.
+// A reloaded certificate that has already expired is not swapped in while
+// the current one is still valid.
 type CertWatcher struct {
 	certFile string
 	keyFile  string
 	log      zerolog.Logger
+	clock    clock.Clock
+	expiry   ExpiryConfig
+	ocsp     *OCSPConfig
+	// passphrase decrypts the key; keyFile is empty for PKCS#12 bundles.
+	passphrase PassphraseFunc
+	checker    *RevocationChecker
+	clientAuth *ClientAuthConfig
+	stop       chan struct{}
+	once       sync.Once
+	// dir and opts are kept to watch further pairs of dir, selected by SNI.
+	dir  string
+	opts []CertWatcherOption
+	sni  sniPairs
+	// fileWatch watches dir for changes; watching is set while the watch
+	// runs and is shared with the pairs selected by SNI.
+	fileWatch bool
+	watching  *atomic.Bool
 
-	mu      sync.RWMutex
-	cert    *tls.Certificate
-	modTime time.Time
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	notAfter time.Time
+	files    fileStamp
+	// warned is how many of expiry.WarnBefore were reported for cert.
+	warned int
+	// stapleDue is when the OCSP staple is next fetched; stapleNext is the
+	// NextUpdate of the stapled response.
+	stapleDue  time.Time
+	stapleNext time.Time
 }
 
-// NewCertWatcher creates a new certificate watcher for the given cert directory.
-func NewCertWatcher(certPath string, log zerolog.Logger) (*CertWatcher, error) {
+// NewCertWatcher creates a new certificate watcher for the given cert
+// directory, holding server.crt and server.key, or a server.p12 bundle, as
+// the default certificate. Further pairs in the directory are served by SNI
+// (see sni.go).
+func NewCertWatcher(certPath string, log zerolog.Logger, opts ...CertWatcherOption) (*CertWatcher, error) {
+	certFile, keyFile := filepath.Join(certPath, "server.crt"), filepath.Join(certPath, "server.key")
+	if bundle := filepath.Join(certPath, "server.p12"); !exists(certFile) && exists(bundle) {
+		certFile, keyFile = bundle, ""
+	}
+	return newCertWatcher(certPath, certFile, keyFile, log.With().Str("component", "cert_watcher").Logger(), opts)
+}
+
+// newCertWatcher watches one pair; a non-empty dir is scanned for pairs
+// selected by SNI.
+func newCertWatcher(dir, certFile, keyFile string, log zerolog.Logger, opts []CertWatcherOption) (*CertWatcher, error) {
 	cw := &CertWatcher{
-		certFile: filepath.Join(certPath, "server.crt"),
-		keyFile:  filepath.Join(certPath, "server.key"),
-		log:      log.With().Str("component", "cert_watcher").Logger(),
+		certFile: certFile,
+		keyFile:  keyFile,
+		log:      log,
+		clock:    clock.Real,
+		stop:     make(chan struct{}),
+		dir:      dir,
+		watching: new(atomic.Bool),
+		opts:     opts,
+	}
+	for _, opt := range opts {
+		opt(cw)
 	}
 
 	if err := cw.reload(); err != nil {
 		return nil, err
 	}
+	if dir != "" {
+		cw.scan()
+	}
 
 	cw.log.Info().
 		Str("cert_file", cw.certFile).
 		Str("key_file", cw.keyFile).
 		Msg("certificate watcher initialized")
 
+	if dir != "" && cw.fileWatch {
+		cw.watch()
+	}
+	if cw.expiry.CheckInterval > 0 {
+		cw.checkExpiry()
+		go cw.checkLoop()
+	}
+	if cw.ocsp != nil {
+		cw.staple()
+		go cw.stapleLoop()
+	}
 	return cw, nil
 }
 
-// latestModTime returns the most recent mtime of cert or key file.
-func (cw *CertWatcher) latestModTime() (time.Time, error) {
-	certInfo, err := os.Stat(cw.certFile)
-	if err != nil {
-		return time.Time{}, err
+// fileStamp identifies the cert and key files as loaded. Comparing file
+// identity besides mtimes catches atomic symlink swaps, e.g. of Kubernetes
+// projected volumes, whose new files need not be newer.
+type fileStamp struct {
+	cert, key os.FileInfo
+}
+
+// stat returns the current stamp of the cert and key file.
+func (cw *CertWatcher) stat() (fileStamp, error) {
+	var s fileStamp
+	var err error
+	if s.cert, err = os.Stat(cw.certFile); err != nil {
+		return fileStamp{}, err
 	}
-	keyInfo, err := os.Stat(cw.keyFile)
-	if err != nil {
-		return time.Time{}, err
+	if cw.keyFile != "" {
+		if s.key, err = os.Stat(cw.keyFile); err != nil {
+			return fileStamp{}, err
+		}
 	}
+	return s, nil
+}
+
+// modTime returns the most recent mtime of cert or key file.
+func (s fileStamp) modTime() time.Time {
+	if s.cert == nil {
+		return time.Time{}
+	}
+	if s.key != nil && s.key.ModTime().After(s.cert.ModTime()) {
+		return s.key.ModTime()
+	}
+	return s.cert.ModTime()
+}
 
-	certMod := certInfo.ModTime()
-	keyMod := keyInfo.ModTime()
-	if keyMod.After(certMod) {
-		return keyMod, nil
+// changedFrom reports whether either file was modified or replaced since old.
+func (s fileStamp) changedFrom(old fileStamp) bool {
+	if old.cert == nil || s.modTime().After(old.modTime()) || !os.SameFile(s.cert, old.cert) {
+		return true
 	}
-	return certMod, nil
+	return s.key != nil && (old.key == nil || !os.SameFile(s.key, old.key))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
 
 // reload loads the certificate from disk.
 func (cw *CertWatcher) reload() error {
-	cert, err := tls.LoadX509KeyPair(cw.certFile, cw.keyFile)
+	cert, err := cw.loadKeyPair()
 	if err != nil {
 		return oops.
 			In("tlsutil").
-			Code("LOAD_KEYPAIR_FAILED").
+			Code(errcode.LoadKeypairFailed).
 			With("cert_file", cw.certFile).
 			With("key_file", cw.keyFile).
 			Wrapf(err, "failed to load server key pair")
 	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return oops.
+				In("tlsutil").
+				Code(errcode.ParseCertFailed).
+				With("cert_file", cw.certFile).
+				Wrapf(err, "failed to parse server certificate")
+		}
+	}
 
-	modTime, err := cw.latestModTime()
+	files, err := cw.stat()
 	if err != nil {
 		return oops.
 			In("tlsutil").
-			Code("STAT_FAILED").
+			Code(errcode.StatFailed).
 			Wrapf(err, "failed to stat certificate files")
 	}
 
+	now := cw.clock.Now()
+	notAfter := cert.Leaf.NotAfter
+
 	cw.mu.Lock()
+	if cw.cert != nil && !now.Before(notAfter) && now.Before(cw.notAfter) {
+		// Keep the last good certificate; the file is not retried until it
+		// changes again.
+		cw.files = files
+		cw.mu.Unlock()
+		cw.log.Error().
+			Err(oops.In("tlsutil").Code(errcode.CertExpired).With("not_after", notAfter).Errorf("reloaded certificate has expired")).
+			Str("cert_file", cw.certFile).
+			Time("serving_not_after", cw.NotAfter()).
+			Msg("ignoring expired certificate, keeping the previous one")
+		return nil
+	}
 	cw.cert = &cert
-	cw.modTime = modTime
+	cw.notAfter = notAfter
+	cw.files = files
+	cw.warned = 0
+	cw.stapleDue = time.Time{}
+	cw.stapleNext = time.Time{}
 	cw.mu.Unlock()
 
+	certExpiry.WithLabelValues(cw.certFile).Set(float64(notAfter.Unix()))
 	cw.log.Info().
 		Str("cert_file", cw.certFile).
 		Str("key_file", cw.keyFile).
-		Time("mod_time", modTime).
+		Time("mod_time", files.modTime()).
+		Time("not_after", notAfter).
+		Stringer("spki_pin", PinOf(cert.Leaf)).
 		Msg("certificate loaded")
 
 	return nil
@@ -99,20 +278,20 @@ func (cw *CertWatcher) reload() error {
 
 // maybeReload checks if certificate files have changed and reloads if needed.
 func (cw *CertWatcher) maybeReload() {
-	modTime, err := cw.latestModTime()
+	files, err := cw.stat()
 	if err != nil {
 		cw.log.Warn().Err(err).Msg("failed to stat certificate files")
 		return
 	}
 
 	cw.mu.RLock()
-	needsReload := modTime.After(cw.modTime)
+	old := cw.files
 	cw.mu.RUnlock()
 
-	if needsReload {
+	if files.changedFrom(old) {
 		cw.log.Debug().
-			Time("old_mod_time", cw.modTime).
-			Time("new_mod_time", modTime).
+			Time("old_mod_time", old.modTime()).
+			Time("new_mod_time", files.modTime()).
 			Msg("certificate file changed, reloading")
 
 		if err := cw.reload(); err != nil {
@@ -121,10 +300,103 @@ func (cw *CertWatcher) maybeReload() {
 	}
 }
 
-// GetCertificate returns the current certificate. Checks for updates on each call.
+func (cw *CertWatcher) checkLoop() {
+	ticker := cw.clock.NewTicker(cw.expiry.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			cw.checkExpiry()
+			if cw.dir != "" {
+				cw.scan()
+			}
+		case <-cw.stop:
+			return
+		}
+	}
+}
+
+// checkExpiry picks up rotated files, warns once per crossed lead time and
+// reports an expired certificate on every call.
+func (cw *CertWatcher) checkExpiry() {
+	cw.maybeReload()
+
+	cw.mu.Lock()
+	remaining := cw.notAfter.Sub(cw.clock.Now())
+	var lead time.Duration
+	for cw.warned < len(cw.expiry.WarnBefore) && remaining <= cw.expiry.WarnBefore[cw.warned] {
+		lead = cw.expiry.WarnBefore[cw.warned]
+		cw.warned++
+	}
+	notAfter := cw.notAfter
+	cw.mu.Unlock()
+
+	switch {
+	case remaining <= 0:
+		action := "serve"
+		if cw.expiry.RejectExpired {
+			action = "reject"
+		}
+		cw.log.Error().
+			Err(oops.In("tlsutil").Code(errcode.CertExpired).With("not_after", notAfter).Errorf("certificate has expired")).
+			Str("cert_file", cw.certFile).
+			Dur("expired_for", -remaining).
+			Str("action", action).
+			Msg("certificate expired")
+	case lead > 0:
+		cw.log.Warn().
+			Err(oops.In("tlsutil").Code(errcode.CertExpiring).With("not_after", notAfter).Errorf("certificate expires soon")).
+			Str("cert_file", cw.certFile).
+			Dur("expires_in", remaining).
+			Dur("lead", lead).
+			Msg("certificate expires soon")
+	}
+}
+
+// NotAfter returns the expiry of the served certificate.
+func (cw *CertWatcher) NotAfter() time.Time {
+	cw.mu.RLock()
+	defer cw.mu.RUnlock()
+	return cw.notAfter
+}
+
+// ExpiresIn returns the time left until the served certificate expires,
+// negative once it has.
+func (cw *CertWatcher) ExpiresIn() time.Duration {
+	return cw.NotAfter().Sub(cw.clock.Now())
+}
+
+// Expired reports whether the served certificate has expired.
+func (cw *CertWatcher) Expired() bool {
+	return cw.ExpiresIn() <= 0
+}
+
+// Rejecting reports whether handshakes fail because the certificate has
+// expired and ExpiryConfig.RejectExpired is set.
+func (cw *CertWatcher) Rejecting() bool {
+	return cw.expiry.RejectExpired && cw.Expired()
+}
+
+// GetCertificate returns the current certificate, or the one of a further
+// pair matching the requested server name. Checks for updates on each call
+// unless the directory is watched.
 // Suitable for use with tls.Config.GetCertificate.
 func (cw *CertWatcher) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	cw.maybeReload()
+	if pair := cw.sni.match(hello.ServerName); pair != nil {
+		return pair.GetCertificate(hello)
+	}
+	if !cw.watching.Load() {
+		cw.maybeReload()
+	}
+
+	if cw.Rejecting() {
+		return nil, oops.
+			In("tlsutil").
+			Code(errcode.CertExpired).
+			With("cert_file", cw.certFile).
+			With("not_after", cw.NotAfter()).
+			Errorf("certificate has expired")
+	}
 
 	cw.mu.RLock()
 	defer cw.mu.RUnlock()
@@ -136,14 +408,33 @@ func (cw *CertWatcher) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certific
 	return cw.cert, nil
 }
 
-// Close is a no-op but kept for interface compatibility.
+// Close stops the expiry check, also of the pairs selected by SNI.
 func (cw *CertWatcher) Close() error {
+	cw.once.Do(func() { close(cw.stop) })
+	cw.sni.close()
 	return nil
 }
 
-// TransportCredentials returns gRPC transport credentials using the watched certificate.
+// TransportCredentials returns gRPC transport credentials using the watched
+// certificate. Client certificates are verified when WithClientAuth is set,
+// and verified ones checked for revocation when WithRevocationChecker is set.
 func (cw *CertWatcher) TransportCredentials() credentials.TransportCredentials {
-	return credentials.NewTLS(&tls.Config{
-		GetCertificate: cw.GetCertificate,
-	})
+	cfg := cw.serverConfig()
+	if cw.clientAuth != nil {
+		// Read the client CA pool per handshake. The returned config replaces
+		// the one credentials.NewTLS prepares, so it must offer h2 itself.
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			hs := cw.serverConfig()
+			hs.NextProtos = []string{"h2"}
+			return hs, nil
+		}
+	}
+	return credentials.NewTLS(cfg)
+}
+
+// GetClientCertificate returns the current certificate to present as a
+// client, e.g. by the health check dialing the local server. Suitable for
+// use with tls.Config.GetClientCertificate.
+func (cw *CertWatcher) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return cw.GetCertificate(&tls.ClientHelloInfo{})
 }
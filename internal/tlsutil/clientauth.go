@@ -0,0 +1,149 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// ClientAuthConfig controls verification of client certificates.
+type ClientAuthConfig struct {
+	// CA verifies client certificates; its pool is read on every handshake,
+	// so rotations are picked up.
+	CA *CAWatcher
+	// Optional accepts clients without a certificate; presented
+	// certificates are still verified.
+	Optional bool
+	// AllowedSANs and AllowedSPIFFEIDs, if either is set, admit only
+	// client certificates matching one of their entries. AllowedSANs match
+	// DNS names, with a leading "*." covering one label, IP addresses,
+	// email addresses or URIs.
+	AllowedSANs []string
+	// AllowedSPIFFEIDs match the SPIFFE ID of the client certificate
+	// exactly, or every ID below an entry ending in "/*".
+	AllowedSPIFFEIDs []string
+}
+
+// WithClientAuth requests client certificates and verifies them with cfg.
+func WithClientAuth(cfg ClientAuthConfig) CertWatcherOption {
+	return func(cw *CertWatcher) {
+		cw.clientAuth = &cfg
+	}
+}
+
+// serverConfig returns the TLS configuration of a handshake: client
+// certificates are verified against the current client CA pool, checked
+// against the allowlists and then for revocation.
+func (cw *CertWatcher) serverConfig() *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: cw.GetCertificate,
+	}
+	var checks []func([][]byte, [][]*x509.Certificate) error
+	if ca := cw.clientAuth; ca != nil {
+		cfg.ClientCAs = ca.CA.Pool()
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		if ca.Optional {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		if len(ca.AllowedSANs) > 0 || len(ca.AllowedSPIFFEIDs) > 0 {
+			checks = append(checks, ca.verifyAllowed)
+		}
+	}
+	if cw.checker != nil {
+		checks = append(checks, cw.checker.VerifyPeerCertificate)
+	}
+	if len(checks) > 0 {
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, check := range checks {
+				if err := check(rawCerts, verifiedChains); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return cfg
+}
+
+// verifyAllowed accepts a verified client certificate matching one of the
+// allowlists; connections without a certificate are left to ClientAuth.
+func (c *ClientAuthConfig) verifyAllowed(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return nil
+	}
+	leaf := verifiedChains[0][0]
+	if c.Allowed(leaf) {
+		return nil
+	}
+	return oops.
+		In("tlsutil").
+		Code(errcode.ClientNotAllowed).
+		With("subject", leaf.Subject.String()).
+		With("dns_names", leaf.DNSNames).
+		With("uris", uriStrings(leaf.URIs)).
+		Errorf("client certificate matches no allowed SAN or SPIFFE ID")
+}
+
+// Allowed reports whether cert matches one of the allowlists.
+func (c *ClientAuthConfig) Allowed(cert *x509.Certificate) bool {
+	if id, ok := SPIFFEID(cert); ok {
+		for _, allowed := range c.AllowedSPIFFEIDs {
+			if prefix, ok := strings.CutSuffix(allowed, "/*"); (ok && strings.HasPrefix(id, prefix+"/")) || id == allowed {
+				return true
+			}
+		}
+	}
+	for _, allowed := range c.AllowedSANs {
+		if sanMatches(cert, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// SPIFFEID returns the SPIFFE ID of an X.509-SVID: its single URI SAN with
+// the spiffe scheme.
+func SPIFFEID(cert *x509.Certificate) (string, bool) {
+	if len(cert.URIs) != 1 || cert.URIs[0].Scheme != "spiffe" || cert.URIs[0].Host == "" {
+		return "", false
+	}
+	return cert.URIs[0].String(), true
+}
+
+func sanMatches(cert *x509.Certificate, allowed string) bool {
+	if ip := net.ParseIP(allowed); ip != nil {
+		return slices.ContainsFunc(cert.IPAddresses, ip.Equal)
+	}
+	if strings.Contains(allowed, "://") {
+		return slices.Contains(uriStrings(cert.URIs), allowed)
+	}
+	if strings.Contains(allowed, "@") {
+		return slices.ContainsFunc(cert.EmailAddresses, func(email string) bool { return strings.EqualFold(email, allowed) })
+	}
+	return slices.ContainsFunc(cert.DNSNames, func(name string) bool { return dnsMatches(allowed, name) })
+}
+
+// dnsMatches matches name against pattern, whose leading "*." covers
+// exactly one label.
+func dnsMatches(pattern, name string) bool {
+	pattern, name = strings.ToLower(pattern), strings.ToLower(strings.TrimSuffix(name, "."))
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, found := strings.Cut(name, ".")
+		return found && label != "" && rest == suffix
+	}
+	return pattern == name
+}
+
+func uriStrings(uris []*url.URL) []string {
+	out := make([]string, len(uris))
+	for i, u := range uris {
+		out[i] = u.String()
+	}
+	return out
+}
@@ -0,0 +1,192 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate for template signed by parent, or
+// self-signed if parent is nil.
+func issue(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func newCA(t *testing.T, name string) *testCert {
+	return issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientAuthAllowed(t *testing.T) {
+	cert := &x509.Certificate{
+		DNSNames:       []string{"envoy.gateway.svc"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.7")},
+		EmailAddresses: []string{"Ops@example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/ns/gateway/sa/envoy"}},
+	}
+	for _, tt := range []struct {
+		sans, ids []string
+		want      bool
+	}{
+		{sans: []string{"envoy.gateway.svc"}, want: true},
+		{sans: []string{"*.gateway.svc"}, want: true},
+		{sans: []string{"*.svc"}, want: false},
+		{sans: []string{"ENVOY.gateway.svc"}, want: true},
+		{sans: []string{"10.0.0.7"}, want: true},
+		{sans: []string{"ops@example.com"}, want: true},
+		{sans: []string{"spiffe://example.org/ns/gateway/sa/envoy"}, want: true},
+		{sans: []string{"other.svc"}, want: false},
+		{ids: []string{"spiffe://example.org/ns/gateway/sa/envoy"}, want: true},
+		{ids: []string{"spiffe://example.org/ns/gateway/*"}, want: true},
+		{ids: []string{"spiffe://example.org/ns/gate/*"}, want: false},
+		{ids: []string{"spiffe://example.org/ns/gateway/sa"}, want: false},
+		{ids: []string{"spiffe://other.org/*"}, sans: []string{"envoy.gateway.svc"}, want: true},
+	} {
+		c := &ClientAuthConfig{AllowedSANs: tt.sans, AllowedSPIFFEIDs: tt.ids}
+		if got := c.Allowed(cert); got != tt.want {
+			t.Errorf("Allowed(sans=%v, ids=%v) = %v, want %v", tt.sans, tt.ids, got, tt.want)
+		}
+	}
+}
+
+func TestClientAuthHandshake(t *testing.T) {
+	dir := t.TempDir()
+	serverCA, clientCA := newCA(t, "server ca"), newCA(t, "client ca")
+	server := issue(t, &x509.Certificate{
+		DNSNames:    []string{"ext-proc"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, serverCA)
+	writePEM(t, filepath.Join(dir, "server.crt"), "CERTIFICATE", server.cert.Raw)
+	keyDER, err := x509.MarshalECPrivateKey(server.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "server.key"), "EC PRIVATE KEY", keyDER)
+	caFile := filepath.Join(t.TempDir(), "clients.pem")
+	writePEM(t, caFile, "CERTIFICATE", clientCA.cert.Raw)
+
+	ca, err := NewCAWatcher(caFile, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw, err := NewCertWatcher(dir, zerolog.Nop(), WithClientAuth(ClientAuthConfig{
+		CA:               ca,
+		AllowedSPIFFEIDs: []string{"spiffe://example.org/envoy/*"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Close()
+	creds := cw.TransportCredentials()
+
+	client := func(uri string, signer *testCert) *tls.Certificate {
+		u, _ := url.Parse(uri)
+		c := issue(t, &x509.Certificate{
+			URIs:        []*url.URL{u},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, signer).tlsCertificate()
+		return &c
+	}
+	handshake := func(cert *tls.Certificate) error {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		done := make(chan error, 1)
+		go func() {
+			defer serverConn.Close()
+			_, _, err := creds.ServerHandshake(serverConn)
+			done <- err
+		}()
+		roots := x509.NewCertPool()
+		roots.AddCert(serverCA.cert)
+		cfg := &tls.Config{RootCAs: roots, ServerName: "ext-proc", NextProtos: []string{"h2"}}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		conn := tls.Client(clientConn, cfg)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = conn.HandshakeContext(ctx)
+		// TLS 1.3 clients learn of a rejected certificate on first read.
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Read(make([]byte, 1))
+		return <-done
+	}
+
+	if err := handshake(client("spiffe://example.org/envoy/gateway", clientCA)); err != nil {
+		t.Errorf("allowed client rejected: %v", err)
+	}
+	if err := handshake(nil); err == nil {
+		t.Error("client without certificate accepted")
+	}
+	if err := handshake(client("spiffe://example.org/other", clientCA)); err == nil {
+		t.Error("client outside the allowlist accepted")
+	}
+	rotated := newCA(t, "rotated client ca")
+	if err := handshake(client("spiffe://example.org/envoy/gateway", rotated)); err == nil {
+		t.Error("client of an unknown CA accepted")
+	}
+
+	// A rotated bundle applies to the next handshake.
+	writePEM(t, caFile, "CERTIFICATE", rotated.cert.Raw)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(client("spiffe://example.org/envoy/gateway", rotated)); err != nil {
+		t.Errorf("client of the rotated CA rejected: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// PassphraseFunc returns the passphrase of an encrypted private key or
+// PKCS#12 bundle. It is called on every load, so a rotated passphrase is
+// picked up along with the new key.
+type PassphraseFunc func() ([]byte, error)
+
+// WithPassphrase decrypts encrypted private keys and PKCS#12 bundles with
+// the passphrase fn returns.
+func WithPassphrase(fn PassphraseFunc) CertWatcherOption {
+	return func(cw *CertWatcher) {
+		cw.passphrase = fn
+	}
+}
+
+// loadKeyPair loads the watched certificate: a PKCS#12 bundle, or a PEM
+// certificate chain and a private key that may be encrypted.
+func (cw *CertWatcher) loadKeyPair() (tls.Certificate, error) {
+	if cw.keyFile == "" {
+		return cw.loadPKCS12()
+	}
+	certPEM, err := os.ReadFile(cw.certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := os.ReadFile(cw.keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	// Legacy PEM encryption is deprecated in x509 but still issued by some
+	// PKIs.
+	if block != nil && (block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block)) {
+		if keyPEM, err = cw.decryptKey(block); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// decryptKey decrypts an encrypted PKCS#8 or legacy encrypted PEM key and
+// returns it as unencrypted PEM.
+func (cw *CertWatcher) decryptKey(block *pem.Block) ([]byte, error) {
+	password, err := cw.readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	errb := oops.In("tlsutil").Code(errcode.DecryptKeyFailed).With("key_file", cw.keyFile)
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, password)
+		if err != nil {
+			return nil, errb.Wrapf(err, "failed to decrypt private key")
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, errb.Wrapf(err, "failed to encode private key")
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	der, err := x509.DecryptPEMBlock(block, password)
+	if err != nil {
+		return nil, errb.Wrapf(err, "failed to decrypt private key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
+
+// loadPKCS12 loads the key, certificate and chain of a PKCS#12 bundle.
+func (cw *CertWatcher) loadPKCS12() (tls.Certificate, error) {
+	data, err := os.ReadFile(cw.certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	password, err := cw.readPassphrase()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(data, string(password))
+	if err != nil {
+		return tls.Certificate{}, oops.
+			In("tlsutil").
+			Code(errcode.DecryptKeyFailed).
+			With("cert_file", cw.certFile).
+			Wrapf(err, "failed to decode PKCS#12 bundle")
+	}
+	cert := tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+func (cw *CertWatcher) readPassphrase() ([]byte, error) {
+	if cw.passphrase == nil {
+		// PKCS#12 bundles may be protected by an empty password.
+		if cw.keyFile == "" {
+			return nil, nil
+		}
+		return nil, oops.
+			In("tlsutil").
+			Code(errcode.DecryptKeyFailed).
+			With("key_file", cw.keyFile).
+			Errorf("private key is encrypted but no passphrase is configured")
+	}
+	password, err := cw.passphrase()
+	if err != nil {
+		return nil, oops.In("tlsutil").Code(errcode.DecryptKeyFailed).Wrapf(err, "failed to read key passphrase")
+	}
+	return password, nil
+}
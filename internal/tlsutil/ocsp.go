@@ -0,0 +1,218 @@
+package tlsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samber/oops"
+	"golang.org/x/crypto/ocsp"
+)
+
+var ocspStapleNextUpdate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tls_ocsp_staple_next_update_timestamp_seconds",
+	Help: "NextUpdate of the stapled OCSP response as a Unix timestamp, by certificate file; 0 when nothing is stapled.",
+}, []string{"cert_file"})
+
+func init() {
+	metrics.Registry.MustRegister(ocspStapleNextUpdate)
+}
+
+// maxOCSPResponseSize bounds OCSP responses read from responders.
+const maxOCSPResponseSize = 1 << 20
+
+// OCSPConfig controls OCSP stapling of the served certificate.
+type OCSPConfig struct {
+	// Timeout bounds a single request to the OCSP responder.
+	Timeout time.Duration
+	// RetryInterval is how long to wait after a failed fetch; responses are
+	// otherwise refreshed halfway through their validity.
+	RetryInterval time.Duration
+}
+
+// WithOCSPStapling staples an OCSP response fetched from the responder named
+// in the certificate. The issuer must be the second certificate of
+// server.crt.
+func WithOCSPStapling(cfg OCSPConfig) CertWatcherOption {
+	return func(cw *CertWatcher) {
+		if cfg.Timeout <= 0 {
+			cfg.Timeout = 5 * time.Second
+		}
+		if cfg.RetryInterval <= 0 {
+			cfg.RetryInterval = time.Minute
+		}
+		cw.ocsp = &cfg
+	}
+}
+
+// fetchOCSP asks the certificate's OCSP responder for its status and returns
+// the verified response with its DER encoding.
+func fetchOCSP(ctx context.Context, client *http.Client, leaf, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	errb := oops.In("tlsutil").Code(errcode.RevocationFailed).With("serial", leaf.SerialNumber.String())
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errb.Errorf("certificate names no OCSP responder")
+	}
+	server := leaf.OCSPServer[0]
+	errb = errb.With("ocsp_server", server)
+
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, errb.Wrapf(err, "failed to create OCSP request")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, errb.Wrapf(err, "failed to create OCSP request")
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, errb.Wrapf(err, "OCSP request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errb.With("status", resp.StatusCode).Errorf("OCSP responder returned status %d", resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, errb.Wrapf(err, "failed to read OCSP response")
+	}
+	parsed, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, errb.Wrapf(err, "invalid OCSP response")
+	}
+	return parsed, raw, nil
+}
+
+// ocspRefreshAt is when a response should be replaced: halfway between
+// ThisUpdate and NextUpdate, or after fallback if it has no NextUpdate.
+func ocspRefreshAt(resp *ocsp.Response, now time.Time, fallback time.Duration) time.Time {
+	if resp.NextUpdate.IsZero() {
+		return now.Add(fallback)
+	}
+	return resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+}
+
+// staple fetches a fresh OCSP response for the served certificate when one
+// is due, and swaps in a copy of the certificate carrying it.
+func (cw *CertWatcher) staple() {
+	now := cw.clock.Now()
+	cw.mu.RLock()
+	cert, due := cw.cert, cw.stapleDue
+	cw.mu.RUnlock()
+	if now.Before(due) {
+		return
+	}
+
+	retry := func() {
+		cw.mu.Lock()
+		if cw.cert == cert {
+			cw.stapleDue = now.Add(cw.ocsp.RetryInterval)
+			// A staple past its NextUpdate is worse than none.
+			if next := cw.stapleNext; !next.IsZero() && !now.Before(next) {
+				stripped := *cw.cert
+				stripped.OCSPStaple = nil
+				cw.cert = &stripped
+				cw.stapleNext = time.Time{}
+				ocspStapleNextUpdate.WithLabelValues(cw.certFile).Set(0)
+			}
+		}
+		cw.mu.Unlock()
+	}
+
+	if len(cert.Certificate) < 2 {
+		cw.log.Warn().Str("cert_file", cw.certFile).Msg("no issuer certificate in chain, OCSP stapling disabled")
+		// Checked again daily; a reload retries at once.
+		cw.mu.Lock()
+		if cw.cert == cert {
+			cw.stapleDue = now.Add(24 * time.Hour)
+		}
+		cw.mu.Unlock()
+		return
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		cw.log.Error().Err(oops.In("tlsutil").Code(errcode.ParseCertFailed).Wrapf(err, "failed to parse issuer certificate")).
+			Str("cert_file", cw.certFile).Msg("OCSP stapling failed")
+		retry()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cw.ocsp.Timeout)
+	defer cancel()
+	resp, raw, err := fetchOCSP(ctx, httpclient.New("ocsp-stapling", 0), cert.Leaf, issuer)
+	if err != nil {
+		cw.log.Error().Err(err).Str("cert_file", cw.certFile).Msg("OCSP stapling failed")
+		retry()
+		return
+	}
+	if resp.Status != ocsp.Good {
+		code := errcode.RevocationFailed
+		if resp.Status == ocsp.Revoked {
+			code = errcode.CertRevoked
+		}
+		cw.log.Error().
+			Err(oops.In("tlsutil").Code(code).With("revoked_at", resp.RevokedAt).Errorf("OCSP status of served certificate is %s", ocspStatusName(resp.Status))).
+			Str("cert_file", cw.certFile).
+			Msg("not stapling OCSP response")
+		retry()
+		return
+	}
+
+	cw.mu.Lock()
+	if cw.cert == cert {
+		stapled := *cert
+		stapled.OCSPStaple = raw
+		cw.cert = &stapled
+		cw.stapleNext = resp.NextUpdate
+		cw.stapleDue = ocspRefreshAt(resp, now, time.Hour)
+	}
+	cw.mu.Unlock()
+
+	ocspStapleNextUpdate.WithLabelValues(cw.certFile).Set(float64(resp.NextUpdate.Unix()))
+	cw.log.Info().
+		Str("cert_file", cw.certFile).
+		Time("this_update", resp.ThisUpdate).
+		Time("next_update", resp.NextUpdate).
+		Msg("OCSP response stapled")
+}
+
+func (cw *CertWatcher) stapleLoop() {
+	ticker := cw.clock.NewTicker(cw.ocsp.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			cw.maybeReload()
+			cw.staple()
+		case <-cw.stop:
+			return
+		}
+	}
+}
+
+// OCSPStaple returns the stapled OCSP response, nil if none.
+func (cw *CertWatcher) OCSPStaple() []byte {
+	cw.mu.RLock()
+	defer cw.mu.RUnlock()
+	return cw.cert.OCSPStaple
+}
+
+func ocspStatusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,85 @@
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"slices"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// SPKIPin is the SHA-256 digest of a certificate's SubjectPublicKeyInfo.
+type SPKIPin [sha256.Size]byte
+
+// PinOf returns the SPKI pin of cert.
+func PinOf(cert *x509.Certificate) SPKIPin {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// String returns the pin in base64, as ParseSPKIPins accepts it.
+func (p SPKIPin) String() string {
+	return base64.StdEncoding.EncodeToString(p[:])
+}
+
+// ParseSPKIPins parses base64 SHA-256 SPKI digests, optionally prefixed
+// with "sha256//" as in curl's --pinnedpubkey.
+func ParseSPKIPins(pins []string) ([]SPKIPin, error) {
+	parsed := make([]SPKIPin, 0, len(pins))
+	for _, pin := range pins {
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), "sha256//"))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, oops.
+				In("tlsutil").
+				Code(errcode.InvalidConfig).
+				With("pin", pin).
+				Errorf("invalid SPKI pin %q, want the base64 SHA-256 digest of a SubjectPublicKeyInfo", pin)
+		}
+		parsed = append(parsed, SPKIPin(digest))
+	}
+	return parsed, nil
+}
+
+// VerifySPKIPins returns a tls.Config.VerifyPeerCertificate function
+// accepting a peer whose presented chain holds a certificate matching one of
+// pins. It does not verify the chain itself.
+func VerifySPKIPins(pins []SPKIPin) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				continue
+			}
+			if slices.Contains(pins, PinOf(cert)) {
+				return nil
+			}
+		}
+		return oops.
+			In("tlsutil").
+			Code(errcode.PinMismatch).
+			Errorf("peer certificate matches none of %d SPKI pins", len(pins))
+	}
+}
+
+// VerifyServed returns a tls.Config.VerifyPeerCertificate function accepting
+// only a peer presenting the certificate cw serves for serverName, for
+// connections to this process itself.
+func (cw *CertWatcher) VerifyServed(serverName string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		leaf := cw.leaf()
+		if pair := cw.sni.match(serverName); pair != nil {
+			leaf = pair.leaf()
+		}
+		if len(rawCerts) > 0 && bytes.Equal(rawCerts[0], leaf.Raw) {
+			return nil
+		}
+		return oops.
+			In("tlsutil").
+			Code(errcode.PinMismatch).
+			With("server_name", serverName).
+			Errorf("peer certificate is not the served certificate")
+	}
+}
@@ -0,0 +1,397 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/clock"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/mnixry/envoy-ext-procs/internal/httpclient"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/samber/oops"
+	"golang.org/x/crypto/ocsp"
+)
+
+var revocationChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tls_revocation_checks_total",
+	Help: "Client certificate revocation checks, by source (crl, ocsp) and result (good, revoked, unknown).",
+}, []string{"source", "result"})
+
+func init() {
+	metrics.Registry.MustRegister(revocationChecks)
+}
+
+const (
+	// maxCRLSize bounds CRLs downloaded from distribution points.
+	maxCRLSize = 16 << 20
+	// failureTTL is how long a failed fetch is remembered, so an unreachable
+	// responder does not delay every handshake.
+	failureTTL = 30 * time.Second
+	// maxCachedResponses triggers pruning of expired OCSP responses.
+	maxCachedResponses = 1024
+)
+
+// RevocationConfig controls revocation checks of client certificates.
+type RevocationConfig struct {
+	// CRLFiles are PEM or DER CRLs, reloaded when modified.
+	CRLFiles []string
+	// FetchCRLs downloads CRLs from the certificates' HTTP distribution
+	// points.
+	FetchCRLs bool
+	// OCSP queries the certificates' OCSP responders.
+	OCSP bool
+	// SoftFail accepts certificates whose status cannot be determined
+	// instead of failing the handshake.
+	SoftFail bool
+	// Timeout bounds a single OCSP or CRL request.
+	Timeout time.Duration
+	// CacheTTL caps how long OCSP responses and fetched CRLs are cached,
+	// even if their NextUpdate is later.
+	CacheTTL time.Duration
+	Clock    clock.Clock
+}
+
+// Enabled reports whether any revocation source is configured.
+func (c RevocationConfig) Enabled() bool {
+	return len(c.CRLFiles) > 0 || c.FetchCRLs || c.OCSP
+}
+
+type revocationStatus int
+
+const (
+	statusUnknown revocationStatus = iota
+	statusGood
+	statusRevoked
+)
+
+var statusNames = map[revocationStatus]string{statusUnknown: "unknown", statusGood: "good", statusRevoked: "revoked"}
+
+// crl is a parsed revocation list with its revoked serials.
+type crl struct {
+	list    *x509.RevocationList
+	revoked map[string]time.Time
+	// modTime is set for CRL files.
+	modTime time.Time
+	// expires is set for fetched CRLs; err is a remembered fetch failure.
+	expires time.Time
+	err     error
+}
+
+// cachedOCSP is an OCSP response; a failure is remembered as unknown.
+type cachedOCSP struct {
+	status    revocationStatus
+	revokedAt time.Time
+	expires   time.Time
+}
+
+// RevocationChecker checks client certificate chains against CRLs and OCSP
+// responders, caching results until their NextUpdate.
+type RevocationChecker struct {
+	cfg    RevocationConfig
+	log    zerolog.Logger
+	clock  clock.Clock
+	client *http.Client
+
+	mu        sync.Mutex
+	files     map[string]*crl
+	fetched   map[string]*crl
+	responses map[string]*cachedOCSP
+}
+
+// NewRevocationChecker loads the configured CRL files.
+func NewRevocationChecker(cfg RevocationConfig, log zerolog.Logger) (*RevocationChecker, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = time.Hour
+	}
+	c := &RevocationChecker{
+		cfg:       cfg,
+		log:       log.With().Str("component", "revocation_checker").Logger(),
+		clock:     clock.Or(cfg.Clock),
+		client:    httpclient.New("revocation", cfg.Timeout),
+		files:     make(map[string]*crl, len(cfg.CRLFiles)),
+		fetched:   make(map[string]*crl),
+		responses: make(map[string]*cachedOCSP),
+	}
+	for _, path := range cfg.CRLFiles {
+		list, err := loadCRLFile(path)
+		if err != nil {
+			return nil, err
+		}
+		c.files[path] = list
+	}
+	c.log.Info().
+		Strs("crl_files", cfg.CRLFiles).
+		Bool("fetch_crls", cfg.FetchCRLs).
+		Bool("ocsp", cfg.OCSP).
+		Bool("soft_fail", cfg.SoftFail).
+		Msg("client certificate revocation checks enabled")
+	return c, nil
+}
+
+// VerifyPeerCertificate checks every certificate of the first verified chain
+// but the root. It is suitable for tls.Config.VerifyPeerCertificate and does
+// nothing when no client certificate was verified.
+func (c *RevocationChecker) VerifyPeerCertificate(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return nil
+	}
+	chain := verifiedChains[0]
+	for i := 0; i+1 < len(chain); i++ {
+		if err := c.Check(chain[i], chain[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check returns an error if cert is revoked, or if its status is unknown and
+// SoftFail is off.
+func (c *RevocationChecker) Check(cert, issuer *x509.Certificate) error {
+	status, revokedAt, source := c.status(cert, issuer)
+	revocationChecks.WithLabelValues(source, statusNames[status]).Inc()
+
+	switch status {
+	case statusRevoked:
+		return oops.
+			In("tlsutil").
+			Code(errcode.CertRevoked).
+			With("subject", cert.Subject.String()).
+			With("serial", cert.SerialNumber.String()).
+			With("revoked_at", revokedAt).
+			With("source", source).
+			Errorf("client certificate has been revoked")
+	case statusUnknown:
+		err := oops.
+			In("tlsutil").
+			Code(errcode.RevocationFailed).
+			With("subject", cert.Subject.String()).
+			With("serial", cert.SerialNumber.String()).
+			Errorf("revocation status of client certificate is unknown")
+		if !c.cfg.SoftFail {
+			return err
+		}
+		c.log.Warn().Err(err).Msg("accepting client certificate of unknown revocation status")
+	}
+	return nil
+}
+
+// status consults CRL files, fetched CRLs and OCSP in that order, stopping at
+// the first conclusive answer.
+func (c *RevocationChecker) status(cert, issuer *x509.Certificate) (revocationStatus, time.Time, string) {
+	now := c.clock.Now()
+	for _, path := range c.cfg.CRLFiles {
+		if status, at := c.fileStatus(path, cert, issuer, now); status != statusUnknown {
+			return status, at, "crl"
+		}
+	}
+	if c.cfg.FetchCRLs {
+		for _, url := range cert.CRLDistributionPoints {
+			if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+				continue
+			}
+			if status, at := c.fetchedStatus(url, cert, issuer, now); status != statusUnknown {
+				return status, at, "crl"
+			}
+		}
+	}
+	if c.cfg.OCSP && len(cert.OCSPServer) > 0 {
+		resp := c.ocspStatus(cert, issuer, now)
+		return resp.status, resp.revokedAt, "ocsp"
+	}
+	return statusUnknown, time.Time{}, "none"
+}
+
+func (c *RevocationChecker) fileStatus(path string, cert, issuer *x509.Certificate, now time.Time) (revocationStatus, time.Time) {
+	c.mu.Lock()
+	list := c.files[path]
+	c.mu.Unlock()
+
+	if info, err := os.Stat(path); err != nil {
+		c.log.Warn().Err(err).Str("crl_file", path).Msg("failed to stat CRL file")
+	} else if info.ModTime().After(list.modTime) {
+		if reloaded, err := loadCRLFile(path); err != nil {
+			c.log.Error().Err(err).Str("crl_file", path).Msg("failed to reload CRL, keeping previous")
+			// Not retried until the file changes again.
+			kept := *list
+			kept.modTime = info.ModTime()
+			c.mu.Lock()
+			c.files[path] = &kept
+			c.mu.Unlock()
+		} else {
+			c.log.Info().Str("crl_file", path).Time("next_update", reloaded.list.NextUpdate).Msg("CRL reloaded")
+			list = reloaded
+			c.mu.Lock()
+			c.files[path] = list
+			c.mu.Unlock()
+		}
+	}
+	return c.lookup(list, path, cert, issuer, now)
+}
+
+func (c *RevocationChecker) fetchedStatus(url string, cert, issuer *x509.Certificate, now time.Time) (revocationStatus, time.Time) {
+	c.mu.Lock()
+	list, ok := c.fetched[url]
+	c.mu.Unlock()
+
+	if !ok || !now.Before(list.expires) {
+		list = c.fetchCRL(url, now)
+		c.mu.Lock()
+		c.fetched[url] = list
+		c.mu.Unlock()
+	}
+	if list.err != nil {
+		return statusUnknown, time.Time{}
+	}
+	return c.lookup(list, url, cert, issuer, now)
+}
+
+// lookup answers from list if it was issued by issuer and is current.
+func (c *RevocationChecker) lookup(list *crl, source string, cert, issuer *x509.Certificate, now time.Time) (revocationStatus, time.Time) {
+	if string(list.list.RawIssuer) != string(cert.RawIssuer) {
+		return statusUnknown, time.Time{}
+	}
+	if err := list.list.CheckSignatureFrom(issuer); err != nil {
+		c.log.Warn().Err(err).Str("crl", source).Msg("CRL not signed by the certificate's issuer")
+		return statusUnknown, time.Time{}
+	}
+	if !list.list.NextUpdate.IsZero() && now.After(list.list.NextUpdate) {
+		c.log.Warn().Str("crl", source).Time("next_update", list.list.NextUpdate).Msg("CRL is stale")
+		return statusUnknown, time.Time{}
+	}
+	if at, revoked := list.revoked[cert.SerialNumber.String()]; revoked {
+		return statusRevoked, at
+	}
+	return statusGood, time.Time{}
+}
+
+func (c *RevocationChecker) fetchCRL(url string, now time.Time) *crl {
+	list, err := c.downloadCRL(url)
+	if err != nil {
+		c.log.Warn().Err(err).Str("crl_url", url).Msg("failed to fetch CRL")
+		return &crl{err: err, expires: now.Add(failureTTL)}
+	}
+	list.expires = c.expiry(list.list.NextUpdate, now)
+	c.log.Info().Str("crl_url", url).Time("next_update", list.list.NextUpdate).Msg("CRL fetched")
+	return list
+}
+
+func (c *RevocationChecker) downloadCRL(url string) (*crl, error) {
+	errb := oops.In("tlsutil").Code(errcode.RevocationFailed).With("crl_url", url)
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errb.Wrapf(err, "failed to create CRL request")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errb.Wrapf(err, "CRL request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errb.With("status", resp.StatusCode).Errorf("CRL distribution point returned status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCRLSize))
+	if err != nil {
+		return nil, errb.Wrapf(err, "failed to read CRL")
+	}
+	list, err := parseCRL(data)
+	if err != nil {
+		return nil, errb.Wrap(err)
+	}
+	return list, nil
+}
+
+func (c *RevocationChecker) ocspStatus(cert, issuer *x509.Certificate, now time.Time) *cachedOCSP {
+	key := string(issuer.RawSubjectPublicKeyInfo) + "/" + cert.SerialNumber.String()
+	c.mu.Lock()
+	cached, ok := c.responses[key]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+	defer cancel()
+	resp, _, err := fetchOCSP(ctx, c.client, cert, issuer)
+	switch {
+	case err != nil:
+		c.log.Warn().Err(err).Str("subject", cert.Subject.String()).Msg("OCSP check failed")
+		cached = &cachedOCSP{expires: now.Add(failureTTL)}
+	case resp.Status == ocsp.Good:
+		cached = &cachedOCSP{status: statusGood, expires: c.expiry(resp.NextUpdate, now)}
+	case resp.Status == ocsp.Revoked:
+		cached = &cachedOCSP{status: statusRevoked, revokedAt: resp.RevokedAt, expires: c.expiry(resp.NextUpdate, now)}
+	default:
+		cached = &cachedOCSP{expires: now.Add(failureTTL)}
+	}
+
+	c.mu.Lock()
+	if len(c.responses) >= maxCachedResponses {
+		for k, v := range c.responses {
+			if !now.Before(v.expires) {
+				delete(c.responses, k)
+			}
+		}
+	}
+	c.responses[key] = cached
+	c.mu.Unlock()
+	return cached
+}
+
+// expiry is when a result valid until nextUpdate leaves the cache.
+func (c *RevocationChecker) expiry(nextUpdate, now time.Time) time.Time {
+	limit := now.Add(c.cfg.CacheTTL)
+	if nextUpdate.IsZero() || nextUpdate.After(limit) {
+		return limit
+	}
+	return nextUpdate
+}
+
+func loadCRLFile(path string) (*crl, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, oops.In("tlsutil").Code(errcode.StatFailed).With("crl_file", path).Wrapf(err, "failed to stat CRL file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, oops.In("tlsutil").Code(errcode.RevocationFailed).With("crl_file", path).Wrapf(err, "failed to read CRL file")
+	}
+	list, err := parseCRL(data)
+	if err != nil {
+		return nil, oops.With("crl_file", path).Wrap(err)
+	}
+	list.modTime = info.ModTime()
+	return list, nil
+}
+
+// parseCRL parses a DER or PEM ("X509 CRL") revocation list.
+func parseCRL(data []byte) (*crl, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, oops.In("tlsutil").Code(errcode.RevocationFailed).With("pem_type", block.Type).Errorf("unexpected PEM block in CRL")
+		}
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, oops.In("tlsutil").Code(errcode.RevocationFailed).Wrapf(err, "failed to parse CRL")
+	}
+	revoked := make(map[string]time.Time, len(list.RevokedCertificateEntries))
+	for _, entry := range list.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = entry.RevocationTime
+	}
+	return &crl{list: list, revoked: revoked}, nil
+}
@@ -0,0 +1,155 @@
+package tlsutil
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Besides the default server.crt and server.key, or server.p12, a cert
+// directory may hold further pairs: <name>.crt with <name>.key, or
+// <name>.p12. Each is watched like the default, with the same options, and
+// served to clients whose ClientHello names one of its DNS SANs, exact
+// names taking precedence over wildcards. Pairs added or removed are picked
+// up on every expiry check and, with WithFileWatch, when the directory
+// changes.
+
+// sniPairs are the further pairs of a cert directory, by cert file name.
+type sniPairs struct {
+	mu    sync.RWMutex
+	pairs []*CertWatcher
+}
+
+// match returns the pair serving serverName, or nil for the default.
+func (p *sniPairs) match(serverName string) *CertWatcher {
+	if serverName == "" {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.pairs) == 0 {
+		return nil
+	}
+	name := strings.TrimSuffix(serverName, ".")
+	for _, pair := range p.pairs {
+		for _, dns := range pair.leaf().DNSNames {
+			if strings.EqualFold(dns, name) {
+				return pair
+			}
+		}
+	}
+	for _, pair := range p.pairs {
+		if pair.leaf().VerifyHostname(name) == nil {
+			return pair
+		}
+	}
+	return nil
+}
+
+// list returns the current pairs.
+func (p *sniPairs) list() []*CertWatcher {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return slices.Clone(p.pairs)
+}
+
+func (p *sniPairs) close() {
+	p.mu.Lock()
+	pairs := p.pairs
+	p.pairs = nil
+	p.mu.Unlock()
+	for _, pair := range pairs {
+		pair.Close()
+	}
+}
+
+// leaf returns the parsed served certificate.
+func (cw *CertWatcher) leaf() *x509.Certificate {
+	cw.mu.RLock()
+	defer cw.mu.RUnlock()
+	return cw.cert.Leaf
+}
+
+// scan starts watching pairs added to the cert directory and stops watching
+// removed ones. A pair that fails to load is retried on the next scan.
+func (cw *CertWatcher) scan() {
+	found, err := findPairs(cw.dir)
+	if err != nil {
+		cw.log.Warn().Err(err).Str("cert_dir", cw.dir).Msg("failed to list certificate directory")
+		return
+	}
+
+	cw.sni.mu.RLock()
+	current := make(map[string]*CertWatcher, len(cw.sni.pairs))
+	for _, pair := range cw.sni.pairs {
+		current[pair.certFile] = pair
+	}
+	cw.sni.mu.RUnlock()
+
+	pairs := make([]*CertWatcher, 0, len(found))
+	changed := false
+	for _, files := range found {
+		if pair, ok := current[files[0]]; ok {
+			pairs = append(pairs, pair)
+			delete(current, files[0])
+			continue
+		}
+		pair, err := newCertWatcher("", files[0], files[1], cw.log, cw.opts)
+		if err != nil {
+			cw.log.Error().Err(err).Str("cert_file", files[0]).Msg("failed to load certificate pair, skipping")
+			continue
+		}
+		pair.watching = cw.watching
+		if names := pair.leaf().DNSNames; len(names) == 0 {
+			cw.log.Warn().Str("cert_file", files[0]).Msg("certificate has no DNS names and is never selected by SNI")
+		} else {
+			cw.log.Info().Str("cert_file", files[0]).Strs("server_names", names).Msg("serving certificate by SNI")
+		}
+		pairs = append(pairs, pair)
+		changed = true
+	}
+	if !changed && len(current) == 0 {
+		return
+	}
+
+	cw.sni.mu.Lock()
+	cw.sni.pairs = pairs
+	cw.sni.mu.Unlock()
+	for file, pair := range current {
+		pair.Close()
+		certExpiry.DeleteLabelValues(file)
+		ocspStapleNextUpdate.DeleteLabelValues(file)
+		cw.log.Info().Str("cert_file", file).Msg("certificate pair removed")
+	}
+}
+
+// findPairs lists the cert and key files (empty for PKCS#12) of the pairs in
+// dir besides the default one, in name order.
+func findPairs(dir string) ([][2]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var pairs [][2]string
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		if entry.IsDir() || stem == "server" || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch ext {
+		case ".crt":
+			// A .crt without a key, e.g. a CA bundle, is not a pair.
+			if key := filepath.Join(dir, stem+".key"); exists(key) {
+				pairs = append(pairs, [2]string{filepath.Join(dir, name), key})
+			}
+		case ".p12":
+			pairs = append(pairs, [2]string{filepath.Join(dir, name), ""})
+		}
+	}
+	return pairs, nil
+}
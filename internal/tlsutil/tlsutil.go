@@ -5,7 +5,10 @@ import (
 	"crypto/x509"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
 	"github.com/samber/oops"
 	"google.golang.org/grpc/credentials"
 )
@@ -20,7 +23,7 @@ func LoadTLSCredentials(certPath string) (credentials.TransportCredentials, erro
 	if err != nil {
 		return nil, oops.
 			In("tlsutil").
-			Code("LOAD_KEYPAIR_FAILED").
+			Code(errcode.LoadKeypairFailed).
 			With("cert_file", certFile).
 			With("key_file", keyFile).
 			Wrapf(err, "failed to load server key pair")
@@ -28,23 +31,64 @@ func LoadTLSCredentials(certPath string) (credentials.TransportCredentials, erro
 	return credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}}), nil
 }
 
-// LoadCA loads a CA certificate pool from a file.
+// caExtensions are the files of a CA directory that are loaded.
+var caExtensions = []string{".pem", ".crt", ".cer"}
+
+// LoadCA loads a CA certificate pool from a PEM file, which may hold several
+// CAs, or from every .pem, .crt and .cer file of a directory.
 func LoadCA(caPath string) (*x509.CertPool, error) {
-	caCert, err := os.ReadFile(caPath)
+	files, err := caFiles(caPath)
 	if err != nil {
 		return nil, oops.
 			In("tlsutil").
-			Code("READ_CA_FAILED").
+			Code(errcode.ReadCAFailed).
 			With("ca_file", caPath).
 			Wrapf(err, "failed to read CA certificate")
 	}
 	pool := x509.NewCertPool()
-	if ok := pool.AppendCertsFromPEM(caCert); !ok {
-		return nil, oops.
-			In("tlsutil").
-			Code("APPEND_CERTS_FAILED").
-			With("ca_file", caPath).
-			Errorf("failed to append CA certificate to pool")
+	for _, file := range files {
+		caCert, err := os.ReadFile(file)
+		if err != nil {
+			return nil, oops.
+				In("tlsutil").
+				Code(errcode.ReadCAFailed).
+				With("ca_file", file).
+				Wrapf(err, "failed to read CA certificate")
+		}
+		if ok := pool.AppendCertsFromPEM(caCert); !ok {
+			return nil, oops.
+				In("tlsutil").
+				Code(errcode.AppendCertsFailed).
+				With("ca_file", file).
+				Errorf("failed to append CA certificate to pool")
+		}
 	}
 	return pool, nil
 }
+
+// caFiles returns caPath, or the CA files in it if it is a directory.
+func caFiles(caPath string) ([]string, error) {
+	info, err := os.Stat(caPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{caPath}, nil
+	}
+	entries, err := os.ReadDir(caPath)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !slices.Contains(caExtensions, strings.ToLower(filepath.Ext(name))) {
+			continue
+		}
+		files = append(files, filepath.Join(caPath, name))
+	}
+	if len(files) == 0 {
+		return nil, oops.Errorf("no %s files in CA directory", strings.Join(caExtensions, ", "))
+	}
+	return files, nil
+}
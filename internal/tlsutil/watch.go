@@ -0,0 +1,91 @@
+package tlsutil
+
+import (
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce collapses the events of one rotation, e.g. the Kubernetes
+// atomic writer creating a timestamped directory, renaming a new ..data
+// symlink over the old one and removing the previous directory, or a cert
+// and key written one after the other.
+const watchDebounce = 100 * time.Millisecond
+
+// WithFileWatch watches the certificate directory for changes and reloads
+// the default pair and the pairs selected by SNI when it reports one,
+// instead of checking the files on every handshake. The expiry check
+// remains a periodic rescan in case an event is missed. If the directory
+// cannot be watched, handshakes check the files as without the option.
+func WithFileWatch() CertWatcherOption {
+	return func(cw *CertWatcher) {
+		cw.fileWatch = true
+	}
+}
+
+// watch starts watching cw.dir.
+func (cw *CertWatcher) watch() {
+	w, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = w.Add(cw.dir); err != nil {
+			_ = w.Close()
+		}
+	}
+	if err != nil {
+		cw.log.Warn().Err(err).Str("cert_dir", cw.dir).Msg("failed to watch certificate directory, checking files on every handshake")
+		return
+	}
+	cw.watching.Store(true)
+	cw.log.Info().Str("cert_dir", cw.dir).Msg("watching certificate directory")
+	go cw.watchLoop(w)
+}
+
+func (cw *CertWatcher) watchLoop(w *fsnotify.Watcher) {
+	defer w.Close()
+	var due <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == filepath.Clean(cw.dir) && event.Has(fsnotify.Remove|fsnotify.Rename) {
+				// The watch ends with the directory; fall back to checking
+				// on handshakes.
+				cw.watching.Store(false)
+				cw.log.Warn().Str("cert_dir", cw.dir).Msg("certificate directory removed, checking files on every handshake")
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			cw.log.Debug().Str("file", event.Name).Stringer("op", event.Op).Msg("certificate directory changed")
+			due = time.After(watchDebounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			cw.log.Warn().Err(err).Str("cert_dir", cw.dir).Msg("certificate directory watch failed")
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				due = time.After(watchDebounce)
+			}
+		case <-due:
+			due = nil
+			cw.refresh()
+		case <-cw.stop:
+			return
+		}
+	}
+}
+
+// refresh reloads the default pair and the pairs selected by SNI whose
+// files changed, and picks up added and removed pairs.
+func (cw *CertWatcher) refresh() {
+	cw.maybeReload()
+	for _, pair := range cw.sni.list() {
+		pair.maybeReload()
+	}
+	cw.scan()
+}
@@ -0,0 +1,113 @@
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// writeVolume writes cert and key into a new timestamped directory of dir
+// and swaps the ..data symlink to it, as the Kubernetes atomic writer does.
+// The files keep mtime, so only their identity changes.
+func writeVolume(t *testing.T, dir, name string, cert *testCert, mtime time.Time) {
+	t.Helper()
+	data := filepath.Join(dir, name)
+	if err := os.Mkdir(data, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(cert.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(data, "server.crt"), "CERTIFICATE", cert.cert.Raw)
+	writePEM(t, filepath.Join(data, "server.key"), "EC PRIVATE KEY", keyDER)
+	for _, file := range []string{"server.crt", "server.key"} {
+		if err := os.Chtimes(filepath.Join(data, file), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(name, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertWatcherFileWatch(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	first := issue(t, &x509.Certificate{DNSNames: []string{"ext-proc"}}, ca)
+	writeVolume(t, dir, "..2024_01", first, mtime)
+	for _, file := range []string{"server.crt", "server.key"} {
+		if err := os.Symlink(filepath.Join("..data", file), filepath.Join(dir, file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cw, err := NewCertWatcher(dir, zerolog.Nop(), WithFileWatch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Close()
+	if !cw.watching.Load() {
+		t.Fatal("directory is not watched")
+	}
+
+	second := issue(t, &x509.Certificate{DNSNames: []string{"ext-proc"}}, ca)
+	writeVolume(t, dir, "..2024_02", second, mtime)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := cw.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(got.Certificate[0], second.cert.Raw) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("swapped certificate not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileStampChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.crt")
+	mtime := time.Now().Add(-time.Hour)
+	write := func() {
+		t.Helper()
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte("cert"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(tmp, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cw := &CertWatcher{certFile: path}
+	write()
+	old, err := cw.stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, _ := cw.stat(); same.changedFrom(old) {
+		t.Error("unchanged file reported as changed")
+	}
+	write()
+	if replaced, _ := cw.stat(); !replaced.changedFrom(old) {
+		t.Error("replaced file with the same mtime not reported as changed")
+	}
+}
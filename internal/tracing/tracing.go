@@ -0,0 +1,153 @@
+// Package tracing sets up OpenTelemetry tracing exported over OTLP.
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Export protocols.
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+)
+
+// Propagator names.
+const (
+	PropagatorTraceContext = "tracecontext"
+	PropagatorBaggage      = "baggage"
+	PropagatorB3           = "b3"
+)
+
+// Config holds the OTLP exporter and sampling settings.
+type Config struct {
+	// Endpoint is the collector's host:port; tracing is disabled if empty.
+	Endpoint string
+	// Protocol is ProtocolGRPC or ProtocolHTTP.
+	Protocol string
+	// Insecure exports without TLS.
+	Insecure bool
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string
+	// ServiceName defaults to the binary name.
+	ServiceName string
+	// SampleRatio is the fraction of new traces sampled; traces whose
+	// parent was sampled are always sampled.
+	SampleRatio float64
+	// Propagators read trace context from request headers, in order.
+	Propagators []string
+	// Timeout bounds a single export.
+	Timeout time.Duration
+}
+
+// Provider exports the spans of its tracer.
+type Provider struct {
+	tp         *sdktrace.TracerProvider
+	propagator propagation.TextMapPropagator
+}
+
+// New creates a Provider exporting to cfg.Endpoint in batches.
+func New(ctx context.Context, cfg Config) (*Provider, error) {
+	propagator, err := newPropagator(cfg.Propagators)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := newExporter(ctx, cfg)
+	if err != nil {
+		return nil, oops.In("tracing").Code(errcode.ClientInitFailed).
+			With("endpoint", cfg.Endpoint).
+			Wrapf(err, "failed to create OTLP exporter")
+	}
+	name := cfg.ServiceName
+	if name == "" {
+		name = filepath.Base(os.Args[0])
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", name)))
+	if err != nil {
+		return nil, oops.In("tracing").Code(errcode.InvalidConfig).Wrapf(err, "failed to build trace resource")
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	return &Provider{tp: tp, propagator: propagator}, nil
+}
+
+func newExporter(ctx context.Context, cfg Config) (*otlptrace.Exporter, error) {
+	switch cfg.Protocol {
+	case ProtocolGRPC, "":
+		opts := []otlptracegrpc.Option{
+			otlptracegrpc.WithEndpoint(cfg.Endpoint),
+			otlptracegrpc.WithHeaders(cfg.Headers),
+			otlptracegrpc.WithTimeout(cfg.Timeout),
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case ProtocolHTTP:
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(cfg.Endpoint),
+			otlptracehttp.WithHeaders(cfg.Headers),
+			otlptracehttp.WithTimeout(cfg.Timeout),
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, oops.In("tracing").Code(errcode.InvalidConfig).
+			With("protocol", cfg.Protocol).
+			Errorf("unknown OTLP protocol %q", cfg.Protocol)
+	}
+}
+
+func newPropagator(names []string) (propagation.TextMapPropagator, error) {
+	var propagators []propagation.TextMapPropagator
+	for _, name := range names {
+		switch name {
+		case PropagatorTraceContext:
+			propagators = append(propagators, propagation.TraceContext{})
+		case PropagatorBaggage:
+			propagators = append(propagators, propagation.Baggage{})
+		case PropagatorB3:
+			// Extraction accepts both the single and multi header forms.
+			propagators = append(propagators, b3.New())
+		default:
+			return nil, oops.In("tracing").Code(errcode.InvalidConfig).
+				With("propagator", name).
+				Errorf("unknown propagator %q", name)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(propagators...), nil
+}
+
+// Tracer returns the tracer of ext_proc spans.
+func (p *Provider) Tracer() trace.Tracer {
+	return p.tp.Tracer("github.com/mnixry/envoy-ext-procs/internal/extproc")
+}
+
+// Propagator returns the configured propagators.
+func (p *Provider) Propagator() propagation.TextMapPropagator {
+	return p.propagator
+}
+
+// Shutdown exports buffered spans and stops the provider.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	return p.tp.Shutdown(ctx)
+}
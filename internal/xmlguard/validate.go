@@ -0,0 +1,206 @@
+// Package xmlguard checks XML documents for well-formedness and resource
+// limits before they reach parsers that may expand entities or resolve
+// external references, and recognizes SOAP envelopes.
+package xmlguard
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// SOAP envelope namespaces.
+const (
+	NamespaceSOAP11 = "http://schemas.xmlsoap.org/soap/envelope/"
+	NamespaceSOAP12 = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+// Limits bound the resources a document may use; zero disables a limit.
+type Limits struct {
+	// MaxDepth is the deepest element nesting.
+	MaxDepth int
+	// MaxElements is the number of elements in the document.
+	MaxElements int
+	// MaxAttributes is the number of attributes of a single element.
+	MaxAttributes int
+}
+
+// Options control validation.
+type Options struct {
+	Limits
+	// AllowDTD accepts internal document type declarations without entity
+	// declarations. External DTDs and entity declarations are always
+	// refused.
+	AllowDTD bool
+}
+
+// Document describes a valid document.
+type Document struct {
+	// Root is the name of the root element.
+	Root xml.Name
+	// SOAPVersion is "1.1" or "1.2" if the root is a SOAP envelope, with
+	// the header and body in order; empty otherwise.
+	SOAPVersion string
+	// Operation is the first element of a SOAP body, if any.
+	Operation xml.Name
+}
+
+// Validate checks that data is a single well-formed UTF-8 XML document
+// within opts.
+func Validate(data []byte, opts Options) (*Document, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = true
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		if strings.EqualFold(charset, "us-ascii") {
+			return input, nil
+		}
+		return nil, oops.
+			In("xmlguard").
+			Code(errcode.InvalidXML).
+			With("charset", charset).
+			Errorf("unsupported encoding %q", charset)
+	}
+
+	var (
+		doc      Document
+		seenRoot bool
+		depth    int
+		elements int
+		// envelope tracks SOAP structure: the children of the envelope seen
+		// so far and whether the body's first child was recorded.
+		envelope []string
+		inBody   bool
+	)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, invalid(err, "not well-formed")
+		}
+		switch t := tok.(type) {
+		case xml.Directive:
+			if err := checkDirective(t, opts.AllowDTD); err != nil {
+				return nil, err
+			}
+		case xml.StartElement:
+			if depth == 0 && seenRoot {
+				return nil, invalid(nil, "more than one root element")
+			}
+			seenRoot = true
+			depth++
+			elements++
+			if opts.MaxDepth > 0 && depth > opts.MaxDepth {
+				return nil, exceeded("depth", opts.MaxDepth)
+			}
+			if opts.MaxElements > 0 && elements > opts.MaxElements {
+				return nil, exceeded("elements", opts.MaxElements)
+			}
+			if opts.MaxAttributes > 0 && len(t.Attr) > opts.MaxAttributes {
+				return nil, exceeded("attributes", opts.MaxAttributes)
+			}
+			switch {
+			case depth == 1:
+				doc.Root = t.Name
+				doc.SOAPVersion = soapVersion(t.Name)
+			case depth == 2 && doc.SOAPVersion != "":
+				if t.Name.Space != doc.Root.Space {
+					return nil, invalid(nil, "unexpected element "+t.Name.Local+" in SOAP envelope")
+				}
+				envelope = append(envelope, t.Name.Local)
+				inBody = t.Name.Local == "Body"
+			case depth == 3 && inBody && doc.Operation.Local == "":
+				doc.Operation = t.Name
+			}
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(t)) > 0 {
+				return nil, invalid(nil, "text outside the root element")
+			}
+		}
+	}
+	if !seenRoot {
+		return nil, invalid(nil, "no root element")
+	}
+	if doc.SOAPVersion != "" {
+		switch strings.Join(envelope, ",") {
+		case "Body", "Header,Body":
+		default:
+			return nil, invalid(nil, "SOAP envelope must hold an optional Header followed by a Body")
+		}
+	}
+	return &doc, nil
+}
+
+// checkDirective refuses external DTDs, entity declarations and, unless
+// allowed, any DTD. Unknown entity references are already rejected by the
+// strict decoder, so nothing can be expanded.
+func checkDirective(d xml.Directive, allowDTD bool) error {
+	s := string(d)
+	if !strings.HasPrefix(s, "DOCTYPE") {
+		return invalid(nil, "unexpected declaration")
+	}
+	var reason string
+	switch {
+	case strings.Contains(s, "<!ENTITY"):
+		reason = "entity declarations are not allowed"
+	case externalID(s):
+		reason = "external DTDs are not allowed"
+	case !allowDTD:
+		reason = "DTDs are not allowed"
+	default:
+		return nil
+	}
+	return oops.In("xmlguard").Code(errcode.ForbiddenDTD).Errorf("%s", reason)
+}
+
+// externalID reports whether a DOCTYPE declaration names an external
+// subset, i.e. has SYSTEM or PUBLIC before its internal subset.
+func externalID(doctype string) bool {
+	head, _, _ := strings.Cut(doctype, "[")
+	fields := strings.Fields(head)
+	for _, f := range fields {
+		if f == "SYSTEM" || f == "PUBLIC" {
+			return true
+		}
+	}
+	return false
+}
+
+func soapVersion(name xml.Name) string {
+	if name.Local != "Envelope" {
+		return ""
+	}
+	switch name.Space {
+	case NamespaceSOAP11:
+		return "1.1"
+	case NamespaceSOAP12:
+		return "1.2"
+	default:
+		return ""
+	}
+}
+
+func invalid(err error, reason string) error {
+	b := oops.In("xmlguard").Code(errcode.InvalidXML)
+	if err != nil {
+		return b.Wrapf(err, "%s", reason)
+	}
+	return b.Errorf("%s", reason)
+}
+
+func exceeded(limit string, max int) error {
+	return oops.
+		In("xmlguard").
+		Code(errcode.LimitExceeded).
+		With("limit", limit).
+		With("max", max).
+		Errorf("document exceeds the %s limit of %d", limit, max)
+}
@@ -0,0 +1,82 @@
+package xmlguard
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+)
+
+const soap11 = `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:m="urn:orders">
+  <soap:Header><m:Auth>t</m:Auth></soap:Header>
+  <soap:Body><m:GetOrder><m:ID>1</m:ID></m:GetOrder></soap:Body>
+</soap:Envelope>`
+
+const billionLaughs = `<?xml version="1.0"?>
+<!DOCTYPE lolz [
+  <!ENTITY lol "lol">
+  <!ENTITY lol2 "&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;">
+]>
+<lolz>&lol2;</lolz>`
+
+func TestValidate(t *testing.T) {
+	limits := Options{Limits: Limits{MaxDepth: 4, MaxElements: 8, MaxAttributes: 2}}
+	tests := []struct {
+		name string
+		doc  string
+		opts Options
+		code errcode.Code
+	}{
+		{name: "plain", doc: `<a x="1"><b/>text</a>`},
+		{name: "soap", doc: soap11, opts: limits},
+		{name: "not well-formed", doc: `<a><b></a>`, code: errcode.InvalidXML},
+		{name: "unknown entity", doc: `<a>&foo;</a>`, code: errcode.InvalidXML},
+		{name: "two roots", doc: `<a/><b/>`, code: errcode.InvalidXML},
+		{name: "text outside root", doc: `<a/>junk`, code: errcode.InvalidXML},
+		{name: "empty", doc: ` `, code: errcode.InvalidXML},
+		{name: "latin1", doc: `<?xml version="1.0" encoding="ISO-8859-1"?><a/>`, code: errcode.InvalidXML},
+		{name: "billion laughs", doc: billionLaughs, opts: Options{AllowDTD: true}, code: errcode.ForbiddenDTD},
+		{name: "xxe", doc: `<!DOCTYPE a [<!ENTITY x SYSTEM "file:///etc/passwd">]><a>&x;</a>`, opts: Options{AllowDTD: true}, code: errcode.ForbiddenDTD},
+		{name: "external dtd", doc: `<!DOCTYPE a SYSTEM "http://evil.example/a.dtd"><a/>`, opts: Options{AllowDTD: true}, code: errcode.ForbiddenDTD},
+		{name: "dtd refused", doc: `<!DOCTYPE a [<!ELEMENT a EMPTY>]><a/>`, code: errcode.ForbiddenDTD},
+		{name: "dtd allowed", doc: `<!DOCTYPE a [<!ELEMENT a EMPTY>]><a/>`, opts: Options{AllowDTD: true}},
+		{name: "too deep", doc: `<a><a><a><a><a/></a></a></a></a>`, opts: limits, code: errcode.LimitExceeded},
+		{name: "too many elements", doc: "<a>" + strings.Repeat("<b/>", 8) + "</a>", opts: limits, code: errcode.LimitExceeded},
+		{name: "too many attributes", doc: `<a x="1" y="2" z="3"/>`, opts: limits, code: errcode.LimitExceeded},
+		{
+			name: "soap without body",
+			doc:  `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header/></s:Envelope>`,
+			code: errcode.InvalidXML,
+		},
+		{
+			name: "soap body before header",
+			doc:  `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body/><s:Header/></s:Envelope>`,
+			code: errcode.InvalidXML,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Validate([]byte(tt.doc), tt.opts)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if !errcode.Is(err, tt.code) {
+				t.Fatalf("Validate() = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestValidateSOAP(t *testing.T) {
+	doc, err := Validate([]byte(soap11), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.SOAPVersion != "1.1" || doc.Operation.Local != "GetOrder" || doc.Operation.Space != "urn:orders" {
+		t.Errorf("Validate() = %+v", doc)
+	}
+}
@@ -0,0 +1,31 @@
+package extproc
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
+	"github.com/samber/oops"
+)
+
+// HeaderEnvoyExternalAddr is the header Envoy sets to the downstream address
+// of requests from external clients.
+const HeaderEnvoyExternalAddr = "x-envoy-external-address"
+
+// ParseIPFromAddress returns the IP of addr, an IP address with or without
+// a port, e.g. Envoy's source.address attribute.
+func ParseIPFromAddress(addr string) (netip.Addr, error) {
+	ip, errParse := netip.ParseAddr(strings.Trim(addr, "[]"))
+	if errParse == nil {
+		return ip, nil
+	}
+	ap, errParseAddrPort := netip.ParseAddrPort(addr)
+	if errParseAddrPort == nil {
+		return ap.Addr(), nil
+	}
+	return netip.Addr{}, oops.
+		In("extproc").
+		Code(errcode.ParseIPFromAddressFailed).
+		With("addr", addr).
+		Join(errParse, errParseAddrPort)
+}
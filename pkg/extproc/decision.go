@@ -0,0 +1,115 @@
+package extproc
+
+import (
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// DecisionMode controls what a blocking processor does with a request it
+// would reject, so a new policy can be trialed on live traffic before it
+// blocks anything.
+type DecisionMode string
+
+const (
+	// DecisionEnforce rejects the request.
+	DecisionEnforce DecisionMode = "enforce"
+	// DecisionHeaderTag lets the request through with HeaderWouldBlock
+	// added, so the upstream can observe or act on the decision.
+	DecisionHeaderTag DecisionMode = "header-tag-only"
+	// DecisionLogOnly lets the request through unchanged; the decision is
+	// only logged and counted.
+	DecisionLogOnly DecisionMode = "log-only"
+)
+
+// HeaderWouldBlock is added to requests let through by DecisionHeaderTag,
+// one value per skipped rejection, e.g. "jwt-auth; reason=invalid_token".
+// Clients can send it too, so upstreams must not trust it for decisions.
+const HeaderWouldBlock = "x-extproc-would-block"
+
+var decisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "extproc_decisions_total",
+	Help: "Requests a blocking processor decided to reject, by processor, decision mode and reason; only enforce rejects them.",
+}, []string{"processor", "mode", "reason"})
+
+func init() {
+	metrics.Registry.MustRegister(decisionsTotal)
+}
+
+// Decider applies a DecisionMode to the rejections of one processor. The
+// zero Decider enforces.
+type Decider struct {
+	processor string
+	mode      DecisionMode
+	log       zerolog.Logger
+}
+
+// NewDecider creates a Decider for the named processor; log receives the
+// rejections that are not enforced.
+func NewDecider(processor string, mode DecisionMode, log zerolog.Logger) Decider {
+	if mode == "" {
+		mode = DecisionEnforce
+	}
+	return Decider{processor: processor, mode: mode, log: log}
+}
+
+// Mode returns the decision mode.
+func (d Decider) Mode() DecisionMode {
+	if d.mode == "" {
+		return DecisionEnforce
+	}
+	return d.mode
+}
+
+// Enforcing counts a rejection for reason and reports whether it is
+// enforced; rejections that are not are logged.
+func (d Decider) Enforcing(reason string) bool {
+	mode := d.Mode()
+	decisionsTotal.WithLabelValues(d.processor, string(mode), reason).Inc()
+	if mode == DecisionEnforce {
+		return true
+	}
+	d.log.Warn().
+		Str("decision_mode", string(mode)).
+		Str("reason", reason).
+		Msg("request would be rejected")
+	return false
+}
+
+// Reject counts and logs the rejection of request requestID for reason.
+// When enforcing, it returns rejection, the result that rejects the request
+// or otherwise enforces the policy. Otherwise it returns pass, or
+// ContinueResult if pass is nil, tagged with HeaderWouldBlock in
+// DecisionHeaderTag mode; pass should strip headers the processor only sets
+// for accepted requests.
+func (d Decider) Reject(requestID, reason string, rejection, pass *ProcessingResult) *ProcessingResult {
+	mode := d.Mode()
+	decisionsTotal.WithLabelValues(d.processor, string(mode), reason).Inc()
+	if mode == DecisionEnforce {
+		return rejection
+	}
+	event := d.log.Warn().
+		Str("request_id", requestID).
+		Str("decision_mode", string(mode)).
+		Str("reason", reason)
+	if rejection.ImmediateResponse != nil {
+		event = event.Int32("status", int32(rejection.ImmediateResponse.GetStatus().GetCode()))
+	}
+	event.Msg("request would be rejected")
+	if pass == nil {
+		pass = ContinueResult()
+	}
+	if mode == DecisionHeaderTag {
+		if pass.HeaderMutations == nil {
+			pass.HeaderMutations = &HeaderMutations{}
+		}
+		pass.HeaderMutations.SetHeaders = append(pass.HeaderMutations.SetHeaders, d.Tag(reason))
+	}
+	return pass
+}
+
+// Tag returns the HeaderWouldBlock value of a rejection for reason.
+func (d Decider) Tag(reason string) *envoy_api_v3_core.HeaderValueOption {
+	return AppendHeader(HeaderWouldBlock, d.processor+"; reason="+reason)
+}
@@ -0,0 +1,49 @@
+// Package extproc is the public API for writing Envoy external processors
+// on this framework: implement Processor, usually by embedding
+// BaseProcessor and overriding the phases needed, return results built by
+// ContinueResult, ContinueWithHeaders, ContinueWithBody or ImmediateResult,
+// and serve a ProcessorFactory with the server package.
+//
+// The bundled processors are built on the same types, so custom and bundled
+// processors can be combined.
+package extproc
+
+import (
+	"strings"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// HeaderValueOption is a header mutation; see SetHeader and AppendHeader.
+type HeaderValueOption = envoy_api_v3_core.HeaderValueOption
+
+// FactoryFunc is a ProcessorFactory calling a function.
+type FactoryFunc func() Processor
+
+// NewProcessor implements ProcessorFactory.
+func (f FactoryFunc) NewProcessor() Processor {
+	return f()
+}
+
+// SetHeader creates a header value option that overwrites existing headers.
+func SetHeader(key, value string) *HeaderValueOption {
+	return &envoy_api_v3_core.HeaderValueOption{
+		Header: &envoy_api_v3_core.HeaderValue{
+			Key:      strings.ToLower(key),
+			Value:    value,
+			RawValue: []byte(value),
+		},
+		AppendAction: envoy_api_v3_core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}
+}
+
+// AppendHeader creates a header value option that adds a value, keeping any
+// existing ones (e.g. multiple set-cookie headers).
+func AppendHeader(key, value string) *HeaderValueOption {
+	opt := SetHeader(key, value)
+	opt.AppendAction = envoy_api_v3_core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD
+	return opt
+}
+
+// Ensure FactoryFunc implements ProcessorFactory.
+var _ ProcessorFactory = FactoryFunc(nil)
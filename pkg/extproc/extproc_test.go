@@ -0,0 +1,42 @@
+package extproc_test
+
+import (
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/internal/extproc/extproctest"
+	"github.com/mnixry/envoy-ext-procs/pkg/extproc"
+	"github.com/rs/zerolog"
+)
+
+type greeter struct {
+	extproc.BaseProcessor
+	decider extproc.Decider
+}
+
+func (g *greeter) ProcessRequestHeaders(ctx *extproc.RequestContext) *extproc.ProcessingResult {
+	if ctx.Headers.Get("x-name") == "" {
+		return g.decider.Reject(ctx.GetRequestID(), "anonymous", extproc.ImmediateResult(401, nil, nil), nil)
+	}
+	return extproc.ContinueWithHeaders([]*extproc.HeaderValueOption{
+		extproc.SetHeader("x-greeting", "hello "+ctx.Headers.Get("x-name")),
+	})
+}
+
+func TestCustomProcessor(t *testing.T) {
+	for _, mode := range []extproc.DecisionMode{extproc.DecisionEnforce, extproc.DecisionLogOnly} {
+		factory := extproc.FactoryFunc(func() extproc.Processor {
+			return &greeter{decider: extproc.NewDecider("greeter", mode, zerolog.Nop())}
+		})
+		p := factory.NewProcessor()
+
+		extproctest.Check(t, p.ProcessRequestHeaders(extproctest.NewContext(nil, "x-name", "envoy")),
+			extproctest.ExpectHeaderSet("x-greeting", "hello envoy"))
+		anonymous := p.ProcessRequestHeaders(extproctest.NewContext(nil))
+		if mode == extproc.DecisionEnforce {
+			extproctest.Check(t, anonymous, extproctest.ExpectDenied(401))
+		} else {
+			extproctest.Check(t, anonymous, extproctest.ExpectContinue())
+		}
+		extproctest.Check(t, p.ProcessResponseHeaders(extproctest.NewContext(nil)), extproctest.ExpectContinue())
+	}
+}
@@ -0,0 +1,134 @@
+package extproc
+
+import (
+	"sync/atomic"
+
+	"github.com/mnixry/envoy-ext-procs/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	memoryBudgetBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "extproc_memory_budget_bytes",
+		Help: "Configured limit of body bytes buffered across all streams.",
+	})
+	memoryBufferedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "extproc_memory_buffered_bytes",
+		Help: "Body bytes currently buffered across all streams.",
+	})
+	memoryShedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_memory_shed_total",
+		Help: "Buffering requests shed because the memory budget was exceeded, by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(memoryBudgetBytes, memoryBufferedBytes, memoryShedTotal)
+}
+
+// MemoryBudget bounds the body bytes held across all active streams: body
+// messages being processed plus whatever processors reserve for their own
+// buffers. Once exceeded, new streams are switched to passthrough and
+// reservations are refused until usage drops.
+type MemoryBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewMemoryBudget creates a MemoryBudget of limit bytes.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	memoryBudgetBytes.Set(float64(limit))
+	return &MemoryBudget{limit: limit}
+}
+
+// Used returns the bytes currently accounted.
+func (b *MemoryBudget) Used() int64 {
+	return b.used.Load()
+}
+
+// Exceeded reports whether usage has reached the limit.
+func (b *MemoryBudget) Exceeded() bool {
+	return b != nil && b.used.Load() >= b.limit
+}
+
+// Shed reports whether the budget is exceeded, counting a stream switched
+// to passthrough if so. The server calls it for the headers of new streams.
+func (b *MemoryBudget) Shed() bool {
+	if !b.Exceeded() {
+		return false
+	}
+	memoryShedTotal.WithLabelValues("passthrough").Inc()
+	return true
+}
+
+// NewAccount creates the account of a single stream. It returns nil for a
+// nil budget; a nil account accepts every reservation.
+func (b *MemoryBudget) NewAccount() *MemoryAccount {
+	if b == nil {
+		return nil
+	}
+	return &MemoryAccount{budget: b}
+}
+
+func (b *MemoryBudget) add(n int64) int64 {
+	memoryBufferedBytes.Add(float64(n))
+	return b.used.Add(n)
+}
+
+// MemoryAccount tracks the bytes one stream holds against a MemoryBudget.
+// It is safe for concurrent use.
+type MemoryAccount struct {
+	budget *MemoryBudget
+	held   atomic.Int64
+}
+
+// Reserve accounts n bytes a processor is about to buffer. It returns false,
+// accounting nothing, if that would exceed the budget; the processor should
+// then stop buffering (pass the body through, truncate, or reject).
+func (a *MemoryAccount) Reserve(n int64) bool {
+	if a == nil {
+		return true
+	}
+	if a.budget.add(n) > a.budget.limit {
+		a.budget.add(-n)
+		memoryShedTotal.WithLabelValues("reserve").Inc()
+		return false
+	}
+	a.held.Add(n)
+	return true
+}
+
+// Charge accounts n bytes already in memory, regardless of the limit.
+func (a *MemoryAccount) Charge(n int64) {
+	if a == nil {
+		return
+	}
+	a.budget.add(n)
+	a.held.Add(n)
+}
+
+// Release returns n previously reserved or charged bytes.
+func (a *MemoryAccount) Release(n int64) {
+	if a == nil {
+		return
+	}
+	a.held.Add(-n)
+	a.budget.add(-n)
+}
+
+// Held returns the bytes the stream currently accounts.
+func (a *MemoryAccount) Held() int64 {
+	if a == nil {
+		return 0
+	}
+	return a.held.Load()
+}
+
+// Close releases everything the account still holds. The server closes the
+// account of a stream when the stream ends.
+func (a *MemoryAccount) Close() {
+	if a == nil {
+		return
+	}
+	a.budget.add(-a.held.Swap(0))
+}
@@ -0,0 +1,29 @@
+package extproc_test
+
+import (
+	"testing"
+
+	"github.com/mnixry/envoy-ext-procs/pkg/extproc"
+)
+
+func TestMemoryAccountReserve(t *testing.T) {
+	budget := extproc.NewMemoryBudget(10)
+	a, b := budget.NewAccount(), budget.NewAccount()
+	if !a.Reserve(6) {
+		t.Fatal("reservation within the budget refused")
+	}
+	if b.Reserve(5) {
+		t.Fatal("reservation over the budget accepted")
+	}
+	if !b.Reserve(4) || !budget.Exceeded() {
+		t.Fatalf("used %d, want the full budget", budget.Used())
+	}
+	a.Close()
+	if budget.Used() != 4 || a.Held() != 0 {
+		t.Errorf("after close used %d, held %d; want 4, 0", budget.Used(), a.Held())
+	}
+	var nilAccount *extproc.MemoryAccount
+	if !nilAccount.Reserve(1 << 40) {
+		t.Error("nil account refused a reservation")
+	}
+}
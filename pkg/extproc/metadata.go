@@ -0,0 +1,132 @@
+package extproc
+
+import (
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Dynamic metadata namespaces of Envoy filters commonly placed before
+// ext_proc. Envoy only forwards the namespaces listed in the filter's
+// metadata_options.forwarding_namespaces.
+const (
+	MetadataNamespaceJWTAuthn  = "envoy.filters.http.jwt_authn"
+	MetadataNamespaceRateLimit = "envoy.filters.http.ratelimit"
+	MetadataNamespaceExtAuthz  = "envoy.filters.http.ext_authz"
+	MetadataNamespaceRBAC      = "envoy.filters.http.rbac"
+)
+
+// SetMetadata sets key to value in the namespace of the dynamic metadata
+// emitted with r, and returns r. Envoy only accepts namespaces listed in
+// the filter's metadata_options.receiving_namespaces.untyped.
+func (r *ProcessingResult) SetMetadata(namespace, key string, value *structpb.Value) *ProcessingResult {
+	if r.DynamicMetadata == nil {
+		r.DynamicMetadata = &structpb.Struct{}
+	}
+	if r.DynamicMetadata.Fields == nil {
+		r.DynamicMetadata.Fields = make(map[string]*structpb.Value)
+	}
+	ns := r.DynamicMetadata.Fields[namespace].GetStructValue()
+	if ns == nil {
+		ns = &structpb.Struct{}
+		r.DynamicMetadata.Fields[namespace] = structpb.NewStructValue(ns)
+	}
+	if ns.Fields == nil {
+		ns.Fields = make(map[string]*structpb.Value)
+	}
+	ns.Fields[key] = value
+	return r
+}
+
+// FilterMetadata returns the untyped dynamic metadata set under namespace.
+func (c *RequestContext) FilterMetadata(namespace string) (*structpb.Struct, bool) {
+	s, ok := c.Metadata.GetFilterMetadata()[namespace]
+	return s, ok && s != nil
+}
+
+// MetadataValue returns the value at path within the namespace's metadata,
+// descending through nested structs.
+func (c *RequestContext) MetadataValue(namespace string, path ...string) (*structpb.Value, bool) {
+	s, ok := c.FilterMetadata(namespace)
+	if !ok || len(path) == 0 {
+		return nil, false
+	}
+	for _, key := range path[:len(path)-1] {
+		s = s.GetFields()[key].GetStructValue()
+		if s == nil {
+			return nil, false
+		}
+	}
+	v, ok := s.GetFields()[path[len(path)-1]]
+	return v, ok
+}
+
+// MetadataString returns the string at path within the namespace's metadata.
+func (c *RequestContext) MetadataString(namespace string, path ...string) (string, bool) {
+	v, ok := c.MetadataValue(namespace, path...)
+	if !ok {
+		return "", false
+	}
+	s, ok := v.GetKind().(*structpb.Value_StringValue)
+	if !ok {
+		return "", false
+	}
+	return s.StringValue, true
+}
+
+// MetadataNumber returns the number at path within the namespace's metadata.
+func (c *RequestContext) MetadataNumber(namespace string, path ...string) (float64, bool) {
+	v, ok := c.MetadataValue(namespace, path...)
+	if !ok {
+		return 0, false
+	}
+	n, ok := v.GetKind().(*structpb.Value_NumberValue)
+	if !ok {
+		return 0, false
+	}
+	return n.NumberValue, true
+}
+
+// MetadataBool returns the boolean at path within the namespace's metadata.
+func (c *RequestContext) MetadataBool(namespace string, path ...string) (bool, bool) {
+	v, ok := c.MetadataValue(namespace, path...)
+	if !ok {
+		return false, false
+	}
+	b, ok := v.GetKind().(*structpb.Value_BoolValue)
+	if !ok {
+		return false, false
+	}
+	return b.BoolValue, true
+}
+
+// TypedMetadata unmarshals the typed dynamic metadata set under namespace
+// into m. It reports false if the namespace is absent or holds another type.
+func (c *RequestContext) TypedMetadata(namespace string, m proto.Message) bool {
+	a, ok := c.Metadata.GetTypedFilterMetadata()[namespace]
+	return ok && a.UnmarshalTo(m) == nil
+}
+
+// JWTPayload returns the verified JWT payload the jwt_authn filter stored
+// under payloadKey (the provider's payload_in_metadata).
+func (c *RequestContext) JWTPayload(payloadKey string) (map[string]any, bool) {
+	v, ok := c.MetadataValue(MetadataNamespaceJWTAuthn, payloadKey)
+	if !ok || v.GetStructValue() == nil {
+		return nil, false
+	}
+	return v.GetStructValue().AsMap(), true
+}
+
+// JWTClaim returns a string claim of the payload stored under payloadKey.
+func (c *RequestContext) JWTClaim(payloadKey, claim string) (string, bool) {
+	return c.MetadataString(MetadataNamespaceJWTAuthn, payloadKey, claim)
+}
+
+// RateLimitMetadata returns the dynamic metadata the rate limit service
+// attached to its response, such as hit counts or the matched descriptor.
+func (c *RequestContext) RateLimitMetadata() (map[string]any, bool) {
+	s, ok := c.FilterMetadata(MetadataNamespaceRateLimit)
+	if !ok {
+		return nil, false
+	}
+	return s.AsMap(), true
+}
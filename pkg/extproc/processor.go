@@ -5,25 +5,39 @@ import (
 	"net/netip"
 
 	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_ext_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
 	envoy_service_proc_v3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	envoy_type_v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/mnixry/envoy-ext-procs/internal/errcode"
 	"github.com/samber/oops"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
-const envoyAttributesKey = "envoy.filters.http.ext_proc"
+// EnvoyAttributesKey is the attributes namespace Envoy uses for ext_proc.
+const EnvoyAttributesKey = "envoy.filters.http.ext_proc"
 
 // RequestContext provides context for processing a single request phase.
 type RequestContext struct {
 	// Attributes from Envoy (e.g., source.address, request metadata).
 	Attributes map[string]*structpb.Struct
-	// Headers parsed into http.Header for convenience.
+	// Metadata is the dynamic metadata of earlier filters in the chain, for
+	// the namespaces listed in the filter's metadata_options.
+	Metadata *envoy_api_v3_core.Metadata
+	// Headers parsed into http.Header for convenience. In trailer phases it
+	// holds the trailers.
 	Headers http.Header
 	// EndOfStream indicates if this is the final message for this phase.
 	EndOfStream bool
+	// Request is the 0-based position of the request on the stream.
+	Request int
+	// Memory is the stream's share of the memory budget. Processors
+	// reserve bytes they keep beyond the current message. It is nil, and
+	// accepts every reservation, when no budget is configured.
+	Memory *MemoryAccount
 }
 
 func (c *RequestContext) GetEnvoyAttributeValue(key string) (*structpb.Value, bool) {
-	if attr, ok := c.Attributes[envoyAttributesKey]; ok {
+	if attr, ok := c.Attributes[EnvoyAttributesKey]; ok {
 		if field, ok := attr.Fields[key]; ok {
 			return field, true
 		}
@@ -45,9 +59,19 @@ func (c *RequestContext) GetDownstreamRemoteIP() (netip.Addr, error) {
 	return netip.Addr{}, oops.
 		With("attrs", c.Attributes).
 		With("headers", c.Headers).
+		Code(errcode.MissingAttribute).
 		New("downstream remote IP not found")
 }
 
+// Cookie returns the named cookie from the request headers.
+func (c *RequestContext) Cookie(name string) (*http.Cookie, bool) {
+	if c.Headers == nil {
+		return nil, false
+	}
+	cookie, err := (&http.Request{Header: http.Header{"Cookie": c.Headers.Values("cookie")}}).Cookie(name)
+	return cookie, err == nil
+}
+
 func (c *RequestContext) GetRequestID() string {
 	if value, ok := c.GetEnvoyAttributeValue("request.id"); ok {
 		return value.GetStringValue()
@@ -72,6 +96,20 @@ type ProcessingResult struct {
 	HeaderMutations *HeaderMutations
 	// ImmediateResponse, if non-nil, sends an immediate response to the client.
 	ImmediateResponse *envoy_service_proc_v3.ImmediateResponse
+	// ClearRouteCache asks Envoy to recompute the route after the mutations,
+	// for processors whose headers drive routing.
+	ClearRouteCache bool
+	// BodyMutation, if non-nil, replaces or clears the body chunk being
+	// processed. It is only honored in body phases.
+	BodyMutation *envoy_service_proc_v3.BodyMutation
+	// ModeOverride, if non-nil, changes the processing mode for the rest of
+	// the stream. Envoy honors it only in request headers responses and only
+	// when allow_mode_override is enabled on the filter.
+	ModeOverride *envoy_extensions_ext_proc_v3.ProcessingMode
+	// DynamicMetadata, if non-nil, is emitted as dynamic metadata for later
+	// filters, access logs and rate limit descriptors. Its top-level fields
+	// are namespaces; see SetMetadata.
+	DynamicMetadata *structpb.Struct
 }
 
 // ContinueResult returns a ProcessingResult that continues processing.
@@ -91,6 +129,33 @@ func ContinueWithHeaders(setHeaders []*envoy_api_v3_core.HeaderValueOption) *Pro
 	}
 }
 
+// ContinueWithBody returns a ProcessingResult that continues with the body
+// chunk replaced by body.
+func ContinueWithBody(body []byte) *ProcessingResult {
+	return &ProcessingResult{
+		Status: envoy_service_proc_v3.CommonResponse_CONTINUE,
+		BodyMutation: &envoy_service_proc_v3.BodyMutation{
+			Mutation: &envoy_service_proc_v3.BodyMutation_Body{Body: body},
+		},
+	}
+}
+
+// ImmediateResult returns a ProcessingResult that stops processing and sends
+// the given status, headers and body to the client.
+func ImmediateResult(status int, headers []*envoy_api_v3_core.HeaderValueOption, body []byte) *ProcessingResult {
+	resp := &envoy_service_proc_v3.ImmediateResponse{
+		Status: &envoy_type_v3.HttpStatus{Code: envoy_type_v3.StatusCode(status)},
+		Body:   body,
+	}
+	if len(headers) > 0 {
+		resp.Headers = &envoy_service_proc_v3.HeaderMutation{SetHeaders: headers}
+	}
+	return &ProcessingResult{
+		Status:            envoy_service_proc_v3.CommonResponse_CONTINUE,
+		ImmediateResponse: resp,
+	}
+}
+
 // Processor defines the interface for handling ext_proc requests.
 // Each method handles a specific phase of the request/response lifecycle.
 // Implementations can maintain state across phases within a single request.
@@ -118,6 +183,53 @@ type Processor interface {
 	ProcessResponseTrailers(ctx *RequestContext) *ProcessingResult
 }
 
+// StreamEndHandler is implemented by processors that must release resources
+// when the ext_proc stream ends, including client aborts and upstream resets
+// where no end-of-stream message is ever received. OnStreamEnd is called once
+// and may run concurrently with in-flight phase handlers.
+type StreamEndHandler interface {
+	OnStreamEnd()
+}
+
+// RequestEndHandler is implemented by processors that reset their
+// per-request state themselves. A stream may carry several requests one
+// after another; OnRequestEnd is called when the next request starts, after
+// every handler of the previous one returned, and once more when the stream
+// ends, right before OnStreamEnd; like OnStreamEnd, that last call may run
+// concurrently with in-flight phase handlers. Processors without it get a
+// fresh instance for every request, and the previous instance gets
+// OnStreamEnd once its handlers returned.
+type RequestEndHandler interface {
+	OnRequestEnd()
+}
+
+// Phase is a set of ext_proc processing phases.
+type Phase uint8
+
+const (
+	PhaseRequestHeaders Phase = 1 << iota
+	PhaseRequestBody
+	PhaseRequestTrailers
+	PhaseResponseHeaders
+	PhaseResponseBody
+	PhaseResponseTrailers
+)
+
+// PhaseAware is implemented by processors that handle only some phases,
+// e.g. request headers only. The server answers the other phases with
+// CONTINUE itself, without building a RequestContext or calling the
+// processor, which is most of the per-message cost of such processors.
+type PhaseAware interface {
+	Phases() Phase
+}
+
+// Named is implemented by processors that choose the name they are
+// reported under, as the processor label of metrics, logs and trace spans.
+// Other processors are named after their package.
+type Named interface {
+	Name() string
+}
+
 // ProcessorFactory creates new Processor instances for each incoming request stream.
 // This allows processors to maintain per-request state.
 type ProcessorFactory interface {
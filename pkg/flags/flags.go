@@ -0,0 +1,136 @@
+// Package flags defines the command-line flags shared by every processor
+// command, for embedding in kong CLI structs; see the server package.
+package flags
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// GRPC holds gRPC server configuration.
+type GRPC struct {
+	Port          int    `name:"port" env:"PORT" default:"9002" help:"gRPC server listen port."`
+	CertPath      string `name:"cert-path" env:"CERT_PATH" type:"path" xor:"grpc-tls" required:"" help:"Path to directory containing server.crt and server.key, or a server.p12 bundle, for TLS."`
+	Insecure      bool   `name:"insecure" env:"INSECURE" xor:"grpc-tls" required:"" help:"Serve gRPC in plaintext without --grpc-cert-path; only for development or when a sidecar terminates mTLS."`
+	CAFile        string `name:"ca-file" env:"CA_FILE" type:"path" help:"CA bundle, or directory of .pem/.crt/.cer files, verifying the health check dial; reloaded when changed."`
+	MemoryBudget  int    `name:"memory-budget" env:"MEMORY_BUDGET" default:"0" help:"Megabytes of body data buffered across all streams before new streams are switched to passthrough (0 disables)."`
+	RouteKey      string `name:"route-key" env:"ROUTE_KEY" default:":authority" help:"gRPC metadata key used to select per-policy processor settings."`
+	Dispatch      string `name:"dispatch" env:"DISPATCH" enum:"ordered,sequential,unordered" default:"ordered" help:"How messages of a stream are handled: concurrently with responses sent in order (ordered), one at a time (sequential) or concurrently with responses sent when ready (unordered)."`
+	DispatchQueue int    `name:"dispatch-queue" env:"DISPATCH_QUEUE" default:"64" help:"Messages of a stream queued or in flight before the server stops reading from it."`
+
+	PhaseTimeout       time.Duration `name:"phase-timeout" env:"PHASE_TIMEOUT" default:"0" help:"Time the processor may spend on a message before it is answered with the --grpc-phase-timeout-policy fallback; keep it below Envoy's message_timeout (0 disables)."`
+	PhaseTimeoutPolicy string        `name:"phase-timeout-policy" env:"PHASE_TIMEOUT_POLICY" enum:"auto,continue,deny" default:"auto" help:"Fallback of messages overrunning --grpc-phase-timeout: let them through unchanged (continue) or answer 504 (deny); auto denies for processors that reject requests in enforce mode and continues for others."`
+
+	CertExpiryWarn  []time.Duration `name:"cert-expiry-warn" env:"CERT_EXPIRY_WARN" default:"720h,168h,24h" help:"Lead times before certificate expiry at which a warning is logged."`
+	CertExpiryCheck time.Duration   `name:"cert-expiry-check" env:"CERT_EXPIRY_CHECK" default:"1m" help:"Interval of certificate expiry checks, which also pick up rotated files (0 disables)."`
+	CertWatch       bool            `name:"cert-watch" env:"CERT_WATCH" default:"true" negatable:"" help:"Watch certificate directories for changes, including symlink swaps of Kubernetes volumes, instead of checking the files on every handshake; --grpc-cert-expiry-check remains as a fallback rescan."`
+	CertExpired     string          `name:"cert-expired" env:"CERT_EXPIRED" enum:"serve,reject" default:"serve" help:"Once the certificate has expired: keep serving it while logging errors (serve) or fail handshakes (reject)."`
+
+	KeyPassphrase     string `name:"key-passphrase" env:"KEY_PASSPHRASE" xor:"key-passphrase" help:"Passphrase of an encrypted server.key or of server.p12."`
+	KeyPassphraseFile string `name:"key-passphrase-file" env:"KEY_PASSPHRASE_FILE" xor:"key-passphrase" help:"File or 'secret://[namespace/]name/key' reference holding the key passphrase, re-read on every certificate reload."`
+
+	ClientCAFile           string   `name:"client-ca-file" env:"CLIENT_CA_FILE" type:"path" help:"CA bundle, or directory of .pem/.crt/.cer files, verifying client certificates of Envoy; reloaded when changed. Enables mTLS."`
+	ClientAuth             string   `name:"client-auth" env:"CLIENT_AUTH" enum:"require,optional" default:"require" help:"With --grpc-client-ca-file: require a verified client certificate (require) or verify one only if presented (optional)."`
+	ClientAllowedSANs      []string `name:"client-allowed-sans" env:"CLIENT_ALLOWED_SANS" help:"DNS names ('*.' covers one label), IPs, emails or URIs one of which a client certificate must hold."`
+	ClientAllowedSPIFFEIDs []string `name:"client-allowed-spiffe-ids" env:"CLIENT_ALLOWED_SPIFFE_IDS" help:"SPIFFE IDs a client certificate may have; a trailing '/*' allows every ID below."`
+
+	OCSPStaple           bool          `name:"ocsp-staple" env:"OCSP_STAPLE" help:"Staple an OCSP response for the server certificate; server.crt must include the issuer."`
+	ClientCRLFiles       []string      `name:"client-crl-files" env:"CLIENT_CRL_FILES" type:"path" help:"PEM or DER CRLs checked against client certificates, reloaded when modified."`
+	ClientCRLFetch       bool          `name:"client-crl-fetch" env:"CLIENT_CRL_FETCH" help:"Fetch CRLs from the HTTP distribution points of client certificates."`
+	ClientOCSP           bool          `name:"client-ocsp" env:"CLIENT_OCSP" help:"Check client certificates with their OCSP responders."`
+	ClientRevocationFail string        `name:"client-revocation-fail" env:"CLIENT_REVOCATION_FAIL" enum:"soft,hard" default:"soft" help:"When a client certificate's revocation status is unknown: accept it (soft) or fail the handshake (hard)."`
+	RevocationTimeout    time.Duration `name:"revocation-timeout" env:"REVOCATION_TIMEOUT" default:"5s" help:"Timeout of a single OCSP or CRL request."`
+	RevocationCacheTTL   time.Duration `name:"revocation-cache-ttl" env:"REVOCATION_CACHE_TTL" default:"1h" help:"Maximum time OCSP responses and fetched CRLs are cached."`
+}
+
+// Health holds health check server configuration.
+type Health struct {
+	Port              int           `name:"port" env:"PORT" default:"8080" help:"Health check HTTP server listen port."`
+	DialServerName    string        `name:"dial-server-name" env:"DIAL_SERVER_NAME" default:"grpc-ext-proc.envoygateway" help:"TLS server name for health check gRPC dial."`
+	DialCertPath      string        `name:"dial-cert-path" env:"DIAL_CERT_PATH" type:"path" help:"Directory with server.crt and server.key, or server.p12, presented as client certificate by the health check under gRPC mTLS; defaults to the served certificate."`
+	DialSPKIPins      []string      `name:"dial-spki-pins" env:"DIAL_SPKI_PINS" help:"Base64 SHA-256 SPKI digests ('sha256//' prefix optional), one of which the gRPC server's chain must hold for health checks."`
+	ReadTimeout       time.Duration `name:"read-timeout" env:"READ_TIMEOUT" default:"5s" help:"Maximum duration for reading an entire HTTP request."`
+	ReadHeaderTimeout time.Duration `name:"read-header-timeout" env:"READ_HEADER_TIMEOUT" default:"2s" help:"Maximum duration for reading HTTP request headers."`
+	WriteTimeout      time.Duration `name:"write-timeout" env:"WRITE_TIMEOUT" default:"10s" help:"Maximum duration before timing out writes of an HTTP response."`
+	IdleTimeout       time.Duration `name:"idle-timeout" env:"IDLE_TIMEOUT" default:"60s" help:"Maximum time to wait for the next request on keep-alive connections."`
+	MaxHeaderBytes    int           `name:"max-header-bytes" env:"MAX_HEADER_BYTES" default:"16384" help:"Maximum size in bytes of HTTP request headers."`
+	CertPath          string        `name:"cert-path" env:"CERT_PATH" type:"path" help:"Path to directory containing server.crt and server.key, or server.p12, to serve HTTPS (optional)."`
+}
+
+// Admin holds settings for the admin API served on the health listener.
+type Admin struct {
+	RecentMessages    int      `name:"recent-messages" env:"RECENT_MESSAGES" default:"0" help:"Number of recent ext_proc message pairs kept for /admin/messages (0 disables)."`
+	RecentRedact      []string `name:"recent-redact-headers" env:"RECENT_REDACT_HEADERS" default:"cookie,set-cookie,authorization,proxy-authorization" help:"Headers redacted in recorded messages."`
+	RecentIncludeBody bool     `name:"recent-include-body" env:"RECENT_INCLUDE_BODY" default:"false" help:"Keep request/response bodies in recorded messages."`
+
+	WatchdogInterval      time.Duration `name:"watchdog-interval" env:"WATCHDOG_INTERVAL" default:"30s" help:"Interval of leak checks on streams, goroutines and queues; the stream table is served at /admin/streams (0 disables)."`
+	WatchdogStaleAfter    time.Duration `name:"watchdog-stale-after" env:"WATCHDOG_STALE_AFTER" default:"5m" help:"Report streams without a message for this long (0 disables)."`
+	WatchdogGrowthSamples int           `name:"watchdog-growth-samples" env:"WATCHDOG_GROWTH_SAMPLES" default:"10" help:"Report goroutine, stream and queue counts growing for this many consecutive checks (0 disables)."`
+	WatchdogMaxGoroutines int           `name:"watchdog-max-goroutines" env:"WATCHDOG_MAX_GOROUTINES" default:"0" help:"Report whenever the process runs more goroutines (0 disables)."`
+
+	ChangeHistory    int      `name:"change-history" env:"CHANGE_HISTORY" default:"100" help:"Number of runtime configuration changes kept for /admin/changes (0 keeps none; changes are still logged)."`
+	ChangeRedactKeys []string `name:"change-redact-keys" env:"CHANGE_REDACT_KEYS" default:"password,passphrase,secret,token,credential,private_key,api_key,apikey,cookie,authorization" help:"Key fragments whose values are redacted in logged and kept configuration diffs."`
+
+	Token        string `name:"token" env:"TOKEN" help:"Bearer token admitting state-changing admin requests, e.g. PUT /admin/bluegreen; without it or --admin-client-ca-file they are only accepted from loopback."`
+	ClientCAFile string `name:"client-ca-file" env:"CLIENT_CA_FILE" type:"path" help:"CA bundle, or directory of .pem/.crt/.cer files, verifying client certificates that admit state-changing admin requests; reloaded when changed, needs --health-cert-path."`
+}
+
+// Metrics holds Prometheus metrics settings.
+type Metrics struct {
+	Enabled      bool     `name:"enabled" env:"ENABLED" default:"true" negatable:"" help:"Serve Prometheus metrics at /metrics on the health listener."`
+	PathPatterns []string `name:"path-patterns" env:"PATH_PATTERNS" help:"Route templates used as path labels, e.g. '/users/{id},/orders/{id}/items/{item}'."`
+	OpenAPIFile  string   `name:"openapi-file" env:"OPENAPI_FILE" type:"existingfile" help:"OpenAPI document whose paths are used as route templates."`
+	Heuristics   bool     `name:"path-heuristics" env:"PATH_HEURISTICS" default:"true" negatable:"" help:"Replace ID-like segments of unmatched paths with {id}."`
+	MaxPaths     int      `name:"max-paths" env:"MAX_PATHS" default:"500" help:"Maximum distinct route templates before paths are reported as {other} (0 disables)."`
+
+	Tracing Tracing `embed:"" prefix:"tracing-" envprefix:"TRACING_"`
+}
+
+// Tracing holds OpenTelemetry tracing settings.
+type Tracing struct {
+	Endpoint    string            `name:"endpoint" env:"ENDPOINT" help:"OTLP collector host:port spans of processed messages are exported to (empty disables tracing)."`
+	Protocol    string            `name:"protocol" env:"PROTOCOL" enum:"grpc,http" default:"grpc" help:"OTLP transport: 'grpc' or 'http' (protobuf)."`
+	Insecure    bool              `name:"insecure" env:"INSECURE" help:"Export without TLS."`
+	Headers     map[string]string `name:"headers" env:"HEADERS" help:"Headers sent with every export, e.g. 'authorization=Bearer abc'."`
+	ServiceName string            `name:"service-name" env:"SERVICE_NAME" help:"Service name of exported spans (default: the binary name)."`
+	SampleRatio float64           `name:"sample-ratio" env:"SAMPLE_RATIO" default:"1" help:"Fraction of traces without a sampled parent that are recorded."`
+	Propagators []string          `name:"propagators" env:"PROPAGATORS" enum:"tracecontext,baggage,b3" default:"tracecontext,baggage,b3" help:"Trace context formats read from request headers: 'tracecontext' (W3C), 'baggage' and 'b3' (single or multi header)."`
+	Timeout     time.Duration     `name:"timeout" env:"TIMEOUT" default:"10s" help:"Timeout of a single export."`
+}
+
+// Decision selects what a blocking processor does with the requests
+// it would reject.
+type Decision struct {
+	Mode string `name:"mode" env:"MODE" enum:"enforce,header-tag-only,log-only" default:"enforce" help:"Reject requests (enforce), let them through tagged with an x-extproc-would-block header (header-tag-only) or let them through and only log and count the decision (log-only); for trialing a policy before it blocks traffic."`
+}
+
+// LogFormat is the encoding of log lines.
+type LogFormat string
+
+const (
+	LogFormatJSON    LogFormat = "json"
+	LogFormatConsole LogFormat = "console"
+)
+
+// Log holds logging configuration.
+type Log struct {
+	Level      zerolog.Level `name:"level" env:"LEVEL" default:"info" help:"Log level (trace, debug, info, warn, error, fatal, panic)."`
+	Output     string        `name:"output" env:"OUTPUT" default:"stdout" help:"Log output location: 'stdout', 'stderr', or a file path."`
+	Format     LogFormat     `name:"format" env:"FORMAT" default:"json" enum:"json,console" help:"Log format: 'json' or 'console'."`
+	MaxSize    int           `name:"max-size" env:"MAX_SIZE" default:"100" help:"Max size in MB before log rotation (0 disables rotation)."`
+	MaxAge     int           `name:"max-age" env:"MAX_AGE" default:"30" help:"Max age in days to retain old log files (0 keeps all)."`
+	MaxBackups int           `name:"max-backups" env:"MAX_BACKUPS" default:"10" help:"Max number of old log files to retain (0 keeps all)."`
+	Compress   bool          `name:"compress" env:"COMPRESS" default:"true" help:"Compress rotated log files with gzip."`
+
+	Sentry Sentry `embed:"" prefix:"sentry-" envprefix:"SENTRY_"`
+}
+
+// Sentry holds crash reporting configuration.
+type Sentry struct {
+	DSN          string        `name:"dsn" env:"DSN" help:"Sentry (or compatible) DSN panics and error-level log events are reported to (empty disables)."`
+	Environment  string        `name:"environment" env:"ENVIRONMENT" default:"production" help:"Environment tag of reported events."`
+	Release      string        `name:"release" env:"RELEASE" help:"Release tag of reported events (default: the binary name and its module version or VCS revision)."`
+	SampleRate   float64       `name:"sample-rate" env:"SAMPLE_RATE" default:"1" help:"Fraction of error events reported (panics are always reported)."`
+	FlushTimeout time.Duration `name:"flush-timeout" env:"FLUSH_TIMEOUT" default:"2s" help:"Time spent delivering pending events before a crash or fatal exit."`
+}
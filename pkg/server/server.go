@@ -0,0 +1,122 @@
+// Package server runs processors written with the extproc package as an
+// Envoy ext_proc gRPC server, with the flags, TLS, health checks, admin API,
+// metrics and tracing of the bundled processors.
+//
+// A command embeds Flags in its kong CLI struct, next to its own flags:
+//
+//	var cli struct {
+//		Server server.Flags `embed:""`
+//		Header string       `name:"header" default:"x-hello"`
+//	}
+//	server.Parse(&cli, "Adds a header to every request.")
+//	log := cli.Server.Logger()
+//	if err := server.Run(cli.Server, factory, log); err != nil {
+//		log.Fatal().Err(err).Send()
+//	}
+package server
+
+import (
+	"maps"
+	"net/http"
+
+	"github.com/alecthomas/kong"
+	"github.com/mnixry/envoy-ext-procs/internal/config"
+	"github.com/mnixry/envoy-ext-procs/internal/logger"
+	"github.com/mnixry/envoy-ext-procs/internal/server"
+	"github.com/mnixry/envoy-ext-procs/pkg/extproc"
+	"github.com/mnixry/envoy-ext-procs/pkg/flags"
+	"github.com/rs/zerolog"
+)
+
+// Flags are the command-line flags and environment variables shared by
+// every processor: --config, --grpc-*, --health-*, --admin-*, --metrics-*
+// and --log-*.
+type Flags struct {
+	Config kong.ConfigFlag `name:"config" type:"path" placeholder:"FILE" help:"YAML file of flag values keyed by flag name; see the schema subcommand."`
+
+	GRPC    flags.GRPC    `embed:"" prefix:"grpc-" envprefix:"GRPC_"`
+	Health  flags.Health  `embed:"" prefix:"health-" envprefix:"HEALTH_"`
+	Admin   flags.Admin   `embed:"" prefix:"admin-" envprefix:"ADMIN_"`
+	Metrics flags.Metrics `embed:"" prefix:"metrics-" envprefix:"METRICS_"`
+	Log     flags.Log     `embed:"" prefix:"log-" envprefix:"LOG_"`
+}
+
+// DecisionFlags select the decision mode of a blocking processor; embed
+// them with `embed:"" prefix:"decision-" envprefix:"DECISION_"` and pass
+// extproc.DecisionMode(Mode) to extproc.NewDecider.
+type DecisionFlags = flags.Decision
+
+// Parse parses the command line and environment into cli, a pointer to a
+// struct embedding Flags, exiting with usage on errors. The schema
+// subcommand prints the JSON schema of --config files.
+func Parse(cli any, description string) {
+	config.Parse(cli, description)
+}
+
+// Logger returns the logger configured by the --log-* flags.
+func (f *Flags) Logger() zerolog.Logger {
+	return logger.New(f.Log)
+}
+
+// Setting is a security-relevant processor setting reported in the
+// posture summary logged at startup and served at /admin/posture.
+type Setting struct {
+	Name  string
+	Value string
+	// Permissive marks values that let through requests the policy would
+	// reject or weaken a check, such as fail-open or log-only.
+	Permissive bool
+}
+
+// DecisionSetting returns the Setting of a blocking processor's decision
+// mode, permissive unless it enforces.
+func DecisionSetting(mode extproc.DecisionMode) Setting {
+	s := server.DecisionSetting(mode)
+	return Setting{Name: s.Name, Value: s.Value, Permissive: s.Permissive}
+}
+
+// Option configures Run.
+type Option func(*options)
+
+type options struct {
+	posture  []Setting
+	handlers map[string]http.Handler
+}
+
+// WithPosture adds settings to the posture summary.
+func WithPosture(settings ...Setting) Option {
+	return func(o *options) {
+		o.posture = append(o.posture, settings...)
+	}
+}
+
+// WithAdminHandler serves handler on the admin API under pattern, a
+// ServeMux pattern such as "GET /admin/rules".
+func WithAdminHandler(pattern string, handler http.Handler) Option {
+	return func(o *options) {
+		if o.handlers == nil {
+			o.handlers = make(map[string]http.Handler)
+		}
+		o.handlers[pattern] = handler
+	}
+}
+
+// Run serves factory on the gRPC port and the health check and admin API on
+// the health port, blocking until the health check server exits.
+func Run(f Flags, factory extproc.ProcessorFactory, log zerolog.Logger, opts ...Option) error {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	cfg := server.NewConfig(f.GRPC, f.Health, f.Admin, f.Metrics)
+	for _, s := range o.posture {
+		cfg.Posture = append(cfg.Posture, server.PostureSetting{Name: s.Name, Value: s.Value, Permissive: s.Permissive})
+	}
+	if len(o.handlers) > 0 {
+		if cfg.Admin.Handlers == nil {
+			cfg.Admin.Handlers = make(map[string]http.Handler)
+		}
+		maps.Copy(cfg.Admin.Handlers, o.handlers)
+	}
+	return server.Run(cfg, factory, log)
+}
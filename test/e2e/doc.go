@@ -0,0 +1,12 @@
+// Package e2e runs the processors behind a real Envoy: it builds the
+// binaries, starts them with a self-signed certificate next to an upstream
+// echo server, renders testdata/envoy.yaml.tmpl and starts Envoy in Docker
+// (or the binary named by E2E_ENVOY_BIN), then sends requests through it.
+//
+// The suite is behind the e2e build tag and needs Docker with host
+// networking (Linux):
+//
+//	go test -tags e2e ./test/e2e/
+//
+// E2E_ENVOY_IMAGE overrides the Envoy image.
+package e2e
@@ -0,0 +1,443 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+)
+
+const defaultEnvoyImage = "envoyproxy/envoy:v1.34-latest"
+
+// processor is a binary under test.
+type processor struct {
+	Name     string
+	GRPCPort int
+	args     []string
+}
+
+// suite is the running environment shared by the tests.
+type suite struct {
+	dir          string
+	envoyURL     string
+	accessLog    string
+	upstreamHits atomic.Int64
+	cleanups     []func()
+}
+
+var (
+	env      *suite
+	setupErr error
+)
+
+func TestMain(m *testing.M) {
+	env, setupErr = setup()
+	code := m.Run()
+	if env != nil {
+		for i := len(env.cleanups) - 1; i >= 0; i-- {
+			env.cleanups[i]()
+		}
+	}
+	os.Exit(code)
+}
+
+// requireEnv returns the environment, skipping the test when no Envoy is
+// available and failing it when the environment could not be started.
+func requireEnv(t *testing.T) *suite {
+	t.Helper()
+	var skip skipError
+	if errors.As(setupErr, &skip) {
+		t.Skip(skip.Error())
+	}
+	if setupErr != nil {
+		t.Fatalf("e2e environment: %v", setupErr)
+	}
+	return env
+}
+
+type skipError string
+
+func (e skipError) Error() string { return string(e) }
+
+func setup() (*suite, error) {
+	envoyBin := os.Getenv("E2E_ENVOY_BIN")
+	if envoyBin == "" {
+		if _, err := exec.LookPath("docker"); err != nil {
+			return nil, skipError("neither docker nor E2E_ENVOY_BIN is available")
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "ext-procs-e2e-")
+	if err != nil {
+		return nil, err
+	}
+	// Envoy runs as an unprivileged user in its image.
+	if err := os.Chmod(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &suite{dir: dir, accessLog: filepath.Join(dir, "access.log")}
+	s.cleanups = append(s.cleanups, func() {
+		if os.Getenv("E2E_KEEP") == "" {
+			_ = os.RemoveAll(dir)
+		}
+	})
+	if err := s.start(envoyBin); err != nil {
+		for i := len(s.cleanups) - 1; i >= 0; i-- {
+			s.cleanups[i]()
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *suite) start(envoyBin string) error {
+	certDir := filepath.Join(s.dir, "certs")
+	if err := writeCert(certDir); err != nil {
+		return err
+	}
+
+	upstreamPort, err := s.startUpstream()
+	if err != nil {
+		return err
+	}
+
+	// Filters run in this order on requests and in reverse on responses;
+	// the access log comes first so it sees local replies as well.
+	processors := []*processor{
+		{Name: "accesslog", args: []string{"--output-path", s.accessLog}},
+		{Name: "fault-inject", args: []string{"--fault-abort-percent", "100", "--fault-abort-status", "503"}},
+		{Name: "edgeone-real-ip", args: []string{
+			"--edgeone-secret-id", "e2e", "--edgeone-secret-key", "e2e",
+			"--edgeone-api-endpoint", "http://127.0.0.1:1", "--edgeone-timeout", "200ms",
+		}},
+		{Name: "header-policy"},
+	}
+	for _, p := range processors {
+		if err := s.startProcessor(p, certDir); err != nil {
+			return err
+		}
+	}
+
+	listenPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	adminPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	if err := renderEnvoyConfig(filepath.Join(s.dir, "envoy.yaml"), map[string]any{
+		"AdminPort":    adminPort,
+		"ListenPort":   listenPort,
+		"UpstreamPort": upstreamPort,
+		"Processors":   processors,
+	}); err != nil {
+		return err
+	}
+	if err := s.startEnvoy(envoyBin); err != nil {
+		return err
+	}
+	s.envoyURL = "http://127.0.0.1:" + strconv.Itoa(listenPort)
+	return waitReady(fmt.Sprintf("http://127.0.0.1:%d/ready", adminPort), 60*time.Second)
+}
+
+// startUpstream serves the request headers it received as JSON, with
+// headers the header policy is expected to remove.
+func (s *suite) startUpstream() (int, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.upstreamHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Powered-By", "e2e-upstream")
+		w.Header().Set("X-Upstream", "yes")
+		_ = json.NewEncoder(w).Encode(r.Header)
+	})}
+	go func() { _ = srv.Serve(lis) }()
+	s.cleanups = append(s.cleanups, func() { _ = srv.Close() })
+	return lis.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (s *suite) startProcessor(p *processor, certDir string) error {
+	bin := filepath.Join(s.dir, "bin", p.Name)
+	build := exec.Command("go", "build", "-o", bin, "./cmd/"+p.Name)
+	build.Dir = filepath.Join("..", "..")
+	if out, err := build.CombinedOutput(); err != nil {
+		return fmt.Errorf("build %s: %v\n%s", p.Name, err, out)
+	}
+
+	grpcPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	healthPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	p.GRPCPort = grpcPort
+	args := append([]string{
+		"--grpc-port", strconv.Itoa(grpcPort),
+		"--grpc-cert-path", certDir,
+		"--health-port", strconv.Itoa(healthPort),
+		"--log-level", "debug",
+	}, p.args...)
+	if err := s.run(p.Name, bin, args...); err != nil {
+		return err
+	}
+	return waitListening(grpcPort, 30*time.Second)
+}
+
+func (s *suite) startEnvoy(envoyBin string) error {
+	if envoyBin != "" {
+		return s.run("envoy", envoyBin, "-c", filepath.Join(s.dir, "envoy.yaml"), "--log-level", "info")
+	}
+	image := os.Getenv("E2E_ENVOY_IMAGE")
+	if image == "" {
+		image = defaultEnvoyImage
+	}
+	name := "ext-procs-e2e-" + strconv.Itoa(os.Getpid())
+	s.cleanups = append(s.cleanups, func() { _ = exec.Command("docker", "rm", "-f", name).Run() })
+	return s.run("envoy", "docker", "run", "--rm", "--name", name, "--network", "host",
+		"-v", s.dir+":/e2e:ro", image, "-c", "/e2e/envoy.yaml", "--log-level", "info")
+}
+
+// run starts a background process logging to <name>.log in the work
+// directory.
+func (s *suite) run(name, bin string, args ...string) error {
+	logFile, err := os.Create(filepath.Join(s.dir, name+".log"))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		cancel()
+		_ = logFile.Close()
+		return fmt.Errorf("start %s: %w", name, err)
+	}
+	s.cleanups = append(s.cleanups, func() {
+		cancel()
+		_ = cmd.Wait()
+		_ = logFile.Close()
+	})
+	return nil
+}
+
+func writeCert(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "server.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "server.key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+}
+
+func renderEnvoyConfig(path string, data map[string]any) error {
+	tmpl, err := template.ParseFiles(filepath.Join("testdata", "envoy.yaml.tmpl"))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return tmpl.Execute(f, data)
+}
+
+func freePort() (int, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port, nil
+}
+
+func waitListening(port int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second)
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("port %d not listening after %s: %w", port, timeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func waitReady(url string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := http.Get(url)
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("envoy not ready after %s (see envoy.log)", timeout)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// get sends a request through Envoy.
+func (s *suite) get(t *testing.T, path string, headers map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.envoyURL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+// accessLogEntry waits for the access log entry of the request to uri.
+func (s *suite) accessLogEntry(t *testing.T, uri string) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if f, err := os.Open(s.accessLog); err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				var entry map[string]any
+				if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+					continue
+				}
+				if req, ok := entry["request"].(map[string]any); ok && req["uri"] == uri {
+					_ = f.Close()
+					return entry
+				}
+			}
+			_ = f.Close()
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no access log entry for %s in %s", uri, s.accessLog)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestHeaderMutations(t *testing.T) {
+	s := requireEnv(t)
+	resp := s.get(t, "/headers", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	// Request side: the EdgeOne processor marks the untrusted peer.
+	var upstream http.Header
+	if err := json.NewDecoder(resp.Body).Decode(&upstream); err != nil {
+		t.Fatalf("decode upstream echo: %v", err)
+	}
+	if got := upstream.Get("X-Forwarded-From-Edgeone"); got != "no" {
+		t.Errorf("upstream x-forwarded-from-edgeone = %q, want %q", got, "no")
+	}
+	if got := upstream.Get("X-Real-Ip"); got != "127.0.0.1" {
+		t.Errorf("upstream x-real-ip = %q, want 127.0.0.1", got)
+	}
+
+	// Response side: the header policy strips fingerprinting headers.
+	if got := resp.Header.Get("X-Powered-By"); got != "" {
+		t.Errorf("x-powered-by = %q, want it removed", got)
+	}
+	if got := resp.Header.Get("X-Upstream"); got != "yes" {
+		t.Errorf("x-upstream = %q, want it kept", got)
+	}
+}
+
+func TestImmediateResponse(t *testing.T) {
+	s := requireEnv(t)
+	hits := s.upstreamHits.Load()
+	resp := s.get(t, "/abort", map[string]string{"X-Fault-Inject": "1"})
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Fault-Injected"); !strings.Contains(got, "abort") {
+		t.Errorf("x-fault-injected = %q, want it to list the abort", got)
+	}
+	if s.upstreamHits.Load() != hits {
+		t.Error("aborted request reached the upstream")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	s := requireEnv(t)
+	s.get(t, "/logged?e2e=1", map[string]string{"Authorization": "Bearer secret"})
+	s.get(t, "/logged-abort", map[string]string{"X-Fault-Inject": "1"})
+
+	entry := s.accessLogEntry(t, "/logged?e2e=1")
+	if entry["status"] != float64(http.StatusOK) {
+		t.Errorf("status = %v, want 200", entry["status"])
+	}
+	if entry["message"] != "request processed" {
+		t.Errorf("message = %v", entry["message"])
+	}
+	headers, _ := entry["request"].(map[string]any)["headers"].(map[string]any)
+	if auth := fmt.Sprint(headers["Authorization"]); auth != "[REDACTED]" {
+		t.Errorf("logged authorization = %s, want it redacted", auth)
+	}
+
+	aborted := s.accessLogEntry(t, "/logged-abort")
+	if aborted["status"] != float64(http.StatusServiceUnavailable) {
+		t.Errorf("aborted status = %v, want 503", aborted["status"])
+	}
+}